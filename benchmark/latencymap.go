@@ -7,11 +7,14 @@ package benchmark
 import (
 	"sync"
 	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type latencyMapEntry struct {
 	count int
 	dur   time.Duration
+	queue time.Duration
 }
 
 type LatencyMap struct {
@@ -19,6 +22,8 @@ type LatencyMap struct {
 	stats map[string]*latencyMapEntry
 }
 
+var _ = (fuse.TimingMap)((*LatencyMap)(nil))
+
 func NewLatencyMap() *LatencyMap {
 	m := &LatencyMap{}
 	m.stats = make(map[string]*latencyMapEntry)
@@ -48,6 +53,26 @@ func (m *LatencyMap) Add(name string, dt time.Duration) {
 	m.Mutex.Unlock()
 }
 
+// AddTiming implements fuse.TimingMap.
+func (m *LatencyMap) AddTiming(name string, t *fuse.RequestTiming) {
+	m.Mutex.Lock()
+	if e := m.stats[name]; e != nil {
+		e.queue += t.Queue
+	}
+	m.Mutex.Unlock()
+}
+
+// GetQueue returns the total estimated time requests spent in the
+// kernel queue.
+func (m *LatencyMap) GetQueue(name string) time.Duration {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	if l := m.stats[name]; l != nil {
+		return l.queue
+	}
+	return 0
+}
+
 func (m *LatencyMap) Counts() map[string]int {
 	r := make(map[string]int)
 	m.Mutex.Lock()
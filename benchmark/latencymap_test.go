@@ -7,6 +7,8 @@ package benchmark
 import (
 	"testing"
 	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func TestLatencyMap(t *testing.T) {
@@ -18,3 +20,14 @@ func TestLatencyMap(t *testing.T) {
 		t.Errorf("got %v, %d, want 2, 150ms", c, d)
 	}
 }
+
+func TestLatencyMapQueue(t *testing.T) {
+	m := NewLatencyMap()
+	m.Add("foo", 100*time.Millisecond)
+	m.AddTiming("foo", &fuse.RequestTiming{Handler: 100 * time.Millisecond, Queue: 5 * time.Millisecond})
+	m.Add("foo", 100*time.Millisecond)
+	m.AddTiming("foo", &fuse.RequestTiming{Handler: 100 * time.Millisecond, Queue: 7 * time.Millisecond})
+	if got := m.GetQueue("foo"); got != 12*time.Millisecond {
+		t.Errorf("got %v, want 12ms", got)
+	}
+}
@@ -11,14 +11,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path"
 	"runtime/pprof"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func writeMemProfile(fn string, sigs <-chan os.Signal) {
@@ -40,15 +44,108 @@ func writeMemProfile(fn string, sigs <-chan os.Signal) {
 	}
 }
 
+// toggleDebug switches debug output on and off for every signal, so
+// traces can be captured from a live mount.
+func toggleDebug(server *fuse.Server, debug bool, sigs <-chan os.Signal) {
+	for range sigs {
+		debug = !debug
+		log.Printf("debug output: %v", debug)
+		server.SetDebug(debug)
+	}
+}
+
+// serveHandOff passes the mount on to the first process that
+// connects to the socket at path, eg. an upgraded binary started with
+// the same -handoff flag. It returns a function that removes the
+// socket, for when the server exits without a hand-off.
+func serveHandOff(server *fuse.Server, path string) (func(), error) {
+	var mu sync.Mutex
+	var l *net.UnixListener
+	stopped := false
+	// listen returns nil once the server has exited.
+	listen := func() (*net.UnixListener, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return nil, nil
+		}
+		os.Remove(path)
+		var err error
+		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		return l, err
+	}
+	// unlisten closes the listener, which removes the socket.
+	unlisten := func(stop bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = stopped || stop
+		if l != nil {
+			l.Close()
+			l = nil
+		}
+	}
+
+	cur, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := cur.AcceptUnix()
+			if err != nil {
+				mu.Lock()
+				if !stopped {
+					log.Printf("handoff: %v", err)
+				}
+				mu.Unlock()
+				return
+			}
+			// The taking process waits for the hand-off, so it
+			// cannot listen on path before the socket is gone.
+			unlisten(false)
+			err = server.HandOff(conn)
+			conn.Close()
+			if err == nil {
+				log.Printf("handed off the mount")
+				return
+			}
+			log.Printf("handoff: %v", err)
+			if cur, err = listen(); cur == nil {
+				if err != nil {
+					log.Printf("handoff: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	return func() { unlisten(true) }, nil
+}
+
+// mount mounts the file system, or takes it over from the process
+// that listens on the hand-off socket, if any.
+func mount(dir string, root fs.InodeEmbedder, opts *fs.Options, handOff string) (*fuse.Server, error) {
+	if handOff != "" {
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: handOff, Net: "unix"})
+		if err == nil {
+			defer conn.Close()
+			return fs.TakeOver(conn, root, opts)
+		}
+	}
+	return fs.Mount(dir, root, opts)
+}
+
 func main() {
 	log.SetFlags(log.Lmicroseconds)
 	// Scans the arg list and sets up flags
 	debug := flag.Bool("debug", false, "print debugging messages.")
+	debugOps := flag.String("debug-ops", "", "comma-separated opcodes to print debugging messages for, eg. LOOKUP,READ")
 	other := flag.Bool("allow-other", false, "mount with -o allowother.")
 	quiet := flag.Bool("q", false, "quiet")
 	ro := flag.Bool("ro", false, "mount read-only")
+	fds := flag.Bool("fds", false, "make calls relative to a file descriptor per node, rather than by path")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to this file")
 	memprofile := flag.String("memprofile", "", "write memory profile to this file")
+	handOff := flag.String("handoff", "", "take over the mount from the process listening on this socket, and listen on it for the next one")
 	flag.Parse()
 	if flag.NArg() < 2 {
 		fmt.Printf("usage: %s MOUNTPOINT ORIGINAL\n", path.Base(os.Args[0]))
@@ -83,7 +180,11 @@ func main() {
 	}
 
 	orig := flag.Arg(1)
-	loopbackRoot, err := fs.NewLoopbackRoot(orig)
+	newRoot := fs.NewLoopbackRoot
+	if *fds {
+		newRoot = fs.NewLoopbackFdRoot
+	}
+	loopbackRoot, err := newRoot(orig)
 	if err != nil {
 		log.Fatalf("NewLoopbackRoot(%s): %v\n", orig, err)
 	}
@@ -114,10 +215,30 @@ func main() {
 	if !*quiet {
 		opts.Logger = log.New(os.Stderr, "", 0)
 	}
-	server, err := fs.Mount(flag.Arg(0), loopbackRoot, opts)
+	// Give new files the mode that the caller asked for.
+	syscall.Umask(0)
+	server, err := mount(flag.Arg(0), loopbackRoot, opts, *handOff)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
+	if *handOff != "" {
+		stop, err := serveHandOff(server, *handOff)
+		if err != nil {
+			log.Printf("handoff: %v", err)
+		} else {
+			defer stop()
+		}
+	}
+	if *debugOps != "" {
+		server.SetDebugFilter(&fuse.DebugFilter{Opcodes: strings.Split(*debugOps, ",")})
+	}
+	if !*quiet {
+		log.Printf("send SIGUSR2 to %d to toggle debug output", os.Getpid())
+	}
+	debugSig := make(chan os.Signal, 1)
+	signal.Notify(debugSig, syscall.SIGUSR2)
+	go toggleDebug(server, *debug, debugSig)
+
 	if !*quiet {
 		fmt.Println("Mounted!")
 	}
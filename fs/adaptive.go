@@ -0,0 +1,125 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"log"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AdaptiveTimeout sets the entry and attribute timeouts of each node
+// from how often its attributes change, see Options.AdaptiveTimeout.
+// Nodes start out with the Min timeout. Each time the kernel
+// revalidates a node, with LOOKUP or GETATTR, its attributes are
+// compared to the ones it got before. If they have not changed for
+// Stable revalidations in a row, the timeout is doubled, up to Max.
+// If they changed, it drops back to Min. In a tree that rarely
+// changes, the kernel thus caches most nodes for Max, while nodes
+// that change stay close to Min.
+type AdaptiveTimeout struct {
+	// Min is the timeout of nodes that changed recently. It must
+	// be positive.
+	Min time.Duration
+
+	// Max is the longest timeout. It must not be below Min.
+	Max time.Duration
+
+	// Stable is the number of unchanged revalidations after which
+	// the timeout is doubled. If 0, 3 is used.
+	Stable int
+}
+
+const defaultAdaptiveStable = 3
+
+// checkAdaptiveTimeout panics if a is invalid, like the other checks
+// of Options in NewNodeFS.
+func checkAdaptiveTimeout(a *AdaptiveTimeout) {
+	if a == nil {
+		return
+	}
+	if a.Min <= 0 {
+		log.Panicf("AdaptiveTimeout: Min %v must be positive", a.Min)
+	}
+	if a.Max < a.Min {
+		log.Panicf("AdaptiveTimeout: Max %v is below Min %v", a.Max, a.Min)
+	}
+	if a.Stable < 0 {
+		log.Panicf("AdaptiveTimeout: Stable %d must not be negative", a.Stable)
+	}
+}
+
+// attrSig holds the attributes that change when a node changes.
+type attrSig struct {
+	size, mtime, ctime    uint64
+	mtimensec, ctimensec  uint32
+	mode, nlink, uid, gid uint32
+}
+
+func newAttrSig(a *fuse.Attr) attrSig {
+	return attrSig{
+		size:      a.Size,
+		mtime:     a.Mtime,
+		ctime:     a.Ctime,
+		mtimensec: a.Mtimensec,
+		ctimensec: a.Ctimensec,
+		mode:      a.Mode,
+		nlink:     a.Nlink,
+		uid:       a.Uid,
+		gid:       a.Gid,
+	}
+}
+
+func newStatxSig(sx *fuse.Statx) attrSig {
+	return attrSig{
+		size:      sx.Size,
+		mtime:     uint64(sx.Mtime.Sec),
+		ctime:     uint64(sx.Ctime.Sec),
+		mtimensec: sx.Mtime.Nsec,
+		ctimensec: sx.Ctime.Nsec,
+		mode:      uint32(sx.Mode),
+		nlink:     sx.Nlink,
+		uid:       sx.Uid,
+		gid:       sx.Gid,
+	}
+}
+
+// adaptiveState is the AdaptiveTimeout state of a node.
+type adaptiveState struct {
+	sig     attrSig
+	timeout time.Duration
+	stable  int
+}
+
+// adaptiveTimeout records that the kernel was sent attributes with
+// the given signature for n, and returns the timeout to send along.
+func (b *rawBridge) adaptiveTimeout(n *Inode, sig attrSig) time.Duration {
+	a := b.options.AdaptiveTimeout
+	stable := a.Stable
+	if stable == 0 {
+		stable = defaultAdaptiveStable
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := &n.adaptive
+	switch {
+	case s.timeout == 0 || s.sig != sig:
+		s.timeout = a.Min
+		s.stable = 0
+	default:
+		s.stable++
+		if s.stable >= stable {
+			s.stable = 0
+			s.timeout *= 2
+			if s.timeout > a.Max {
+				s.timeout = a.Max
+			}
+		}
+	}
+	s.sig = sig
+	return s.timeout
+}
@@ -40,6 +40,12 @@
 // integer with predefined error codes, where the value 0 (`OK`)
 // should be used to indicate success.
 //
+// The context passed to the operations is canceled if the kernel
+// interrupts the request, eg. because the calling process got
+// SIGINT. Operations that wait for slow backends should pass it on,
+// and return EINTR once it is canceled; ToErrno maps
+// context.Canceled to EINTR.
+//
 // File system concepts
 //
 // The FUSE API is very similar to Linux' internal VFS API for
@@ -127,7 +133,22 @@
 //
 // Locks for networked filesystems are supported through the suite of
 // Getlk, Setlk and Setlkw methods. They alllow locks on regions of
-// regular files.
+// regular files. With fuse.MountOptions.EnableLocks, BSD locks from
+// flock(2) are passed through the same methods, with
+// fuse.FUSE_LK_FLOCK set in the flags. Such a lock covers the whole
+// file, and is dropped with an F_UNLCK Setlk when the file is
+// released.
+//
+// fcntl(2) locks belong to the owner passed to the lock methods, not
+// to the FileHandle they are taken through. For POSIX locks
+// (F_SETLK), the owner is the process, which may use several
+// FileHandles, and processes sharing an open file share its
+// FileHandle. For open file description locks (F_OFD_SETLK), the
+// owner is the open file. The kernel does not say which kind a lock
+// is, so locks should conflict exactly when their owners differ.
+// When a file is flushed, the locks of the flushing owner are
+// dropped with an F_UNLCK Setlk over the whole file, and when it is
+// released, so are the remaining locks taken through it.
 //
 // Parallelism
 //
@@ -202,6 +223,15 @@ type NodeStatfser interface {
 	Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
 }
 
+// Syncfs is called on the root for syncfs(2) on the mount, and
+// should write out all dirty state of the file system. Linux only
+// sends it for virtiofs, see fuse.NewVirtioFSServer; syncfs(2) on a
+// /dev/fuse mount does not reach the file system. If not defined,
+// the kernel stops sending syncfs requests.
+type NodeSyncfser interface {
+	Syncfs(ctx context.Context) syscall.Errno
+}
+
 // Access should return if the caller can access the file with the
 // given mode.  This is used for two purposes: to determine if a user
 // may enter a directory, and to answer to implement the access system
@@ -229,6 +259,17 @@ type NodeGetattrer interface {
 	Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno
 }
 
+// Statx is called for statx(2) calls that ask for fields that
+// Getattr cannot provide, such as the birth time (STATX_BTIME). The
+// flags and mask are those of statx(2); out.Mask should have the
+// fields that were filled in. The library will ensure that Mode and
+// Ino are set correctly, and fills in the defaults of Getattr, such
+// as the size of inline files and st_blocks. If not implemented, the
+// result of Getattr is used.
+type NodeStatxer interface {
+	Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
+}
+
 // SetAttr sets attributes for an Inode.
 type NodeSetattrer interface {
 	Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
@@ -239,6 +280,16 @@ type NodeOnAdder interface {
 	OnAdd(ctx context.Context)
 }
 
+// OnForget is called when this InodeEmbedder goes out of use: the
+// kernel has forgotten it and it has no children, or it was never
+// handed to the kernel, because an existing node with the same
+// StableAttr was used instead. It can release resources that the
+// node holds, such as file descriptors. It is not called for the
+// root.
+type NodeOnForgetter interface {
+	OnForget()
+}
+
 // Getxattr should read data for the given attribute into
 // `dest` and return the number of bytes. If `dest` is too
 // small, it should return ERANGE and the size of the attribute.
@@ -274,7 +325,11 @@ type NodeReadlinker interface {
 }
 
 // Open opens an Inode (of regular file type) for reading. It
-// is optional but recommended to return a FileHandle.
+// is optional but recommended to return a FileHandle. The fuseFlags
+// are fuse.FOPEN_* flags, eg. fuse.FOPEN_KEEP_CACHE to keep the
+// page cache, or fuse.FOPEN_NOFLUSH for handles that need no Flush.
+// With MountOptions.NoOpen, Open is not called, and the file
+// methods of the node get a nil FileHandle.
 type NodeOpener interface {
 	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
@@ -288,6 +343,36 @@ type NodeReader interface {
 	Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 }
 
+// VerifyRead checks the data of a successful read at offset off
+// before it is handed to the kernel, eg. against a hash tree of the
+// file content. If it fails, the read returns EIO, and the failure is
+// counted in Options.ReadVerifyFailures. Reads of passthrough files
+// bypass the server, and are not verified.
+type NodeReadVerifier interface {
+	VerifyRead(ctx context.Context, f FileHandle, off int64, data []byte) syscall.Errno
+}
+
+// NodeInliner is implemented by files that can be read and written
+// as a whole, eg. objects in an object store. With
+// Options.InlineSize, small files are then loaded into memory on
+// open and served from there, so the backend sees one LoadInline and
+// one StoreInline instead of many small reads and writes. Inline
+// files are opened without calling NodeOpener, so LoadInline should
+// do the checks Open would do. The contents are shared by all open
+// files of the node.
+type NodeInliner interface {
+	// LoadInline returns the contents of the file, and a version
+	// that identifies them, eg. an ETag.
+	LoadInline(ctx context.Context) (data []byte, version string, errno syscall.Errno)
+
+	// StoreInline atomically replaces the contents of the file,
+	// and returns their new version. If the stored version is no
+	// longer the given version, the file was changed elsewhere,
+	// and StoreInline should fail with ESTALE. It is called on
+	// flush, fsync and on the last release of a modified file.
+	StoreInline(ctx context.Context, data []byte, version string) (newVersion string, errno syscall.Errno)
+}
+
 // Writes the data into the file handle at given offset. After
 // returning, the data will be reused and may not referenced.
 // The default implementation forwards to the FileHandle.
@@ -296,16 +381,65 @@ type NodeWriter interface {
 }
 
 // Fsync is a signal to ensure writes to the Inode are flushed
-// to stable storage.
+// to stable storage. The flags have fuse.FSYNC_FDATASYNC set for
+// fdatasync(2). Options.FsyncPolicy and NodeFsyncPolicier can change
+// which calls get here, and with what flags.
 type NodeFsyncer interface {
 	Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno
 }
 
+// FsyncPolicy decides what fsync(2) and fdatasync(2) on files, and
+// fsync(2) on directories, make the file system do. See
+// Options.FsyncPolicy.
+type FsyncPolicy uint8
+
+const (
+	// FsyncAsSent passes syncs on to NodeFsyncer and FileFsyncer
+	// as the kernel sends them. This is the default.
+	FsyncAsSent FsyncPolicy = iota
+
+	// FsyncFull passes every sync of a file on as a full fsync,
+	// without fuse.FSYNC_FDATASYNC, for backends that only make
+	// data durable along with its metadata.
+	FsyncFull
+
+	// FsyncMetadata passes syncs of directories on, so that
+	// creates, renames and deletes can be made durable, and
+	// acknowledges syncs of files at once, without making their
+	// data durable.
+	FsyncMetadata
+
+	// FsyncNone acknowledges all syncs at once. Use it for
+	// scratch mounts whose contents may be lost on a crash.
+	FsyncNone
+)
+
+// NodeFsyncPolicier sets the FsyncPolicy of a subtree: the policy of a
+// node is the one of the nearest node, going up from it, whose
+// FsyncPolicy returns true, or Options.FsyncPolicy if there is none.
+type NodeFsyncPolicier interface {
+	FsyncPolicy(ctx context.Context) (FsyncPolicy, bool)
+}
+
+// NodeRangeLockPolicier decides whether the writes to the files of a
+// subtree are serialized by range: the writes, fallocates and
+// copy_file_ranges whose byte ranges overlap, and truncates, which
+// overlap with everything, wait for each other, rather than reaching
+// the node at the same time. Backends that rewrite a file as a whole,
+// such as object stores with whole-object PUT, need this when local
+// processes write the same file concurrently. The setting of a node
+// is the one of the nearest node, going up from it, whose
+// RangeLocking returns ok, or Options.RangeLocking if there is none.
+type NodeRangeLockPolicier interface {
+	RangeLocking(ctx context.Context) (lock bool, ok bool)
+}
+
 // Flush is called for the close(2) call on a file descriptor. In case
 // of a descriptor that was duplicated using dup(2), it may be called
 // more than once for the same FileHandle.  The default implementation
 // forwards to the FileHandle, or if the handle does not support
-// FileFlusher, returns OK.
+// FileFlusher, returns OK. Files opened with fuse.FOPEN_NOFLUSH are
+// not flushed on close, unless the writeback cache is enabled.
 type NodeFlusher interface {
 	Flush(ctx context.Context, f FileHandle) syscall.Errno
 }
@@ -319,8 +453,41 @@ type NodeReleaser interface {
 	Release(ctx context.Context, f FileHandle) syscall.Errno
 }
 
+// OnFirstOpen is called when the Inode goes from having no open
+// files to having one. The `writable` argument reports whether
+// that first open was for writing. Use Inode.OpenCount to inspect
+// the current counts. This can be used to implement caching
+// policies or leases that depend on whether a file is in use.
+type NodeOnFirstOpener interface {
+	OnFirstOpen(ctx context.Context, writable bool)
+}
+
+// OnLastClose is called after the last open file for the Inode is
+// released.
+type NodeOnLastCloser interface {
+	OnLastClose(ctx context.Context)
+}
+
 // Allocate preallocates space for future writes, so they will
-// never encounter ESPACE.
+// never encounter ESPACE. The mode holds the fallocate(2) flags, eg.
+// fuse.FALLOC_FL_KEEP_SIZE, PUNCH_HOLE, ZERO_RANGE, COLLAPSE_RANGE
+// or INSERT_RANGE. Invalid combinations are rejected before Allocate
+// is called, like Linux does; modes the file system does not
+// support should return EOPNOTSUPP.
+//
+// The Linux FUSE driver only passes on KEEP_SIZE and PUNCH_HOLE,
+// and ZERO_RANGE on recent kernels; it fails fallocate(2) with the
+// other modes itself, without sending a request.
+//
+// The size reported by later Getattr calls must reflect the mode:
+// plain allocation and ZERO_RANGE grow the file to off+size unless
+// KEEP_SIZE is set, COLLAPSE_RANGE shrinks it and INSERT_RANGE grows
+// it by size, and PUNCH_HOLE and UNSHARE_RANGE leave it alone. After
+// a successful PUNCH_HOLE, the kernel drops its cached pages in the
+// range; for the other modes, the file system must invalidate them
+// itself if the contents change, see NotifyContent. File systems
+// that keep file contents themselves can use Allocation to report
+// st_blocks.
 type NodeAllocater interface {
 	Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno
 }
@@ -340,6 +507,51 @@ type NodeLseeker interface {
 	Lseek(ctx context.Context, f FileHandle, Off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// Bmap maps block, counted in units of blocksize within the file,
+// to the block on the device that holds it. It is used by FIBMAP
+// and for swap files, and only called for file systems mounted with
+// fuse.MountOptions.BlockDevice. If not defined, returns ENOSYS.
+type NodeBmapper interface {
+	Bmap(ctx context.Context, blocksize uint32, block uint64) (uint64, syscall.Errno)
+}
+
+// SetupMapping maps length bytes of the file at offset into the DAX
+// window of a virtio-fs device at moffset, so the guest can access
+// them directly. flags holds fuse.SETUPMAPPING_FLAG_READ and
+// fuse.SETUPMAPPING_FLAG_WRITE. The node does the mapping itself,
+// through the VMM. f is usually nil, as the kernel does not pass a
+// file handle. If not defined, returns ENOSYS, and the kernel falls back
+// to regular reads and writes.
+type NodeSetupMapper interface {
+	SetupMapping(ctx context.Context, f FileHandle, offset, length, moffset uint64, flags uint64) syscall.Errno
+}
+
+// RemoveMapping unmaps ranges of the DAX window that were mapped
+// with SetupMapping on this node. If not defined, returns ENOSYS.
+type NodeRemoveMapper interface {
+	RemoveMapping(ctx context.Context, mappings []fuse.RemoveMappingOne) syscall.Errno
+}
+
+// Submount returns whether the directory is the root of a submount,
+// which the kernel mounts as a separate file system, with its own
+// st_dev, when it is crossed into. This lets one mount expose several
+// backends that tools like find -xdev or du -x tell apart. It is only
+// consulted for directories, and only has effect on Linux, for
+// virtiofs, with fuse.MountOptions.EnableSubmounts.
+type NodeSubmounter interface {
+	Submount() bool
+}
+
+// Poll reports the poll(2) events that are ready on an open file. If
+// none of the requested events are ready and wakeup is non-nil, the
+// file should keep wakeup, eg. in a PollQueue, and call its Wakeup
+// method once they are. Files that implement neither NodePoller nor
+// FilePoller are always ready for reading and writing. Poll is only
+// called with fuse.MountOptions.EnablePoll.
+type NodePoller interface {
+	Poll(ctx context.Context, f FileHandle, events uint32, wakeup *PollWakeup) (revents uint32, errno syscall.Errno)
+}
+
 // Getlk returns locks that would conflict with the given input
 // lock. If no locks conflict, the output has type L_UNLCK. See
 // fcntl(2) for more information.
@@ -349,8 +561,10 @@ type NodeGetlker interface {
 }
 
 // Setlk obtains a lock on a file, or fail if the lock could not
-// obtained.  See fcntl(2) for more information.  If not defined,
-// returns ENOTSUP
+// obtained.  See fcntl(2) for more information. The lock belongs
+// to owner, see "Locking" above. If flags has fuse.FUSE_LK_FLOCK,
+// it is a flock(2) lock instead, which should conflict with those
+// taken through other FileHandles. If not defined, returns ENOTSUP
 type NodeSetlker interface {
 	Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno
 }
@@ -409,11 +623,26 @@ type NodeLookuper interface {
 // OpenDir opens a directory Inode for reading its
 // contents. The actual reading is driven from ReadDir, so
 // this method is just for performing sanity/permission
-// checks. The default is to return success.
+// checks. The default is to return success. With
+// MountOptions.NoOpendir, Opendir is not called, and each READDIR
+// lists the directory from a fresh DirStream.
 type NodeOpendirer interface {
 	Opendir(ctx context.Context) syscall.Errno
 }
 
+// NodeReaddirCacher decides, when a directory is opened, whether the
+// kernel may cache its listing. Stable directories can return true
+// to have repeated listings answered by the kernel, while dynamic
+// ones, like the entries of /proc, return false so every listing
+// reaches Readdir. The cached listing survives across opens, and is
+// dropped when the kernel sees the directory change: when its mtime
+// changes, when entries are created or removed through the mount,
+// and on NotifyEntry, NotifyDelete or NotifyReaddir. Directories
+// that do not implement this follow Options.CacheReaddir.
+type NodeReaddirCacher interface {
+	ReaddirCache(ctx context.Context) bool
+}
+
 // ReadDir opens a stream of directory entries.
 //
 // Readdir essentiallly returns a list of strings, and it is allowed
@@ -429,6 +658,28 @@ type NodeReaddirer interface {
 	Readdir(ctx context.Context) (DirStream, syscall.Errno)
 }
 
+// NodeReaddirPager lists a directory one page at a time. It suits
+// backends, such as object stores, whose listing API returns a
+// continuation token along with each batch of results: the first
+// READDIR is answered from the first page, rather than from a
+// listing of the entire prefix.
+//
+// ReaddirPage returns the entries following token, which is empty
+// for the first page, and the token of the next page. An empty next
+// token ends the listing.
+//
+// The bridge remembers the directory offset at which each page
+// starts, so a seek back into an open directory resumes from the
+// page containing the offset. Tokens are kept per directory handle,
+// and are discarded when the directory is rewound to offset 0. If
+// Options.MagicEntries is set, seeks restart the listing from the
+// first page.
+//
+// NodeReaddirPager takes precedence over NodeReaddirer.
+type NodeReaddirPager interface {
+	ReaddirPage(ctx context.Context, token string) (entries []fuse.DirEntry, next string, errno syscall.Errno)
+}
+
 // Mkdir is similar to Lookup, but must create a directory entry and Inode.
 // Default is to return EROFS.
 type NodeMkdirer interface {
@@ -461,6 +712,16 @@ type NodeCreater interface {
 	Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
 
+// Tmpfile creates an unnamed regular file in this directory, for
+// open(2) with O_TMPFILE. The node is not added to the tree, and
+// disappears when the kernel forgets it. As it has no parent,
+// Inode.Path reports it as deleted, so its operations should use
+// the file handle rather than a path. Default is to return
+// EOPNOTSUPP.
+type NodeTmpfiler interface {
+	Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
 // Unlink should remove a child from this directory.  If the
 // return status is OK, the Inode is removed as child in the
 // FS tree automatically. Default is to return EROFS.
@@ -477,6 +738,13 @@ type NodeRmdirer interface {
 // Rename should move a child from one directory to a different
 // one. The change is effected in the FS tree if the return status is
 // OK. Default is to return EROFS.
+//
+// The flags are those of renameat2(2): RENAME_NOREPLACE,
+// RENAME_EXCHANGE and RENAME_WHITEOUT. Invalid combinations are
+// rejected before Rename is called. File systems that don't support
+// a flag should return EINVAL. RENAME_WHITEOUT must leave a whiteout
+// (see NewWhiteout) in place of the source, which overlayfs needs to
+// use the file system as its upper layer.
 type NodeRenamer interface {
 	Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno
 }
@@ -512,6 +780,11 @@ type FileGetattrer interface {
 	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 }
 
+// See NodeStatxer.
+type FileStatxer interface {
+	Statx(ctx context.Context, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
+}
+
 // See NodeReader.
 type FileReader interface {
 	Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
@@ -522,6 +795,16 @@ type FileWriter interface {
 	Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno)
 }
 
+// FileWriteSplicer is implemented by files that can take the data of
+// a write from a pipe, eg. with data.SpliceTo into a backing file,
+// if the mount sets fuse.MountOptions.SpliceWrite. It is not used
+// for nodes that implement NodeWriter, for inline files, or for
+// appends that are serialized. Returning ENOSYS without having used
+// data makes the write go to Write instead.
+type FileWriteSplicer interface {
+	WriteSplice(ctx context.Context, data *fuse.WriteData, off int64) (written uint32, errno syscall.Errno)
+}
+
 // See NodeGetlker.
 type FileGetlker interface {
 	Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno
@@ -542,6 +825,11 @@ type FileLseeker interface {
 	Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// See NodePoller.
+type FilePoller interface {
+	Poll(ctx context.Context, events uint32, wakeup *PollWakeup) (revents uint32, errno syscall.Errno)
+}
+
 // See NodeFlusher.
 type FileFlusher interface {
 	Flush(ctx context.Context) syscall.Errno
@@ -562,6 +850,18 @@ type FileAllocater interface {
 	Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno
 }
 
+// FilePassthroughFder is implemented by file handles that are backed
+// by a file descriptor. If the mount has
+// fuse.MountOptions.EnablePassthrough set, the descriptor is
+// registered with the kernel, which then serves reads and writes
+// directly from it, bypassing the Read and Write methods of the file
+// handle. The kernel allows a single backing file per inode, so all
+// open handles of an inode share the backing file of the first one.
+// If registration fails, the file handle is used as usual.
+type FilePassthroughFder interface {
+	PassthroughFd() (fd int, ok bool)
+}
+
 // Options sets options for the entire filesystem
 type Options struct {
 	// MountOptions contain the options for mounting the fuse server
@@ -576,6 +876,28 @@ type Options struct {
 	// information.
 	AttrTimeout *time.Duration
 
+	// Features, if set, selects the kernel features to ask for,
+	// in place of the corresponding MountOptions fields:
+	// DisableReadDirPlus, ReadDirPlusAuto, DisableParallelDirOps,
+	// EnableWriteback, EnablePassthrough, EnableLocks and
+	// EnableAcl. It is applied by Mount, TakeOver and Restore.
+	// Inode.EffectiveFeatures reports the features in use.
+	Features *Features
+
+	// FsyncPolicy decides what syncs do, see FsyncPolicy and
+	// NodeFsyncPolicier.
+	FsyncPolicy FsyncPolicy
+
+	// RangeLocking serializes overlapping writes and truncates of
+	// files, see NodeRangeLockPolicier.
+	RangeLocking bool
+
+	// AdaptiveTimeout, if set, chooses the entry and attribute
+	// timeouts of each node from how often it changes, in place
+	// of EntryTimeout and AttrTimeout. Timeouts that the file
+	// system sets itself are kept.
+	AdaptiveTimeout *AdaptiveTimeout
+
 	// If set to nonnil, this defines the overall entry timeout
 	// for failed lookups (fuse.ENOENT). See fuse.EntryOut for
 	// more information.
@@ -585,6 +907,14 @@ type Options struct {
 	// starting from this number. If unset, use 2^63.
 	FirstAutomaticIno uint64
 
+	// ReservedNodeIds lists FUSE node IDs that the bridge does not
+	// hand out automatically. They can be used for nodes that a
+	// RawFileSystem wrapping the one returned by NewNodeFS serves
+	// itself, or for nodes created with
+	// Inode.NewPersistentInodeWithNodeId. The ranges must not
+	// contain the root node ID 1.
+	ReservedNodeIds []NodeIdRange
+
 	// OnAdd is an alternative way to specify the OnAdd
 	// functionality of the root node.
 	OnAdd func(ctx context.Context)
@@ -601,6 +931,89 @@ type Options struct {
 	// If nonzero, replace default (zero) GID with the given GID
 	GID uint32
 
+	// MagicEntries are added to every directory of the file
+	// system. They shadow entries of the same name that the
+	// directory nodes return, and cannot be removed, renamed or
+	// created through the file system.
+	MagicEntries []MagicEntry
+
+	// ResolveSymlinks makes lookups follow symlinks inside the
+	// server: a symlink is presented as the node it points to,
+	// with that node's attributes and content, and is never read
+	// by the kernel. This is for clients that cannot resolve
+	// symlinks themselves, such as some NFS re-exports and
+	// Windows clients.
+	//
+	// Targets are resolved within the file system: absolute
+	// targets start at its root, and ".." of the root is the root
+	// itself. Resolution fails with ELOOP after 40 symlinks, or if
+	// it ends at the root. Directories reached through a symlink
+	// are aliases of the target, which the kernel keeps under one
+	// name at a time.
+	ResolveSymlinks bool
+
+	// ReadVerifyFailures, if set, is incremented atomically for
+	// each read that fails NodeReadVerifier verification.
+	ReadVerifyFailures *uint64
+
+	// NameEncoding selects how names that are not valid UTF-8 are
+	// handled in lookups, directory listings and requests that
+	// create, remove or rename entries. By default, names are
+	// passed as raw bytes in both directions.
+	NameEncoding NameEncoding
+
+	// SillyRename makes unlinking a file that is still open rename
+	// it to a hidden name (".fuse_hidden" followed by hex digits)
+	// instead, like NFS clients do. The file is unlinked when its
+	// last open file is released. Renames that replace an open
+	// file hide it the same way. This is for backends that delete
+	// data right away, which would break reading files that were
+	// unlinked while open. It needs NodeRenamer on directories.
+	SillyRename bool
+
+	// CacheReaddir lets the kernel cache the listings of
+	// directories that do not implement NodeReaddirCacher. It
+	// needs kernel protocol version 28, and is ignored otherwise.
+	CacheReaddir bool
+
+	// OpenFlags are fuse.FOPEN_* flags that are added to the
+	// flags returned by all Open, Create and Tmpfile calls. For
+	// example, fuse.FOPEN_DIRECT_IO|fuse.FOPEN_PARALLEL_DIRECT_WRITES
+	// lets databases write to their files in parallel.
+	OpenFlags uint32
+
+	// CoalesceLookups makes concurrent lookups of the same name in
+	// the same directory share a single NodeLookuper.Lookup call
+	// and its result. Tools that list directories can send
+	// hundreds of identical lookups against cold caches. The
+	// shared call runs with the context of the first request, so
+	// this should not be used if Lookup depends on the caller.
+	CoalesceLookups bool
+
+	// InlineSize is the largest file size, in bytes, that is
+	// opened inline. Files whose node implements NodeInliner and
+	// that are at most this large when opened are kept in memory
+	// while open, and written back when they are flushed. While
+	// a file is open inline, writes and truncations that would
+	// grow it beyond this size fail with EFBIG. Files that are
+	// open already are not opened inline. If zero, no files are
+	// opened inline.
+	InlineSize int
+
+	// AppendMode selects how files opened with O_APPEND are
+	// handled if the kernel writeback cache is enabled. See
+	// AppendMode for the choices.
+	AppendMode AppendMode
+
+	// TxnHandler, if set, groups modifying operations into
+	// transactions, and is told when they begin and commit. See
+	// Txn for how operations are grouped.
+	TxnHandler TxnHandler
+
+	// TxnIdle is the time without operations after which a
+	// transaction is committed. If 0, it is 100ms.
+	TxnIdle time.Duration
+
 	// ServerCallbacks can be provided to stub out notification
 	// functions for testing a filesystem without mounting it.
 	ServerCallbacks ServerCallbacks
@@ -0,0 +1,102 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AppendMode selects how files opened with O_APPEND are handled when
+// the kernel writeback cache is enabled (see
+// fuse.MountOptions.EnableWriteback). With the writeback cache, the
+// kernel computes the offset of appends from its cached file size,
+// and writes them back later, so appends from other clients of the
+// backend are overwritten, and never seen. Without the writeback
+// cache, the mode has no effect.
+type AppendMode int
+
+const (
+	// AppendKernel leaves appends to the kernel.
+	AppendKernel AppendMode = iota
+
+	// AppendReject fails opening files with O_APPEND with
+	// EINVAL.
+	AppendReject
+
+	// AppendDirectIO opens files with O_APPEND with
+	// FOPEN_DIRECT_IO, so appends bypass the page cache and reach
+	// the file system right away. The offset is still chosen by
+	// the kernel.
+	AppendDirectIO
+
+	// AppendSerialize is like AppendDirectIO, but the offset of
+	// each write to a file opened with O_APPEND is replaced by
+	// the file size from Getattr. Appends through the mount are
+	// serialized per Inode, so they don't overwrite each other.
+	// Writes larger than the maximum write size are split by the
+	// kernel, and the parts may be interleaved with other
+	// appends. The kernel's idea of the file size may lag behind.
+	AppendSerialize
+)
+
+// writeback returns whether the kernel writeback cache is enabled.
+func (b *rawBridge) writeback() bool {
+	return b.features().Writeback
+}
+
+// checkAppend applies Options.AppendMode to a file opened with the
+// given flags. It returns the FOPEN_* flags to add to the reply.
+func (b *rawBridge) checkAppend(flags uint32) (uint32, syscall.Errno) {
+	if flags&syscall.O_APPEND == 0 || b.options.AppendMode == AppendKernel || !b.writeback() {
+		return 0, OK
+	}
+	if b.options.AppendMode == AppendReject {
+		return 0, syscall.EINVAL
+	}
+	return fuse.FOPEN_DIRECT_IO, OK
+}
+
+// serializeAppend returns whether a write should be placed at the end
+// of the file. Writes of cached pages keep their offset, even if
+// the kernel sends them through a file opened with O_APPEND.
+func (b *rawBridge) serializeAppend(f *fileEntry, input *fuse.WriteIn) bool {
+	return b.options.AppendMode == AppendSerialize &&
+		f.openFlags&syscall.O_APPEND != 0 &&
+		input.WriteFlags&fuse.WRITE_CACHE == 0 &&
+		b.writeback()
+}
+
+// appendWrite writes data at the current end of the file.
+func (b *rawBridge) appendWrite(ctx *fuse.Context, n *Inode, f *fileEntry, data []byte) (uint32, syscall.Errno) {
+	n.appendMu.Lock()
+	defer n.appendMu.Unlock()
+
+	var attr fuse.AttrOut
+	if errno := b.getattr(ctx, n, f.file, &attr); errno != 0 {
+		return 0, errno
+	}
+	return b.write(ctx, n, f, data, int64(attr.Size))
+}
+
+func (b *rawBridge) write(ctx context.Context, n *Inode, f *fileEntry, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.inline {
+		return n.inlineFile().write(data, off)
+	}
+	unlock, errno := b.lockRange(ctx, n, newByteRange(uint64(off), uint64(len(data))))
+	if errno != 0 {
+		return 0, errno
+	}
+	defer unlock()
+	if wr, ok := n.ops.(NodeWriter); ok {
+		return wr.Write(ctx, f.file, data, off)
+	}
+	if fr, ok := f.file.(FileWriter); ok {
+		return fr.Write(ctx, data, off)
+	}
+	return 0, syscall.ENOTSUP
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func appendMount(t *testing.T, mode AppendMode) (*MemRegularFile, string, func()) {
+	mf := &MemRegularFile{Attr: fuse.Attr{Mode: 0644}}
+	root := &Inode{}
+	mntDir, server, clean := testMount(t, root, &Options{
+		AppendMode: mode,
+		MountOptions: fuse.MountOptions{
+			EnableWriteback: true,
+		},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, mf, StableAttr{}), false)
+		},
+	})
+	if server.KernelSettings().Flags&fuse.CAP_WRITEBACK_CACHE == 0 {
+		clean()
+		t.Skip("kernel does not support writeback cache")
+	}
+	return mf, mntDir + "/file", clean
+}
+
+func memContents(f *MemRegularFile) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte{}, f.Data...)
+}
+
+func TestAppendReject(t *testing.T) {
+	_, fn, clean := appendMount(t, AppendReject)
+	defer clean()
+
+	if _, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0); !isErrno(err, syscall.EINVAL) {
+		t.Errorf("open O_APPEND: got %v, want EINVAL", err)
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.Close()
+}
+
+// testConcurrentAppends has several goroutines append records to
+// the file, and checks that all of them end up intact.
+func testConcurrentAppends(t *testing.T, mf *MemRegularFile, fn string, prefix []byte) {
+	const writers = 8
+	const records = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer f.Close()
+			for j := 0; j < records; j++ {
+				if _, err := fmt.Fprintf(f, "writer %d record %03d\n", i, j); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	got := memContents(mf)
+	if !bytes.HasPrefix(got, prefix) {
+		t.Fatalf("contents do not start with %q", prefix)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(got[len(prefix):], []byte("\n")), []byte("\n"))
+	if len(lines) != writers*records {
+		t.Fatalf("got %d records, want %d", len(lines), writers*records)
+	}
+	seen := map[string]bool{}
+	for _, l := range lines {
+		var i, j int
+		if _, err := fmt.Sscanf(string(l), "writer %d record %03d", &i, &j); err != nil {
+			t.Fatalf("garbled record %q", l)
+		}
+		seen[string(l)] = true
+	}
+	if len(seen) != writers*records {
+		t.Errorf("got %d distinct records, want %d", len(seen), writers*records)
+	}
+}
+
+func TestAppendDirectIO(t *testing.T) {
+	mf, fn, clean := appendMount(t, AppendDirectIO)
+	defer clean()
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The write bypassed the page cache, so it arrived before
+	// the file is closed.
+	if got := memContents(mf); string(got) != "hello\n" {
+		t.Errorf("got %q before close, want %q", got, "hello\n")
+	}
+	f.Close()
+
+	testConcurrentAppends(t, mf, fn, []byte("hello\n"))
+}
+
+func TestAppendSerialize(t *testing.T) {
+	mf, fn, clean := appendMount(t, AppendSerialize)
+	defer clean()
+
+	// Make the kernel cache the size of the file.
+	if fi, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("got size %d, want 0", fi.Size())
+	}
+
+	// Change the file behind the kernel's back. The append
+	// should go after the new contents.
+	mf.mu.Lock()
+	mf.Data = []byte("changed elsewhere\n")
+	mf.mu.Unlock()
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	prefix := []byte("changed elsewhere\nhello\n")
+	if got := memContents(mf); !bytes.Equal(got, prefix) {
+		t.Errorf("got %q, want %q", got, prefix)
+	}
+
+	testConcurrentAppends(t, mf, fn, prefix)
+}
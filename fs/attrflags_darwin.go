@@ -0,0 +1,16 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// setAttrFlags does nothing, as OSX has no submounts.
+func (n *Inode) setAttrFlags(out *fuse.Attr) {
+}
+
+func (n *Inode) setStatxFlags(out *fuse.StatxOut) {
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// setAttrFlags sets the flags of the attributes of n, marking
+// submount roots.
+func (n *Inode) setAttrFlags(out *fuse.Attr) {
+	if !n.IsDir() {
+		return
+	}
+	if sm, ok := n.ops.(NodeSubmounter); ok && sm.Submount() {
+		out.Padding |= fuse.FUSE_ATTR_SUBMOUNT
+	}
+}
+
+// setStatxFlags is setAttrFlags for STATX replies.
+func (n *Inode) setStatxFlags(out *fuse.StatxOut) {
+	var a fuse.Attr
+	n.setAttrFlags(&a)
+	out.Flags |= a.AttrFlags()
+}
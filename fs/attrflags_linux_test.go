@@ -0,0 +1,129 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+type submountDir struct {
+	Inode
+}
+
+func (n *submountDir) Submount() bool { return true }
+
+func TestSubmountFlag(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("sub", root.NewPersistentInode(ctx, &submountDir{}, StableAttr{Mode: syscall.S_IFDIR}), false)
+			root.AddChild("dir", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR}), false)
+		},
+	})
+
+	for _, tc := range []struct {
+		name string
+		want uint32
+	}{
+		{"sub", fuse.FUSE_ATTR_SUBMOUNT},
+		{"dir", 0},
+	} {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", tc.name, st)
+		}
+		if out.Attr.AttrFlags() != tc.want {
+			t.Errorf("Lookup(%q): got flags %x, want %x", tc.name, out.Attr.AttrFlags(), tc.want)
+		}
+		var attrOut fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr(%q): %v", tc.name, st)
+		}
+		if attrOut.AttrFlags() != tc.want {
+			t.Errorf("GetAttr(%q): got flags %x, want %x", tc.name, attrOut.AttrFlags(), tc.want)
+		}
+	}
+}
+
+// statxObject answers STATX from the backend only, leaving the
+// rest to the bridge.
+type statxObject struct {
+	objectNode
+}
+
+func (n *statxObject) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out.Mask = unix.STATX_BASIC_STATS
+	out.Ino = 99
+	out.Size = uint64(len(n.data))
+	return 0
+}
+
+type statxSubmountDir struct {
+	submountDir
+}
+
+func (n *statxSubmountDir) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	return 0
+}
+
+func TestStatxFixup(t *testing.T) {
+	obj := &statxObject{objectNode{data: []byte("hi")}}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		InlineSize: 1024,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, obj, StableAttr{Ino: 5}), false)
+			root.AddChild("sub", root.NewPersistentInode(ctx, &statxSubmountDir{}, StableAttr{Mode: syscall.S_IFDIR}), false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	in := fuse.OpenIn{Flags: uint32(syscall.O_RDWR)}
+	in.NodeId = entry.NodeId
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &in, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	win := fuse.WriteIn{Fh: openOut.Fh}
+	win.NodeId = entry.NodeId
+	if _, st := rawFS.Write(nil, &win, []byte("hello world")); !st.Ok() {
+		t.Fatalf("Write: %v", st)
+	}
+
+	// The size comes from the inline contents, which are not
+	// stored yet.
+	var out fuse.StatxOut
+	sin := fuse.StatxIn{SxMask: unix.STATX_BASIC_STATS}
+	sin.NodeId = entry.NodeId
+	if st := rawFS.Statx(nil, &sin, &out); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if out.Ino != 5 || out.Mode != syscall.S_IFREG|0644 || out.Size != 11 ||
+		out.Blksize != allocBlockSize || out.Blocks != BlocksForBytes(11) {
+		t.Errorf("Statx: got %+v", out.Statx)
+	}
+
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "sub", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	out = fuse.StatxOut{}
+	sin.NodeId = entry.NodeId
+	if st := rawFS.Statx(nil, &sin, &out); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if out.Flags != fuse.FUSE_ATTR_SUBMOUNT {
+		t.Errorf("Statx of submount: got flags %x", out.Flags)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// allocBlockSize is the granularity of Allocation, and the st_blksize
+// it reports.
+const allocBlockSize = 4096
+
+// BlocksForBytes returns st_blocks, which counts 512-byte units, for
+// n bytes of storage, rounded up to whole 4k blocks.
+func BlocksForBytes(n uint64) uint64 {
+	return (n + allocBlockSize - 1) / allocBlockSize * (allocBlockSize / 512)
+}
+
+type extent struct {
+	start, end uint64
+}
+
+// Allocation tracks which parts of a file are backed by storage, so
+// file systems can report st_blocks for sparse and preallocated
+// files, like du(1) expects. Space is tracked in 4k blocks. The zero
+// value has nothing allocated. Allocation is not safe for
+// concurrent use.
+type Allocation struct {
+	// sorted, non-overlapping, non-adjacent and block aligned.
+	extents []extent
+}
+
+func roundDown(n uint64) uint64 {
+	return n &^ (allocBlockSize - 1)
+}
+
+func roundUp(n uint64) uint64 {
+	return roundDown(n + allocBlockSize - 1)
+}
+
+// Write marks the blocks touched by writing n bytes at off as
+// allocated.
+func (a *Allocation) Write(off, n uint64) {
+	if n == 0 {
+		return
+	}
+	a.add(roundDown(off), roundUp(off+n))
+}
+
+// Truncate releases the blocks past size.
+func (a *Allocation) Truncate(size uint64) {
+	a.remove(roundUp(size), ^uint64(0))
+}
+
+// checkAllocateMode validates a fallocate(2) mode, following the
+// rules of Linux.
+func checkAllocateMode(mode uint32) syscall.Errno {
+	const supported = fuse.FALLOC_FL_KEEP_SIZE | fuse.FALLOC_FL_PUNCH_HOLE |
+		fuse.FALLOC_FL_COLLAPSE_RANGE | fuse.FALLOC_FL_ZERO_RANGE |
+		fuse.FALLOC_FL_INSERT_RANGE | fuse.FALLOC_FL_UNSHARE_RANGE
+	switch {
+	case mode&^supported != 0:
+		return syscall.EOPNOTSUPP
+	case mode&fuse.FALLOC_FL_PUNCH_HOLE != 0 && mode&fuse.FALLOC_FL_ZERO_RANGE != 0:
+		return syscall.EOPNOTSUPP
+	case mode&fuse.FALLOC_FL_PUNCH_HOLE != 0 && mode&fuse.FALLOC_FL_KEEP_SIZE == 0:
+		return syscall.EOPNOTSUPP
+	case mode&fuse.FALLOC_FL_COLLAPSE_RANGE != 0 && mode != fuse.FALLOC_FL_COLLAPSE_RANGE:
+		return syscall.EINVAL
+	case mode&fuse.FALLOC_FL_INSERT_RANGE != 0 && mode != fuse.FALLOC_FL_INSERT_RANGE:
+		return syscall.EINVAL
+	case mode&fuse.FALLOC_FL_UNSHARE_RANGE != 0 && mode&^(fuse.FALLOC_FL_UNSHARE_RANGE|fuse.FALLOC_FL_KEEP_SIZE) != 0:
+		return syscall.EINVAL
+	}
+	return OK
+}
+
+// Fallocate applies fallocate(2) on the range [off, off+n) of a file
+// of the given size, and returns the new file size. Punching only
+// releases blocks that lie entirely in the range. COLLAPSE_RANGE
+// and INSERT_RANGE need a block aligned range inside the file, and
+// shift the blocks after it. The caller must move or clear the data
+// itself.
+func (a *Allocation) Fallocate(size, off, n uint64, mode uint32) (uint64, syscall.Errno) {
+	if errno := checkAllocateMode(mode); errno != 0 {
+		return size, errno
+	}
+	if n == 0 {
+		return size, syscall.EINVAL
+	}
+	end := off + n
+	if end < off {
+		return size, syscall.EFBIG
+	}
+	keep := mode&fuse.FALLOC_FL_KEEP_SIZE != 0
+	switch mode &^ fuse.FALLOC_FL_KEEP_SIZE {
+	case 0, fuse.FALLOC_FL_ZERO_RANGE, fuse.FALLOC_FL_UNSHARE_RANGE:
+		a.add(roundDown(off), roundUp(end))
+		if !keep && mode&fuse.FALLOC_FL_UNSHARE_RANGE == 0 && end > size {
+			size = end
+		}
+	case fuse.FALLOC_FL_PUNCH_HOLE:
+		a.remove(roundUp(off), roundDown(end))
+	case fuse.FALLOC_FL_COLLAPSE_RANGE:
+		if off%allocBlockSize != 0 || n%allocBlockSize != 0 || end >= size {
+			return size, syscall.EINVAL
+		}
+		a.remove(off, end)
+		a.shift(end, func(x uint64) uint64 { return x - n })
+		size -= n
+	case fuse.FALLOC_FL_INSERT_RANGE:
+		if off%allocBlockSize != 0 || n%allocBlockSize != 0 || off >= size {
+			return size, syscall.EINVAL
+		}
+		if size+n < size {
+			return size, syscall.EFBIG
+		}
+		a.split(off)
+		a.shift(off, func(x uint64) uint64 { return x + n })
+		size += n
+	}
+	return size, OK
+}
+
+// Bytes returns the number of allocated bytes.
+func (a *Allocation) Bytes() uint64 {
+	var n uint64
+	for _, e := range a.extents {
+		n += e.end - e.start
+	}
+	return n
+}
+
+// FillAttr sets Blocks, and on Linux Blksize, in out.
+func (a *Allocation) FillAttr(out *fuse.Attr) {
+	setBlksize(out)
+	out.Blocks = BlocksForBytes(a.Bytes())
+}
+
+func (a *Allocation) add(start, end uint64) {
+	if start >= end {
+		return
+	}
+	// first extent that ends at or after start.
+	i := sort.Search(len(a.extents), func(i int) bool { return a.extents[i].end >= start })
+	j := i
+	for j < len(a.extents) && a.extents[j].start <= end {
+		if a.extents[j].start < start {
+			start = a.extents[j].start
+		}
+		if a.extents[j].end > end {
+			end = a.extents[j].end
+		}
+		j++
+	}
+	merged := append([]extent{{start, end}}, a.extents[j:]...)
+	a.extents = append(a.extents[:i], merged...)
+}
+
+func (a *Allocation) remove(start, end uint64) {
+	if start >= end {
+		return
+	}
+	var result []extent
+	for _, e := range a.extents {
+		if e.end <= start || e.start >= end {
+			result = append(result, e)
+			continue
+		}
+		if e.start < start {
+			result = append(result, extent{e.start, start})
+		}
+		if e.end > end {
+			result = append(result, extent{end, e.end})
+		}
+	}
+	a.extents = result
+}
+
+// split cuts the extent containing off in two.
+func (a *Allocation) split(off uint64) {
+	for i, e := range a.extents {
+		if e.start < off && off < e.end {
+			a.extents = append(a.extents[:i+1], a.extents[i:]...)
+			a.extents[i].end = off
+			a.extents[i+1].start = off
+			return
+		}
+	}
+}
+
+// shift moves the extents that start at or after from, and merges
+// extents that become adjacent.
+func (a *Allocation) shift(from uint64, f func(uint64) uint64) {
+	var result []extent
+	for _, e := range a.extents {
+		if e.start >= from {
+			e = extent{f(e.start), f(e.end)}
+		}
+		if l := len(result); l > 0 && result[l-1].end == e.start {
+			result[l-1].end = e.end
+			continue
+		}
+		result = append(result, e)
+	}
+	a.extents = result
+}
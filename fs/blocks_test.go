@@ -0,0 +1,153 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestBlocksForBytes(t *testing.T) {
+	for in, want := range map[uint64]uint64{
+		0:    0,
+		1:    8,
+		4096: 8,
+		4097: 16,
+	} {
+		if got := BlocksForBytes(in); got != want {
+			t.Errorf("BlocksForBytes(%d): got %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestAllocation(t *testing.T) {
+	var a Allocation
+	a.Write(100, 10)
+	a.Write(3*4096, 1)
+	if got, want := a.Bytes(), uint64(2*4096); got != want {
+		t.Fatalf("after write: got %d, want %d", got, want)
+	}
+
+	// Preallocate past EOF without changing the size.
+	size, errno := a.Fallocate(3*4096+1, 0, 8*4096, fuse.FALLOC_FL_KEEP_SIZE)
+	if errno != 0 || size != 3*4096+1 {
+		t.Fatalf("KEEP_SIZE: got %d, %v", size, errno)
+	}
+	if got, want := a.Bytes(), uint64(8*4096); got != want {
+		t.Fatalf("after KEEP_SIZE: got %d, want %d", got, want)
+	}
+
+	// Partial blocks at the edges of a hole stay allocated.
+	if _, errno := a.Fallocate(size, 4000, 4096+200, fuse.FALLOC_FL_PUNCH_HOLE|fuse.FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatalf("PUNCH_HOLE: %v", errno)
+	}
+	if got, want := a.Bytes(), uint64(7*4096); got != want {
+		t.Fatalf("after PUNCH_HOLE: got %d, want %d", got, want)
+	}
+	if _, errno := a.Fallocate(size, 0, 1, fuse.FALLOC_FL_PUNCH_HOLE); errno != syscall.EOPNOTSUPP {
+		t.Errorf("PUNCH_HOLE without KEEP_SIZE: got %v", errno)
+	}
+	if _, errno := a.Fallocate(size, 0, 1, fuse.FALLOC_FL_COLLAPSE_RANGE); errno != syscall.EINVAL {
+		t.Errorf("unaligned COLLAPSE_RANGE: got %v", errno)
+	}
+
+	size, errno = a.Fallocate(size, 0, 10*4096, 0)
+	if errno != 0 || size != 10*4096 {
+		t.Fatalf("mode 0: got %d, %v", size, errno)
+	}
+	if got, want := a.Bytes(), uint64(10*4096); got != want {
+		t.Fatalf("after mode 0: got %d, want %d", got, want)
+	}
+
+	a.Truncate(4097)
+	var attr fuse.Attr
+	a.FillAttr(&attr)
+	if attr.Blocks != 16 {
+		t.Errorf("after truncate: got blocks %d, want 16", attr.Blocks)
+	}
+}
+
+func TestMemRegularFileAllocate(t *testing.T) {
+	ctx := context.Background()
+	f := &MemRegularFile{Data: bytes.Repeat([]byte("x"), 3*4096)}
+	if errno := f.Allocate(ctx, nil, 0, 3*4096, fuse.FALLOC_FL_PUNCH_HOLE|fuse.FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatalf("Allocate: %v", errno)
+	}
+	if errno := f.Allocate(ctx, nil, 0, 8*4096, fuse.FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatalf("Allocate: %v", errno)
+	}
+
+	var out fuse.AttrOut
+	if errno := f.Getattr(ctx, nil, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if out.Size != 3*4096 || out.Blocks != 64 {
+		t.Errorf("got size %d blocks %d, want %d, 64", out.Size, out.Blocks, 3*4096)
+	}
+	if !bytes.Equal(f.Data, make([]byte, 3*4096)) {
+		t.Errorf("punched data was not zeroed")
+	}
+}
+
+func TestCheckAllocateMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode uint32
+		want syscall.Errno
+	}{
+		{0, 0},
+		{fuse.FALLOC_FL_KEEP_SIZE, 0},
+		{fuse.FALLOC_FL_PUNCH_HOLE | fuse.FALLOC_FL_KEEP_SIZE, 0},
+		{fuse.FALLOC_FL_ZERO_RANGE | fuse.FALLOC_FL_KEEP_SIZE, 0},
+		{fuse.FALLOC_FL_COLLAPSE_RANGE, 0},
+		{fuse.FALLOC_FL_INSERT_RANGE, 0},
+		{fuse.FALLOC_FL_UNSHARE_RANGE | fuse.FALLOC_FL_KEEP_SIZE, 0},
+		{fuse.FALLOC_FL_PUNCH_HOLE, syscall.EOPNOTSUPP},
+		{fuse.FALLOC_FL_PUNCH_HOLE | fuse.FALLOC_FL_ZERO_RANGE | fuse.FALLOC_FL_KEEP_SIZE, syscall.EOPNOTSUPP},
+		{fuse.FALLOC_FL_COLLAPSE_RANGE | fuse.FALLOC_FL_KEEP_SIZE, syscall.EINVAL},
+		{fuse.FALLOC_FL_INSERT_RANGE | fuse.FALLOC_FL_KEEP_SIZE, syscall.EINVAL},
+		{fuse.FALLOC_FL_UNSHARE_RANGE | fuse.FALLOC_FL_ZERO_RANGE, syscall.EINVAL},
+		{0x80, syscall.EOPNOTSUPP},
+	} {
+		if got := checkAllocateMode(tc.mode); got != tc.want {
+			t.Errorf("mode 0x%x: got %v, want %v", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestMemRegularFileShiftRange(t *testing.T) {
+	ctx := context.Background()
+	data := append(bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 4096)...)
+	f := &MemRegularFile{Data: append([]byte{}, data...)}
+
+	if errno := f.Allocate(ctx, nil, 4096, 8192, fuse.FALLOC_FL_INSERT_RANGE); errno != 0 {
+		t.Fatalf("INSERT_RANGE: %v", errno)
+	}
+	want := append(append(bytes.Repeat([]byte("a"), 4096), make([]byte, 8192)...), bytes.Repeat([]byte("b"), 4096)...)
+	if !bytes.Equal(f.Data, want) {
+		t.Fatalf("INSERT_RANGE: got %d bytes, wrong content", len(f.Data))
+	}
+	var out fuse.AttrOut
+	f.Getattr(ctx, nil, &out)
+	if out.Blocks != 16 {
+		t.Errorf("INSERT_RANGE: got %d blocks, want 16", out.Blocks)
+	}
+
+	if errno := f.Allocate(ctx, nil, 4096, 8192, fuse.FALLOC_FL_COLLAPSE_RANGE); errno != 0 {
+		t.Fatalf("COLLAPSE_RANGE: %v", errno)
+	}
+	if !bytes.Equal(f.Data, data) {
+		t.Fatalf("COLLAPSE_RANGE: got %d bytes, wrong content", len(f.Data))
+	}
+	if errno := f.Allocate(ctx, nil, 4096, 4096, fuse.FALLOC_FL_COLLAPSE_RANGE); errno != syscall.EINVAL {
+		t.Errorf("COLLAPSE_RANGE to EOF: got %v, want EINVAL", errno)
+	}
+	if errno := f.Allocate(ctx, nil, 100, 4096, fuse.FALLOC_FL_INSERT_RANGE); errno != syscall.EINVAL {
+		t.Errorf("unaligned INSERT_RANGE: got %v, want EINVAL", errno)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"context"
 	"log"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -40,6 +42,25 @@ type fileEntry struct {
 	// directory seek has taken place.
 	dirOffset uint64
 
+	// Set if the directory is listed through NodeReaddirPager.
+	// dirPages maps the offset at which a page starts to its
+	// continuation token.
+	dirPager *pagedDirStream
+	dirPages map[uint64]string
+
+	// Set if the file was opened in passthrough mode.
+	passthrough bool
+
+	// Set if the file is served from Inode.inline.
+	inline bool
+
+	// The flags the file was opened with.
+	openFlags uint32
+
+	// Owners of the fcntl locks taken through this file. Protected
+	// by rawBridge.mu.
+	lockOwners map[uint64]bool
+
 	wg sync.WaitGroup
 }
 
@@ -89,12 +110,32 @@ type rawBridge struct {
 	// estimate for stableAttrs.
 	nodeCountHigh int
 
+	// fixedNodeIds holds the nodes created with a fixed node ID
+	// from Options.ReservedNodeIds.
+	fixedNodeIds map[uint64]*Inode
+
 	files     []*fileEntry
 	freeFiles []uint32
+
+	// silly holds the hidden names of unlinked files that are
+	// still open. See Options.SillyRename.
+	silly        map[*Inode][]sillyName
+	sillyCounter uint32
+
+	// lookups holds the lookups in progress. See
+	// Options.CoalesceLookups.
+	lookups map[lookupKey]*lookupCall
+
+	// txns holds the open transactions by process. See
+	// Options.TxnHandler.
+	txnMu     sync.Mutex
+	txns      map[uint32]*Txn
+	nextTxnId uint64
 }
 
-// newInode creates creates new inode pointing to ops.
-func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
+// newInode creates creates new inode pointing to ops. If nodeId is
+// 0, the node ID is chosen automatically.
+func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persistent bool, nodeId uint64) *Inode {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -125,8 +166,12 @@ func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persisten
 		}
 	}
 
-	initInode(ops.embed(), ops, id, b, persistent, b.nextNodeId)
-	b.nextNodeId++
+	if nodeId == 0 {
+		nodeId = b.allocNodeId()
+	} else {
+		b.claimNodeId(nodeId, ops.embed())
+	}
+	initInode(ops.embed(), ops, id, b, persistent, nodeId)
 	return ops.embed()
 }
 
@@ -137,7 +182,11 @@ func (b *rawBridge) logf(format string, args ...interface{}) {
 }
 
 func (b *rawBridge) newInode(ctx context.Context, ops InodeEmbedder, id StableAttr, persistent bool) *Inode {
-	ch := b.newInodeUnlocked(ops, id, persistent)
+	return b.newInodeWithNodeId(ctx, ops, id, persistent, 0)
+}
+
+func (b *rawBridge) newInodeWithNodeId(ctx context.Context, ops InodeEmbedder, id StableAttr, persistent bool, nodeId uint64) *Inode {
+	ch := b.newInodeUnlocked(ops, id, persistent, nodeId)
 	if ch != ops.embed() {
 		return ch
 	}
@@ -206,6 +255,9 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 
 	child.lookupCount++
 	child.changeCounter++
+	if parent.magic {
+		child.magic = true
+	}
 
 	b.kernelNodeIds[child.nodeId] = child
 	if len(b.kernelNodeIds) > b.nodeCountHigh {
@@ -217,7 +269,9 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 		fh = b.registerFile(child, file, fileFlags)
 	}
 
-	parent.setEntry(name, child)
+	if name != "" {
+		parent.setEntry(name, child)
+	}
 
 	out.NodeId = child.nodeId
 	out.Generation = child.stableAttr.Gen
@@ -226,11 +280,24 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	b.mu.Unlock()
 	unlockNodes(parent, child)
 
+	if child != orig {
+		if f, ok := orig.ops.(NodeOnForgetter); ok {
+			f.OnForget()
+		}
+	}
 	return child, fh
 }
 
-func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
+func (b *rawBridge) setEntryOutTimeout(n *Inode, out *fuse.EntryOut) {
 	b.setAttr(&out.Attr)
+	if b.options.AdaptiveTimeout != nil {
+		if out.AttrTimeout() == 0 && out.EntryTimeout() == 0 {
+			t := b.adaptiveTimeout(n, newAttrSig(&out.Attr))
+			out.SetAttrTimeout(t)
+			out.SetEntryTimeout(t)
+		}
+		return
+	}
 	if b.options.AttrTimeout != nil && out.AttrTimeout() == 0 {
 		out.SetAttrTimeout(*b.options.AttrTimeout)
 	}
@@ -255,7 +322,30 @@ func (b *rawBridge) setAttr(out *fuse.Attr) {
 	setBlocks(out)
 }
 
-func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
+// setStatx applies the same defaults as setAttr.
+func (b *rawBridge) setStatx(out *fuse.Statx) {
+	if !b.options.NullPermissions && out.Mode&07777 == 0 {
+		out.Mode |= 0644
+		if uint32(out.Mode)&syscall.S_IFDIR != 0 {
+			out.Mode |= 0111
+		}
+	}
+	if b.options.UID != 0 && out.Uid == 0 {
+		out.Uid = b.options.UID
+	}
+	if b.options.GID != 0 && out.Gid == 0 {
+		out.Gid = b.options.GID
+	}
+	setStatxBlocks(out)
+}
+
+func (b *rawBridge) setAttrTimeout(n *Inode, out *fuse.AttrOut) {
+	if b.options.AdaptiveTimeout != nil {
+		if out.Timeout() == 0 {
+			out.SetTimeout(b.adaptiveTimeout(n, newAttrSig(&out.Attr)))
+		}
+		return
+	}
 	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
 		out.SetTimeout(*b.options.AttrTimeout)
 	}
@@ -269,6 +359,9 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		server:       opts.ServerCallbacks,
 		nextNodeId:   2, // the root node has nodeid 1
 		stableAttrs:  make(map[StableAttr]*Inode),
+		silly:        make(map[*Inode][]sillyName),
+		lookups:      make(map[lookupKey]*lookupCall),
+		fixedNodeIds: make(map[uint64]*Inode),
 	}
 	if bridge.automaticIno == 1 {
 		bridge.automaticIno++
@@ -285,6 +378,8 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		bridge.options.EntryTimeout = &oneSec
 		bridge.options.AttrTimeout = &oneSec
 	}
+	checkReservedNodeIds(bridge.options.ReservedNodeIds)
+	checkAdaptiveTimeout(bridge.options.AdaptiveTimeout)
 
 	initInode(root.embed(), root,
 		StableAttr{
@@ -317,6 +412,35 @@ func (b *rawBridge) String() string {
 	return "rawBridge"
 }
 
+var _ = (fuse.NodePather)((*rawBridge)(nil))
+
+// NodePath returns the last known path of a node, for filtering debug
+// output.
+func (b *rawBridge) NodePath(id uint64) (string, bool) {
+	b.mu.Lock()
+	n := b.kernelNodeIds[id]
+	b.mu.Unlock()
+	if n == nil {
+		return "", false
+	}
+
+	var segments []string
+	for n != b.root {
+		n.mu.Lock()
+		pd := n.parents.get()
+		n.mu.Unlock()
+		if pd == nil {
+			return "", false
+		}
+		segments = append(segments, pd.name)
+		n = pd.parent
+	}
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+	return strings.Join(segments, "/"), true
+}
+
 func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -328,9 +452,17 @@ func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 }
 
 func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(header.NodeId, 0)
 	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
 	child, errno := b.lookup(ctx, parent, name, out)
+	if errno == 0 && b.options.ResolveSymlinks && child.stableAttr.Mode == syscall.S_IFLNK {
+		child, errno = b.followSymlink(ctx, parent, name, child, out)
+	} else if errno == 0 {
+		child, _ = b.addNewChild(parent, name, child, nil, 0, out)
+	}
 
 	if errno != 0 {
 		if b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
@@ -339,14 +471,19 @@ func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name s
 		return errnoToStatus(errno)
 	}
 
-	child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if m := b.magicEntry(parent, name); m != nil {
+		return b.lookupMagic(ctx, parent, m, out), OK
+	}
 	if lu, ok := parent.ops.(NodeLookuper); ok {
+		if b.options.CoalesceLookups {
+			return b.sharedLookup(ctx, parent, lu, name, out)
+		}
 		return lu.Lookup(ctx, name, out)
 	}
 
@@ -366,8 +503,67 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 	return child, OK
 }
 
+type lookupKey struct {
+	parent *Inode
+	name   string
+}
+
+// lookupCall is a Lookup in progress, whose result is shared by
+// concurrent lookups of the same name.
+type lookupCall struct {
+	done  chan struct{}
+	child *Inode
+	out   fuse.EntryOut
+	errno syscall.Errno
+}
+
+// sharedLookup calls lu.Lookup, or waits for the Lookup of the same
+// name that is already in progress and returns its result.
+func (b *rawBridge) sharedLookup(ctx *fuse.Context, parent *Inode, lu NodeLookuper, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	key := lookupKey{parent, name}
+	for {
+		b.mu.Lock()
+		c := b.lookups[key]
+		if c == nil {
+			c = &lookupCall{done: make(chan struct{})}
+			b.lookups[key] = c
+			b.mu.Unlock()
+
+			c.child, c.errno = lu.Lookup(ctx, name, &c.out)
+			b.mu.Lock()
+			delete(b.lookups, key)
+			b.mu.Unlock()
+			close(c.done)
+
+			*out = c.out
+			return c.child, c.errno
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Cancel:
+			return nil, syscall.EINTR
+		}
+		if c.errno == syscall.EINTR && ctx.Err() == nil {
+			// The request that did the lookup was
+			// interrupted, but this one was not.
+			continue
+		}
+		*out = c.out
+		return c.child, c.errno
+	}
+}
+
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := b.checkMagicName(parent, name, false); !st.Ok() {
+		return st
+	}
+	defer b.txnDone(b.txnOp(cancel, &header.Caller, parent))
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeRmdirer); ok {
 		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
@@ -380,10 +576,22 @@ func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name st
 }
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := b.checkMagicName(parent, name, false); !st.Ok() {
+		return st
+	}
+	defer b.txnDone(b.txnOp(cancel, &header.Caller, parent))
+	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+	if hidden, errno := b.hideOpen(ctx, parent, name); hidden != "" || errno != 0 {
+		return errnoToStatus(errno)
+	}
+
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeUnlinker); ok {
-		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		errno = mops.Unlink(ctx, name)
 	}
 
 	if errno == 0 {
@@ -392,13 +600,31 @@ func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name s
 	return errnoToStatus(errno)
 }
 
+// umask returns the umask for the Context of a request that creates
+// a file, see fuse.Context.Umask.
+func (b *rawBridge) umask(umask uint32) uint32 {
+	if !b.options.DontUmask {
+		return 0
+	}
+	return umask
+}
+
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := b.checkMagicName(parent, name, true); !st.Ok() {
+		return st
+	}
+
+	txn := b.txnOp(cancel, &input.Caller, parent)
+	defer b.txnDone(txn)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMkdirer); ok {
-		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, out)
+		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel, SuppGroups: input.SuppGroups(), Umask: b.umask(input.Umask)}, name, input.Mode, out)
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -416,18 +642,28 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 	}
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
+	b.txnAdd(txn, child)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := b.checkMagicName(parent, name, true); !st.Ok() {
+		return st
+	}
+
+	txn := b.txnOp(cancel, &input.Caller, parent)
+	defer b.txnDone(txn)
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMknoder); ok {
-		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, input.Rdev, out)
+		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel, SuppGroups: input.SuppGroups(), Umask: b.umask(input.CallerUmask())}, name, input.Mode, input.Rdev, out)
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -437,17 +673,32 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 	}
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
+	b.txnAdd(txn, child)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, SuppGroups: input.SuppGroups(), KillSuidGid: input.KillSuidGid(),
+		Umask: b.umask(input.CallerUmask())}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := b.checkMagicName(parent, name, true); !st.Ok() {
+		return st
+	}
+
+	appendFlags, errno := b.checkAppend(input.Flags)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+
+	txn := b.txnOp(cancel, &input.Caller, parent)
+	defer b.txnDone(txn)
 
 	var child *Inode
-	var errno syscall.Errno
 	var f FileHandle
 	var flags uint32
 	if mops, ok := parent.ops.(NodeCreater); ok {
@@ -464,12 +715,60 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	}
 
 	child, fh := b.addNewChild(parent, name, child, f, input.Flags|syscall.O_CREAT|syscall.O_EXCL, &out.EntryOut)
+	if input.Flags&syscall.O_TRUNC != 0 {
+		// The file may have existed.
+		child.invalidatePinnedAttr()
+	}
+	b.txnAdd(txn, child)
+	child.addOpen(ctx, input.Flags)
+
+	out.Fh = uint64(fh)
+	out.OpenFlags = flags | b.options.OpenFlags | appendFlags
+	if f != nil && b.addBackingID(child, f, &out.OpenOut) {
+		b.mu.Lock()
+		b.files[fh].passthrough = true
+		b.mu.Unlock()
+	}
+
+	child.setEntryOut(&out.EntryOut)
+	b.setEntryOutTimeout(child, &out.EntryOut)
+	return fuse.OK
+}
+
+func (b *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, SuppGroups: input.SuppGroups(), Umask: b.umask(input.CallerUmask())}
+	parent, _ := b.inode(input.NodeId, 0)
+
+	mops, ok := parent.ops.(NodeTmpfiler)
+	if !ok {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	appendFlags, errno := b.checkAppend(input.Flags)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+	txn := b.txnOp(cancel, &input.Caller, parent)
+	defer b.txnDone(txn)
+	child, f, flags, errno := mops.Tmpfile(ctx, input.Flags, input.Mode, &out.EntryOut)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+
+	// The file has no name, so it is not linked into parent.
+	child, fh := b.addNewChild(parent, "", child, f, input.Flags|syscall.O_EXCL, &out.EntryOut)
+	b.txnAdd(txn, child)
+	child.addOpen(ctx, input.Flags)
 
 	out.Fh = uint64(fh)
-	out.OpenFlags = flags
+	out.OpenFlags = flags | b.options.OpenFlags | appendFlags
+	if f != nil && b.addBackingID(child, f, &out.OpenOut) {
+		b.mu.Lock()
+		b.files[fh].passthrough = true
+		b.mu.Unlock()
+	}
 
 	child.setEntryOut(&out.EntryOut)
-	b.setEntryOutTimeout(&out.EntryOut)
+	b.setEntryOutTimeout(child, &out.EntryOut)
 	return fuse.OK
 }
 
@@ -482,6 +781,33 @@ func (b *rawBridge) Forget(nodeid, nlookup uint64) {
 	}
 }
 
+var _ = (fuse.BatchForgetter)((*rawBridge)(nil))
+
+// BatchForget looks up the nodes of a chunk of a BATCH_FORGET with
+// a single lock, and compacts the maps once at the end.
+func (b *rawBridge) BatchForget(forgets []fuse.ForgetOne) {
+	nodes := make([]*Inode, len(forgets))
+	b.mu.Lock()
+	for i, f := range forgets {
+		nodes[i] = b.kernelNodeIds[f.NodeId]
+		if nodes[i] == nil {
+			b.mu.Unlock()
+			log.Panicf("unknown node %d", f.NodeId)
+		}
+	}
+	b.mu.Unlock()
+
+	forgotten := false
+	for i, n := range nodes {
+		if f, _ := n.removeRef(forgets[i].Nlookup, false); f {
+			forgotten = true
+		}
+	}
+	if forgotten {
+		b.compactMemory()
+	}
+}
+
 // compactMemory tries to free memory that was previously used by forgotten
 // nodes.
 //
@@ -536,6 +862,12 @@ func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *
 		}
 		b.mu.Unlock()
 	}
+	if f == nil {
+		if a, ok := n.pinnedAttr(); ok {
+			*out = a
+			return fuse.OK
+		}
+	}
 	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
 	return errnoToStatus(b.getattr(ctx, n, f, out))
 }
@@ -562,37 +894,161 @@ func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fu
 		}
 		out.Ino = n.stableAttr.Ino
 		out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
+		n.setAttrFlags(&out.Attr)
+		if inl := n.inlineFile(); inl != nil {
+			out.Size = inl.size()
+		}
 		b.setAttr(&out.Attr)
-		b.setAttrTimeout(out)
+		b.setAttrTimeout(n, out)
 	}
 	return errno
 }
 
-func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+func (b *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	var fh uint64
+	if in.GetattrFlags&fuse.FUSE_GETATTR_FH != 0 {
+		fh = in.Fh
+	}
+	n, fEntry := b.inode(in.NodeId, fh)
+	f := fEntry.file
 	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
 
+	var fsx FileStatxer
+	if f != nil {
+		fsx, _ = f.(FileStatxer)
+	}
+
+	var errno syscall.Errno
+	if sx, ok := n.ops.(NodeStatxer); ok {
+		errno = sx.Statx(ctx, f, in.SxFlags, in.SxMask, out)
+	} else if fsx != nil {
+		errno = fsx.Statx(ctx, in.SxFlags, in.SxMask, out)
+	} else {
+		// Returning ENOSYS would disable STATX for the whole
+		// mount, so answer from Getattr instead.
+		var attr fuse.AttrOut
+		ok := false
+		if f == nil {
+			attr, ok = n.pinnedAttr()
+		}
+		if !ok {
+			errno = b.getattr(ctx, n, f, &attr)
+		}
+		if errno == 0 {
+			out.Statx.FromAttr(&attr.Attr)
+			out.AttrValid = attr.AttrValid
+			out.AttrValidNsec = attr.AttrValidNsec
+		}
+		return errnoToStatus(errno)
+	}
+
+	if errno == 0 {
+		if out.Ino != 0 && n.stableAttr.Ino > 1 && out.Ino != n.stableAttr.Ino {
+			b.logf("warning: rawBridge.Statx: overriding ino %d with %d", out.Ino, n.stableAttr.Ino)
+		}
+		out.Ino = n.stableAttr.Ino
+		out.Mode = uint16(uint32(out.Mode)&07777 | n.stableAttr.Mode)
+		n.setStatxFlags(out)
+		if inl := n.inlineFile(); inl != nil {
+			out.Size = inl.size()
+		}
+		b.setStatx(&out.Statx)
+		if b.options.AdaptiveTimeout != nil && out.Timeout() == 0 {
+			out.SetTimeout(b.adaptiveTimeout(n, newStatxSig(&out.Statx)))
+		} else if b.options.AdaptiveTimeout == nil && b.options.AttrTimeout != nil && out.Timeout() == 0 {
+			out.SetTimeout(*b.options.AttrTimeout)
+		}
+	}
+	return errnoToStatus(errno)
+}
+
+func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel, KillSuidGid: in.KillSuidGid()}
+
 	fh, _ := in.GetFh()
 
 	n, fEntry := b.inode(in.NodeId, fh)
 	f := fEntry.file
+	n.invalidatePinnedAttr()
+	defer b.txnDone(b.txnOp(cancel, &in.Caller, n))
+
+	inl := n.inlineFile()
+	if sz, ok := in.GetSize(); ok && inl != nil {
+		// The size is stored along with the contents.
+		if errno := inl.truncate(sz); errno != 0 {
+			return errnoToStatus(errno)
+		}
+		in.Valid &^= fuse.FATTR_SIZE
+	}
+
+	if _, ok := in.GetSize(); ok && inl == nil {
+		unlock, errno := b.lockRange(ctx, n, wholeFile)
+		if errno != 0 {
+			return errnoToStatus(errno)
+		}
+		defer unlock()
+	}
 
 	var errno = syscall.ENOTSUP
-	if fops, ok := n.ops.(NodeSetattrer); ok {
+	if inl != nil && in.Valid&^(fuse.FATTR_FH|fuse.FATTR_LOCKOWNER) == 0 {
+		errno = b.getattr(ctx, n, f, out)
+	} else if fops, ok := n.ops.(NodeSetattrer); ok {
 		errno = fops.Setattr(ctx, f, in, out)
 	} else if fops, ok := f.(FileSetattrer); ok {
 		errno = fops.Setattr(ctx, in, out)
 	}
+	if errno == 0 && inl != nil {
+		out.Size = inl.size()
+	}
 
 	out.Mode = n.stableAttr.Mode | (out.Mode & 07777)
 	return errnoToStatus(errno)
 }
 
+// checkRenameFlags validates renameat2(2) flags, following the rules
+// of Linux.
+func checkRenameFlags(flags uint32) syscall.Errno {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE|RENAME_WHITEOUT) != 0 {
+		return syscall.EINVAL
+	}
+	if flags&RENAME_EXCHANGE != 0 && flags&(RENAME_NOREPLACE|RENAME_WHITEOUT) != 0 {
+		return syscall.EINVAL
+	}
+	return OK
+}
+
 func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if st := b.decodeNames(&oldName, &newName); !st.Ok() {
+		return st
+	}
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
+	txn := b.txnOp(cancel, &input.Caller, p1)
+	defer b.txnDone(txn)
+	b.txnAdd(txn, p2)
+	if st := b.checkMagicName(p1, oldName, false); !st.Ok() {
+		return st
+	}
+	if st := b.checkMagicName(p2, newName, false); !st.Ok() {
+		return st
+	}
+	if errno := checkRenameFlags(input.Flags); errno != 0 {
+		return errnoToStatus(errno)
+	}
 
 	if mops, ok := p1.ops.(NodeRenamer); ok {
-		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
+		ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+		var hidden string
+		if dest := p2.GetChild(newName); input.Flags&(RENAME_EXCHANGE|RENAME_NOREPLACE) == 0 && dest != nil && dest != p1.GetChild(oldName) {
+			var errno syscall.Errno
+			if hidden, errno = b.hideOpen(ctx, p2, newName); errno != 0 {
+				return errnoToStatus(errno)
+			}
+		}
+		errno := mops.Rename(ctx, oldName, p2.ops, newName, input.Flags)
+		if errno != 0 && hidden != "" {
+			b.unhide(ctx, p2, hidden, newName)
+		}
 		if errno == 0 {
 			if input.Flags&RENAME_EXCHANGE != 0 {
 				p1.ExchangeChild(oldName, p2, newName)
@@ -607,8 +1063,17 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName
 }
 
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := b.checkMagicName(parent, name, true); !st.Ok() {
+		return st
+	}
 	target, _ := b.inode(input.Oldnodeid, 0)
+	txn := b.txnOp(cancel, &input.Caller, parent)
+	defer b.txnDone(txn)
+	b.txnAdd(txn, target)
 
 	if mops, ok := parent.ops.(NodeLinker); ok {
 		child, errno := mops.Link(&fuse.Context{Caller: input.Caller, Cancel: cancel}, target.ops, name, out)
@@ -618,24 +1083,32 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 
 		child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 		child.setEntryOut(out)
-		b.setEntryOutTimeout(out)
+		b.setEntryOutTimeout(child, out)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	if st := b.decodeNames(&name); !st.Ok() {
+		return st
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := b.checkMagicName(parent, name, true); !st.Ok() {
+		return st
+	}
+
+	defer b.txnDone(b.txnOp(cancel, &header.Caller, parent))
 
 	if mops, ok := parent.ops.(NodeSymlinker); ok {
-		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, target, name, out)
+		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel, SuppGroups: header.SuppGroups()}, target, name, out)
 		if status != 0 {
 			return errnoToStatus(status)
 		}
 
 		child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 		child.setEntryOut(out)
-		b.setEntryOutTimeout(out)
+		b.setEntryOutTimeout(child, out)
 		return fuse.OK
 	}
 	return fuse.ENOTSUP
@@ -703,14 +1176,17 @@ func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, des
 
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
+	defer b.txnDone(b.txnOp(cancel, &input.Caller, n))
 	if xops, ok := n.ops.(NodeSetxattrer); ok {
-		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
+		ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, KillSgid: input.KillSgid()}
+		return errnoToStatus(xops.Setxattr(ctx, attr, data, input.Flags))
 	}
 	return fuse.ENOATTR
 }
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
 	n, _ := b.inode(header.NodeId, 0)
+	defer b.txnDone(b.txnOp(cancel, &header.Caller, n))
 	if xops, ok := n.ops.(NodeRemovexattrer); ok {
 		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
 	}
@@ -719,19 +1195,47 @@ func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, a
 
 func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
+	if input.Flags&syscall.O_TRUNC != 0 {
+		defer n.invalidatePinnedAttr()
+	}
+
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, KillSuidGid: input.KillSuidGid()}
+	appendFlags, errno := b.checkAppend(input.Flags)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+	if ok, errno := b.openInline(ctx, n); errno != 0 {
+		return errnoToStatus(errno)
+	} else if ok {
+		if input.Flags&syscall.O_TRUNC != 0 {
+			// Sent with fuse.MountOptions.EnableAtomicTrunc
+			// only; the contents are stored on flush.
+			n.inlineFile().truncate(0)
+		}
+		out.OpenFlags = b.options.OpenFlags | appendFlags
+		b.mu.Lock()
+		out.Fh = uint64(b.registerFile(n, nil, input.Flags))
+		b.files[out.Fh].inline = true
+		b.mu.Unlock()
+		n.addOpen(ctx, input.Flags)
+		return fuse.OK
+	}
 
 	if op, ok := n.ops.(NodeOpener); ok {
-		f, flags, errno := op.Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
+		f, flags, errno := op.Open(ctx, input.Flags)
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
 
+		out.OpenFlags = flags | b.options.OpenFlags | appendFlags
 		if f != nil {
+			passthrough := b.addBackingID(n, f, out)
 			b.mu.Lock()
-			defer b.mu.Unlock()
 			out.Fh = uint64(b.registerFile(n, f, input.Flags))
+			b.files[out.Fh].passthrough = passthrough
+			b.mu.Unlock()
 		}
-		out.OpenFlags = flags
+		n.addOpen(ctx, input.Flags)
 		return fuse.OK
 	}
 
@@ -753,6 +1257,10 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	fileEntry := b.files[fh]
 	fileEntry.nodeIndex = len(n.openFiles)
 	fileEntry.file = f
+	fileEntry.passthrough = false
+	fileEntry.inline = false
+	fileEntry.openFlags = flags
+	fileEntry.lockOwners = nil
 
 	n.openFiles = append(n.openFiles, fh)
 	return fh
@@ -760,17 +1268,46 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
 
-	if fops, ok := n.ops.(NodeReader); ok {
-		res, errno := fops.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, buf, int64(input.Offset))
-		return res, errnoToStatus(errno)
+	var res fuse.ReadResult
+	var errno syscall.Errno
+	if f.inline {
+		return n.inlineFile().read(buf, int64(input.Offset)), fuse.OK
+	} else if fops, ok := n.ops.(NodeReader); ok {
+		res, errno = fops.Read(ctx, f.file, buf, int64(input.Offset))
+	} else if fr, ok := f.file.(FileReader); ok {
+		res, errno = fr.Read(ctx, buf, int64(input.Offset))
+	} else {
+		return nil, fuse.ENOTSUP
 	}
-	if fr, ok := f.file.(FileReader); ok {
-		res, errno := fr.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, buf, int64(input.Offset))
-		return res, errnoToStatus(errno)
+
+	if v, ok := n.ops.(NodeReadVerifier); ok && errno == 0 && res != nil {
+		res, errno = b.verifyRead(ctx, v, n, f.file, res, buf, int64(input.Offset))
 	}
+	return res, errnoToStatus(errno)
+}
 
-	return nil, fuse.ENOTSUP
+// verifyRead runs the verifier on the data of res. The data is
+// moved into buf, so res can be released before the reply is sent.
+func (b *rawBridge) verifyRead(ctx context.Context, v NodeReadVerifier, n *Inode, f FileHandle, res fuse.ReadResult, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	data, st := res.Bytes(buf)
+	if st == 0 && len(data) > 0 && (len(buf) == 0 || &data[0] != &buf[0]) {
+		data = buf[:copy(buf, data)]
+	}
+	res.Done()
+	if st != 0 {
+		return nil, syscall.Errno(st)
+	}
+
+	if errno := v.VerifyRead(ctx, f, off, data); errno != 0 {
+		b.logf("VerifyRead n%d [%d +%d): %v", n.nodeId, off, len(data), errno)
+		if c := b.options.ReadVerifyFailures; c != nil {
+			atomic.AddUint64(c, 1)
+		}
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(data), 0
 }
 
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
@@ -787,42 +1324,173 @@ func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.Lk
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	errno := syscall.ENOTSUP
 	if lops, ok := n.ops.(NodeSetlker); ok {
-		return errnoToStatus(lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
-	}
-	if sl, ok := n.ops.(FileSetlker); ok {
-		return errnoToStatus(sl.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
+		errno = lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags)
+	} else if sl, ok := f.file.(FileSetlker); ok {
+		errno = sl.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags)
 	}
-	return fuse.ENOTSUP
+	b.addLockOwner(f, input, errno)
+	return errnoToStatus(errno)
 }
+
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	errno := syscall.ENOTSUP
 	if lops, ok := n.ops.(NodeSetlkwer); ok {
-		return errnoToStatus(lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
+		errno = lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags)
+	} else if sl, ok := f.file.(FileSetlkwer); ok {
+		errno = sl.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags)
 	}
-	if sl, ok := n.ops.(FileSetlkwer); ok {
-		return errnoToStatus(sl.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
+	b.addLockOwner(f, input, errno)
+	return errnoToStatus(errno)
+}
+
+// addLockOwner records the owner of an fcntl lock, so its locks
+// can be dropped when the kernel no longer holds them.
+func (b *rawBridge) addLockOwner(f *fileEntry, input *fuse.LkIn, errno syscall.Errno) {
+	if errno != 0 || input.LkFlags&fuse.FUSE_LK_FLOCK != 0 || input.Lk.Typ == syscall.F_UNLCK {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f.lockOwners == nil {
+		f.lockOwners = map[uint64]bool{}
+	}
+	f.lockOwners[input.Owner] = true
+}
+
+// unlockPosix drops the fcntl locks of owner on n, as a process
+// loses its POSIX locks on a file when it closes any descriptor
+// for it. This is a no-op for OFD locks, as their owner is the
+// open file description rather than the process that flushes.
+func (b *rawBridge) unlockPosix(ctx context.Context, n *Inode, owner uint64) {
+	var files []*fileEntry
+	b.mu.Lock()
+	for _, fh := range n.openFiles {
+		if f := b.files[fh]; f.lockOwners[owner] {
+			delete(f.lockOwners, owner)
+			files = append(files, f)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, f := range files {
+		b.unlock(ctx, n, f, owner, 0)
+	}
+}
+
+// unlockAll drops the fcntl locks that remain on a file that is
+// being released. These are OFD locks, as POSIX locks are dropped
+// on flush.
+func (b *rawBridge) unlockAll(ctx context.Context, n *Inode, f *fileEntry) {
+	b.mu.Lock()
+	owners := f.lockOwners
+	f.lockOwners = nil
+	b.mu.Unlock()
+
+	for owner := range owners {
+		b.unlock(ctx, n, f, owner, 0)
 	}
-	return fuse.ENOTSUP
 }
 
 func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	n, f := b.releaseFileEntry(input.NodeId, input.Fh)
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	b.commitNodeTxns(n)
 	if f == nil {
+		n.removeOpen(ctx, input.Flags)
+		b.releaseHidden(ctx, n)
 		return
 	}
 
 	f.wg.Wait()
 
-	if r, ok := n.ops.(NodeReleaser); ok {
-		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file)
+	if input.ReleaseFlags&fuse.RELEASE_FLOCK_UNLOCK != 0 {
+		b.unlock(ctx, n, f, input.LockOwner, fuse.FUSE_LK_FLOCK)
+	}
+	b.unlockAll(ctx, n, f)
+
+	if f.inline {
+		b.releaseInline(ctx, n)
+	} else if r, ok := n.ops.(NodeReleaser); ok {
+		r.Release(ctx, f.file)
 	} else if r, ok := f.file.(FileReleaser); ok {
-		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel})
+		r.Release(ctx)
+	}
+
+	if f.passthrough {
+		b.releaseBackingID(n)
 	}
 
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
+	b.mu.Unlock()
+
+	// Count the file off with the flags it was counted with, in
+	// case the access mode of the request differs.
+	n.removeOpen(ctx, f.openFlags)
+	b.releaseHidden(ctx, n)
+}
+
+// unlock drops the locks of owner on the whole file, as the kernel
+// won't send a separate unlock request on close.
+func (b *rawBridge) unlock(ctx context.Context, n *Inode, f *fileEntry, owner uint64, flags uint32) {
+	lk := fuse.FileLock{Typ: syscall.F_UNLCK, End: (1 << 63) - 1}
+	if lops, ok := n.ops.(NodeSetlker); ok {
+		lops.Setlk(ctx, f.file, owner, &lk, flags)
+	} else if sl, ok := f.file.(FileSetlker); ok {
+		sl.Setlk(ctx, owner, &lk, flags)
+	}
+}
+
+type backingFdRegisterer interface {
+	RegisterBackingFd(m *fuse.BackingMap) (int32, syscall.Errno)
+	UnregisterBackingFd(id int32) syscall.Errno
+}
+
+// addBackingID puts the node in passthrough mode if the file handle
+// supports it, and returns whether it did so.
+func (b *rawBridge) addBackingID(n *Inode, f FileHandle, out *fuse.OpenOut) bool {
+	pf, ok := f.(FilePassthroughFder)
+	if !ok {
+		return false
+	}
+	reg, ok := b.server.(backingFdRegisterer)
+	if !ok {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.backingIDRefcount == 0 {
+		fd, ok := pf.PassthroughFd()
+		if !ok {
+			return false
+		}
+		id, errno := reg.RegisterBackingFd(&fuse.BackingMap{Fd: int32(fd)})
+		if errno != 0 {
+			return false
+		}
+		n.backingID = id
+	}
+	n.backingIDRefcount++
+	out.BackingId = n.backingID
+	out.OpenFlags |= fuse.FOPEN_PASSTHROUGH
+	return true
+}
+
+func (b *rawBridge) releaseBackingID(n *Inode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.backingIDRefcount--
+	if n.backingIDRefcount > 0 {
+		return
+	}
+	if errno := b.server.(backingFdRegisterer).UnregisterBackingFd(n.backingID); errno != 0 {
+		b.logf("UnregisterBackingFd(%d): %v", n.backingID, errno)
+	}
+	n.backingID = 0
 }
 
 func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
@@ -830,10 +1498,9 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	f.wg.Wait()
 
 	f.mu.Lock()
-	if f.dirStream != nil {
-		f.dirStream.Close()
-		f.dirStream = nil
-	}
+	f.closeDir()
+	f.dirPager = nil
+	f.dirPages = nil
 	f.mu.Unlock()
 
 	b.mu.Lock()
@@ -862,50 +1529,220 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, KillSuidGid: input.KillSuidGid()}
+	defer b.txnDone(b.txnOp(cancel, &input.Caller, n))
+	defer n.invalidatePinnedAttr()
 
-	if wr, ok := n.ops.(NodeWriter); ok {
-		w, errno := wr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, data, int64(input.Offset))
+	if b.serializeAppend(f, input) {
+		w, errno := b.appendWrite(ctx, n, f, data)
 		return w, errnoToStatus(errno)
 	}
-	if fr, ok := f.file.(FileWriter); ok {
-		w, errno := fr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+	w, errno := b.write(ctx, n, f, data, int64(input.Offset))
+	return w, errnoToStatus(errno)
+}
+
+var _ = (fuse.WriteSplicer)((*rawBridge)(nil))
+
+func (b *rawBridge) WriteSplice(cancel <-chan struct{}, input *fuse.WriteIn, data *fuse.WriteData) (uint32, fuse.Status) {
+	n, f := b.inode(input.NodeId, input.Fh)
+	ws, ok := f.file.(FileWriteSplicer)
+	if _, isWriter := n.ops.(NodeWriter); !ok || isWriter || f.inline || b.serializeAppend(f, input) {
+		return 0, fuse.ENOSYS
 	}
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel, KillSuidGid: input.KillSuidGid()}
+	defer b.txnDone(b.txnOp(cancel, &input.Caller, n))
+	defer n.invalidatePinnedAttr()
 
-	return 0, fuse.ENOTSUP
+	unlock, errno := b.lockRange(ctx, n, newByteRange(input.Offset, uint64(data.Size())))
+	if errno != 0 {
+		return 0, errnoToStatus(errno)
+	}
+	defer unlock()
+	w, errno := ws.WriteSplice(ctx, data, int64(input.Offset))
+	return w, errnoToStatus(errno)
 }
 
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	if fl, ok := n.ops.(NodeFlusher); ok {
-		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file))
-	}
-	if fl, ok := f.file.(FileFlusher); ok {
-		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}))
-	}
-	return 0
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	var errno syscall.Errno
+	if f.inline {
+		errno = b.storeInline(ctx, n, n.inlineFile())
+	} else if fl, ok := n.ops.(NodeFlusher); ok {
+		errno = fl.Flush(ctx, f.file)
+	} else if fl, ok := f.file.(FileFlusher); ok {
+		errno = fl.Flush(ctx)
+	}
+	b.unlockPosix(ctx, n, input.LockOwner)
+	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	b.commitNodeTxns(n)
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	flags := input.FsyncFlags
+	switch b.fsyncPolicy(ctx, n) {
+	case FsyncMetadata, FsyncNone:
+		return fuse.OK
+	case FsyncFull:
+		flags &^= fuse.FSYNC_FDATASYNC
+	}
+	if f.inline {
+		return errnoToStatus(b.storeInline(ctx, n, n.inlineFile()))
+	}
 	if fs, ok := n.ops.(NodeFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
+		return errnoToStatus(fs.Fsync(ctx, f.file, flags))
 	}
 	if fs, ok := f.file.(FileFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.FsyncFlags))
+		return errnoToStatus(fs.Fsync(ctx, flags))
 	}
 	return fuse.ENOTSUP
 }
 
+// fsyncPolicy returns the FsyncPolicy of n.
+func (b *rawBridge) fsyncPolicy(ctx context.Context, n *Inode) FsyncPolicy {
+	policy := b.options.FsyncPolicy
+	n.inheritPolicy(func(ops InodeEmbedder) bool {
+		fp, ok := ops.(NodeFsyncPolicier)
+		if !ok {
+			return false
+		}
+		p, ok := fp.FsyncPolicy(ctx)
+		if ok {
+			policy = p
+		}
+		return ok
+	})
+	return policy
+}
+
+// inheritPolicy calls get on the operations of n and then of its
+// parents, until get returns true, ie. finds a policy that overrides
+// the mount option.
+func (n *Inode) inheritPolicy(get func(ops InodeEmbedder) bool) {
+	for p := n; p != nil; _, p = p.Parent() {
+		if get(p.ops) {
+			return
+		}
+	}
+}
+
+var _ = (fuse.OpenFileFlusher)((*rawBridge)(nil))
+
+// FlushOpenFiles flushes and syncs the files open for writing, for
+// MountOptions.UnmountFlushTimeout.
+func (b *rawBridge) FlushOpenFiles(cancel <-chan struct{}) []fuse.FlushFailure {
+	type openFile struct {
+		n  *Inode
+		fh uint64
+		f  *fileEntry
+	}
+	var files []openFile
+	b.mu.Lock()
+	for _, n := range b.kernelNodeIds {
+		for _, fh := range n.openFiles {
+			f := b.files[fh]
+			if (f.file == nil && !f.inline) || f.openFlags&syscall.O_ACCMODE == syscall.O_RDONLY {
+				continue
+			}
+			// Keep Release from running concurrently.
+			f.wg.Add(1)
+			files = append(files, openFile{n, uint64(fh), f})
+		}
+	}
+	b.mu.Unlock()
+
+	type result struct {
+		i     int
+		errno syscall.Errno
+	}
+	results := make(chan result, len(files))
+	for i, of := range files {
+		go func(i int, of openFile) {
+			defer of.f.wg.Done()
+			ctx := &fuse.Context{Cancel: cancel}
+			results <- result{i, b.flushFile(ctx, of.n, of.f)}
+		}(i, of)
+	}
+
+	errnos := make([]syscall.Errno, len(files))
+	for i := range errnos {
+		errnos[i] = syscall.ETIMEDOUT
+	}
+wait:
+	for range files {
+		select {
+		case r := <-results:
+			errnos[r.i] = r.errno
+		case <-cancel:
+			break wait
+		}
+	}
+
+	var failures []fuse.FlushFailure
+	for i, errno := range errnos {
+		if errno != 0 {
+			failures = append(failures, fuse.FlushFailure{
+				NodeId: files[i].n.nodeId,
+				Fh:     files[i].fh,
+				Status: errnoToStatus(errno),
+			})
+		}
+	}
+	return failures
+}
+
+// flushFile runs Flush and Fsync on an open file. Files that do not
+// implement Fsync only need the Flush.
+func (b *rawBridge) flushFile(ctx *fuse.Context, n *Inode, f *fileEntry) syscall.Errno {
+	if f.inline {
+		return b.storeInline(ctx, n, n.inlineFile())
+	}
+	var errno syscall.Errno
+	if fl, ok := n.ops.(NodeFlusher); ok {
+		errno = fl.Flush(ctx, f.file)
+	} else if fl, ok := f.file.(FileFlusher); ok {
+		errno = fl.Flush(ctx)
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	if fs, ok := n.ops.(NodeFsyncer); ok {
+		errno = fs.Fsync(ctx, f.file, 0)
+	} else if fs, ok := f.file.(FileFsyncer); ok {
+		errno = fs.Fsync(ctx, 0)
+	}
+	if errno == syscall.ENOTSUP || errno == syscall.ENOSYS {
+		errno = 0
+	}
+	return errno
+}
+
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
-	n, f := b.inode(input.NodeId, input.Fh)
-	if a, ok := n.ops.(NodeAllocater); ok {
-		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Offset, input.Length, input.Mode))
+	if errno := checkAllocateMode(input.Mode); errno != 0 {
+		return errnoToStatus(errno)
 	}
-	if a, ok := f.file.(FileAllocater); ok {
-		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Offset, input.Length, input.Mode))
+	n, f := b.inode(input.NodeId, input.Fh)
+	defer b.txnDone(b.txnOp(cancel, &input.Caller, n))
+	defer n.invalidatePinnedAttr()
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	unlock, errno := b.lockRange(ctx, n, newByteRange(input.Offset, input.Length))
+	if errno != 0 {
+		return errnoToStatus(errno)
 	}
-	return fuse.ENOTSUP
+	defer unlock()
+	errno = b.inlineBackendOp(ctx, n, func() syscall.Errno {
+		if a, ok := n.ops.(NodeAllocater); ok {
+			return a.Allocate(ctx, f.file, input.Offset, input.Length, input.Mode)
+		}
+		if a, ok := f.file.(FileAllocater); ok {
+			return a.Allocate(ctx, input.Offset, input.Length, input.Mode)
+		}
+		return syscall.ENOTSUP
+	})
+	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
@@ -918,6 +1755,16 @@ func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fus
 		}
 	}
 
+	cache := b.options.CacheReaddir
+	if rc, ok := n.ops.(NodeReaddirCacher); ok {
+		cache = rc.ReaddirCache(&fuse.Context{Caller: input.Caller, Cancel: cancel})
+	}
+	if cache {
+		// Without KEEP_CACHE, the kernel drops the listing
+		// on each open.
+		out.OpenFlags |= fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	out.Fh = uint64(b.registerFile(n, nil, 0))
@@ -939,14 +1786,33 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 			f.dirStream.Close()
 			f.dirStream = nil
 		}
-		str, errno := b.getStream(&fuse.Context{Caller: input.Caller, Cancel: cancel}, inode)
-		if errno != 0 {
-			return errno, false
-		}
-
+		f.dirPager = nil
 		f.dirOffset = 0
 		f.hasOverflow = false
-		f.dirStream = str
+
+		ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+		if pager, ok := inode.ops.(NodeReaddirPager); ok && len(b.options.MagicEntries) == 0 {
+			if input.Offset == 0 {
+				f.dirPages = nil
+			}
+			if b.options.NameEncoding != NamesRaw {
+				pager = &encodedPager{pager, b.options.NameEncoding}
+			}
+			f.dirOffset, f.dirPager = f.resumePager(ctx, pager, input.Offset)
+			f.dirStream = f.dirPager
+		} else {
+			str, errno := b.getStream(ctx, inode)
+			if errno != 0 {
+				return errno, false
+			}
+			if b.options.NameEncoding != NamesRaw {
+				str = &encodedDirStream{DirStream: str, enc: b.options.NameEncoding}
+			}
+			f.dirStream = str
+		}
+	} else if f.dirPager != nil {
+		// Fetch further pages on behalf of the current request.
+		f.dirPager.ctx = &fuse.Context{Caller: input.Caller, Cancel: cancel}
 	}
 
 	// Seek forward?
@@ -967,7 +1833,42 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 	return 0, false
 }
 
+// resumePager returns a stream that starts at the last page known to
+// begin at or before offset, along with the offset of that page.
+// Caller must hold `f.mu`.
+func (f *fileEntry) resumePager(ctx context.Context, pager NodeReaddirPager, offset uint64) (uint64, *pagedDirStream) {
+	var start uint64
+	var token string
+	for off, tok := range f.dirPages {
+		if off <= offset && off > start {
+			start, token = off, tok
+		}
+	}
+	s := newPagedDirStream(ctx, pager, start, token)
+	s.mark = func(off uint64, token string) {
+		if f.dirPages == nil {
+			f.dirPages = map[uint64]string{}
+		}
+		f.dirPages[off] = token
+	}
+	return start, s
+}
+
 func (b *rawBridge) getStream(ctx context.Context, inode *Inode) (DirStream, syscall.Errno) {
+	if len(b.options.MagicEntries) > 0 && !inode.magic {
+		s, errno := b.getNodeStream(ctx, inode)
+		if errno != 0 {
+			return nil, errno
+		}
+		return newMagicDirStream(inode, s, b.options.MagicEntries), 0
+	}
+	return b.getNodeStream(ctx, inode)
+}
+
+func (b *rawBridge) getNodeStream(ctx context.Context, inode *Inode) (DirStream, syscall.Errno) {
+	if pager, ok := inode.ops.(NodeReaddirPager); ok {
+		return newPagedDirStream(ctx, pager, 0, ""), 0
+	}
 	if rd, ok := inode.ops.(NodeReaddirer); ok {
 		return rd.Readdir(ctx)
 	}
@@ -981,11 +1882,35 @@ func (b *rawBridge) getStream(ctx context.Context, inode *Inode) (DirStream, sys
 	return NewListDirStream(r), 0
 }
 
-func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+// dirEntry returns the directory handle for a READDIR[PLUS]. Without
+// OPENDIR (MountOptions.NoOpendir), the kernel sends file handle 0,
+// and each request lists the directory from the start on a handle of
+// its own, which must be closed with closeDir.
+func (b *rawBridge) dirEntry(input *fuse.ReadIn) (*Inode, *fileEntry) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	if input.Fh == 0 {
+		f = &fileEntry{}
+	}
+	return n, f
+}
+
+// closeDir closes the stream of a handle returned by dirEntry for
+// file handle 0. Caller must hold `f.mu`.
+func (f *fileEntry) closeDir() {
+	if f.dirStream != nil {
+		f.dirStream.Close()
+		f.dirStream = nil
+	}
+}
+
+func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	n, f := b.dirEntry(input)
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if input.Fh == 0 {
+		defer f.closeDir()
+	}
 
 	errno, eof := b.setStream(cancel, input, n, f)
 	if errno != 0 {
@@ -1007,6 +1932,11 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
+		if b.options.ResolveSymlinks && e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			// The type of the target is not known without
+			// a lookup. Report DT_UNKNOWN.
+			e.Mode &^= syscall.S_IFMT
+		}
 		if !out.AddDirEntry(e) {
 			f.overflow = e
 			f.hasOverflow = true
@@ -1019,10 +1949,13 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 }
 
 func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
-	n, f := b.inode(input.NodeId, input.Fh)
+	n, f := b.dirEntry(input)
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if input.Fh == 0 {
+		defer f.closeDir()
+	}
 
 	errno, eof := b.setStream(cancel, input, n, f)
 	if errno != 0 {
@@ -1064,15 +1997,29 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			continue
 		}
 
-		child, errno := b.lookup(ctx, n, e.Name, entryOut)
+		// The listing has the encoded name; the nodes use the
+		// original.
+		name := e.Name
+		b.decodeNames(&name)
+		child, errno := b.lookup(ctx, n, name, entryOut)
+		if errno == 0 && b.options.ResolveSymlinks && child.stableAttr.Mode == syscall.S_IFLNK {
+			// Leave the symlink to LOOKUP. If it resolves to a
+			// directory that the kernel cannot alias, only that
+			// entry should fail, rather than the whole listing.
+			*entryOut = fuse.EntryOut{}
+			out.FixMode(0)
+			continue
+		}
+		if errno == 0 {
+			child, _ = b.addNewChild(n, name, child, nil, 0, entryOut)
+		}
 		if errno != 0 {
 			if b.options.NegativeTimeout != nil {
 				entryOut.SetEntryTimeout(*b.options.NegativeTimeout)
 			}
 		} else {
-			child, _ = b.addNewChild(n, e.Name, child, nil, 0, entryOut)
 			child.setEntryOut(entryOut)
-			b.setEntryOutTimeout(entryOut)
+			b.setEntryOutTimeout(child, entryOut)
 			if e.Mode&syscall.S_IFMT != child.stableAttr.Mode&syscall.S_IFMT {
 				// The file type has changed behind our back. Use the new value.
 				out.FixMode(child.stableAttr.Mode)
@@ -1086,8 +2033,12 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, input.Fh)
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if b.fsyncPolicy(ctx, n) == FsyncNone {
+		return fuse.OK
+	}
 	if fs, ok := n.ops.(NodeFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, nil, input.FsyncFlags))
+		return errnoToStatus(fs.Fsync(ctx, nil, input.FsyncFlags))
 	}
 
 	return fuse.ENOTSUP
@@ -1103,6 +2054,14 @@ func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fu
 	return fuse.OK
 }
 
+func (b *rawBridge) SyncFs(cancel <-chan struct{}, input *fuse.SyncFsIn) fuse.Status {
+	n, _ := b.inode(input.NodeId, 0)
+	if sf, ok := n.ops.(NodeSyncfser); ok {
+		return errnoToStatus(sf.Syncfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}))
+	}
+	return fuse.ENOSYS
+}
+
 func (b *rawBridge) Init(s *fuse.Server) {
 	b.server = s
 }
@@ -1115,14 +2074,38 @@ func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRange
 	}
 
 	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	defer n2.invalidatePinnedAttr()
+	defer b.txnDone(b.txnOp(cancel, &in.Caller, n2))
 
-	sz, errno := cfr.CopyFileRange(&fuse.Context{Caller: in.Caller, Cancel: cancel},
-		f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
+	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	unlock, errno := b.lockRange(ctx, n2, newByteRange(in.OffOut, in.Len))
+	if errno != 0 {
+		return 0, errnoToStatus(errno)
+	}
+	defer unlock()
+	// The backend copies what it has, so the source must be
+	// stored if it is open inline.
+	if inl := n1.inlineFile(); inl != nil && inl != n2.inlineFile() {
+		if errno := b.storeInline(ctx, n1, inl); errno != 0 {
+			return 0, errnoToStatus(errno)
+		}
+	}
+	var sz uint32
+	errno = b.inlineBackendOp(ctx, n2, func() syscall.Errno {
+		var errno syscall.Errno
+		sz, errno = cfr.CopyFileRange(ctx, f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
+		return errno
+	})
 	return sz, errnoToStatus(errno)
 }
 
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
+	if f.inline && (in.Whence == _SEEK_DATA || in.Whence == _SEEK_HOLE) {
+		off, errno := n.inlineFile().lseek(in.Offset, in.Whence)
+		out.Offset = off
+		return errnoToStatus(errno)
+	}
 
 	ls, ok := n.ops.(NodeLseeker)
 	if ok {
@@ -1145,6 +2128,43 @@ func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.Ls
 	return fuse.ENOTSUP
 }
 
+func (b *rawBridge) Bmap(cancel <-chan struct{}, in *fuse.BmapIn, out *fuse.BmapOut) fuse.Status {
+	n, _ := b.inode(in.NodeId, 0)
+	bm, ok := n.ops.(NodeBmapper)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	block, errno := bm.Bmap(&fuse.Context{Caller: in.Caller, Cancel: cancel}, in.Blocksize, in.Block)
+	out.Block = block
+	return errnoToStatus(errno)
+}
+
+func (b *rawBridge) SetupMapping(cancel <-chan struct{}, in *fuse.SetupMappingIn) fuse.Status {
+	fh := in.Fh
+	if fh == ^uint64(0) {
+		fh = 0
+	}
+	n, f := b.inode(in.NodeId, fh)
+	sm, ok := n.ops.(NodeSetupMapper)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	var file FileHandle
+	if f != nil {
+		file = f.file
+	}
+	return errnoToStatus(sm.SetupMapping(&fuse.Context{Caller: in.Caller, Cancel: cancel}, file, in.Foffset, in.Len, in.Moffset, in.Flags))
+}
+
+func (b *rawBridge) RemoveMapping(cancel <-chan struct{}, in *fuse.RemoveMappingIn, mappings []fuse.RemoveMappingOne) fuse.Status {
+	n, _ := b.inode(in.NodeId, 0)
+	rm, ok := n.ops.(NodeRemoveMapper)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	return errnoToStatus(rm.RemoveMapping(&fuse.Context{Caller: in.Caller, Cancel: cancel}, mappings))
+}
+
 func (fs *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, out *fuse.IoctlOut, bufIn, bufOut []byte) fuse.Status {
 	return fuse.ENOSYS
 }
@@ -6,12 +6,18 @@ package fs
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -201,3 +207,469 @@ func (n *testDeletedIno) Getattr(ctx context.Context, f FileHandle, out *fuse.At
 	// Otherwise EILSEQ
 	return syscall.EILSEQ
 }
+
+type pagedDir struct {
+	Inode
+
+	names []string
+	// fetched records the token of each ReaddirPage call.
+	fetched []string
+}
+
+var _ = (NodeReaddirPager)((*pagedDir)(nil))
+
+// ReaddirPage returns 3 entries per page. The token is the index of
+// the first entry of the page.
+func (d *pagedDir) ReaddirPage(ctx context.Context, token string) ([]fuse.DirEntry, string, syscall.Errno) {
+	d.fetched = append(d.fetched, token)
+	start := 0
+	if token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := start + 3
+	next := strconv.Itoa(end)
+	if end >= len(d.names) {
+		end = len(d.names)
+		next = ""
+	}
+	var r []fuse.DirEntry
+	for i := start; i < end; i++ {
+		r = append(r, fuse.DirEntry{Name: d.names[i], Ino: uint64(i + 1), Mode: syscall.S_IFREG})
+	}
+	return r, next, 0
+}
+
+func TestReaddirPager(t *testing.T) {
+	root := &pagedDir{}
+	for i := 0; i < 10; i++ {
+		root.names = append(root.names, fmt.Sprintf("e%02d", i))
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var openOut fuse.OpenOut
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}
+	if st := rawFS.OpenDir(nil, &openIn, &openOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+
+	// readdir returns the names at offset, 2 per call: each dirent
+	// takes 24 bytes plus 8 for the name.
+	readdir := func(off uint64) []string {
+		t.Helper()
+		buf := make([]byte, 64)
+		in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh, Offset: off}
+		if st := rawFS.ReadDir(nil, &in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+			t.Fatalf("ReadDir(%d): %v", off, st)
+		}
+		var names []string
+		for p := 0; p+32 <= len(buf) && binary.LittleEndian.Uint64(buf[p:]) != 0; p += 32 {
+			names = append(names, string(buf[p+24:p+27]))
+		}
+		return names
+	}
+
+	var all []string
+	for off := uint64(0); ; {
+		names := readdir(off)
+		if len(names) == 0 {
+			break
+		}
+		all = append(all, names...)
+		off += uint64(len(names))
+	}
+	if got, want := strings.Join(all, ","), strings.Join(root.names, ","); got != want {
+		t.Errorf("listing: got %s, want %s", got, want)
+	}
+	if got, want := strings.Join(root.fetched, ","), ",3,6,9"; got != want {
+		t.Errorf("fetched tokens: got %q, want %q", got, want)
+	}
+
+	// Seeking back resumes from the page holding the offset. The
+	// entry that did not fit the buffer comes from the next page.
+	root.fetched = nil
+	if got := readdir(7); strings.Join(got, ",") != "e07,e08" {
+		t.Errorf("seek to 7: got %v", got)
+	}
+	if got := strings.Join(root.fetched, ","); got != "6,9" {
+		t.Errorf("seek to 7 fetched %q, want \"6,9\"", got)
+	}
+
+	// Rewinding starts a new listing.
+	root.fetched = nil
+	if got := readdir(0); strings.Join(got, ",") != "e00,e01" {
+		t.Errorf("rewind: got %v", got)
+	}
+	if len(root.fetched) != 1 || root.fetched[0] != "" {
+		t.Errorf("rewind fetched %q, want first page", root.fetched)
+	}
+}
+
+func TestBridgeOpenFlags(t *testing.T) {
+	root := &Inode{}
+	const flags = fuse.FOPEN_DIRECT_IO | fuse.FOPEN_PARALLEL_DIRECT_WRITES
+	rawFS := NewNodeFS(root, &Options{
+		OpenFlags: flags,
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatal(st)
+	}
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	if out.OpenFlags&flags != flags {
+		t.Errorf("got open flags %x, want %x set", out.OpenFlags, flags)
+	}
+}
+
+func TestBridgeNodePath(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			ch := dir.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+			dir.AddChild("file", ch, false)
+		},
+	})
+	pather := rawFS.(fuse.NodePather)
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "dir", &entry); !st.Ok() {
+		t.Fatal(st)
+	}
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: entry.NodeId}, "file", &entry); !st.Ok() {
+		t.Fatal(st)
+	}
+	for _, tc := range []struct {
+		id   uint64
+		path string
+		ok   bool
+	}{
+		{1, "", true},
+		{entry.NodeId, "dir/file", true},
+		{entry.NodeId + 100, "", false},
+	} {
+		if p, ok := pather.NodePath(tc.id); p != tc.path || ok != tc.ok {
+			t.Errorf("NodePath(%d): got %q, %v, want %q, %v", tc.id, p, ok, tc.path, tc.ok)
+		}
+	}
+
+	root.GetChild("dir").RmChild("file")
+	if _, ok := pather.NodePath(entry.NodeId); ok {
+		t.Errorf("unlinked node has a path")
+	}
+}
+
+type slowLookupDir struct {
+	Inode
+	calls   int32
+	release chan struct{}
+}
+
+func (n *slowLookupDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	atomic.AddInt32(&n.calls, 1)
+	<-n.release
+	out.Size = 42
+	return n.NewInode(ctx, &Inode{}, StableAttr{Ino: 100}), 0
+}
+
+func TestCoalesceLookups(t *testing.T) {
+	root := &slowLookupDir{release: make(chan struct{})}
+	rawFS := NewNodeFS(root, &Options{CoalesceLookups: true})
+
+	const N = 10
+	outs := make([]fuse.EntryOut, N)
+	sts := make([]fuse.Status, N)
+	var started, done sync.WaitGroup
+	for i := 0; i < N; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			sts[i] = rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &outs[i])
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(root.release)
+	done.Wait()
+
+	if got := atomic.LoadInt32(&root.calls); got != 1 {
+		t.Errorf("got %d Lookup calls, want 1", got)
+	}
+	for i := range outs {
+		if !sts[i].Ok() || outs[i].NodeId != outs[0].NodeId || outs[i].Size != 42 {
+			t.Errorf("lookup %d: got %v, %+v", i, sts[i], outs[i])
+		}
+	}
+	if n := root.GetChild("file").lookupCount; n != N {
+		t.Errorf("got lookupCount %d, want %d", n, N)
+	}
+}
+
+type readdirCacheNode struct {
+	Inode
+	cache bool
+}
+
+func (n *readdirCacheNode) ReaddirCache(ctx context.Context) bool {
+	return n.cache
+}
+
+func TestBridgeReaddirCache(t *testing.T) {
+	for _, defaultCache := range []bool{false, true} {
+		root := &Inode{}
+		rawFS := NewNodeFS(root, &Options{
+			CacheReaddir: defaultCache,
+			OnAdd: func(ctx context.Context) {
+				for _, cache := range []bool{false, true} {
+					ch := root.NewPersistentInode(ctx, &readdirCacheNode{cache: cache}, StableAttr{Mode: syscall.S_IFDIR})
+					root.AddChild(fmt.Sprintf("cache=%v", cache), ch, false)
+				}
+			},
+		})
+
+		openDir := func(nodeId uint64) uint32 {
+			var out fuse.OpenOut
+			if st := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeId}}, &out); !st.Ok() {
+				t.Fatal(st)
+			}
+			return out.OpenFlags & (fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE)
+		}
+		want := uint32(0)
+		if defaultCache {
+			want = fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE
+		}
+		if got := openDir(1); got != want {
+			t.Errorf("default %v: root flags %x, want %x", defaultCache, got, want)
+		}
+		for _, cache := range []bool{false, true} {
+			var entry fuse.EntryOut
+			if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, fmt.Sprintf("cache=%v", cache), &entry); !st.Ok() {
+				t.Fatal(st)
+			}
+			want := uint32(0)
+			if cache {
+				want = fuse.FOPEN_CACHE_DIR | fuse.FOPEN_KEEP_CACHE
+			}
+			if got := openDir(entry.NodeId); got != want {
+				t.Errorf("default %v, cache=%v: flags %x, want %x", defaultCache, cache, got, want)
+			}
+		}
+	}
+}
+
+func TestReaddirNoOpendir(t *testing.T) {
+	root := &pagedDir{}
+	for i := 0; i < 10; i++ {
+		root.names = append(root.names, fmt.Sprintf("e%02d", i))
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	// Without OPENDIR, the kernel lists with file handle 0.
+	var all []string
+	for off := uint64(0); ; {
+		buf := make([]byte, 64)
+		in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Offset: off}
+		if st := rawFS.ReadDir(nil, &in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+			t.Fatalf("ReadDir(%d): %v", off, st)
+		}
+		var names []string
+		for p := 0; p+32 <= len(buf) && binary.LittleEndian.Uint64(buf[p:]) != 0; p += 32 {
+			names = append(names, string(buf[p+24:p+27]))
+		}
+		if len(names) == 0 {
+			break
+		}
+		all = append(all, names...)
+		off += uint64(len(names))
+	}
+	if got, want := strings.Join(all, ","), strings.Join(root.names, ","); got != want {
+		t.Errorf("listing: got %s, want %s", got, want)
+	}
+}
+
+func TestChildNames(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for _, name := range []string{"tmp.1", "tmp.2", "data", "tmp"} {
+				ch := root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+				root.AddChild(name, ch, false)
+			}
+		},
+	})
+
+	got := root.childNames(func(name string) bool { return strings.HasPrefix(name, "tmp.") })
+	sort.Strings(got)
+	if want := []string{"tmp.1", "tmp.2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type adaptiveNode struct {
+	Inode
+	size uint64
+}
+
+func (n *adaptiveNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = n.size
+	return 0
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	root := &Inode{}
+	node := &adaptiveNode{}
+	rawFS := NewNodeFS(root, &Options{
+		AdaptiveTimeout: &AdaptiveTimeout{Min: time.Second, Max: 3 * time.Second, Stable: 2},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatal(st)
+	}
+	if entry.AttrTimeout() != time.Second || entry.EntryTimeout() != time.Second {
+		t.Errorf("lookup: got timeouts %v, %v, want 1s", entry.AttrTimeout(), entry.EntryTimeout())
+	}
+
+	for i, tc := range []struct {
+		size uint64
+		want time.Duration
+	}{
+		{0, time.Second},
+		{0, 2 * time.Second},
+		{0, 2 * time.Second},
+		{0, 3 * time.Second},
+		{0, 3 * time.Second},
+		{0, 3 * time.Second},
+		{1, time.Second},
+	} {
+		node.size = tc.size
+		var out fuse.AttrOut
+		if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		if got := out.Timeout(); got != tc.want {
+			t.Errorf("%d: got timeout %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestAdaptiveTimeoutCheck(t *testing.T) {
+	for _, a := range []AdaptiveTimeout{
+		{Min: 0, Max: time.Second},
+		{Min: 2 * time.Second, Max: time.Second},
+		{Min: time.Second, Max: time.Second, Stable: -1},
+	} {
+		a := a
+		mustPanic(t, fmt.Sprintf("%+v", a), func() {
+			NewNodeFS(&Inode{}, &Options{AdaptiveTimeout: &a})
+		})
+	}
+	NewNodeFS(&Inode{}, &Options{AdaptiveTimeout: &AdaptiveTimeout{Min: time.Second, Max: time.Second}})
+}
+
+type fsyncNode struct {
+	Inode
+	flags []uint32
+}
+
+func (n *fsyncNode) Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	n.flags = append(n.flags, flags)
+	return 0
+}
+
+type scratchDir struct {
+	Inode
+}
+
+func (d *scratchDir) FsyncPolicy(ctx context.Context) (FsyncPolicy, bool) {
+	return FsyncNone, true
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	root := &Inode{}
+	file := &fsyncNode{}
+	scratchFile := &fsyncNode{}
+	rawFS := NewNodeFS(root, &Options{
+		FsyncPolicy: FsyncFull,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+			dir := root.NewPersistentInode(ctx, &scratchDir{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("scratch", dir, false)
+			dir.AddChild("file", dir.NewPersistentInode(ctx, scratchFile, StableAttr{}), false)
+		},
+	})
+
+	lookup := func(parent uint64, name string) uint64 {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		return out.NodeId
+	}
+	fileId := lookup(1, "file")
+	scratchId := lookup(lookup(1, "scratch"), "file")
+
+	for _, id := range []uint64{fileId, scratchId} {
+		in := &fuse.FsyncIn{InHeader: fuse.InHeader{NodeId: id}, FsyncFlags: fuse.FSYNC_FDATASYNC}
+		if st := rawFS.Fsync(nil, in); !st.Ok() {
+			t.Errorf("Fsync %d: %v", id, st)
+		}
+	}
+	if len(file.flags) != 1 || file.flags[0] != 0 {
+		t.Errorf("FsyncFull: got flags %v, want a full fsync", file.flags)
+	}
+	if len(scratchFile.flags) != 0 {
+		t.Errorf("FsyncNone: got calls with flags %v", scratchFile.flags)
+	}
+}
+
+func TestBatchForget(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for _, name := range []string{"a", "b", "c"} {
+				root.AddChild(name, root.NewInode(ctx, &Inode{}, StableAttr{}), false)
+			}
+		},
+	})
+	bridge := rawFS.(*rawBridge)
+
+	var forgets []fuse.ForgetOne
+	for _, name := range []string{"a", "b", "c"} {
+		var out fuse.EntryOut
+		for i := 0; i < 2; i++ {
+			if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+				t.Fatal(st)
+			}
+		}
+		forgets = append(forgets, fuse.ForgetOne{NodeId: out.NodeId, Nlookup: 2})
+	}
+	forgets[2].Nlookup = 1
+
+	bridge.BatchForget(forgets)
+	for i, f := range forgets {
+		bridge.mu.Lock()
+		n := bridge.kernelNodeIds[f.NodeId]
+		bridge.mu.Unlock()
+		if live := i == 2; (n != nil) != live {
+			t.Errorf("node %d: got %v, want live %v", f.NodeId, n, live)
+		}
+	}
+	if root.GetChild("a") != nil || root.GetChild("c") == nil {
+		t.Errorf("got children %v", root.Children())
+	}
+}
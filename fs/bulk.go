@@ -0,0 +1,140 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// BulkEntry describes a node to add with Inode.BulkAdd.
+type BulkEntry struct {
+	// Path is the slash-separated path of the entry, relative to
+	// the node BulkAdd is called on. All directories leading to
+	// it must exist, or be added by earlier entries.
+	Path string
+
+	// Node is the node to add. If it is nil, BulkAdd creates a
+	// node that returns Attr from Getattr.
+	Node InodeEmbedder
+
+	// Stable is the StableAttr of the node. If Stable.Mode or
+	// Stable.Ino are zero, they are taken from Attr. Entries with
+	// the same inode number are hard links to the same node.
+	Stable StableAttr
+
+	// Attr is returned by nodes that BulkAdd creates.
+	Attr fuse.Attr
+
+	// Persistent nodes stay in the tree until they are removed
+	// with RmChild or ForgetPersistent.
+	Persistent bool
+}
+
+// bulkNode is the node that BulkAdd creates for entries without Node.
+type bulkNode struct {
+	Inode
+	attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*bulkNode)(nil))
+
+func (n *bulkNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = n.attr
+	return 0
+}
+
+// BulkAdd adds entries to the tree below n, for example to restore a
+// tree from a snapshot without issuing a lookup for every name. It can
+// be called before or while the file system is served.
+//
+// The kernel does not know about the added nodes, so they start out
+// with no lookups. The kernel finds them through the LOOKUP of their
+// name, after which they follow the normal lifecycle: nodes that are
+// not persistent are dropped from the tree once the kernel forgets
+// them and they have no children.
+//
+// BulkAdd stops at the first entry that cannot be added, and returns
+// the number of entries added along with the error: ENOENT if a
+// parent directory is missing, ENOTDIR if it is not a directory, and
+// EEXIST if the name is taken by another node.
+func (n *Inode) BulkAdd(ctx context.Context, entries []BulkEntry) (int, syscall.Errno) {
+	b := n.bridge
+	dirs := map[string]*Inode{"": n}
+	links := map[StableAttr]*Inode{}
+	for i, e := range entries {
+		dirName, name := "", strings.Trim(e.Path, "/")
+		if j := strings.LastIndex(name, "/"); j >= 0 {
+			dirName, name = name[:j], name[j+1:]
+		}
+		if name == "" || name == "." || name == ".." {
+			return i, syscall.EINVAL
+		}
+
+		parent := dirs[dirName]
+		if parent == nil {
+			parent = n
+			for _, comp := range strings.Split(dirName, "/") {
+				if parent = parent.GetChild(comp); parent == nil {
+					return i, syscall.ENOENT
+				}
+			}
+			dirs[dirName] = parent
+		}
+		if !parent.IsDir() {
+			return i, syscall.ENOTDIR
+		}
+
+		id := e.Stable
+		if id.Mode == 0 {
+			id.Mode = e.Attr.Mode & syscall.S_IFMT
+		}
+		if id.Ino == 0 {
+			id.Ino = e.Attr.Ino
+		}
+		id.Mode &= syscall.S_IFMT
+
+		var child *Inode
+		if id.Ino != 0 {
+			if child = links[id]; child == nil {
+				b.mu.Lock()
+				child = b.stableAttrs[id]
+				b.mu.Unlock()
+			}
+		}
+		if child == nil {
+			ops := e.Node
+			if ops == nil {
+				ops = &bulkNode{attr: e.Attr}
+			}
+			child = b.newInode(ctx, ops, id, e.Persistent)
+		}
+		if id.Ino != 0 {
+			links[id] = child
+		}
+
+		if old := parent.GetChild(name); old == child {
+			continue
+		} else if old != nil || !parent.AddChild(name, child, false) {
+			return i, syscall.EEXIST
+		}
+		if child.IsDir() {
+			dirs[strings.Trim(e.Path, "/")] = child
+		}
+
+		// Drop negative entries the kernel may have cached for
+		// the name.
+		parent.mu.Lock()
+		known := parent.lookupCount > 0 || parent == b.root
+		parent.mu.Unlock()
+		if known && b.server != nil {
+			parent.NotifyEntry(name)
+		}
+	}
+	return len(entries), 0
+}
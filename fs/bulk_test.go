@@ -0,0 +1,76 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestBulkAdd(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	entries := []BulkEntry{
+		{Path: "dir", Attr: fuse.Attr{Ino: 10, Mode: syscall.S_IFDIR | 0755}, Persistent: true},
+		{Path: "dir/file", Attr: fuse.Attr{Ino: 11, Mode: syscall.S_IFREG | 0644, Size: 42}},
+		{Path: "dir/link", Attr: fuse.Attr{Ino: 11, Mode: syscall.S_IFREG | 0644, Size: 42}},
+		{Path: "mem", Node: &MemRegularFile{Data: []byte("hello")}, Persistent: true},
+	}
+	if n, errno := root.BulkAdd(ctx, entries); errno != 0 || n != len(entries) {
+		t.Fatalf("BulkAdd: %d, %v", n, errno)
+	}
+	dir := root.GetChild("dir")
+	if dir.GetChild("file") != dir.GetChild("link") {
+		t.Errorf("hard link was not shared")
+	}
+
+	for _, tc := range []struct {
+		entries []BulkEntry
+		errno   syscall.Errno
+	}{
+		{[]BulkEntry{{Path: "missing/file"}}, syscall.ENOENT},
+		{[]BulkEntry{{Path: "mem/file"}}, syscall.ENOTDIR},
+		{[]BulkEntry{{Path: "dir/file"}}, syscall.EEXIST},
+		{[]BulkEntry{{Path: "dir/x"}, {Path: ".."}}, syscall.EINVAL},
+	} {
+		n, errno := root.BulkAdd(ctx, tc.entries)
+		if errno != tc.errno || n != len(tc.entries)-1 {
+			t.Errorf("BulkAdd(%v): got %d, %v, want %v", tc.entries, n, errno, tc.errno)
+		}
+	}
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "dir", &out); !st.Ok() {
+		t.Fatalf("Lookup(dir): %v", st)
+	}
+	dirId := out.NodeId
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: dirId}, "file", &out); !st.Ok() {
+		t.Fatalf("Lookup(file): %v", st)
+	}
+	if out.Ino != 11 || out.Size != 42 {
+		t.Errorf("got attr %v, want ino 11, size 42", out.Attr)
+	}
+
+	file := dir.GetChild("file")
+	if file.lookupCount != 1 {
+		t.Errorf("got lookupCount %d, want 1", file.lookupCount)
+	}
+
+	// The file is not persistent, so it is dropped when the
+	// kernel forgets it.
+	rawFS.Forget(out.NodeId, 1)
+	if dir.GetChild("file") != nil || dir.GetChild("link") != nil {
+		t.Errorf("forgotten file is still in the tree")
+	}
+	rawFS.Forget(dirId, 1)
+	if root.GetChild("dir") != dir {
+		t.Errorf("persistent dir was dropped")
+	}
+}
@@ -19,9 +19,17 @@ func ToErrno(err error) syscall.Errno {
 	return syscall.Errno(s)
 }
 
+// RENAME_NOREPLACE is a flag argument for renameat2(). The rename
+// fails with EEXIST if the destination exists.
+const RENAME_NOREPLACE = 0x1
+
 // RENAME_EXCHANGE is a flag argument for renameat2()
 const RENAME_EXCHANGE = 0x2
 
+// RENAME_WHITEOUT is a flag argument for renameat2(). It leaves an
+// overlayfs whiteout in place of the source.
+const RENAME_WHITEOUT = 0x4
+
 // seek to the next data
 const _SEEK_DATA = 3
 
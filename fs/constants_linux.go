@@ -8,3 +8,11 @@ import "syscall"
 
 // ENOATTR indicates that an extended attribute was not present.
 var ENOATTR = syscall.ENODATA
+
+// Mask for the statx(2) flags that control synchronization with a
+// remote server.
+const _AT_STATX_SYNC_TYPE = 0x6000
+
+// Flag for the *at(2) calls to operate on the file descriptor
+// itself, missing from golang.org/x/sys/unix.
+const _AT_EMPTY_PATH = 0x1000
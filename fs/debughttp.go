@@ -0,0 +1,197 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// DebugHandler returns a read-only HTTP handler that serves the tree
+// below root straight from the node operations, without going
+// through the kernel. This helps to inspect the file system when the
+// mount itself is stuck. Requests are served as follows:
+//
+//	GET /dir/         lists the children of dir
+//	GET /dir/file     returns the contents of file
+//	GET /dir/link     returns the target of a symlink
+//	GET /path?attr    returns the attributes of path as JSON
+//
+// Only the Inodes that are in the tree are served, ie. the ones the
+// kernel has looked up, and persistent ones. Files are opened
+// read-only with the uid and gid of the process. The handler does
+// not authenticate requests, so it should only be served on a
+// trusted address.
+func DebugHandler(root *Inode) http.Handler {
+	return &debugHandler{root: root}
+}
+
+type debugHandler struct {
+	root *Inode
+}
+
+func (h *debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := h.root
+	for _, name := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n = n.GetChild(name); n == nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	ctx := &fuse.Context{
+		Caller: fuse.Caller{
+			Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+			Pid:   uint32(os.Getpid()),
+		},
+		Cancel: r.Context().Done(),
+	}
+
+	var errno syscall.Errno
+	switch {
+	case r.URL.Query()["attr"] != nil:
+		errno = h.serveAttr(ctx, w, n)
+	case n.IsDir():
+		h.serveDir(w, n)
+	case n.Mode()&syscall.S_IFMT == syscall.S_IFLNK:
+		errno = h.serveLink(ctx, w, n)
+	case n.Mode()&syscall.S_IFMT == syscall.S_IFREG:
+		errno = h.serveFile(ctx, w, n)
+	default:
+		errno = syscall.EINVAL
+	}
+	if errno != 0 {
+		http.Error(w, errno.Error(), debugHTTPStatus(errno))
+	}
+}
+
+func debugHTTPStatus(errno syscall.Errno) int {
+	switch errno {
+	case syscall.ENOENT:
+		return http.StatusNotFound
+	case syscall.EACCES, syscall.EPERM:
+		return http.StatusForbidden
+	case syscall.EINVAL:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *debugHandler) serveAttr(ctx context.Context, w http.ResponseWriter, n *Inode) syscall.Errno {
+	var out fuse.AttrOut
+	if errno := n.bridge.getattr(ctx, n, nil, &out); errno != 0 {
+		return errno
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(&out.Attr)
+	return OK
+}
+
+func (h *debugHandler) serveDir(w http.ResponseWriter, n *Inode) {
+	children := n.Children()
+	names := make([]string, 0, len(children))
+	for k := range children {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		ch := children[name]
+		if ch.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s i%d %s\n", modeStr(ch.Mode()), ch.StableAttr().Ino, name)
+	}
+}
+
+func (h *debugHandler) serveLink(ctx context.Context, w http.ResponseWriter, n *Inode) syscall.Errno {
+	rl, ok := n.ops.(NodeReadlinker)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	target, errno := rl.Readlink(ctx)
+	if errno != 0 {
+		return errno
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(target)
+	return OK
+}
+
+func (h *debugHandler) serveFile(ctx context.Context, w http.ResponseWriter, n *Inode) syscall.Errno {
+	var f FileHandle
+	if op, ok := n.ops.(NodeOpener); ok {
+		var errno syscall.Errno
+		f, _, errno = op.Open(ctx, syscall.O_RDONLY)
+		if errno != 0 {
+			return errno
+		}
+		defer func() {
+			if r, ok := n.ops.(NodeReleaser); ok {
+				r.Release(ctx, f)
+			} else if r, ok := f.(FileReleaser); ok {
+				r.Release(ctx)
+			}
+		}()
+	}
+
+	nr, _ := n.ops.(NodeReader)
+	fr, _ := f.(FileReader)
+	if nr == nil && fr == nil {
+		return syscall.ENOTSUP
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	buf := make([]byte, 128*1024)
+	for off := int64(0); ; {
+		var res fuse.ReadResult
+		var errno syscall.Errno
+		if nr != nil {
+			res, errno = nr.Read(ctx, f, buf, off)
+		} else {
+			res, errno = fr.Read(ctx, buf, off)
+		}
+		if errno != 0 {
+			if off == 0 {
+				return errno
+			}
+			return OK
+		}
+		data, st := res.Bytes(buf)
+		var err error
+		if st == 0 && len(data) > 0 {
+			_, err = w.Write(data)
+		}
+		res.Done()
+		if st != 0 && off == 0 {
+			return syscall.Errno(st)
+		}
+		if st != 0 || len(data) == 0 || err != nil {
+			// Once data is sent, errors can't be reported.
+			return OK
+		}
+		off += int64(len(data))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDebugHandler(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			dir.AddChild("file", root.NewPersistentInode(ctx,
+				&MemRegularFile{Data: []byte("hello")}, StableAttr{Ino: 42}), false)
+			dir.AddChild("link", root.NewPersistentInode(ctx,
+				&MemSymlink{Data: []byte("file")}, StableAttr{Mode: fuse.S_IFLNK}), false)
+		},
+	})
+
+	srv := httptest.NewServer(DebugHandler(root))
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/"); code != 200 || !strings.HasPrefix(body, "dir ") || !strings.HasSuffix(body, " dir/\n") {
+		t.Errorf("root: got %d %q", code, body)
+	}
+	if code, body := get("/dir/"); code != 200 || !strings.Contains(body, "reg i42 file\n") || !strings.Contains(body, " link\n") {
+		t.Errorf("dir: got %d %q", code, body)
+	}
+	if code, body := get("/dir/file"); code != 200 || body != "hello" {
+		t.Errorf("file: got %d %q", code, body)
+	}
+	if code, body := get("/dir/link"); code != 200 || body != "file" {
+		t.Errorf("link: got %d %q", code, body)
+	}
+	if code, _ := get("/dir/missing"); code != http.StatusNotFound {
+		t.Errorf("missing: got %d", code)
+	}
+
+	code, body := get("/dir/file?attr")
+	var attr fuse.Attr
+	if err := json.Unmarshal([]byte(body), &attr); code != 200 || err != nil {
+		t.Fatalf("attr: got %d %q: %v", code, body, err)
+	}
+	if attr.Ino != 42 || attr.Size != 5 {
+		t.Errorf("attr: got %+v", attr)
+	}
+
+	resp, err := http.Post(srv.URL+"/dir/file", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d", resp.StatusCode)
+	}
+}
@@ -5,6 +5,7 @@
 package fs
 
 import (
+	"context"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -32,3 +33,72 @@ func (a *dirArray) Close() {
 func NewListDirStream(list []fuse.DirEntry) DirStream {
 	return &dirArray{list}
 }
+
+// pagedDirStream is a DirStream over a NodeReaddirPager. Pages are
+// fetched when the entries of the previous page are used up.
+type pagedDirStream struct {
+	ctx   context.Context
+	pager NodeReaddirPager
+
+	// off is the directory offset of the next entry.
+	off     uint64
+	token   string
+	eof     bool
+	entries []fuse.DirEntry
+	errno   syscall.Errno
+
+	// mark, if set, is called with the offset and token of each
+	// page but the first.
+	mark func(off uint64, token string)
+}
+
+// newPagedDirStream returns a stream that starts at the page for
+// token, which is at directory offset off.
+func newPagedDirStream(ctx context.Context, pager NodeReaddirPager, off uint64, token string) *pagedDirStream {
+	return &pagedDirStream{
+		ctx:   ctx,
+		pager: pager,
+		off:   off,
+		token: token,
+	}
+}
+
+func (s *pagedDirStream) HasNext() bool {
+	for len(s.entries) == 0 && !s.eof && s.errno == 0 {
+		s.fetch()
+	}
+	return len(s.entries) > 0 || s.errno != 0
+}
+
+func (s *pagedDirStream) fetch() {
+	if s.token != "" && s.mark != nil {
+		s.mark(s.off, s.token)
+	}
+	entries, next, errno := s.pager.ReaddirPage(s.ctx, s.token)
+	if errno != 0 {
+		s.errno = errno
+		return
+	}
+	s.entries = entries
+	s.token = next
+	s.eof = next == ""
+}
+
+func (s *pagedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.HasNext() {
+		return fuse.DirEntry{}, syscall.EBADF
+	}
+	if errno := s.errno; errno != 0 {
+		// Clear the error, so the page is fetched again on
+		// the next call.
+		s.errno = 0
+		return fuse.DirEntry{}, errno
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	s.off++
+	return e, 0
+}
+
+func (s *pagedDirStream) Close() {
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Features are the optional kernel features of a mount. In
+// Options.Features, they select the features to ask the kernel for;
+// Inode.EffectiveFeatures reports the ones that are in use, so code
+// can branch on them in one place.
+type Features struct {
+	// ReadDirPlus returns the attributes of the entries along with
+	// directory listings, so "ls -l" needs no separate lookups.
+	ReadDirPlus bool
+
+	// ReadDirPlusAuto lets the kernel choose between READDIR and
+	// READDIRPLUS per request, see
+	// fuse.MountOptions.ReadDirPlusAuto. It needs ReadDirPlus.
+	ReadDirPlusAuto bool
+
+	// ParallelDirOps lets the kernel send lookups and readdirs
+	// within the same directory concurrently.
+	ParallelDirOps bool
+
+	// Writeback enables the kernel writeback cache: writes are
+	// gathered in the page cache, and the kernel owns the file
+	// size and modification time. See Options.AppendMode.
+	Writeback bool
+
+	// Passthrough lets the kernel serve I/O on open files from a
+	// registered backing file, see
+	// fuse.MountOptions.EnablePassthrough.
+	Passthrough bool
+
+	// Locks forwards POSIX and BSD file locks to the file system.
+	Locks bool
+
+	// Acl makes the kernel enforce POSIX ACLs.
+	Acl bool
+}
+
+// apply sets the fields of o that select the features.
+func (f *Features) apply(o *fuse.MountOptions) {
+	o.DisableReadDirPlus = !f.ReadDirPlus
+	o.ReadDirPlusAuto = f.ReadDirPlusAuto
+	o.DisableParallelDirOps = !f.ParallelDirOps
+	o.EnableWriteback = f.Writeback
+	o.EnablePassthrough = f.Passthrough
+	o.EnableLocks = f.Locks
+	o.EnableAcl = f.Acl
+}
+
+// featuresOf returns the features that are enabled by the flags
+// negotiated with the kernel.
+func featuresOf(flags uint64) Features {
+	return Features{
+		ReadDirPlus:     flags&fuse.CAP_READDIRPLUS != 0,
+		ReadDirPlusAuto: flags&fuse.CAP_READDIRPLUS_AUTO != 0,
+		ParallelDirOps:  flags&fuse.CAP_PARALLEL_DIROPS != 0,
+		Writeback:       flags&fuse.CAP_WRITEBACK_CACHE != 0,
+		Passthrough:     flags&fuse.CAP_PASSTHROUGH != 0,
+		Locks:           flags&(fuse.CAP_POSIX_LOCKS|fuse.CAP_FLOCK_LOCKS) != 0,
+		Acl:             flags&fuse.CAP_POSIX_ACL != 0,
+	}
+}
+
+// mountOptions returns the options to pass to the fuse.Server, with
+// Features applied.
+func (o *Options) mountOptions() *fuse.MountOptions {
+	if o.Features == nil {
+		return &o.MountOptions
+	}
+	mo := o.MountOptions
+	o.Features.apply(&mo)
+	return &mo
+}
+
+// features returns the features that are in use.
+func (b *rawBridge) features() Features {
+	s, ok := b.server.(*fuse.Server)
+	if !ok {
+		return Features{}
+	}
+	return featuresOf(s.KernelSettings().Flags64())
+}
+
+// EffectiveFeatures returns the features of the mount that are in
+// use: the ones that were asked for, and that the kernel supports.
+// Before the file system is mounted, it returns no features.
+func (n *Inode) EffectiveFeatures() Features {
+	if n.bridge == nil {
+		return Features{}
+	}
+	return n.bridge.features()
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestFeaturesMountOptions(t *testing.T) {
+	opts := &Options{}
+	opts.EnableWriteback = true
+	if mo := opts.mountOptions(); mo != &opts.MountOptions {
+		t.Errorf("mount options were copied without Features")
+	}
+
+	opts.Features = &Features{ReadDirPlus: true, Passthrough: true, Locks: true}
+	mo := opts.mountOptions()
+	if mo.EnableWriteback || !mo.EnablePassthrough || !mo.EnableLocks || mo.EnableAcl {
+		t.Errorf("Features not applied: %+v", mo)
+	}
+	if mo.DisableReadDirPlus || !mo.DisableParallelDirOps {
+		t.Errorf("got DisableReadDirPlus %v, DisableParallelDirOps %v", mo.DisableReadDirPlus, mo.DisableParallelDirOps)
+	}
+	if !opts.EnableWriteback || opts.EnablePassthrough {
+		t.Errorf("Options.MountOptions was changed: %+v", opts.MountOptions)
+	}
+}
+
+func TestEffectiveFeatures(t *testing.T) {
+	flags := uint64(fuse.CAP_READDIRPLUS | fuse.CAP_PARALLEL_DIROPS | fuse.CAP_FLOCK_LOCKS | fuse.CAP_PASSTHROUGH)
+	want := Features{ReadDirPlus: true, ParallelDirOps: true, Locks: true, Passthrough: true}
+	if got := featuresOf(flags); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	root := &Inode{}
+	NewNodeFS(root, &Options{})
+	if got := root.EffectiveFeatures(); got != (Features{}) {
+		t.Errorf("unmounted file system has features %+v", got)
+	}
+}
@@ -34,6 +34,7 @@ var _ = (FileReleaser)((*loopbackFile)(nil))
 var _ = (FileGetattrer)((*loopbackFile)(nil))
 var _ = (FileReader)((*loopbackFile)(nil))
 var _ = (FileWriter)((*loopbackFile)(nil))
+var _ = (FileWriteSplicer)((*loopbackFile)(nil))
 var _ = (FileGetlker)((*loopbackFile)(nil))
 var _ = (FileSetlker)((*loopbackFile)(nil))
 var _ = (FileSetlkwer)((*loopbackFile)(nil))
@@ -42,6 +43,7 @@ var _ = (FileFlusher)((*loopbackFile)(nil))
 var _ = (FileFsyncer)((*loopbackFile)(nil))
 var _ = (FileSetattrer)((*loopbackFile)(nil))
 var _ = (FileAllocater)((*loopbackFile)(nil))
+var _ = (FilePassthroughFder)((*loopbackFile)(nil))
 
 func (f *loopbackFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
 	f.mu.Lock()
@@ -54,9 +56,26 @@ func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (uint3
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	n, err := syscall.Pwrite(f.fd, data, off)
+	if err == nil && killSuidGid(ctx) {
+		return uint32(n), clearSuidGid(f.fd)
+	}
+	return uint32(n), ToErrno(err)
+}
+
+func (f *loopbackFile) WriteSplice(ctx context.Context, data *fuse.WriteData, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := data.SpliceTo(uintptr(f.fd), off)
+	if err == nil && killSuidGid(ctx) {
+		return uint32(n), clearSuidGid(f.fd)
+	}
 	return uint32(n), ToErrno(err)
 }
 
+func (f *loopbackFile) PassthroughFd() (int, bool) {
+	return f.fd, true
+}
+
 func (f *loopbackFile) Release(ctx context.Context) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -99,10 +118,25 @@ const (
 
 func (f *loopbackFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (errno syscall.Errno) {
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	fd := f.fd
+	key, errno := ownerLockKeyFor(fd, owner)
+	var ol *ownerLock
+	if errno == OK {
+		ol, errno = acquireOwnerLock(key, fd, false)
+	}
+	f.mu.Unlock()
+	if errno != OK {
+		return errno
+	}
+	if ol != nil {
+		// The owner's own locks don't conflict.
+		fd = ol.fd
+		defer releaseOwnerLock(key, ol, nil, OK)
+	}
+
 	flk := syscall.Flock_t{}
 	lk.ToFlockT(&flk)
-	errno = ToErrno(syscall.FcntlFlock(uintptr(f.fd), _OFD_GETLK, &flk))
+	errno = ToErrno(syscall.FcntlFlock(uintptr(fd), _OFD_GETLK, &flk))
 	out.FromFlockT(&flk)
 	return
 }
@@ -116,9 +150,9 @@ func (f *loopbackFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLo
 }
 
 func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) (errno syscall.Errno) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
 	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
 		var op int
 		switch lk.Typ {
 		case syscall.F_RDLCK:
@@ -134,17 +168,34 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 			op |= syscall.LOCK_NB
 		}
 		return ToErrno(syscall.Flock(f.fd, op))
+	}
+
+	// fcntl locks are scoped to their owner, see ownerLock. The
+	// file is not locked while waiting, so the owner holding the
+	// lock can still use it.
+	f.mu.Lock()
+	key, errno := ownerLockKeyFor(f.fd, owner)
+	var ol *ownerLock
+	if errno == OK {
+		ol, errno = acquireOwnerLock(key, f.fd, lk.Typ != syscall.F_UNLCK)
+	}
+	f.mu.Unlock()
+	if errno != OK || ol == nil {
+		// Unlocking without locks is a no-op.
+		return errno
+	}
+
+	flk := syscall.Flock_t{}
+	lk.ToFlockT(&flk)
+	var op int
+	if blocking {
+		op = _OFD_SETLKW
 	} else {
-		flk := syscall.Flock_t{}
-		lk.ToFlockT(&flk)
-		var op int
-		if blocking {
-			op = _OFD_SETLKW
-		} else {
-			op = _OFD_SETLK
-		}
-		return ToErrno(syscall.FcntlFlock(uintptr(f.fd), op, &flk))
+		op = _OFD_SETLK
 	}
+	errno = ToErrno(syscall.FcntlFlock(uintptr(ol.fd), op, &flk))
+	releaseOwnerLock(key, ol, lk, errno)
+	return errno
 }
 
 func (f *loopbackFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
@@ -207,6 +258,11 @@ func (f *loopbackFile) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.
 		if errno != 0 {
 			return errno
 		}
+		if in.KillSuidGid() {
+			if errno := clearSuidGid(f.fd); errno != 0 {
+				return errno
+			}
+		}
 	}
 	return OK
 }
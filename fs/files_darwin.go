@@ -4,7 +4,21 @@
 
 package fs
 
-import "github.com/hanwen/go-fuse/v2/fuse"
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
 
 func setBlocks(out *fuse.Attr) {
 }
+
+func setBlksize(out *fuse.Attr) {
+}
+
+func setStatxBlocks(out *fuse.Statx) {
+}
+
+func reopenFd(fd int, flags int) (int, error) {
+	return -1, syscall.ENOTSUP
+}
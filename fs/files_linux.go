@@ -6,10 +6,12 @@ package fs
 
 import (
 	"context"
+	"fmt"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
@@ -22,6 +24,31 @@ func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode
 	return OK
 }
 
+var _ = (FileStatxer)((*loopbackFile)(nil))
+
+func (f *loopbackFile) Statx(ctx context.Context, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := unix.Statx_t{}
+	err := unix.Statx(f.fd, "", unix.AT_EMPTY_PATH|int(flags)&_AT_STATX_SYNC_TYPE, int(mask), &st)
+	if err == syscall.ENOSYS {
+		// statx(2) is not available, fall back to fstat.
+		var sst syscall.Stat_t
+		if err := syscall.Fstat(f.fd, &sst); err != nil {
+			return ToErrno(err)
+		}
+		var attr fuse.Attr
+		attr.FromStat(&sst)
+		out.Statx.FromAttr(&attr)
+		return OK
+	}
+	if err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatx(&st)
+	return OK
+}
+
 // Utimens - file handle based version of loopbackFileSystem.Utimens()
 func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	var ts [2]syscall.Timespec
@@ -36,7 +63,25 @@ func setBlocks(out *fuse.Attr) {
 		return
 	}
 
-	out.Blksize = 4096
-	pages := (out.Size + 4095) / 4096
-	out.Blocks = pages * 8
+	setBlksize(out)
+	out.Blocks = BlocksForBytes(out.Size)
+}
+
+func setBlksize(out *fuse.Attr) {
+	out.Blksize = allocBlockSize
+}
+
+// setStatxBlocks is setBlocks for STATX replies.
+func setStatxBlocks(out *fuse.Statx) {
+	if out.Blksize > 0 {
+		return
+	}
+	out.Blksize = allocBlockSize
+	out.Blocks = BlocksForBytes(out.Size)
+}
+
+// reopenFd opens the file of fd again, yielding a new open file
+// description.
+func reopenFd(fd int, flags int) (int, error) {
+	return syscall.Open(fmt.Sprintf("/proc/self/fd/%d", fd), flags|syscall.O_CLOEXEC, 0)
 }
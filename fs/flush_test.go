@@ -0,0 +1,100 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// flushNode opens files that fail to flush with flushErrno, or that
+// hang in Fsync if hang is set.
+type flushNode struct {
+	Inode
+	flushErrno syscall.Errno
+	hang       bool
+}
+
+var _ = (NodeOpener)((*flushNode)(nil))
+
+func (n *flushNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &flushFile{n}, 0, 0
+}
+
+type flushFile struct {
+	node *flushNode
+}
+
+var _ = (FileFlusher)((*flushFile)(nil))
+var _ = (FileFsyncer)((*flushFile)(nil))
+
+func (f *flushFile) Flush(ctx context.Context) syscall.Errno {
+	return f.node.flushErrno
+}
+
+func (f *flushFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	if f.node.hang {
+		<-ctx.(*fuse.Context).Cancel
+		return syscall.EINTR
+	}
+	return 0
+}
+
+func TestFlushOpenFiles(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for name, n := range map[string]*flushNode{
+				"ok":       {},
+				"fail":     {flushErrno: syscall.EIO},
+				"hang":     {hang: true},
+				"readonly": {flushErrno: syscall.EIO},
+			} {
+				root.AddChild(name, root.NewPersistentInode(ctx, n, StableAttr{}), false)
+			}
+		},
+	})
+
+	open := func(name string, flags uint32) (nodeId, fh uint64) {
+		t.Helper()
+		var entry fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: flags}, &out); !st.Ok() {
+			t.Fatalf("Open(%q): %v", name, st)
+		}
+		return entry.NodeId, out.Fh
+	}
+	open("ok", syscall.O_WRONLY)
+	failId, failFh := open("fail", syscall.O_RDWR)
+	hangId, hangFh := open("hang", syscall.O_WRONLY)
+	open("readonly", syscall.O_RDONLY)
+
+	cancel := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancel) })
+	failures := rawFS.(fuse.OpenFileFlusher).FlushOpenFiles(cancel)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].NodeId < failures[j].NodeId })
+
+	want := []fuse.FlushFailure{
+		{NodeId: failId, Fh: failFh, Status: fuse.EIO},
+		{NodeId: hangId, Fh: hangFh, Status: fuse.Status(syscall.ETIMEDOUT)},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].NodeId < want[j].NodeId })
+	if len(failures) != len(want) {
+		t.Fatalf("got failures %v, want %v", failures, want)
+	}
+	for i := range want {
+		if failures[i] != want[i] {
+			t.Errorf("failure %d: got %v, want %v", i, failures[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// The bridge passes the nodes and file handles that the kernel knows
+// about on to the process taking over with fuse.Server.HandOff. The
+// process taking over finds the nodes again by their path, through
+// the children in its tree and Lookup, and reopens the files. Nodes
+// that cannot be found again, such as unlinked files, answer ESTALE.
+// Passthrough files are reopened without passthrough.
+
+// handOffNode is a node known to the kernel.
+type handOffNode struct {
+	NodeId  uint64
+	Lookups uint64
+	Mode    uint32
+	Ino     uint64
+	Gen     uint64
+
+	// Path holds the names from the root to the node, and is nil
+	// if the node is not in the tree.
+	Path []string
+
+	// Readers and Writers count the opens without a file handle,
+	// which the kernel releases with handle 0.
+	Readers uint32
+	Writers uint32
+}
+
+// handOffFile is an open file handle.
+type handOffFile struct {
+	Fh     uint32
+	NodeId uint64
+	Flags  uint32
+}
+
+type handOffState struct {
+	NextNodeId   uint64
+	AutomaticIno uint64
+	Nodes        []handOffNode
+	Files        []handOffFile
+}
+
+var _ = (fuse.HandOffSaver)((*rawBridge)(nil))
+var _ = (fuse.HandOffRestorer)((*rawBridge)(nil))
+
+// SaveHandOff implements fuse.HandOffSaver.
+func (b *rawBridge) SaveHandOff() ([]byte, error) {
+	b.mu.Lock()
+	st := handOffState{
+		NextNodeId:   b.nextNodeId,
+		AutomaticIno: b.automaticIno,
+	}
+	nodes := make([]*Inode, 0, len(b.kernelNodeIds))
+	for _, n := range b.kernelNodeIds {
+		nodes = append(nodes, n)
+	}
+	b.mu.Unlock()
+
+	for _, n := range nodes {
+		n.mu.Lock()
+		hn := handOffNode{
+			NodeId:  n.nodeId,
+			Lookups: n.lookupCount,
+			Mode:    n.stableAttr.Mode,
+			Ino:     n.stableAttr.Ino,
+			Gen:     n.stableAttr.Gen,
+		}
+		n.mu.Unlock()
+		hn.Path = b.handOffPath(n)
+
+		n.mu.Lock()
+		b.mu.Lock()
+		hn.Readers, hn.Writers = n.openReaders, n.openWriters
+		for _, fh := range n.openFiles {
+			flags := b.files[fh].openFlags
+			st.Files = append(st.Files, handOffFile{Fh: fh, NodeId: hn.NodeId, Flags: flags})
+			if n.IsDir() {
+				continue
+			} else if flags&syscall.O_ACCMODE == syscall.O_RDONLY && hn.Readers > 0 {
+				hn.Readers--
+			} else if flags&syscall.O_ACCMODE != syscall.O_RDONLY && hn.Writers > 0 {
+				hn.Writers--
+			}
+		}
+		b.mu.Unlock()
+		n.mu.Unlock()
+		st.Nodes = append(st.Nodes, hn)
+	}
+
+	// Restore parents before their children.
+	sort.Slice(st.Nodes, func(i, j int) bool {
+		return len(st.Nodes[i].Path) < len(st.Nodes[j].Path)
+	})
+	return json.Marshal(&st)
+}
+
+// handOffPath returns the names leading from the root to n, or nil
+// if n is not in the tree.
+func (b *rawBridge) handOffPath(n *Inode) []string {
+	path := []string{}
+	for p := n; p != b.root; {
+		p.mu.Lock()
+		pd := p.parents.get()
+		p.mu.Unlock()
+		if pd == nil {
+			return nil
+		}
+		path = append([]string{pd.name}, path...)
+		p = pd.parent
+	}
+	return path
+}
+
+// staleNode stands in for nodes that could not be found again after
+// a hand-off.
+type staleNode struct {
+	Inode
+}
+
+var _ = (NodeGetattrer)((*staleNode)(nil))
+var _ = (NodeOpener)((*staleNode)(nil))
+
+func (n *staleNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return syscall.ESTALE
+}
+
+func (n *staleNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, syscall.ESTALE
+}
+
+// RestoreHandOff implements fuse.HandOffRestorer.
+func (b *rawBridge) RestoreHandOff(data []byte) error {
+	var st handOffState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if st.NextNodeId > b.nextNodeId {
+		b.nextNodeId = st.NextNodeId
+	}
+	if st.AutomaticIno > b.automaticIno {
+		b.automaticIno = st.AutomaticIno
+	}
+	b.mu.Unlock()
+
+	ctx := &fuse.Context{}
+	nodes := map[uint64]*Inode{}
+	for _, hn := range st.Nodes {
+		n := b.root
+		if hn.NodeId != 1 {
+			n = b.restoreNode(ctx, &hn)
+		}
+		n.mu.Lock()
+		b.mu.Lock()
+		n.nodeId = hn.NodeId
+		n.lookupCount = hn.Lookups
+		b.kernelNodeIds[n.nodeId] = n
+		if _, stale := n.ops.(*staleNode); !stale && n != b.root {
+			// Stale nodes must not be found by inode number,
+			// which may be reused already.
+			b.stableAttrs[n.stableAttr] = n
+		}
+		b.mu.Unlock()
+		n.mu.Unlock()
+		nodes[hn.NodeId] = n
+	}
+
+	sort.Slice(st.Files, func(i, j int) bool { return st.Files[i].Fh < st.Files[j].Fh })
+	used := map[uint32]bool{}
+	for _, hf := range st.Files {
+		n := nodes[hf.NodeId]
+		if n == nil {
+			continue
+		}
+		b.restoreFile(ctx, n, hf.Fh, hf.Flags)
+		used[hf.Fh] = true
+	}
+	for _, hn := range st.Nodes {
+		n := nodes[hn.NodeId]
+		for i := uint32(0); i < hn.Readers; i++ {
+			n.addOpen(ctx, syscall.O_RDONLY)
+		}
+		for i := uint32(0); i < hn.Writers; i++ {
+			n.addOpen(ctx, syscall.O_WRONLY)
+		}
+	}
+	b.mu.Lock()
+	for fh := len(b.files) - 1; fh > 0; fh-- {
+		if !used[uint32(fh)] {
+			b.freeFiles = append(b.freeFiles, uint32(fh))
+		}
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// restoreNode finds the node for hn by its path, or returns a
+// staleNode.
+func (b *rawBridge) restoreNode(ctx *fuse.Context, hn *handOffNode) *Inode {
+	id := StableAttr{Mode: hn.Mode, Ino: hn.Ino, Gen: hn.Gen}
+	b.mu.Lock()
+	n := b.stableAttrs[id]
+	b.mu.Unlock()
+	if n != nil {
+		return n
+	}
+
+	if hn.Path != nil {
+		n = b.root
+		for _, name := range hn.Path {
+			if n = b.restoreChild(ctx, n, name); n == nil {
+				break
+			}
+		}
+		if n != nil && n.stableAttr.Mode == hn.Mode {
+			return n
+		}
+	}
+	b.logf("hand-off: n%d (%v) not found, answering ESTALE", hn.NodeId, hn.Path)
+	return b.newInode(ctx, &staleNode{}, id, false)
+}
+
+// restoreChild returns the child of parent by the given name, looking
+// it up if it is not in the tree.
+func (b *rawBridge) restoreChild(ctx *fuse.Context, parent *Inode, name string) *Inode {
+	if ch := parent.GetChild(name); ch != nil {
+		return ch
+	}
+	var out fuse.EntryOut
+	ch, errno := b.lookup(ctx, parent, name, &out)
+	if errno != 0 {
+		return nil
+	}
+	parent.AddChild(name, ch, false)
+	return parent.GetChild(name)
+}
+
+// restoreFile reopens a file, and registers it under the handle that
+// the kernel knows it by.
+func (b *rawBridge) restoreFile(ctx *fuse.Context, n *Inode, fh uint32, flags uint32) {
+	var f FileHandle
+	inline := false
+	if !n.IsDir() {
+		var errno syscall.Errno
+		inline, errno = b.openInline(ctx, n)
+		if errno == 0 && !inline {
+			if op, ok := n.ops.(NodeOpener); ok {
+				f, _, errno = op.Open(ctx, flags&^(syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC))
+			}
+		}
+		if errno != 0 {
+			b.logf("hand-off: reopen n%d: %v", n.nodeId, errno)
+		}
+		n.addOpen(ctx, flags)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for uint32(len(b.files)) <= fh {
+		b.files = append(b.files, &fileEntry{})
+	}
+	entry := b.files[fh]
+	entry.nodeIndex = len(n.openFiles)
+	entry.file = f
+	entry.inline = inline
+	entry.openFlags = flags
+	n.openFiles = append(n.openFiles, fh)
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestHandOffNodes(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(dir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/file", "gone"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newFS := func() fuse.RawFileSystem {
+		root, err := NewLoopbackRoot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewNodeFS(root, &Options{})
+	}
+	lookup := func(fs fuse.RawFileSystem, parent uint64, name string) uint64 {
+		t.Helper()
+		var out fuse.EntryOut
+		if st := fs.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return out.NodeId
+	}
+
+	oldFS := newFS()
+	dirId := lookup(oldFS, 1, "dir")
+	fileId := lookup(oldFS, dirId, "file")
+	goneId := lookup(oldFS, 1, "gone")
+	var openOut fuse.OpenOut
+	if st := oldFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fileId}, Flags: syscall.O_RDWR}, &openOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	fh := openOut.Fh
+
+	state, err := oldFS.(fuse.HandOffSaver).SaveHandOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dir + "/gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFS()
+	if err := fs.(fuse.HandOffRestorer).RestoreHandOff(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The open file is served under its old handle.
+	buf := make([]byte, 10)
+	res, st := fs.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: fileId}, Fh: fh, Size: uint32(len(buf))}, buf)
+	if !st.Ok() {
+		t.Fatalf("Read: %v", st)
+	}
+	if data, _ := res.Bytes(buf); string(data) != "hello" {
+		t.Errorf("got %q, want hello", data)
+	}
+	fs.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: fileId}, Fh: fh})
+
+	var attrOut fuse.AttrOut
+	if st := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: dirId}}, &attrOut); !st.Ok() || attrOut.Mode&syscall.S_IFDIR == 0 {
+		t.Errorf("GetAttr(dir): %v, mode %o", st, attrOut.Mode)
+	}
+	if st := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: goneId}}, &attrOut); st != fuse.Status(syscall.ESTALE) {
+		t.Errorf("GetAttr(gone): got %v, want ESTALE", st)
+	}
+
+	// Lookups of known names return the restored node, and new
+	// nodes do not collide with restored ones.
+	if got := lookup(fs, dirId, "file"); got != fileId {
+		t.Errorf("Lookup(file): got n%d, want n%d", got, fileId)
+	}
+	if err := ioutil.WriteFile(dir+"/new", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookup(fs, 1, "new"); got == dirId || got == fileId || got == goneId {
+		t.Errorf("Lookup(new): got restored node ID %d", got)
+	}
+	fs.Forget(goneId, 1)
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// inlineFile holds the contents of a small file while it is open,
+// see Options.InlineSize. It is shared by all open files of the
+// Inode.
+type inlineFile struct {
+	// opens counts the open files using it. Protected by Inode.mu.
+	opens int
+
+	// limit is the size the contents may not grow beyond, see
+	// Options.InlineSize.
+	limit uint64
+
+	mu      sync.Mutex
+	data    []byte
+	version string
+	dirty   bool
+}
+
+// inlineFile returns the contents held in memory, or nil if the file
+// is not open inline.
+func (n *Inode) inlineFile() *inlineFile {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.inline
+}
+
+// openInline tries to open a file inline. It returns false if the
+// file should be opened normally.
+func (b *rawBridge) openInline(ctx context.Context, n *Inode) (bool, syscall.Errno) {
+	inl, ok := n.ops.(NodeInliner)
+	if !ok || b.options.InlineSize <= 0 {
+		return false, OK
+	}
+
+	b.mu.Lock()
+	n.mu.Lock()
+	if n.inline != nil {
+		n.inline.opens++
+	}
+	joined := n.inline != nil
+	// Files that are open already must keep using the backend.
+	busy := len(n.openFiles) > 0
+	n.mu.Unlock()
+	b.mu.Unlock()
+	if joined || busy {
+		return joined, OK
+	}
+
+	var attr fuse.AttrOut
+	if errno := b.getattr(ctx, n, nil, &attr); errno != 0 {
+		return false, errno
+	}
+	if attr.Size > uint64(b.options.InlineSize) {
+		return false, OK
+	}
+
+	data, version, errno := inl.LoadInline(ctx)
+	if errno != 0 {
+		return false, errno
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.inline == nil {
+		n.inline = &inlineFile{data: data, version: version, limit: uint64(b.options.InlineSize)}
+	}
+	n.inline.opens++
+	return true, OK
+}
+
+// releaseInline drops an open file from the inline contents, and
+// stores them if this was the last one.
+func (b *rawBridge) releaseInline(ctx context.Context, n *Inode) {
+	n.mu.Lock()
+	f := n.inline
+	f.opens--
+	last := f.opens == 0
+	if last {
+		n.inline = nil
+	}
+	n.mu.Unlock()
+
+	if last {
+		if errno := b.storeInline(ctx, n, f); errno != 0 {
+			b.logf("rawBridge.releaseInline: n%d: storing %d bytes: %v", n.nodeId, len(f.data), errno)
+		}
+	}
+}
+
+// storeInline writes back modified contents.
+func (b *rawBridge) storeInline(ctx context.Context, n *Inode, f *inlineFile) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.store(ctx, n)
+}
+
+// store must be called with f.mu held.
+func (f *inlineFile) store(ctx context.Context, n *Inode) syscall.Errno {
+	if !f.dirty {
+		return OK
+	}
+	version, errno := n.ops.(NodeInliner).StoreInline(ctx, f.data, f.version)
+	if errno != 0 {
+		return errno
+	}
+	f.version = version
+	f.dirty = false
+	return OK
+}
+
+// inlineBackendOp runs op, which changes the file in the backend,
+// eg. fallocate or copy_file_range into it. If n is open inline, the
+// contents are stored before, and loaded again after, so op sees the
+// data written so far, and later reads and stores see what op did.
+func (b *rawBridge) inlineBackendOp(ctx context.Context, n *Inode, op func() syscall.Errno) syscall.Errno {
+	f := n.inlineFile()
+	if f == nil {
+		return op()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno := f.store(ctx, n); errno != 0 {
+		return errno
+	}
+	errno := op()
+	data, version, loadErrno := n.ops.(NodeInliner).LoadInline(ctx)
+	if loadErrno != 0 {
+		// Keep what we have; it is what was stored.
+		if errno == 0 {
+			errno = loadErrno
+		}
+		return errno
+	}
+	f.data = data
+	f.version = version
+	return errno
+}
+
+func (f *inlineFile) read(dest []byte, off int64) fuse.ReadResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil)
+	}
+	n := copy(dest, f.data[off:])
+	return fuse.ReadResultData(dest[:n])
+}
+
+func (f *inlineFile) write(data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := uint64(off) + uint64(len(data)); end > uint64(len(f.data)) {
+		if errno := f.resize(end); errno != 0 {
+			return 0, errno
+		}
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), OK
+}
+
+func (f *inlineFile) truncate(size uint64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size == uint64(len(f.data)) {
+		return OK
+	}
+	if errno := f.resize(size); errno != 0 {
+		return errno
+	}
+	f.dirty = true
+	return OK
+}
+
+// resize must be called with f.mu held. It returns EFBIG if the
+// contents would grow beyond the limit.
+func (f *inlineFile) resize(size uint64) syscall.Errno {
+	if size <= uint64(len(f.data)) {
+		f.data = f.data[:size]
+		return OK
+	}
+	if size > f.limit {
+		return syscall.EFBIG
+	}
+	data := make([]byte, size)
+	copy(data, f.data)
+	f.data = data
+	return OK
+}
+
+func (f *inlineFile) size() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint64(len(f.data))
+}
+
+// lseek implements SEEK_DATA and SEEK_HOLE. The contents have no
+// holes.
+func (f *inlineFile) lseek(off uint64, whence uint32) (uint64, syscall.Errno) {
+	size := f.size()
+	if off >= size {
+		return 0, syscall.ENXIO
+	}
+	if whence == _SEEK_DATA {
+		return off, OK
+	}
+	return size, OK
+}
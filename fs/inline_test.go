@@ -0,0 +1,380 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// objectNode is a file in a simulated object store, which can only
+// be read and written as a whole.
+type objectNode struct {
+	Inode
+
+	mu      sync.Mutex
+	data    []byte
+	version int
+	loads   int
+	stores  int
+}
+
+var _ = (NodeInliner)((*objectNode)(nil))
+var _ = (NodeGetattrer)((*objectNode)(nil))
+
+func (n *objectNode) LoadInline(ctx context.Context) ([]byte, string, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loads++
+	return append([]byte{}, n.data...), strconv.Itoa(n.version), 0
+}
+
+func (n *objectNode) StoreInline(ctx context.Context, data []byte, version string) (string, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if version != strconv.Itoa(n.version) {
+		return "", syscall.ESTALE
+	}
+	n.stores++
+	n.version++
+	n.data = append([]byte{}, data...)
+	return strconv.Itoa(n.version), 0
+}
+
+func (n *objectNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out.Mode = 0644
+	out.Size = uint64(len(n.data))
+	return 0
+}
+
+// overwrite changes the object behind the back of the file system.
+func (n *objectNode) overwrite(data string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.data = []byte(data)
+	n.version++
+}
+
+func (n *objectNode) counts() (loads, stores int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.loads, n.stores
+}
+
+func inlineMount(t *testing.T, content string) (*objectNode, string, func()) {
+	obj := &objectNode{data: []byte(content)}
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		InlineSize: 1024,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, obj, StableAttr{}), false)
+		},
+	})
+	return obj, mntDir + "/file", clean
+}
+
+func TestInlineFile(t *testing.T) {
+	obj, fn, clean := inlineMount(t, "hello")
+	defer clean()
+
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		data string
+		off  int64
+	}{{"H", 0}, {"ELLO", 1}, {" world", 5}} {
+		if _, err := f.WriteAt([]byte(w.data), w.off); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+	}
+	if fi, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 11 {
+		t.Errorf("got size %d, want 11", fi.Size())
+	}
+	if loads, stores := obj.counts(); loads != 1 || stores != 0 {
+		t.Errorf("before close: got %d loads, %d stores, want 1, 0", loads, stores)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if loads, stores := obj.counts(); loads != 1 || stores != 1 {
+		t.Errorf("after close: got %d loads, %d stores, want 1, 1", loads, stores)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || string(got) != "HELLO world" {
+		t.Errorf("ReadFile: %q, %v", got, err)
+	}
+
+	// Truncation through an open file goes to the inline contents.
+	f, err = os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(2); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil || string(got) != "HE" {
+		t.Errorf("ReadFile after truncate: %q, %v", got, err)
+	}
+}
+
+func TestInlineFileConflict(t *testing.T) {
+	obj, fn, clean := inlineMount(t, "hello")
+	defer clean()
+
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("bye")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	obj.overwrite("changed elsewhere")
+	if err := f.Close(); !isErrno(err, syscall.ESTALE) {
+		t.Errorf("Close: got %v, want ESTALE", err)
+	}
+	if _, stores := obj.counts(); stores != 0 {
+		t.Errorf("got %d stores, want 0", stores)
+	}
+}
+
+func isErrno(err error, want syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == want
+}
+
+// allocObjectNode can also be changed in place by the backend.
+type allocObjectNode struct {
+	objectNode
+}
+
+var _ = (NodeAllocater)((*allocObjectNode)(nil))
+var _ = (NodeCopyFileRanger)((*allocObjectNode)(nil))
+
+func (n *allocObjectNode) Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mode != 0 {
+		return syscall.EOPNOTSUPP
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if end := int(off + size); end > len(n.data) {
+		n.data = append(n.data, make([]byte, end-len(n.data))...)
+		n.version++
+	}
+	return 0
+}
+
+func (n *allocObjectNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	data := append([]byte{}, n.data[offIn:offIn+len]...)
+	n.mu.Unlock()
+
+	dst := out.Operations().(*allocObjectNode)
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	copy(dst.data[offOut:], data)
+	dst.version++
+	return uint32(len), 0
+}
+
+func TestInlineBackendOps(t *testing.T) {
+	src := &allocObjectNode{objectNode{data: []byte("xyz")}}
+	dst := &allocObjectNode{objectNode{data: []byte("hello")}}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		InlineSize: 1024,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("src", root.NewPersistentInode(ctx, src, StableAttr{}), false)
+			root.AddChild("dst", root.NewPersistentInode(ctx, dst, StableAttr{}), false)
+		},
+	})
+
+	open := func(name string) (nodeID, fh uint64) {
+		var entry fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !st.Ok() {
+			t.Fatalf("Lookup %s: %v", name, st)
+		}
+		in := fuse.OpenIn{Flags: uint32(os.O_RDWR)}
+		in.NodeId = entry.NodeId
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &in, &out); !st.Ok() {
+			t.Fatalf("Open %s: %v", name, st)
+		}
+		return entry.NodeId, out.Fh
+	}
+	write := func(nodeID, fh uint64, data string, off uint64) {
+		in := fuse.WriteIn{Fh: fh, Offset: off, Size: uint32(len(data))}
+		in.NodeId = nodeID
+		if _, st := rawFS.Write(nil, &in, []byte(data)); !st.Ok() {
+			t.Fatalf("Write: %v", st)
+		}
+	}
+	read := func(nodeID, fh uint64) string {
+		in := fuse.ReadIn{Fh: fh, Size: 100}
+		in.NodeId = nodeID
+		res, st := rawFS.Read(nil, &in, make([]byte, 100))
+		if !st.Ok() {
+			t.Fatalf("Read: %v", st)
+		}
+		data, _ := res.Bytes(make([]byte, 100))
+		return string(data)
+	}
+
+	srcID, srcFh := open("src")
+	dstID, dstFh := open("dst")
+	write(srcID, srcFh, "XY", 0)
+	write(dstID, dstFh, "HE", 0)
+
+	// Fallocate sees the inline writes, and extends the contents.
+	fin := fuse.FallocateIn{Fh: dstFh, Length: 8}
+	fin.NodeId = dstID
+	if st := rawFS.Fallocate(nil, &fin); !st.Ok() {
+		t.Fatalf("Fallocate: %v", st)
+	}
+	if got, want := read(dstID, dstFh), "HEllo\x00\x00\x00"; got != want {
+		t.Errorf("after Fallocate: got %q, want %q", got, want)
+	}
+
+	// CopyFileRange copies the inline writes of the source.
+	cin := fuse.CopyFileRangeIn{FhIn: srcFh, NodeIdOut: dstID, FhOut: dstFh, OffOut: 5, Len: 3}
+	cin.NodeId = srcID
+	if n, st := rawFS.CopyFileRange(nil, &cin); !st.Ok() || n != 3 {
+		t.Fatalf("CopyFileRange: %d, %v", n, st)
+	}
+	if got, want := read(dstID, dstFh), "HElloXYz"; got != want {
+		t.Errorf("after CopyFileRange: got %q, want %q", got, want)
+	}
+
+	lin := fuse.LseekIn{Fh: dstFh, Whence: _SEEK_HOLE}
+	lin.NodeId = dstID
+	var lout fuse.LseekOut
+	if st := rawFS.Lseek(nil, &lin, &lout); !st.Ok() || lout.Offset != 8 {
+		t.Errorf("SEEK_HOLE: got %d, %v, want 8", lout.Offset, st)
+	}
+
+	// Releasing stores the contents over what the backend wrote,
+	// without losing it.
+	write(dstID, dstFh, "!", 7)
+	for _, f := range [][2]uint64{{srcID, srcFh}, {dstID, dstFh}} {
+		in := fuse.ReleaseIn{Fh: f[1]}
+		in.NodeId = f[0]
+		rawFS.Release(nil, &in)
+	}
+	if got, want := string(dst.data), "HElloXY!"; got != want {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+	if got, want := string(src.data), "XYz"; got != want {
+		t.Errorf("stored source %q, want %q", got, want)
+	}
+}
+
+func TestInlineOpenTrunc(t *testing.T) {
+	obj := &objectNode{data: []byte("hello")}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		InlineSize: 1024,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, obj, StableAttr{}), false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	in := fuse.OpenIn{Flags: uint32(os.O_WRONLY | os.O_TRUNC)}
+	in.NodeId = entry.NodeId
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &in, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	var attr fuse.AttrOut
+	gin := fuse.GetAttrIn{Flags_: fuse.FUSE_GETATTR_FH, Fh_: out.Fh}
+	gin.NodeId = entry.NodeId
+	if st := rawFS.GetAttr(nil, &gin, &attr); !st.Ok() || attr.Size != 0 {
+		t.Errorf("GetAttr: got size %d, %v, want 0", attr.Size, st)
+	}
+
+	rin := fuse.ReleaseIn{Fh: out.Fh}
+	rin.NodeId = entry.NodeId
+	rawFS.Release(nil, &rin)
+	if len(obj.data) != 0 {
+		t.Errorf("stored %q, want empty", obj.data)
+	}
+}
+
+func TestInlineFileLimit(t *testing.T) {
+	obj := &objectNode{data: []byte("hello")}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		InlineSize: 1024,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, obj, StableAttr{}), false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	in := fuse.OpenIn{Flags: uint32(os.O_RDWR)}
+	in.NodeId = entry.NodeId
+	var out fuse.OpenOut
+	if st := rawFS.Open(nil, &in, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	win := fuse.WriteIn{Fh: out.Fh, Offset: 1 << 40}
+	win.NodeId = entry.NodeId
+	if _, st := rawFS.Write(nil, &win, []byte("x")); st != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write at %d: got %v, want EFBIG", win.Offset, st)
+	}
+	win.Offset = 1023
+	if _, st := rawFS.Write(nil, &win, []byte("x")); !st.Ok() {
+		t.Errorf("Write at %d: %v", win.Offset, st)
+	}
+
+	sin := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_SIZE | fuse.FATTR_FH,
+		Fh:    out.Fh,
+		Size:  1 << 40,
+	}}
+	sin.NodeId = entry.NodeId
+	var attr fuse.AttrOut
+	if st := rawFS.SetAttr(nil, &sin, &attr); st != fuse.Status(syscall.EFBIG) {
+		t.Errorf("SetAttr size %d: got %v, want EFBIG", sin.Size, st)
+	}
+	sin.Size = 2
+	if st := rawFS.SetAttr(nil, &sin, &attr); !st.Ok() || attr.Size != 2 {
+		t.Errorf("SetAttr size 2: got size %d, %v", attr.Size, st)
+	}
+
+	rin := fuse.ReleaseIn{Fh: out.Fh}
+	rin.NodeId = entry.NodeId
+	rawFS.Release(nil, &rin)
+	if string(obj.data) != "he" {
+		t.Errorf("stored %q, want %q", obj.data, "he")
+	}
+}
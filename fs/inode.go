@@ -101,6 +101,36 @@ type Inode struct {
 	// Parents of this Inode. Can be more than one due to hard links.
 	// When you change this, you MUST increment changeCounter.
 	parents inodeParents
+
+	// Number of open files, split by access mode.
+	openReaders uint32
+	openWriters uint32
+
+	// Passthrough backing file shared by the open files, and the
+	// number of files using it.
+	backingID         int32
+	backingIDRefcount int
+
+	// Set for magic entries (see Options.MagicEntries) and the
+	// nodes below them.
+	magic bool
+
+	// Set while the attributes are refreshed in the background,
+	// see PinAttr.
+	attrPin *attrPin
+
+	// Set while the file is open inline, see Options.InlineSize.
+	inline *inlineFile
+
+	// Timeout state, see Options.AdaptiveTimeout.
+	adaptive adaptiveState
+
+	// Serializes appends, see AppendSerialize.
+	appendMu sync.Mutex
+
+	// Serializes overlapping writes, see NodeRangeLockPolicier.
+	// Allocated on first use.
+	ranges *rangeLocks
 }
 
 func (n *Inode) IsDir() bool {
@@ -131,6 +161,7 @@ func (n *Inode) setEntryOut(out *fuse.EntryOut) {
 	out.NodeId = n.nodeId
 	out.Ino = n.stableAttr.Ino
 	out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
+	n.setAttrFlags(&out.Attr)
 }
 
 // StableAttr returns the (Ino, Gen) tuple for this node.
@@ -262,6 +293,58 @@ func (n *Inode) Forgotten() bool {
 	return n.lookupCount == 0 && n.parents.count() == 0 && !n.persistent
 }
 
+// OpenCount returns the number of files currently open on this
+// inode, split into read-only and writable opens.
+func (n *Inode) OpenCount() (readers, writers int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return int(n.openReaders), int(n.openWriters)
+}
+
+// addOpen accounts for a new open file with the given open flags,
+// and runs the NodeOnFirstOpener callback if applicable.
+func (n *Inode) addOpen(ctx context.Context, flags uint32) {
+	writable := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	n.mu.Lock()
+	first := n.openReaders+n.openWriters == 0
+	if writable {
+		n.openWriters++
+	} else {
+		n.openReaders++
+	}
+	n.mu.Unlock()
+
+	if first {
+		if fo, ok := n.ops.(NodeOnFirstOpener); ok {
+			fo.OnFirstOpen(ctx, writable)
+		}
+	}
+}
+
+// removeOpen undoes addOpen, and runs the NodeOnLastCloser
+// callback if this was the last open file.
+func (n *Inode) removeOpen(ctx context.Context, flags uint32) {
+	writable := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	n.mu.Lock()
+	if writable && n.openWriters > 0 {
+		n.openWriters--
+	} else if !writable && n.openReaders > 0 {
+		n.openReaders--
+	} else {
+		n.mu.Unlock()
+		n.bridge.logf("warning: Inode.removeOpen: n%d open count underflow", n.nodeId)
+		return
+	}
+	last := n.openReaders+n.openWriters == 0
+	n.mu.Unlock()
+
+	if last {
+		if lc, ok := n.ops.(NodeOnLastCloser); ok {
+			lc.OnLastClose(ctx)
+		}
+	}
+}
+
 // Operations returns the object implementing the file system
 // operations.
 func (n *Inode) Operations() InodeEmbedder {
@@ -431,6 +514,7 @@ retry:
 		}
 		n.parents.clear()
 		n.changeCounter++
+		n.stopAttrPin()
 
 		if n.lookupCount != 0 {
 			log.Panicf("n%d %p lookupCount changed: %d", n.nodeId, n, n.lookupCount)
@@ -439,6 +523,10 @@ retry:
 		unlockNodes(lockme...)
 		break
 	}
+	n.bridge.releaseNodeId(n)
+	if f, ok := n.ops.(NodeOnForgetter); ok {
+		f.OnForget()
+	}
 
 	for _, p := range lockme {
 		if p != n {
@@ -471,6 +559,9 @@ retry:
 		if !ok {
 			n.children[name] = ch
 			ch.parents.add(parentData{name, n})
+			if n.magic {
+				ch.magic = true
+			}
 			n.changeCounter++
 			ch.changeCounter++
 			unlockNode2(n, ch)
@@ -491,6 +582,9 @@ retry:
 		prev.parents.delete(parentData{name, n})
 		n.children[name] = ch
 		ch.parents.add(parentData{name, n})
+		if n.magic {
+			ch.magic = true
+		}
 		n.changeCounter++
 		ch.changeCounter++
 		prev.changeCounter++
@@ -716,15 +810,111 @@ retry:
 
 // NotifyEntry notifies the kernel that data for a (directory, name)
 // tuple should be invalidated. On next access, a LOOKUP operation
-// will be started.
+// will be started. The kernel also drops its cached listing of the
+// directory.
 func (n *Inode) NotifyEntry(name string) syscall.Errno {
 	status := n.bridge.server.EntryNotify(n.nodeId, name)
 	return syscall.Errno(status)
 }
 
+// entryExpireNotifier is implemented by fuse.Server. It is not part of
+// ServerCallbacks, so existing stubs of it keep working.
+type entryExpireNotifier interface {
+	EntryExpireNotify(parent uint64, name string) fuse.Status
+}
+
+// NotifyEntryExpire is like NotifyEntry, but the kernel keeps the
+// entry, and revalidates it with a lookup on its next use. This is
+// cheaper than NotifyEntry for frequent invalidations, and does not
+// disturb lookups in progress. It needs kernel protocol version 38,
+// and returns ENOSYS otherwise, or if Options.ServerCallbacks does
+// not implement EntryExpireNotify.
+func (n *Inode) NotifyEntryExpire(name string) syscall.Errno {
+	en, ok := n.bridge.server.(entryExpireNotifier)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	return syscall.Errno(en.EntryExpireNotify(n.nodeId, name))
+}
+
+// NotifyRename tells the kernel that the entry oldName of this
+// directory was renamed to newName in newParent by someone else, eg.
+// another client of a network file system. The child is moved in the
+// tree as with MvChild, overwriting the destination, and only the
+// two directory entries are invalidated. Unlike forgetting the node,
+// this leaves the attributes and cached data of the inode in the
+// kernel, so the next lookup of newName finds them again. The
+// entries are expired if the kernel supports it (protocol version
+// 38), and dropped as with NotifyEntry otherwise, in which case the
+// kernel may drop the inode if it is not in use.
+func (n *Inode) NotifyRename(oldName string, newParent *Inode, newName string) syscall.Errno {
+	n.MvChild(oldName, newParent, newName, true)
+
+	notify := func(parent *Inode, name string) syscall.Errno {
+		errno := parent.NotifyEntryExpire(name)
+		if errno == syscall.ENOSYS {
+			errno = parent.NotifyEntry(name)
+		}
+		if errno == syscall.ENOENT {
+			// The kernel did not have the entry cached.
+			errno = 0
+		}
+		return errno
+	}
+	errno := notify(n, oldName)
+	if errno2 := notify(newParent, newName); errno == 0 {
+		errno = errno2
+	}
+	return errno
+}
+
+// NotifyEntries invalidates the entries of this directory that are
+// in the tree and whose names match, as NotifyEntry does for a single
+// name. Use it when an operation on the backing store, such as a
+// bulk delete on a remote server, affects many entries at once.
+// Entries that the kernel does not have cached are skipped. It stops
+// at the first other error, and returns the number of entries it
+// invalidated.
+func (n *Inode) NotifyEntries(match func(name string) bool) (int, syscall.Errno) {
+	count := 0
+	for _, name := range n.childNames(match) {
+		errno := n.NotifyEntry(name)
+		if errno == syscall.ENOENT {
+			continue
+		}
+		if errno != 0 {
+			return count, errno
+		}
+		count++
+	}
+	return count, 0
+}
+
+// NotifyEntriesPrefix invalidates the entries of this directory whose
+// names start with prefix, see NotifyEntries.
+func (n *Inode) NotifyEntriesPrefix(prefix string) (int, syscall.Errno) {
+	return n.NotifyEntries(func(name string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+// childNames returns the names of the children that match.
+func (n *Inode) childNames(match func(name string) bool) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var r []string
+	for name := range n.children {
+		if match(name) {
+			r = append(r, name)
+		}
+	}
+	return r
+}
+
 // NotifyDelete notifies the kernel that the given inode was removed
 // from this directory as entry under the given name. It is equivalent
-// to NotifyEntry, but also sends an event to inotify watchers.
+// to NotifyEntry, but also sends an event to inotify watchers. Like
+// NotifyEntry, it drops the kernel's cached listing of the directory.
 func (n *Inode) NotifyDelete(name string, child *Inode) syscall.Errno {
 	// XXX arg ordering?
 	return syscall.Errno(n.bridge.server.DeleteNotify(n.nodeId, child.nodeId, name))
@@ -738,6 +928,67 @@ func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
 	return syscall.Errno(n.bridge.server.InodeNotify(n.nodeId, off, sz))
 }
 
+// NotifyReaddir drops the kernel's cached listing of this directory,
+// so the next listing reaches Readdir. Use it when entries change
+// without an entry to notify for, eg. when a directory that caches
+// its listing with NodeReaddirCacher gains several entries at once.
+// It also invalidates the attributes of the directory.
+func (n *Inode) NotifyReaddir() syscall.Errno {
+	return n.NotifyContent(0, 0)
+}
+
+// ChangeMask says what changed about a node, see NotifyChanged.
+type ChangeMask uint32
+
+const (
+	// ChangeAttr: the attributes changed, eg. the mode or the
+	// times.
+	ChangeAttr ChangeMask = 1 << iota
+
+	// ChangeContent: the data of a file changed, or the entries
+	// of a directory. This implies ChangeAttr.
+	ChangeContent
+
+	// ChangeDeleted: the node was removed from the directories
+	// that it was in.
+	ChangeDeleted
+)
+
+// NotifyChanged tells the kernel that the node was changed by someone
+// else, eg. another client of a network file system, with the best
+// notification that the kernel supports. Deletions use NotifyDelete
+// for every name the node has, which also gives watchers of the
+// directories an inotify event; kernels before protocol version 18
+// only drop the entries. Changed content drops the cached data and
+// listing, and changed attributes only the attributes. The kernel
+// has no notification that raises inotify events for those. Callers
+// that have the new data at hand can follow up with WriteCache.
+// Names and nodes that the kernel does not have cached are skipped.
+func (n *Inode) NotifyChanged(mask ChangeMask) syscall.Errno {
+	var errno syscall.Errno
+	keep := func(e syscall.Errno) {
+		if e != 0 && e != syscall.ENOENT && errno == 0 {
+			errno = e
+		}
+	}
+	if mask&ChangeDeleted != 0 {
+		n.mu.Lock()
+		parents := n.parents.all()
+		n.mu.Unlock()
+		for _, p := range parents {
+			keep(p.parent.NotifyDelete(p.name, n))
+		}
+	}
+	switch {
+	case mask&ChangeContent != 0:
+		keep(n.NotifyContent(0, 0))
+	case mask&ChangeAttr != 0:
+		// A negative offset only invalidates the attributes.
+		keep(n.NotifyContent(-1, 0))
+	}
+	return errno
+}
+
 // WriteCache stores data in the kernel cache.
 func (n *Inode) WriteCache(offset int64, data []byte) syscall.Errno {
 	return syscall.Errno(n.bridge.server.InodeNotifyStoreCache(n.nodeId, offset, data))
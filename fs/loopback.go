@@ -25,7 +25,8 @@ type LoopbackRoot struct {
 	Dev uint64
 
 	// NewNode returns a new InodeEmbedder to be used to respond
-	// to a LOOKUP/CREATE/MKDIR/MKNOD opcode. If not set, use a
+	// to a LOOKUP/CREATE/MKDIR/MKNOD/TMPFILE opcode. For TMPFILE,
+	// name is "#" and the inode number. If not set, use a
 	// LoopbackNode.
 	NewNode func(rootData *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder
 }
@@ -132,12 +133,72 @@ func (n *LoopbackNode) preserveOwner(ctx context.Context, path string) error {
 	if !ok {
 		return nil
 	}
-	return syscall.Lchown(path, int(caller.Uid), int(caller.Gid))
+	return syscall.Lchown(path, int(caller.Uid), ownerGid(caller, filepath.Dir(path)))
+}
+
+// ownerGid returns the group for a file created by caller in the
+// directory dir: the caller's group, or -1 to keep the group of dir,
+// which the file inherits if dir is setgid.
+func ownerGid(caller *fuse.Caller, dir string) int {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err == nil && st.Mode&syscall.S_ISGID != 0 {
+		return -1
+	}
+	return int(caller.Gid)
+}
+
+// killSuidGid returns whether the request asks to clear the setuid and
+// setgid bits of the file. See fuse.MountOptions.EnableKillPriv.
+func killSuidGid(ctx context.Context) bool {
+	fc, ok := ctx.(*fuse.Context)
+	return ok && fc.KillSuidGid
+}
+
+// killSgid returns whether the request asks to clear the setgid bit
+// after setting a POSIX ACL. See fuse.MountOptions.EnableSetXAttrExt.
+func killSgid(ctx context.Context) bool {
+	fc, ok := ctx.(*fuse.Context)
+	return ok && fc.KillSgid
+}
+
+// createMode returns the mode for a new file in the directory dir:
+// mode without the bits of the caller's umask, unless a default POSIX
+// ACL of dir determines the mode. See fuse.Context.Umask.
+func createMode(ctx context.Context, dir string, mode uint32) uint32 {
+	fc, ok := ctx.(*fuse.Context)
+	if !ok || fc.Umask == 0 || hasDefaultACL(dir) {
+		return mode
+	}
+	return mode &^ fc.Umask
+}
+
+// withoutSuidGid returns mode without the setuid bit, and without the
+// setgid bit if the file is group-executable, like the kernel clears
+// them after a write by a process without CAP_FSETID.
+func withoutSuidGid(mode uint32) uint32 {
+	mode &^= syscall.S_ISUID
+	if mode&(syscall.S_ISGID|syscall.S_IXGRP) == syscall.S_ISGID|syscall.S_IXGRP {
+		mode &^= syscall.S_ISGID
+	}
+	return mode
+}
+
+// clearSuidGid clears the setuid and setgid bits of an open file.
+func clearSuidGid(fd int) syscall.Errno {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return ToErrno(err)
+	}
+	mode := uint32(st.Mode)
+	if m := withoutSuidGid(mode); m != mode {
+		return ToErrno(syscall.Fchmod(fd, m&07777))
+	}
+	return 0
 }
 
 func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
-	err := syscall.Mknod(p, mode, int(rdev))
+	err := syscall.Mknod(p, createMode(ctx, n.path(), mode), int(rdev))
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -158,7 +219,7 @@ func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 
 func (n *LoopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
-	err := os.Mkdir(p, os.FileMode(mode))
+	err := os.Mkdir(p, os.FileMode(createMode(ctx, n.path(), mode)))
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -196,6 +257,9 @@ func (n *LoopbackNode) Rename(ctx context.Context, name string, newParent InodeE
 
 	p1 := filepath.Join(n.path(), name)
 	p2 := filepath.Join(n.RootData.Path, newParent.EmbeddedInode().Path(nil), newName)
+	if flags != 0 {
+		return renameat2(p1, p2, flags)
+	}
 
 	err := syscall.Rename(p1, p2)
 	return ToErrno(err)
@@ -206,10 +270,16 @@ var _ = (NodeCreater)((*LoopbackNode)(nil))
 func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	p := filepath.Join(n.path(), name)
 	flags = flags &^ syscall.O_APPEND
-	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
+	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, createMode(ctx, n.path(), mode))
 	if err != nil {
 		return nil, nil, 0, ToErrno(err)
 	}
+	if flags&syscall.O_TRUNC != 0 && killSuidGid(ctx) {
+		if errno := clearSuidGid(fd); errno != 0 {
+			syscall.Close(fd)
+			return nil, nil, 0, errno
+		}
+	}
 	n.preserveOwner(ctx, p)
 	st := syscall.Stat_t{}
 	if err := syscall.Fstat(fd, &st); err != nil {
@@ -286,6 +356,12 @@ func (n *LoopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, f
 	if err != nil {
 		return nil, 0, ToErrno(err)
 	}
+	if flags&syscall.O_TRUNC != 0 && killSuidGid(ctx) {
+		if errno := clearSuidGid(f); errno != 0 {
+			syscall.Close(f)
+			return nil, 0, errno
+		}
+	}
 	lf := NewLoopbackFile(f)
 	return lf, 0, 0
 }
@@ -381,6 +457,17 @@ func (n *LoopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAt
 			if err := syscall.Truncate(p, int64(sz)); err != nil {
 				return ToErrno(err)
 			}
+			if in.KillSuidGid() {
+				var st syscall.Stat_t
+				if err := syscall.Stat(p, &st); err != nil {
+					return ToErrno(err)
+				}
+				if m := withoutSuidGid(uint32(st.Mode)); m != uint32(st.Mode) {
+					if err := syscall.Chmod(p, m&07777); err != nil {
+						return ToErrno(err)
+					}
+				}
+			}
 		}
 	}
 
@@ -401,6 +488,12 @@ func (n *LoopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAt
 // NewLoopbackRoot returns a root node for a loopback file system whose
 // root is at the given root. This node implements all NodeXxxxer
 // operations available.
+//
+// New files get the mode of the request, which the kernel has
+// already masked with the caller's umask, or with
+// fuse.MountOptions.DontUmask, the loopback masks it unless the
+// backing directory has a default POSIX ACL. The umask of the
+// server process applies on top, so mirrors should run with umask 0.
 func NewLoopbackRoot(rootPath string) (InodeEmbedder, error) {
 	var st syscall.Stat_t
 	err := syscall.Stat(rootPath, &st)
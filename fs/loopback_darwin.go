@@ -36,8 +36,21 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 	return syscall.ENOSYS
 }
 
+func renameat2(oldPath, newPath string, flags uint32) syscall.Errno {
+	return syscall.ENOTSUP
+}
+
+// NewLoopbackFdRoot is not supported on Darwin, which has no O_PATH.
+func NewLoopbackFdRoot(rootPath string) (InodeEmbedder, error) {
+	return nil, syscall.ENOTSUP
+}
+
 func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
-	// TODO: Handle `mode` parameter.
+	// F_PREALLOCATE can only reserve space, and never changes the
+	// file size.
+	if mode&^fuse.FALLOC_FL_KEEP_SIZE != 0 {
+		return syscall.EOPNOTSUPP
+	}
 
 	// From `man fcntl` on OSX:
 	//     The F_PREALLOCATE command operates on the following structure:
@@ -80,8 +93,19 @@ func (f *loopbackFile) Allocate(ctx context.Context, off uint64, sz uint64, mode
 	// Linux version for reference:
 	// err := syscall.Fallocate(int(f.File.Fd()), mode, int64(off), int64(sz))
 	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(f.fd), uintptr(syscall.F_PREALLOCATE), uintptr(unsafe.Pointer(&k)))
-
-	return errno
+	if errno != 0 {
+		return errno
+	}
+	if mode&fuse.FALLOC_FL_KEEP_SIZE == 0 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(f.fd, &st); err != nil {
+			return ToErrno(err)
+		}
+		if end := int64(off + sz); end > st.Size {
+			return ToErrno(syscall.Ftruncate(f.fd, end))
+		}
+	}
+	return OK
 }
 
 // timeToTimeval - Convert time.Time to syscall.Timeval
@@ -116,3 +140,8 @@ func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
 	return 0, syscall.ENOSYS
 }
+
+// hasDefaultACL returns false: macOS has no default POSIX ACLs.
+func hasDefaultACL(dir string) bool {
+	return false
+}
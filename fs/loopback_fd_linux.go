@@ -0,0 +1,478 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// LoopbackFdNode is a node of a loopback file system that holds an
+// O_PATH file descriptor for its file, and makes all calls relative
+// to it, with the *at(2) system calls or through /proc/self/fd.
+// Unlike LoopbackNode, it never builds the path of a file from the
+// names in the tree, so operations that race with renames, in the
+// mount or in the underlying file system, cannot reach the wrong
+// file. Each node that the kernel knows of costs a file descriptor.
+// See NewLoopbackFdRoot.
+type LoopbackFdNode struct {
+	Inode
+
+	// RootData points back to the root of the loopback filesystem.
+	RootData *LoopbackRoot
+
+	// fd is the O_PATH file descriptor, or -1 once the node is
+	// forgotten. Accessed atomically.
+	fd int32
+}
+
+var _ = (NodeStatfser)((*LoopbackFdNode)(nil))
+var _ = (NodeGetattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeSetattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeStatxer)((*LoopbackFdNode)(nil))
+var _ = (NodeGetxattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeSetxattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeRemovexattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeListxattrer)((*LoopbackFdNode)(nil))
+var _ = (NodeReadlinker)((*LoopbackFdNode)(nil))
+var _ = (NodeOpener)((*LoopbackFdNode)(nil))
+var _ = (NodeCreater)((*LoopbackFdNode)(nil))
+var _ = (NodeTmpfiler)((*LoopbackFdNode)(nil))
+var _ = (NodeCopyFileRanger)((*LoopbackFdNode)(nil))
+var _ = (NodeLookuper)((*LoopbackFdNode)(nil))
+var _ = (NodeOpendirer)((*LoopbackFdNode)(nil))
+var _ = (NodeReaddirer)((*LoopbackFdNode)(nil))
+var _ = (NodeMkdirer)((*LoopbackFdNode)(nil))
+var _ = (NodeMknoder)((*LoopbackFdNode)(nil))
+var _ = (NodeLinker)((*LoopbackFdNode)(nil))
+var _ = (NodeSymlinker)((*LoopbackFdNode)(nil))
+var _ = (NodeUnlinker)((*LoopbackFdNode)(nil))
+var _ = (NodeRmdirer)((*LoopbackFdNode)(nil))
+var _ = (NodeRenamer)((*LoopbackFdNode)(nil))
+var _ = (NodeSyncfser)((*LoopbackFdNode)(nil))
+var _ = (NodeOnForgetter)((*LoopbackFdNode)(nil))
+
+// NewLoopbackFdRoot returns a root node for a loopback file system
+// whose root is at the given root, like NewLoopbackRoot, but whose
+// nodes are LoopbackFdNodes.
+func NewLoopbackFdRoot(rootPath string) (InodeEmbedder, error) {
+	fd, err := syscall.Open(rootPath, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: rootPath, Err: err}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: rootPath, Err: err}
+	}
+
+	root := &LoopbackRoot{
+		Path: rootPath,
+		Dev:  uint64(st.Dev),
+	}
+	return &LoopbackFdNode{RootData: root, fd: int32(fd)}, nil
+}
+
+// Fd returns the O_PATH file descriptor of the node. It is closed
+// once the node is forgotten.
+func (n *LoopbackFdNode) Fd() int {
+	return int(atomic.LoadInt32(&n.fd))
+}
+
+// OnForget closes the file descriptor of the node.
+func (n *LoopbackFdNode) OnForget() {
+	if fd := atomic.SwapInt32(&n.fd, -1); fd >= 0 {
+		syscall.Close(int(fd))
+	}
+}
+
+// procPath returns the path that opens the file of the node again.
+func (n *LoopbackFdNode) procPath() string {
+	return fmt.Sprintf("/proc/self/fd/%d", n.Fd())
+}
+
+// newChild returns the node for the file of fd, an O_PATH file
+// descriptor that is owned by the node from then on.
+func (n *LoopbackFdNode) newChild(ctx context.Context, fd int, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	node := &LoopbackFdNode{RootData: n.RootData, fd: int32(fd)}
+	return n.NewInode(ctx, node, n.RootData.idFromStat(&st)), 0
+}
+
+// lookupChild opens name in the directory of n, and returns its node.
+func (n *LoopbackFdNode) lookupChild(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	fd, err := unix.Openat(n.Fd(), name, unix.O_PATH|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, ToErrno(err)
+	}
+	return n.newChild(ctx, fd, out)
+}
+
+// preserveOwner sets uid and gid of name according to the caller
+// information in ctx.
+func (n *LoopbackFdNode) preserveOwner(ctx context.Context, name string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return unix.Fchownat(n.Fd(), name, int(caller.Uid), ownerGid(caller, n.procPath()), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (n *LoopbackFdNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	s := syscall.Statfs_t{}
+	if err := syscall.Fstatfs(n.Fd(), &s); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return OK
+}
+
+func (n *LoopbackFdNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return n.lookupChild(ctx, name, out)
+}
+
+func (n *LoopbackFdNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if err := unix.Mknodat(n.Fd(), name, createMode(ctx, n.procPath(), mode), int(rdev)); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, name)
+	ch, errno := n.lookupChild(ctx, name, out)
+	if errno != 0 {
+		unix.Unlinkat(n.Fd(), name, 0)
+	}
+	return ch, errno
+}
+
+func (n *LoopbackFdNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if err := unix.Mkdirat(n.Fd(), name, createMode(ctx, n.procPath(), mode)); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, name)
+	ch, errno := n.lookupChild(ctx, name, out)
+	if errno != 0 {
+		unix.Unlinkat(n.Fd(), name, unix.AT_REMOVEDIR)
+	}
+	return ch, errno
+}
+
+func (n *LoopbackFdNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return ToErrno(unix.Unlinkat(n.Fd(), name, unix.AT_REMOVEDIR))
+}
+
+func (n *LoopbackFdNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return ToErrno(unix.Unlinkat(n.Fd(), name, 0))
+}
+
+func (n *LoopbackFdNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	p, ok := newParent.(*LoopbackFdNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if flags != 0 {
+		return ToErrno(unix.Renameat2(n.Fd(), name, p.Fd(), newName, uint(flags)))
+	}
+	return ToErrno(unix.Renameat(n.Fd(), name, p.Fd(), newName))
+}
+
+func (n *LoopbackFdNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	flags = flags &^ syscall.O_APPEND
+	fd, err := unix.Openat(n.Fd(), name, int(flags)|os.O_CREATE|syscall.O_CLOEXEC, createMode(ctx, n.procPath(), mode))
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	if flags&syscall.O_TRUNC != 0 && killSuidGid(ctx) {
+		if errno := clearSuidGid(fd); errno != 0 {
+			syscall.Close(fd)
+			return nil, nil, 0, errno
+		}
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && os.Getuid() == 0 {
+		syscall.Fchown(fd, int(caller.Uid), ownerGid(caller, n.procPath()))
+	}
+
+	// Take the O_PATH descriptor from the open file rather than
+	// from the name, which may have been renamed meanwhile.
+	pathFd, err := reopenFd(fd, unix.O_PATH)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+	ch, errno := n.newChild(ctx, pathFd, out)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, nil, 0, errno
+	}
+	return ch, NewLoopbackFile(fd), 0, 0
+}
+
+// Tmpfile creates an O_TMPFILE file in the backing directory.
+func (n *LoopbackFdNode) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	flags = flags &^ syscall.O_APPEND
+	fd, err := unix.Openat(n.Fd(), ".", int(flags)|unix.O_TMPFILE|syscall.O_CLOEXEC, createMode(ctx, n.procPath(), mode))
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && os.Getuid() == 0 {
+		syscall.Fchown(fd, int(caller.Uid), ownerGid(caller, n.procPath()))
+	}
+	pathFd, err := reopenFd(fd, unix.O_PATH)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+	ch, errno := n.newChild(ctx, pathFd, out)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, nil, 0, errno
+	}
+	return ch, NewLoopbackFile(fd), 0, 0
+}
+
+func (n *LoopbackFdNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if err := unix.Symlinkat(target, n.Fd(), name); err != nil {
+		return nil, ToErrno(err)
+	}
+	n.preserveOwner(ctx, name)
+	ch, errno := n.lookupChild(ctx, name, out)
+	if errno != 0 {
+		unix.Unlinkat(n.Fd(), name, 0)
+	}
+	return ch, errno
+}
+
+func (n *LoopbackFdNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	t, ok := target.(*LoopbackFdNode)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+	// linkat(2) with AT_EMPTY_PATH needs CAP_DAC_READ_SEARCH;
+	// following the link in /proc does not.
+	if err := unix.Linkat(unix.AT_FDCWD, t.procPath(), n.Fd(), name, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return nil, ToErrno(err)
+	}
+	ch, errno := n.lookupChild(ctx, name, out)
+	if errno != 0 {
+		unix.Unlinkat(n.Fd(), name, 0)
+	}
+	return ch, errno
+}
+
+func (n *LoopbackFdNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	for l := 256; ; l *= 2 {
+		buf := make([]byte, l)
+		sz, err := unix.Readlinkat(n.Fd(), "", buf)
+		if err != nil {
+			return nil, ToErrno(err)
+		}
+		if sz < len(buf) {
+			return buf[:sz], 0
+		}
+	}
+}
+
+func (n *LoopbackFdNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	// O_NOFOLLOW would refuse the link in /proc.
+	flags = flags &^ (syscall.O_APPEND | syscall.O_NOFOLLOW)
+	f, err := reopenFd(n.Fd(), int(flags))
+	if err != nil {
+		return nil, 0, ToErrno(err)
+	}
+	if flags&syscall.O_TRUNC != 0 && killSuidGid(ctx) {
+		if errno := clearSuidGid(f); errno != 0 {
+			syscall.Close(f)
+			return nil, 0, errno
+		}
+	}
+	return NewLoopbackFile(f), 0, 0
+}
+
+func (n *LoopbackFdNode) Opendir(ctx context.Context) syscall.Errno {
+	fd, err := reopenFd(n.Fd(), syscall.O_RDONLY|syscall.O_DIRECTORY)
+	if err != nil {
+		return ToErrno(err)
+	}
+	syscall.Close(fd)
+	return OK
+}
+
+func (n *LoopbackFdNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return NewLoopbackDirStream(n.procPath())
+}
+
+func (n *LoopbackFdNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f != nil {
+		return f.(FileGetattrer).Getattr(ctx, out)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(n.Fd(), &st); err != nil {
+		return ToErrno(err)
+	}
+	out.FromStat(&st)
+	return OK
+}
+
+func (n *LoopbackFdNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if fsa, ok := f.(FileSetattrer); ok && fsa != nil {
+		fsa.Setattr(ctx, in, out)
+	} else if errno := n.setattr(in); errno != 0 {
+		return errno
+	}
+
+	if fga, ok := f.(FileGetattrer); ok && fga != nil {
+		return fga.Getattr(ctx, out)
+	}
+	return n.Getattr(ctx, nil, out)
+}
+
+// setattr changes the attributes of the file without an open file.
+// fchmod(2), ftruncate(2) and futimens(2) do not take O_PATH
+// descriptors, so these go through /proc.
+func (n *LoopbackFdNode) setattr(in *fuse.SetAttrIn) syscall.Errno {
+	p := n.procPath()
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid := -1
+		sgid := -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := unix.Fchownat(n.Fd(), "", suid, sgid, _AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		var ts [2]syscall.Timespec
+		ts[0] = fuse.UtimeToTimespec(ap)
+		ts[1] = fuse.UtimeToTimespec(mp)
+		if err := syscall.UtimesNano(p, ts[:]); err != nil {
+			return ToErrno(err)
+		}
+	}
+
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return ToErrno(err)
+		}
+		if in.KillSuidGid() {
+			var st syscall.Stat_t
+			if err := syscall.Fstat(n.Fd(), &st); err != nil {
+				return ToErrno(err)
+			}
+			if m := withoutSuidGid(uint32(st.Mode)); m != uint32(st.Mode) {
+				if err := syscall.Chmod(p, m&07777); err != nil {
+					return ToErrno(err)
+				}
+			}
+		}
+	}
+	return OK
+}
+
+func (n *LoopbackFdNode) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	if f != nil {
+		return f.(FileStatxer).Statx(ctx, flags, mask, out)
+	}
+
+	st := unix.Statx_t{}
+	err := unix.Statx(n.Fd(), "", int(flags)&_AT_STATX_SYNC_TYPE|_AT_EMPTY_PATH, int(mask), &st)
+	if err == syscall.ENOSYS {
+		// statx(2) is not available, fall back to stat.
+		var attr fuse.AttrOut
+		if errno := n.Getattr(ctx, nil, &attr); errno != 0 {
+			return errno
+		}
+		out.Statx.FromAttr(&attr.Attr)
+		return OK
+	}
+	if err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatx(&st)
+	return OK
+}
+
+// The xattr calls do not take O_PATH descriptors, so they go through
+// /proc, which leads to the file itself, also for symlinks.
+
+func (n *LoopbackFdNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	sz, err := unix.Getxattr(n.procPath(), attr, dest)
+	return uint32(sz), ToErrno(err)
+}
+
+func (n *LoopbackFdNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	p := n.procPath()
+	if err := unix.Setxattr(p, attr, data, int(flags)); err != nil {
+		return ToErrno(err)
+	}
+	if killSgid(ctx) {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(n.Fd(), &st); err != nil {
+			return ToErrno(err)
+		}
+		if st.Mode&syscall.S_ISGID != 0 && st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			return ToErrno(syscall.Chmod(p, st.Mode&07777&^syscall.S_ISGID))
+		}
+	}
+	return 0
+}
+
+func (n *LoopbackFdNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return ToErrno(unix.Removexattr(n.procPath(), attr))
+}
+
+func (n *LoopbackFdNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	sz, err := unix.Listxattr(n.procPath(), dest)
+	return uint32(sz), ToErrno(err)
+}
+
+func (n *LoopbackFdNode) Syncfs(ctx context.Context) syscall.Errno {
+	fd, err := reopenFd(n.Fd(), syscall.O_RDONLY)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return ToErrno(unix.Syncfs(fd))
+}
+
+func (n *LoopbackFdNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
+	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	return copyFileRange(fhIn, offIn, fhOut, offOut, len, flags)
+}
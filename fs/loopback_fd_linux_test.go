@@ -0,0 +1,64 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestLoopbackFdRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoopbackFdRename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, err := NewLoopbackFdRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var dirOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "a", &dirOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	var createOut fuse.CreateOut
+	createIn := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Flags: syscall.O_WRONLY, Mode: 0644}
+	if st := rawFS.Create(nil, createIn, "f", &createOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId}, Fh: createOut.Fh})
+
+	// Rename the directory behind the back of the file system.
+	// The nodes keep referring to the same files.
+	if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	var attr fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId}}, &attr); !st.Ok() {
+		t.Errorf("GetAttr after rename: %v", st)
+	}
+	var entry fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Mode: 0755}, "sub", &entry); !st.Ok() {
+		t.Fatalf("Mkdir after rename: %v", st)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b", "sub")); err != nil {
+		t.Errorf("Mkdir did not follow the renamed directory: %v", err)
+	}
+
+	// Forgetting a node closes its descriptor.
+	n, _ := rawFS.(*rawBridge).inode(entry.NodeId, 0)
+	rawFS.Forget(entry.NodeId, 1)
+	if fd := n.Operations().(*LoopbackFdNode).Fd(); fd != -1 {
+		t.Errorf("forgotten node has descriptor %d", fd)
+	}
+}
@@ -8,9 +8,12 @@ package fs
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
@@ -20,8 +23,20 @@ func (n *LoopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (
 }
 
 func (n *LoopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
-	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
-	return ToErrno(err)
+	p := n.path()
+	if err := unix.Lsetxattr(p, attr, data, int(flags)); err != nil {
+		return ToErrno(err)
+	}
+	if killSgid(ctx) {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			return ToErrno(err)
+		}
+		if st.Mode&syscall.S_ISGID != 0 && st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			return ToErrno(syscall.Chmod(p, st.Mode&07777&^syscall.S_ISGID))
+		}
+	}
+	return 0
 }
 
 func (n *LoopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
@@ -34,6 +49,85 @@ func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, sysc
 	return uint32(sz), ToErrno(err)
 }
 
+var _ = (NodeSyncfser)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Syncfs(ctx context.Context) syscall.Errno {
+	fd, err := syscall.Open(n.path(), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return ToErrno(unix.Syncfs(fd))
+}
+
+// hasDefaultACL returns whether the directory dir has a default POSIX
+// ACL, which gives new files their mode instead of the umask.
+func hasDefaultACL(dir string) bool {
+	sz, err := unix.Getxattr(dir, "system.posix_acl_default", nil)
+	return err == nil && sz > 0
+}
+
+var _ = (NodeTmpfiler)((*LoopbackNode)(nil))
+
+// tmpfileName is the name that NewNode gets for an O_TMPFILE file,
+// which has none. Like Linux, it is "#" and the inode number.
+func tmpfileName(st *syscall.Stat_t) string {
+	return fmt.Sprintf("#%d", st.Ino)
+}
+
+// Tmpfile creates an O_TMPFILE file in the backing directory. Giving
+// it a name with linkat(2) on the mount is not supported.
+func (n *LoopbackNode) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	flags = flags &^ syscall.O_APPEND
+	fd, err := syscall.Open(n.path(), int(flags)|unix.O_TMPFILE, createMode(ctx, n.path(), mode))
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && os.Getuid() == 0 {
+		syscall.Fchown(fd, int(caller.Uid), ownerGid(caller, n.path()))
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+
+	node := n.RootData.newNode(n.EmbeddedInode(), tmpfileName(&st), &st)
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+
+	out.FromStat(&st)
+	return ch, NewLoopbackFile(fd), 0, 0
+}
+
+var _ = (NodeStatxer)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	if f != nil {
+		return f.(FileStatxer).Statx(ctx, flags, mask, out)
+	}
+
+	atFlags := int(flags) & _AT_STATX_SYNC_TYPE
+	if &n.Inode != n.Root() {
+		atFlags |= unix.AT_SYMLINK_NOFOLLOW
+	}
+	st := unix.Statx_t{}
+	err := unix.Statx(unix.AT_FDCWD, n.path(), atFlags, int(mask), &st)
+	if err == syscall.ENOSYS {
+		// statx(2) is not available, fall back to stat.
+		var attr fuse.AttrOut
+		if errno := n.Getattr(ctx, nil, &attr); errno != 0 {
+			return errno
+		}
+		out.Statx.FromAttr(&attr.Attr)
+		return OK
+	}
+	if err != nil {
+		return ToErrno(err)
+	}
+	out.FromStatx(&st)
+	return OK
+}
+
 func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
 	fd1, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0)
 	if err != nil {
@@ -69,8 +163,21 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
 }
 
+// renameat2 renames with flags, such as RENAME_NOREPLACE and
+// RENAME_WHITEOUT, that rename(2) can't express.
+func renameat2(oldPath, newPath string, flags uint32) syscall.Errno {
+	return ToErrno(unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, uint(flags)))
+}
+
 func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
+	len uint64, flags uint64) (uint32, syscall.Errno) {
+	return copyFileRange(fhIn, offIn, fhOut, offOut, len, flags)
+}
+
+// copyFileRange copies between two loopback files with
+// copy_file_range(2).
+func copyFileRange(fhIn FileHandle, offIn uint64, fhOut FileHandle, offOut uint64,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
 	lfIn, ok := fhIn.(*loopbackFile)
 	if !ok {
@@ -6,9 +6,12 @@ package fs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -105,6 +108,226 @@ func TestRenameNoOverwrite(t *testing.T) {
 	}
 }
 
+func TestRenameWhiteout(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	f1, err := syscall.Open(tc.mntDir+"/", syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer syscall.Close(f1)
+
+	if err := unix.Renameat2(f1, "file", f1, "moved", unix.RENAME_WHITEOUT); err == syscall.EPERM || err == syscall.EINVAL {
+		t.Skipf("RENAME_WHITEOUT not supported: %v", err)
+	} else if err != nil {
+		t.Fatalf("Renameat2: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/file", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	var attr fuse.Attr
+	attr.FromStat(&st)
+	if !IsWhiteout(&attr) {
+		t.Errorf("got mode %o rdev %d, want whiteout", st.Mode, st.Rdev)
+	}
+	if got, err := ioutil.ReadFile(tc.mntDir + "/moved"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: %q, %v", got, err)
+	}
+
+	if err := unix.Renameat2(f1, "moved", f1, "file", unix.RENAME_EXCHANGE|unix.RENAME_WHITEOUT); err != syscall.EINVAL {
+		t.Errorf("EXCHANGE|WHITEOUT: got %v, want EINVAL", err)
+	}
+}
+
+func TestFlock(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true, locks: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	f1, err := os.Open(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("Flock 1: %v", err)
+	}
+	if err := syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Flock 2: got %v, want EWOULDBLOCK", err)
+	}
+
+	// The lock is taken on the backing file.
+	orig, err := os.Open(tc.origDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	if err := syscall.Flock(int(orig.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("Flock orig: got %v, want EWOULDBLOCK", err)
+	}
+
+	// Closing the file releases the lock.
+	f1.Close()
+	if err := syscall.Flock(int(f2.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("Flock 2 after close: %v", err)
+	}
+}
+
+// origLocked returns whether a write lock on the backing file
+// conflicts with a lock taken through the mount.
+func origLocked(t *testing.T, tc *testCase) bool {
+	orig, err := os.Open(tc.origDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(orig.Fd(), _OFD_GETLK, &lk); err != nil {
+		t.Fatalf("OFD_GETLK: %v", err)
+	}
+	return lk.Type != syscall.F_UNLCK
+}
+
+func TestPosixLock(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true, locks: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	f1, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	// POSIX locks belong to the process, so locks through
+	// different files don't conflict.
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f1.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("SETLK 1: %v", err)
+	}
+	if err := syscall.FcntlFlock(f2.Fd(), syscall.F_SETLK, &lk); err != nil {
+		t.Fatalf("SETLK 2: %v", err)
+	}
+	if !origLocked(t, tc) {
+		t.Errorf("backing file not locked")
+	}
+
+	// Closing any file of the process drops its locks.
+	f2.Close()
+	if origLocked(t, tc) {
+		t.Errorf("backing file still locked after close")
+	}
+}
+
+func TestOFDLock(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true, locks: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	f1, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	// OFD locks belong to the open file, so locks through
+	// different files conflict.
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f1.Fd(), _OFD_SETLK, &lk); err != nil {
+		t.Fatalf("OFD_SETLK 1: %v", err)
+	}
+	lk = syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f2.Fd(), _OFD_SETLK, &lk); err != syscall.EAGAIN {
+		t.Errorf("OFD_SETLK 2: got %v, want EAGAIN", err)
+	}
+
+	// Closing another file does not drop the lock.
+	f2.Close()
+	if !origLocked(t, tc) {
+		t.Errorf("backing file not locked after closing other file")
+	}
+
+	// Closing the locked file does. The kernel releases the
+	// file asynchronously.
+	f1.Close()
+	for i := 0; origLocked(t, tc); i++ {
+		if i == 100 {
+			t.Fatalf("backing file still locked after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOwnerLockWriteOnly(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	name := dir + "/file"
+	fd, err := syscall.Open(name, syscall.O_WRONLY|syscall.O_CREAT, 0200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewLoopbackFile(fd).(*loopbackFile)
+	defer f.Release(context.Background())
+
+	ctx := context.Background()
+	lk := fuse.FileLock{Start: 0, End: (1 << 63) - 1, Typ: syscall.F_WRLCK}
+	if errno := f.Setlk(ctx, 1, &lk, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+	var out fuse.FileLock
+	if errno := f.Getlk(ctx, 2, &lk, 0, &out); errno != 0 {
+		t.Fatalf("Getlk: %v", errno)
+	}
+	if out.Typ != syscall.F_WRLCK {
+		t.Errorf("lock of other owner: got type %d, want F_WRLCK", out.Typ)
+	}
+
+	lk.Typ = syscall.F_UNLCK
+	if errno := f.Setlk(ctx, 1, &lk, 0); errno != 0 {
+		t.Fatalf("unlock: %v", errno)
+	}
+}
+
+func TestOwnerGid(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+
+	caller := &fuse.Caller{Owner: fuse.Owner{Uid: 1, Gid: 2}}
+	if got := ownerGid(caller, dir); got != 2 {
+		t.Errorf("got gid %d, want the caller's 2", got)
+	}
+	if err := os.Chmod(dir, 0755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	if got := ownerGid(caller, dir); got != -1 {
+		t.Errorf("setgid directory: got gid %d, want -1", got)
+	}
+}
+
 func TestXAttr(t *testing.T) {
 	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
 	defer tc.Clean()
@@ -248,6 +471,77 @@ func TestCopyFileRange(t *testing.T) {
 
 }
 
+func TestStatx(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	if !tc.server.KernelSettings().SupportsVersion(7, 39) {
+		t.Skip("need v7.39 for STATX")
+	}
+
+	tc.writeOrig("file", "hello", 0644)
+
+	var want unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.origDir+"/file", 0, unix.STATX_ALL, &want); err != nil {
+		t.Fatalf("Statx orig: %v", err)
+	}
+	if want.Mask&unix.STATX_BTIME == 0 {
+		t.Skip("backing file system does not support birth time")
+	}
+
+	var got unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.mntDir+"/file", 0, unix.STATX_ALL, &got); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if got.Mask&unix.STATX_BTIME == 0 {
+		t.Fatalf("got mask 0x%x, want STATX_BTIME", got.Mask)
+	}
+	if got.Btime != want.Btime {
+		t.Errorf("got btime %v, want %v", got.Btime, want.Btime)
+	}
+	if got.Size != 5 {
+		t.Errorf("got size %d, want 5", got.Size)
+	}
+}
+
+func TestTmpfile(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+
+	if !tc.server.KernelSettings().SupportsVersion(7, 37) {
+		t.Skip("need v7.37 for TMPFILE")
+	}
+
+	fd, err := syscall.Open(tc.mntDir, unix.O_TMPFILE|syscall.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("Open(O_TMPFILE): %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "tmpfile")
+	defer f.Close()
+
+	if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, 0)
+	if string(buf[:n]) != "hello" {
+		t.Errorf("ReadAt: got %q, %v", buf[:n], err)
+	}
+	if st, err := f.Stat(); err != nil {
+		t.Errorf("Stat: %v", err)
+	} else if st.Size() != 5 || !st.Mode().IsRegular() {
+		t.Errorf("Stat: got size %d mode %v", st.Size(), st.Mode())
+	}
+
+	entries, err := ioutil.ReadDir(tc.origDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("backing directory has entries %v", entries)
+	}
+}
+
 // Wait for a change in /proc/self/mounts. Efficient through the use of
 // unix.Poll().
 func waitProcMountsChange() error {
@@ -385,3 +679,306 @@ func TestRoMount(t *testing.T) {
 	tc := newTestCase(t, &testOptions{ro: true})
 	defer tc.Clean()
 }
+
+func TestKillSuidGid(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	loopbackRoot, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(loopbackRoot, &Options{})
+
+	setup := func(name string, mode uint32) uint64 {
+		t.Helper()
+		p := dir + "/" + name
+		if err := ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(p, os.FileMode(mode&0777)|os.ModeSetuid|os.ModeSetgid); err != nil {
+			t.Fatal(err)
+		}
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return out.NodeId
+	}
+	mode := func(name string) uint32 {
+		t.Helper()
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir+"/"+name, &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Mode & 07777
+	}
+
+	// Without the flag, the bits stay.
+	id := setup("keep", 0755)
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}, Flags: syscall.O_WRONLY}, &openOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if _, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: id}, Fh: openOut.Fh}, []byte("x")); !st.Ok() {
+		t.Fatal(st)
+	}
+	if got := mode("keep"); got != 06755 {
+		t.Errorf("write without flag: got mode %o, want 6755", got)
+	}
+
+	// setgid is only cleared for group-executable files.
+	id = setup("write", 0744)
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}, Flags: syscall.O_WRONLY}, &openOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	in := fuse.WriteIn{InHeader: fuse.InHeader{NodeId: id}, Fh: openOut.Fh, WriteFlags: fuse.WRITE_KILL_SUIDGID}
+	if _, st := rawFS.Write(nil, &in, []byte("x")); !st.Ok() {
+		t.Fatal(st)
+	}
+	if got := mode("write"); got != 02744 {
+		t.Errorf("write: got mode %o, want 2744", got)
+	}
+
+	id = setup("open", 0755)
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: id}, Flags: syscall.O_WRONLY | syscall.O_TRUNC, Mode: fuse.OPEN_KILL_SUIDGID}
+	if st := rawFS.Open(nil, &openIn, &openOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if got := mode("open"); got != 0755 {
+		t.Errorf("open: got mode %o, want 755", got)
+	}
+
+	id = setup("truncate", 0755)
+	setIn := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: fuse.InHeader{NodeId: id},
+		Valid:    fuse.FATTR_SIZE | fuse.FATTR_KILL_SUIDGID,
+	}}
+	var attrOut fuse.AttrOut
+	if st := rawFS.SetAttr(nil, &setIn, &attrOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if got := mode("truncate"); got != 0755 {
+		t.Errorf("truncate: got mode %o, want 755", got)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	for _, newRoot := range []func(string) (InodeEmbedder, error){NewLoopbackRoot, NewLoopbackFdRoot} {
+		for _, dontUmask := range []bool{false, true} {
+			dir := testutil.TempDir()
+			defer os.RemoveAll(dir)
+			root, err := newRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := &Options{}
+			opts.DontUmask = dontUmask
+			rawFS := NewNodeFS(root, opts)
+
+			// Without DontUmask, the kernel has applied the
+			// umask already.
+			want := uint32(0777)
+			if dontUmask {
+				want = 0755
+			}
+			mode := func(name string) uint32 {
+				t.Helper()
+				var st syscall.Stat_t
+				if err := syscall.Lstat(dir+"/"+name, &st); err != nil {
+					t.Fatal(err)
+				}
+				return st.Mode & 07777
+			}
+
+			var entryOut fuse.EntryOut
+			if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0777, Umask: 022}, "dir", &entryOut); !st.Ok() {
+				t.Fatal(st)
+			}
+			if got := mode("dir"); got != want {
+				t.Errorf("DontUmask %v: mkdir: got mode %o, want %o", dontUmask, got, want)
+			}
+
+			var createOut fuse.CreateOut
+			createIn := fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_WRONLY, Mode: 0777, Umask: 022}
+			if st := rawFS.Create(nil, &createIn, "file", &createOut); !st.Ok() {
+				t.Fatal(st)
+			}
+			rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: createOut.NodeId}, Fh: createOut.Fh})
+			if got := mode("file"); got != want {
+				t.Errorf("DontUmask %v: create: got mode %o, want %o", dontUmask, got, want)
+			}
+
+			mknodIn := fuse.MknodIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: syscall.S_IFIFO | 0777, Umask: 022}
+			if st := rawFS.Mknod(nil, &mknodIn, "fifo", &entryOut); !st.Ok() {
+				t.Fatal(st)
+			}
+			if got := mode("fifo"); got != want {
+				t.Errorf("DontUmask %v: mknod: got mode %o, want %o", dontUmask, got, want)
+			}
+		}
+	}
+}
+
+func TestSillyRename(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	loopbackRoot, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(loopbackRoot, &Options{SillyRename: true})
+
+	open := func(name string) (nodeId, fh uint64) {
+		t.Helper()
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var entry fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !st.Ok() {
+			t.Fatalf("Open(%q): %v", name, st)
+		}
+		return entry.NodeId, out.Fh
+	}
+	read := func(nodeId, fh uint64) string {
+		t.Helper()
+		buf := make([]byte, 100)
+		res, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: nodeId}, Fh: fh, Size: 100}, buf)
+		if !st.Ok() {
+			t.Fatalf("Read: %v", st)
+		}
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	hidden := func() []string {
+		t.Helper()
+		var names []string
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".fuse_hidden") {
+				names = append(names, e.Name())
+			}
+		}
+		return names
+	}
+
+	id, fh := open("unlinked")
+	if st := rawFS.Unlink(nil, &fuse.InHeader{NodeId: 1}, "unlinked"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	if _, err := os.Lstat(dir + "/unlinked"); !os.IsNotExist(err) {
+		t.Errorf("unlinked file still exists: %v", err)
+	}
+	if got := hidden(); len(got) != 1 {
+		t.Errorf("got hidden files %q, want 1", got)
+	}
+	if got := read(id, fh); got != "unlinked" {
+		t.Errorf("read after unlink: got %q", got)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: id}, Fh: fh})
+	if got := hidden(); len(got) != 0 {
+		t.Errorf("hidden files %q remain after release", got)
+	}
+
+	// A rename that replaces an open file hides it too.
+	id, fh = open("target")
+	open("source")
+	renameIn := fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}
+	if st := rawFS.Rename(nil, &renameIn, "source", "target"); !st.Ok() {
+		t.Fatalf("Rename: %v", st)
+	}
+	if data, err := ioutil.ReadFile(dir + "/target"); err != nil || string(data) != "source" {
+		t.Errorf("target after rename: %q, %v", data, err)
+	}
+	if got := read(id, fh); got != "target" {
+		t.Errorf("read after rename: got %q", got)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: id}, Fh: fh})
+	if got := hidden(); len(got) != 0 {
+		t.Errorf("hidden files %q remain after release", got)
+	}
+}
+
+func TestSetXAttrKillSgid(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	loopbackRoot, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(loopbackRoot, &Options{})
+
+	p := dir + "/file"
+	if err := ioutil.WriteFile(p, []byte("hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p, 0755|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+		t.Fatal(st)
+	}
+
+	for _, tc := range []struct {
+		flags uint32
+		want  uint32
+	}{
+		{0, 02755},
+		{fuse.SETXATTR_ACL_KILL_SGID, 0755},
+	} {
+		in := fuse.SetXAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, SetXAttrFlags: tc.flags}
+		if st := rawFS.SetXAttr(nil, &in, "user.attr", []byte("value")); st == fuse.Status(syscall.EOPNOTSUPP) {
+			t.Skip("xattrs not supported")
+		} else if !st.Ok() {
+			t.Fatal(st)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(p, &st); err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode & 07777; got != tc.want {
+			t.Errorf("flags %x: got mode %o, want %o", tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestTmpfileName(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root := &LoopbackRoot{Path: dir}
+	var names []string
+	root.NewNode = func(r *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
+		names = append(names, name)
+		return &LoopbackNode{RootData: r}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	root.Dev = uint64(st.Dev)
+	rawFS := NewNodeFS(root.newNode(nil, "", &st), &Options{})
+
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0600}
+	var out fuse.CreateOut
+	if st := rawFS.Tmpfile(nil, in, &out); st == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("O_TMPFILE not supported by the backing file system")
+	} else if !st.Ok() {
+		t.Fatal(st)
+	}
+	defer rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, Fh: out.Fh})
+
+	want := fmt.Sprintf("#%d", out.Attr.Ino)
+	if len(names) != 2 || names[1] != want {
+		t.Errorf("NewNode got names %q, want %q for the tmpfile", names, want)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MagicEntry is a virtual directory entry, such as ".snapshot" or
+// ".control", that is added to every directory of the file system
+// without the directory nodes knowing about it. See
+// Options.MagicEntries.
+type MagicEntry struct {
+	// Name is the name of the entry in each directory.
+	Name string
+
+	// Mode is the file type of the entry, eg. syscall.S_IFDIR.
+	Mode uint32
+
+	// NewNode returns the node for the entry in directory
+	// dir. It is called on lookup if the kernel does not
+	// reference the entry of that directory already. Nodes below
+	// the returned node are part of the virtual tree, and do not
+	// get magic entries themselves.
+	NewNode func(ctx context.Context, dir *Inode) InodeEmbedder
+}
+
+// magicEntry returns the magic entry for name, if the directory
+// gets magic entries.
+func (b *rawBridge) magicEntry(dir *Inode, name string) *MagicEntry {
+	if dir.magic || !dir.IsDir() {
+		return nil
+	}
+	for i := range b.options.MagicEntries {
+		if b.options.MagicEntries[i].Name == name {
+			return &b.options.MagicEntries[i]
+		}
+	}
+	return nil
+}
+
+// lookupMagic returns the node for a magic entry, reusing the one
+// the kernel knows about if possible.
+func (b *rawBridge) lookupMagic(ctx *fuse.Context, dir *Inode, m *MagicEntry, out *fuse.EntryOut) *Inode {
+	child := dir.GetChild(m.Name)
+	if child == nil || !child.magic {
+		child = dir.NewInode(ctx, m.NewNode(ctx, dir), StableAttr{Mode: m.Mode})
+		child.magic = true
+	}
+	if ga, ok := child.ops.(NodeGetattrer); ok {
+		var a fuse.AttrOut
+		if errno := ga.Getattr(ctx, nil, &a); errno == 0 {
+			out.Attr = a.Attr
+		}
+	}
+	return child
+}
+
+// checkMagicName returns the status for a modifying operation on
+// name in dir, or OK if name is not a magic entry.
+func (b *rawBridge) checkMagicName(dir *Inode, name string, create bool) fuse.Status {
+	if b.magicEntry(dir, name) == nil {
+		return fuse.OK
+	}
+	if create {
+		return fuse.Status(syscall.EEXIST)
+	}
+	return fuse.EPERM
+}
+
+// magicDirStream hides the entries of a directory that are shadowed
+// by magic entries, and appends the magic entries.
+type magicDirStream struct {
+	DirStream
+
+	dir   *Inode
+	magic []MagicEntry
+
+	pending    fuse.DirEntry
+	pendingErr syscall.Errno
+	hasPending bool
+}
+
+func newMagicDirStream(dir *Inode, s DirStream, magic []MagicEntry) DirStream {
+	return &magicDirStream{
+		DirStream: s,
+		dir:       dir,
+		magic:     magic,
+	}
+}
+
+func (s *magicDirStream) isMagic(name string) bool {
+	for _, m := range s.magic {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *magicDirStream) HasNext() bool {
+	if s.hasPending {
+		return true
+	}
+	for s.DirStream.HasNext() {
+		e, errno := s.DirStream.Next()
+		if errno == 0 && s.isMagic(e.Name) {
+			continue
+		}
+		s.pending, s.pendingErr, s.hasPending = e, errno, true
+		return true
+	}
+	return len(s.magic) > 0
+}
+
+func (s *magicDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.HasNext() {
+		return fuse.DirEntry{}, syscall.EBADF
+	}
+	if s.hasPending {
+		s.hasPending = false
+		return s.pending, s.pendingErr
+	}
+
+	m := s.magic[0]
+	s.magic = s.magic[1:]
+	e := fuse.DirEntry{Name: m.Name, Mode: m.Mode}
+	if ch := s.dir.GetChild(m.Name); ch != nil && ch.magic {
+		e.Ino = ch.StableAttr().Ino
+	}
+	return e, 0
+}
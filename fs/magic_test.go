@@ -0,0 +1,90 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMagicEntries(t *testing.T) {
+	root := &Inode{}
+	var created []*Inode
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			shadowed := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+			root.AddChild(".snapshot", shadowed, false)
+		},
+		MagicEntries: []MagicEntry{{
+			Name: ".snapshot",
+			Mode: syscall.S_IFDIR,
+			NewNode: func(ctx context.Context, dir *Inode) InodeEmbedder {
+				created = append(created, dir)
+				return &Inode{}
+			},
+		}},
+	})
+	b := rawFS.(*rawBridge)
+
+	lookup := func(parent uint64, name string) fuse.EntryOut {
+		t.Helper()
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%d, %q): %v", parent, name, st)
+		}
+		return out
+	}
+	names := func(n *Inode) []string {
+		t.Helper()
+		s, errno := b.getStream(context.Background(), n)
+		if errno != 0 {
+			t.Fatalf("getStream: %v", errno)
+		}
+		var r []string
+		for s.HasNext() {
+			e, _ := s.Next()
+			r = append(r, e.Name)
+		}
+		sort.Strings(r)
+		return r
+	}
+
+	snap := lookup(1, ".snapshot")
+	if snap.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("got mode %o, want directory", snap.Mode)
+	}
+	if again := lookup(1, ".snapshot"); again.NodeId != snap.NodeId {
+		t.Errorf("second lookup returned node %d, want %d", again.NodeId, snap.NodeId)
+	}
+	dir := lookup(1, "dir")
+	if dirSnap := lookup(dir.NodeId, ".snapshot"); dirSnap.NodeId == snap.NodeId {
+		t.Errorf("directories share the magic node")
+	}
+	if len(created) != 2 {
+		t.Errorf("NewNode called %d times, want 2", len(created))
+	}
+
+	if got := names(root); len(got) != 2 || got[0] != ".snapshot" || got[1] != "dir" {
+		t.Errorf("root listing: got %v", got)
+	}
+	snapNode, _ := b.inode(snap.NodeId, 0)
+	if got := names(snapNode); len(got) != 0 {
+		t.Errorf("magic directory listing: got %v, want none", got)
+	}
+
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: snap.NodeId}, ".snapshot", &out); st != fuse.ENOENT {
+		t.Errorf("nested magic lookup: got %v, want ENOENT", st)
+	}
+	if st := rawFS.Unlink(nil, &fuse.InHeader{NodeId: 1}, ".snapshot"); st != fuse.EPERM {
+		t.Errorf("Unlink: got %v, want EPERM", st)
+	}
+}
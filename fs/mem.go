@@ -20,6 +20,11 @@ type MemRegularFile struct {
 	mu   sync.Mutex
 	Data []byte
 	Attr fuse.Attr
+
+	// alloc tracks the blocks in use, for st_blocks. It is set up
+	// on first use, because Data may be filled in directly.
+	alloc     Allocation
+	allocInit bool
 }
 
 var _ = (NodeOpener)((*MemRegularFile)(nil))
@@ -27,9 +32,34 @@ var _ = (NodeReader)((*MemRegularFile)(nil))
 var _ = (NodeWriter)((*MemRegularFile)(nil))
 var _ = (NodeSetattrer)((*MemRegularFile)(nil))
 var _ = (NodeFlusher)((*MemRegularFile)(nil))
+var _ = (NodeAllocater)((*MemRegularFile)(nil))
+
+// allocation returns the block accounting, considering all of the
+// initial Data as written.
+func (f *MemRegularFile) allocation() *Allocation {
+	if !f.allocInit {
+		f.alloc.Write(0, uint64(len(f.Data)))
+		f.allocInit = true
+	}
+	return &f.alloc
+}
+
+// resize sets the length of Data to sz, zeroing any new bytes.
+func (f *MemRegularFile) resize(sz uint64) {
+	if sz <= uint64(len(f.Data)) {
+		f.Data = f.Data[:sz]
+		return
+	}
+	n := make([]byte, sz)
+	copy(n, f.Data)
+	f.Data = n
+}
 
 func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	return nil, fuse.FOPEN_KEEP_CACHE, OK
+	if errno := TruncateOnOpen(ctx, f, nil, flags); errno != 0 {
+		return nil, 0, errno
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE | fuse.FOPEN_NOFLUSH, OK
 }
 
 func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
@@ -37,12 +67,11 @@ func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte,
 	defer f.mu.Unlock()
 	end := int64(len(data)) + off
 	if int64(len(f.Data)) < end {
-		n := make([]byte, end)
-		copy(n, f.Data)
-		f.Data = n
+		f.resize(uint64(end))
 	}
 
 	copy(f.Data[off:off+int64(len(data))], data)
+	f.allocation().Write(uint64(off), uint64(len(data)))
 
 	return uint32(len(data)), 0
 }
@@ -54,6 +83,7 @@ func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.A
 	defer f.mu.Unlock()
 	out.Attr = f.Attr
 	out.Attr.Size = uint64(len(f.Data))
+	f.allocation().FillAttr(&out.Attr)
 	return OK
 }
 
@@ -61,10 +91,41 @@ func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.Se
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if sz, ok := in.GetSize(); ok {
-		f.Data = f.Data[:sz]
+		f.allocation().Truncate(sz)
+		f.resize(sz)
 	}
 	out.Attr = f.Attr
 	out.Size = uint64(len(f.Data))
+	f.allocation().FillAttr(&out.Attr)
+	return OK
+}
+
+func (f *MemRegularFile) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	newSize, errno := f.allocation().Fallocate(uint64(len(f.Data)), off, size, mode)
+	if errno != 0 {
+		return errno
+	}
+	switch mode {
+	case fuse.FALLOC_FL_COLLAPSE_RANGE:
+		f.Data = append(f.Data[:off], f.Data[off+size:]...)
+		return OK
+	case fuse.FALLOC_FL_INSERT_RANGE:
+		f.resize(newSize)
+		copy(f.Data[off+size:], f.Data[off:])
+	default:
+		f.resize(newSize)
+	}
+	if mode&(fuse.FALLOC_FL_PUNCH_HOLE|fuse.FALLOC_FL_ZERO_RANGE|fuse.FALLOC_FL_INSERT_RANGE) != 0 && off < newSize {
+		end := off + size
+		if end > newSize {
+			end = newSize
+		}
+		for i := off; i < end; i++ {
+			f.Data[i] = 0
+		}
+	}
 	return OK
 }
 
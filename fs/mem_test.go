@@ -28,6 +28,7 @@ func testMount(t *testing.T, root InodeEmbedder, opts *Options) (string, *fuse.S
 	}
 	opts.Debug = testutil.VerboseTest()
 
+	checkFds := testutil.CheckFdLeaks(t)
 	server, err := Mount(mntDir, root, opts)
 	if err != nil {
 		t.Fatal(err)
@@ -36,6 +37,7 @@ func testMount(t *testing.T, root InodeEmbedder, opts *Options) (string, *fuse.S
 		if err := server.Unmount(); err != nil {
 			t.Fatalf("testMount: Unmount failed: %v", err)
 		}
+		checkFds()
 		if err := syscall.Rmdir(mntDir); err != nil {
 			t.Errorf("testMount: Remove failed: %v", err)
 		}
@@ -197,3 +199,30 @@ func TestDataSymlink(t *testing.T) {
 		t.Errorf("Readlink: got %q want %q", got, want)
 	}
 }
+
+func TestAtomicTrunc(t *testing.T) {
+	mf := &MemRegularFile{Data: []byte("hello")}
+	root := &Inode{}
+	mntDir, server, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableAtomicTrunc: true},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, mf, StableAttr{}), false)
+		},
+	})
+	defer clean()
+	if server.KernelSettings().Flags&fuse.CAP_ATOMIC_O_TRUNC == 0 {
+		t.Skip("kernel does not support ATOMIC_O_TRUNC")
+	}
+
+	f, err := os.OpenFile(mntDir+"/file", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mf.mu.Lock()
+	got := len(mf.Data)
+	mf.mu.Unlock()
+	if got != 0 {
+		t.Errorf("got size %d after O_TRUNC open, want 0", got)
+	}
+}
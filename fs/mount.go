@@ -5,6 +5,8 @@
 package fs
 
 import (
+	"io"
+	"net"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -15,16 +17,10 @@ import (
 // fuse.NewServer.  If nil is given as options, default settings are
 // applied, which are 1 second entry and attribute timeout.
 func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, error) {
-	if options == nil {
-		oneSec := time.Second
-		options = &Options{
-			EntryTimeout: &oneSec,
-			AttrTimeout:  &oneSec,
-		}
-	}
+	options = defaultOptions(options)
 
 	rawFS := NewNodeFS(root, options)
-	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	server, err := fuse.NewServer(rawFS, dir, options.mountOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -38,3 +34,48 @@ func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, erro
 
 	return server, nil
 }
+
+// TakeOver takes over the mount that another process passes on with
+// fuse.Server.HandOff over conn, and starts serving requests. The
+// nodes and open files that the kernel knows about are found again
+// below root, see fuse.HandOffRestorer. This is the counterpart of
+// Mount for upgrading a daemon without unmounting; the options
+// should match those of the other process.
+func TakeOver(conn *net.UnixConn, root InodeEmbedder, options *Options) (*fuse.Server, error) {
+	options = defaultOptions(options)
+	rawFS := NewNodeFS(root, options)
+	server, err := fuse.TakeOver(conn, rawFS, options.mountOptions())
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// Restore restores the mount from the FUSE device fd and the state
+// that fuse.Server.Checkpoint wrote to r, and starts serving
+// requests. Like TakeOver, it finds the nodes and open files that the
+// kernel knows about again below root.
+func Restore(fd int, r io.Reader, root InodeEmbedder, options *Options) (*fuse.Server, error) {
+	options = defaultOptions(options)
+	rawFS := NewNodeFS(root, options)
+	server, err := fuse.Restore(fd, r, rawFS, options.mountOptions())
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return server, nil
+}
+
+// defaultOptions returns options, or the defaults of Mount if it is
+// nil.
+func defaultOptions(options *Options) *Options {
+	if options != nil {
+		return options
+	}
+	oneSec := time.Second
+	return &Options{
+		EntryTimeout: &oneSec,
+		AttrTimeout:  &oneSec,
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NameEncoding selects how file names that are not valid UTF-8 are
+// passed between the kernel and the nodes of the file system.
+type NameEncoding int
+
+const (
+	// NamesRaw passes names unchanged, as byte strings. Names
+	// need not be valid UTF-8, so Latin-1 names from legacy
+	// backends survive the round trip, as long as the nodes do
+	// not convert them, eg. through []rune.
+	NamesRaw NameEncoding = iota
+
+	// NamesRejectInvalid fails requests for names that are not
+	// valid UTF-8 with EILSEQ, and leaves such names out of
+	// directory listings.
+	NamesRejectInvalid
+
+	// NamesEscapeInvalid presents names that are not valid UTF-8
+	// as valid UTF-8 to the kernel, by replacing each invalid byte
+	// b with the private use rune U+F700+b. Names from the kernel
+	// are unescaped before they reach the nodes, so the nodes see
+	// the original bytes. Names with runes U+F780 to U+F7FF are
+	// escaped too, to keep the mapping reversible. Names from the
+	// kernel that are not valid UTF-8 fail with EILSEQ.
+	//
+	// Names passed to notification methods, such as
+	// Inode.NotifyEntry, are not escaped.
+	NamesEscapeInvalid
+)
+
+// Invalid bytes, which are all 0x80 and above, are escaped as
+// nameEscapeBase + byte.
+const nameEscapeBase = 0xF700
+
+func isNameEscape(r rune) bool {
+	return r >= nameEscapeBase+0x80 && r <= nameEscapeBase+0xff
+}
+
+// escapeName escapes the invalid UTF-8 in name for NamesEscapeInvalid.
+func escapeName(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); {
+		r, sz := utf8.DecodeRuneInString(name[i:])
+		if (r == utf8.RuneError && sz == 1) || isNameEscape(r) {
+			if sb.Len() == 0 {
+				sb.WriteString(name[:i])
+			}
+			for _, c := range []byte(name[i : i+sz]) {
+				sb.WriteRune(nameEscapeBase + rune(c))
+			}
+		} else if sb.Len() > 0 {
+			sb.WriteString(name[i : i+sz])
+		}
+		i += sz
+	}
+	if sb.Len() == 0 {
+		return name
+	}
+	return sb.String()
+}
+
+// unescapeName reverses escapeName. It returns false if name is not
+// valid UTF-8.
+func unescapeName(name string) (string, bool) {
+	if !utf8.ValidString(name) {
+		return "", false
+	}
+	var buf []byte
+	for i, r := range name {
+		if isNameEscape(r) {
+			if buf == nil {
+				buf = append(buf, name[:i]...)
+			}
+			buf = append(buf, byte(r-nameEscapeBase))
+		} else if buf != nil {
+			buf = append(buf, string(r)...)
+		}
+	}
+	if buf == nil {
+		return name, true
+	}
+	return string(buf), true
+}
+
+// decodeNames converts names received from the kernel to the names
+// used by the nodes.
+func (b *rawBridge) decodeNames(names ...*string) fuse.Status {
+	switch b.options.NameEncoding {
+	case NamesRejectInvalid:
+		for _, n := range names {
+			if !utf8.ValidString(*n) {
+				return fuse.Status(syscall.EILSEQ)
+			}
+		}
+	case NamesEscapeInvalid:
+		for _, n := range names {
+			name, ok := unescapeName(*n)
+			if !ok {
+				return fuse.Status(syscall.EILSEQ)
+			}
+			*n = name
+		}
+	}
+	return fuse.OK
+}
+
+// encodeDirEntry converts the name of a directory entry for the
+// kernel. It returns false if the entry should be left out.
+func encodeDirEntry(enc NameEncoding, e *fuse.DirEntry) bool {
+	switch enc {
+	case NamesRejectInvalid:
+		return utf8.ValidString(e.Name)
+	case NamesEscapeInvalid:
+		e.Name = escapeName(e.Name)
+	}
+	return true
+}
+
+// encodedDirStream applies a NameEncoding to the entries of a
+// DirStream.
+type encodedDirStream struct {
+	DirStream
+	enc NameEncoding
+
+	// The next entry, or error, if hasNext is set.
+	next    fuse.DirEntry
+	errno   syscall.Errno
+	hasNext bool
+}
+
+func (s *encodedDirStream) HasNext() bool {
+	for !s.hasNext && s.DirStream.HasNext() {
+		s.next, s.errno = s.DirStream.Next()
+		s.hasNext = s.errno != 0 || encodeDirEntry(s.enc, &s.next)
+	}
+	return s.hasNext
+}
+
+func (s *encodedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.HasNext() {
+		return fuse.DirEntry{}, syscall.EBADF
+	}
+	s.hasNext = false
+	return s.next, s.errno
+}
+
+// encodedPager applies a NameEncoding to the pages of a
+// NodeReaddirPager, so the directory offsets recorded for the pages
+// count the entries the kernel sees.
+type encodedPager struct {
+	NodeReaddirPager
+	enc NameEncoding
+}
+
+func (p *encodedPager) ReaddirPage(ctx context.Context, token string) ([]fuse.DirEntry, string, syscall.Errno) {
+	entries, next, errno := p.NodeReaddirPager.ReaddirPage(ctx, token)
+	// Don't modify entries, which may be owned by the pager.
+	out := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if encodeDirEntry(p.enc, &e) {
+			out = append(out, e)
+		}
+	}
+	return out, next, errno
+}
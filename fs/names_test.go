@@ -0,0 +1,108 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"syscall"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestEscapeName(t *testing.T) {
+	for _, tc := range []struct {
+		name, escaped string
+	}{
+		{"plain", "plain"},
+		{"caf\xe9", "caf\uf7e9"},
+		{"\xff\xfe", "\uf7ff\uf7fe"},
+		{"caf\u00e9", "caf\u00e9"},
+		{"\ufffd", "\ufffd"},
+		// Runes in the escape range are escaped too.
+		{"x\uf7e9", "x\uf7ef\uf79f\uf7a9"},
+	} {
+		got := escapeName(tc.name)
+		if got != tc.escaped {
+			t.Errorf("escapeName(%q): got %q, want %q", tc.name, got, tc.escaped)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("escapeName(%q) = %q is not valid UTF-8", tc.name, got)
+		}
+		if back, ok := unescapeName(got); !ok || back != tc.name {
+			t.Errorf("unescapeName(%q): got %q, %v, want %q", got, back, ok, tc.name)
+		}
+	}
+	if _, ok := unescapeName("caf\xe9"); ok {
+		t.Errorf("unescapeName accepted invalid UTF-8")
+	}
+}
+
+func TestNameEncoding(t *testing.T) {
+	const latin1 = "caf\xe9"
+	for _, tc := range []struct {
+		enc    NameEncoding
+		lookup string
+		errno  syscall.Errno
+		listed []string
+	}{
+		{NamesRaw, latin1, 0, []string{"a", latin1}},
+		{NamesRejectInvalid, latin1, syscall.EILSEQ, []string{"a"}},
+		{NamesEscapeInvalid, latin1, syscall.EILSEQ, []string{"a", "caf\uf7e9"}},
+		{NamesEscapeInvalid, "caf\uf7e9", 0, []string{"a", "caf\uf7e9"}},
+	} {
+		root := &Inode{}
+		rawFS := NewNodeFS(root, &Options{
+			NameEncoding: tc.enc,
+			OnAdd: func(ctx context.Context) {
+				for _, name := range []string{"a", latin1} {
+					ch := root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+					root.AddChild(name, ch, false)
+				}
+			},
+		})
+
+		var out fuse.EntryOut
+		st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, tc.lookup, &out)
+		if st != fuse.Status(tc.errno) {
+			t.Errorf("%d: Lookup(%q): got %v, want %v", tc.enc, tc.lookup, st, tc.errno)
+		}
+
+		var openOut fuse.OpenOut
+		openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}
+		if st := rawFS.OpenDir(nil, &openIn, &openOut); !st.Ok() {
+			t.Fatal(st)
+		}
+		buf := make([]byte, 1024)
+		in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh}
+		if st := rawFS.ReadDir(nil, &in, fuse.NewDirEntryList(buf, 0)); !st.Ok() {
+			t.Fatalf("ReadDir: %v", st)
+		}
+		rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh})
+
+		// Dirents are ino, off, namelen, type, and the name
+		// padded to 8 bytes.
+		var names []string
+		for p := 0; p+24 <= len(buf) && binary.LittleEndian.Uint64(buf[p+8:]) != 0; {
+			l := int(binary.LittleEndian.Uint32(buf[p+16:]))
+			names = append(names, string(buf[p+24:p+24+l]))
+			p += 24 + (l+7)&^7
+		}
+		sort.Strings(names)
+		if len(names) != len(tc.listed) {
+			t.Errorf("%d: got listing %q, want %q", tc.enc, names, tc.listed)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.listed[i] {
+				t.Errorf("%d: got listing %q, want %q", tc.enc, names, tc.listed)
+				break
+			}
+		}
+	}
+}
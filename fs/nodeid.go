@@ -0,0 +1,92 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"log"
+)
+
+// NodeIdRange is the range [Start, End) of FUSE node IDs. See
+// Options.ReservedNodeIds.
+type NodeIdRange struct {
+	Start uint64
+	End   uint64
+}
+
+// Contains returns whether id lies in the range.
+func (r NodeIdRange) Contains(id uint64) bool {
+	return id >= r.Start && id < r.End
+}
+
+// checkReservedNodeIds panics on ranges that are empty or contain
+// the root.
+func checkReservedNodeIds(rs []NodeIdRange) {
+	for _, r := range rs {
+		if r.Start >= r.End {
+			log.Panicf("empty node ID range [%d, %d)", r.Start, r.End)
+		}
+		if r.Contains(1) {
+			log.Panicf("node ID range [%d, %d) contains the root", r.Start, r.End)
+		}
+	}
+}
+
+// reservedNodeId returns the reserved range holding id, if any.
+func (b *rawBridge) reservedNodeId(id uint64) (NodeIdRange, bool) {
+	for _, r := range b.options.ReservedNodeIds {
+		if r.Contains(id) {
+			return r, true
+		}
+	}
+	return NodeIdRange{}, false
+}
+
+// allocNodeId returns the next node ID outside the reserved ranges.
+// The caller must hold b.mu.
+func (b *rawBridge) allocNodeId() uint64 {
+	for {
+		id := b.nextNodeId
+		b.nextNodeId++
+		r, ok := b.reservedNodeId(id)
+		if !ok {
+			return id
+		}
+		b.nextNodeId = r.End
+	}
+}
+
+// claimNodeId checks that id may be given to a new node with a fixed
+// node ID. The caller must hold b.mu.
+func (b *rawBridge) claimNodeId(id uint64, n *Inode) {
+	if _, ok := b.reservedNodeId(id); !ok {
+		log.Panicf("node ID %d is not in Options.ReservedNodeIds", id)
+	}
+	if old := b.fixedNodeIds[id]; old != nil {
+		log.Panicf("node ID %d is already in use by %p", id, old)
+	}
+	b.fixedNodeIds[id] = n
+}
+
+// releaseNodeId makes the fixed node ID of n, if any, available
+// again after n was dropped from the tree.
+func (b *rawBridge) releaseNodeId(n *Inode) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fixedNodeIds[n.nodeId] == n {
+		delete(b.fixedNodeIds, n.nodeId)
+	}
+}
+
+// NewPersistentInodeWithNodeId is like NewPersistentInode, but the
+// node uses the given FUSE node ID. This makes for well-known IDs,
+// eg. for a control file that a RawFileSystem wrapping the one
+// returned by NewNodeFS answers directly. The ID must lie in one of
+// Options.ReservedNodeIds, and must not be used by another live
+// node; this panics otherwise. If the node is already part of the
+// tree, it is returned as is.
+func (n *Inode) NewPersistentInodeWithNodeId(ctx context.Context, node InodeEmbedder, id StableAttr, nodeId uint64) *Inode {
+	return n.bridge.newInodeWithNodeId(ctx, node, id, true, nodeId)
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func mustPanic(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: did not panic", what)
+		}
+	}()
+	f()
+}
+
+func TestReservedNodeIds(t *testing.T) {
+	const controlId = 5
+	root := &Inode{}
+	var control *Inode
+	rawFS := NewNodeFS(root, &Options{
+		ReservedNodeIds: []NodeIdRange{{2, 10}},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+			control = root.NewPersistentInodeWithNodeId(ctx, &Inode{}, StableAttr{}, controlId)
+			root.AddChild(".control", control, false)
+		},
+	})
+
+	lookup := func(name string) uint64 {
+		t.Helper()
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return out.NodeId
+	}
+	if got := lookup("file"); got != 10 {
+		t.Errorf("file: got node ID %d, want 10", got)
+	}
+	if got := lookup(".control"); got != controlId {
+		t.Errorf(".control: got node ID %d, want %d", got, controlId)
+	}
+
+	ctx := context.Background()
+	mustPanic(t, "duplicate ID", func() {
+		root.NewPersistentInodeWithNodeId(ctx, &Inode{}, StableAttr{}, controlId)
+	})
+	mustPanic(t, "unreserved ID", func() {
+		root.NewPersistentInodeWithNodeId(ctx, &Inode{}, StableAttr{}, 20)
+	})
+	mustPanic(t, "range with root", func() {
+		NewNodeFS(&Inode{}, &Options{ReservedNodeIds: []NodeIdRange{{1, 2}}})
+	})
+
+	// Once the node is gone, its ID can be used again.
+	root.RmChild(".control")
+	rawFS.Forget(controlId, 1)
+	control.ForgetPersistent()
+	root.NewPersistentInodeWithNodeId(ctx, &Inode{}, StableAttr{}, controlId)
+}
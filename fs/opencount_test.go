@@ -0,0 +1,131 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type openCountNode struct {
+	Inode
+
+	firstOpens []bool
+	lastCloses int
+}
+
+var _ = (NodeOpener)((*openCountNode)(nil))
+var _ = (NodeOnFirstOpener)((*openCountNode)(nil))
+var _ = (NodeOnLastCloser)((*openCountNode)(nil))
+
+func (n *openCountNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, 0
+}
+
+func (n *openCountNode) OnFirstOpen(ctx context.Context, writable bool) {
+	n.firstOpens = append(n.firstOpens, writable)
+}
+
+func (n *openCountNode) OnLastClose(ctx context.Context) {
+	n.lastCloses++
+}
+
+func TestOpenCount(t *testing.T) {
+	child := &openCountNode{}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, child, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+
+	open := func(flags uint32) {
+		in := fuse.OpenIn{Flags: flags}
+		in.NodeId = entry.NodeId
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &in, &out); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+	}
+	release := func(flags uint32) {
+		in := fuse.ReleaseIn{Flags: flags}
+		in.NodeId = entry.NodeId
+		rawFS.Release(nil, &in)
+	}
+	check := func(wantR, wantW int) {
+		t.Helper()
+		if r, w := child.OpenCount(); r != wantR || w != wantW {
+			t.Errorf("OpenCount: got (%d, %d), want (%d, %d)", r, w, wantR, wantW)
+		}
+	}
+
+	open(syscall.O_WRONLY)
+	open(syscall.O_RDONLY)
+	check(1, 1)
+	if len(child.firstOpens) != 1 || !child.firstOpens[0] {
+		t.Errorf("got first opens %v, want [true]", child.firstOpens)
+	}
+
+	release(syscall.O_WRONLY)
+	check(1, 0)
+	if child.lastCloses != 0 {
+		t.Errorf("OnLastClose called with files still open")
+	}
+	release(syscall.O_RDONLY)
+	check(0, 0)
+	if child.lastCloses != 1 {
+		t.Errorf("got %d last closes, want 1", child.lastCloses)
+	}
+}
+
+func TestOpenCountHandOff(t *testing.T) {
+	newFS := func(child *openCountNode) fuse.RawFileSystem {
+		root := &Inode{}
+		return NewNodeFS(root, &Options{
+			OnAdd: func(ctx context.Context) {
+				ch := root.NewPersistentInode(ctx, child, StableAttr{Ino: 2})
+				root.AddChild("file", ch, false)
+			},
+		})
+	}
+
+	oldChild := &openCountNode{}
+	oldFS := newFS(oldChild)
+	var entry fuse.EntryOut
+	if st := oldFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	var out fuse.OpenOut
+	if st := oldFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: syscall.O_WRONLY}, &out); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	state, err := oldFS.(fuse.HandOffSaver).SaveHandOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child := &openCountNode{}
+	fs := newFS(child)
+	if err := fs.(fuse.HandOffRestorer).RestoreHandOff(state); err != nil {
+		t.Fatal(err)
+	}
+	if r, w := child.OpenCount(); r != 0 || w != 1 {
+		t.Errorf("OpenCount after hand-off: got (%d, %d), want (0, 1)", r, w)
+	}
+
+	fs.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: syscall.O_WRONLY})
+	if child.lastCloses != 1 {
+		t.Errorf("got %d last closes, want 1", child.lastCloses)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// The kernel passes the owner of fcntl locks, but not whether they
+// are POSIX locks, owned by a process, or OFD locks, owned by an
+// open file description. A process can take POSIX locks through
+// different FileHandles, and processes sharing a file description
+// share a FileHandle, so neither kind maps onto the descriptor of a
+// loopbackFile. Instead, the loopback takes the locks as OFD locks
+// on a descriptor per owner, opened on first use. The descriptor is
+// closed once the owner unlocks the whole file, which the bridge
+// does when the owner no longer holds locks in the kernel's view.
+
+type ownerLockKey struct {
+	dev   uint64
+	ino   uint64
+	owner uint64
+}
+
+type ownerLock struct {
+	fd int
+
+	// Number of lock calls using fd.
+	users int
+
+	// Set if the owner may hold a lock through fd.
+	held bool
+}
+
+var ownerLocks = struct {
+	mu sync.Mutex
+	m  map[ownerLockKey]*ownerLock
+}{m: map[ownerLockKey]*ownerLock{}}
+
+func ownerLockKeyFor(fd int, owner uint64) (ownerLockKey, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return ownerLockKey{}, ToErrno(err)
+	}
+	return ownerLockKey{dev: uint64(st.Dev), ino: uint64(st.Ino), owner: owner}, OK
+}
+
+// acquireOwnerLock returns the lock descriptor of the owner. If the
+// owner has none, it is opened from fd if create is set, and nil is
+// returned otherwise. It must be returned with releaseOwnerLock.
+func acquireOwnerLock(key ownerLockKey, fd int, create bool) (*ownerLock, syscall.Errno) {
+	ownerLocks.mu.Lock()
+	defer ownerLocks.mu.Unlock()
+	ol := ownerLocks.m[key]
+	if ol == nil {
+		if !create {
+			return nil, OK
+		}
+		lockFd, err := openOwnerLockFd(fd)
+		if err != nil {
+			return nil, ToErrno(err)
+		}
+		ol = &ownerLock{fd: lockFd}
+		ownerLocks.m[key] = ol
+	}
+	ol.users++
+	return ol, OK
+}
+
+// openOwnerLockFd opens a lock descriptor with the access mode of fd,
+// which the lock types possible through it depend on. If the file
+// cannot be opened again, eg. on platforms without /proc, the
+// descriptor shares the open file description of fd, and the owners
+// of the FileHandle share its locks.
+func openOwnerLockFd(fd int) (int, error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err == nil {
+		var lockFd int
+		lockFd, err = reopenFd(fd, flags&syscall.O_ACCMODE)
+		if err == nil {
+			return lockFd, nil
+		}
+	}
+	return syscall.Dup(fd)
+}
+
+// releaseOwnerLock records the outcome of a lock call, if lk is set,
+// and closes the descriptor if the owner holds no more locks through
+// it.
+func releaseOwnerLock(key ownerLockKey, ol *ownerLock, lk *fuse.FileLock, errno syscall.Errno) {
+	ownerLocks.mu.Lock()
+	defer ownerLocks.mu.Unlock()
+	if lk != nil && errno == OK {
+		if lk.Typ != syscall.F_UNLCK {
+			ol.held = true
+		} else if lk.Start == 0 && lk.End == (1<<63)-1 {
+			ol.held = false
+		}
+	}
+	ol.users--
+	if ol.users == 0 && !ol.held {
+		syscall.Close(ol.fd)
+		delete(ownerLocks.m, key)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type backingServer struct {
+	ServerCallbacks
+	registered map[int32]int32
+	nextID     int32
+}
+
+func (s *backingServer) RegisterBackingFd(m *fuse.BackingMap) (int32, syscall.Errno) {
+	s.nextID++
+	s.registered[s.nextID] = m.Fd
+	return s.nextID, 0
+}
+
+func (s *backingServer) UnregisterBackingFd(id int32) syscall.Errno {
+	if _, ok := s.registered[id]; !ok {
+		return syscall.EINVAL
+	}
+	delete(s.registered, id)
+	return 0
+}
+
+type passthroughFile struct {
+	fd int
+}
+
+func (f *passthroughFile) PassthroughFd() (int, bool) {
+	return f.fd, true
+}
+
+type passthroughNode struct {
+	Inode
+	opens int
+}
+
+func (n *passthroughNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	n.opens++
+	return &passthroughFile{fd: 100 + n.opens}, 0, 0
+}
+
+func TestPassthroughBackingID(t *testing.T) {
+	child := &passthroughNode{}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, child, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+	srv := &backingServer{registered: map[int32]int32{}}
+	rawFS.(*rawBridge).server = srv
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+
+	open := func() fuse.OpenOut {
+		in := fuse.OpenIn{}
+		in.NodeId = entry.NodeId
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &in, &out); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		if out.OpenFlags&fuse.FOPEN_PASSTHROUGH == 0 {
+			t.Fatalf("FOPEN_PASSTHROUGH not set: %v", out)
+		}
+		return out
+	}
+	release := func(fh uint64) {
+		in := fuse.ReleaseIn{Fh: fh}
+		in.NodeId = entry.NodeId
+		rawFS.Release(nil, &in)
+	}
+
+	out1 := open()
+	out2 := open()
+	if out1.BackingId != out2.BackingId {
+		t.Errorf("got backing IDs %d and %d, want them shared", out1.BackingId, out2.BackingId)
+	}
+	if got := srv.registered[out1.BackingId]; got != 101 {
+		t.Errorf("registered fd %d, want 101", got)
+	}
+
+	release(out1.Fh)
+	if len(srv.registered) != 1 {
+		t.Errorf("backing file unregistered while still in use")
+	}
+	release(out2.Fh)
+	if len(srv.registered) != 0 {
+		t.Errorf("backing file not unregistered: %v", srv.registered)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// attrPin is the background refresh state of a node pinned with
+// PinAttr.
+type attrPin struct {
+	interval time.Duration
+	stop     chan struct{}
+
+	// Protected by Inode.mu.
+	attr  fuse.AttrOut
+	valid bool
+}
+
+// PinAttr refreshes the attributes of the node in the background,
+// by calling Getattr every interval. GETATTR requests for the node
+// are answered from the last result, so they do not wait for the
+// backend. If the attributes change, the kernel's cached attributes
+// are invalidated, along with the cached content if the size or
+// modification time changed. Getattr can therefore return long
+// attribute timeouts for pinned nodes, without hiding remote changes
+// for longer than interval. Changes through the mount, such as
+// writes, truncation, fallocate and copy_file_range, make GETATTR
+// call Getattr again until the next refresh.
+//
+// This is meant for a few hot nodes, such as the root or often read
+// configuration files. Calling PinAttr again changes the interval.
+// The refresh stops on UnpinAttr, or when the node is dropped from
+// the tree. It returns EINVAL if interval is not positive, or if the
+// node was not added to the file system yet.
+func (n *Inode) PinAttr(interval time.Duration) syscall.Errno {
+	if interval <= 0 || n.bridge == nil {
+		return syscall.EINVAL
+	}
+	p := &attrPin{
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	n.mu.Lock()
+	if n.attrPin != nil {
+		close(n.attrPin.stop)
+	}
+	n.attrPin = p
+	n.mu.Unlock()
+
+	go n.refreshAttr(p)
+	return OK
+}
+
+// UnpinAttr stops the refresh started by PinAttr.
+func (n *Inode) UnpinAttr() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stopAttrPin()
+}
+
+// stopAttrPin stops the attribute refresh. Caller must hold n.mu.
+func (n *Inode) stopAttrPin() {
+	if n.attrPin != nil {
+		close(n.attrPin.stop)
+		n.attrPin = nil
+	}
+}
+
+// pinnedAttr returns the attributes from the last refresh, if the
+// node is pinned.
+func (n *Inode) pinnedAttr() (fuse.AttrOut, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.attrPin == nil || !n.attrPin.valid {
+		return fuse.AttrOut{}, false
+	}
+	return n.attrPin.attr, true
+}
+
+// invalidatePinnedAttr makes GETATTR go to the node until the next
+// refresh, eg. after the attributes were changed through the mount.
+func (n *Inode) invalidatePinnedAttr() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.attrPin != nil {
+		n.attrPin.valid = false
+	}
+}
+
+func (n *Inode) refreshAttr(p *attrPin) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	b := n.bridge
+	ctx := &fuse.Context{Cancel: p.stop}
+	var last fuse.Attr
+	first := true
+	for {
+		var out fuse.AttrOut
+		if errno := b.getattr(ctx, n, nil, &out); errno != 0 {
+			b.logf("PinAttr: Getattr n%d: %v", n.nodeId, errno)
+		} else {
+			n.mu.Lock()
+			if n.attrPin != p {
+				n.mu.Unlock()
+				return
+			}
+			p.attr = out
+			p.valid = true
+			n.mu.Unlock()
+
+			if !first && b.server != nil {
+				if out.Size != last.Size || out.Mtime != last.Mtime || out.Mtimensec != last.Mtimensec {
+					n.NotifyContent(0, 0)
+				} else if attrChanged(&out.Attr, &last) {
+					// A negative offset only drops the
+					// attributes.
+					n.NotifyContent(-1, 0)
+				}
+			}
+			last = out.Attr
+			first = false
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attrChanged compares attributes, ignoring the access time.
+func attrChanged(a, b *fuse.Attr) bool {
+	x, y := *a, *b
+	x.Atime, x.Atimensec = 0, 0
+	y.Atime, y.Atimensec = 0, 0
+	return x != y
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type pinNode struct {
+	Inode
+
+	mu    sync.Mutex
+	attr  fuse.Attr
+	calls int
+}
+
+var _ = (NodeGetattrer)((*pinNode)(nil))
+
+func (n *pinNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	out.Attr = n.attr
+	return 0
+}
+
+var _ = (NodeWriter)((*pinNode)(nil))
+
+func (n *pinNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if end := uint64(off) + uint64(len(data)); end > n.attr.Size {
+		n.attr.Size = end
+	}
+	return uint32(len(data)), 0
+}
+
+func (n *pinNode) set(f func(a *fuse.Attr)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f(&n.attr)
+}
+
+// notifyRecorder records InodeNotify calls.
+type notifyRecorder struct {
+	ServerCallbacks
+	offsets chan int64
+}
+
+func (r *notifyRecorder) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	r.offsets <- off
+	return fuse.OK
+}
+
+func TestPinAttr(t *testing.T) {
+	root := &pinNode{attr: fuse.Attr{Size: 1, Mode: 0755}}
+	rec := &notifyRecorder{offsets: make(chan int64, 10)}
+	rawFS := NewNodeFS(root, &Options{ServerCallbacks: rec})
+	defer root.UnpinAttr()
+
+	pin := func(interval time.Duration) {
+		t.Helper()
+		if errno := root.PinAttr(interval); errno != 0 {
+			t.Fatalf("PinAttr: %v", errno)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, ok := root.pinnedAttr(); ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("attributes were not refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	notified := func() int64 {
+		t.Helper()
+		select {
+		case off := <-rec.offsets:
+			return off
+		case <-time.After(10 * time.Second):
+			t.Fatal("no notification")
+		}
+		return 0
+	}
+
+	// GETATTR is answered without calling Getattr.
+	pin(time.Hour)
+	root.mu.Lock()
+	calls := root.calls
+	root.mu.Unlock()
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	root.mu.Lock()
+	if root.calls != calls {
+		t.Errorf("Getattr called %d times, want %d", root.calls, calls)
+	}
+	root.mu.Unlock()
+	if out.Size != 1 {
+		t.Errorf("got size %d, want 1", out.Size)
+	}
+
+	// Changes invalidate the kernel cache.
+	pin(time.Millisecond)
+	root.set(func(a *fuse.Attr) { a.Mode = 0700 })
+	if off := notified(); off != -1 {
+		t.Errorf("mode change: got offset %d, want -1", off)
+	}
+	root.set(func(a *fuse.Attr) { a.Size = 2 })
+	if off := notified(); off != 0 {
+		t.Errorf("size change: got offset %d, want 0", off)
+	}
+}
+
+func TestPinAttrWrite(t *testing.T) {
+	root := &pinNode{attr: fuse.Attr{Size: 1, Mode: 0644}}
+	rawFS := NewNodeFS(root, &Options{ServerCallbacks: &notifyRecorder{offsets: make(chan int64, 10)}})
+	defer root.UnpinAttr()
+
+	if errno := root.PinAttr(time.Hour); errno != 0 {
+		t.Fatalf("PinAttr: %v", errno)
+	}
+	for {
+		if _, ok := root.pinnedAttr(); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	in := fuse.WriteIn{Offset: 9, Size: 1}
+	in.NodeId = 1
+	if _, st := rawFS.Write(nil, &in, []byte("x")); !st.Ok() {
+		t.Fatalf("Write: %v", st)
+	}
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	if out.Size != 10 {
+		t.Errorf("got size %d after write, want 10", out.Size)
+	}
+}
+
+func TestPinAttrInvalid(t *testing.T) {
+	node := &pinNode{}
+	if errno := node.PinAttr(time.Second); errno != syscall.EINVAL {
+		t.Errorf("PinAttr before mount: got %v, want EINVAL", errno)
+	}
+	NewNodeFS(node, &Options{})
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if errno := node.PinAttr(interval); errno != syscall.EINVAL {
+			t.Errorf("PinAttr(%v): got %v, want EINVAL", interval, errno)
+		}
+	}
+}
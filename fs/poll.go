@@ -0,0 +1,106 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// defaultPollMask is what the kernel reports for files that do not
+// support poll: POLLIN | POLLOUT | POLLRDNORM | POLLWRNORM, in the
+// Linux encoding that FUSE uses.
+const defaultPollMask = 0x1 | 0x4 | 0x40 | 0x100
+
+// PollWakeup is a poll(2) call that waits for a file to become
+// ready. See NodePoller.
+type PollWakeup struct {
+	kh     uint64
+	bridge *rawBridge
+}
+
+type pollNotifier interface {
+	NotifyPollWakeup(kh uint64) fuse.Status
+}
+
+// Wakeup tells the kernel to poll the file again.
+func (w *PollWakeup) Wakeup() syscall.Errno {
+	pn, ok := w.bridge.server.(pollNotifier)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	return syscall.Errno(pn.NotifyPollWakeup(w.kh))
+}
+
+// PollQueue collects the PollWakeups of a file, so they can be woken
+// up together when the file becomes ready. The kernel uses the same
+// handle for all polls on an open file, so each handle is queued
+// once. The zero value is ready for use.
+type PollQueue struct {
+	mu      sync.Mutex
+	waiters map[uint64]*PollWakeup
+}
+
+// Add queues w. A nil w is ignored, so the argument of Poll can be
+// passed as is.
+func (q *PollQueue) Add(w *PollWakeup) {
+	if w == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiters == nil {
+		q.waiters = map[uint64]*PollWakeup{}
+	}
+	q.waiters[w.kh] = w
+}
+
+// Len returns the number of queued PollWakeups.
+func (q *PollQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters)
+}
+
+// Wakeup wakes up all queued polls, and empties the queue.
+func (q *PollQueue) Wakeup() {
+	q.mu.Lock()
+	waiters := q.waiters
+	q.waiters = nil
+	q.mu.Unlock()
+
+	for _, w := range waiters {
+		// The file may have been closed in the meantime,
+		// which is not an error.
+		w.Wakeup()
+	}
+}
+
+func (b *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	n, f := b.inode(in.NodeId, in.Fh)
+
+	var wakeup *PollWakeup
+	if in.ScheduleNotify() {
+		wakeup = &PollWakeup{kh: in.Kh, bridge: b}
+	}
+	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+
+	var revents uint32
+	var errno syscall.Errno
+	if f.inline {
+		// Contents in memory are always ready.
+		revents = defaultPollMask
+	} else if np, ok := n.ops.(NodePoller); ok {
+		revents, errno = np.Poll(ctx, f.file, in.Events, wakeup)
+	} else if fp, ok := f.file.(FilePoller); ok {
+		revents, errno = fp.Poll(ctx, in.Events, wakeup)
+	} else {
+		revents = defaultPollMask
+	}
+	out.Revents = revents
+	return errnoToStatus(errno)
+}
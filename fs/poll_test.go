@@ -0,0 +1,117 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// pollFile is a file that is readable once it has data.
+type pollFile struct {
+	mu    sync.Mutex
+	ready bool
+	queue PollQueue
+}
+
+var _ = (FilePoller)((*pollFile)(nil))
+
+func (f *pollFile) Poll(ctx context.Context, events uint32, wakeup *PollWakeup) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ready {
+		return events & 0x1, 0
+	}
+	f.queue.Add(wakeup)
+	return 0, 0
+}
+
+func (f *pollFile) setReady() {
+	f.mu.Lock()
+	f.ready = true
+	f.mu.Unlock()
+	f.queue.Wakeup()
+}
+
+type pollNode struct {
+	Inode
+	file *pollFile
+}
+
+func (n *pollNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return n.file, 0, 0
+}
+
+// wakeupRecorder records NotifyPollWakeup calls.
+type wakeupRecorder struct {
+	ServerCallbacks
+	khs []uint64
+}
+
+func (r *wakeupRecorder) NotifyPollWakeup(kh uint64) fuse.Status {
+	r.khs = append(r.khs, kh)
+	return fuse.OK
+}
+
+func TestPoll(t *testing.T) {
+	root := &Inode{}
+	file := &pollFile{}
+	rec := &wakeupRecorder{}
+	rawFS := NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("queue", root.NewPersistentInode(ctx, &pollNode{file: file}, StableAttr{}), false)
+			root.AddChild("plain", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+
+	open := func(name string) (uint64, uint64) {
+		t.Helper()
+		var entry fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !st.Ok() {
+			t.Fatal(st)
+		}
+		var out fuse.OpenOut
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		return entry.NodeId, out.Fh
+	}
+	poll := func(id, fh, kh uint64) uint32 {
+		t.Helper()
+		in := fuse.PollIn{InHeader: fuse.InHeader{NodeId: id}, Fh: fh, Kh: kh, Flags: fuse.FUSE_POLL_SCHEDULE_NOTIFY, Events: 0x1}
+		var out fuse.PollOut
+		if st := rawFS.Poll(nil, &in, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		return out.Revents
+	}
+
+	id, fh := open("queue")
+	if got := poll(id, fh, 7); got != 0 {
+		t.Errorf("got revents %x before data, want 0", got)
+	}
+	poll(id, fh, 7)
+	if n := file.queue.Len(); n != 1 {
+		t.Errorf("got %d queued polls, want 1", n)
+	}
+	file.setReady()
+	if len(rec.khs) != 1 || rec.khs[0] != 7 {
+		t.Errorf("got wakeups %v, want [7]", rec.khs)
+	}
+	if got := poll(id, fh, 7); got != 0x1 {
+		t.Errorf("got revents %x after data, want 1", got)
+	}
+
+	// Files without poll support are always ready.
+	id, fh = open("plain")
+	if got := poll(id, fh, 8); got != defaultPollMask {
+		t.Errorf("got revents %x, want %x", got, defaultPollMask)
+	}
+}
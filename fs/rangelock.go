@@ -0,0 +1,139 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"math"
+	"sync"
+	"syscall"
+)
+
+// byteRange is a half-open range of file offsets.
+type byteRange struct {
+	start, end uint64
+}
+
+func (r byteRange) overlaps(o byteRange) bool {
+	return r.start < o.end && o.start < r.end
+}
+
+// newByteRange returns the range of size bytes at off, clipped to the
+// largest offset.
+func newByteRange(off, size uint64) byteRange {
+	end := off + size
+	if end < off {
+		end = math.MaxUint64
+	}
+	return byteRange{off, end}
+}
+
+// wholeFile is the range that truncates lock.
+var wholeFile = byteRange{0, math.MaxUint64}
+
+// rangeLocks serializes the writes to a node whose ranges overlap,
+// see NodeRangeLockPolicier.
+type rangeLocks struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held []byteRange
+}
+
+func newRangeLocks() *rangeLocks {
+	l := &rangeLocks{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// lock waits until no held range overlaps r, and holds r. It
+// returns EINTR if ctx is done before.
+func (l *rangeLocks) lock(ctx context.Context, r byteRange) syscall.Errno {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conflicts(r) && ctx.Done() != nil {
+		// Wake up the waiters if ctx is done while we wait.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.mu.Lock()
+				l.cond.Broadcast()
+				l.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for l.conflicts(r) {
+		if ctx.Err() != nil {
+			return syscall.EINTR
+		}
+		l.cond.Wait()
+	}
+	l.held = append(l.held, r)
+	return 0
+}
+
+func (l *rangeLocks) conflicts(r byteRange) bool {
+	for _, h := range l.held {
+		if h.overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlock releases r, which must be held.
+func (l *rangeLocks) unlock(r byteRange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, h := range l.held {
+		if h == r {
+			last := len(l.held) - 1
+			l.held[i] = l.held[last]
+			l.held = l.held[:last]
+			break
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// rangeLocking returns whether the writes to n must be serialized by
+// range.
+func (b *rawBridge) rangeLocking(ctx context.Context, n *Inode) bool {
+	lock := b.options.RangeLocking
+	n.inheritPolicy(func(ops InodeEmbedder) bool {
+		rp, ok := ops.(NodeRangeLockPolicier)
+		if !ok {
+			return false
+		}
+		l, ok := rp.RangeLocking(ctx)
+		if ok {
+			lock = l
+		}
+		return ok
+	})
+	return lock
+}
+
+// lockRange locks r of n, if n needs range locking, and returns the
+// function that unlocks it. It returns EINTR if ctx is done before
+// r can be locked.
+func (b *rawBridge) lockRange(ctx context.Context, n *Inode, r byteRange) (func(), syscall.Errno) {
+	if r.start == r.end || !b.rangeLocking(ctx, n) {
+		return func() {}, 0
+	}
+	n.mu.Lock()
+	if n.ranges == nil {
+		n.ranges = newRangeLocks()
+	}
+	l := n.ranges
+	n.mu.Unlock()
+
+	if errno := l.lock(ctx, r); errno != 0 {
+		return nil, errno
+	}
+	return func() { l.unlock(r) }, 0
+}
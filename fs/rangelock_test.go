@@ -0,0 +1,147 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// rangeNode records how many writes run at the same time.
+type rangeNode struct {
+	Inode
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (n *rangeNode) Write(ctx context.Context, f FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	n.running++
+	if n.running > n.maxRunning {
+		n.maxRunning = n.running
+	}
+	n.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	n.mu.Lock()
+	n.running--
+	n.mu.Unlock()
+	return uint32(len(data)), 0
+}
+
+type lockedDir struct {
+	Inode
+}
+
+func (d *lockedDir) RangeLocking(ctx context.Context) (bool, bool) {
+	return true, true
+}
+
+func TestRangeLocking(t *testing.T) {
+	root := &Inode{}
+	free := &rangeNode{}
+	locked := &rangeNode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("free", root.NewPersistentInode(ctx, free, StableAttr{}), false)
+			dir := root.NewPersistentInode(ctx, &lockedDir{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			dir.AddChild("locked", dir.NewPersistentInode(ctx, locked, StableAttr{}), false)
+		},
+	})
+
+	lookup := func(parent uint64, name string) uint64 {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		return out.NodeId
+	}
+	freeId := lookup(1, "free")
+	lockedId := lookup(lookup(1, "dir"), "locked")
+
+	// Writes of 10 bytes at 0, 5 and 20: the first two overlap.
+	writeAll := func(id uint64) {
+		var wg sync.WaitGroup
+		for _, off := range []uint64{0, 5, 20} {
+			wg.Add(1)
+			go func(off uint64) {
+				defer wg.Done()
+				in := &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: id}, Offset: off}
+				if _, st := rawFS.Write(nil, in, make([]byte, 10)); !st.Ok() {
+					t.Error(st)
+				}
+			}(off)
+		}
+		wg.Wait()
+	}
+	writeAll(freeId)
+	writeAll(lockedId)
+
+	if free.maxRunning != 3 {
+		t.Errorf("without range locking, %d writes ran at once, want 3", free.maxRunning)
+	}
+	if locked.maxRunning != 2 {
+		t.Errorf("with range locking, %d writes ran at once, want 2", locked.maxRunning)
+	}
+}
+
+func TestRangeLocksTruncate(t *testing.T) {
+	l := newRangeLocks()
+	w := newByteRange(100, ^uint64(0))
+	if w.end != ^uint64(0) {
+		t.Errorf("range did not clip: %v", w)
+	}
+	l.lock(context.Background(), w)
+
+	locked := make(chan struct{})
+	go func() {
+		l.lock(context.Background(), wholeFile)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("truncate did not wait for the write")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.unlock(w)
+	<-locked
+	l.unlock(wholeFile)
+	if len(l.held) != 0 {
+		t.Errorf("ranges still held: %v", l.held)
+	}
+}
+
+func TestRangeLocksCancel(t *testing.T) {
+	l := newRangeLocks()
+	l.lock(context.Background(), wholeFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan syscall.Errno)
+	go func() {
+		done <- l.lock(ctx, newByteRange(0, 10))
+	}()
+	select {
+	case <-done:
+		t.Fatal("lock did not wait for the held range")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if errno := <-done; errno != syscall.EINTR {
+		t.Errorf("got %v after cancel, want EINTR", errno)
+	}
+	l.unlock(wholeFile)
+	if len(l.held) != 0 {
+		t.Errorf("ranges still held: %v", l.held)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// sillyName is a hidden name that an open file was renamed to. See
+// Options.SillyRename.
+type sillyName struct {
+	parent *Inode
+	name   string
+}
+
+// hideOpen renames parent/name to a hidden name if it is a file that
+// is still open, and returns the hidden name, or "" if the file was
+// not hidden. The file is removed for good once it is released; see
+// releaseHidden.
+func (b *rawBridge) hideOpen(ctx context.Context, parent *Inode, name string) (string, syscall.Errno) {
+	if !b.options.SillyRename {
+		return "", 0
+	}
+	ch := parent.GetChild(name)
+	if ch == nil || ch.IsDir() {
+		return "", 0
+	}
+	if r, w := ch.OpenCount(); r+w == 0 {
+		return "", 0
+	}
+	rn, ok := parent.ops.(NodeRenamer)
+	if !ok {
+		return "", 0
+	}
+
+	for try := 0; try < 10; try++ {
+		hidden := fmt.Sprintf(".fuse_hidden%08x%08x", uint32(ch.StableAttr().Ino), atomic.AddUint32(&b.sillyCounter, 1))
+		if parent.GetChild(hidden) != nil {
+			continue
+		}
+		if lu, ok := parent.ops.(NodeLookuper); ok {
+			var out fuse.EntryOut
+			if _, errno := lu.Lookup(ctx, hidden, &out); errno != syscall.ENOENT {
+				continue
+			}
+		}
+		if errno := rn.Rename(ctx, name, parent.ops, hidden, 0); errno != 0 {
+			return "", errno
+		}
+		parent.MvChild(name, parent, hidden, true)
+
+		b.mu.Lock()
+		b.silly[ch] = append(b.silly[ch], sillyName{parent, hidden})
+		b.mu.Unlock()
+		return hidden, 0
+	}
+	return "", syscall.EBUSY
+}
+
+// unhide undoes hideOpen, for a rename that failed.
+func (b *rawBridge) unhide(ctx context.Context, parent *Inode, hidden, name string) {
+	ch := parent.GetChild(hidden)
+	if ch == nil {
+		return
+	}
+	if errno := parent.ops.(NodeRenamer).Rename(ctx, hidden, parent.ops, name, 0); errno != 0 {
+		b.logf("restoring hidden %q to %q: %v", hidden, name, errno)
+		return
+	}
+	parent.MvChild(hidden, parent, name, true)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := b.silly[ch]
+	for i, s := range names {
+		if s.parent == parent && s.name == hidden {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+	if len(names) == 0 {
+		delete(b.silly, ch)
+	} else {
+		b.silly[ch] = names
+	}
+}
+
+// releaseHidden removes the hidden names of n after its last open
+// file was released.
+func (b *rawBridge) releaseHidden(ctx context.Context, n *Inode) {
+	if r, w := n.OpenCount(); r+w > 0 {
+		return
+	}
+	b.mu.Lock()
+	names := b.silly[n]
+	delete(b.silly, n)
+	b.mu.Unlock()
+
+	for _, s := range names {
+		// The hidden name is visible, so it may have been
+		// renamed or removed in the meantime.
+		if s.parent.GetChild(s.name) != n {
+			continue
+		}
+		ul, ok := s.parent.ops.(NodeUnlinker)
+		if !ok {
+			continue
+		}
+		if errno := ul.Unlink(ctx, s.name); errno != 0 {
+			b.logf("removing hidden %q: %v", s.name, errno)
+			continue
+		}
+		s.parent.RmChild(s.name)
+	}
+}
@@ -61,6 +61,7 @@ type testOptions struct {
 	suppressDebug bool
 	testDir       string
 	ro            bool
+	locks         bool
 }
 
 // newTestCase creates the directories `orig` and `mnt` inside a temporary
@@ -107,7 +108,7 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 		Logger:       log.New(os.Stderr, "", 0),
 	})
 
-	mOpts := &fuse.MountOptions{}
+	mOpts := &fuse.MountOptions{VerifyReplies: true, EnableLocks: opts.locks}
 	if !opts.suppressDebug {
 		mOpts.Debug = testutil.VerboseTest()
 	}
@@ -212,6 +213,142 @@ func TestNotifyEntry(t *testing.T) {
 	}
 }
 
+func TestNotifyEntryExpire(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	if !tc.server.KernelSettings().SupportsVersion(7, 38) {
+		t.Skip("need v7.38 for FUSE_EXPIRE_ONLY")
+	}
+
+	fn := tc.mntDir + "/file"
+	tc.writeOrig("file", "hello", 0644)
+
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(fn, &st); err != nil {
+		t.Fatalf("Lstat before: %v", err)
+	}
+	if err := os.Remove(tc.origDir + "/file"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if errno := tc.loopback.EmbeddedInode().NotifyEntryExpire("file"); errno != 0 {
+		t.Errorf("notify failed: %v", errno)
+	}
+
+	if err := syscall.Lstat(fn, &st); err != syscall.ENOENT {
+		t.Fatalf("Lstat after: got %v, want ENOENT", err)
+	}
+}
+
+func TestNotifyRename(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	var before syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/file", &before); err != nil {
+		t.Fatalf("Lstat before: %v", err)
+	}
+	// Populate a negative entry for the destination.
+	if err := syscall.Lstat(tc.mntDir+"/renamed", &syscall.Stat_t{}); err != syscall.ENOENT {
+		t.Fatalf("Lstat destination: got %v, want ENOENT", err)
+	}
+	if err := os.Rename(tc.origDir+"/file", tc.origDir+"/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	root := tc.loopback.EmbeddedInode()
+	if errno := root.NotifyRename("file", root, "renamed"); errno != 0 {
+		t.Errorf("notify failed: %v", errno)
+	}
+
+	if err := syscall.Lstat(tc.mntDir+"/file", &syscall.Stat_t{}); err != syscall.ENOENT {
+		t.Errorf("Lstat old name: got %v, want ENOENT", err)
+	}
+	var after syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/renamed", &after); err != nil {
+		t.Fatalf("Lstat new name: %v", err)
+	}
+	if after.Ino != before.Ino {
+		t.Errorf("got ino %d after rename, want %d", after.Ino, before.Ino)
+	}
+}
+
+// entryNotifyRecorder records EntryNotify calls. It does not
+// implement EntryExpireNotify.
+type entryNotifyRecorder struct {
+	ServerCallbacks
+	names []string
+}
+
+func (r *entryNotifyRecorder) EntryNotify(parent uint64, name string) fuse.Status {
+	r.names = append(r.names, name)
+	return fuse.OK
+}
+
+func TestNotifyRenameCallbacks(t *testing.T) {
+	root := &Inode{}
+	rec := &entryNotifyRecorder{}
+	NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+		},
+	})
+
+	if errno := root.NotifyEntryExpire("file"); errno != syscall.ENOSYS {
+		t.Errorf("NotifyEntryExpire: got %v, want ENOSYS", errno)
+	}
+	if errno := root.NotifyRename("file", root, "renamed"); errno != 0 {
+		t.Fatalf("NotifyRename: %v", errno)
+	}
+	if got, want := strings.Join(rec.names, ","), "file,renamed"; got != want {
+		t.Errorf("got EntryNotify for %s, want %s", got, want)
+	}
+}
+
+func TestNotifyChanged(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/file", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	root := tc.loopback.EmbeddedInode()
+	child := root.GetChild("file")
+	if child == nil {
+		t.Fatal("file is not in the tree")
+	}
+
+	if err := os.Chmod(tc.origDir+"/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if errno := child.NotifyChanged(ChangeAttr); errno != 0 {
+		t.Fatalf("NotifyChanged(ChangeAttr): %v", errno)
+	}
+	if err := syscall.Lstat(tc.mntDir+"/file", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if st.Mode&07777 != 0600 {
+		t.Errorf("got mode %o, want 0600", st.Mode&07777)
+	}
+
+	if err := os.Remove(tc.origDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	if errno := child.NotifyChanged(ChangeDeleted); errno != 0 {
+		t.Fatalf("NotifyChanged(ChangeDeleted): %v", errno)
+	}
+	if err := syscall.Lstat(tc.mntDir+"/file", &st); err != syscall.ENOENT {
+		t.Errorf("Lstat after delete: got %v, want ENOENT", err)
+	}
+}
+
 func TestReadDirStress(t *testing.T) {
 	tc := newTestCase(t, &testOptions{suppressDebug: true, attrCache: true, entryCache: true})
 	defer tc.Clean()
@@ -0,0 +1,123 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// maxSymlinks bounds the number of symlinks followed while resolving
+// a single lookup, like MAXSYMLINKS in Linux.
+const maxSymlinks = 40
+
+// followSymlink resolves the symlink link, found as name in dir. The
+// nodes along the way are added to the tree, so they can compute
+// their paths, but only the returned node keeps a lookup reference.
+// On failure, out is cleared so it does not carry a node ID.
+func (b *rawBridge) followSymlink(ctx *fuse.Context, dir *Inode, name string, link *Inode, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	var held []*Inode
+	defer func() {
+		for _, n := range held {
+			n.removeRef(1, false)
+		}
+	}()
+
+	var eo fuse.EntryOut
+	cur, _ := b.addNewChild(dir, name, link, nil, 0, &eo)
+	held = append(held, cur)
+
+	var rest []string
+	budget := maxSymlinks
+	for {
+		if cur.stableAttr.Mode == syscall.S_IFLNK {
+			if budget == 0 {
+				*out = fuse.EntryOut{}
+				return nil, syscall.ELOOP
+			}
+			budget--
+			target, errno := b.readlinkNode(ctx, cur)
+			if errno != 0 {
+				*out = fuse.EntryOut{}
+				return nil, errno
+			}
+			if strings.HasPrefix(target, "/") {
+				dir = b.root
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+		} else if !cur.IsDir() {
+			*out = fuse.EntryOut{}
+			return nil, syscall.ENOTDIR
+		} else {
+			dir = cur
+		}
+
+		name = ""
+		for len(rest) > 0 && name == "" {
+			c := rest[0]
+			rest = rest[1:]
+			switch c {
+			case "", ".":
+			case "..":
+				// Like in a chroot, ".." of the root is the
+				// root itself.
+				if dir != b.root {
+					if _, dir = dir.Parent(); dir == nil {
+						*out = fuse.EntryOut{}
+						return nil, syscall.ENOENT
+					}
+				}
+			default:
+				name = c
+			}
+		}
+		if name == "" {
+			// The path ends in a directory we already
+			// have. Look it up by name in its parent, so
+			// the kernel gets a reference to it.
+			if dir == b.root {
+				// The kernel cannot alias the root.
+				*out = fuse.EntryOut{}
+				return nil, syscall.ELOOP
+			}
+			var p *Inode
+			if name, p = dir.Parent(); p == nil {
+				*out = fuse.EntryOut{}
+				return nil, syscall.ENOENT
+			}
+			dir = p
+		}
+
+		eo = fuse.EntryOut{}
+		child, errno := b.lookup(ctx, dir, name, &eo)
+		if errno != 0 {
+			*out = fuse.EntryOut{}
+			return nil, errno
+		}
+		cur, _ = b.addNewChild(dir, name, child, nil, 0, &eo)
+		if cur.stableAttr.Mode != syscall.S_IFLNK && len(rest) == 0 {
+			*out = eo
+			return cur, 0
+		}
+		held = append(held, cur)
+	}
+}
+
+func (b *rawBridge) readlinkNode(ctx *fuse.Context, n *Inode) (string, syscall.Errno) {
+	linker, ok := n.ops.(NodeReadlinker)
+	if !ok {
+		return "", syscall.ENOTSUP
+	}
+	target, errno := linker.Readlink(ctx)
+	if errno != 0 {
+		return "", errno
+	}
+	if len(target) == 0 {
+		return "", syscall.ENOENT
+	}
+	return string(target), 0
+}
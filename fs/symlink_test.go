@@ -0,0 +1,99 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestResolveSymlinks(t *testing.T) {
+	root := &Inode{}
+	var dir *Inode
+	rawFS := NewNodeFS(root, &Options{
+		ResolveSymlinks: true,
+		OnAdd: func(ctx context.Context) {
+			add := func(parent *Inode, name string, ops InodeEmbedder, mode uint32) *Inode {
+				ch := parent.NewPersistentInode(ctx, ops, StableAttr{Mode: mode})
+				parent.AddChild(name, ch, false)
+				return ch
+			}
+			link := func(parent *Inode, name, target string) {
+				add(parent, name, &MemSymlink{Data: []byte(target)}, syscall.S_IFLNK)
+			}
+			add(root, "file", &MemRegularFile{Data: []byte("hello")}, 0)
+			dir = add(root, "dir", &Inode{}, syscall.S_IFDIR)
+			add(dir, "sub", &MemRegularFile{}, 0)
+			add(dir, "deep", &Inode{}, syscall.S_IFDIR)
+
+			link(root, "l_file", "file")
+			link(root, "l_dir", "dir/")
+			link(dir, "l_up", "../file")
+			link(root, "l_abs", "/dir/sub")
+			link(root, "l_chain", "l_dir/l_up")
+			link(root, "l_dotdot", "dir/deep/..")
+			link(root, "l_updir", "dir/..")
+			link(root, "l_loop1", "l_loop2")
+			link(root, "l_loop2", "l_loop1")
+			link(root, "l_dangling", "missing")
+			link(root, "l_root", "/")
+			link(root, "l_notdir", "file/x")
+		},
+	})
+
+	lookup := func(parent uint64, name string) (fuse.EntryOut, fuse.Status) {
+		var out fuse.EntryOut
+		st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out)
+		return out, st
+	}
+
+	file, _ := lookup(1, "file")
+	dirOut, _ := lookup(1, "dir")
+	sub, _ := lookup(dirOut.NodeId, "sub")
+	for name, want := range map[string]fuse.EntryOut{
+		"l_file":   file,
+		"l_dir":    dirOut,
+		"l_abs":    sub,
+		"l_chain":  file,
+		"l_dotdot": dirOut,
+	} {
+		got, st := lookup(1, name)
+		if !st.Ok() {
+			t.Errorf("Lookup(%q): %v", name, st)
+			continue
+		}
+		if got.NodeId != want.NodeId || got.Mode != want.Mode {
+			t.Errorf("Lookup(%q): got node %d mode %o, want node %d mode %o",
+				name, got.NodeId, got.Mode, want.NodeId, want.Mode)
+		}
+	}
+	if got, st := lookup(dirOut.NodeId, "l_up"); !st.Ok() || got.NodeId != file.NodeId {
+		t.Errorf("Lookup(dir/l_up): got node %d, %v, want node %d", got.NodeId, st, file.NodeId)
+	}
+
+	for name, want := range map[string]fuse.Status{
+		"l_loop1":    fuse.Status(syscall.ELOOP),
+		"l_dangling": fuse.ENOENT,
+		"l_root":     fuse.Status(syscall.ELOOP),
+		"l_updir":    fuse.Status(syscall.ELOOP),
+		"l_notdir":   fuse.ENOTDIR,
+	} {
+		if out, st := lookup(1, name); st != want || out.NodeId != 0 {
+			t.Errorf("Lookup(%q): got node %d, %v, want %v", name, out.NodeId, st, want)
+		}
+	}
+
+	// Only the lookups that returned dir (dir, l_dir and l_dotdot)
+	// hold references; resolving through it does not leak any.
+	if dir.lookupCount != 3 {
+		t.Errorf("dir has lookupCount %d, want 3", dir.lookupCount)
+	}
+	if l := root.GetChild("l_abs"); l.lookupCount != 0 {
+		t.Errorf("symlink has lookupCount %d, want 0", l.lookupCount)
+	}
+}
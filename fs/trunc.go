@@ -0,0 +1,37 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// TruncateOnOpen truncates the file of node to size zero if flags
+// has O_TRUNC, through the Setattr of node or, if it has none, of
+// f. With fuse.MountOptions.EnableAtomicTrunc, the kernel passes
+// O_TRUNC to Open instead of truncating the file with a separate
+// Setattr call, so nodes whose Open does not truncate the file
+// itself can call this from Open. Open of the loopback nodes
+// truncates through open(2) already.
+func TruncateOnOpen(ctx context.Context, node InodeEmbedder, f FileHandle, flags uint32) syscall.Errno {
+	if flags&syscall.O_TRUNC == 0 {
+		return OK
+	}
+	in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE}}
+	if fc, ok := ctx.(*fuse.Context); ok && fc.KillSuidGid {
+		in.Valid |= fuse.FATTR_KILL_SUIDGID
+	}
+	var out fuse.AttrOut
+	if sa, ok := node.(NodeSetattrer); ok {
+		return sa.Setattr(ctx, f, &in, &out)
+	}
+	if sa, ok := f.(FileSetattrer); ok {
+		return sa.Setattr(ctx, &in, &out)
+	}
+	return syscall.ENOTSUP
+}
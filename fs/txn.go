@@ -0,0 +1,259 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Txn is a transaction: a group of the operations that the kernel
+// issues for one logical user action, such as the CREATE, WRITEs and
+// SETATTRs that make up cp copying a file. Backends that commit
+// metadata to a remote store can collect the changes of a transaction
+// in Data, and commit them together in TxnHandler.CommitTxn.
+//
+// The grouping is heuristic. A transaction starts with a modifying
+// operation (create, tmpfile, mkdir, mknod, symlink, link, rename,
+// unlink, rmdir, setattr, write, fallocate, copy_file_range, setxattr
+// or removexattr) of a process, and takes in that process's further modifying operations.
+// Operations sent without a process, such as writeback from the page
+// cache, join the transaction that touched their node. The
+// transaction ends when a file that it touched is released or
+// fsynced, or when no operation has run for Options.TxnIdle.
+type Txn struct {
+	// ID numbers the transactions of a file system, from 1.
+	ID uint64
+
+	// Pid is the process whose operations are grouped.
+	Pid uint32
+
+	// Data is for the TxnHandler to store the pending changes.
+	Data interface{}
+
+	bridge *rawBridge
+
+	// Closed once BeginTxn returns.
+	begun chan struct{}
+
+	// Protected by rawBridge.txnMu.
+	nodes   map[*Inode]struct{}
+	ops     int
+	active  int
+	pending bool
+	done    bool
+	timer   *time.Timer
+}
+
+// Nodes returns the nodes that operations of the transaction have
+// touched so far: the parent directories of created and removed
+// entries, the new entries, and the nodes that were written or
+// changed.
+func (t *Txn) Nodes() []*Inode {
+	t.bridge.txnMu.Lock()
+	defer t.bridge.txnMu.Unlock()
+	var r []*Inode
+	for n := range t.nodes {
+		r = append(r, n)
+	}
+	return r
+}
+
+// Ops returns the number of operations in the transaction.
+func (t *Txn) Ops() int {
+	t.bridge.txnMu.Lock()
+	defer t.bridge.txnMu.Unlock()
+	return t.ops
+}
+
+// TxnHandler receives the begin and commit of transactions, see
+// Options.TxnHandler.
+type TxnHandler interface {
+	// BeginTxn is called before the first operation of txn
+	// runs. Further operations of the transaction wait for it to
+	// return.
+	BeginTxn(ctx context.Context, txn *Txn)
+
+	// CommitTxn is called once the last operation of txn has
+	// returned. Operations that start afterwards begin a new
+	// transaction.
+	CommitTxn(txn *Txn)
+}
+
+const defaultTxnIdle = 100 * time.Millisecond
+
+// txnOp adds an operation of caller on n to the caller's transaction,
+// starting one if needed. The result, which is nil if transactions are
+// off, must be passed to txnDone when the operation returns.
+func (b *rawBridge) txnOp(cancel <-chan struct{}, caller *fuse.Caller, n *Inode) *Txn {
+	h := b.options.TxnHandler
+	if h == nil {
+		return nil
+	}
+
+	b.txnMu.Lock()
+	var txn *Txn
+	if caller.Pid != 0 {
+		txn = b.txns[caller.Pid]
+	} else {
+		txn = b.nodeTxnLocked(n)
+	}
+	begin := false
+	if txn == nil {
+		if caller.Pid == 0 {
+			b.txnMu.Unlock()
+			return nil
+		}
+		b.nextTxnId++
+		txn = &Txn{
+			ID:     b.nextTxnId,
+			Pid:    caller.Pid,
+			bridge: b,
+			begun:  make(chan struct{}),
+			nodes:  map[*Inode]struct{}{},
+		}
+		if b.txns == nil {
+			b.txns = map[uint32]*Txn{}
+		}
+		b.txns[caller.Pid] = txn
+		begin = true
+	}
+	txn.nodes[n] = struct{}{}
+	txn.ops++
+	txn.active++
+	if txn.timer != nil {
+		txn.timer.Stop()
+		txn.timer = nil
+	}
+	b.txnMu.Unlock()
+
+	if begin {
+		h.BeginTxn(&fuse.Context{Caller: *caller, Cancel: cancel}, txn)
+		close(txn.begun)
+	} else {
+		<-txn.begun
+	}
+	return txn
+}
+
+// txnAdd records that the operation of txn touched n, eg. because
+// it created n.
+func (b *rawBridge) txnAdd(txn *Txn, n *Inode) {
+	if txn == nil || n == nil {
+		return
+	}
+	b.txnMu.Lock()
+	defer b.txnMu.Unlock()
+	txn.nodes[n] = struct{}{}
+}
+
+// txnDone ends an operation started with txnOp.
+func (b *rawBridge) txnDone(txn *Txn) {
+	if txn == nil {
+		return
+	}
+	b.txnMu.Lock()
+	txn.active--
+	if txn.active > 0 || txn.done {
+		b.txnMu.Unlock()
+		return
+	}
+	if !txn.pending {
+		idle := b.options.TxnIdle
+		if idle == 0 {
+			idle = defaultTxnIdle
+		}
+		txn.timer = time.AfterFunc(idle, func() { b.commitTxn(txn, false) })
+		b.txnMu.Unlock()
+		return
+	}
+	b.endTxnLocked(txn)
+	b.txnMu.Unlock()
+	b.options.TxnHandler.CommitTxn(txn)
+}
+
+// commitTxn commits txn. Unless force is set, it is left alone if
+// operations are running; otherwise it is committed once they
+// return.
+func (b *rawBridge) commitTxn(txn *Txn, force bool) {
+	b.txnMu.Lock()
+	if txn.done {
+		b.txnMu.Unlock()
+		return
+	}
+	if txn.active > 0 {
+		if force {
+			txn.pending = true
+		}
+		b.txnMu.Unlock()
+		return
+	}
+	b.endTxnLocked(txn)
+	b.txnMu.Unlock()
+	b.options.TxnHandler.CommitTxn(txn)
+}
+
+// commitNodeTxns commits the transactions that touched n, eg. when
+// it is released.
+func (b *rawBridge) commitNodeTxns(n *Inode) {
+	if b.options.TxnHandler == nil {
+		return
+	}
+	b.txnMu.Lock()
+	var txns []*Txn
+	for _, txn := range b.txns {
+		if _, ok := txn.nodes[n]; ok {
+			txns = append(txns, txn)
+		}
+	}
+	b.txnMu.Unlock()
+	for _, txn := range txns {
+		b.commitTxn(txn, true)
+	}
+}
+
+// endTxnLocked marks txn done. Must hold txnMu.
+func (b *rawBridge) endTxnLocked(txn *Txn) {
+	txn.done = true
+	if txn.timer != nil {
+		txn.timer.Stop()
+		txn.timer = nil
+	}
+	if b.txns[txn.Pid] == txn {
+		delete(b.txns, txn.Pid)
+	}
+}
+
+// nodeTxnLocked returns a transaction that touched n. Must hold
+// txnMu.
+func (b *rawBridge) nodeTxnLocked(n *Inode) *Txn {
+	for _, txn := range b.txns {
+		if _, ok := txn.nodes[n]; ok {
+			return txn
+		}
+	}
+	return nil
+}
+
+// Txn returns the transaction that the operation with the given
+// context belongs to, or nil if Options.TxnHandler is not set.
+func (n *Inode) Txn(ctx context.Context) *Txn {
+	b := n.bridge
+	if b == nil || b.options.TxnHandler == nil {
+		return nil
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	b.txnMu.Lock()
+	defer b.txnMu.Unlock()
+	if caller.Pid != 0 {
+		return b.txns[caller.Pid]
+	}
+	return b.nodeTxnLocked(n)
+}
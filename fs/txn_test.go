@@ -0,0 +1,133 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type txnDir struct {
+	Inode
+}
+
+func (d *txnDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	if d.Txn(ctx) == nil {
+		return nil, nil, 0, syscall.EIO
+	}
+	ch := d.NewInode(ctx, &MemRegularFile{}, StableAttr{})
+	return ch, nil, 0, OK
+}
+
+func (d *txnDir) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	return d.Create(ctx, "", flags, mode, out)
+}
+
+type txnRecorder struct {
+	begun     chan *Txn
+	committed chan *Txn
+}
+
+func (r *txnRecorder) BeginTxn(ctx context.Context, txn *Txn) {
+	r.begun <- txn
+}
+
+func (r *txnRecorder) CommitTxn(txn *Txn) {
+	r.committed <- txn
+}
+
+func TestTxn(t *testing.T) {
+	rec := &txnRecorder{begun: make(chan *Txn, 10), committed: make(chan *Txn, 10)}
+	root := &txnDir{}
+	rawFS := NewNodeFS(root, &Options{TxnHandler: rec, TxnIdle: 200 * time.Millisecond})
+
+	cp := fuse.Caller{Pid: 10}
+	var out fuse.CreateOut
+	in := fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1, Caller: cp}, Mode: 0644}
+	if st := rawFS.Create(nil, &in, "file", &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	node := out.NodeId
+	if _, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: node, Caller: cp}}, []byte("hello")); !st.Ok() {
+		t.Fatal(st)
+	}
+	// Writeback comes without a process, and joins through the node.
+	if _, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: node}, Offset: 5}, []byte("!")); !st.Ok() {
+		t.Fatal(st)
+	}
+	var attrOut fuse.AttrOut
+	setIn := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: fuse.InHeader{NodeId: node, Caller: cp}, Valid: fuse.FATTR_MODE, Mode: 0600}}
+	if st := rawFS.SetAttr(nil, &setIn, &attrOut); !st.Ok() {
+		t.Fatal(st)
+	}
+
+	txn := <-rec.begun
+	if txn.ID != 1 || txn.Pid != 10 {
+		t.Errorf("got txn %d pid %d, want 1 and 10", txn.ID, txn.Pid)
+	}
+	select {
+	case txn := <-rec.begun:
+		t.Fatalf("unexpected transaction %d", txn.ID)
+	case txn := <-rec.committed:
+		t.Fatalf("transaction %d committed before release", txn.ID)
+	default:
+	}
+
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: node}, Fh: out.Fh})
+	select {
+	case got := <-rec.committed:
+		if got != txn {
+			t.Fatalf("committed %d, want %d", got.ID, txn.ID)
+		}
+	default:
+		t.Fatal("release did not commit")
+	}
+	if got := txn.Ops(); got != 4 {
+		t.Errorf("got %d ops, want 4", got)
+	}
+	if got := len(txn.Nodes()); got != 2 {
+		t.Errorf("got %d nodes, want 2", got)
+	}
+
+	// Without a release, the transaction commits when idle.
+	setIn.Caller.Pid = 11
+	if st := rawFS.SetAttr(nil, &setIn, &attrOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	txn = <-rec.begun
+	select {
+	case got := <-rec.committed:
+		if got != txn || got.Pid != 11 {
+			t.Errorf("committed %d pid %d, want %d pid 11", got.ID, got.Pid, txn.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle transaction was not committed")
+	}
+}
+
+func TestTxnTmpfile(t *testing.T) {
+	rec := &txnRecorder{begun: make(chan *Txn, 10), committed: make(chan *Txn, 10)}
+	root := &txnDir{}
+	rawFS := NewNodeFS(root, &Options{TxnHandler: rec})
+
+	var out fuse.CreateOut
+	in := fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1, Caller: fuse.Caller{Pid: 10}}, Mode: 0644}
+	if st := rawFS.Tmpfile(nil, &in, &out); !st.Ok() {
+		t.Fatalf("Tmpfile: %v", st)
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, Fh: out.Fh})
+
+	txn := <-rec.begun
+	if got := <-rec.committed; got != txn {
+		t.Fatalf("committed %d, want %d", got.ID, txn.ID)
+	}
+	if got := len(txn.Nodes()); got != 2 {
+		t.Errorf("got %d nodes, want 2", got)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// verifiedFile rejects reads that contain "bad".
+type verifiedFile struct {
+	MemRegularFile
+}
+
+var _ = (NodeReadVerifier)((*verifiedFile)(nil))
+
+func (f *verifiedFile) VerifyRead(ctx context.Context, fh FileHandle, off int64, data []byte) syscall.Errno {
+	if bytes.Contains(data, []byte("bad")) {
+		return syscall.EBADMSG
+	}
+	return 0
+}
+
+func TestVerifyRead(t *testing.T) {
+	root := &Inode{}
+	var failures uint64
+	rawFS := NewNodeFS(root, &Options{
+		ReadVerifyFailures: &failures,
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &verifiedFile{
+				MemRegularFile: MemRegularFile{Data: []byte("good...bad")},
+			}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+
+	var entry fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	var open fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &open); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	read := func(off, sz uint64) (string, fuse.Status) {
+		buf := make([]byte, sz)
+		res, st := rawFS.Read(nil, &fuse.ReadIn{
+			InHeader: fuse.InHeader{NodeId: entry.NodeId},
+			Fh:       open.Fh,
+			Offset:   off,
+			Size:     uint32(sz),
+		}, buf)
+		if !st.Ok() {
+			return "", st
+		}
+		data, _ := res.Bytes(buf)
+		return string(data), st
+	}
+
+	if got, st := read(0, 4); !st.Ok() || got != "good" {
+		t.Errorf("read good: got %q, %v", got, st)
+	}
+	if failures != 0 {
+		t.Errorf("got %d failures, want 0", failures)
+	}
+	if _, st := read(4, 6); st != fuse.EIO {
+		t.Errorf("read bad: got %v, want EIO", st)
+	}
+	if failures != 1 {
+		t.Errorf("got %d failures, want 1", failures)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// WhiteoutMode is the file type of an overlayfs whiteout. Overlayfs
+// marks entries deleted from the lower layers with a character
+// device with device number 0/0 in the upper layer.
+const WhiteoutMode = syscall.S_IFCHR
+
+// IsWhiteout returns whether attr describes an overlayfs whiteout.
+// File systems serving as a lower layer can use it to hide such
+// entries from their own listings.
+func IsWhiteout(attr *fuse.Attr) bool {
+	return attr.Mode&syscall.S_IFMT == WhiteoutMode && attr.Rdev == 0
+}
+
+// NewWhiteout returns a new in-memory whiteout, to be added as a
+// child of n. In-memory file systems can use it to implement
+// RENAME_WHITEOUT and Mknod of whiteouts, so they can serve as the
+// upper layer of overlayfs.
+func (n *Inode) NewWhiteout(ctx context.Context) *Inode {
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: WhiteoutMode})
+}
@@ -90,6 +90,12 @@
 // you care about correctness.
 package fuse
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // Types for users to implement.
 
 // The result of Read is an array of bytes, but for performance
@@ -119,8 +125,19 @@ type MountOptions struct {
 	// Default is _DEFAULT_BACKGROUND_TASKS, 12.  This numbers
 	// controls the allowed number of requests that relate to
 	// async I/O.  Concurrency for synchronous I/O is not limited.
+	// Raising it lets the kernel keep more readahead and
+	// writeback requests in flight; for unprivileged mounts, the
+	// kernel caps it at the fs.fuse.max_user_bgreq sysctl. If 0,
+	// the kernel default is used. It can be changed on a live
+	// mount through the fusectl package.
 	MaxBackground int
 
+	// CongestionThreshold is the number of background requests at
+	// which the kernel considers the file system congested, and
+	// makes writeback and readahead back off. If 0, it is 3/4 of
+	// MaxBackground.
+	CongestionThreshold int
+
 	// MaxWrite is the max size for read and write requests. If 0, use
 	// go-fuse default (currently 64 kiB).
 	// This number is internally capped at MAX_KERNEL_WRITE (higher values don't make
@@ -170,6 +187,26 @@ type MountOptions struct {
 	// This may be useful for NFS.
 	RememberInodes bool
 
+	// If SkipForgetOnUnmount is set, forgets that arrive while
+	// Unmount runs are dropped, without calling the file system.
+	// When a file system is unmounted, the kernel forgets every
+	// node that it knows of, which can take millions of calls
+	// that only free memory that is about to go away anyway. Do
+	// not set it if the file system releases other resources
+	// when nodes are forgotten.
+	SkipForgetOnUnmount bool
+
+	// AfterUnmountStatus, if not OK, is the error, eg. ENOTCONN or
+	// EIO, that requests get once the file system goes away: once
+	// Unmount has succeeded, or the kernel has sent DESTROY. They
+	// are answered right away, without calling the file system, so
+	// they cannot reach backend code that is being torn down.
+	// Forgets, interrupts and releases are still served, so the
+	// file system can free its resources. If OK, requests are
+	// served as usual until the file system is destroyed (see
+	// Destroyer), and get ENOTCONN after that.
+	AfterUnmountStatus Status
+
 	// Values shown in "df -T" and friends
 	// First column, "Filesystem"
 	FsName string
@@ -180,15 +217,104 @@ type MountOptions struct {
 	// If set, wrap the file system in a single-threaded locking wrapper.
 	SingleThreaded bool
 
+	// MaxReaders is the number of goroutines that may wait for
+	// requests on the FUSE device. Each of them handles the
+	// request that it reads; once done, it exits if MaxReaders
+	// others are already waiting, so the pool shrinks back after
+	// a burst. If 0, the number of CPUs is used, but at most 4.
+	MaxReaders int
+
+	// MaxHandlers, if positive, limits the number of goroutines
+	// that read or handle requests, which bounds the memory held
+	// by request buffers. It counts the reader loops, including
+	// those of PinReaders and DeviceClones, and the handlers of
+	// the Scheduler, which get at most MaxHandlers-1 of them.
+	// Once it is reached, further requests wait in the kernel
+	// until a handler returns. Requests over io_uring are not
+	// counted; IoUringQueueDepth bounds them instead. Handlers
+	// that wait for other requests to be served, eg. through
+	// InodeRetrieveCache, can deadlock if the limit is too low.
+	MaxHandlers int
+
+	// BufferPool, if set, tunes the buffers that requests are
+	// read into and that replies are assembled in, and caps the
+	// memory that they hold while idle.
+	BufferPool *BufferPoolOptions
+
+	// Scheduler, if set, has a pool of handlers serve requests
+	// in order of priority, so metadata requests are not stuck
+	// behind bulk transfers when all handlers are busy.
+	Scheduler *SchedulerOptions
+
+	// RateLimit, if set, limits the rate and the concurrency of
+	// the requests of each UID or process.
+	RateLimit *RateLimitOptions
+
+	// PinReaders starts a reader loop for each CPU that the
+	// process may run on, up to GOMAXPROCS, and locks each loop
+	// to an OS thread that is restricted to its CPU. A request
+	// is then read and handled on the same CPU, which improves
+	// cache locality and saves cross-CPU wakeups on many-core
+	// machines with a high request rate. The loops never exit.
+	// They count against MaxHandlers, so fewer CPUs are used if
+	// it is lower, but not against MaxReaders. If they are all
+	// busy, unpinned readers are started as usual, within
+	// MaxReaders and MaxHandlers. PinReaders is only supported
+	// on Linux.
+	PinReaders bool
+
+	// ReaderCPUs, if set, are the CPUs on which PinReaders starts
+	// its loops, instead of all CPUs of the process.
+	ReaderCPUs []int
+
+	// DeviceClones, if positive, clones the FUSE device this many
+	// times with FUSE_DEV_IOC_CLONE, and runs a reader loop on
+	// each clone in addition to the readers of the mount
+	// descriptor. The kernel keeps the requests that are being
+	// served per device, so the readers no longer contend on a
+	// single lock at high request rates; the reply to a request
+	// goes to the device that it was read from. The loops on the
+	// clones count against MaxReaders and MaxHandlers, and pause
+	// like the main loop during HandOff and GracefulUnmount.
+	// Clones are not passed on by HandOff; once it succeeds,
+	// their loops exit. DeviceClones is only supported on Linux
+	// 4.2 and later; if cloning fails, the error is logged and
+	// the server runs with the clones that it has.
+	DeviceClones int
+
 	// If set, return ENOSYS for Getxattr calls, so the kernel does not issue any
 	// Xattr operations at all.
 	DisableXAttrs bool
 
-	// If set, print debugging information.
+	// If set, print debugging information. This can be changed
+	// later with Server.SetDebug.
 	Debug bool
 
+	// Logger, if set, receives the debugging information and the
+	// errors of the server, instead of the standard logger. It
+	// accepts a *slog.Logger; see Logger for the attributes that
+	// are logged. With a Logger, replies carry the latency of the
+	// request.
+	Logger Logger
+
+	// DebugFormatter, if set, renders the requests and replies
+	// that are logged while debugging, eg. as JSON with
+	// JSONDebugFormatter, or with file names redacted.
+	DebugFormatter DebugFormatter
+
+	// If set, check every reply and notification header before it
+	// is written to the kernel, and panic if it is malformed (eg.
+	// a wrong length, or an error with a payload). This catches
+	// serialization bugs at their source rather than as
+	// mysterious kernel errors. It is meant for development and
+	// tests.
+	VerifyReplies bool
+
 	// If set, ask kernel to forward file locks to FUSE. If using,
-	// you must implement the GetLk/SetLk/SetLkw methods.
+	// you must implement the GetLk/SetLk/SetLkw methods. POSIX
+	// (fcntl) locks and BSD (flock) locks are each enabled if the
+	// kernel supports them. flock(2) calls arrive as SetLk/SetLkw
+	// with FUSE_LK_FLOCK in the flags, and apply to the whole file.
 	EnableLocks bool
 
 	// If set, ask kernel not to do automatic data cache invalidation.
@@ -200,6 +326,12 @@ type MountOptions struct {
 	// but might be needed if fusermount is not available.
 	DirectMount bool
 
+	// DirectMountStrict is like DirectMount, but if syscall.Mount
+	// fails, the mount fails rather than falling back to
+	// fusermount. Unmount then also only uses the umount2 system
+	// call. Linux only.
+	DirectMountStrict bool
+
 	// DirectMountFlags are the mountflags passed to syscall.Mount. If zero, the
 	// default value used by fusermount are used: syscall.MS_NOSUID|syscall.MS_NODEV.
 	//
@@ -207,6 +339,24 @@ type MountOptions struct {
 	// by the kernel. See `man 2 mount` for details about MS_MGC_VAL.
 	DirectMountFlags uintptr
 
+	// LazyUnmount makes Unmount detach the file system lazily, with
+	// MNT_DETACH or fusermount -z, if it cannot be unmounted
+	// otherwise, eg. because it is busy. The kernel then finishes
+	// the unmount once the last reference to it is gone. Linux
+	// only.
+	LazyUnmount bool
+
+	// MountRetries is the number of times a mount is retried if it
+	// fails with a transient error, such as EBUSY on the mountpoint,
+	// EINTR, or a failing fusermount invocation (which may be
+	// caused by lock contention when many filesystems are mounted
+	// concurrently). If 0, the mount is attempted only once.
+	MountRetries int
+
+	// MountRetryDelay is the delay before the first retry. It is
+	// doubled after each failed attempt. If 0, 10ms is used.
+	MountRetryDelay time.Duration
+
 	// EnableAcls enables kernel ACL support.
 	//
 	// See the comments to FUSE_CAP_POSIX_ACL
@@ -217,9 +367,235 @@ type MountOptions struct {
 	// EnableWriteback enables kernel writeback cache.
 	EnableWriteback bool
 
+	// EnableAtomicTrunc negotiates ATOMIC_O_TRUNC. The kernel
+	// then passes O_TRUNC to Open, and the file system truncates
+	// the file as part of opening it, rather than the kernel
+	// sending a separate SETATTR for the size first. Only file
+	// systems that truncate in Open should set it.
+	EnableAtomicTrunc bool
+
+	// NoOpen makes the server answer the first OPEN with ENOSYS
+	// without calling the file system, if the kernel supports
+	// NO_OPEN_SUPPORT. The kernel then opens files without
+	// asking, and sends no RELEASE. File operations arrive with
+	// file handle 0. This saves round trips for stateless file
+	// systems. Create is still called.
+	NoOpen bool
+
+	// NoOpendir is like NoOpen, but for OPENDIR and RELEASEDIR.
+	// It negotiates NO_OPENDIR_SUPPORT.
+	NoOpendir bool
+
+	// EnableKillPriv negotiates HANDLE_KILLPRIV_V2 (Linux 5.12 and
+	// later). The kernel then leaves it to the file system to
+	// clear the setuid and setgid bits of files that are written,
+	// truncated or chowned. Requests that should clear them are
+	// flagged with WRITE_KILL_SUIDGID, OPEN_KILL_SUIDGID or
+	// FATTR_KILL_SUIDGID, which the fs package passes on in
+	// Context.KillSuidGid. Only file systems that implement this
+	// should set it.
+	EnableKillPriv bool
+
+	// EnableSetXAttrExt negotiates SETXATTR_EXT (protocol 7.33).
+	// The kernel then leaves it to the file system to clear the
+	// setgid bit when a POSIX ACL is set by a caller outside the
+	// file's group, and flags those requests with
+	// SETXATTR_ACL_KILL_SGID, which the fs package passes on in
+	// Context.KillSgid. Only file systems that implement this
+	// should set it.
+	EnableSetXAttrExt bool
+
+	// ReadDirPlusAuto negotiates READDIRPLUS_AUTO, which lets the
+	// kernel choose between READDIR and READDIRPLUS per request.
+	// It starts listing a directory with READDIRPLUS, and only
+	// continues with it if the returned entries were looked up
+	// in the meantime, as with "ls -l". A plain "ls" of a large
+	// directory then does not pay for the attributes of every
+	// entry. The file system must implement both ReadDir and
+	// ReadDirPlus, on the same offsets.
+	ReadDirPlusAuto bool
+
+	// DisableReadDirPlus turns off READDIRPLUS, which is otherwise
+	// used if the kernel supports it. Directory listings then
+	// carry no attributes, and the kernel looks up entries
+	// separately.
+	DisableReadDirPlus bool
+
+	// DisableParallelDirOps turns off PARALLEL_DIROPS, which is
+	// otherwise used if the kernel supports it. The kernel then
+	// serializes lookups and readdirs within a directory.
+	DisableParallelDirOps bool
+
+	// EnablePassthrough negotiates FUSE passthrough (Linux 6.9 and
+	// later). With passthrough, a file system can register a backing
+	// file descriptor with Server.RegisterBackingFd and return its
+	// ID in OpenOut, after which the kernel serves reads and writes
+	// for that file directly from the backing file. Registering
+	// backing files requires CAP_SYS_ADMIN.
+	EnablePassthrough bool
+
+	// MaxStackDepth is the file system stacking depth that the
+	// mount announces with passthrough. At 1, the default, backing
+	// files must not live on stacked file systems, such as
+	// overlayfs or other FUSE mounts that use passthrough. At 2,
+	// the kernel maximum, they may, but then this mount cannot be
+	// stacked on in turn. It needs EnablePassthrough.
+	MaxStackDepth int
+
+	// EnableIoUring negotiates FUSE-over-io_uring (Linux 6.14 and
+	// later, with the fuse module parameter enable_uring set). The
+	// kernel then delivers requests through io_uring entries that
+	// are registered for each CPU, which saves a read and a write
+	// system call per request. If the kernel does not support it,
+	// requests are read from /dev/fuse as usual.
+	EnableIoUring bool
+
+	// IoUringQueueDepth is the number of io_uring entries per CPU,
+	// ie. the number of requests that can be served in parallel
+	// per CPU, regardless of MaxHandlers. Each entry holds a
+	// buffer of MaxWrite bytes. The default is 8.
+	IoUringQueueDepth int
+
+	// EnableNUMA places the buffers of each io_uring queue on the
+	// NUMA node of its CPU, and handles the queue's requests on
+	// threads that run on that node. This avoids cross-node
+	// memory traffic for large reads and writes on multi-socket
+	// machines. It only has effect with EnableIoUring.
+	EnableNUMA bool
+
+	// EnableIoctl passes ioctl(2) on files to RawFileSystem.Ioctl.
 	EnableIoctl bool
 
-	// If set, tell kernel not to apply umask for create/mkdir/mknod
+	// EnablePoll passes poll(2) on files to RawFileSystem.Poll.
+	// By default, go-fuse makes the kernel disable poll on the
+	// mount, because the Go runtime polls the files that the
+	// server process opens itself, which may deadlock when they
+	// are on the same mount. With EnablePoll, the server should
+	// not open files on its own mount through the os package.
+	EnablePoll bool
+
+	// EnableSubmounts negotiates SUBMOUNTS (Linux 5.10 and
+	// later). Directories whose attributes have
+	// FUSE_ATTR_SUBMOUNT set in Attr.AttrFlags are then mounted
+	// by the kernel as a separate file system, with its own
+	// st_dev, when they are crossed into. The submount shares the
+	// connection, and is unmounted along with the mount point.
+	// The kernel only offers SUBMOUNTS to virtiofs, see
+	// NewVirtioFSServer; mounts of /dev/fuse ignore the flag.
+	EnableSubmounts bool
+
+	// SlowRequestThreshold, if set, samples the stack traces of
+	// handlers that take longer than this to answer a request.
+	// The requests in flight are checked once per threshold, and
+	// a goroutine profile is only taken if one of them is slow.
+	// The handler goroutines carry a pprof label, so only they
+	// are picked from it. The stacks are aggregated per opcode,
+	// and returned by Server.SlowStacks.
+	SlowRequestThreshold time.Duration
+
+	// RequestTimeout, if set, bounds the time that the file system
+	// may take to answer a request. Requests that take longer are
+	// logged, and passed to OnRequestTimeout, so hung backends,
+	// which leave processes in uninterruptible sleep, are noticed.
+	// The requests in flight are checked once per quarter of the
+	// timeout. SETLKW, which waits as long as the lock is held, is
+	// exempt, and the time that requests wait for RateLimit is not
+	// counted.
+	RequestTimeout time.Duration
+
+	// RequestTimeoutEIO makes requests that time out fail with EIO
+	// right away, and closes the cancel channel of their handlers.
+	// When the handlers return, the replies are dropped. Requests
+	// whose replies hand out nodes or file handles, ie. LOOKUP,
+	// READDIRPLUS, CREATE, MKNOD, MKDIR, SYMLINK, LINK, TMPFILE,
+	// OPEN and OPENDIR, are only reported, because the kernel
+	// would never forget or release what a dropped reply hands
+	// out. So are requests that arrive over io_uring or
+	// virtio-fs.
+	RequestTimeoutEIO bool
+
+	// OnRequestTimeout, if set, is called for each request that
+	// times out, once. It runs on the goroutine that checks for
+	// timeouts, so it should not block.
+	OnRequestTimeout func(r *TimedOutRequest)
+
+	// EnableMetrics keeps counters of the requests, errors, bytes
+	// and latencies of each opcode, which are returned by
+	// Server.Metrics.
+	EnableMetrics bool
+
+	// MetricsCollector, if set, is called for every finished
+	// request, eg. to export metrics to Prometheus.
+	MetricsCollector MetricsCollector
+
+	// MountpointResolvers resolves mount points of the form
+	// "scheme:name", keyed by scheme, eg. "fdstore" for a
+	// resolver that fetches a mounted FUSE device from the
+	// systemd file descriptor store. Mount points with other
+	// schemes are directories.
+	MountpointResolvers map[string]MountpointResolver
+
+	// RequestTracer, if set, starts a span for every request,
+	// eg. for OpenTelemetry tracing.
+	RequestTracer RequestTracer
+
+	// TraceIDs gives every request a correlation ID, which is
+	// included in debug logs, and which the file system can pass
+	// on to its backend, see TraceIDFromContext. That way, one
+	// operation can be followed from the kernel request through
+	// the logs of the daemon and the backend. IDs are made of a
+	// random prefix per server and the unique number of the
+	// request, unless NewTraceID is set.
+	TraceIDs bool
+
+	// NewTraceID, if set, returns the ID for a request, eg. one
+	// that the backend accepts, or one taken from the calling
+	// process. It is called concurrently, and implies TraceIDs.
+	NewTraceID func(h *InHeader) string
+
+	// Interceptors wrap the handling of every request that is
+	// answered: all but INIT, FORGET, BATCH_FORGET, INTERRUPT and
+	// NOTIFY_REPLY.
+	// The first interceptor is the outermost: it sees the request
+	// first, and the reply last.
+	Interceptors []Interceptor
+
+	// AllowedPeerUids are the user IDs of the processes that may
+	// be at the other end of the unix sockets that the server
+	// exchanges the FUSE device or requests over: the connections
+	// of HandOff and TakeOver, the socket named by _FUSE_FD_COMM,
+	// and the vhost-user socket. The kernel reports the peer's
+	// user ID with SO_PEERCRED. If empty, only root and the
+	// effective user ID of this process are allowed.
+	AllowedPeerUids []uint32
+
+	// Extensions handles opcodes that go-fuse does not implement,
+	// eg. to prototype new kernel features. Opcodes that go-fuse
+	// implements cannot be overridden. Requests for other
+	// unimplemented opcodes fail with ENOSYS.
+	Extensions map[uint32]OpcodeHandler
+
+	// BlockDevice mounts the file system as type fuseblk, with
+	// this block device as its source. The kernel then sends BMAP
+	// requests, see RawFileSystem.Bmap. Mounting a block device
+	// needs root privileges. Linux only.
+	BlockDevice string
+
+	// BlockSize is the block size of a BlockDevice mount, and the
+	// unit of BMAP requests. It must be a power of two between
+	// 512 and the page size. If zero, the kernel uses 512.
+	BlockSize int
+
+	// MapAlignment is the log2 of the alignment that offsets of
+	// SETUPMAPPING requests must have, eg. 21 for mappings of the
+	// DAX window in units of 2MB. If zero, the kernel's default
+	// is used.
+	MapAlignment int
+
+	// If set, tell kernel not to apply umask for create/mkdir/mknod.
+	// The file system then gets the umask in Context.Umask, and
+	// should apply it itself, which lets it honor default POSIX
+	// ACLs.
 	DontUmask bool
 
 	// Other capability flags
@@ -227,6 +603,141 @@ type MountOptions struct {
 
 	// don't alloc buffer for read operation
 	NoAllocForRead bool
+
+	// SpliceWrite reads requests from the FUSE device through a
+	// pipe, and leaves the data of WRITE requests in it, if the
+	// file system implements WriteSplicer. Loopback-style file
+	// systems can then splice the data into their backing files
+	// without copying it through user space, which pays off for
+	// large writes. Every other request takes three system calls
+	// to read instead of one. Requests that do not fit in a pipe,
+	// because MaxWrite exceeds /proc/sys/fs/pipe-max-size, are
+	// read with read(2). It is only supported on Linux.
+	SpliceWrite bool
+
+	// SpliceTimeout bounds how long a reply that is spliced from a
+	// file waits for room in a pipe. If it passes, the reply is
+	// written with writev instead, so a stalled pipe does not
+	// block the handler; see ServerStats.SpliceStalls. Waiting for
+	// data from a pipe or socket is not bounded. If 0, 1 second is
+	// used.
+	SpliceTimeout time.Duration
+
+	// UnmountFlushTimeout, if positive, makes Unmount and Shutdown
+	// write back open files before detaching: requests that modify
+	// the file system are rejected with EROFS, and if the file
+	// system implements OpenFileFlusher, its open files are
+	// flushed and synced, waiting at most UnmountFlushTimeout.
+	// Unmount returns a *FlushError for the files that could not
+	// be flushed.
+	UnmountFlushTimeout time.Duration
+
+	// UnmountOnSignal, if set, makes the server unmount the file
+	// system gracefully when the process receives SIGINT or
+	// SIGTERM, rather than leaving behind a mount that fails with
+	// ENOTCONN.
+	UnmountOnSignal *UnmountOnSignalOptions
+
+	// WriteQueueSize, if positive, makes a dedicated goroutine
+	// write the replies to the kernel, from a queue of this many
+	// replies. Handlers then return as soon as their reply is
+	// queued, rather than waiting for slow writes, such as
+	// splicing into a full pipe; if the queue is full, they wait
+	// for room. Replies are written in the order they are queued.
+	// Notifications are still written directly, because the
+	// kernel may hold them until earlier requests are answered.
+	// Replies over io_uring and virtio-fs are not queued. See
+	// Server.WriteQueueStats.
+	WriteQueueSize int
+}
+
+// OpenFileFlusher is implemented by file systems that track their
+// open files. See MountOptions.UnmountFlushTimeout.
+type OpenFileFlusher interface {
+	// FlushOpenFiles calls Flush and Fsync on all files that are
+	// open for writing, and returns the files that failed. Once
+	// cancel is closed, it should return, and report the files
+	// that are not done yet as failed with ETIMEDOUT.
+	FlushOpenFiles(cancel <-chan struct{}) []FlushFailure
+}
+
+// BatchForgetter is implemented by file systems that forget many
+// nodes at once more cheaply than one by one. If a RawFileSystem
+// implements it, the entries of BATCH_FORGET requests, which the
+// kernel sends by the thousands on unmount or when caches are
+// dropped, are passed to BatchForget in chunks, straight from the
+// request buffer, instead of to Forget.
+type BatchForgetter interface {
+	// BatchForget forgets the given nodes, as Forget does. The
+	// slice is only valid during the call.
+	BatchForget(forgets []ForgetOne)
+}
+
+// Destroyer is implemented by file systems that release resources,
+// eg. connections to a backend, when the file system goes away.
+type Destroyer interface {
+	// Destroy is called once, when the kernel sends DESTROY, or
+	// else before Serve returns. It is called after the handlers
+	// of all other requests have returned, and no handler is
+	// called after it: requests that still arrive get
+	// MountOptions.AfterUnmountStatus, or ENOTCONN. It is not
+	// called if the server was handed off, see Server.HandOff.
+	Destroy()
+}
+
+// FlushFailure describes an open file that could not be flushed
+// before unmounting.
+type FlushFailure struct {
+	NodeId uint64
+	Fh     uint64
+	Status Status
+}
+
+// FlushError is returned by Server.Unmount if open files could not
+// be flushed.
+type FlushError struct {
+	Failures []FlushFailure
+}
+
+func (e *FlushError) Error() string {
+	var parts []string
+	for _, f := range e.Failures {
+		parts = append(parts, fmt.Sprintf("n%d fh%d: %v", f.NodeId, f.Fh, f.Status))
+	}
+	return fmt.Sprintf("flushing %d open files failed: %s", len(e.Failures), strings.Join(parts, ", "))
+}
+
+// UnmountError is returned by Unmount if none of the ways to unmount
+// the file system worked. Attempts lists them in the order they were
+// tried.
+type UnmountError struct {
+	MountPoint string
+	Attempts   []UnmountAttempt
+}
+
+// UnmountAttempt is a failed attempt to unmount. Method is "umount2"
+// for the system call, or the name of the helper binary, and ends in
+// " (lazy)" for lazy unmounts.
+type UnmountAttempt struct {
+	Method string
+	Err    error
+}
+
+func (e *UnmountError) Error() string {
+	var parts []string
+	for _, a := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("%s: %v", a.Method, a.Err))
+	}
+	return fmt.Sprintf("unmount %s failed: %s", e.MountPoint, strings.Join(parts, "; "))
+}
+
+// Unwrap returns the error of the first attempt, so errors.Is can
+// test for eg. syscall.EBUSY.
+func (e *UnmountError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[0].Err
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -278,6 +789,10 @@ type RawFileSystem interface {
 	GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) (code Status)
 	SetAttr(cancel <-chan struct{}, input *SetAttrIn, out *AttrOut) (code Status)
 
+	// Statx is called for statx(2) calls that ask for more than
+	// GetAttr provides, such as the birth time.
+	Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status)
+
 	// Modifying structure.
 	Mknod(cancel <-chan struct{}, input *MknodIn, name string, out *EntryOut) (code Status)
 	Mkdir(cancel <-chan struct{}, input *MkdirIn, name string, out *EntryOut) (code Status)
@@ -310,6 +825,11 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(cancel <-chan struct{}, input *CreateIn, name string, out *CreateOut) (code Status)
+
+	// Tmpfile creates an unnamed file in the directory, for
+	// open(2) with O_TMPFILE. If it returns ENOSYS, the kernel
+	// fails further O_TMPFILE opens with EOPNOTSUPP.
+	Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status)
 	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
 	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
 	Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status
@@ -336,8 +856,45 @@ type RawFileSystem interface {
 
 	StatFs(cancel <-chan struct{}, input *InHeader, out *StatfsOut) (code Status)
 
+	// SyncFs is called for syncfs(2) on the mount. Linux only
+	// sends it for virtiofs, and stops sending it once it
+	// returns ENOSYS.
+	SyncFs(cancel <-chan struct{}, input *SyncFsIn) (code Status)
+
+	// Ioctl handles ioctl(2) on an open file. bufIn holds in.InSize
+	// bytes of input, and bufOut has room for in.OutSize bytes of
+	// output. For restricted ioctls, the kernel derives the sizes
+	// from the command. Unrestricted ioctls (as sent by CUSE)
+	// start without data; the file system asks for the memory it
+	// needs with IoctlOut.SetRetry.
 	Ioctl(cancel <-chan struct{}, in *IoctlIn, out *IoctlOut, bufIn, bufOut []byte) Status
 
+	// Poll reports the ready poll(2) events of an open file. If
+	// none are ready and in.ScheduleNotify() is set, the file
+	// system should call Server.NotifyPollWakeup with in.Kh once
+	// they are. Returning ENOSYS disables poll for the mount. It
+	// is only called with MountOptions.EnablePoll.
+	Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status
+
+	// Bmap maps in.Block, a block of in.Blocksize bytes within
+	// the file, to the block on the device that holds it, for
+	// the FIBMAP ioctl and swap files. The kernel only sends it
+	// for MountOptions.BlockDevice mounts, and stops sending it
+	// once it returns ENOSYS.
+	Bmap(cancel <-chan struct{}, in *BmapIn, out *BmapOut) Status
+
+	// SetupMapping maps a range of the file into the DAX window
+	// of a virtio-fs device, so the guest can access the file
+	// contents directly. in.Fh is ^uint64(0), as the kernel does
+	// not pass a file handle. The file system maps the range
+	// into the window itself, through the VMM. The kernel only
+	// sends it for virtio-fs mounts with DAX enabled.
+	SetupMapping(cancel <-chan struct{}, in *SetupMappingIn) Status
+
+	// RemoveMapping unmaps ranges of the DAX window, previously
+	// mapped with SetupMapping.
+	RemoveMapping(cancel <-chan struct{}, in *RemoveMappingIn, mappings []RemoveMappingOne) Status
+
 	// This is called on processing the first request. The
 	// filesystem implementation can use the server argument to
 	// talk back to the kernel (through notify methods).
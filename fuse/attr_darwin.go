@@ -24,3 +24,23 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Gid = uint32(s.Gid)
 	a.Rdev = uint32(s.Rdev)
 }
+
+// FromAttr fills s from a, including the OS X creation time.
+func (s *Statx) FromAttr(a *Attr) {
+	*s = Statx{
+		Mask:      STATX_BASIC_STATS | STATX_BTIME,
+		Nlink:     a.Nlink,
+		Uid:       a.Uid,
+		Gid:       a.Gid,
+		Mode:      uint16(a.Mode),
+		Ino:       a.Ino,
+		Size:      a.Size,
+		Blocks:    a.Blocks,
+		Atime:     SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec},
+		Btime:     SxTime{Sec: int64(a.Crtime_), Nsec: a.Crtimensec_},
+		Ctime:     SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec},
+		Mtime:     SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec},
+		RdevMajor: uint32(a.Rdev >> 24),
+		RdevMinor: a.Rdev & 0xffffff,
+	}
+}
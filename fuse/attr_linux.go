@@ -6,6 +6,8 @@ package fuse
 
 import (
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func (a *Attr) FromStat(s *syscall.Stat_t) {
@@ -25,3 +27,49 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Rdev = uint32(s.Rdev)
 	a.Blksize = uint32(s.Blksize)
 }
+
+// FromAttr fills s from a. Attr has no birth time, so the mask is
+// STATX_BASIC_STATS.
+func (s *Statx) FromAttr(a *Attr) {
+	*s = Statx{
+		Mask:      STATX_BASIC_STATS,
+		Blksize:   a.Blksize,
+		Nlink:     a.Nlink,
+		Uid:       a.Uid,
+		Gid:       a.Gid,
+		Mode:      uint16(a.Mode),
+		Ino:       a.Ino,
+		Size:      a.Size,
+		Blocks:    a.Blocks,
+		Atime:     SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec},
+		Ctime:     SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec},
+		Mtime:     SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec},
+		RdevMajor: (a.Rdev & 0xfff00) >> 8,
+		RdevMinor: (a.Rdev & 0xff) | ((a.Rdev >> 12) & 0xfff00),
+	}
+}
+
+// FromStatx fills s from the result of statx(2).
+func (s *Statx) FromStatx(st *unix.Statx_t) {
+	*s = Statx{
+		Mask:           st.Mask,
+		Blksize:        st.Blksize,
+		Attributes:     st.Attributes,
+		Nlink:          st.Nlink,
+		Uid:            st.Uid,
+		Gid:            st.Gid,
+		Mode:           st.Mode,
+		Ino:            st.Ino,
+		Size:           st.Size,
+		Blocks:         st.Blocks,
+		AttributesMask: st.Attributes_mask,
+		Atime:          SxTime{Sec: st.Atime.Sec, Nsec: st.Atime.Nsec},
+		Btime:          SxTime{Sec: st.Btime.Sec, Nsec: st.Btime.Nsec},
+		Ctime:          SxTime{Sec: st.Ctime.Sec, Nsec: st.Ctime.Nsec},
+		Mtime:          SxTime{Sec: st.Mtime.Sec, Nsec: st.Mtime.Nsec},
+		RdevMajor:      st.Rdev_major,
+		RdevMinor:      st.Rdev_minor,
+		DevMajor:       st.Dev_major,
+		DevMinor:       st.Dev_minor,
+	}
+}
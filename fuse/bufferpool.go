@@ -6,9 +6,38 @@ package fuse
 
 import (
 	"os"
+	"sort"
 	"sync"
 )
 
+// BufferPoolOptions tunes the memory that the server keeps for
+// requests and replies. See MountOptions.BufferPool.
+//
+// Without it, buffers are kept in sync.Pools, which hold any number
+// of them until the garbage collector runs. With it, idle buffers are
+// kept on free lists, whose size is bounded by MaxPooled. This
+// matters for servers with a large MaxWrite and many outstanding
+// requests: every request that is read holds a buffer of MaxWrite
+// bytes and more.
+type BufferPoolOptions struct {
+	// Prealloc is the number of buffers to read requests into
+	// that are allocated up front, so a burst of requests does not
+	// have to wait for the allocator.
+	Prealloc int
+
+	// SizeClasses are the sizes in bytes of the buffers for
+	// replies, eg. for READ. A reply gets the smallest class that
+	// fits; replies larger than all classes get a buffer of their
+	// own that is not pooled. If empty, the classes are the page
+	// size, doubled until they hold MaxWrite.
+	SizeClasses []int
+
+	// MaxPooled, if positive, caps the number of bytes that idle
+	// buffers hold. Buffers that are freed beyond it are left to
+	// the garbage collector.
+	MaxPooled int64
+}
+
 // bufferPool implements explicit memory management. It is used for
 // minimizing the GC overhead of communicating with the kernel.
 type bufferPool struct {
@@ -16,10 +45,108 @@ type bufferPool struct {
 
 	// For each page size multiple a list of slice pointers.
 	buffersBySize []*sync.Pool
+
+	// newInput allocates a buffer to read a request into.
+	newInput func() []byte
+	inputs   sync.Pool
+
+	// If bounded, buffers are kept in the free lists below rather
+	// than in the sync.Pools, and pooled is the number of bytes
+	// that they hold. Protected by lock.
+	bounded    bool
+	classes    []int
+	free       [][][]byte
+	freeInputs [][]byte
+	pooled     int64
+	maxPooled  int64
 }
 
 var pageSize = os.Getpagesize()
 
+// init sets up the pool for the given options, which may be nil. It
+// must be called before the pool is used.
+func (p *bufferPool) init(opts *BufferPoolOptions, maxWrite int, newInput func() []byte) {
+	p.newInput = newInput
+	p.inputs.New = func() interface{} { return newInput() }
+	if opts == nil {
+		return
+	}
+
+	p.bounded = true
+	p.maxPooled = opts.MaxPooled
+	p.classes = append([]int(nil), opts.SizeClasses...)
+	sort.Ints(p.classes)
+	if len(p.classes) == 0 {
+		for sz := pageSize; ; sz *= 2 {
+			p.classes = append(p.classes, sz)
+			if sz >= maxWrite {
+				break
+			}
+		}
+	}
+	p.free = make([][][]byte, len(p.classes))
+	for i := 0; i < opts.Prealloc; i++ {
+		p.freeInput(newInput())
+	}
+}
+
+// put adds buf to a free list, unless that exceeds maxPooled. It
+// must be called with lock held.
+func (p *bufferPool) put(list *[][]byte, buf []byte) {
+	if p.maxPooled > 0 && p.pooled+int64(cap(buf)) > p.maxPooled {
+		return
+	}
+	*list = append(*list, buf)
+	p.pooled += int64(cap(buf))
+}
+
+// get takes a buffer from a free list, or returns nil. It must be
+// called with lock held.
+func (p *bufferPool) get(list *[][]byte) []byte {
+	n := len(*list)
+	if n == 0 {
+		return nil
+	}
+	buf := (*list)[n-1]
+	(*list)[n-1] = nil
+	*list = (*list)[:n-1]
+	p.pooled -= int64(cap(buf))
+	return buf
+}
+
+// allocInput returns a buffer to read a request into.
+func (p *bufferPool) allocInput() []byte {
+	if !p.bounded {
+		return p.inputs.Get().([]byte)
+	}
+	p.lock.Lock()
+	buf := p.get(&p.freeInputs)
+	p.lock.Unlock()
+	if buf == nil {
+		buf = p.newInput()
+	}
+	return buf
+}
+
+// freeInput takes back a buffer of allocInput.
+func (p *bufferPool) freeInput(buf []byte) {
+	if !p.bounded {
+		p.inputs.Put(buf)
+		return
+	}
+	p.lock.Lock()
+	p.put(&p.freeInputs, buf)
+	p.lock.Unlock()
+}
+
+// pooledBytes returns the number of bytes held by idle buffers, if
+// the pool is bounded.
+func (p *bufferPool) pooledBytes() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pooled
+}
+
 func (p *bufferPool) getPool(pageCount int) *sync.Pool {
 	p.lock.Lock()
 	for len(p.buffersBySize) < pageCount+1 {
@@ -38,6 +165,9 @@ func (p *bufferPool) getPool(pageCount int) *sync.Pool {
 // AllocBuffer creates a buffer of at least the given size. After use,
 // it should be deallocated with FreeBuffer().
 func (p *bufferPool) AllocBuffer(size uint32) []byte {
+	if p.bounded {
+		return p.allocClass(size)
+	}
 	sz := int(size)
 	if sz < pageSize {
 		sz = pageSize
@@ -52,6 +182,20 @@ func (p *bufferPool) AllocBuffer(size uint32) []byte {
 	return b[:size]
 }
 
+func (p *bufferPool) allocClass(size uint32) []byte {
+	i := sort.SearchInts(p.classes, int(size))
+	if i == len(p.classes) {
+		return make([]byte, size)
+	}
+	p.lock.Lock()
+	b := p.get(&p.free[i])
+	p.lock.Unlock()
+	if b == nil {
+		b = make([]byte, p.classes[i])
+	}
+	return b[:size]
+}
+
 // FreeBuffer takes back a buffer if it was allocated through
 // AllocBuffer.  It is not an error to call FreeBuffer() on a slice
 // obtained elsewhere.
@@ -59,6 +203,15 @@ func (p *bufferPool) FreeBuffer(slice []byte) {
 	if slice == nil {
 		return
 	}
+	if p.bounded {
+		i := sort.SearchInts(p.classes, cap(slice))
+		if i < len(p.classes) && p.classes[i] == cap(slice) {
+			p.lock.Lock()
+			p.put(&p.free[i], slice[:cap(slice)])
+			p.lock.Unlock()
+		}
+		return
+	}
 	if cap(slice)%pageSize != 0 || cap(slice) == 0 {
 		return
 	}
@@ -20,3 +20,47 @@ func TestBufferPool(t *testing.T) {
 	// tried testing to see if we get buf1 back if we ask again,
 	// but it's not guaranteed and sometimes fails
 }
+
+func TestBoundedBufferPool(t *testing.T) {
+	inputs := 0
+	bp := bufferPool{}
+	bp.init(&BufferPoolOptions{
+		Prealloc:    2,
+		SizeClasses: []int{8192, 1024},
+		MaxPooled:   3 * 1024,
+	}, 8192, func() []byte {
+		inputs++
+		return make([]byte, 1024)
+	})
+	if inputs != 2 || bp.pooledBytes() != 2048 {
+		t.Fatalf("preallocated %d inputs of %d bytes, want 2 of 2048", inputs, bp.pooledBytes())
+	}
+	in1, in2, in3 := bp.allocInput(), bp.allocInput(), bp.allocInput()
+	if inputs != 3 || bp.pooledBytes() != 0 {
+		t.Errorf("got %d inputs, %d bytes pooled, want 3 and 0", inputs, bp.pooledBytes())
+	}
+
+	buf := bp.AllocBuffer(1500)
+	if len(buf) != 1500 || cap(buf) != 8192 {
+		t.Errorf("got buffer %d/%d, want 1500/8192", len(buf), cap(buf))
+	}
+	if big := bp.AllocBuffer(10000); len(big) != 10000 {
+		t.Errorf("got buffer of %d bytes, want 10000", len(big))
+	}
+
+	// The 8k buffer exceeds MaxPooled, and is dropped.
+	bp.FreeBuffer(buf)
+	if bp.pooledBytes() != 0 {
+		t.Errorf("pooled %d bytes beyond MaxPooled", bp.pooledBytes())
+	}
+	for _, in := range [][]byte{in1, in2, in3} {
+		bp.freeInput(in)
+	}
+	if bp.pooledBytes() != 3*1024 {
+		t.Errorf("got %d bytes pooled, want %d", bp.pooledBytes(), 3*1024)
+	}
+	bp.FreeBuffer(bp.AllocBuffer(100))
+	if bp.pooledBytes() != 3*1024 {
+		t.Errorf("got %d bytes pooled, want %d", bp.pooledBytes(), 3*1024)
+	}
+}
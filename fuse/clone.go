@@ -0,0 +1,61 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+)
+
+// devClone is a clone of the FUSE device, see
+// MountOptions.DeviceClones. It reads requests of the same
+// connection, but the kernel tracks the requests that it passed out
+// separately, so their replies must be written to it.
+type devClone struct {
+	fd int
+}
+
+// startClones clones the device and starts a reader loop on each
+// clone. The loop on the mount descriptor and the handlers of the
+// Scheduler count against MaxHandlers too.
+func (ms *Server) startClones() {
+	n := ms.opts.DeviceClones
+	ms.reqMu.Lock()
+	if max := ms.opts.MaxHandlers; max > 0 && n > max-ms.handlersLocked() {
+		n = max - ms.handlersLocked()
+	}
+	ms.reqMu.Unlock()
+	for i := 0; i < n; i++ {
+		fd, err := cloneDevice(ms.mountFd)
+		if err != nil {
+			ms.errorf("DeviceClones: clone %d: %v", i, err)
+			break
+		}
+		clone := &devClone{fd: fd}
+		ms.reqMu.Lock()
+		ms.clones = append(ms.clones, clone)
+		ms.reqMu.Unlock()
+		ms.loops.Add(1)
+		go ms.loop(clone, false)
+	}
+}
+
+// closeClones closes the clones, once their loops have exited.
+func (ms *Server) closeClones() {
+	ms.reqMu.Lock()
+	clones := ms.clones
+	ms.clones = nil
+	ms.reqMu.Unlock()
+	for _, c := range clones {
+		syscall.Close(c.fd)
+	}
+}
+
+// devFd returns the descriptor to write the reply to req to.
+func (ms *Server) devFd(req *request) int {
+	if req.clone != nil {
+		return req.clone.fd
+	}
+	return ms.mountFd
+}
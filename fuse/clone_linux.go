@@ -0,0 +1,30 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// _IOR(229, 0, uint32_t)
+const _FUSE_DEV_IOC_CLONE = 0x8004e500
+
+// cloneDevice opens a new FUSE device and attaches it to the
+// connection of fd.
+func cloneDevice(fd int) (int, error) {
+	clone, err := syscall.Open("/dev/fuse", os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	arg := uint32(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(clone),
+		_FUSE_DEV_IOC_CLONE, uintptr(unsafe.Pointer(&arg))); errno != 0 {
+		syscall.Close(clone)
+		return -1, errno
+	}
+	return clone, nil
+}
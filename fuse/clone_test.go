@@ -0,0 +1,109 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestDeviceCloneReply(t *testing.T) {
+	var mount, clone [2]int
+	if err := syscall.Pipe(mount[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(mount[0])
+	defer syscall.Close(mount[1])
+	if err := syscall.Pipe(clone[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(clone[0])
+	defer syscall.Close(clone[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = mount[1]
+
+	// The request is read from the clone, so the reply must go
+	// there too.
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 7}}
+	buf := (*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&in))[:]
+	if _, err := syscall.Write(clone[1], buf); err != nil {
+		t.Fatal(err)
+	}
+	dev := &devClone{fd: clone[0]}
+	req, code := ms.readRequest(dev, false)
+	if !code.Ok() || req == nil {
+		t.Fatalf("readRequest: %v", code)
+	}
+	if req.clone != dev {
+		t.Errorf("request has clone %v, want %v", req.clone, dev)
+	}
+	if ms.reqReaders != 0 || ms.extraLoops != 0 {
+		t.Errorf("got reqReaders %d, extraLoops %d after reading from a clone", ms.reqReaders, ms.extraLoops)
+	}
+
+	// Reply through the write end of the clone pipe.
+	dev.fd = clone[1]
+	ms.handleRequest(req)
+
+	out := make([]byte, 4096)
+	n, err := syscall.Read(clone[0], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < int(sizeOfOutHeader) {
+		t.Fatalf("short reply of %d bytes", n)
+	}
+	if h := (*OutHeader)(unsafe.Pointer(&out[0])); h.Unique != 7 {
+		t.Errorf("got reply to %d, want 7", h.Unique)
+	}
+	if err := syscall.SetNonblock(mount[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := syscall.Read(mount[0], out); err != syscall.EAGAIN {
+		t.Errorf("mount descriptor got %d bytes (%v), want none", n, err)
+	}
+}
+
+func TestDeviceClonesNegative(t *testing.T) {
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{DeviceClones: -1}); err == nil {
+		t.Error("newServer accepted negative DeviceClones")
+	}
+}
+
+func TestDeviceCloneTimedOutReply(t *testing.T) {
+	var mount, clone [2]int
+	if err := syscall.Pipe(mount[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(mount[0])
+	defer syscall.Close(mount[1])
+	if err := syscall.Pipe(clone[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(clone[0])
+	defer syscall.Close(clone[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = mount[1]
+
+	// The EIO of the watchdog goes where the request came from.
+	ms.replyTimedOut(&TimedOutRequest{Unique: 9, opcode: _OP_GETATTR, clone: &devClone{fd: clone[1]}})
+	out := make([]byte, 4096)
+	n, err := syscall.Read(clone[0], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := (*OutHeader)(unsafe.Pointer(&out[0])); n != int(sizeOfOutHeader) || h.Unique != 9 || h.Status != -int32(syscall.EIO) {
+		t.Errorf("got reply %+v of %d bytes, want EIO to 9", h, n)
+	}
+}
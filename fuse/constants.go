@@ -20,6 +20,10 @@ const (
 
 	FUSE_IOCTL_MAX_IOV = 256
 
+	// The kernel accepts at least a page of output for ioctl,
+	// which is where the iovecs of a retry go.
+	ioctlRetrySize = 4096
+
 	FUSE_POLL_SCHEDULE_NOTIFY = (1 << 0)
 
 	CUSE_INIT_INFO_MAX = 4096
@@ -19,6 +19,30 @@ import (
 type Context struct {
 	Caller
 	Cancel <-chan struct{}
+
+	// SuppGroups is set for requests that create files, if the
+	// caller may create them through a supplementary group. See
+	// InHeader.SuppGroups.
+	SuppGroups []uint32
+
+	// KillSuidGid is set for writes, truncating opens and size
+	// changes after which the setuid and setgid bits of the file
+	// should be cleared. It is only set if
+	// MountOptions.EnableKillPriv is set.
+	KillSuidGid bool
+
+	// KillSgid is set for setting POSIX ACLs, after which the
+	// setgid bit of the file should be cleared. It is only set if
+	// MountOptions.EnableSetXAttrExt is set.
+	KillSgid bool
+
+	// Umask is the umask of the caller, for requests that create
+	// files. It is only set if MountOptions.DontUmask is set, as
+	// the kernel has already cleared its bits from the mode
+	// otherwise. The file system should clear them, unless the
+	// mode of the new file is determined by a default POSIX ACL
+	// of the parent directory.
+	Umask uint32
 }
 
 func (c *Context) Deadline() (time.Time, bool) {
@@ -55,7 +79,7 @@ func (c *Context) Value(key interface{}) interface{} {
 	if key == callerKey {
 		return &c.Caller
 	}
-	return nil
+	return requestValue(c.Cancel, key)
 }
 
 var _ = context.Context((*Context)(nil))
@@ -0,0 +1,98 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// DebugFilter restricts the requests that are logged while debugging
+// is on. The zero value logs all requests.
+type DebugFilter struct {
+	// Opcodes lists the names of the opcodes to log, eg. "LOOKUP"
+	// or "NOTIFY_INVAL_ENTRY". If empty, all opcodes are logged.
+	Opcodes []string
+
+	// PathPrefix, if set, logs only the requests for the given
+	// path and its descendants, relative to the mount point, eg.
+	// "dir/sub". Paths are obtained from the file system through
+	// NodePather; if it does not implement that, or the path of
+	// a node is unknown, the request is not logged.
+	PathPrefix string
+}
+
+// NodePather is implemented by file systems that can map node IDs to
+// paths. It is used to filter debug output, see DebugFilter.
+type NodePather interface {
+	// NodePath returns the path of the node relative to the
+	// mount point, or false if it is unknown.
+	NodePath(nodeId uint64) (string, bool)
+}
+
+type debugFilter struct {
+	opcodes    map[string]bool
+	pathPrefix string
+}
+
+// SetDebug switches logging of requests and replies on or off, on a
+// live server. See also MountOptions.Debug and SetDebugFilter.
+func (ms *Server) SetDebug(dbg bool) {
+	var v int32
+	if dbg {
+		v = 1
+	}
+	atomic.StoreInt32(&ms.debug, v)
+}
+
+// SetDebugFilter restricts the requests that SetDebug logs. A nil
+// filter logs all requests.
+func (ms *Server) SetDebugFilter(f *DebugFilter) {
+	df := &debugFilter{}
+	if f != nil {
+		if len(f.Opcodes) > 0 {
+			df.opcodes = map[string]bool{}
+			for _, op := range f.Opcodes {
+				df.opcodes[strings.ToUpper(op)] = true
+			}
+		}
+		df.pathPrefix = strings.Trim(f.PathPrefix, "/")
+	}
+	ms.debugFilter.Store(df)
+}
+
+func (ms *Server) debugEnabled() bool {
+	return atomic.LoadInt32(&ms.debug) != 0
+}
+
+// debugRequest returns whether req should be logged.
+func (ms *Server) debugRequest(req *request) bool {
+	if !ms.debugEnabled() {
+		return false
+	}
+	df, _ := ms.debugFilter.Load().(*debugFilter)
+	if df == nil {
+		return true
+	}
+	if df.opcodes != nil && !df.opcodes[operationName(req.inHeader.Opcode)] {
+		return false
+	}
+	if df.pathPrefix == "" {
+		return true
+	}
+
+	pather, ok := ms.fileSystem.(NodePather)
+	if !ok || req.inHeader.NodeId == 0 {
+		return false
+	}
+	p, ok := pather.NodePath(req.inHeader.NodeId)
+	if !ok {
+		return false
+	}
+	if len(req.filenames) > 0 {
+		p = strings.TrimPrefix(p+"/"+req.filenames[0], "/")
+	}
+	return p == df.pathPrefix || strings.HasPrefix(p, df.pathPrefix+"/")
+}
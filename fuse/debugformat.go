@@ -0,0 +1,174 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DebugFormatter renders the requests and replies that are logged
+// while debugging, see MountOptions.DebugFormatter. The arguments,
+// including their byte slices, are only valid during the call.
+type DebugFormatter interface {
+	FormatRequest(r *RequestInfo) string
+	FormatReply(r *DebugReply) string
+}
+
+// DebugReply is a reply or notification as passed to a DebugFormatter.
+// Notifications have Unique 0.
+type DebugReply struct {
+	Opcode string
+	Unique uint64
+	NodeId uint64
+	Status Status
+
+	// TraceID is the correlation ID of the request, if any.
+	TraceID string
+
+	// Output is the decoded output struct, eg. *EntryOut, or nil.
+	Output interface{}
+
+	// Name is set for replies that carry a file name, such as
+	// READLINK.
+	Name string
+
+	// Data is the payload of the reply, if it is in memory.
+	// DataSize is its size, also for payloads that are spliced
+	// from a file descriptor.
+	Data     []byte
+	DataSize int
+
+	// Latency is the time since the request was read, and Queued
+	// the estimated time it spent in the kernel queue. They are
+	// zero unless requests are timed, eg. with LatencyMap.
+	Latency time.Duration
+	Queued  time.Duration
+}
+
+func (r *request) debugReply() *DebugReply {
+	d := &DebugReply{
+		Opcode:   operationName(r.inHeader.Opcode),
+		Unique:   r.inHeader.Unique,
+		NodeId:   r.inHeader.NodeId,
+		Status:   r.status,
+		TraceID:  r.traceID,
+		DataSize: r.flatDataSize(),
+		Queued:   r.queueLatency,
+	}
+	if r.handler != nil && r.handler.DecodeOut != nil && r.handler.OutputSize > 0 {
+		d.Output = r.handler.DecodeOut(r.outData())
+	}
+	if r.fdData == nil && r.slices == nil {
+		if r.handler != nil && r.handler.FileNameOut {
+			d.Name = strings.TrimRight(string(r.flatData), "\x00")
+		} else {
+			d.Data = r.flatData
+		}
+	}
+	if !r.startTime.IsZero() {
+		d.Latency = time.Since(r.startTime)
+	}
+	return d
+}
+
+// JSONDebugFormatter renders requests and replies as JSON objects,
+// one per line, for machine-parsable traces.
+type JSONDebugFormatter struct {
+	// RedactNames replaces file names, in requests and in
+	// replies, with "<redacted>". Payloads are replaced too, as
+	// they may hold names, eg. directory listings and extended
+	// attribute names; their size is still included.
+	RedactNames bool
+
+	// MaxData is the number of payload bytes to include. If 0,
+	// payloads are left out, and only their size is included.
+	MaxData int
+}
+
+type jsonTrace struct {
+	Dir      string        `json:"dir"`
+	Opcode   string        `json:"op"`
+	Unique   uint64        `json:"unique"`
+	NodeId   uint64        `json:"node"`
+	TraceID  string        `json:"trace_id,omitempty"`
+	Status   string        `json:"status,omitempty"`
+	Input    interface{}   `json:"in,omitempty"`
+	Output   interface{}   `json:"out,omitempty"`
+	Names    []string      `json:"names,omitempty"`
+	Data     string        `json:"data,omitempty"`
+	DataSize int           `json:"size,omitempty"`
+	Latency  time.Duration `json:"latency_ns,omitempty"`
+	Queued   time.Duration `json:"queued_ns,omitempty"`
+}
+
+const redacted = "<redacted>"
+
+func (f *JSONDebugFormatter) data(d []byte) string {
+	if f.RedactNames && f.MaxData > 0 && len(d) > 0 {
+		return redacted
+	}
+	if len(d) > f.MaxData {
+		d = d[:f.MaxData]
+	}
+	return string(d)
+}
+
+func (f *JSONDebugFormatter) marshal(t *jsonTrace) string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Sprintf(`{"dir":%q,"op":%q,"unique":%d,"error":%q}`, t.Dir, t.Opcode, t.Unique, err.Error())
+	}
+	return string(b)
+}
+
+// FormatRequest implements DebugFormatter.
+func (f *JSONDebugFormatter) FormatRequest(r *RequestInfo) string {
+	t := &jsonTrace{
+		Dir:      "rx",
+		Opcode:   r.OpcodeName(),
+		Unique:   r.Header.Unique,
+		NodeId:   r.Header.NodeId,
+		TraceID:  r.TraceID,
+		Input:    r.Input,
+		Names:    r.Names,
+		Data:     f.data(r.Data),
+		DataSize: len(r.Data),
+	}
+	if f.RedactNames && len(r.Names) > 0 {
+		t.Names = make([]string, len(r.Names))
+		for i := range t.Names {
+			t.Names[i] = redacted
+		}
+	}
+	return f.marshal(t)
+}
+
+// FormatReply implements DebugFormatter.
+func (f *JSONDebugFormatter) FormatReply(r *DebugReply) string {
+	t := &jsonTrace{
+		Dir:      "tx",
+		Opcode:   r.Opcode,
+		Unique:   r.Unique,
+		NodeId:   r.NodeId,
+		TraceID:  r.TraceID,
+		Status:   r.Status.String(),
+		Output:   r.Output,
+		Data:     f.data(r.Data),
+		DataSize: r.DataSize,
+		Latency:  r.Latency,
+		Queued:   r.Queued,
+	}
+	if r.Name != "" {
+		name := r.Name
+		if f.RedactNames {
+			name = redacted
+		}
+		t.Names = []string{name}
+	}
+	return f.marshal(t)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/json"
+	"testing"
+	"unsafe"
+)
+
+func TestJSONDebugFormatter(t *testing.T) {
+	in := InHeader{Opcode: _OP_LOOKUP, Unique: 3, NodeId: 1}
+	req := &request{
+		inHeader:  &in,
+		inData:    unsafe.Pointer(&in),
+		handler:   operationHandlers[_OP_LOOKUP],
+		filenames: []string{"secret.txt"},
+	}
+
+	f := &JSONDebugFormatter{RedactNames: true}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(f.FormatRequest(req.info())), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["dir"] != "rx" || got["op"] != "LOOKUP" || got["unique"] != 3.0 || got["node"] != 1.0 {
+		t.Errorf("got %v", got)
+	}
+	if names := got["names"].([]interface{}); len(names) != 1 || names[0] != redacted {
+		t.Errorf("got names %v, want redacted", names)
+	}
+
+	wIn := WriteIn{InHeader: InHeader{Opcode: _OP_WRITE, Unique: 4, NodeId: 2}, Size: 11}
+	req = &request{
+		inHeader: &wIn.InHeader,
+		inData:   unsafe.Pointer(&wIn),
+		handler:  operationHandlers[_OP_WRITE],
+		arg:      []byte("hello world"),
+	}
+	for _, tc := range []struct {
+		max  int
+		data interface{}
+	}{{0, nil}, {5, "hello"}, {100, "hello world"}} {
+		f := &JSONDebugFormatter{MaxData: tc.max}
+		got = nil
+		if err := json.Unmarshal([]byte(f.FormatRequest(req.info())), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["data"] != tc.data || got["size"] != 11.0 {
+			t.Errorf("MaxData %d: got data %v size %v", tc.max, got["data"], got["size"])
+		}
+		if in, ok := got["in"].(map[string]interface{}); !ok || in["Size"] != 11.0 {
+			t.Errorf("MaxData %d: got input %v", tc.max, got["in"])
+		}
+	}
+
+	req.status = EIO
+	got = nil
+	if err := json.Unmarshal([]byte(f.FormatReply(req.debugReply())), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["dir"] != "tx" || got["status"] != EIO.String() || got["unique"] != 4.0 {
+		t.Errorf("reply: got %v", got)
+	}
+
+	// Directory listings hold names.
+	rIn := ReadIn{InHeader: InHeader{Opcode: _OP_READDIR, Unique: 5, NodeId: 1}}
+	req = &request{
+		inHeader: &rIn.InHeader,
+		inData:   unsafe.Pointer(&rIn),
+		handler:  operationHandlers[_OP_READDIR],
+		flatData: []byte("secret.txt"),
+	}
+	f = &JSONDebugFormatter{RedactNames: true, MaxData: 100}
+	got = nil
+	if err := json.Unmarshal([]byte(f.FormatReply(req.debugReply())), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["data"] != redacted || got["size"] != 10.0 {
+		t.Errorf("READDIR: got data %v size %v, want redacted", got["data"], got["size"])
+	}
+}
@@ -30,6 +30,10 @@ func (fs *defaultRawFileSystem) StatFs(cancel <-chan struct{}, header *InHeader,
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) SyncFs(cancel <-chan struct{}, input *SyncFsIn) Status {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) (code Status) {
 	return ENOSYS
 }
@@ -105,6 +109,10 @@ func (fs *defaultRawFileSystem) Create(cancel <-chan struct{}, input *CreateIn,
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status) {
 	return ENOSYS
 }
@@ -167,6 +175,26 @@ func (fs *defaultRawFileSystem) Lseek(cancel <-chan struct{}, in *LseekIn, out *
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Statx(cancel <-chan struct{}, in *StatxIn, out *StatxOut) Status {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Ioctl(cancel <-chan struct{}, in *IoctlIn, out *IoctlOut, bufIn, bufOut []byte) Status {
 	return ENOSYS
 }
+
+func (fs *defaultRawFileSystem) Poll(cancel <-chan struct{}, in *PollIn, out *PollOut) Status {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) Bmap(cancel <-chan struct{}, in *BmapIn, out *BmapOut) Status {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetupMapping(cancel <-chan struct{}, in *SetupMappingIn) Status {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) RemoveMapping(cancel <-chan struct{}, in *RemoveMappingIn, mappings []RemoveMappingOne) Status {
+	return ENOSYS
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// rejectedAfterUnmount returns true if the request must fail with
+// MountOptions.AfterUnmountStatus, because the file system is going
+// away.
+func (ms *Server) rejectedAfterUnmount(req *request) bool {
+	if ms.opts.AfterUnmountStatus.Ok() {
+		return false
+	}
+	if atomic.LoadInt32(&ms.unmounted) == 0 && atomic.LoadInt32(&ms.destroying) == 0 {
+		return false
+	}
+	switch req.inHeader.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_RELEASE, _OP_RELEASEDIR, _OP_DESTROY:
+		return false
+	}
+	return true
+}
+
+// dispatchUndestroyed dispatches req, unless the file system was
+// destroyed already.
+func (ms *Server) dispatchUndestroyed(req *request) {
+	if req.inHeader.Opcode == _OP_DESTROY {
+		// doDestroy waits for the other handlers itself.
+		ms.dispatch(req)
+		return
+	}
+	ms.destroyMu.Lock()
+	if ms.destroyed {
+		ms.destroyMu.Unlock()
+		req.status = ENOTCONN
+		if !ms.opts.AfterUnmountStatus.Ok() {
+			req.status = ms.opts.AfterUnmountStatus
+		}
+		return
+	}
+	ms.dispatched++
+	ms.destroyMu.Unlock()
+
+	ms.dispatch(req)
+
+	ms.destroyMu.Lock()
+	ms.dispatched--
+	if ms.dispatched == 0 && ms.destroyCond != nil {
+		ms.destroyCond.Broadcast()
+	}
+	ms.destroyMu.Unlock()
+}
+
+// destroy calls Destroyer.Destroy once, when no handler runs.
+// Requests are still dispatched while it waits, as a running handler
+// may wait for one of them.
+func (ms *Server) destroy() {
+	ms.destroyMu.Lock()
+	defer ms.destroyMu.Unlock()
+	if ms.destroyed {
+		return
+	}
+	if ms.destroyCond == nil {
+		ms.destroyCond = sync.NewCond(&ms.destroyMu)
+	}
+	for ms.dispatched > 0 {
+		ms.destroyCond.Wait()
+	}
+	if ms.destroyed {
+		return
+	}
+	ms.destroyed = true
+	if d, ok := ms.fileSystem.(Destroyer); ok {
+		d.Destroy()
+	}
+}
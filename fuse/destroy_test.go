@@ -0,0 +1,242 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type destroyFS struct {
+	RawFileSystem
+
+	release   chan struct{}
+	getattrs  int32
+	running   int32
+	destroyed int32
+
+	// Number of GETATTRs that were running when Destroy was
+	// called.
+	runningAtDestroy int32
+}
+
+func (fs *destroyFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	atomic.AddInt32(&fs.getattrs, 1)
+	atomic.AddInt32(&fs.running, 1)
+	defer atomic.AddInt32(&fs.running, -1)
+	if fs.release != nil {
+		<-fs.release
+	}
+	return OK
+}
+
+func (fs *destroyFS) Destroy() {
+	atomic.StoreInt32(&fs.runningAtDestroy, atomic.LoadInt32(&fs.running))
+	atomic.AddInt32(&fs.destroyed, 1)
+}
+
+// serveRequest passes a request without arguments, or a GETATTR, to
+// ms.
+func serveRequest(t *testing.T, ms *Server, opcode uint32, unique uint64) {
+	size := unsafe.Sizeof(InHeader{})
+	if opcode == _OP_GETATTR {
+		size = unsafe.Sizeof(GetAttrIn{})
+	}
+	buf := make([]byte, size)
+	*(*InHeader)(unsafe.Pointer(&buf[0])) = InHeader{Length: uint32(size), Opcode: opcode, NodeId: 1, Unique: unique}
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Error(st)
+		return
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+	ms.handleRequest(req)
+}
+
+// readReplies reads n replies from fd, and returns their status by
+// unique ID.
+func readReplies(t *testing.T, fd int, n int) map[uint64]int32 {
+	replies := map[uint64]int32{}
+	out := make([]byte, 4096)
+	for len(replies) < n {
+		m, err := syscall.Read(fd, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(out[:m]) >= int(unsafe.Sizeof(OutHeader{})) {
+			h := (*OutHeader)(unsafe.Pointer(&out[0]))
+			replies[h.Unique] = h.Status
+			out = out[h.Length:]
+			m -= int(h.Length)
+		}
+		out = out[:cap(out)]
+	}
+	return replies
+}
+
+func TestAfterUnmountStatus(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &destroyFS{RawFileSystem: NewDefaultRawFileSystem()}
+	if _, err := newServer(fs, &MountOptions{AfterUnmountStatus: -1}); err == nil {
+		t.Error("newServer accepted a negative AfterUnmountStatus")
+	}
+	ms, err := newServer(fs, &MountOptions{AfterUnmountStatus: EIO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	serveRequest(t, ms, _OP_GETATTR, 1)
+	atomic.StoreInt32(&ms.unmounted, 1)
+	serveRequest(t, ms, _OP_GETATTR, 2)
+
+	got := readReplies(t, fds[0], 2)
+	if got[1] != 0 {
+		t.Errorf("GETATTR before unmount: got status %d", got[1])
+	}
+	if got[2] != -int32(syscall.EIO) {
+		t.Errorf("GETATTR after unmount: got status %d, want EIO", got[2])
+	}
+	if n := atomic.LoadInt32(&fs.getattrs); n != 1 {
+		t.Errorf("file system got %d GETATTRs, want 1", n)
+	}
+}
+
+func TestDestroyWaitsForHandlers(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &destroyFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+	}
+	ms, err := newServer(fs, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		serveRequest(t, ms, _OP_GETATTR, 1)
+	}()
+	for atomic.LoadInt32(&fs.running) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		defer wg.Done()
+		serveRequest(t, ms, _OP_DESTROY, 2)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&fs.destroyed) != 0 {
+		t.Error("Destroy was called while a GETATTR was running")
+	}
+	close(fs.release)
+	wg.Wait()
+
+	serveRequest(t, ms, _OP_GETATTR, 3)
+	ms.destroy()
+
+	got := readReplies(t, fds[0], 3)
+	if got[1] != 0 || got[2] != 0 {
+		t.Errorf("got replies %v, want OK for GETATTR and DESTROY", got)
+	}
+	if got[3] != -int32(syscall.ENOTCONN) {
+		t.Errorf("GETATTR after DESTROY: got status %d, want ENOTCONN", got[3])
+	}
+	if n := atomic.LoadInt32(&fs.destroyed); n != 1 {
+		t.Errorf("Destroy was called %d times", n)
+	}
+	if n := atomic.LoadInt32(&fs.runningAtDestroy); n != 0 {
+		t.Errorf("%d GETATTRs were running during Destroy", n)
+	}
+	if n := atomic.LoadInt32(&fs.getattrs); n != 1 {
+		t.Errorf("file system got %d GETATTRs, want 1", n)
+	}
+}
+
+// statfsReleaseFS lets the GETATTRs return once a STATFS arrives.
+type statfsReleaseFS struct {
+	destroyFS
+}
+
+func (fs *statfsReleaseFS) StatFs(cancel <-chan struct{}, in *InHeader, out *StatfsOut) Status {
+	close(fs.release)
+	return OK
+}
+
+func TestDestroyDispatchesWhileWaiting(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &statfsReleaseFS{destroyFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+	}}
+	ms, err := newServer(fs, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	go serveRequest(t, ms, _OP_GETATTR, 1)
+	for atomic.LoadInt32(&fs.running) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	destroyed := make(chan struct{})
+	go func() {
+		ms.destroy()
+		close(destroyed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The GETATTR waits for the STATFS, which must not wait for
+	// the destroy.
+	served := make(chan struct{})
+	go func() {
+		serveRequest(t, ms, _OP_STATFS, 2)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("STATFS was held behind the pending destroy")
+	}
+	<-destroyed
+
+	got := readReplies(t, fds[0], 2)
+	if got[1] != 0 || got[2] != 0 {
+		t.Errorf("got replies %v, want OK", got)
+	}
+	if n := atomic.LoadInt32(&fs.runningAtDestroy); n != 0 {
+		t.Errorf("%d GETATTRs were running during Destroy", n)
+	}
+}
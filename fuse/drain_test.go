@@ -0,0 +1,119 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestGracefulUnmountDrain(t *testing.T) {
+	ms, err := newServer(NewDefaultRawFileSystem(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inflight := func() *request {
+		req := ms.reqPool.Get().(*request)
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		return req
+	}
+
+	req := inflight()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ms.returnRequest(req)
+	}()
+	if err := ms.GracefulUnmount(context.Background()); err != nil {
+		t.Errorf("GracefulUnmount: %v", err)
+	}
+	if ms.isShutdown() {
+		t.Error("server still stopped after GracefulUnmount")
+	}
+
+	req = inflight()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = ms.GracefulUnmount(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	select {
+	case <-req.cancel:
+	default:
+		t.Error("request in flight was not interrupted")
+	}
+}
+
+func TestDrainWaitsForReaders(t *testing.T) {
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxHandlers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	ms.mountFd = fds[0]
+	ms.mountPoint = os.TempDir()
+
+	read := make(chan *request, 1)
+	go func() {
+		req, _ := ms.readRequest(nil, false)
+		read <- req
+	}()
+	for {
+		ms.reqMu.Lock()
+		readers := ms.reqReaders
+		ms.reqMu.Unlock()
+		if readers > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ms.reqMu.Lock()
+	ms.shutdown = true
+	ms.reqMu.Unlock()
+	drained := make(chan error, 1)
+	go func() { drained <- ms.drain(context.Background()) }()
+
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned %v while a reader was blocked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stands in for the request that wakeupReader provokes.
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	if _, err := syscall.Write(fds[1], (*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&in))[:]); err != nil {
+		t.Fatal(err)
+	}
+	req := <-read
+	if req == nil {
+		t.Fatal("readRequest failed")
+	}
+	ms.returnRequest(req)
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("drain: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the reader paused")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// OpcodeHandler handles requests for an opcode that go-fuse does not
+// implement, see MountOptions.Extensions. The input is the request
+// payload that follows header, without request extensions. The
+// output is the reply payload that follows the OutHeader; it must
+// stay valid until the reply is sent.
+type OpcodeHandler func(cancel <-chan struct{}, header *InHeader, input []byte) (output []byte, code Status)
+
+// unknownHandler answers opcodes beyond the known ones with ENOSYS,
+// like the known opcodes that are not implemented.
+var unknownHandler = &operationHandler{}
+
+// newExtensions builds the handlers for MountOptions.Extensions.
+func newExtensions(ext map[uint32]OpcodeHandler) (map[uint32]*operationHandler, error) {
+	if len(ext) == 0 {
+		return nil, nil
+	}
+	r := make(map[uint32]*operationHandler, len(ext))
+	for op, f := range ext {
+		if f == nil {
+			return nil, fmt.Errorf("nil handler for opcode %d", op)
+		}
+		if h := getHandler(op); h != nil && h.Func != nil {
+			return nil, fmt.Errorf("opcode %d (%s) is implemented by go-fuse", op, h.Name)
+		}
+		f := f
+		r[op] = &operationHandler{
+			Name: operationName(op),
+			Func: func(s *Server, req *request) {
+				defer func() {
+					if e := recover(); e != nil {
+						req.status = EIO
+						s.errorf("extension for %s recovered, io error: %v\nstacktrace: \n%s", operationName(op), e, string(debug.Stack()))
+					}
+				}()
+				out, code := f(req.cancel, req.inHeader, req.arg)
+				req.status = code
+				if code.Ok() {
+					req.flatData = out
+				}
+			},
+		}
+	}
+	return r, nil
+}
+
+// handler returns the handler for an opcode.
+func (ms *Server) handler(op uint32) *operationHandler {
+	if h := ms.extensions[op]; h != nil {
+		return h
+	}
+	if h := getHandler(op); h != nil {
+		return h
+	}
+	return unknownHandler
+}
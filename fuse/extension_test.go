@@ -0,0 +1,79 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestExtensions(t *testing.T) {
+	echo := func(cancel <-chan struct{}, header *InHeader, input []byte) ([]byte, Status) {
+		return bytes.ToUpper(input), OK
+	}
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		Extensions: map[uint32]OpcodeHandler{_OP_LOOKUP: echo},
+	}); err == nil {
+		t.Errorf("newServer accepted extension for LOOKUP")
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	const opEcho = 200
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		Extensions: map[uint32]OpcodeHandler{opEcho: echo},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	for i, tc := range []struct {
+		opcode  uint32
+		payload string
+		status  Status
+		reply   string
+	}{
+		{opEcho, "hello", OK, "HELLO"},
+		{opEcho + 1, "hello", ENOSYS, ""},
+		{7, "", ENOSYS, ""},
+	} {
+		hdrSz := int(unsafe.Sizeof(InHeader{}))
+		buf := make([]byte, hdrSz+len(tc.payload))
+		copy(buf[hdrSz:], tc.payload)
+		*(*InHeader)(unsafe.Pointer(&buf[0])) = InHeader{Length: uint32(len(buf)), Opcode: tc.opcode, Unique: uint64(i + 1)}
+
+		req := ms.reqPool.Get().(*request)
+		req.setInput(buf)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+
+		out := make([]byte, 4096)
+		n, err := syscall.Read(fds[0], out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := (*OutHeader)(unsafe.Pointer(&out[0]))
+		if hdr.Unique != uint64(i+1) || hdr.Status != -int32(tc.status) || int(hdr.Length) != n {
+			t.Errorf("opcode %d: got header %+v, %d bytes", tc.opcode, hdr, n)
+		}
+		if got := string(out[sizeOfOutHeader:n]); got != tc.reply {
+			t.Errorf("opcode %d: got reply %q, want %q", tc.opcode, got, tc.reply)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fusectl is a client for the Linux fusectl file system,
+// which is usually mounted at /sys/fs/fuse/connections. It lists the
+// live FUSE connections, maps them to their mount points, reads and
+// tunes their queue settings, and aborts connections whose server
+// hangs.
+package fusectl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dir is where the fusectl file system is mounted.
+var Dir = "/sys/fs/fuse/connections"
+
+const mountInfo = "/proc/self/mountinfo"
+
+// Conn is a FUSE connection.
+type Conn struct {
+	// ID is the device number of the connection, and the name of
+	// its directory in Dir.
+	ID uint32
+
+	// Mountpoints lists where the connection is mounted, as seen
+	// from this process. It is empty for connections that are
+	// mounted in other mount namespaces only.
+	Mountpoints []string
+
+	// FsType is the file system type, eg. "fuse.zipfs".
+	FsType string
+
+	// Source is the mount source, eg. the MountOptions.FsName.
+	Source string
+
+	dir string
+}
+
+// Stats are the queue statistics of a connection.
+type Stats struct {
+	// Waiting is the number of requests that are waiting to be
+	// read by the server, or that it is processing.
+	Waiting int
+
+	// MaxBackground is the maximum number of background requests
+	// (eg. readahead and asynchronous writes) in flight.
+	MaxBackground int
+
+	// CongestionThreshold is the number of background requests
+	// at which the kernel considers the connection congested.
+	CongestionThreshold int
+}
+
+// List returns the live FUSE connections, sorted by ID.
+func List() ([]*Conn, error) {
+	f, err := os.Open(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return list(Dir, f)
+}
+
+// ForMountpoint returns the connection mounted at path. It reads
+// the mount table rather than accessing path, so it also works if the
+// server is hung.
+func ForMountpoint(path string) (*Conn, error) {
+	f, err := os.Open(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return forMountpoint(Dir, f, path)
+}
+
+func forMountpoint(ctlDir string, mountinfo io.Reader, path string) (*Conn, error) {
+	path = filepath.Clean(path)
+
+	// Mounts on the same path hide the earlier ones, so the last
+	// one listed is the one that is visible.
+	var found *mountInfoLine
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		if m, ok := parseMountInfo(scanner.Text()); ok && m.mountpoint == path {
+			found = &m
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil || !isFuse(found.fsType) {
+		return nil, fmt.Errorf("fusectl: no FUSE file system mounted at %s", path)
+	}
+	c, err := open(ctlDir, found.dev)
+	if err != nil {
+		return nil, err
+	}
+	c.Mountpoints = []string{path}
+	c.FsType = found.fsType
+	c.Source = found.source
+	return c, nil
+}
+
+func isFuse(fsType string) bool {
+	return fsType == "fuse" || fsType == "fuseblk" ||
+		strings.HasPrefix(fsType, "fuse.") || strings.HasPrefix(fsType, "fuseblk.")
+}
+
+// list reads the connections in ctlDir, and their mount points from
+// mountinfo.
+func list(ctlDir string, mountinfo io.Reader) ([]*Conn, error) {
+	entries, err := ioutil.ReadDir(ctlDir)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[uint32]*Conn{}
+	var conns []*Conn
+	for _, e := range entries {
+		id, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		c := &Conn{ID: uint32(id), dir: filepath.Join(ctlDir, e.Name())}
+		byID[c.ID] = c
+		conns = append(conns, c)
+	}
+
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		m, ok := parseMountInfo(scanner.Text())
+		if !ok || !isFuse(m.fsType) {
+			continue
+		}
+		c := byID[m.dev]
+		if c == nil {
+			continue
+		}
+		c.Mountpoints = append(c.Mountpoints, m.mountpoint)
+		c.FsType = m.fsType
+		c.Source = m.source
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns, nil
+}
+
+type mountInfoLine struct {
+	dev        uint32
+	mountpoint string
+	fsType     string
+	source     string
+}
+
+// parseMountInfo parses a line of /proc/self/mountinfo, see proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(line string) (m mountInfoLine, ok bool) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || sep+2 >= len(fields) {
+		return m, false
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+		return m, false
+	}
+	// The kernel names the connection after its internal device
+	// number, see MKDEV in linux/kdev_t.h.
+	m.dev = major<<20 | minor
+	m.mountpoint = unescapeMountInfo(fields[4])
+	m.fsType = fields[sep+1]
+	m.source = unescapeMountInfo(fields[sep+2])
+	return m, true
+}
+
+// unescapeMountInfo undoes the octal escapes of space, tab, newline
+// and backslash in mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Open returns the connection with the given ID.
+func Open(id uint32) (*Conn, error) {
+	return open(Dir, id)
+}
+
+func open(ctlDir string, id uint32) (*Conn, error) {
+	dir := filepath.Join(ctlDir, strconv.FormatUint(uint64(id), 10))
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &Conn{ID: id, dir: dir}, nil
+}
+
+func (c *Conn) readInt(name string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (c *Conn) writeInt(name string, v int) error {
+	return ioutil.WriteFile(filepath.Join(c.dir, name), []byte(strconv.Itoa(v)+"\n"), 0)
+}
+
+// Waiting returns the number of requests that wait for the server.
+func (c *Conn) Waiting() (int, error) {
+	return c.readInt("waiting")
+}
+
+// Stats reads the queue statistics of the connection.
+func (c *Conn) Stats() (*Stats, error) {
+	var s Stats
+	var err error
+	if s.Waiting, err = c.readInt("waiting"); err != nil {
+		return nil, err
+	}
+	if s.MaxBackground, err = c.readInt("max_background"); err != nil {
+		return nil, err
+	}
+	if s.CongestionThreshold, err = c.readInt("congestion_threshold"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SetMaxBackground changes the maximum number of background
+// requests. This needs CAP_SYS_ADMIN.
+func (c *Conn) SetMaxBackground(n int) error {
+	return c.writeInt("max_background", n)
+}
+
+// SetCongestionThreshold changes the congestion threshold. This
+// needs CAP_SYS_ADMIN.
+func (c *Conn) SetCongestionThreshold(n int) error {
+	return c.writeInt("congestion_threshold", n)
+}
+
+// Abort aborts the connection. Pending and future requests fail
+// with ENOTCONN, and the server reads ENODEV from the device. The
+// mount stays until it is unmounted.
+func (c *Conn) Abort() error {
+	return ioutil.WriteFile(filepath.Join(c.dir, "abort"), []byte("1\n"), 0)
+}
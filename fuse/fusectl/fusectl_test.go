@@ -0,0 +1,116 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fusectl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+40 22 0:45 / /mnt/zip rw,nosuid,nodev,relatime shared:20 - fuse.zipfs zipfs rw,user_id=0,group_id=0
+41 22 0:46 / /mnt/with\040space rw,nosuid,nodev,relatime shared:21 - fuse /dev/fuse rw,user_id=0,group_id=0
+42 22 0:46 / /mnt/bind rw,nosuid,nodev,relatime shared:21 - fuse /dev/fuse rw,user_id=0,group_id=0
+43 40 0:47 / /mnt/zip rw,nosuid,nodev,relatime shared:22 - fuse.other other rw,user_id=0,group_id=0
+44 22 0:48 / /mnt/tmp rw,relatime shared:23 - tmpfs tmpfs rw
+`
+
+func testCtlDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "TestFusectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, waiting := range map[string]string{"45": "3\n", "46": "0\n", "47": "7\n"} {
+		d := filepath.Join(dir, id)
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range map[string]string{
+			"waiting":              waiting,
+			"max_background":       "12\n",
+			"congestion_threshold": "9\n",
+			"abort":                "",
+		} {
+			if err := ioutil.WriteFile(filepath.Join(d, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func TestList(t *testing.T) {
+	dir := testCtlDir(t)
+	defer os.RemoveAll(dir)
+
+	conns, err := list(dir, strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Conn
+	for _, c := range conns {
+		c.dir = ""
+		got = append(got, *c)
+	}
+	want := []Conn{
+		{ID: 45, Mountpoints: []string{"/mnt/zip"}, FsType: "fuse.zipfs", Source: "zipfs"},
+		{ID: 46, Mountpoints: []string{"/mnt/with space", "/mnt/bind"}, FsType: "fuse", Source: "/dev/fuse"},
+		{ID: 47, Mountpoints: []string{"/mnt/zip"}, FsType: "fuse.other", Source: "other"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestForMountpoint(t *testing.T) {
+	dir := testCtlDir(t)
+	defer os.RemoveAll(dir)
+
+	// The later mount on /mnt/zip hides the earlier one.
+	c, err := forMountpoint(dir, strings.NewReader(testMountInfo), "/mnt/zip/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != 47 {
+		t.Errorf("got ID %d, want 47", c.ID)
+	}
+	if _, err := forMountpoint(dir, strings.NewReader(testMountInfo), "/mnt/tmp"); err == nil {
+		t.Errorf("tmpfs mount was accepted")
+	}
+
+	st, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Waiting: 7, MaxBackground: 12, CongestionThreshold: 9}); *st != want {
+		t.Errorf("got stats %+v, want %+v", *st, want)
+	}
+	if err := c.SetMaxBackground(20); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.readInt("max_background"); err != nil || n != 20 {
+		t.Errorf("max_background: got %d, %v, want 20", n, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(c.dir, "abort")); err != nil || len(data) == 0 {
+		t.Errorf("abort was not written: %q, %v", data, err)
+	}
+}
+
+func TestParseMountInfoDevice(t *testing.T) {
+	m, ok := parseMountInfo(`50 22 1:300 / /mnt rw - fuse x rw`)
+	if !ok {
+		t.Fatal("parse failed")
+	}
+	if want := uint32(1<<20 | 300); m.dev != want {
+		t.Errorf("got dev %d, want %d", m.dev, want)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/internal"
+)
+
+// HandOffSaver is implemented by file systems that pass state on to
+// the process taking over the connection with Server.HandOff, such
+// as the node table of the fs package. SaveHandOff is called once
+// the server has stopped serving requests.
+type HandOffSaver interface {
+	SaveHandOff() ([]byte, error)
+}
+
+// HandOffRestorer is implemented by file systems that restore the
+// state saved by HandOffSaver in the process that calls TakeOver. It
+// is called after Init, before any request is served.
+type HandOffRestorer interface {
+	RestoreHandOff(state []byte) error
+}
+
+const (
+	handOffMagic   = 0x46555345 // "FUSE"
+	handOffVersion = 1
+
+	// Limits for the lengths in handOffHeader, so a corrupt
+	// message cannot make us allocate arbitrary amounts of memory.
+	maxHandOffMountPoint = 4096 // PATH_MAX
+	maxHandOffState      = 1 << 30
+)
+
+// handOffHeader starts the hand-off message, and carries the FUSE
+// device along. It is followed by the negotiated InitIn, the mount
+// point and the file system state.
+type handOffHeader struct {
+	Magic         uint32
+	Version       uint32
+	SettingsLen   uint32
+	MountPointLen uint32
+	StateLen      uint64
+}
+
+// HandOff passes the connection to the kernel on to a standby
+// process, which picks it up with TakeOver, for upgrading a daemon
+// without unmounting. The server stops reading requests, waits for
+// the requests in flight like Shutdown, and sends the FUSE device,
+// the settings negotiated with INIT and the state of the file system
+// (see HandOffSaver) over conn. Once the standby process has
+// acknowledged that it serves the mount, Serve returns without
+// unmounting, and Unmount does nothing.
+//
+// If the server cannot be quiesced, or the standby fails to take
+// over, the server resumes serving, and an error is returned.
+func (ms *Server) HandOff(conn *net.UnixConn) error {
+	if err := internal.CheckPeer(conn, ms.opts.AllowedPeerUids); err != nil {
+		return err
+	}
+	return ms.passOn(func() error {
+		return ms.handOff(conn)
+	})
+}
+
+// Checkpoint writes the state of the session to w, for restoring it
+// with Restore in a new process, eg. after exec'ing an upgraded
+// binary. Like HandOff, it stops reading requests and waits for the
+// requests in flight; the state is the same that HandOff sends: the
+// settings negotiated with INIT, the mount point, and the state of
+// the file system, so open files survive the restart. w can be a
+// file, or a memfd that is passed on along with the device.
+//
+// The device is not part of the checkpoint. Checkpoint returns a
+// duplicate of it, which stays open after Serve returns, for passing
+// on to the new process, eg. in exec.Cmd.ExtraFiles. Serve then
+// returns without unmounting, and Unmount does nothing. If the state
+// cannot be written, the server resumes serving, and an error is
+// returned.
+func (ms *Server) Checkpoint(w io.Writer) (*os.File, error) {
+	var dev *os.File
+	err := ms.passOn(func() error {
+		hdr, body, err := ms.handOffMessage()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(hdr, body...)); err != nil {
+			return fmt.Errorf("write state: %v", err)
+		}
+		fd, err := syscall.Dup(ms.mountFd)
+		if err != nil {
+			return fmt.Errorf("dup device: %v", err)
+		}
+		syscall.CloseOnExec(fd)
+		dev = os.NewFile(uintptr(fd), "/dev/fuse")
+		return nil
+	})
+	return dev, err
+}
+
+// passOn quiesces the server, and runs send to pass the connection on
+// to another process. If send fails, the server resumes serving.
+func (ms *Server) passOn(send func() error) error {
+	if ms.vhost != nil {
+		return fmt.Errorf("cannot hand off a virtio-fs server")
+	}
+	if !ms.Shutdown() {
+		return fmt.Errorf("requests are still in flight")
+	}
+	err := send()
+	ms.reqMu.Lock()
+	if err == nil {
+		ms.handedOff = true
+		ms.mountPoint = ""
+	} else {
+		ms.shutdown = false
+	}
+	ms.reqMu.Unlock()
+	atomic.StoreInt32(&ms.flushing, 0)
+	return err
+}
+
+// handOffMessage returns the header and the body of the hand-off
+// message.
+func (ms *Server) handOffMessage() (hdrBytes, body []byte, err error) {
+	var state []byte
+	if s, ok := ms.fileSystem.(HandOffSaver); ok {
+		if state, err = s.SaveHandOff(); err != nil {
+			return nil, nil, fmt.Errorf("save state: %v", err)
+		}
+	}
+
+	settings := ms.KernelSettings()
+	hdr := handOffHeader{
+		Magic:         handOffMagic,
+		Version:       handOffVersion,
+		SettingsLen:   uint32(unsafe.Sizeof(*settings)),
+		MountPointLen: uint32(len(ms.mountPoint)),
+		StateLen:      uint64(len(state)),
+	}
+	hdrBytes = append([]byte(nil), (*[unsafe.Sizeof(handOffHeader{})]byte)(unsafe.Pointer(&hdr))[:]...)
+
+	body = append(body, (*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(settings))[:]...)
+	body = append(body, ms.mountPoint...)
+	body = append(body, state...)
+	return hdrBytes, body, nil
+}
+
+func (ms *Server) handOff(conn *net.UnixConn) error {
+	hdrBytes, body, err := ms.handOffMessage()
+	if err != nil {
+		return err
+	}
+	if err := putFd(conn, hdrBytes, ms.mountFd); err != nil {
+		return fmt.Errorf("send device: %v", err)
+	}
+	if _, err := conn.Write(body); err != nil {
+		return fmt.Errorf("send state: %v", err)
+	}
+
+	var ack [1]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return fmt.Errorf("standby did not take over: %v", err)
+	}
+	return nil
+}
+
+// TakeOver creates a server for the connection that another process
+// passes on with Server.HandOff over conn. The options should match
+// those of the other process. If fs implements HandOffRestorer, it
+// restores the state that the other process saved. TakeOver returns
+// once the other process has stopped serving; call Serve to serve
+// the mount.
+func TakeOver(conn *net.UnixConn, fs RawFileSystem, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := internal.CheckPeer(conn, ms.opts.AllowedPeerUids); err != nil {
+		return nil, err
+	}
+
+	var hdr handOffHeader
+	fd, err := recvHandOffHeader(conn, &hdr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.restore(fd, &hdr, conn); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{1}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("acknowledge: %v", err)
+	}
+	close(ms.ready)
+	ms.loops.Add(1)
+	return ms, nil
+}
+
+// Restore creates a server for the FUSE device fd from the state that
+// Server.Checkpoint wrote to r. The options should match those of the
+// process that wrote the checkpoint. If fs implements
+// HandOffRestorer, it restores the state of the file system. On
+// success, the server owns fd; call Serve to serve the mount.
+func Restore(fd int, r io.Reader, fs RawFileSystem, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr handOffHeader
+	if _, err := io.ReadFull(r, (*[unsafe.Sizeof(handOffHeader{})]byte)(unsafe.Pointer(&hdr))[:]); err != nil {
+		return nil, fmt.Errorf("read checkpoint: %v", err)
+	}
+	if err := ms.restore(fd, &hdr, r); err != nil {
+		return nil, err
+	}
+	close(ms.ready)
+	ms.loops.Add(1)
+	return ms, nil
+}
+
+// restore reads the rest of the hand-off message that starts with
+// hdr from r, and sets up the server to serve the device fd.
+func (ms *Server) restore(fd int, hdr *handOffHeader, r io.Reader) error {
+	if hdr.Magic != handOffMagic || hdr.Version != handOffVersion {
+		return fmt.Errorf("unknown hand-off message %x version %d", hdr.Magic, hdr.Version)
+	}
+	if hdr.SettingsLen != uint32(unsafe.Sizeof(InitIn{})) {
+		return fmt.Errorf("got %d bytes of settings, want %d", hdr.SettingsLen, unsafe.Sizeof(InitIn{}))
+	}
+
+	if hdr.MountPointLen > maxHandOffMountPoint {
+		return fmt.Errorf("mount point of %d bytes exceeds %d", hdr.MountPointLen, maxHandOffMountPoint)
+	}
+	if hdr.StateLen > maxHandOffState {
+		return fmt.Errorf("state of %d bytes exceeds %d", hdr.StateLen, maxHandOffState)
+	}
+
+	body := make([]byte, hdr.SettingsLen+hdr.MountPointLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fmt.Errorf("receive state: %v", err)
+	}
+	// The state is read as it arrives rather than allocated up
+	// front, so a length beyond the end of r fails without
+	// allocating it.
+	state, err := ioutil.ReadAll(io.LimitReader(r, int64(hdr.StateLen)))
+	if err != nil {
+		return fmt.Errorf("receive state: %v", err)
+	}
+	if uint64(len(state)) != hdr.StateLen {
+		return fmt.Errorf("got %d bytes of state, want %d", len(state), hdr.StateLen)
+	}
+	ms.kernelSettings = *(*InitIn)(unsafe.Pointer(&body[0]))
+	ms.mountPoint = string(body[hdr.SettingsLen:])
+
+	syscall.CloseOnExec(fd)
+	ms.mountFd = fd
+	if ms.kernelSettings.Minor >= 13 {
+		ms.setSplice()
+	}
+	ms.fileSystem.Init(ms)
+	if rs, ok := ms.fileSystem.(HandOffRestorer); ok {
+		if err := rs.RestoreHandOff(state); err != nil {
+			return fmt.Errorf("restore state: %v", err)
+		}
+	}
+	return nil
+}
+
+// recvHandOffHeader reads the header and the device descriptor. It
+// reads no further, so the rest of the message can be read from conn.
+func recvHandOffHeader(conn *net.UnixConn, hdr *handOffHeader) (int, error) {
+	f, err := conn.File()
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+
+	buf := (*[unsafe.Sizeof(handOffHeader{})]byte)(unsafe.Pointer(hdr))[:]
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := syscall.Recvmsg(int(f.Fd()), buf, oob, 0)
+	if err != nil {
+		return -1, fmt.Errorf("receive device: %v", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return -1, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return -1, fmt.Errorf("got %d descriptors, want 1", len(fds))
+	}
+	if n < len(buf) {
+		if _, err := io.ReadFull(conn, buf[n:]); err != nil {
+			syscall.Close(fds[0])
+			return -1, err
+		}
+	}
+	return fds[0], nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+type handOffFS struct {
+	RawFileSystem
+	state    string
+	restored string
+}
+
+func (fs *handOffFS) SaveHandOff() ([]byte, error) {
+	return []byte(fs.state), nil
+}
+
+func (fs *handOffFS) RestoreHandOff(state []byte) error {
+	fs.restored = string(state)
+	return nil
+}
+
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandOff(t *testing.T) {
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	oldFS := &handOffFS{RawFileSystem: NewDefaultRawFileSystem(), state: "node table"}
+	old, err := newServer(oldFS, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.mountFd = pipe[1]
+	old.mountPoint = "/mnt/test"
+	old.kernelSettings = InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: CAP_ASYNC_READ}
+
+	// A standby that goes away does not take over.
+	c1, c2 := unixConnPair(t)
+	c2.Close()
+	if err := old.HandOff(c1); err == nil {
+		t.Fatal("HandOff succeeded without standby")
+	}
+	c1.Close()
+	if old.shutdown || old.handedOff {
+		t.Fatalf("server did not resume: shutdown %v handed off %v", old.shutdown, old.handedOff)
+	}
+
+	c1, c2 = unixConnPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	newFS := &handOffFS{RawFileSystem: NewDefaultRawFileSystem()}
+	type result struct {
+		ms  *Server
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ms, err := TakeOver(c2, newFS, &MountOptions{})
+		done <- result{ms, err}
+	}()
+	if err := old.HandOff(c1); err != nil {
+		t.Fatalf("HandOff: %v", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("TakeOver: %v", res.err)
+	}
+	ms := res.ms
+	defer syscall.Close(ms.mountFd)
+
+	if !old.handedOff || old.mountPoint != "" {
+		t.Errorf("old server: handed off %v, mount point %q", old.handedOff, old.mountPoint)
+	}
+	if ms.mountPoint != "/mnt/test" {
+		t.Errorf("got mount point %q", ms.mountPoint)
+	}
+	if got := ms.KernelSettings(); *got != old.kernelSettings {
+		t.Errorf("got settings %+v, want %+v", got, old.kernelSettings)
+	}
+	if newFS.restored != "node table" {
+		t.Errorf("got state %q", newFS.restored)
+	}
+
+	// The new server writes to the same device.
+	if _, err := syscall.Write(ms.mountFd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if n, err := syscall.Read(pipe[0], buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("got %q, %v", buf[:n], err)
+	}
+
+	// The old serve loop exits without reading.
+	if req, code := old.readRequest(nil, false); req != nil || !code.Ok() {
+		t.Errorf("readRequest after hand-off: %v, %v", req, code)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pipe[0])
+
+	oldFS := &handOffFS{RawFileSystem: NewDefaultRawFileSystem(), state: "node table"}
+	old, err := newServer(oldFS, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.mountFd = pipe[1]
+	old.mountPoint = "/mnt/test"
+	old.kernelSettings = InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: CAP_ASYNC_READ}
+
+	var buf bytes.Buffer
+	dev, err := old.Checkpoint(&buf)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if !old.handedOff || old.mountPoint != "" {
+		t.Errorf("old server: handed off %v, mount point %q", old.handedOff, old.mountPoint)
+	}
+
+	// A truncated checkpoint is rejected.
+	fd, err := syscall.Dup(int(dev.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(fd, bytes.NewReader(buf.Bytes()[:buf.Len()-1]), NewDefaultRawFileSystem(), &MountOptions{}); err == nil {
+		t.Error("Restore accepted truncated checkpoint")
+	}
+	syscall.Close(fd)
+
+	newFS := &handOffFS{RawFileSystem: NewDefaultRawFileSystem()}
+	fd, err = syscall.Dup(int(dev.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+	ms, err := Restore(fd, &buf, newFS, &MountOptions{})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	defer syscall.Close(ms.mountFd)
+
+	if ms.mountPoint != "/mnt/test" {
+		t.Errorf("got mount point %q", ms.mountPoint)
+	}
+	if got := ms.KernelSettings(); *got != old.kernelSettings {
+		t.Errorf("got settings %+v, want %+v", got, old.kernelSettings)
+	}
+	if newFS.restored != "node table" {
+		t.Errorf("got state %q", newFS.restored)
+	}
+
+	// The restored server writes to the same device, also once the
+	// old one closed its descriptor.
+	syscall.Close(pipe[1])
+	if _, err := syscall.Write(ms.mountFd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 10)
+	if n, err := syscall.Read(pipe[0], out); err != nil || string(out[:n]) != "hello" {
+		t.Errorf("got %q, %v", out[:n], err)
+	}
+}
+
+func TestRestoreCorruptHeader(t *testing.T) {
+	settings := uint32(unsafe.Sizeof(InitIn{}))
+	for _, hdr := range []handOffHeader{
+		{SettingsLen: settings, MountPointLen: 1 << 31},
+		{SettingsLen: settings, StateLen: 1 << 62},
+		// Within the limits, but beyond the end of the input.
+		{SettingsLen: settings, MountPointLen: 4, StateLen: 1 << 20},
+	} {
+		hdr.Magic = handOffMagic
+		hdr.Version = handOffVersion
+		buf := append([]byte(nil), (*[unsafe.Sizeof(handOffHeader{})]byte)(unsafe.Pointer(&hdr))[:]...)
+		buf = append(buf, make([]byte, settings)...)
+		buf = append(buf, "/mnt"...)
+		if _, err := Restore(-1, bytes.NewReader(buf), NewDefaultRawFileSystem(), &MountOptions{}); err == nil {
+			t.Errorf("Restore accepted %+v", hdr)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"unsafe"
+)
+
+// Interceptor wraps the handling of requests, for features that cut
+// across all operations, such as auditing, rate limiting or access
+// checks. See MountOptions.Interceptors.
+//
+// An Interceptor calls next to pass the request on to the next
+// interceptor, or to the file system, and returns the status of the
+// reply, usually the one that next returned. It may also answer the
+// request itself by returning an error status without calling next.
+// It must not return OK if next was not called or failed, because
+// the reply would then have no output. Interceptors are called
+// concurrently.
+type Interceptor func(r *RequestInfo, next func() Status) Status
+
+// RequestInfo describes a request to a DebugFormatter, an Interceptor
+// or the Priority function of a Scheduler. Its fields, including
+// their byte slices, are only valid during the call.
+type RequestInfo struct {
+	// Cancel is closed if the request is interrupted.
+	Cancel <-chan struct{}
+
+	Header *InHeader
+
+	// TraceID is the correlation ID of the request, if any, see
+	// MountOptions.TraceIDs.
+	TraceID string
+
+	// Input is the decoded input struct, eg. *LookupIn, or nil.
+	Input interface{}
+
+	// Names are the file names of the request, eg. the name to
+	// look up.
+	Names []string
+
+	// Data is the payload of the request that is not a file
+	// name, eg. the data of a WRITE.
+	Data []byte
+}
+
+// OpcodeName returns the name of the operation, eg. "LOOKUP".
+func (r *RequestInfo) OpcodeName() string {
+	return operationName(r.Header.Opcode)
+}
+
+// Size returns the number of bytes of data that the request moves:
+// the size of a READ, or the data of a WRITE, and 0 otherwise.
+func (r *RequestInfo) Size() int {
+	switch r.Header.Opcode {
+	case _OP_READ:
+		if in, ok := r.Input.(*ReadIn); ok {
+			return int(in.Size)
+		}
+	case _OP_WRITE:
+		return int(r.Header.Length) - int(unsafe.Sizeof(WriteIn{}))
+	}
+	return 0
+}
+
+// info returns the description of req that is passed to debug
+// formatters and interceptors.
+func (r *request) info() *RequestInfo {
+	i := &RequestInfo{
+		Cancel:  r.cancel,
+		Header:  r.inHeader,
+		TraceID: r.traceID,
+		Names:   r.filenames,
+	}
+	if r.handler != nil && r.handler.DecodeIn != nil {
+		i.Input = r.handler.DecodeIn(r.inData)
+	}
+	if len(r.filenames) == 0 {
+		i.Data = r.arg
+	}
+	return i
+}
+
+// dispatch hands req to its handler, through the interceptors.
+func (ms *Server) dispatch(req *request) {
+	chain := ms.opts.Interceptors
+	if len(chain) == 0 {
+		req.handler.Func(ms, req)
+		return
+	}
+	switch req.inHeader.Opcode {
+	case _OP_INIT, _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_NOTIFY_REPLY:
+		// These have no reply, so an interceptor could not
+		// answer them, and dropping them would leak inodes or
+		// hang the kernel.
+		req.handler.Func(ms, req)
+		return
+	}
+
+	r := req.info()
+	var call func(i int) Status
+	call = func(i int) Status {
+		if i == len(chain) {
+			req.handler.Func(ms, req)
+			return req.status
+		}
+		return chain[i](r, func() Status { return call(i + 1) })
+	}
+	req.status = call(0)
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+type lookupCountFS struct {
+	RawFileSystem
+	lookups int
+	forgets int
+}
+
+func (fs *lookupCountFS) Forget(nodeid, nlookup uint64) {
+	fs.forgets++
+}
+
+func (fs *lookupCountFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	fs.lookups++
+	return OK
+}
+
+func TestInterceptors(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	var trace []string
+	fs := &lookupCountFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{
+		Interceptors: []Interceptor{
+			func(r *RequestInfo, next func() Status) Status {
+				trace = append(trace, "outer "+r.OpcodeName())
+				code := next()
+				trace = append(trace, "outer done "+code.String())
+				return code
+			},
+			func(r *RequestInfo, next func() Status) Status {
+				if r.Names[0] == "secret" {
+					return EACCES
+				}
+				trace = append(trace, "inner "+r.Names[0])
+				return next()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	lookup := func(name string) *OutHeader {
+		hdr := InHeader{Opcode: _OP_LOOKUP, NodeId: 1, Unique: 1}
+		buf := make([]byte, unsafe.Sizeof(hdr), int(unsafe.Sizeof(hdr))+len(name)+1)
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+		hdr.Length = uint32(len(buf))
+		*(*InHeader)(unsafe.Pointer(&buf[0])) = hdr
+
+		req := ms.reqPool.Get().(*request)
+		req.setInput(buf)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+
+		out := make([]byte, 4096)
+		if _, err := syscall.Read(fds[0], out); err != nil {
+			t.Fatal(err)
+		}
+		h := *(*OutHeader)(unsafe.Pointer(&out[0]))
+		return &h
+	}
+
+	if h := lookup("file"); h.Status != 0 {
+		t.Errorf("lookup file: got status %d", h.Status)
+	}
+	if h := lookup("secret"); h.Status != -int32(syscall.EACCES) {
+		t.Errorf("lookup secret: got status %d, want EACCES", h.Status)
+	}
+	if fs.lookups != 1 {
+		t.Errorf("file system got %d lookups, want 1", fs.lookups)
+	}
+
+	forget := ForgetIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(ForgetIn{})), Opcode: _OP_FORGET, NodeId: 1, Unique: 2}, Nlookup: 1}
+	req := ms.reqPool.Get().(*request)
+	req.setInput((*[unsafe.Sizeof(ForgetIn{})]byte)(unsafe.Pointer(&forget))[:])
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+	ms.handleRequest(req)
+	if fs.forgets != 1 {
+		t.Errorf("file system got %d forgets, want 1", fs.forgets)
+	}
+
+	want := []string{
+		"outer LOOKUP", "inner file", "outer done OK",
+		"outer LOOKUP", "outer done " + EACCES.String(),
+	}
+	if len(trace) != len(want) {
+		t.Fatalf("got %q, want %q", trace, want)
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Errorf("trace[%d] = %q, want %q", i, trace[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"time"
+)
+
+// RequestTiming describes where a request spent its time.
+type RequestTiming struct {
+	// Arrival is the time the request was read from the kernel.
+	Arrival time.Time
+
+	// Handler is the time from arrival until the reply was
+	// written, ie. the time spent in the file system.
+	Handler time.Duration
+
+	// Queue estimates how long the request waited in the kernel
+	// before it was read. It is zero for requests delivered
+	// through io_uring or virtio-fs.
+	Queue time.Duration
+}
+
+// TimingMap may be implemented by the LatencyMap passed to
+// RecordLatencies, to also receive the kernel queue latency of each
+// request. AddTiming is called after Add.
+type TimingMap interface {
+	LatencyMap
+	AddTiming(name string, t *RequestTiming)
+}
+
+// queueEmptyReadTime is how long a read from /dev/fuse must take
+// before we consider it to have found the queue empty.
+const queueEmptyReadTime = 50 * time.Microsecond
+
+// queueClock estimates how long requests waited in the kernel. The
+// kernel hands out unique IDs in the order requests are queued, and
+// /dev/fuse returns them in that order. A read that blocks found the
+// queue empty, so the request it returns was queued about when the
+// read returned. Requests with a higher unique were queued after
+// that, which bounds the wait of requests read without blocking.
+// It is protected by Server.reqMu.
+type queueClock struct {
+	emptyUnique uint64
+	emptyAt     time.Time
+}
+
+// estimate returns the queue latency of the request with the given
+// unique ID, read in the interval [start, arrival].
+func (c *queueClock) estimate(unique uint64, opcode uint32, start, arrival time.Time) time.Duration {
+	if opcode == _OP_INTERRUPT {
+		// Interrupts are read before other requests, and
+		// reuse the unique of the request they interrupt.
+		return 0
+	}
+	if c.emptyAt.IsZero() || arrival.Sub(start) >= queueEmptyReadTime {
+		if unique > c.emptyUnique {
+			c.emptyUnique = unique
+			c.emptyAt = arrival
+		}
+		return 0
+	}
+	if d := arrival.Sub(c.emptyAt); d > 0 {
+		return d
+	}
+	return 0
+}
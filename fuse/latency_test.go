@@ -0,0 +1,40 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueClock(t *testing.T) {
+	var c queueClock
+	t0 := time.Unix(1000, 0)
+	ms := time.Millisecond
+
+	// The first read blocked: the queue was empty.
+	if got := c.estimate(2, _OP_LOOKUP, t0, t0.Add(10*ms)); got != 0 {
+		t.Errorf("blocked read: got %v", got)
+	}
+	// The next ones return at once, so they were queued after
+	// unique 2 and before the read started.
+	if got := c.estimate(4, _OP_GETATTR, t0.Add(13*ms), t0.Add(13*ms)); got != 3*ms {
+		t.Errorf("queued read: got %v, want 3ms", got)
+	}
+	if got := c.estimate(6, _OP_GETATTR, t0.Add(15*ms), t0.Add(15*ms)); got != 5*ms {
+		t.Errorf("queued read: got %v, want 5ms", got)
+	}
+	// Interrupts jump the queue.
+	if got := c.estimate(5, _OP_INTERRUPT, t0.Add(16*ms), t0.Add(16*ms)); got != 0 {
+		t.Errorf("interrupt: got %v", got)
+	}
+	// The queue ran empty again.
+	if got := c.estimate(8, _OP_LOOKUP, t0.Add(16*ms), t0.Add(20*ms)); got != 0 {
+		t.Errorf("blocked read: got %v", got)
+	}
+	if got := c.estimate(10, _OP_LOOKUP, t0.Add(21*ms), t0.Add(21*ms)); got != 1*ms {
+		t.Errorf("queued read: got %v, want 1ms", got)
+	}
+}
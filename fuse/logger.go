@@ -0,0 +1,152 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger receives the output of the server: traces of requests and
+// replies while debugging, and the errors it encounters. It is
+// implemented by *slog.Logger, so servers can route FUSE traces into
+// their existing logging pipeline:
+//
+//	opts.Logger = slog.Default()
+//
+// The arguments alternate between keys and values, as for slog.
+// Requests are logged as "fuse request", and replies as "fuse
+// reply", at debug level, with these attributes:
+//
+//	op       the opcode, eg. "LOOKUP"
+//	unique   the unique ID of the request
+//	node     the node ID
+//	size     bytes of input, or of output for replies
+//	in       decoded input of requests, if any
+//	status   status of replies
+//	out      decoded output of replies, if any
+//	latency  time since the request was read, for replies
+//	queued   estimated time in the kernel queue, for replies
+//
+// With MountOptions.DebugFormatter, the in, names and out attributes
+// are replaced by "trace", holding the formatted request or reply.
+//
+// Notifications are logged as replies with unique ID 0.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// logRequest logs a request that is being debugged.
+func (ms *Server) logRequest(req *request) {
+	l := ms.opts.Logger
+	f := ms.opts.DebugFormatter
+	if l == nil {
+		if f != nil {
+			log.Println(f.FormatRequest(req.info()))
+		} else {
+			log.Println(req.InputDebug())
+		}
+		return
+	}
+	args := []interface{}{
+		"op", operationName(req.inHeader.Opcode),
+		"unique", req.inHeader.Unique,
+		"node", req.inHeader.NodeId,
+		"size", len(req.inputBuf),
+	}
+	if req.traceID != "" {
+		args = append(args, "trace_id", req.traceID)
+	}
+	if f != nil {
+		args = append(args, "trace", f.FormatRequest(req.info()))
+	} else {
+		if req.handler != nil && req.handler.DecodeIn != nil {
+			args = append(args, "in", Print(req.handler.DecodeIn(req.inData)))
+		}
+		if len(req.filenames) > 0 {
+			args = append(args, "names", req.filenames)
+		}
+	}
+	l.Debug("fuse request", args...)
+}
+
+// logReply logs the reply to a request that is being debugged.
+func (ms *Server) logReply(req *request) {
+	l := ms.opts.Logger
+	f := ms.opts.DebugFormatter
+	if l == nil {
+		if f != nil {
+			log.Println(f.FormatReply(req.debugReply()))
+		} else {
+			log.Println(req.OutputDebug())
+		}
+		return
+	}
+	size := req.flatDataSize()
+	if req.status.Ok() && req.handler != nil {
+		size += int(req.handler.OutputSize)
+	}
+	args := []interface{}{
+		"op", operationName(req.inHeader.Opcode),
+		"unique", req.inHeader.Unique,
+		"node", req.inHeader.NodeId,
+		"status", req.status.String(),
+		"size", size,
+	}
+	if req.traceID != "" {
+		args = append(args, "trace_id", req.traceID)
+	}
+	if f != nil {
+		args = append(args, "trace", f.FormatReply(req.debugReply()))
+	} else if req.handler != nil && req.handler.DecodeOut != nil && req.handler.OutputSize > 0 {
+		args = append(args, "out", Print(req.handler.DecodeOut(req.outData())))
+	}
+	if !req.startTime.IsZero() {
+		args = append(args, "latency", time.Since(req.startTime), "queued", req.queueLatency)
+	}
+	l.Debug("fuse reply", args...)
+}
+
+// debugf logs a debugging message.
+func (ms *Server) debugf(format string, args ...interface{}) {
+	ms.opts.debugf(format, args...)
+}
+
+// debugf logs a debugging message to the Logger of o, eg. while
+// mounting, before there is a Server.
+func (o *MountOptions) debugf(format string, args ...interface{}) {
+	if l := o.Logger; l != nil {
+		l.Debug(fmt.Sprintf(format, args...))
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// infof logs an informational message, eg. on the progress of a
+// shutdown.
+func (ms *Server) infof(format string, args ...interface{}) {
+	if l := ms.opts.Logger; l != nil {
+		l.Info(fmt.Sprintf(format, args...))
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// errorf logs an error.
+func (ms *Server) errorf(format string, args ...interface{}) {
+	ms.opts.errorf(format, args...)
+}
+
+// errorf logs an error to the Logger of o, eg. while mounting.
+func (o *MountOptions) errorf(format string, args ...interface{}) {
+	if l := o.Logger; l != nil {
+		l.Error(fmt.Sprintf(format, args...))
+	} else {
+		log.Printf(format, args...)
+	}
+}
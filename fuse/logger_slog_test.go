@@ -0,0 +1,12 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package fuse
+
+import "log/slog"
+
+var _ Logger = (*slog.Logger)(nil)
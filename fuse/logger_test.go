@@ -0,0 +1,79 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type logEntry struct {
+	level, msg string
+	attrs      map[string]interface{}
+}
+
+type recordLogger struct {
+	entries []logEntry
+}
+
+func (l *recordLogger) log(level, msg string, args []interface{}) {
+	e := logEntry{level: level, msg: msg, attrs: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.attrs[args[i].(string)] = args[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+func TestLogger(t *testing.T) {
+	logger := &recordLogger{}
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ms.timed() {
+		t.Error("requests are not timed with a Logger")
+	}
+
+	in := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 42, NodeId: 7}}
+	req := &request{
+		inHeader:  &in.InHeader,
+		inData:    unsafe.Pointer(&in),
+		inputBuf:  make([]byte, unsafe.Sizeof(in)),
+		handler:   operationHandlers[_OP_GETATTR],
+		startTime: time.Now(),
+	}
+	ms.logRequest(req)
+	req.status = ENOENT
+	ms.logReply(req)
+	ms.errorf("failed: %d", 1)
+
+	if len(logger.entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(logger.entries))
+	}
+	for i, e := range logger.entries[:2] {
+		if e.level != "debug" || e.attrs["op"] != "GETATTR" || e.attrs["unique"] != uint64(42) || e.attrs["node"] != uint64(7) {
+			t.Errorf("entry %d: got %v", i, e)
+		}
+	}
+	if e := logger.entries[0]; e.msg != "fuse request" || e.attrs["size"] != int(unsafe.Sizeof(in)) {
+		t.Errorf("request: got %v", e)
+	}
+	reply := logger.entries[1]
+	if reply.msg != "fuse reply" || reply.attrs["status"] != ENOENT.String() || reply.attrs["size"] != 0 {
+		t.Errorf("reply: got %v", reply)
+	}
+	if _, ok := reply.attrs["latency"].(time.Duration); !ok {
+		t.Errorf("reply has no latency: %v", reply)
+	}
+	if e := logger.entries[2]; e.level != "error" || e.msg != fmt.Sprintf("failed: %d", 1) {
+		t.Errorf("error: got %v", e)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram
+// buckets of OpMetrics.
+var LatencyBuckets = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// OpMetrics are the counters of one opcode, see Server.Metrics.
+type OpMetrics struct {
+	// Requests is the number of requests.
+	Requests uint64
+
+	// Errors is the number of replies with an error status.
+	Errors uint64
+
+	// BytesIn is the number of bytes read from the kernel,
+	// including headers, and BytesOut the number written to it.
+	BytesIn  uint64
+	BytesOut uint64
+
+	// LatencyCount is the number of requests in the latency
+	// histogram, and LatencySum their total latency. Requests
+	// without a reply, like FORGET, are not included.
+	LatencyCount uint64
+	LatencySum   time.Duration
+
+	// Buckets[i] is the number of requests that took at most
+	// LatencyBuckets[i], and more than LatencyBuckets[i-1]. The
+	// last element counts the requests that took longer than all
+	// buckets.
+	Buckets []uint64
+}
+
+// Histogram returns the latency histogram in the form that
+// Prometheus' MustNewConstHistogram takes: the count, the sum in
+// seconds, and the cumulative count for each upper bound in seconds.
+func (m *OpMetrics) Histogram() (count uint64, sum float64, buckets map[float64]uint64) {
+	buckets = make(map[float64]uint64, len(LatencyBuckets))
+	var total uint64
+	for i, b := range LatencyBuckets {
+		if i < len(m.Buckets) {
+			total += m.Buckets[i]
+		}
+		buckets[b.Seconds()] = total
+	}
+	return m.LatencyCount, m.LatencySum.Seconds(), buckets
+}
+
+// MetricsCollector receives every finished request, eg. to feed
+// metrics that are not kept by Server.Metrics. See
+// MountOptions.MetricsCollector. It is called concurrently.
+type MetricsCollector interface {
+	// CollectRequest is called after the reply to a request is
+	// written. The latency is zero for requests without a reply.
+	CollectRequest(op string, status Status, bytesIn, bytesOut int, latency time.Duration)
+}
+
+// opStats holds the counters of an opcode. They are updated
+// atomically.
+type opStats struct {
+	requests     uint64
+	errors       uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	latencyCount uint64
+	latencySum   uint64
+	buckets      []uint64
+}
+
+type serverMetrics struct {
+	ops []*opStats
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{ops: make([]*opStats, _OPCODE_COUNT)}
+	for i := range m.ops {
+		m.ops[i] = &opStats{buckets: make([]uint64, len(LatencyBuckets)+1)}
+	}
+	return m
+}
+
+// replySize returns the number of bytes written to the kernel for req.
+func replySize(req *request) int {
+	switch req.inHeader.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_NOTIFY_REPLY:
+		return 0
+	case _OP_INTERRUPT:
+		if req.status.Ok() {
+			return 0
+		}
+	}
+	n := int(sizeOfOutHeader)
+	if req.status.Ok() && req.handler != nil {
+		n += int(req.handler.OutputSize) + req.flatDataSize()
+	}
+	return n
+}
+
+// collectMetrics records a finished request.
+func (ms *Server) collectMetrics(req *request) {
+	if ms.metrics == nil && ms.opts.MetricsCollector == nil {
+		return
+	}
+	op := req.inHeader.Opcode
+	in := len(req.inputBuf)
+	out := replySize(req)
+	var latency time.Duration
+	if !req.startTime.IsZero() && out > 0 {
+		latency = time.Since(req.startTime)
+	}
+	errored := req.status != OK && !(op == _OP_INTERRUPT && req.status == EAGAIN)
+
+	if m := ms.metrics; m != nil && op < _OPCODE_COUNT {
+		s := m.ops[op]
+		atomic.AddUint64(&s.requests, 1)
+		if errored {
+			atomic.AddUint64(&s.errors, 1)
+		}
+		atomic.AddUint64(&s.bytesIn, uint64(in))
+		atomic.AddUint64(&s.bytesOut, uint64(out))
+		if latency > 0 {
+			i := 0
+			for i < len(LatencyBuckets) && latency > LatencyBuckets[i] {
+				i++
+			}
+			atomic.AddUint64(&s.buckets[i], 1)
+			atomic.AddUint64(&s.latencyCount, 1)
+			atomic.AddUint64(&s.latencySum, uint64(latency))
+		}
+	}
+	if c := ms.opts.MetricsCollector; c != nil {
+		c.CollectRequest(operationName(op), req.status, in, out, latency)
+	}
+}
+
+// Metrics returns the counters of each opcode that was seen, by
+// name, eg. "LOOKUP". It returns nil unless MountOptions.EnableMetrics
+// is set. The counters are cumulative since the server started.
+func (ms *Server) Metrics() map[string]OpMetrics {
+	if ms.metrics == nil {
+		return nil
+	}
+	r := map[string]OpMetrics{}
+	for op, s := range ms.metrics.ops {
+		n := atomic.LoadUint64(&s.requests)
+		if n == 0 {
+			continue
+		}
+		m := OpMetrics{
+			Requests:     n,
+			Errors:       atomic.LoadUint64(&s.errors),
+			BytesIn:      atomic.LoadUint64(&s.bytesIn),
+			BytesOut:     atomic.LoadUint64(&s.bytesOut),
+			LatencyCount: atomic.LoadUint64(&s.latencyCount),
+			LatencySum:   time.Duration(atomic.LoadUint64(&s.latencySum)),
+			Buckets:      make([]uint64, len(s.buckets)),
+		}
+		for i := range s.buckets {
+			m.Buckets[i] = atomic.LoadUint64(&s.buckets[i])
+		}
+		r[operationName(uint32(op))] = m
+	}
+	return r
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type countCollector struct {
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func (c *countCollector) CollectRequest(op string, status Status, bytesIn, bytesOut int, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[op]++
+}
+
+func TestMetrics(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	collector := &countCollector{seen: map[string]int{}}
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		EnableMetrics:    true,
+		MetricsCollector: collector,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	if !ms.timed() {
+		t.Error("requests are not timed with metrics")
+	}
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1}}
+	for i := 0; i < 2; i++ {
+		in.Unique = uint64(i + 1)
+		buf := make([]byte, in.Length)
+		*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+		req := ms.reqPool.Get().(*request)
+		req.setInput(buf)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		req.startTime = time.Now()
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+
+		out := make([]byte, 4096)
+		if _, err := syscall.Read(fds[0], out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, ok := ms.Metrics()["GETATTR"]
+	if !ok {
+		t.Fatalf("no GETATTR metrics in %v", ms.Metrics())
+	}
+	if m.Requests != 2 || m.Errors != 2 || m.BytesIn != 2*uint64(in.Length) || m.BytesOut != 2*uint64(sizeOfOutHeader) {
+		t.Errorf("got %+v", m)
+	}
+	count, _, buckets := m.Histogram()
+	if count != 2 || buckets[LatencyBuckets[len(LatencyBuckets)-1].Seconds()] != 2 {
+		t.Errorf("got histogram count %d, buckets %v", count, buckets)
+	}
+	if collector.seen["GETATTR"] != 2 {
+		t.Errorf("collector saw %v", collector.seen)
+	}
+}
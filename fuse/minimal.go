@@ -0,0 +1,36 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+// NewMinimalServer is like NewServer, but it only mounts and
+// unmounts with the mount and umount2 system calls, and does not use
+// splice. The server then runs no other binaries and needs no pipes,
+// which suits scratch containers and initramfs images, where
+// fusermount is missing. Mounting requires CAP_SYS_ADMIN. Linux
+// only.
+//
+// Building with the fuse_minimal tag leaves fusermount, /bin/mount
+// and splice out of the binary altogether, and makes NewServer
+// behave like NewMinimalServer. With CGO_ENABLED=0, the result is a
+// static binary without runtime dependencies:
+//
+//	CGO_ENABLED=0 go build -tags fuse_minimal
+func NewMinimalServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	o := MountOptions{
+		MaxBackground: _DEFAULT_BACKGROUND_TASKS,
+	}
+	if opts != nil {
+		o = *opts
+	}
+	o.DirectMountStrict = true
+	o.SpliceWrite = false
+
+	ms, err := NewServer(fs, mountPoint, &o)
+	if err != nil {
+		return nil, err
+	}
+	ms.noSplice = true
+	return ms, nil
+}
@@ -7,26 +7,34 @@
 package fuse
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"reflect"
 	"syscall"
 	"time"
 	"unsafe"
 )
 
+var notifyNames = []string{
+	"OK",
+	"NOTIFY_POLL",
+	"NOTIFY_INVAL_INODE",
+	"NOTIFY_INVAL_ENTRY",
+	"NOTIFY_STORE_CACHE",
+	"NOTIFY_RETRIEVE_CACHE",
+	"NOTIFY_DELETE",
+	"NOTIFY_RESEND",
+}
+
 func (code Status) String() string {
 	if code <= 0 {
-		return []string{
-			"OK",
-			"NOTIFY_POLL",
-			"NOTIFY_INVAL_INODE",
-			"NOTIFY_INVAL_ENTRY",
-			"NOTIFY_STORE_CACHE",
-			"NOTIFY_RETRIEVE_CACHE",
-			"NOTIFY_DELETE",
-		}[-code]
+		// Raw notifications may carry codes newer than ours.
+		if n := -int(code); n < len(notifyNames) {
+			return notifyNames[n]
+		}
+		return fmt.Sprintf("NOTIFY_%d", -int(code))
 	}
 	return fmt.Sprintf("%d=%v", int(code), syscall.Errno(code))
 }
@@ -35,9 +43,19 @@ func (code Status) Ok() bool {
 	return code == OK
 }
 
-// ToStatus extracts an errno number from Go error objects.  If it
-// fails, it logs an error and returns ENOSYS.
+// ToStatus extracts an errno number from Go error objects. The
+// errors of a canceled context give EINTR and ETIMEDOUT, also when
+// they are wrapped, so handlers can return the error of a call that
+// was aborted because the request was interrupted. If it fails, it
+// logs an error and returns ENOSYS.
 func ToStatus(err error) Status {
+	if errors.Is(err, context.Canceled) {
+		return EINTR
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Status(syscall.ETIMEDOUT)
+	}
+
 	switch err {
 	case nil:
 		return OK
@@ -66,12 +84,7 @@ func ToStatus(err error) Status {
 }
 
 func toSlice(dest *[]byte, ptr unsafe.Pointer, byteCount uintptr) {
-	h := (*reflect.SliceHeader)(unsafe.Pointer(dest))
-	*h = reflect.SliceHeader{
-		Data: uintptr(ptr),
-		Len:  int(byteCount),
-		Cap:  int(byteCount),
-	}
+	*dest = (*[1 << 30]byte)(ptr)[:byteCount:byteCount]
 }
 
 func CurrentOwner() *Owner {
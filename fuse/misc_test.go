@@ -5,9 +5,15 @@
 package fuse
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"unsafe"
 )
 
 func TestToStatus(t *testing.T) {
@@ -27,4 +33,879 @@ func TestToStatus(t *testing.T) {
 	if errNo != ENOENT {
 		t.Errorf("Wrong conversion %v != %v", errNo, syscall.ENOENT)
 	}
+
+	if errNo = ToStatus(context.Canceled); errNo != EINTR {
+		t.Errorf("Wrong conversion %v != %v", errNo, syscall.EINTR)
+	}
+	if errNo = ToStatus(context.DeadlineExceeded); errNo != Status(syscall.ETIMEDOUT) {
+		t.Errorf("Wrong conversion %v != %v", errNo, syscall.ETIMEDOUT)
+	}
+	if errNo = ToStatus(fmt.Errorf("backend: %w", context.Canceled)); errNo != EINTR {
+		t.Errorf("Wrong conversion %v != %v", errNo, syscall.EINTR)
+	}
+}
+
+type countGetAttrFS struct {
+	RawFileSystem
+	calls int
+}
+
+func (fs *countGetAttrFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	fs.calls++
+	return OK
+}
+
+func TestInterruptedBeforeDispatch(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &countGetAttrFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 3}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	// The kernel interrupts the request before a handler picks it
+	// up.
+	intr := &request{inData: unsafe.Pointer(&InterruptIn{Unique: 3})}
+	doInterrupt(ms, intr)
+	if !intr.status.Ok() {
+		t.Fatalf("doInterrupt: %v", intr.status)
+	}
+	ms.handleRequest(req)
+
+	out := make([]byte, 4096)
+	if _, err := syscall.Read(fds[0], out); err != nil {
+		t.Fatal(err)
+	}
+	if h := (*OutHeader)(unsafe.Pointer(&out[0])); h.Unique != 3 || h.Status != -int32(syscall.EINTR) {
+		t.Errorf("got reply %+v, want EINTR for 3", h)
+	}
+	if fs.calls != 0 {
+		t.Errorf("file system was called %d times for interrupted request", fs.calls)
+	}
+}
+
+func TestNotifyStatusString(t *testing.T) {
+	if got := Status(NOTIFY_RESEND).String(); got != "NOTIFY_RESEND" {
+		t.Errorf("got %q, want NOTIFY_RESEND", got)
+	}
+	if got := Status(-8).String(); got != "NOTIFY_8" {
+		t.Errorf("got %q, want NOTIFY_8", got)
+	}
+}
+
+func TestRequestHeader(t *testing.T) {
+	in := &CreateIn{
+		InHeader: InHeader{
+			Length: 80,
+			Opcode: _OP_CREATE,
+			Caller: Caller{Owner: Owner{Uid: 1, Gid: 2}, Pid: 3},
+		},
+	}
+	// total_extlen occupies the first two bytes of the header
+	// padding.
+	*(*uint16)(unsafe.Pointer(&in.InHeader.Padding)) = 2
+
+	var h RequestHeader = in
+	if h.CallerUid() != 1 || h.CallerGid() != 2 || h.CallerPid() != 3 {
+		t.Errorf("got caller %d/%d/%d, want 1/2/3", h.CallerUid(), h.CallerGid(), h.CallerPid())
+	}
+	if got := h.OpcodeName(); got != "CREATE" {
+		t.Errorf("got opcode %q, want CREATE", got)
+	}
+	if got := h.RequestLength(); got != 80 {
+		t.Errorf("got length %d, want 80", got)
+	}
+	if got := h.ExtensionLength(); got != 16 {
+		t.Errorf("got extension length %d, want 16", got)
+	}
+}
+
+func TestSuppGroups(t *testing.T) {
+	name := "dir\x00"
+	hdrSize := int(unsafe.Sizeof(MkdirIn{}))
+	buf := make([]byte, hdrSize+len(name)+16)
+	in := (*MkdirIn)(unsafe.Pointer(&buf[0]))
+	in.Length = uint32(len(buf))
+	in.Opcode = _OP_MKDIR
+	*(*uint16)(unsafe.Pointer(&in.InHeader.Padding)) = 2
+	copy(buf[hdrSize:], name)
+
+	ext := buf[hdrSize+len(name):]
+	*(*fuseExtHeader)(unsafe.Pointer(&ext[0])) = fuseExtHeader{Size: 16, Type: _FUSE_EXT_GROUPS}
+	*(*uint32)(unsafe.Pointer(&ext[8])) = 1
+	*(*uint32)(unsafe.Pointer(&ext[12])) = 1234
+
+	if got := in.SuppGroups(); len(got) != 1 || got[0] != 1234 {
+		t.Errorf("got groups %v, want [1234]", got)
+	}
+
+	req := &request{}
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatalf("parseHeader: %v", st)
+	}
+	req.parse(InitIn{})
+	if !req.status.Ok() {
+		t.Fatalf("parse: %v", req.status)
+	}
+	if len(req.filenames) != 1 || req.filenames[0] != "dir" {
+		t.Errorf("got names %q, want [\"dir\"]", req.filenames)
+	}
+}
+
+func TestResendNotify(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	ms.kernelSettings = InitIn{Major: 7, Minor: 40}
+	if st := ms.ResendNotify(); st != ENOSYS {
+		t.Errorf("without CAP_HAS_RESEND: got %v, want ENOSYS", st)
+	}
+
+	ms.kernelSettings.Flags = CAP_INIT_EXT
+	ms.kernelSettings.Flags2 = uint32(CAP_HAS_RESEND >> 32)
+	if st := ms.ResendNotify(); !st.Ok() {
+		t.Fatalf("ResendNotify: %v", st)
+	}
+	buf := make([]byte, 64)
+	n, err := syscall.Read(fds[0], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := (*OutHeader)(unsafe.Pointer(&buf[0]))
+	if n != int(sizeOfOutHeader) || out.Length != uint32(sizeOfOutHeader) || out.Status != -NOTIFY_RESEND || out.Unique != 0 {
+		t.Errorf("got %d bytes, header %+v", n, out)
+	}
+}
+
+func TestMaxStackDepth(t *testing.T) {
+	for _, opts := range []MountOptions{
+		{MaxStackDepth: 3, EnablePassthrough: true},
+		{MaxStackDepth: -1, EnablePassthrough: true},
+		{MaxStackDepth: 2},
+	} {
+		if _, err := newServer(NewDefaultRawFileSystem(), &opts); err == nil {
+			t.Errorf("newServer accepted %+v", opts)
+		}
+	}
+
+	for _, tc := range []struct {
+		depth  int
+		kernel uint64
+		want   uint32
+	}{
+		{0, CAP_PASSTHROUGH, 1},
+		{2, CAP_PASSTHROUGH, 2},
+		{2, 0, 0},
+	} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxStackDepth: tc.depth, EnablePassthrough: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{
+			Major:  _FUSE_KERNEL_VERSION,
+			Minor:  40,
+			Flags:  CAP_INIT_EXT,
+			Flags2: uint32(tc.kernel >> 32),
+		}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		if !req.status.Ok() {
+			t.Fatalf("doInit: %v", req.status)
+		}
+		if got := (*InitOut)(req.outData()).MaxStackDepth; got != tc.want {
+			t.Errorf("depth %d, kernel flags %x: got MaxStackDepth %d, want %d", tc.depth, tc.kernel, got, tc.want)
+		}
+	}
+}
+
+func TestDisableDirFlags(t *testing.T) {
+	kernel := uint32(CAP_READDIRPLUS | CAP_READDIRPLUS_AUTO | CAP_PARALLEL_DIROPS)
+	for _, tc := range []struct {
+		opts MountOptions
+		want uint32
+	}{
+		{MountOptions{ReadDirPlusAuto: true}, kernel},
+		{MountOptions{ReadDirPlusAuto: true, DisableReadDirPlus: true}, CAP_PARALLEL_DIROPS},
+		{MountOptions{DisableParallelDirOps: true}, CAP_READDIRPLUS},
+	} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: kernel}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		if got := (*InitOut)(req.outData()).Flags & kernel; got != tc.want {
+			t.Errorf("%+v: got flags %x, want %x", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestCheckOpenFlags(t *testing.T) {
+	ms := &Server{}
+	for _, minor := range []uint32{34, 35, 37, 38} {
+		ms.kernelSettings = InitIn{Major: 7, Minor: minor}
+		out := OpenOut{OpenFlags: FOPEN_DIRECT_IO | FOPEN_NOFLUSH | FOPEN_PARALLEL_DIRECT_WRITES}
+		ms.checkOpenFlags(&out)
+		want := uint32(FOPEN_DIRECT_IO)
+		if minor >= 35 {
+			want |= FOPEN_NOFLUSH
+		}
+		if minor >= 38 {
+			want |= FOPEN_PARALLEL_DIRECT_WRITES
+		}
+		if out.OpenFlags != want {
+			t.Errorf("minor %d: got flags %x, want %x", minor, out.OpenFlags, want)
+		}
+	}
+}
+
+func TestVerifyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		unique   uint64
+		status   Status
+		flatData []byte
+		ok       bool
+	}{
+		{"reply", 1, OK, []byte("data"), true},
+		{"error", 1, ENOENT, nil, true},
+		{"notify", 0, NOTIFY_INVAL_INODE, nil, true},
+		{"error with payload", 1, EIO, []byte("data"), false},
+		{"reply without unique", 0, OK, nil, false},
+	} {
+		req := &request{
+			inHeader: &InHeader{Unique: tc.unique, Opcode: _OP_READ},
+			handler:  operationHandlers[_OP_READ],
+			status:   tc.status,
+			flatData: tc.flatData,
+		}
+		header := req.serializeHeader(req.flatDataSize())
+		if err := req.verifyHeader(header); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+
+	req := &request{
+		inHeader: &InHeader{Unique: 1, Opcode: _OP_READ},
+		handler:  operationHandlers[_OP_READ],
+	}
+	header := req.serializeHeader(0)
+	(*OutHeader)(unsafe.Pointer(&header[0])).Length++
+	if err := req.verifyHeader(header); err == nil {
+		t.Errorf("wrong length was accepted")
+	}
+}
+
+type pathFS struct {
+	RawFileSystem
+	paths map[uint64]string
+}
+
+func (fs *pathFS) NodePath(id uint64) (string, bool) {
+	p, ok := fs.paths[id]
+	return p, ok
+}
+
+func TestDebugFilter(t *testing.T) {
+	fs := &pathFS{NewDefaultRawFileSystem(), map[uint64]string{1: "", 2: "dir", 3: "dir/sub", 4: "dirx"}}
+	ms, err := newServer(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := func(op uint32, node uint64, names ...string) *request {
+		return &request{inHeader: &InHeader{Opcode: op, NodeId: node}, filenames: names}
+	}
+	if ms.debugRequest(req(_OP_GETATTR, 1)) {
+		t.Errorf("logged while debugging is off")
+	}
+	ms.SetDebug(true)
+	if !ms.debugRequest(req(_OP_GETATTR, 1)) {
+		t.Errorf("not logged without filter")
+	}
+
+	ms.SetDebugFilter(&DebugFilter{Opcodes: []string{"lookup"}, PathPrefix: "/dir/"})
+	for _, tc := range []struct {
+		req  *request
+		want bool
+	}{
+		{req(_OP_LOOKUP, 1, "dir"), true},
+		{req(_OP_LOOKUP, 1, "dirx"), false},
+		{req(_OP_LOOKUP, 2, "file"), true},
+		{req(_OP_LOOKUP, 3, "file"), true},
+		{req(_OP_LOOKUP, 4, "file"), false},
+		{req(_OP_LOOKUP, 5, "file"), false},
+		{req(_OP_GETATTR, 3), false},
+	} {
+		if got := ms.debugRequest(tc.req); got != tc.want {
+			t.Errorf("%s n%d %q: got %v, want %v", operationName(tc.req.inHeader.Opcode),
+				tc.req.inHeader.NodeId, tc.req.filenames, got, tc.want)
+		}
+	}
+
+	ms.SetDebugFilter(nil)
+	if !ms.debugRequest(req(_OP_GETATTR, 5)) {
+		t.Errorf("not logged after clearing filter")
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{WriteQueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	ms.startWriteQueue()
+
+	const N = 3
+	for i := 1; i <= N; i++ {
+		in := InHeader{Length: uint32(unsafe.Sizeof(InHeader{})), Opcode: _OP_STATFS, Unique: uint64(i)}
+		req := ms.reqPool.Get().(*request)
+		req.setInput((*[unsafe.Sizeof(InHeader{})]byte)(unsafe.Pointer(&in))[:])
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+	}
+	ms.stopWriteQueue()
+
+	buf := make([]byte, 4096)
+	n, err := syscall.Read(fds[0], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != N*int(sizeOfOutHeader) {
+		t.Fatalf("got %d bytes, want %d", n, N*sizeOfOutHeader)
+	}
+	for i := 0; i < N; i++ {
+		out := (*OutHeader)(unsafe.Pointer(&buf[i*int(sizeOfOutHeader)]))
+		if out.Unique != uint64(i+1) || out.Status != -int32(ENOSYS) {
+			t.Errorf("reply %d: got %+v", i, out)
+		}
+	}
+	if st := ms.WriteQueueStats(); st.Written != N || st.Queued != 0 {
+		t.Errorf("got stats %+v", st)
+	}
+	if len(ms.reqInflight) != 0 {
+		t.Errorf("%d requests still in flight", len(ms.reqInflight))
+	}
+}
+
+func TestBackgroundLimits(t *testing.T) {
+	for _, opts := range []MountOptions{
+		{MaxBackground: -1},
+		{MaxBackground: 1 << 16},
+		{CongestionThreshold: 1 << 16},
+	} {
+		if _, err := newServer(NewDefaultRawFileSystem(), &opts); err == nil {
+			t.Errorf("newServer accepted %+v", opts)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts                MountOptions
+		maxBackground       uint16
+		congestionThreshold uint16
+	}{
+		{MountOptions{}, 0, 0},
+		{MountOptions{MaxBackground: 100}, 100, 75},
+		{MountOptions{MaxBackground: 100, CongestionThreshold: 90}, 100, 90},
+	} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		out := (*InitOut)(req.outData())
+		if out.MaxBackground != tc.maxBackground || out.CongestionThreshold != tc.congestionThreshold {
+			t.Errorf("%+v: got %d/%d, want %d/%d", tc.opts, out.MaxBackground, out.CongestionThreshold,
+				tc.maxBackground, tc.congestionThreshold)
+		}
+	}
+}
+
+func TestNotifyPollWakeup(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	ms.kernelSettings = InitIn{Major: 7, Minor: 31}
+	if st := ms.NotifyPollWakeup(42); !st.Ok() {
+		t.Fatalf("NotifyPollWakeup: %v", st)
+	}
+
+	buf := make([]byte, 64)
+	n, err := syscall.Read(fds[0], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := (*OutHeader)(unsafe.Pointer(&buf[0]))
+	want := int(sizeOfOutHeader + unsafe.Sizeof(NotifyPollWakeupOut{}))
+	if n != want || out.Status != -NOTIFY_POLL || out.Unique != 0 {
+		t.Errorf("got %d bytes, header %+v", n, out)
+	}
+	if kh := (*NotifyPollWakeupOut)(unsafe.Pointer(&buf[sizeOfOutHeader])).Kh; kh != 42 {
+		t.Errorf("got kh %d, want 42", kh)
+	}
+}
+
+type retryIoctlFS struct {
+	RawFileSystem
+}
+
+func (fs *retryIoctlFS) Ioctl(cancel <-chan struct{}, in *IoctlIn, out *IoctlOut, bufIn, bufOut []byte) Status {
+	return out.SetRetry(bufOut,
+		[]IoctlIovec{{Base: in.Arg, Len: 16}},
+		[]IoctlIovec{{Base: in.Arg + 16, Len: 8}})
+}
+
+func TestIoctlRetry(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(&retryIoctlFS{NewDefaultRawFileSystem()}, &MountOptions{EnableIoctl: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	for i, in := range []IoctlIn{
+		{Flags: FUSE_IOCTL_UNRESTRICTED},
+		{OutSize: 64},
+	} {
+		in.InHeader = InHeader{Length: uint32(unsafe.Sizeof(IoctlIn{})), Opcode: _OP_IOCTL, Unique: uint64(i + 1)}
+		in.Cmd = 0x1234
+		in.Arg = 0x1000
+		req := ms.reqPool.Get().(*request)
+		req.setInput((*[unsafe.Sizeof(IoctlIn{})]byte)(unsafe.Pointer(&in))[:])
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := syscall.Read(fds[0], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iovSz := int(unsafe.Sizeof(IoctlIovec{}))
+	want := int(sizeOfOutHeader+unsafe.Sizeof(IoctlOut{})) + 2*iovSz
+	if n < want {
+		t.Fatalf("got %d bytes, want at least %d", n, want)
+	}
+	hdr := (*OutHeader)(unsafe.Pointer(&buf[0]))
+	if hdr.Status != 0 || int(hdr.Length) != want {
+		t.Fatalf("got header %+v, want length %d", hdr, want)
+	}
+	out := (*IoctlOut)(unsafe.Pointer(&buf[sizeOfOutHeader]))
+	if out.Flags != FUSE_IOCTL_RETRY || out.InIovs != 1 || out.OutIovs != 1 {
+		t.Errorf("got %+v", out)
+	}
+	iovs := buf[sizeOfOutHeader+unsafe.Sizeof(IoctlOut{}):]
+	if got := *(*IoctlIovec)(unsafe.Pointer(&iovs[iovSz])); got != (IoctlIovec{Base: 0x1010, Len: 8}) {
+		t.Errorf("got out iovec %+v", got)
+	}
+
+	// Restricted ioctls cannot be retried.
+	hdr = (*OutHeader)(unsafe.Pointer(&buf[want]))
+	if hdr.Unique != 2 || hdr.Status != -int32(EIO) {
+		t.Errorf("restricted retry: got %+v", hdr)
+	}
+
+	if st := (&IoctlOut{}).SetRetry(nil, []IoctlIovec{{}}, nil); st != EINVAL {
+		t.Errorf("SetRetry without room: got %v", st)
+	}
+}
+
+func TestBlockDeviceOptions(t *testing.T) {
+	for _, opts := range []MountOptions{
+		{BlockSize: 4096},
+		{BlockDevice: "/dev/loop0", BlockSize: 256},
+		{BlockDevice: "/dev/loop0", BlockSize: 1000},
+		{BlockDevice: "/dev/loop0", BlockSize: 2 * os.Getpagesize()},
+	} {
+		if _, err := newServer(NewDefaultRawFileSystem(), &opts); err == nil {
+			t.Errorf("newServer accepted %+v", opts)
+		}
+	}
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		FsName:      "ignored",
+		BlockDevice: "/dev/loop0",
+		BlockSize:   1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(ms.opts.optionsStrings(), ",")
+	for _, want := range []string{"blkdev", "fsname=/dev/loop0", "blksize=1024"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("options %q lack %q", got, want)
+		}
+	}
+	if strings.Contains(got, "ignored") {
+		t.Errorf("options %q contain FsName", got)
+	}
+}
+
+func TestReadDirPlusAuto(t *testing.T) {
+	for _, tc := range []struct {
+		opts   MountOptions
+		kernel uint32
+		want   uint32
+	}{
+		{MountOptions{}, CAP_READDIRPLUS | CAP_READDIRPLUS_AUTO, CAP_READDIRPLUS},
+		{MountOptions{ReadDirPlusAuto: true}, CAP_READDIRPLUS | CAP_READDIRPLUS_AUTO, CAP_READDIRPLUS | CAP_READDIRPLUS_AUTO},
+		{MountOptions{ReadDirPlusAuto: true}, CAP_READDIRPLUS, CAP_READDIRPLUS},
+	} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: tc.kernel}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		out := (*InitOut)(req.outData())
+		if got := out.Flags & (CAP_READDIRPLUS | CAP_READDIRPLUS_AUTO); got != tc.want {
+			t.Errorf("%+v, kernel %x: got flags %x, want %x", tc.opts, tc.kernel, got, tc.want)
+		}
+	}
+}
+
+type mappingFS struct {
+	RawFileSystem
+	removed []RemoveMappingOne
+}
+
+func (fs *mappingFS) RemoveMapping(cancel <-chan struct{}, in *RemoveMappingIn, mappings []RemoveMappingOne) Status {
+	fs.removed = mappings
+	return OK
+}
+
+func TestDAXMapping(t *testing.T) {
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MapAlignment: 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: CAP_MAP_ALIGNMENT}
+	req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+	doInit(ms, req)
+	out := (*InitOut)(req.outData())
+	if out.Flags&CAP_MAP_ALIGNMENT == 0 || out.MapAlignment != 21 {
+		t.Errorf("got flags %x alignment %d, want MAP_ALIGNMENT and 21", out.Flags, out.MapAlignment)
+	}
+
+	fs := &mappingFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err = newServer(fs, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The kernel sends the count right after the header, and the
+	// entries right after the count.
+	want := []RemoveMappingOne{{Moffset: 0, Len: 1 << 21}, {Moffset: 4 << 21, Len: 2 << 21}}
+	removeMapping := func(count uint32, entries []RemoveMappingOne) *request {
+		msg := make([]byte, 44+16*len(entries))
+		*(*InHeader)(unsafe.Pointer(&msg[0])) = InHeader{Length: uint32(len(msg)), Opcode: _OP_REMOVEMAPPING, Unique: 1}
+		binary.LittleEndian.PutUint32(msg[40:], count)
+		for i, m := range entries {
+			binary.LittleEndian.PutUint64(msg[44+16*i:], m.Moffset)
+			binary.LittleEndian.PutUint64(msg[52+16*i:], m.Len)
+		}
+		req := &request{}
+		req.setInput(msg)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		req.parse(InitIn{})
+		doRemoveMapping(ms, req)
+		return req
+	}
+	if req := removeMapping(uint32(len(want)), want); req.status != OK || !reflect.DeepEqual(fs.removed, want) {
+		t.Errorf("got %v %v, want %v", req.status, fs.removed, want)
+	}
+	if req := removeMapping(3, want); req.status != EINVAL {
+		t.Errorf("short payload: got %v, want EINVAL", req.status)
+	}
+}
+
+func TestSubmountsNegotiation(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{EnableSubmounts: enable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 32, Flags: CAP_SUBMOUNTS}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		out := (*InitOut)(req.outData())
+		if got := out.Flags&CAP_SUBMOUNTS != 0; got != enable {
+			t.Errorf("EnableSubmounts %v: got SUBMOUNTS %v", enable, got)
+		}
+	}
+}
+
+func TestAtomicTruncNegotiation(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{EnableAtomicTrunc: enable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: CAP_ATOMIC_O_TRUNC}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		out := (*InitOut)(req.outData())
+		if got := out.Flags&CAP_ATOMIC_O_TRUNC != 0; got != enable {
+			t.Errorf("EnableAtomicTrunc %v: got ATOMIC_O_TRUNC %v", enable, got)
+		}
+	}
+}
+
+type openCountFS struct {
+	RawFileSystem
+	opens int
+}
+
+func (fs *openCountFS) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	fs.opens++
+	return OK
+}
+
+func (fs *openCountFS) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	fs.opens++
+	return OK
+}
+
+func TestNoOpen(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		fs := &openCountFS{RawFileSystem: NewDefaultRawFileSystem()}
+		ms, err := newServer(fs, &MountOptions{NoOpen: enable, NoOpendir: enable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := InitIn{Major: _FUSE_KERNEL_VERSION, Minor: 31, Flags: CAP_NO_OPEN_SUPPORT | CAP_NO_OPENDIR_SUPPORT}
+		req := &request{inData: unsafe.Pointer(&in), handler: operationHandlers[_OP_INIT]}
+		doInit(ms, req)
+		out := (*InitOut)(req.outData())
+		if got := out.Flags&CAP_NO_OPENDIR_SUPPORT != 0; got != enable {
+			t.Errorf("NoOpendir %v: got NO_OPENDIR_SUPPORT %v", enable, got)
+		}
+
+		for _, op := range []uint32{_OP_OPEN, _OP_OPENDIR} {
+			openIn := OpenIn{}
+			req := &request{inData: unsafe.Pointer(&openIn), handler: operationHandlers[op]}
+			req.handler.Func(ms, req)
+			want := OK
+			if enable {
+				want = ENOSYS
+			}
+			if req.status != want {
+				t.Errorf("NoOpen %v, %s: got %v, want %v", enable, operationName(op), req.status, want)
+			}
+		}
+		if want := map[bool]int{false: 2, true: 0}[enable]; fs.opens != want {
+			t.Errorf("NoOpen %v: file system saw %d opens, want %d", enable, fs.opens, want)
+		}
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxHandlers: -1}); err == nil {
+		t.Error("negative MaxHandlers was accepted")
+	}
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxReaders: 7, MaxHandlers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.maxReaders != 7 {
+		t.Errorf("got maxReaders %d, want 7", ms.maxReaders)
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	ms.mountFd = fds[0]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	if _, err := syscall.Write(fds[1], (*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&in))[:]); err != nil {
+		t.Fatal(err)
+	}
+	req, code := ms.readRequest(nil, false)
+	if !code.Ok() || req == nil {
+		t.Fatalf("readRequest: %v", code)
+	}
+	if ms.extraLoops != 0 {
+		t.Errorf("started %d readers beyond MaxHandlers", ms.extraLoops)
+	}
+}
+
+func TestSchedulerMaxHandlers(t *testing.T) {
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxHandlers: 1, Scheduler: &SchedulerOptions{}}); err == nil {
+		t.Error("Scheduler with MaxHandlers 1 was accepted")
+	}
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{MaxHandlers: 4, Scheduler: &SchedulerOptions{Handlers: 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.sched.handlers != 3 {
+		t.Errorf("got %d scheduler handlers, want 3", ms.sched.handlers)
+	}
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	ms.mountFd = fds[0]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	if _, err := syscall.Write(fds[1], (*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&in))[:]); err != nil {
+		t.Fatal(err)
+	}
+	req, code := ms.readRequest(nil, false)
+	if !code.Ok() || req == nil {
+		t.Fatalf("readRequest: %v", code)
+	}
+	if ms.extraLoops != 0 {
+		t.Errorf("started %d readers beyond MaxHandlers", ms.extraLoops)
+	}
+}
+
+type batchForgetFS struct {
+	RawFileSystem
+	chunks  []int
+	forgets int
+}
+
+func (fs *batchForgetFS) BatchForget(forgets []ForgetOne) {
+	fs.chunks = append(fs.chunks, len(forgets))
+	for _, f := range forgets {
+		if f.NodeId == pollHackInode {
+			panic("poll hack inode was forgotten")
+		}
+		fs.forgets++
+	}
+}
+
+func TestBatchForget(t *testing.T) {
+	fs := &batchForgetFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{SkipForgetOnUnmount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := func(count uint32, forgets []ForgetOne) {
+		in := _BatchForgetIn{InHeader: InHeader{Opcode: _OP_BATCH_FORGET, Unique: 1}, Count: count}
+		inSize := int(unsafe.Sizeof(in))
+		entrySize := int(unsafe.Sizeof(ForgetOne{}))
+		buf := make([]byte, inSize+len(forgets)*entrySize)
+		in.Length = uint32(len(buf))
+		*(*_BatchForgetIn)(unsafe.Pointer(&buf[0])) = in
+		for i, f := range forgets {
+			*(*ForgetOne)(unsafe.Pointer(&buf[inSize+i*entrySize])) = f
+		}
+
+		req := ms.reqPool.Get().(*request)
+		req.setInput(buf)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+	}
+
+	forgets := make([]ForgetOne, 600)
+	for i := range forgets {
+		forgets[i] = ForgetOne{NodeId: uint64(i + 2), Nlookup: 1}
+	}
+	forgets[300].NodeId = pollHackInode
+	batch(uint32(len(forgets)), forgets)
+	if want := []int{256, 44, 256, 43}; !reflect.DeepEqual(fs.chunks, want) {
+		t.Errorf("got chunks %v, want %v", fs.chunks, want)
+	}
+	if fs.forgets != 599 {
+		t.Errorf("got %d forgets, want 599", fs.forgets)
+	}
+
+	// A count beyond the end of the request is cut off.
+	fs.chunks, fs.forgets = nil, 0
+	batch(1000, forgets[:10])
+	if fs.forgets != 10 {
+		t.Errorf("got %d forgets, want 10", fs.forgets)
+	}
+
+	fs.chunks, fs.forgets = nil, 0
+	ms.unmounting = 1
+	batch(uint32(len(forgets)), forgets)
+	if fs.forgets != 0 {
+		t.Errorf("got %d forgets while unmounting", fs.forgets)
+	}
 }
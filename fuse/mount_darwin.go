@@ -194,3 +194,8 @@ func mountV4(mountPoint string, opts *MountOptions, ready chan<- error) (fd int,
 func unmount(dir string, opts *MountOptions) error {
 	return syscall.Unmount(dir, 0)
 }
+
+func (ms *Server) wakeupReader() {
+	cmd := exec.Command("df", ms.mountPointLocked())
+	_ = cmd.Run()
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !fuse_minimal
+// +build !fuse_minimal
+
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// haveMountHelpers is set if mount and unmount may fall back to
+// fusermount, see the fuse_minimal build tag.
+const haveMountHelpers = true
+
+func unixgramSocketpair() (l, r *os.File, err error) {
+	fd, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair",
+			err.(syscall.Errno))
+	}
+	l = os.NewFile(uintptr(fd[0]), "socketpair-half1")
+	r = os.NewFile(uintptr(fd[1]), "socketpair-half2")
+	return
+}
+
+func updateMtab(source, mnt, _type, options string, opts *MountOptions) {
+	cmd := exec.Cmd{
+		Path: "/bin/mount",
+		Args: []string{
+			"/bin/mount", "--no-canonicalize", "-i", "-f", "-t", "fuse." + _type, "-o", options, source, mnt,
+		},
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		opts.errorf("update /etc/mtab: %v: %s", err, bytes.TrimSpace(out))
+	}
+}
+
+// mountHelper mounts with fusermount, which passes us the
+// descriptor of /dev/fuse over a socket.
+func mountHelper(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
+	local, remote, err := unixgramSocketpair()
+	if err != nil {
+		return
+	}
+
+	defer local.Close()
+	defer remote.Close()
+
+	bin, err := fusermountBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := []string{bin, mountPoint}
+	if s := opts.optionsStrings(); len(s) > 0 {
+		cmd = append(cmd, "-o", strings.Join(s, ","))
+	}
+	// Keep the error output, which tells why the mount failed.
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer errR.Close()
+	proc, err := os.StartProcess(bin,
+		cmd,
+		&os.ProcAttr{
+			Env:   []string{"_FUSE_COMMFD=3"},
+			Files: []*os.File{os.Stdin, os.Stdout, errW, remote}})
+	errW.Close()
+	if err != nil {
+		return
+	}
+	errOut := make(chan []byte, 1)
+	go func() {
+		out, _ := ioutil.ReadAll(errR)
+		errOut <- out
+	}()
+
+	w, err := proc.Wait()
+	if err != nil {
+		return
+	}
+	if !w.Success() {
+		err = &fusermountError{status: w.Sys(), msg: strings.TrimSpace(string(<-errOut))}
+		return
+	}
+
+	fd, err = getConnection(local)
+	if err != nil {
+		// fusermount did mount, but we can't use it; clean up.
+		unmount(mountPoint, opts)
+		return -1, err
+	}
+
+	// golang sets CLOEXEC on file descriptors when they are
+	// acquired through normal operations (e.g. open).
+	// Buf for fd, we have to set CLOEXEC manually
+	syscall.CloseOnExec(fd)
+
+	close(ready)
+	return fd, err
+}
+
+// fusermountError is returned if the fusermount helper fails. Its
+// exit status does not tell us why, so the error output is kept.
+type fusermountError struct {
+	status interface{}
+	msg    string
+}
+
+func (e *fusermountError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("fusermount exited with code %v", e.status)
+	}
+	return fmt.Sprintf("fusermount exited with code %v: %s", e.status, e.msg)
+}
+
+// fusermountTemporary are parts of the error output of fusermount
+// for failures that may go away, eg. when mounting many file systems
+// concurrently contends for the /etc/mtab lock.
+var fusermountTemporary = []string{
+	"mtab",
+	"Device or resource busy",
+	"Resource temporarily unavailable",
+	"Interrupted system call",
+}
+
+// Temporary returns whether the mount may succeed if it is tried
+// again.
+func (e *fusermountError) Temporary() bool {
+	for _, s := range fusermountTemporary {
+		if strings.Contains(e.msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmountHelpers are the fusermount binaries that unmount tries, in
+// order. fusermount3 is installed by libfuse 3 packages that do not
+// provide a fusermount compatibility link.
+var unmountHelpers = []string{"fusermount", "fusermount3"}
+
+// runUnmountHelper runs a fusermount binary, and returns its error
+// output as the error.
+func runUnmountHelper(bin, flags, mountPoint string) error {
+	errBuf := bytes.Buffer{}
+	cmd := exec.Command(bin, flags, mountPoint)
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	if errBuf.Len() > 0 {
+		return fmt.Errorf("%s (code %v)", strings.TrimSpace(errBuf.String()), err)
+	}
+	return err
+}
+
+func getConnection(local *os.File) (int, error) {
+	var data [4]byte
+	control := make([]byte, 4*256)
+
+	// n, oobn, recvflags, from, errno  - todo: error checking.
+	_, oobn, _, _,
+		err := syscall.Recvmsg(
+		int(local.Fd()), data[:], control[:], 0)
+	if err != nil {
+		return 0, err
+	}
+
+	message := *(*syscall.Cmsghdr)(unsafe.Pointer(&control[0]))
+	fd := *(*int32)(unsafe.Pointer(uintptr(unsafe.Pointer(&control[0])) + syscall.SizeofCmsghdr))
+
+	if message.Type != 1 {
+		return 0, fmt.Errorf("getConnection: recvmsg returned wrong control type: %d", message.Type)
+	}
+	if oobn <= syscall.SizeofCmsghdr {
+		return 0, fmt.Errorf("getConnection: too short control message. Length: %d", oobn)
+	}
+	if fd < 0 {
+		return 0, fmt.Errorf("getConnection: fd < 0: %d", fd)
+	}
+	return int(fd), nil
+}
+
+// lookPathFallback - search binary in PATH and, if that fails,
+// in fallbackDir. This is useful if PATH is possible empty.
+func lookPathFallback(file string, fallbackDir string) (string, error) {
+	binPath, err := exec.LookPath(file)
+	if err == nil {
+		return binPath, nil
+	}
+
+	abs := path.Join(fallbackDir, file)
+	return exec.LookPath(abs)
+}
+
+func fusermountBinary() (string, error) {
+	return lookPathFallback("fusermount", "/bin")
+}
+
+func umountBinary() (string, error) {
+	return lookPathFallback("umount", "/bin")
+}
+
+func (ms *Server) wakeupReader() {
+	cmd := exec.Command("df", ms.mountPointLocked())
+	_ = cmd.Run()
+}
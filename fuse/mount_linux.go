@@ -5,31 +5,15 @@
 package fuse
 
 import (
-	"bytes"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-func unixgramSocketpair() (l, r *os.File, err error) {
-	fd, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
-	if err != nil {
-		return nil, nil, os.NewSyscallError("socketpair",
-			err.(syscall.Errno))
-	}
-	l = os.NewFile(uintptr(fd[0]), "socketpair-half1")
-	r = os.NewFile(uintptr(fd[1]), "socketpair-half2")
-	return
-}
-
 func mtabNeedUpdate(mnt string) bool {
 	mtabPath := "/etc/mtab"
 	if strings.HasPrefix(mtabPath, mnt) {
@@ -45,19 +29,6 @@ func mtabNeedUpdate(mnt string) bool {
 	return true
 }
 
-func updateMtab(source, mnt, _type, options string) {
-	cmd := exec.Cmd{
-		Path: "/bin/mount",
-		Args: []string{
-			"/bin/mount", "--no-canonicalize", "-i", "-f", "-t", "fuse." + _type, "-o", options, source, mnt,
-		},
-	}
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		println("update /etc/mtab: ", string(out))
-	}
-}
-
 // Create a FUSE FS on the specified mount point without using
 // fusermount.
 func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
@@ -71,6 +42,11 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	if source == "" {
 		source = opts.Name
 	}
+	fstype := "fuse." + opts.Name
+	if opts.BlockDevice != "" {
+		source = opts.BlockDevice
+		fstype = "fuseblk." + opts.Name
+	}
 
 	var flags uintptr = syscall.MS_NOSUID | syscall.MS_NODEV
 	if opts.DirectMountFlags != 0 {
@@ -93,12 +69,15 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	if opts.AllowOther {
 		r = append(r, "allow_other")
 	}
+	if opts.BlockSize != 0 {
+		r = append(r, fmt.Sprintf("blksize=%d", opts.BlockSize))
+	}
 
 	if opts.Debug {
-		log.Printf("mountDirect: calling syscall.Mount(%q, %q, %q, %#x, %q)",
-			source, mountPoint, "fuse."+opts.Name, flags, strings.Join(r, ","))
+		opts.debugf("mountDirect: calling syscall.Mount(%q, %q, %q, %#x, %q)",
+			source, mountPoint, fstype, flags, strings.Join(r, ","))
 	}
-	err = syscall.Mount(source, mountPoint, "fuse."+opts.Name, flags, strings.Join(r, ","))
+	err = syscall.Mount(source, mountPoint, fstype, flags, strings.Join(r, ","))
 	if err != nil {
 		syscall.Close(fd)
 		return
@@ -107,7 +86,7 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	if os.Geteuid() == 0 {
 		realmnt, _ := filepath.Abs(mountPoint)
 		if mtabNeedUpdate(realmnt) {
-			updateMtab(source, realmnt, opts.Name, strings.Join(r, ","))
+			updateMtab(source, realmnt, opts.Name, strings.Join(r, ","), opts)
 		}
 	}
 
@@ -119,132 +98,69 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 // Create a FUSE FS on the specified mount point.  The returned
 // mount point is always absolute.
 func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
-	if opts.DirectMount {
+	strict := opts.DirectMountStrict || !haveMountHelpers
+	if opts.DirectMount || strict {
 		fd, err := mountDirect(mountPoint, opts, ready)
 		if err == nil {
 			return fd, nil
+		} else if strict {
+			return -1, err
 		} else if opts.Debug {
-			log.Printf("mount: failed to do direct mount: %s", err)
+			opts.debugf("mount: failed to do direct mount: %s", err)
 		}
 	}
 
-	local, remote, err := unixgramSocketpair()
-	if err != nil {
-		return
-	}
-
-	defer local.Close()
-	defer remote.Close()
-
-	bin, err := fusermountBinary()
-	if err != nil {
-		return 0, err
-	}
-
-	cmd := []string{bin, mountPoint}
-	if s := opts.optionsStrings(); len(s) > 0 {
-		cmd = append(cmd, "-o", strings.Join(s, ","))
-	}
-	proc, err := os.StartProcess(bin,
-		cmd,
-		&os.ProcAttr{
-			Env:   []string{"_FUSE_COMMFD=3"},
-			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, remote}})
-
-	if err != nil {
-		return
-	}
-
-	w, err := proc.Wait()
-	if err != nil {
-		return
-	}
-	if !w.Success() {
-		err = fmt.Errorf("fusermount exited with code %v\n", w.Sys())
-		return
-	}
-
-	fd, err = getConnection(local)
-	if err != nil {
-		return -1, err
-	}
-
-	// golang sets CLOEXEC on file descriptors when they are
-	// acquired through normal operations (e.g. open).
-	// Buf for fd, we have to set CLOEXEC manually
-	syscall.CloseOnExec(fd)
-
-	close(ready)
-	return fd, err
+	return mountHelper(mountPoint, opts, ready)
 }
 
-func unmount(mountPoint string, opts *MountOptions) (err error) {
-	if opts.DirectMount {
-		// Attempt to directly unmount, if fails fallback to fusermount method
+// unmount unmounts with the first method that works: the umount2
+// system call, if we may use it; fusermount -u; fusermount3 -u; and
+// with opts.LazyUnmount, the lazy variants of these. If all fail, it
+// returns an *UnmountError that lists what was tried.
+func unmount(mountPoint string, opts *MountOptions) error {
+	e := &UnmountError{MountPoint: mountPoint}
+	direct := opts.DirectMount || opts.DirectMountStrict || !haveMountHelpers || os.Geteuid() == 0
+	if direct {
 		err := syscall.Unmount(mountPoint, 0)
 		if err == nil {
 			return nil
 		}
+		e.Attempts = append(e.Attempts, UnmountAttempt{Method: "umount2", Err: err})
 	}
 
-	bin, err := fusermountBinary()
-	if err != nil {
-		return err
+	names := unmountHelpers
+	if opts.DirectMountStrict {
+		names = nil
 	}
-	errBuf := bytes.Buffer{}
-	cmd := exec.Command(bin, "-u", mountPoint)
-	cmd.Stderr = &errBuf
-	err = cmd.Run()
-	if errBuf.Len() > 0 {
-		return fmt.Errorf("%s (code %v)\n",
-			errBuf.String(), err)
-	}
-	return err
-}
-
-func getConnection(local *os.File) (int, error) {
-	var data [4]byte
-	control := make([]byte, 4*256)
-
-	// n, oobn, recvflags, from, errno  - todo: error checking.
-	_, oobn, _, _,
-		err := syscall.Recvmsg(
-		int(local.Fd()), data[:], control[:], 0)
-	if err != nil {
-		return 0, err
+	var helpers []string
+	for _, name := range names {
+		bin, err := lookPathFallback(name, "/bin")
+		if err == nil {
+			helpers = append(helpers, bin)
+			err = runUnmountHelper(bin, "-u", mountPoint)
+			if err == nil {
+				return nil
+			}
+		}
+		e.Attempts = append(e.Attempts, UnmountAttempt{Method: name, Err: err})
 	}
 
-	message := *(*syscall.Cmsghdr)(unsafe.Pointer(&control[0]))
-	fd := *(*int32)(unsafe.Pointer(uintptr(unsafe.Pointer(&control[0])) + syscall.SizeofCmsghdr))
-
-	if message.Type != 1 {
-		return 0, fmt.Errorf("getConnection: recvmsg returned wrong control type: %d", message.Type)
-	}
-	if oobn <= syscall.SizeofCmsghdr {
-		return 0, fmt.Errorf("getConnection: too short control message. Length: %d", oobn)
+	if !opts.LazyUnmount {
+		return e
 	}
-	if fd < 0 {
-		return 0, fmt.Errorf("getConnection: fd < 0: %d", fd)
+	if direct {
+		err := syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		if err == nil {
+			return nil
+		}
+		e.Attempts = append(e.Attempts, UnmountAttempt{Method: "umount2 (lazy)", Err: err})
 	}
-	return int(fd), nil
-}
-
-// lookPathFallback - search binary in PATH and, if that fails,
-// in fallbackDir. This is useful if PATH is possible empty.
-func lookPathFallback(file string, fallbackDir string) (string, error) {
-	binPath, err := exec.LookPath(file)
-	if err == nil {
-		return binPath, nil
+	for _, bin := range helpers {
+		err := runUnmountHelper(bin, "-uz", mountPoint)
+		if err == nil {
+			return nil
+		}
+		e.Attempts = append(e.Attempts, UnmountAttempt{Method: filepath.Base(bin) + " (lazy)", Err: err})
 	}
-
-	abs := path.Join(fallbackDir, file)
-	return exec.LookPath(abs)
-}
-
-func fusermountBinary() (string, error) {
-	return lookPathFallback("fusermount", "/bin")
-}
-
-func umountBinary() (string, error) {
-	return lookPathFallback("umount", "/bin")
+	return e
 }
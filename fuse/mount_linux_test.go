@@ -0,0 +1,86 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !fuse_minimal
+// +build !fuse_minimal
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsTransientMountError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EBUSY, true},
+		{syscall.EINTR, true},
+		{&os.SyscallError{Syscall: "mount", Err: syscall.EAGAIN}, true},
+		{&fusermountError{status: 1, msg: "fusermount: failed to open /etc/mtab: Resource temporarily unavailable"}, true},
+		{&fusermountError{status: 1, msg: "fusermount: mount failed: Operation not permitted"}, false},
+		{&fusermountError{status: 1}, false},
+		{syscall.ENOENT, false},
+		{syscall.EPERM, false},
+		{fmt.Errorf("some error"), false},
+	} {
+		if got := isTransientMountError(tc.err); got != tc.want {
+			t.Errorf("isTransientMountError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUnmountError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUnmountError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	err = unmount(dir, &MountOptions{DirectMount: true, LazyUnmount: true})
+	ue, ok := err.(*UnmountError)
+	if !ok {
+		t.Fatalf("got %v (%T), want *UnmountError", err, err)
+	}
+	if ue.MountPoint != dir {
+		t.Errorf("got mount point %q, want %q", ue.MountPoint, dir)
+	}
+
+	var methods []string
+	for _, a := range ue.Attempts {
+		methods = append(methods, a.Method)
+	}
+	if len(methods) < 4 || methods[0] != "umount2" || methods[1] != "fusermount" ||
+		methods[2] != "fusermount3" || methods[3] != "umount2 (lazy)" {
+		t.Errorf("got attempts %v", methods)
+	}
+	if !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.EPERM) {
+		t.Errorf("got %v, want the umount2 error", err)
+	}
+}
+
+func TestUnmountDirectMountStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUnmountDirectMountStrict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	err = unmount(dir, &MountOptions{DirectMountStrict: true, LazyUnmount: true})
+	ue, ok := err.(*UnmountError)
+	if !ok {
+		t.Fatalf("got %v (%T), want *UnmountError", err, err)
+	}
+	var methods []string
+	for _, a := range ue.Attempts {
+		methods = append(methods, a.Method)
+	}
+	if len(methods) != 2 || methods[0] != "umount2" || methods[1] != "umount2 (lazy)" {
+		t.Errorf("got attempts %v, want only umount2", methods)
+	}
+}
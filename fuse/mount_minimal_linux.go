@@ -0,0 +1,46 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build fuse_minimal
+// +build fuse_minimal
+
+package fuse
+
+import (
+	"errors"
+	"syscall"
+)
+
+// haveMountHelpers is set if mount and unmount may fall back to
+// fusermount. Binaries built with the fuse_minimal tag only use the
+// mount system calls, so they do not depend on any other binary.
+const haveMountHelpers = false
+
+var errNoMountHelpers = errors.New("fuse: mount helpers are not available with the fuse_minimal build tag")
+
+// unmountHelpers is empty, so unmount only tries umount2.
+var unmountHelpers []string
+
+func mountHelper(mountPoint string, opts *MountOptions, ready chan<- error) (int, error) {
+	return -1, errNoMountHelpers
+}
+
+// updateMtab is a no-op: /bin/mount may not exist.
+func updateMtab(source, mnt, _type, options string, opts *MountOptions) {
+}
+
+func runUnmountHelper(bin, flags, mountPoint string) error {
+	return errNoMountHelpers
+}
+
+func lookPathFallback(file string, fallbackDir string) (string, error) {
+	return "", errNoMountHelpers
+}
+
+// wakeupReader makes the kernel send a request, so blocked readers
+// return. It does the statfs in process, as there is no df to run.
+func (ms *Server) wakeupReader() {
+	var st syscall.Statfs_t
+	_ = syscall.Statfs(ms.mountPointLocked(), &st)
+}
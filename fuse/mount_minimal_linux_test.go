@@ -0,0 +1,46 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build fuse_minimal
+// +build fuse_minimal
+
+package fuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMinimalMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMinimalMount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+
+	// Without fusermount, the mount system call is the only way
+	// to mount, even without DirectMount.
+	_, err = mount(filepath.Join(dir, "missing"), &MountOptions{Name: "test"}, make(chan error, 1))
+	if err == nil {
+		t.Fatal("mount on a missing directory succeeded")
+	}
+	if err == errNoMountHelpers {
+		t.Errorf("mount tried fusermount")
+	}
+
+	err = unmount(dir, &MountOptions{LazyUnmount: true})
+	ue, ok := err.(*UnmountError)
+	if !ok {
+		t.Fatalf("got %v (%T), want *UnmountError", err, err)
+	}
+	var methods []string
+	for _, a := range ue.Attempts {
+		methods = append(methods, a.Method)
+	}
+	if len(methods) != 2 || methods[0] != "umount2" || methods[1] != "umount2 (lazy)" {
+		t.Errorf("got attempts %v, want only umount2", methods)
+	}
+}
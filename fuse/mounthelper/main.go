@@ -0,0 +1,112 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mounthelper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// daemonEnv marks the background process, which reports the outcome
+// of the mount on file descriptor 3.
+const daemonEnv = "_GO_FUSE_MOUNT_HELPER_DAEMON"
+
+// mountOK is written to the status pipe after a successful mount.
+const mountOK = "ok"
+
+// Main runs a mount helper. It parses os.Args, calls mount to mount
+// the file system, and serves it until it is unmounted.
+//
+// Unless the "foreground" option is given, Main starts itself again
+// in a new session, with its standard streams on /dev/null, and
+// calls mount there. The process started by mount(8) waits for the
+// outcome of the mount, and exits: with 0 if the file system is
+// mounted, and with ExitMountFailure and the error on stderr
+// otherwise. With -f, Main exits after parsing the arguments.
+func Main(mount func(args *Args) (*fuse.Server, error)) {
+	name := filepath.Base(os.Args[0])
+	args, err := Parse(os.Args[1:])
+	if err != nil {
+		fail(name, ExitUsage, err)
+	}
+	if args.Fake {
+		os.Exit(0)
+	}
+
+	daemon := os.Getenv(daemonEnv) != ""
+	if !args.Foreground && !daemon {
+		code, err := startDaemon()
+		if err != nil {
+			fail(name, code, err)
+		}
+		os.Exit(0)
+	}
+
+	server, err := mount(args)
+	if daemon {
+		status := os.NewFile(3, "status")
+		msg := mountOK
+		if err != nil {
+			msg = err.Error()
+		}
+		status.Write([]byte(msg))
+		status.Close()
+	}
+	if err != nil {
+		fail(name, ExitMountFailure, err)
+	}
+	server.Wait()
+}
+
+// startDaemon starts the background process, and waits for it to
+// report the outcome of the mount. On failure, it returns the exit
+// code for the error.
+func startDaemon() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return ExitSystem, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return ExitSystem, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return ExitSystem, err
+	}
+
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ExitSystem, err
+	}
+	switch string(msg) {
+	case mountOK:
+		cmd.Process.Release()
+		return 0, nil
+	case "":
+		cmd.Wait()
+		return ExitMountFailure, fmt.Errorf("background process exited before mounting: %v", cmd.ProcessState)
+	}
+	return ExitMountFailure, fmt.Errorf("%s", msg)
+}
+
+func fail(name string, code int, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	os.Exit(code)
+}
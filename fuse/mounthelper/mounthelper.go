@@ -0,0 +1,183 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mounthelper lets a go-fuse file system run as a mount(8)
+// helper. Installed as /sbin/mount.fuse.NAME, the file system can be
+// mounted with "mount -t fuse.NAME device mountpoint", and listed in
+// /etc/fstab, eg.
+//
+//	device  /mnt/data  fuse.NAME  allow_other,x-systemd.automount  0 0
+//
+// mount(8) runs the helper as
+//
+//	mount.fuse.NAME device mountpoint [-sfnv] [-o options] [-t type]
+//
+// and waits for it to exit. Main parses the arguments, starts the
+// server in the background and exits once the file system is
+// mounted, with the exit codes that mount(8) documents.
+package mounthelper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Exit codes of mount helpers, from mount(8).
+const (
+	// ExitUsage is for incorrect invocation or permissions.
+	ExitUsage = 1
+
+	// ExitSystem is for system errors, such as failing to start
+	// the background process.
+	ExitSystem = 2
+
+	// ExitMountFailure is for a failed mount.
+	ExitMountFailure = 32
+)
+
+// Args are the parsed arguments of a mount helper.
+type Args struct {
+	// Device is the mount source, eg. the first column of an
+	// fstab line. It is also the default MountOptions.FsName.
+	Device string
+
+	// Mountpoint is the directory to mount on.
+	Mountpoint string
+
+	// MountOptions holds the options that go-fuse and the kernel
+	// understand: allow_other, debug, fsname=, subtype= and the
+	// generic mount flags such as ro, nosuid or noatime, which are
+	// passed on in MountOptions.Options.
+	MountOptions fuse.MountOptions
+
+	// FsOptions holds the remaining -o options, for the file
+	// system to interpret. Options without a value map to "".
+	FsOptions map[string]string
+
+	// Foreground is set by the "foreground" option. The helper
+	// then serves in the foreground rather than in a background
+	// process, eg. for debugging or systemd services.
+	Foreground bool
+
+	// Sloppy (-s) asks to ignore options that are not understood.
+	Sloppy bool
+
+	// Fake (-f) asks to do everything but the mount.
+	Fake bool
+
+	// Verbose (-v) asks for verbose output.
+	Verbose bool
+}
+
+// kernelOptions are the generic mount options that are passed to
+// fusermount or mount(2).
+var kernelOptions = map[string]bool{
+	"ro": true, "rw": true,
+	"suid": true, "nosuid": true,
+	"dev": true, "nodev": true,
+	"exec": true, "noexec": true,
+	"sync": true, "async": true, "dirsync": true,
+	"atime": true, "noatime": true, "diratime": true, "nodiratime": true,
+	"relatime": true, "norelatime": true, "strictatime": true, "lazytime": true,
+	"default_permissions": true,
+}
+
+// userspaceOptions are the options for mount(8) and systemd, which
+// it passes on to helpers, but which do not concern the file system.
+var userspaceOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true,
+	"user": true, "nouser": true, "users": true, "owner": true, "group": true,
+	"nofail": true, "_netdev": true,
+}
+
+// Parse parses the arguments of a mount helper, without the program
+// name.
+func Parse(argv []string) (*Args, error) {
+	a := &Args{FsOptions: map[string]string{}}
+	var positional []string
+	var opts []string
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		for j := 1; j < len(arg); j++ {
+			switch c := arg[j]; c {
+			case 's':
+				a.Sloppy = true
+			case 'f':
+				a.Fake = true
+			case 'n':
+				// There is no mtab to skip.
+			case 'v':
+				a.Verbose = true
+			case 'o', 't', 'N':
+				val := arg[j+1:]
+				if val == "" {
+					i++
+					if i == len(argv) {
+						return nil, fmt.Errorf("option -%c needs an argument", c)
+					}
+					val = argv[i]
+				}
+				switch c {
+				case 'o':
+					opts = append(opts, val)
+				case 't':
+					// mount(8) passes fuse.NAME.
+					if k := strings.IndexByte(val, '.'); k >= 0 {
+						a.MountOptions.Name = val[k+1:]
+					}
+				case 'N':
+					return nil, fmt.Errorf("mount namespaces (-N) are not supported")
+				}
+				j = len(arg)
+			default:
+				return nil, fmt.Errorf("unknown flag -%c", c)
+			}
+		}
+	}
+	if len(positional) != 2 {
+		return nil, fmt.Errorf("usage: device mountpoint [-sfnv] [-o options]")
+	}
+	a.Device, a.Mountpoint = positional[0], positional[1]
+	a.MountOptions.FsName = a.Device
+
+	for _, o := range opts {
+		for _, opt := range strings.Split(o, ",") {
+			if opt != "" {
+				a.addOption(opt)
+			}
+		}
+	}
+	return a, nil
+}
+
+func (a *Args) addOption(opt string) {
+	key, val := opt, ""
+	if k := strings.IndexByte(opt, '='); k >= 0 {
+		key, val = opt[:k], opt[k+1:]
+	}
+	switch {
+	case key == "allow_other":
+		a.MountOptions.AllowOther = true
+	case key == "debug":
+		a.MountOptions.Debug = true
+	case key == "fsname":
+		a.MountOptions.FsName = val
+	case key == "subtype":
+		a.MountOptions.Name = val
+	case key == "foreground":
+		a.Foreground = true
+	case kernelOptions[key]:
+		a.MountOptions.Options = append(a.MountOptions.Options, opt)
+	case userspaceOptions[key], key == "comment",
+		strings.HasPrefix(key, "x-"), strings.HasPrefix(key, "X-"):
+	default:
+		a.FsOptions[key] = val
+	}
+}
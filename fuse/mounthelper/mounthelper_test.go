@@ -0,0 +1,61 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mounthelper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	a, err := Parse(strings.Fields("-sv srv:/data /mnt/data -t fuse.myfs -o rw,allow_other,noauto,x-systemd.automount,_netdev -o cache=64m,nosuid,readonly"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Device != "srv:/data" || a.Mountpoint != "/mnt/data" {
+		t.Errorf("got device %q, mountpoint %q", a.Device, a.Mountpoint)
+	}
+	if !a.Sloppy || !a.Verbose || a.Fake || a.Foreground {
+		t.Errorf("got flags %+v", a)
+	}
+	mo := a.MountOptions
+	if !mo.AllowOther || mo.FsName != "srv:/data" || mo.Name != "myfs" {
+		t.Errorf("got AllowOther %v, FsName %q, Name %q", mo.AllowOther, mo.FsName, mo.Name)
+	}
+	if want := []string{"rw", "nosuid"}; !reflect.DeepEqual(mo.Options, want) {
+		t.Errorf("got options %q, want %q", mo.Options, want)
+	}
+	if want := map[string]string{"cache": "64m", "readonly": ""}; !reflect.DeepEqual(a.FsOptions, want) {
+		t.Errorf("got fs options %v, want %v", a.FsOptions, want)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	a, err := Parse([]string{"dev", "mnt", "-ofsname=other,subtype=sub,debug,foreground", "-f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MountOptions.FsName != "other" || a.MountOptions.Name != "sub" || !a.MountOptions.Debug {
+		t.Errorf("got %+v", a.MountOptions)
+	}
+	if !a.Foreground || !a.Fake {
+		t.Errorf("got Foreground %v, Fake %v", a.Foreground, a.Fake)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, argv := range []string{
+		"dev",
+		"dev mnt extra",
+		"dev mnt -o",
+		"dev mnt -x",
+		"dev mnt -N /proc/1/ns/mnt",
+	} {
+		if _, err := Parse(strings.Fields(argv)); err == nil {
+			t.Errorf("Parse(%q) succeeded", argv)
+		}
+	}
+}
@@ -363,6 +363,10 @@ func (c *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 	return code
 }
 
+func (c *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
 func (c *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	if input.Fh != 0 {
 		node := c.toInode(input.NodeId)
@@ -486,6 +490,10 @@ func (c *rawBridge) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *f
 	return fuse.OK
 }
 
+func (c *rawBridge) SyncFs(cancel <-chan struct{}, input *fuse.SyncFsIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (c *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	node := c.toInode(input.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
@@ -504,6 +512,26 @@ func (fs *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.L
 	return fuse.ENOSYS
 }
 
+func (fs *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (fs *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, out *fuse.IoctlOut, bufIn, bufOut []byte) fuse.Status {
 	return fuse.ENOSYS
 }
+
+func (fs *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) Bmap(cancel <-chan struct{}, in *fuse.BmapIn, out *fuse.BmapOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) SetupMapping(cancel <-chan struct{}, in *fuse.SetupMappingIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) RemoveMapping(cancel <-chan struct{}, in *fuse.RemoveMappingIn, mappings []fuse.RemoveMappingOne) fuse.Status {
+	return fuse.ENOSYS
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"unsafe"
+)
+
+// notifyOpcodes are the pseudo opcodes of the notifications that
+// Notify knows about, by code.
+var notifyOpcodes = map[int]uint32{
+	NOTIFY_POLL:           _OP_NOTIFY_POLL,
+	NOTIFY_INVAL_INODE:    _OP_NOTIFY_INVAL_INODE,
+	NOTIFY_INVAL_ENTRY:    _OP_NOTIFY_INVAL_ENTRY,
+	NOTIFY_STORE_CACHE:    _OP_NOTIFY_STORE_CACHE,
+	NOTIFY_RETRIEVE_CACHE: _OP_NOTIFY_RETRIEVE_CACHE,
+	NOTIFY_DELETE:         _OP_NOTIFY_DELETE,
+	NOTIFY_RESEND:         _OP_NOTIFY_RESEND,
+}
+
+// Notify sends the notification with the given code, one of the
+// NOTIFY_ constants, and payload, the bytes that follow the header,
+// as the kernel defines them. The payload functions below build them
+// for the known codes. Other codes, eg. ones added to the kernel
+// after this package was written, are sent as they are: the caller
+// should check KernelSettings().SupportsVersion first.
+//
+// For the known codes, Notify returns ENOSYS if the kernel does not
+// support the code, and EINVAL if the payload is malformed.
+// NOTIFY_RETRIEVE_CACHE is refused, as its reply must be waited for:
+// use InodeRetrieveCache instead.
+func (ms *Server) Notify(code int, payload []byte) Status {
+	if code >= 0 {
+		return EINVAL
+	}
+	opcode, known := notifyOpcodes[code]
+	if !known {
+		opcode = _OP_NOTIFY_RAW
+	} else if !ms.kernelSettings.SupportsNotify(code) {
+		return ENOSYS
+	} else if code == NOTIFY_RESEND && ms.kernelSettings.Flags64()&CAP_HAS_RESEND == 0 {
+		return ENOSYS
+	} else if st := checkNotifyPayload(code, payload); !st.Ok() {
+		return st
+	}
+	if ms.isShutdown() {
+		return EINTR
+	}
+
+	req := request{
+		inHeader: &InHeader{
+			Opcode: opcode,
+		},
+		handler: operationHandlers[opcode],
+		status:  Status(code),
+	}
+	fixed := int(req.handler.OutputSize)
+	copy(req.outBuf[sizeOfOutHeader:], payload[:fixed])
+	req.flatData = payload[fixed:]
+
+	// Protect against concurrent close.
+	ms.writeMu.RLock()
+	result := ms.write(&req)
+	ms.writeMu.RUnlock()
+
+	if req.debug {
+		ms.debugf("Response: %s: %v", operationName(opcode), result)
+	}
+	return result
+}
+
+// checkNotifyPayload checks the payload of a notification with a
+// known code.
+func checkNotifyPayload(code int, payload []byte) Status {
+	fixed := int(operationHandlers[notifyOpcodes[code]].OutputSize)
+	if len(payload) < fixed {
+		return EINVAL
+	}
+	tail := len(payload) - fixed
+	var p unsafe.Pointer
+	if fixed > 0 {
+		p = unsafe.Pointer(&payload[0])
+	}
+	switch code {
+	case NOTIFY_POLL, NOTIFY_INVAL_INODE:
+		if tail != 0 {
+			return EINVAL
+		}
+	case NOTIFY_INVAL_ENTRY:
+		if !validNotifyName(payload[fixed:], (*NotifyInvalEntryOut)(p).NameLen) {
+			return EINVAL
+		}
+	case NOTIFY_DELETE:
+		if !validNotifyName(payload[fixed:], (*NotifyInvalDeleteOut)(p).NameLen) {
+			return EINVAL
+		}
+	case NOTIFY_STORE_CACHE:
+		if uint64(tail) != uint64((*NotifyStoreOut)(p).Size) {
+			return EINVAL
+		}
+	case NOTIFY_RESEND:
+		if len(payload) != 0 {
+			return EINVAL
+		}
+	case NOTIFY_RETRIEVE_CACHE:
+		return EINVAL
+	}
+	return OK
+}
+
+// validNotifyName checks that name holds nameLen bytes and a
+// terminating NUL, which older kernels depend on.
+func validNotifyName(name []byte, nameLen uint32) bool {
+	return uint64(len(name)) == uint64(nameLen)+1 && name[nameLen] == 0
+}
+
+// notifyPayload concatenates the bytes of the fixed-size message at
+// msg, and the tail.
+func notifyPayload(msg unsafe.Pointer, size uintptr, tail []byte) []byte {
+	buf := make([]byte, int(size)+len(tail))
+	copy(buf, (*[outputHeaderSize]byte)(msg)[:size])
+	copy(buf[size:], tail)
+	return buf
+}
+
+// nulTerminated returns name followed by a NUL byte.
+func nulTerminated(name string) []byte {
+	b := make([]byte, len(name)+1)
+	copy(b, name)
+	return b
+}
+
+// NotifyPollPayload builds the payload of NOTIFY_POLL, see
+// NotifyPollWakeup.
+func NotifyPollPayload(kh uint64) []byte {
+	out := NotifyPollWakeupOut{Kh: kh}
+	return notifyPayload(unsafe.Pointer(&out), unsafe.Sizeof(out), nil)
+}
+
+// NotifyInvalInodePayload builds the payload of NOTIFY_INVAL_INODE,
+// see InodeNotify.
+func NotifyInvalInodePayload(node uint64, off int64, length int64) []byte {
+	out := NotifyInvalInodeOut{Ino: node, Off: off, Length: length}
+	return notifyPayload(unsafe.Pointer(&out), unsafe.Sizeof(out), nil)
+}
+
+// NotifyInvalEntryPayload builds the payload of NOTIFY_INVAL_ENTRY,
+// see EntryNotify and EntryExpireNotify.
+func NotifyInvalEntryPayload(parent uint64, name string, flags uint32) []byte {
+	out := NotifyInvalEntryOut{Parent: parent, NameLen: uint32(len(name)), Flags: flags}
+	return notifyPayload(unsafe.Pointer(&out), unsafe.Sizeof(out), nulTerminated(name))
+}
+
+// NotifyDeletePayload builds the payload of NOTIFY_DELETE, see
+// DeleteNotify.
+func NotifyDeletePayload(parent uint64, child uint64, name string) []byte {
+	out := NotifyInvalDeleteOut{Parent: parent, Child: child, NameLen: uint32(len(name))}
+	return notifyPayload(unsafe.Pointer(&out), unsafe.Sizeof(out), nulTerminated(name))
+}
+
+// NotifyStoreCachePayload builds the payload of NOTIFY_STORE_CACHE,
+// see InodeNotifyStoreCache. data must be smaller than 4 GiB.
+func NotifyStoreCachePayload(node uint64, offset int64, data []byte) []byte {
+	out := NotifyStoreOut{Nodeid: node, Offset: uint64(offset), Size: uint32(len(data))}
+	return notifyPayload(unsafe.Pointer(&out), unsafe.Sizeof(out), data)
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestNotify(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{VerifyReplies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	ms.kernelSettings.Major = 7
+	ms.kernelSettings.Minor = 12
+
+	read := func() (OutHeader, []byte) {
+		buf := make([]byte, 4096)
+		n, err := syscall.Read(fds[0], buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *(*OutHeader)(unsafe.Pointer(&buf[0])), buf[sizeOfOutHeader:n]
+	}
+
+	payload := NotifyInvalEntryPayload(1, "file", 0)
+	if st := ms.Notify(NOTIFY_INVAL_ENTRY, payload); !st.Ok() {
+		t.Fatalf("Notify: %v", st)
+	}
+	h, got := read()
+	if h.Status != -NOTIFY_INVAL_ENTRY || h.Unique != 0 || int(h.Length) != int(sizeOfOutHeader)+len(payload) {
+		t.Errorf("got header %+v", h)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got payload %q, want %q", got, payload)
+	}
+
+	// A name without its NUL is rejected.
+	if st := ms.Notify(NOTIFY_INVAL_ENTRY, payload[:len(payload)-1]); st != EINVAL {
+		t.Errorf("truncated name: got %v, want EINVAL", st)
+	}
+	if st := ms.Notify(NOTIFY_INVAL_INODE, payload); st != EINVAL {
+		t.Errorf("wrong size: got %v, want EINVAL", st)
+	}
+	if st := ms.Notify(NOTIFY_DELETE, NotifyDeletePayload(1, 2, "file")); st != ENOSYS {
+		t.Errorf("NOTIFY_DELETE on 7.12: got %v, want ENOSYS", st)
+	}
+	ms.kernelSettings.Minor = 15
+	if st := ms.Notify(NOTIFY_RETRIEVE_CACHE, make([]byte, unsafe.Sizeof(NotifyRetrieveOut{}))); st != EINVAL {
+		t.Errorf("NOTIFY_RETRIEVE_CACHE: got %v, want EINVAL", st)
+	}
+
+	// Codes that are not known are passed on as they are.
+	raw := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if st := ms.Notify(-9, raw); !st.Ok() {
+		t.Fatalf("Notify(-9): %v", st)
+	}
+	h, got = read()
+	if h.Status != 9 || !bytes.Equal(got, raw) {
+		t.Errorf("got header %+v, payload %v", h, got)
+	}
+}
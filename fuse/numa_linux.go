@@ -0,0 +1,135 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_MPOL_PREFERRED = 1
+
+	// Largest node number and CPU number supported by the masks
+	// below.
+	maxNUMANodes = 1024
+	maxCPUs      = 8192
+)
+
+// numaTopology describes which CPUs belong to which NUMA node.
+type numaTopology struct {
+	cpuNode  map[int]int
+	nodeCPUs map[int][]int
+}
+
+// readNUMATopology reads the NUMA layout from sysfs.
+func readNUMATopology() (*numaTopology, error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	t := &numaTopology{
+		cpuNode:  map[int]int{},
+		nodeCPUs: map[int][]int{},
+	}
+	for _, d := range dirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(d), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(d, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		cpus, err := parseCPUList(string(data))
+		if err != nil {
+			return nil, err
+		}
+		t.nodeCPUs[node] = cpus
+		for _, c := range cpus {
+			t.cpuNode[c] = node
+		}
+	}
+	return t, nil
+}
+
+// node returns the NUMA node of the given CPU, or -1 if the machine
+// has a single node, so there is nothing to optimize.
+func (t *numaTopology) node(cpu int) int {
+	if len(t.nodeCPUs) < 2 {
+		return -1
+	}
+	if n, ok := t.cpuNode[cpu]; ok {
+		return n
+	}
+	return -1
+}
+
+// bindToNode asks the kernel to back mem with pages from the given
+// node. The policy is a preference, so allocation still succeeds if
+// the node runs out of memory. It must be called before mem is
+// touched.
+func bindToNode(mem []byte, node int) error {
+	if node < 0 || node >= maxNUMANodes {
+		return syscall.EINVAL
+	}
+	var mask [maxNUMANodes / 64]uint64
+	mask[node/64] |= 1 << uint(node%64)
+	_, _, errno := syscall.Syscall6(syscall.SYS_MBIND,
+		uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)),
+		_MPOL_PREFERRED, uintptr(unsafe.Pointer(&mask[0])), maxNUMANodes, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setThreadAffinity restricts the calling thread to the given CPUs.
+// The caller should be locked to its OS thread.
+func setThreadAffinity(cpus []int) error {
+	var mask [maxCPUs / 64]uint64
+	for _, c := range cpus {
+		if c < 0 || c >= maxCPUs {
+			return syscall.EINVAL
+		}
+		mask[c/64] |= 1 << uint(c%64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// processCPUs returns the CPUs that the calling thread may run on,
+// in ascending order.
+func processCPUs() ([]int, error) {
+	var mask [maxCPUs / 64]uint64
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0,
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+	var cpus []int
+	for i, w := range mask {
+		for b := 0; w != 0; b++ {
+			if w&1 != 0 {
+				cpus = append(cpus, i*64+b)
+			}
+			w >>= 1
+		}
+	}
+	return cpus, nil
+}
+
+// pinThread restricts the calling thread to a single CPU.
+func pinThread(cpu int) error {
+	return setThreadAffinity([]int{cpu})
+}
@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -62,6 +63,11 @@ const (
 	_OP_RENAME2         = uint32(45) // protocol version 23.
 	_OP_LSEEK           = uint32(46) // protocol version 24
 	_OP_COPY_FILE_RANGE = uint32(47) // protocol version 28.
+	_OP_SETUPMAPPING    = uint32(48) // protocol version 31.
+	_OP_REMOVEMAPPING   = uint32(49) // protocol version 31.
+	_OP_SYNCFS          = uint32(50) // protocol version 34.
+	_OP_TMPFILE         = uint32(51) // protocol version 37.
+	_OP_STATX           = uint32(52) // protocol version 39.
 
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_INVAL_ENTRY    = uint32(100)
@@ -69,8 +75,11 @@ const (
 	_OP_NOTIFY_STORE_CACHE    = uint32(102)
 	_OP_NOTIFY_RETRIEVE_CACHE = uint32(103)
 	_OP_NOTIFY_DELETE         = uint32(104) // protocol version 18
+	_OP_NOTIFY_RESEND         = uint32(105) // protocol version 40
+	_OP_NOTIFY_POLL           = uint32(106)
+	_OP_NOTIFY_RAW            = uint32(107) // see Server.Notify
 
-	_OPCODE_COUNT = uint32(105)
+	_OPCODE_COUNT = uint32(108)
 
 	// Constants from Linux kernel fs/fuse/fuse_i.h
 	// Default MaxPages value in all kernel versions
@@ -84,12 +93,12 @@ const (
 func doInit(server *Server, req *request) {
 	input := (*InitIn)(req.inData)
 	if input.Major != _FUSE_KERNEL_VERSION {
-		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, _FUSE_KERNEL_VERSION)
+		server.errorf("Major versions does not match. Given %d, want %d", input.Major, _FUSE_KERNEL_VERSION)
 		req.status = EIO
 		return
 	}
 	if input.Minor < _MINIMUM_MINOR_VERSION {
-		log.Printf("Minor version is less than we support. Given %d, want at least %d\n", input.Minor, _MINIMUM_MINOR_VERSION)
+		server.errorf("Minor version is less than we support. Given %d, want at least %d", input.Minor, _MINIMUM_MINOR_VERSION)
 		req.status = EIO
 		return
 	}
@@ -99,12 +108,19 @@ func doInit(server *Server, req *request) {
 	server.kernelSettings.Flags = input.Flags & (CAP_ASYNC_READ | CAP_BIG_WRITES | CAP_FILE_OPS |
 		CAP_READDIRPLUS | CAP_NO_OPEN_SUPPORT | CAP_PARALLEL_DIROPS | CAP_EXPORT_SUPPORT | CAP_MAX_PAGES | server.opts.OtherCaps)
 
+	if server.opts.DisableReadDirPlus {
+		server.kernelSettings.Flags &^= CAP_READDIRPLUS
+	}
+	if server.opts.DisableParallelDirOps {
+		server.kernelSettings.Flags &^= CAP_PARALLEL_DIROPS
+	}
+
 	if server.opts.DontUmask {
 		server.kernelSettings.Flags |= CAP_DONT_MASK
 	}
 
 	if server.opts.EnableLocks {
-		server.kernelSettings.Flags |= CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS
+		server.kernelSettings.Flags |= input.Flags & (CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS)
 	}
 
 	if server.opts.EnableAcl {
@@ -115,6 +131,34 @@ func doInit(server *Server, req *request) {
 		server.kernelSettings.Flags |= CAP_WRITEBACK_CACHE
 	}
 
+	if server.opts.EnableAtomicTrunc {
+		server.kernelSettings.Flags |= input.Flags & CAP_ATOMIC_O_TRUNC
+	}
+
+	if server.opts.NoOpendir {
+		server.kernelSettings.Flags |= input.Flags & CAP_NO_OPENDIR_SUPPORT
+	}
+
+	if server.opts.EnableKillPriv {
+		server.kernelSettings.Flags |= input.Flags & CAP_HANDLE_KILLPRIV_V2
+	}
+
+	if server.opts.EnableSetXAttrExt {
+		server.kernelSettings.Flags |= input.Flags & CAP_SETXATTR_EXT
+	}
+
+	if server.opts.ReadDirPlusAuto && !server.opts.DisableReadDirPlus {
+		server.kernelSettings.Flags |= input.Flags & CAP_READDIRPLUS_AUTO
+	}
+
+	if server.opts.EnableSubmounts {
+		server.kernelSettings.Flags |= input.Flags & CAP_SUBMOUNTS
+	}
+
+	if server.opts.MapAlignment != 0 {
+		server.kernelSettings.Flags |= input.Flags & CAP_MAP_ALIGNMENT
+	}
+
 	dataCacheMode := input.Flags & CAP_AUTO_INVAL_DATA
 	if server.opts.ExplicitDataCacheControl {
 		// we don't want CAP_AUTO_INVAL_DATA even if we cannot go into fully explicit mode
@@ -127,6 +171,19 @@ func doInit(server *Server, req *request) {
 	}
 	server.kernelSettings.Flags |= dataCacheMode
 
+	server.kernelSettings.Flags2 = 0
+	if input.Flags&CAP_INIT_EXT != 0 {
+		flags2 := uint64(CAP_CREATE_SUPP_GROUP | CAP_HAS_RESEND)
+		if server.opts.EnablePassthrough {
+			flags2 |= CAP_PASSTHROUGH
+		}
+		if server.opts.EnableIoUring {
+			flags2 |= CAP_OVER_IO_URING
+		}
+		server.kernelSettings.Flags |= CAP_INIT_EXT
+		server.kernelSettings.Flags2 = uint32((input.Flags64() & flags2) >> 32)
+	}
+
 	if input.Minor >= 13 {
 		server.setSplice()
 	}
@@ -143,15 +200,27 @@ func doInit(server *Server, req *request) {
 		Minor:               _OUR_MINOR_VERSION,
 		MaxReadAhead:        input.MaxReadAhead,
 		Flags:               server.kernelSettings.Flags,
+		Flags2:              server.kernelSettings.Flags2,
 		MaxWrite:            uint32(server.opts.MaxWrite),
-		CongestionThreshold: uint16(server.opts.MaxBackground * 3 / 4),
+		CongestionThreshold: uint16(server.opts.CongestionThreshold),
 		MaxBackground:       uint16(server.opts.MaxBackground),
 		MaxPages:            uint16(maxPages),
 	}
 
+	if out.Flags&CAP_MAP_ALIGNMENT != 0 {
+		out.MapAlignment = uint16(server.opts.MapAlignment)
+	}
 	if server.opts.MaxReadAhead != 0 && uint32(server.opts.MaxReadAhead) < out.MaxReadAhead {
 		out.MaxReadAhead = uint32(server.opts.MaxReadAhead)
 	}
+	if server.kernelSettings.Flags64()&CAP_PASSTHROUGH != 0 {
+		// The kernel refuses passthrough without a stacking
+		// depth.
+		out.MaxStackDepth = 1
+		if server.opts.MaxStackDepth > 0 {
+			out.MaxStackDepth = uint32(server.opts.MaxStackDepth)
+		}
+	}
 	if out.Minor > input.Minor {
 		out.Minor = input.Minor
 	}
@@ -168,18 +237,50 @@ func doInit(server *Server, req *request) {
 }
 
 func doOpen(server *Server, req *request) {
+	if server.opts.NoOpen && server.kernelSettings.Flags&CAP_NO_OPEN_SUPPORT != 0 {
+		// The kernel stops sending OPEN.
+		req.status = ENOSYS
+		return
+	}
 	out := (*OpenOut)(req.outData())
 	status := server.fileSystem.Open(req.cancel, (*OpenIn)(req.inData), out)
 	req.status = status
 	if status != OK {
 		return
 	}
+	server.checkOpenFlags(out)
 }
 
 func doCreate(server *Server, req *request) {
 	out := (*CreateOut)(req.outData())
 	status := server.fileSystem.Create(req.cancel, (*CreateIn)(req.inData), req.filenames[0], out)
 	req.status = status
+	if status == OK {
+		server.checkOpenFlags(&out.OpenOut)
+	}
+}
+
+// checkOpenFlags drops the open flags that the kernel does not
+// know about.
+func (ms *Server) checkOpenFlags(out *OpenOut) {
+	if !ms.kernelSettings.SupportsVersion(7, 28) {
+		out.OpenFlags &^= FOPEN_CACHE_DIR
+	}
+	if !ms.kernelSettings.SupportsVersion(7, 35) {
+		out.OpenFlags &^= FOPEN_NOFLUSH
+	}
+	if !ms.kernelSettings.SupportsVersion(7, 38) {
+		out.OpenFlags &^= FOPEN_PARALLEL_DIRECT_WRITES
+	}
+}
+
+func doSyncFs(server *Server, req *request) {
+	req.status = server.fileSystem.SyncFs(req.cancel, (*SyncFsIn)(req.inData))
+}
+
+func doTmpfile(server *Server, req *request) {
+	out := (*CreateOut)(req.outData())
+	req.status = server.fileSystem.Tmpfile(req.cancel, (*CreateIn)(req.inData), out)
 }
 
 func doReadDir(server *Server, req *request) {
@@ -203,9 +304,16 @@ func doReadDirPlus(server *Server, req *request) {
 }
 
 func doOpenDir(server *Server, req *request) {
+	if server.opts.NoOpendir && server.kernelSettings.Flags&CAP_NO_OPENDIR_SUPPORT != 0 {
+		req.status = ENOSYS
+		return
+	}
 	out := (*OpenOut)(req.outData())
 	status := server.fileSystem.OpenDir(req.cancel, (*OpenIn)(req.inData), out)
 	req.status = status
+	if status == OK {
+		server.checkOpenFlags(out)
+	}
 }
 
 func doSetattr(server *Server, req *request) {
@@ -214,7 +322,22 @@ func doSetattr(server *Server, req *request) {
 }
 
 func doWrite(server *Server, req *request) {
-	n, status := server.fileSystem.Write(req.cancel, (*WriteIn)(req.inData), req.arg)
+	in := (*WriteIn)(req.inData)
+	data := req.arg
+	if wd := req.writeData; wd != nil {
+		n, status := server.fileSystem.(WriteSplicer).WriteSplice(req.cancel, in, wd)
+		if status != ENOSYS || wd.used {
+			(*WriteOut)(req.outData()).Size = n
+			req.status = status
+			return
+		}
+		var err error
+		if data, err = wd.Bytes(server.allocOut(req, uint32(wd.Size()))); err != nil {
+			req.status = ToStatus(err)
+			return
+		}
+	}
+	n, status := server.fileSystem.Write(req.cancel, in, data)
 	o := (*WriteOut)(req.outData())
 	o.Size = n
 	req.status = status
@@ -228,7 +351,7 @@ func doNotifyReply(server *Server, req *request) {
 	server.retrieveMu.Unlock()
 
 	badf := func(format string, argv ...interface{}) {
-		log.Printf("notify reply: "+format, argv...)
+		server.errorf("notify reply: "+format, argv...)
 	}
 
 	if reading == nil {
@@ -316,38 +439,64 @@ func doGetAttr(server *Server, req *request) {
 
 // doForget - forget one NodeId
 func doForget(server *Server, req *request) {
-	if !server.opts.RememberInodes {
+	if !server.opts.RememberInodes && !server.skipForget() {
 		server.fileSystem.Forget(req.inHeader.NodeId, (*ForgetIn)(req.inData).Nlookup)
 	}
 }
 
+// forgetChunk is the number of BATCH_FORGET entries that are passed
+// to a BatchForgetter at once.
+const forgetChunk = 256
+
 // doBatchForget - forget a list of NodeIds
 func doBatchForget(server *Server, req *request) {
 	in := (*_BatchForgetIn)(req.inData)
-	wantBytes := uintptr(in.Count) * unsafe.Sizeof(_ForgetOne{})
-	if uintptr(len(req.arg)) < wantBytes {
+	count := int(in.Count)
+	if max := len(req.arg) / int(unsafe.Sizeof(ForgetOne{})); count > max {
 		// We have no return value to complain, so log an error.
-		log.Printf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
-			len(req.arg), wantBytes, in.Count)
+		server.errorf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
+			len(req.arg), uintptr(in.Count)*unsafe.Sizeof(ForgetOne{}), in.Count)
+		count = max
 	}
-
-	h := &reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&req.arg[0])),
-		Len:  int(in.Count),
-		Cap:  int(in.Count),
+	if count == 0 || server.skipForget() {
+		return
 	}
 
-	forgets := *(*[]_ForgetOne)(unsafe.Pointer(h))
-	for i, f := range forgets {
-		if server.opts.Debug {
-			log.Printf("doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
+	// count is bounded by the request size, far below the array
+	// length, which only has to fit the address space on 32-bit.
+	forgets := (*[1 << 26]ForgetOne)(unsafe.Pointer(&req.arg[0]))[:count:count]
+	if req.debug {
+		for i, f := range forgets {
+			server.debugf("doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
 				req.inHeader.Unique, i+1, len(forgets), f.NodeId, f.Nlookup)
 		}
+	}
+
+	batcher, _ := server.fileSystem.(BatchForgetter)
+	forget := func(chunk []ForgetOne) {
+		if len(chunk) == 0 {
+			return
+		}
+		if batcher != nil {
+			batcher.BatchForget(chunk)
+			return
+		}
+		for _, f := range chunk {
+			server.fileSystem.Forget(f.NodeId, f.Nlookup)
+		}
+	}
+
+	start := 0
+	for i, f := range forgets {
 		if f.NodeId == pollHackInode {
-			continue
+			forget(forgets[start:i])
+			start = i + 1
+		} else if i-start == forgetChunk {
+			forget(forgets[start:i])
+			start = i
 		}
-		server.fileSystem.Forget(f.NodeId, f.Nlookup)
 	}
+	forget(forgets[start:])
 }
 
 func doReadlink(server *Server, req *request) {
@@ -490,20 +639,62 @@ func doIoctl(server *Server, req *request) {
 	}
 	in := (*IoctlIn)(req.inData)
 	out := (*IoctlOut)(req.outData())
-	if in.OutSize > 0 {
-		req.flatData = server.allocOut(req, in.OutSize)
+	unrestricted := in.Flags&FUSE_IOCTL_UNRESTRICTED != 0
+	if sz := in.OutSize; sz > 0 || unrestricted {
+		if unrestricted && sz < ioctlRetrySize {
+			// Leave room for the iovecs of IoctlOut.SetRetry.
+			sz = ioctlRetrySize
+		}
+		req.flatData = server.allocOut(req, sz)[:in.OutSize]
 	}
 	req.status = server.fileSystem.Ioctl(req.cancel, in, out, req.arg, req.flatData)
+	if req.status.Ok() && out.Flags&FUSE_IOCTL_RETRY != 0 {
+		if !unrestricted {
+			// The kernel would fail the ioctl with EIO.
+			server.errorf("ioctl 0x%x: FUSE_IOCTL_RETRY is only allowed for unrestricted ioctls", in.Cmd)
+			req.status = EIO
+		} else {
+			req.flatData = req.flatData[:int(out.InIovs+out.OutIovs)*int(unsafe.Sizeof(IoctlIovec{}))]
+		}
+	}
 	if !req.status.Ok() {
 		req.flatData = req.flatData[:0]
 	}
 }
 
 func doPoll(server *Server, req *request) {
-	req.status = ENOSYS
+	if !server.opts.EnablePoll {
+		req.status = ENOSYS
+		return
+	}
+	req.status = server.fileSystem.Poll(req.cancel, (*PollIn)(req.inData), (*PollOut)(req.outData()))
+}
+
+func doBmap(server *Server, req *request) {
+	req.status = server.fileSystem.Bmap(req.cancel, (*BmapIn)(req.inData), (*BmapOut)(req.outData()))
+}
+
+func doSetupMapping(server *Server, req *request) {
+	req.status = server.fileSystem.SetupMapping(req.cancel, (*SetupMappingIn)(req.inData))
+}
+
+func doRemoveMapping(server *Server, req *request) {
+	in := (*RemoveMappingIn)(req.inData)
+	sz := int(unsafe.Sizeof(RemoveMappingOne{}))
+	if len(req.arg) < int(in.Count)*sz {
+		req.status = EINVAL
+		return
+	}
+	mappings := make([]RemoveMappingOne, in.Count)
+	for i := range mappings {
+		mappings[i] = *(*RemoveMappingOne)(unsafe.Pointer(&req.arg[i*sz]))
+	}
+	req.status = server.fileSystem.RemoveMapping(req.cancel, in, mappings)
 }
 
 func doDestroy(server *Server, req *request) {
+	atomic.StoreInt32(&server.destroying, 1)
+	server.destroy()
 	req.status = OK
 }
 
@@ -529,6 +720,12 @@ func doLseek(server *Server, req *request) {
 	req.status = server.fileSystem.Lseek(req.cancel, in, out)
 }
 
+func doStatx(server *Server, req *request) {
+	in := (*StatxIn)(req.inData)
+	out := (*StatxOut)(req.outData())
+	req.status = server.fileSystem.Statx(req.cancel, in, out)
+}
+
 func doCopyFileRange(server *Server, req *request) {
 	in := (*CopyFileRangeIn)(req.inData)
 	out := (*WriteOut)(req.outData())
@@ -573,6 +770,14 @@ type operationHandler struct {
 	DecodeOut   castPointerFunc
 	FileNames   int
 	FileNameOut bool
+
+	// Mutates is set for requests that change the file
+	// system.
+	Mutates bool
+
+	// FuncName is the name of the function behind Func, to find
+	// it in stack traces.
+	FuncName string
 }
 
 var operationHandlers []*operationHandler
@@ -580,7 +785,7 @@ var operationHandlers []*operationHandler
 func operationName(op uint32) string {
 	h := getHandler(op)
 	if h == nil {
-		return "unknown"
+		return fmt.Sprintf("OPCODE-%d", op)
 	}
 	return h.Name
 }
@@ -636,15 +841,20 @@ func init() {
 		_OP_ACCESS:          unsafe.Sizeof(AccessIn{}),
 		_OP_CREATE:          unsafe.Sizeof(CreateIn{}),
 		_OP_INTERRUPT:       unsafe.Sizeof(InterruptIn{}),
-		_OP_BMAP:            unsafe.Sizeof(_BmapIn{}),
+		_OP_BMAP:            unsafe.Sizeof(BmapIn{}),
+		_OP_SETUPMAPPING:    unsafe.Sizeof(SetupMappingIn{}),
+		_OP_REMOVEMAPPING:   removeMappingInSize,
 		_OP_IOCTL:           unsafe.Sizeof(IoctlIn{}),
-		_OP_POLL:            unsafe.Sizeof(_PollIn{}),
+		_OP_POLL:            unsafe.Sizeof(PollIn{}),
 		_OP_NOTIFY_REPLY:    unsafe.Sizeof(NotifyRetrieveIn{}),
 		_OP_FALLOCATE:       unsafe.Sizeof(FallocateIn{}),
 		_OP_READDIRPLUS:     unsafe.Sizeof(ReadIn{}),
 		_OP_RENAME2:         unsafe.Sizeof(RenameIn{}),
 		_OP_LSEEK:           unsafe.Sizeof(LseekIn{}),
 		_OP_COPY_FILE_RANGE: unsafe.Sizeof(CopyFileRangeIn{}),
+		_OP_SYNCFS:          unsafe.Sizeof(SyncFsIn{}),
+		_OP_TMPFILE:         unsafe.Sizeof(CreateIn{}),
+		_OP_STATX:           unsafe.Sizeof(StatxIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 		if sz > maxInputSize {
@@ -669,16 +879,19 @@ func init() {
 		_OP_OPENDIR:               unsafe.Sizeof(OpenOut{}),
 		_OP_GETLK:                 unsafe.Sizeof(LkOut{}),
 		_OP_CREATE:                unsafe.Sizeof(CreateOut{}),
-		_OP_BMAP:                  unsafe.Sizeof(_BmapOut{}),
+		_OP_BMAP:                  unsafe.Sizeof(BmapOut{}),
 		_OP_IOCTL:                 unsafe.Sizeof(IoctlOut{}),
-		_OP_POLL:                  unsafe.Sizeof(_PollOut{}),
+		_OP_POLL:                  unsafe.Sizeof(PollOut{}),
 		_OP_NOTIFY_INVAL_ENTRY:    unsafe.Sizeof(NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INVAL_INODE:    unsafe.Sizeof(NotifyInvalInodeOut{}),
 		_OP_NOTIFY_STORE_CACHE:    unsafe.Sizeof(NotifyStoreOut{}),
 		_OP_NOTIFY_RETRIEVE_CACHE: unsafe.Sizeof(NotifyRetrieveOut{}),
 		_OP_NOTIFY_DELETE:         unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_NOTIFY_POLL:           unsafe.Sizeof(NotifyPollWakeupOut{}),
 		_OP_LSEEK:                 unsafe.Sizeof(LseekOut{}),
 		_OP_COPY_FILE_RANGE:       unsafe.Sizeof(WriteOut{}),
+		_OP_TMPFILE:               unsafe.Sizeof(CreateOut{}),
+		_OP_STATX:                 unsafe.Sizeof(StatxOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
@@ -720,6 +933,8 @@ func init() {
 		_OP_CREATE:                "CREATE",
 		_OP_INTERRUPT:             "INTERRUPT",
 		_OP_BMAP:                  "BMAP",
+		_OP_SETUPMAPPING:          "SETUPMAPPING",
+		_OP_REMOVEMAPPING:         "REMOVEMAPPING",
 		_OP_DESTROY:               "DESTROY",
 		_OP_IOCTL:                 "IOCTL",
 		_OP_POLL:                  "POLL",
@@ -729,11 +944,17 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    "NOTIFY_STORE",
 		_OP_NOTIFY_RETRIEVE_CACHE: "NOTIFY_RETRIEVE",
 		_OP_NOTIFY_DELETE:         "NOTIFY_DELETE",
+		_OP_NOTIFY_RESEND:         "NOTIFY_RESEND",
+		_OP_NOTIFY_POLL:           "NOTIFY_POLL",
+		_OP_NOTIFY_RAW:            "NOTIFY",
 		_OP_FALLOCATE:             "FALLOCATE",
 		_OP_READDIRPLUS:           "READDIRPLUS",
 		_OP_RENAME2:               "RENAME2",
 		_OP_LSEEK:                 "LSEEK",
 		_OP_COPY_FILE_RANGE:       "COPY_FILE_RANGE",
+		_OP_SYNCFS:                "SYNCFS",
+		_OP_TMPFILE:               "TMPFILE",
+		_OP_STATX:                 "STATX",
 	} {
 		operationHandlers[op].Name = v
 	}
@@ -775,6 +996,9 @@ func init() {
 		_OP_STATFS:          doStatFs,
 		_OP_IOCTL:           doIoctl,
 		_OP_POLL:            doPoll,
+		_OP_BMAP:            doBmap,
+		_OP_SETUPMAPPING:    doSetupMapping,
+		_OP_REMOVEMAPPING:   doRemoveMapping,
 		_OP_DESTROY:         doDestroy,
 		_OP_NOTIFY_REPLY:    doNotifyReply,
 		_OP_FALLOCATE:       doFallocate,
@@ -783,13 +1007,17 @@ func init() {
 		_OP_INTERRUPT:       doInterrupt,
 		_OP_COPY_FILE_RANGE: doCopyFileRange,
 		_OP_LSEEK:           doLseek,
+		_OP_SYNCFS:          doSyncFs,
+		_OP_TMPFILE:         doTmpfile,
+		_OP_STATX:           doStatx,
 	} {
 		handler := v
+		operationHandlers[op].FuncName = runtime.FuncForPC(reflect.ValueOf(v).Pointer()).Name()
 		operationHandlers[op].Func = func(s *Server, r *request) {
 			defer func() {
 				if e := recover(); e != nil {
 					r.status = EIO
-					log.Printf("raw filesystem recovered, io error: %v\nstacktrace: \n%s", e, string(debug.Stack()))
+					s.errorf("raw filesystem recovered, io error: %v\nstacktrace: \n%s", e, string(debug.Stack()))
 				}
 			}()
 			handler(s, r)
@@ -812,11 +1040,17 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    func(ptr unsafe.Pointer) interface{} { return (*NotifyStoreOut)(ptr) },
 		_OP_NOTIFY_RETRIEVE_CACHE: func(ptr unsafe.Pointer) interface{} { return (*NotifyRetrieveOut)(ptr) },
 		_OP_NOTIFY_DELETE:         func(ptr unsafe.Pointer) interface{} { return (*NotifyInvalDeleteOut)(ptr) },
+		_OP_NOTIFY_POLL:           func(ptr unsafe.Pointer) interface{} { return (*NotifyPollWakeupOut)(ptr) },
 		_OP_STATFS:                func(ptr unsafe.Pointer) interface{} { return (*StatfsOut)(ptr) },
 		_OP_SYMLINK:               func(ptr unsafe.Pointer) interface{} { return (*EntryOut)(ptr) },
 		_OP_GETLK:                 func(ptr unsafe.Pointer) interface{} { return (*LkOut)(ptr) },
 		_OP_LSEEK:                 func(ptr unsafe.Pointer) interface{} { return (*LseekOut)(ptr) },
+		_OP_IOCTL:                 func(ptr unsafe.Pointer) interface{} { return (*IoctlOut)(ptr) },
+		_OP_POLL:                  func(ptr unsafe.Pointer) interface{} { return (*PollOut)(ptr) },
+		_OP_BMAP:                  func(ptr unsafe.Pointer) interface{} { return (*BmapOut)(ptr) },
 		_OP_COPY_FILE_RANGE:       func(ptr unsafe.Pointer) interface{} { return (*WriteOut)(ptr) },
+		_OP_TMPFILE:               func(ptr unsafe.Pointer) interface{} { return (*CreateOut)(ptr) },
+		_OP_STATX:                 func(ptr unsafe.Pointer) interface{} { return (*StatxOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -831,7 +1065,10 @@ func init() {
 		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
 		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
 		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*IoctlIn)(ptr) },
-		_OP_POLL:            func(ptr unsafe.Pointer) interface{} { return (*_PollIn)(ptr) },
+		_OP_POLL:            func(ptr unsafe.Pointer) interface{} { return (*PollIn)(ptr) },
+		_OP_BMAP:            func(ptr unsafe.Pointer) interface{} { return (*BmapIn)(ptr) },
+		_OP_SETUPMAPPING:    func(ptr unsafe.Pointer) interface{} { return (*SetupMappingIn)(ptr) },
+		_OP_REMOVEMAPPING:   func(ptr unsafe.Pointer) interface{} { return (*RemoveMappingIn)(ptr) },
 		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
 		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
 		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
@@ -856,6 +1093,9 @@ func init() {
 		_OP_INTERRUPT:       func(ptr unsafe.Pointer) interface{} { return (*InterruptIn)(ptr) },
 		_OP_LSEEK:           func(ptr unsafe.Pointer) interface{} { return (*LseekIn)(ptr) },
 		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*CopyFileRangeIn)(ptr) },
+		_OP_SYNCFS:          func(ptr unsafe.Pointer) interface{} { return (*SyncFsIn)(ptr) },
+		_OP_TMPFILE:         func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
+		_OP_STATX:           func(ptr unsafe.Pointer) interface{} { return (*StatxIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -879,6 +1119,14 @@ func init() {
 		operationHandlers[op].FileNames = count
 	}
 
+	mutatingOps := []uint32{_OP_SETATTR, _OP_SYMLINK, _OP_MKNOD, _OP_MKDIR,
+		_OP_UNLINK, _OP_RMDIR, _OP_RENAME, _OP_RENAME2, _OP_LINK,
+		_OP_WRITE, _OP_SETXATTR, _OP_REMOVEXATTR, _OP_CREATE,
+		_OP_FALLOCATE, _OP_COPY_FILE_RANGE, _OP_TMPFILE}
+	for _, op := range mutatingOps {
+		operationHandlers[op].Mutates = true
+	}
+
 	var r request
 	sizeOfOutHeader := unsafe.Sizeof(OutHeader{})
 	for code, h := range operationHandlers {
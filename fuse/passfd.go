@@ -4,6 +4,8 @@ import (
 	"net"
 	"os"
 	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/internal"
 )
 
 // Get receives file descriptors from a Unix domain socket.
@@ -74,12 +76,15 @@ func putFd(via *net.UnixConn, msg []byte, fds ...int) error {
 	return syscall.Sendmsg(socket, msg, rights, nil, 0)
 }
 
-func sendFuseFd(path string, msg []byte, fd int) error {
+func sendFuseFd(path string, msg []byte, fd int, allowed []uint32) error {
 	conn, err := net.Dial("unix", path)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	if err := internal.CheckPeer(conn.(*net.UnixConn), allowed); err != nil {
+		return err
+	}
 	_, fds, err := getFd(conn.(*net.UnixConn), 2)
 	if err != nil {
 		return err
@@ -90,7 +95,7 @@ func sendFuseFd(path string, msg []byte, fd int) error {
 	return putFd(conn.(*net.UnixConn), msg, fd)
 }
 
-func closeFuseFd() error {
+func closeFuseFd(allowed []uint32) error {
 	path := os.Getenv("_FUSE_FD_COMM")
 	if path == "" {
 		return nil
@@ -101,6 +106,9 @@ func closeFuseFd() error {
 	}
 	defer c.Close()
 	via := c.(*net.UnixConn)
+	if err := internal.CheckPeer(via, allowed); err != nil {
+		return err
+	}
 	_, fds, err := getFd(via, 2)
 	if err != nil {
 		return err
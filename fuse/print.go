@@ -13,8 +13,13 @@ import (
 
 var (
 	writeFlagNames = map[int64]string{
-		WRITE_CACHE:     "CACHE",
-		WRITE_LOCKOWNER: "LOCKOWNER",
+		WRITE_CACHE:        "CACHE",
+		WRITE_LOCKOWNER:    "LOCKOWNER",
+		WRITE_KILL_SUIDGID: "KILL_SUIDGID",
+	}
+	setupMappingFlagNames = map[int64]string{
+		SETUPMAPPING_FLAG_WRITE: "WRITE",
+		SETUPMAPPING_FLAG_READ:  "READ",
 	}
 	readFlagNames = map[int64]string{
 		READ_LOCKOWNER: "LOCKOWNER",
@@ -46,9 +51,18 @@ var (
 		CAP_CACHE_SYMLINKS:      "CACHE_SYMLINKS",
 		CAP_NO_OPENDIR_SUPPORT:  "NO_OPENDIR_SUPPORT",
 		CAP_EXPLICIT_INVAL_DATA: "EXPLICIT_INVAL_DATA",
+		CAP_MAP_ALIGNMENT:       "MAP_ALIGNMENT",
+		CAP_SUBMOUNTS:           "SUBMOUNTS",
+		CAP_HANDLE_KILLPRIV_V2:  "HANDLE_KILLPRIV_V2",
+		CAP_SETXATTR_EXT:        "SETXATTR_EXT",
+		CAP_INIT_EXT:            "INIT_EXT",
+		CAP_PASSTHROUGH:         "PASSTHROUGH",
+		CAP_HAS_RESEND:          "HAS_RESEND",
+		CAP_OVER_IO_URING:       "OVER_IO_URING",
 	}
 	releaseFlagNames = map[int64]string{
-		RELEASE_FLUSH: "FLUSH",
+		RELEASE_FLUSH:        "FLUSH",
+		RELEASE_FLOCK_UNLOCK: "FLOCK_UNLOCK",
 	}
 	openFlagNames = map[int64]string{
 		int64(os.O_WRONLY):        "WRONLY",
@@ -66,11 +80,30 @@ var (
 		int64(syscall.O_DIRECTORY): "DIRECTORY",
 	}
 	fuseOpenFlagNames = map[int64]string{
-		FOPEN_DIRECT_IO:   "DIRECT",
-		FOPEN_KEEP_CACHE:  "CACHE",
-		FOPEN_NONSEEKABLE: "NONSEEK",
-		FOPEN_CACHE_DIR:   "CACHE_DIR",
-		FOPEN_STREAM:      "STREAM",
+		FOPEN_DIRECT_IO:              "DIRECT",
+		FOPEN_KEEP_CACHE:             "CACHE",
+		FOPEN_NONSEEKABLE:            "NONSEEK",
+		FOPEN_CACHE_DIR:              "CACHE_DIR",
+		FOPEN_STREAM:                 "STREAM",
+		FOPEN_NOFLUSH:                "NOFLUSH",
+		FOPEN_PARALLEL_DIRECT_WRITES: "PARALLEL_DIRECT_WRITES",
+		FOPEN_PASSTHROUGH:            "PASSTHROUGH",
+	}
+	fallocateFlagNames = map[int64]string{
+		FALLOC_FL_KEEP_SIZE:      "KEEP_SIZE",
+		FALLOC_FL_PUNCH_HOLE:     "PUNCH_HOLE",
+		FALLOC_FL_COLLAPSE_RANGE: "COLLAPSE_RANGE",
+		FALLOC_FL_ZERO_RANGE:     "ZERO_RANGE",
+		FALLOC_FL_INSERT_RANGE:   "INSERT_RANGE",
+		FALLOC_FL_UNSHARE_RANGE:  "UNSHARE_RANGE",
+	}
+	ioctlFlagNames = map[int64]string{
+		FUSE_IOCTL_COMPAT:       "COMPAT",
+		FUSE_IOCTL_UNRESTRICTED: "UNRESTRICTED",
+		FUSE_IOCTL_RETRY:        "RETRY",
+		FUSE_IOCTL_32BIT:        "32BIT",
+		FUSE_IOCTL_DIR:          "DIR",
+		FUSE_IOCTL_COMPAT_X32:   "COMPAT_X32",
 	}
 	accessFlagName = map[int64]string{
 		X_OK: "x",
@@ -140,6 +173,9 @@ func (in *SetAttrIn) string() string {
 	if in.Valid&FATTR_FH != 0 {
 		s = append(s, fmt.Sprintf("fh %d", in.Fh))
 	}
+	if in.Valid&FATTR_KILL_SUIDGID != 0 {
+		s = append(s, "kill_suidgid")
+	}
 	// TODO - FATTR_ATIME_NOW = (1 << 7), FATTR_MTIME_NOW = (1 << 8), FATTR_LOCKOWNER = (1 << 9)
 	return fmt.Sprintf("{%s}", strings.Join(s, ", "))
 }
@@ -152,10 +188,17 @@ func (in *ReleaseIn) string() string {
 }
 
 func (in *OpenIn) string() string {
+	if in.KillSuidGid() {
+		return fmt.Sprintf("{%s KILL_SUIDGID}", flagString(openFlagNames, int64(in.Flags), "O_RDONLY"))
+	}
 	return fmt.Sprintf("{%s}", flagString(openFlagNames, int64(in.Flags), "O_RDONLY"))
 }
 
 func (in *OpenOut) string() string {
+	if in.OpenFlags&FOPEN_PASSTHROUGH != 0 {
+		return fmt.Sprintf("{Fh %d %s Backing %d}", in.Fh,
+			flagString(fuseOpenFlagNames, int64(in.OpenFlags), ""), in.BackingId)
+	}
 	return fmt.Sprintf("{Fh %d %s}", in.Fh,
 		flagString(fuseOpenFlagNames, int64(in.OpenFlags), ""))
 }
@@ -163,13 +206,13 @@ func (in *OpenOut) string() string {
 func (in *InitIn) string() string {
 	return fmt.Sprintf("{%d.%d Ra 0x%x %s}",
 		in.Major, in.Minor, in.MaxReadAhead,
-		flagString(initFlagNames, int64(in.Flags), ""))
+		flagString(initFlagNames, int64(in.Flags64()), ""))
 }
 
 func (o *InitOut) string() string {
 	return fmt.Sprintf("{%d.%d Ra 0x%x %s %d/%d Wr 0x%x Tg 0x%x}",
 		o.Major, o.Minor, o.MaxReadAhead,
-		flagString(initFlagNames, int64(o.Flags), ""),
+		flagString(initFlagNames, int64(o.Flags)|int64(o.Flags2)<<32, ""),
 		o.CongestionThreshold, o.MaxBackground, o.MaxWrite,
 		o.TimeGran)
 }
@@ -179,6 +222,9 @@ func (s *FsyncIn) string() string {
 }
 
 func (in *SetXAttrIn) string() string {
+	if in.KillSgid() {
+		return fmt.Sprintf("{sz %d f%o KILL_SGID}", in.Size, in.Flags)
+	}
 	return fmt.Sprintf("{sz %d f%o}", in.Size, in.Flags)
 }
 
@@ -231,7 +277,7 @@ func (o *StatfsOut) string() string {
 }
 
 func (o *NotifyInvalEntryOut) string() string {
-	return fmt.Sprintf("{parent i%d sz %d}", o.Parent, o.NameLen)
+	return fmt.Sprintf("{parent i%d sz %d flags 0x%x}", o.Parent, o.NameLen, o.Flags)
 }
 
 func (o *NotifyInvalInodeOut) string() string {
@@ -255,8 +301,8 @@ func (i *NotifyRetrieveIn) string() string {
 }
 
 func (f *FallocateIn) string() string {
-	return fmt.Sprintf("{Fh %d [%d +%d) mod 0%o}",
-		f.Fh, f.Offset, f.Length, f.Mode)
+	return fmt.Sprintf("{Fh %d [%d +%d) %s}",
+		f.Fh, f.Offset, f.Length, flagString(fallocateFlagNames, int64(f.Mode), "0"))
 }
 
 func (f *LinkIn) string() string {
@@ -293,6 +339,55 @@ func (o *LseekOut) string() string {
 	return fmt.Sprintf("{%d}", o.Offset)
 }
 
+func (in *IoctlIn) string() string {
+	return fmt.Sprintf("{Fh %d cmd 0x%x arg 0x%x in %d out %d %s}",
+		in.Fh, in.Cmd, in.Arg, in.InSize, in.OutSize, flagString(ioctlFlagNames, int64(in.Flags), ""))
+}
+
+func (o *IoctlOut) string() string {
+	return fmt.Sprintf("{result %d %s iovs %d/%d}",
+		o.Result, flagString(ioctlFlagNames, int64(o.Flags), ""), o.InIovs, o.OutIovs)
+}
+
+func (in *PollIn) string() string {
+	return fmt.Sprintf("{Fh %d Kh %d events %x flags %x}", in.Fh, in.Kh, in.Events, in.Flags)
+}
+
+func (o *PollOut) string() string {
+	return fmt.Sprintf("{revents %x}", o.Revents)
+}
+
+func (o *NotifyPollWakeupOut) string() string {
+	return fmt.Sprintf("{Kh %d}", o.Kh)
+}
+
+func (in *BmapIn) string() string {
+	return fmt.Sprintf("{block %d blocksize %d}", in.Block, in.Blocksize)
+}
+
+func (o *BmapOut) string() string {
+	return fmt.Sprintf("{block %d}", o.Block)
+}
+
+func (in *SetupMappingIn) string() string {
+	return fmt.Sprintf("{Fh %d [%d +%d) moff %d %s}", in.Fh, in.Foffset, in.Len, in.Moffset,
+		flagString(setupMappingFlagNames, int64(in.Flags), ""))
+}
+
+func (in *RemoveMappingIn) string() string {
+	return fmt.Sprintf("{count %d}", in.Count)
+}
+
+func (in *StatxIn) string() string {
+	return fmt.Sprintf("{Fh %d mask 0x%x flags 0x%x}", in.Fh, in.SxMask, in.SxFlags)
+}
+
+func (o *StatxOut) string() string {
+	return fmt.Sprintf("{tA=%gs mask 0x%x M0%o SZ=%d L=%d %d:%d i%d B %d.%09d}",
+		ft(o.AttrValid, o.AttrValidNsec), o.Mask, o.Mode, o.Size, o.Nlink,
+		o.Uid, o.Gid, o.Ino, o.Btime.Sec, o.Btime.Nsec)
+}
+
 // Print pretty prints FUSE data types for kernel communication
 func Print(obj interface{}) string {
 	t, ok := obj.(interface {
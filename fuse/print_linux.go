@@ -31,9 +31,13 @@ func (a *Attr) string() string {
 }
 
 func (in *CreateIn) string() string {
+	kill := ""
+	if in.KillSuidGid() {
+		kill = " KILL_SUIDGID"
+	}
 	return fmt.Sprintf(
-		"{0%o [%s] (0%o)}", in.Mode,
-		flagString(openFlagNames, int64(in.Flags), "O_RDONLY"), in.Umask)
+		"{0%o [%s] (0%o)%s}", in.Mode,
+		flagString(openFlagNames, int64(in.Flags), "O_RDONLY"), in.Umask, kill)
 }
 
 func (in *GetAttrIn) string() string {
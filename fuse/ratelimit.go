@@ -0,0 +1,304 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// RateLimitOptions throttles the requests of each caller, see
+// MountOptions.RateLimit. On a host that many users share, it keeps
+// the workload of one of them from monopolizing the file system.
+//
+// Requests are held before they are passed to the file system until
+// the limits of their caller allow them; if a request is interrupted
+// meanwhile, it fails with EINTR. Held requests wait on goroutines
+// of their own, so they do not keep readers or the handlers of the
+// Scheduler from serving other callers; requests over io_uring and
+// virtio-fs are held by their handler, which must answer them.
+// Forgets, interrupts and releases are not limited. A zero limit
+// means unlimited.
+type RateLimitOptions struct {
+	// MaxIOPS is the number of requests per second that a caller
+	// may make. Idle callers may burst up to a second's worth.
+	MaxIOPS int
+
+	// MaxBytesPerSecond is the number of bytes that a caller may
+	// READ and WRITE per second. Idle callers may burst up to a
+	// second's worth.
+	MaxBytesPerSecond int64
+
+	// MaxConcurrent is the number of requests of a caller that the
+	// file system may serve at the same time.
+	MaxConcurrent int
+
+	// If PerPID is set, limits apply to each process. Otherwise,
+	// they apply to each UID. With PerPID, the WRITEs of the
+	// writeback cache, which the kernel sends with pid 0, all
+	// share one limit.
+	PerPID bool
+}
+
+// maxIdleCallers is the number of callers above which the state of
+// idle callers is dropped.
+const maxIdleCallers = 1024
+
+// rateLimiter enforces RateLimitOptions.
+type rateLimiter struct {
+	opts RateLimitOptions
+
+	mu      sync.Mutex
+	callers map[uint32]*callerLimit
+}
+
+// callerLimit is the state of a caller. Its fields but sem are
+// protected by rateLimiter.mu.
+type callerLimit struct {
+	// users counts the requests that hold the state.
+	users int
+
+	// ops and bytes are the tokens of the buckets for MaxIOPS and
+	// MaxBytesPerSecond, as of last. They are negative if
+	// requests wait for them.
+	ops, bytes float64
+	last       time.Time
+
+	// sem holds a token for each request that is served, if
+	// MaxConcurrent is set.
+	sem chan struct{}
+}
+
+func newRateLimiter(opts *RateLimitOptions) *rateLimiter {
+	return &rateLimiter{
+		opts:    *opts,
+		callers: map[uint32]*callerLimit{},
+	}
+}
+
+// limited returns whether requests with the given opcode are limited.
+func limited(opcode uint32) bool {
+	switch opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_NOTIFY_REPLY,
+		_OP_INIT, _OP_DESTROY, _OP_RELEASE, _OP_RELEASEDIR:
+		return false
+	}
+	return true
+}
+
+// transferSize returns the number of bytes that req reads or writes.
+func transferSize(req *request) int64 {
+	switch req.inHeader.Opcode {
+	case _OP_READ:
+		return int64((*ReadIn)(req.inData).Size)
+	case _OP_WRITE:
+		return int64(req.inHeader.Length) - int64(unsafe.Sizeof(WriteIn{}))
+	}
+	return 0
+}
+
+// reserve takes the tokens for req from the buckets of its caller,
+// and returns the state of the caller and how long req must wait
+// until the tokens accrue.
+func (l *rateLimiter) reserve(req *request) (*callerLimit, time.Duration) {
+	key := req.inHeader.Caller.Uid
+	if l.opts.PerPID {
+		key = req.inHeader.Caller.Pid
+	}
+	size := float64(transferSize(req))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.callers[key]
+	if c == nil {
+		if len(l.callers) >= maxIdleCallers {
+			l.pruneLocked()
+		}
+		c = &callerLimit{
+			ops:   float64(l.opts.MaxIOPS),
+			bytes: float64(l.opts.MaxBytesPerSecond),
+			last:  time.Now(),
+		}
+		if l.opts.MaxConcurrent > 0 {
+			c.sem = make(chan struct{}, l.opts.MaxConcurrent)
+		}
+		l.callers[key] = c
+	}
+	c.users++
+	l.refillLocked(c, time.Now())
+
+	var wait time.Duration
+	if l.opts.MaxIOPS > 0 {
+		c.ops--
+		if c.ops < 0 {
+			wait = time.Duration(-c.ops / float64(l.opts.MaxIOPS) * float64(time.Second))
+		}
+	}
+	if l.opts.MaxBytesPerSecond > 0 {
+		c.bytes -= size
+		if c.bytes < 0 {
+			if w := time.Duration(-c.bytes / float64(l.opts.MaxBytesPerSecond) * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	return c, wait
+}
+
+// tryAcquire returns whether req may be served right away. If it
+// returns false, acquire must be called to wait.
+func (l *rateLimiter) tryAcquire(c *callerLimit, wait time.Duration) bool {
+	if wait > 0 {
+		return false
+	}
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// acquire waits until the limits of the caller of req allow it, after
+// reserve. If it returns OK, release must be called with c once the
+// request is served.
+func (l *rateLimiter) acquire(req *request, c *callerLimit, wait time.Duration) Status {
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.cancel:
+			t.Stop()
+			l.mu.Lock()
+			// Give back the tokens that were not used.
+			if l.opts.MaxIOPS > 0 {
+				c.ops++
+			}
+			if l.opts.MaxBytesPerSecond > 0 {
+				c.bytes += float64(transferSize(req))
+			}
+			c.users--
+			l.mu.Unlock()
+			return EINTR
+		}
+	}
+
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+		case <-req.cancel:
+			l.mu.Lock()
+			c.users--
+			l.mu.Unlock()
+			return EINTR
+		}
+	}
+	return OK
+}
+
+// release ends a request that acquire let through.
+func (l *rateLimiter) release(c *callerLimit) {
+	if c.sem != nil {
+		<-c.sem
+	}
+	l.mu.Lock()
+	c.users--
+	l.mu.Unlock()
+}
+
+// refillLocked adds the tokens that accrued since c.last, up to a
+// second's worth.
+func (l *rateLimiter) refillLocked(c *callerLimit, now time.Time) {
+	dt := now.Sub(c.last).Seconds()
+	c.last = now
+	if max := float64(l.opts.MaxIOPS); max > 0 {
+		c.ops += dt * max
+		if c.ops > max {
+			c.ops = max
+		}
+	}
+	if max := float64(l.opts.MaxBytesPerSecond); max > 0 {
+		c.bytes += dt * max
+		if c.bytes > max {
+			c.bytes = max
+		}
+	}
+}
+
+// pruneLocked drops the callers that have no requests and full
+// buckets.
+func (l *rateLimiter) pruneLocked() {
+	now := time.Now()
+	for key, c := range l.callers {
+		if c.users > 0 {
+			continue
+		}
+		l.refillLocked(c, now)
+		if c.ops >= float64(l.opts.MaxIOPS) && c.bytes >= float64(l.opts.MaxBytesPerSecond) {
+			delete(l.callers, key)
+		}
+	}
+}
+
+// dispatchLimited dispatches req if the rate limits allow it right
+// away, or once they do for requests of io_uring and virtio, and
+// returns true. Otherwise, it hands req to holdLimited, and
+// returns false; the caller must then leave req alone.
+func (ms *Server) dispatchLimited(req *request) bool {
+	if !limited(req.inHeader.Opcode) {
+		ms.dispatchUndestroyed(req)
+		return true
+	}
+	c, wait := ms.limiter.reserve(req)
+	if !ms.limiter.tryAcquire(c, wait) {
+		if req.ring == nil && req.virtq == nil {
+			go ms.holdLimited(req, c, wait)
+			return false
+		}
+		// The io_uring and virtio transports answer the request
+		// once handleRequest returns, so it is held on their
+		// goroutine instead.
+		if st := ms.acquireLimited(req, c, wait); !st.Ok() {
+			req.status = st
+			return true
+		}
+	}
+	defer ms.limiter.release(c)
+	ms.dispatchUndestroyed(req)
+	return true
+}
+
+// holdLimited waits until the rate limits allow req, serves it, and
+// writes the reply. It runs on a goroutine of its own, so waiting
+// does not take up a reader or handler.
+func (ms *Server) holdLimited(req *request, c *callerLimit, wait time.Duration) {
+	if st := ms.acquireLimited(req, c, wait); !st.Ok() {
+		req.status = st
+	} else {
+		ms.dispatchUndestroyed(req)
+		ms.limiter.release(c)
+	}
+	ms.sendReply(req)
+}
+
+// acquireLimited waits in limiter.acquire, and marks req as parked
+// meanwhile, so the watchdog does not count the wait against
+// MountOptions.RequestTimeout.
+func (ms *Server) acquireLimited(req *request, c *callerLimit, wait time.Duration) Status {
+	ms.reqMu.Lock()
+	req.limitedSince = time.Now()
+	ms.reqMu.Unlock()
+
+	st := ms.limiter.acquire(req, c, wait)
+
+	ms.reqMu.Lock()
+	req.limitWait += time.Since(req.limitedSince)
+	req.limitedSince = time.Time{}
+	ms.reqMu.Unlock()
+	return st
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func limitedRequest(opcode uint32, uid uint32, size uint32) *request {
+	in := &ReadIn{
+		InHeader: InHeader{Opcode: opcode, Caller: Caller{Owner: Owner{Uid: uid}, Pid: 100 + uid}},
+		Size:     size,
+	}
+	return &request{
+		inHeader: &in.InHeader,
+		inData:   unsafe.Pointer(in),
+		cancel:   make(chan struct{}),
+	}
+}
+
+// acquire waits until l lets req through.
+func acquire(l *rateLimiter, req *request) (*callerLimit, Status) {
+	c, wait := l.reserve(req)
+	return c, l.acquire(req, c, wait)
+}
+
+func TestRateLimitIOPS(t *testing.T) {
+	l := newRateLimiter(&RateLimitOptions{MaxIOPS: 20})
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		c, st := acquire(l, limitedRequest(_OP_GETATTR, 1, 0))
+		if !st.Ok() {
+			t.Fatal(st)
+		}
+		l.release(c)
+	}
+	if dt := time.Since(start); dt > 40*time.Millisecond {
+		t.Errorf("burst of 20 requests took %v", dt)
+	}
+
+	start = time.Now()
+	c, _ := acquire(l, limitedRequest(_OP_GETATTR, 2, 0))
+	l.release(c)
+	if dt := time.Since(start); dt > 40*time.Millisecond {
+		t.Errorf("request of another UID took %v", dt)
+	}
+
+	c, _ = acquire(l, limitedRequest(_OP_GETATTR, 1, 0))
+	l.release(c)
+	if dt := time.Since(start); dt < 40*time.Millisecond {
+		t.Errorf("21st request took %v, want about 50ms", dt)
+	}
+}
+
+func TestRateLimitBytes(t *testing.T) {
+	l := newRateLimiter(&RateLimitOptions{MaxBytesPerSecond: 1000})
+	c, _ := acquire(l, limitedRequest(_OP_READ, 1, 1000))
+	l.release(c)
+
+	req := limitedRequest(_OP_READ, 1, 1000)
+	time.AfterFunc(20*time.Millisecond, func() { close(req.cancel) })
+	start := time.Now()
+	if _, st := acquire(l, req); st != EINTR {
+		t.Errorf("got %v for interrupted READ, want EINTR", st)
+	}
+	if dt := time.Since(start); dt > 500*time.Millisecond {
+		t.Errorf("interrupted READ took %v", dt)
+	}
+
+	// The interrupted READ gave its bytes back.
+	l.mu.Lock()
+	bytes := l.callers[1].bytes
+	l.mu.Unlock()
+	if bytes < -100 {
+		t.Errorf("got %v bytes in the bucket", bytes)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	l := newRateLimiter(&RateLimitOptions{MaxConcurrent: 1, PerPID: true})
+	c1, _ := acquire(l, limitedRequest(_OP_GETATTR, 1, 0))
+
+	done := make(chan *callerLimit)
+	go func() {
+		c, _ := acquire(l, limitedRequest(_OP_GETATTR, 1, 0))
+		done <- c
+	}()
+
+	c2, _ := acquire(l, limitedRequest(_OP_GETATTR, 2, 0))
+	l.release(c2)
+
+	select {
+	case <-done:
+		t.Fatal("second request of the same process was not held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release(c1)
+	l.release(<-done)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked()
+	if len(l.callers) != 0 {
+		t.Errorf("idle callers were not pruned: %v", l.callers)
+	}
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{RateLimit: &RateLimitOptions{MaxIOPS: -1}}); err == nil {
+		t.Error("newServer accepted a negative MaxIOPS")
+	}
+	if limited(_OP_FORGET) || limited(_OP_RELEASE) || !limited(_OP_LOOKUP) {
+		t.Error("wrong requests are limited")
+	}
+}
+
+func TestRateLimitDoesNotHoldReader(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{RateLimit: &RateLimitOptions{MaxIOPS: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	handle := func(uid uint32, unique uint64) {
+		in := InHeader{Length: uint32(unsafe.Sizeof(InHeader{})), Opcode: _OP_STATFS, Unique: unique, Caller: Caller{Owner: Owner{Uid: uid}}}
+		req := ms.reqPool.Get().(*request)
+		req.setInput((*[unsafe.Sizeof(InHeader{})]byte)(unsafe.Pointer(&in))[:])
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		ms.reqMu.Lock()
+		req.inflightIndex = len(ms.reqInflight)
+		ms.reqInflight = append(ms.reqInflight, req)
+		ms.reqMu.Unlock()
+		ms.handleRequest(req)
+	}
+	readReply := func() uint64 {
+		out := make([]byte, 4096)
+		if _, err := syscall.Read(fds[0], out); err != nil {
+			t.Fatal(err)
+		}
+		return (*OutHeader)(unsafe.Pointer(&out[0])).Unique
+	}
+
+	// UID 1 uses up its burst; its next request is held, without
+	// keeping the handler from serving UID 2.
+	for i := 1; i <= 5; i++ {
+		handle(1, uint64(i))
+		readReply()
+	}
+	start := time.Now()
+	handle(1, 6)
+	handle(2, 7)
+	if dt := time.Since(start); dt > 100*time.Millisecond {
+		t.Errorf("handlers were held for %v", dt)
+	}
+	if got := readReply(); got != 7 {
+		t.Errorf("got reply to %d first, want 7", got)
+	}
+	if got := readReply(); got != 6 {
+		t.Errorf("got reply to %d, want 6", got)
+	}
+	if dt := time.Since(start); dt < 100*time.Millisecond {
+		t.Errorf("held request was answered after %v, want about 200ms", dt)
+	}
+}
+
+func TestRateLimitRingRequest(t *testing.T) {
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{RateLimit: &RateLimitOptions{MaxIOPS: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newReq := func(unique uint64) *request {
+		in := InHeader{Length: uint32(unsafe.Sizeof(InHeader{})), Opcode: _OP_STATFS, Unique: unique, Caller: Caller{Owner: Owner{Uid: 1}}}
+		req := ms.reqPool.Get().(*request)
+		req.setInput((*[unsafe.Sizeof(InHeader{})]byte)(unsafe.Pointer(&in))[:])
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatal(st)
+		}
+		req.handler = ms.handler(_OP_STATFS)
+		return req
+	}
+	for i := 1; i <= 5; i++ {
+		if !ms.dispatchLimited(newReq(uint64(i))) {
+			t.Fatalf("request %d within the burst was held", i)
+		}
+	}
+
+	// The transport answers once handleRequest returns, so a ring
+	// request must be served before dispatchLimited returns.
+	req := newReq(6)
+	req.ring = &uringEntry{}
+	start := time.Now()
+	if !ms.dispatchLimited(req) {
+		t.Fatal("ring request was handed to another goroutine")
+	}
+	if dt := time.Since(start); dt < 100*time.Millisecond {
+		t.Errorf("ring request was served after %v, want about 200ms", dt)
+	}
+	// The default file system answers STATFS with ENOSYS.
+	if req.status != ENOSYS {
+		t.Errorf("got status %v, want the file system's ENOSYS", req.status)
+	}
+}
@@ -7,7 +7,6 @@ package fuse
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 	"unsafe"
@@ -24,6 +23,15 @@ type request struct {
 	// written under Server.reqMu
 	interrupted bool
 
+	// Set once the request was reported as timed out, see
+	// MountOptions.RequestTimeout. Written under Server.reqMu.
+	timedOut bool
+
+	// Set by whoever writes the reply, the handler or the
+	// watchdog, if MountOptions.RequestTimeoutEIO is set. Accessed
+	// atomically.
+	replied int32
+
 	inputBuf []byte
 
 	// These split up inputBuf.
@@ -43,9 +51,48 @@ type request struct {
 	// Done() on it.
 	readResult ReadResult
 
-	// Start timestamp for timing info.
+	// The io_uring entry that delivered the request, if any.
+	ring *uringEntry
+
+	// The virtqueue element that delivered the request, if any.
+	virtq *virtqElem
+
+	// The device clone that the request was read from, if any. The
+	// reply must be written to the same device.
+	clone *devClone
+
+	// Time the request was read from the kernel, if latencies are
+	// recorded.
 	startTime time.Time
 
+	// Estimated time spent in the kernel queue, see queueClock.
+	queueLatency time.Duration
+
+	// Set while the request waits for MountOptions.RateLimit, and
+	// the total time it waited. Written under Server.reqMu.
+	limitedSince time.Time
+	limitWait    time.Duration
+
+	// Set if the request is logged, see Server.SetDebug.
+	debug bool
+
+	// Ends the span of the request, see RequestTracer. traced is
+	// set if the request has a context in requestContexts.
+	traceEnd func(Status, int)
+	traced   bool
+
+	// traceID is the correlation ID of the request, see
+	// MountOptions.TraceIDs.
+	traceID string
+
+	// The data of a WRITE that was left in a pipe, see
+	// WriteSplicer.
+	writeData *WriteData
+
+	// Holds the input of SETXATTR if the kernel sent the shorter
+	// struct, see setXAttrInCompatSize.
+	setXAttrIn SetXAttrIn
+
 	// All information pertaining to opcode of this request.
 	handler *operationHandler
 
@@ -75,8 +122,18 @@ func (r *request) clear() {
 	r.fdData = nil
 	r.slices = nil
 	r.startTime = time.Time{}
+	r.queueLatency = 0
+	r.limitedSince = time.Time{}
+	r.limitWait = 0
 	r.handler = nil
 	r.readResult = nil
+	r.ring = nil
+	r.virtq = nil
+	r.clone = nil
+	r.debug = false
+	r.traceID = ""
+	r.timedOut = false
+	r.replied = 0
 }
 
 func (r *request) InputDebug() string {
@@ -105,9 +162,9 @@ func (r *request) InputDebug() string {
 		names += fmt.Sprintf("%s %db", data, len(r.arg))
 	}
 
-	return fmt.Sprintf("rx %d: %s n%d %s%s",
+	return fmt.Sprintf("rx %d: %s n%d %s%s%s",
 		r.inHeader.Unique, operationName(r.inHeader.Opcode), r.inHeader.NodeId,
-		val, names)
+		val, names, r.traceIDDebug())
 }
 
 func (r *request) OutputDebug() string {
@@ -149,8 +206,19 @@ func (r *request) OutputDebug() string {
 	if extraStr != "" {
 		extraStr = ", " + extraStr
 	}
-	return fmt.Sprintf("tx %d:     %v%s",
-		r.inHeader.Unique, r.status, extraStr)
+	timing := ""
+	if !r.startTime.IsZero() {
+		timing = fmt.Sprintf(" (%v, queued %v)", time.Since(r.startTime), r.queueLatency)
+	}
+	return fmt.Sprintf("tx %d:     %v%s%s%s",
+		r.inHeader.Unique, r.status, extraStr, timing, r.traceIDDebug())
+}
+
+func (r *request) traceIDDebug() string {
+	if r.traceID == "" {
+		return ""
+	}
+	return " trace=" + r.traceID
 }
 
 // setInput returns true if it takes ownership of the argument, false if not.
@@ -166,9 +234,10 @@ func (r *request) setInput(input []byte) bool {
 	return true
 }
 
+// parseHeader returns EINVAL if the input is shorter than the
+// header.
 func (r *request) parseHeader() Status {
 	if len(r.inputBuf) < int(unsafe.Sizeof(InHeader{})) {
-		log.Printf("Short read for input header: %v", r.inputBuf)
 		return EINVAL
 	}
 
@@ -176,28 +245,62 @@ func (r *request) parseHeader() Status {
 	return OK
 }
 
-func (r *request) parse() {
+// parse decodes the arguments of the request. If they are malformed,
+// it sets r.status, and returns an error to log.
+func (r *request) parse(kernelSettings InitIn) error {
 	r.arg = r.inputBuf[:]
-	r.handler = getHandler(r.inHeader.Opcode)
 	if r.handler == nil {
-		log.Printf("Unknown opcode %d", r.inHeader.Opcode)
+		r.handler = getHandler(r.inHeader.Opcode)
+	}
+	if r.handler == nil {
 		r.status = ENOSYS
-		return
+		return fmt.Errorf("unknown opcode %d", r.inHeader.Opcode)
 	}
 
-	if len(r.arg) < int(r.handler.InputSize) {
-		log.Printf("Short read for %v: %v", operationName(r.inHeader.Opcode), r.arg)
+	if r.inHeader.Opcode == _OP_INIT && len(r.arg) < int(r.handler.InputSize) &&
+		cap(r.arg) >= int(r.handler.InputSize) {
+		// Kernels before protocol 7.36 send a shorter InitIn
+		// without Flags2. Zero the missing fields.
+		n := len(r.arg)
+		r.arg = r.arg[:r.handler.InputSize]
+		copy(r.arg[n:], zeroOutBuf[:])
+	}
+
+	inputSize := r.handler.InputSize
+	if r.inHeader.Opcode == _OP_SETXATTR && kernelSettings.Flags&CAP_SETXATTR_EXT == 0 {
+		inputSize = setXAttrInCompatSize
+	}
+
+	if len(r.arg) < int(inputSize) {
 		r.status = EIO
-		return
+		return fmt.Errorf("short read for %v: %v", operationName(r.inHeader.Opcode), r.arg)
 	}
 
-	if r.handler.InputSize > 0 {
+	if inputSize < r.handler.InputSize {
+		// The kernel sent a shorter struct, followed by the
+		// arguments. Copy it, so the missing fields are zero.
+		r.setXAttrIn = SetXAttrIn{}
+		copy((*[unsafe.Sizeof(SetXAttrIn{})]byte)(unsafe.Pointer(&r.setXAttrIn))[:inputSize], r.arg)
+		r.inData = unsafe.Pointer(&r.setXAttrIn)
+		r.arg = r.arg[inputSize:]
+	} else if inputSize > 0 {
 		r.inData = unsafe.Pointer(&r.arg[0])
-		r.arg = r.arg[r.handler.InputSize:]
+		r.arg = r.arg[inputSize:]
 	} else {
 		r.arg = r.arg[unsafe.Sizeof(InHeader{}):]
 	}
 
+	// Request extensions follow the arguments. They are read
+	// through InHeader, and must not end up in the file names.
+	if extLen := int(r.inHeader.ExtensionLength()); extLen > 0 {
+		if extLen > len(r.arg) {
+			r.status = EIO
+			return fmt.Errorf("short read for %v extensions: %v", operationName(r.inHeader.Opcode), r.arg)
+		}
+		r.arg = r.arg[:len(r.arg)-extLen]
+	}
+
+	var err error
 	count := r.handler.FileNames
 	if count > 0 {
 		if count == 1 && r.inHeader.Opcode == _OP_SETXATTR {
@@ -214,15 +317,15 @@ func (r *request) parse() {
 				r.filenames[i] = string(n)
 			}
 			if len(names) != count {
-				log.Println("filename argument mismatch", names, count)
 				r.status = EIO
+				err = fmt.Errorf("filename argument mismatch: %q, want %d", names, count)
 			}
 		}
 	}
 
 	copy(r.outBuf[:r.handler.OutputSize+sizeOfOutHeader],
 		zeroOutBuf[:r.handler.OutputSize+sizeOfOutHeader])
-
+	return err
 }
 
 func (r *request) outData() unsafe.Pointer {
@@ -261,6 +364,34 @@ func (r *request) serializeHeader(flatDataSize int) (header []byte) {
 	return header
 }
 
+// verifyHeader parses back a header produced by serializeHeader, and
+// checks that it is consistent with the request and its payload.
+func (r *request) verifyHeader(header []byte) error {
+	if len(header) < int(sizeOfOutHeader) {
+		return fmt.Errorf("header has %d bytes, want at least %d", len(header), sizeOfOutHeader)
+	}
+	o := (*OutHeader)(unsafe.Pointer(&header[0]))
+	if want := len(header) + r.flatDataSize(); int(o.Length) != want {
+		return fmt.Errorf("header length %d, want %d", o.Length, want)
+	}
+	if o.Status > 0 {
+		// Notification.
+		if o.Unique != 0 {
+			return fmt.Errorf("notification %d has unique %d", o.Status, o.Unique)
+		}
+		return nil
+	}
+	if o.Unique == 0 || o.Unique != r.inHeader.Unique {
+		return fmt.Errorf("reply unique %d, want %d", o.Unique, r.inHeader.Unique)
+	}
+	if o.Status < 0 {
+		if o.Length != uint32(sizeOfOutHeader) {
+			return fmt.Errorf("error %v has a %d byte payload", Status(-o.Status), o.Length-uint32(sizeOfOutHeader))
+		}
+	}
+	return nil
+}
+
 func (r *request) flatDataSize() int {
 	if r.fdData != nil {
 		return r.fdData.Size()
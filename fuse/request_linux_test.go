@@ -0,0 +1,48 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestParseSetXAttr(t *testing.T) {
+	for _, ext := range []bool{false, true} {
+		hdrSize := int(setXAttrInCompatSize)
+		var kernel InitIn
+		if ext {
+			hdrSize = int(unsafe.Sizeof(SetXAttrIn{}))
+			kernel.Flags = CAP_SETXATTR_EXT
+		}
+		arg := "user.attr\x00value"
+		buf := make([]byte, hdrSize+len(arg))
+		in := (*SetXAttrIn)(unsafe.Pointer(&buf[0]))
+		in.Length = uint32(len(buf))
+		in.Opcode = _OP_SETXATTR
+		in.Size = 5
+		if ext {
+			in.SetXAttrFlags = SETXATTR_ACL_KILL_SGID
+		}
+		copy(buf[hdrSize:], arg)
+
+		req := &request{}
+		req.setInput(buf)
+		if st := req.parseHeader(); !st.Ok() {
+			t.Fatalf("parseHeader: %v", st)
+		}
+		req.parse(kernel)
+		if !req.status.Ok() {
+			t.Fatalf("parse: %v", req.status)
+		}
+		got := (*SetXAttrIn)(req.inData)
+		if got.Size != 5 || got.KillSgid() != ext {
+			t.Errorf("ext %v: got %+v", ext, got)
+		}
+		if string(req.arg) != arg || len(req.filenames) != 1 || req.filenames[0] != "user.attr" {
+			t.Errorf("ext %v: got arg %q, names %q", ext, req.arg, req.filenames)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountpointResolver resolves mount points of the form
+// "scheme:name", see MountOptions.MountpointResolvers.
+type MountpointResolver interface {
+	// ResolveMountpoint is passed the name after the scheme. It
+	// returns either an open, already mounted FUSE device, with
+	// dir empty, or a directory to mount on, with fd -1.
+	ResolveMountpoint(name string) (fd int, dir string, err error)
+}
+
+// MountpointResolverFunc adapts a function to a MountpointResolver.
+type MountpointResolverFunc func(name string) (fd int, dir string, err error)
+
+// ResolveMountpoint implements MountpointResolver.
+func (f MountpointResolverFunc) ResolveMountpoint(name string) (int, string, error) {
+	return f(name)
+}
+
+// devFdPrefix marks mount points that name an open file descriptor
+// of a mounted FUSE device, as mount helpers that hand the device to
+// an unprivileged server pass them.
+const devFdPrefix = "/dev/fd/"
+
+// resolveMountpoint resolves the mount point given to NewServer.
+// "/dev/fd/N" resolves to file descriptor N. If the text before the
+// first colon is a scheme in MountOptions.MountpointResolvers, the
+// resolver of the scheme is asked. Anything else is a directory.
+func (ms *Server) resolveMountpoint(mountPoint string) (fd int, dir string, err error) {
+	if strings.HasPrefix(mountPoint, devFdPrefix) {
+		return parseFuseFd(mountPoint)
+	}
+
+	i := strings.Index(mountPoint, ":")
+	if i <= 0 || strings.Contains(mountPoint[:i], "/") {
+		return -1, mountPoint, nil
+	}
+	r := ms.opts.MountpointResolvers[mountPoint[:i]]
+	if r == nil {
+		return -1, mountPoint, nil
+	}
+	fd, dir, err = r.ResolveMountpoint(mountPoint[i+1:])
+	if err != nil {
+		return -1, "", fmt.Errorf("resolve %q: %v", mountPoint, err)
+	}
+	if (fd < 0) == (dir == "") {
+		return -1, "", fmt.Errorf("resolve %q: got fd %d and directory %q, want one of them", mountPoint, fd, dir)
+	}
+	return fd, dir, nil
+}
+
+// parseFuseFd returns the file descriptor N of "/dev/fd/N".
+func parseFuseFd(mountPoint string) (int, string, error) {
+	fd, err := strconv.Atoi(strings.TrimPrefix(mountPoint, devFdPrefix))
+	if err != nil || fd < 0 {
+		return -1, "", fmt.Errorf("invalid file descriptor in %q", mountPoint)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return -1, "", fmt.Errorf("%s: %v", mountPoint, err)
+	}
+	return fd, "", nil
+}
+
+// serveFd attaches the server to fd, a FUSE device that is already
+// mounted, and handles the INIT request.
+func (ms *Server) serveFd(fd int) error {
+	ms.mountFd = fd
+	close(ms.ready)
+	if code := ms.handleInit(); !code.Ok() {
+		return fmt.Errorf("init: %s", code)
+	}
+	return nil
+}
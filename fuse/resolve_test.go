@@ -0,0 +1,123 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestResolveMountpoint(t *testing.T) {
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		MountpointResolvers: map[string]MountpointResolver{
+			"dir": MountpointResolverFunc(func(name string) (int, string, error) {
+				return -1, "/mnt/" + name, nil
+			}),
+			"fd": MountpointResolverFunc(func(name string) (int, string, error) {
+				return 7, "", nil
+			}),
+			"bad": MountpointResolverFunc(func(name string) (int, string, error) {
+				return -1, "", errors.New("no such unit")
+			}),
+			"both": MountpointResolverFunc(func(name string) (int, string, error) {
+				return 7, "/mnt", nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		in     string
+		fd     int
+		dir    string
+		errors bool
+	}{
+		{in: "/mnt/x", fd: -1, dir: "/mnt/x"},
+		{in: "relative/dir", fd: -1, dir: "relative/dir"},
+		{in: "dir:x", fd: -1, dir: "/mnt/x"},
+		{in: "fd:x", fd: 7},
+		{in: "other:x", fd: -1, dir: "other:x"},
+		{in: "/tmp/dir:x", fd: -1, dir: "/tmp/dir:x"},
+		{in: ":x", fd: -1, dir: ":x"},
+		{in: "bad:x", errors: true},
+		{in: "both:x", errors: true},
+		{in: "/dev/fd/x", errors: true},
+		{in: "/dev/fd/999999", errors: true},
+		{in: "/dev/fd/0", fd: 0},
+	} {
+		fd, dir, err := ms.resolveMountpoint(tc.in)
+		if tc.errors {
+			if err == nil {
+				t.Errorf("%q: got fd %d, dir %q, want error", tc.in, fd, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+		} else if fd != tc.fd || dir != tc.dir {
+			t.Errorf("%q: got fd %d, dir %q, want %d, %q", tc.in, fd, dir, tc.fd, tc.dir)
+		}
+	}
+}
+
+func TestNewServerResolvedFd(t *testing.T) {
+	// A seqpacket socket keeps the message boundaries, like the
+	// FUSE device.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+
+	init := InitIn{
+		InHeader: InHeader{Opcode: _OP_INIT, Unique: 1},
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    31,
+	}
+	init.Length = uint32(unsafe.Sizeof(init))
+	in := (*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(&init))[:]
+	if _, err := syscall.Write(fds[1], in); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := NewServer(NewDefaultRawFileSystem(), "fdstore:test", &MountOptions{
+		MountpointResolvers: map[string]MountpointResolver{
+			"fdstore": MountpointResolverFunc(func(name string) (int, string, error) {
+				if name != "test" {
+					return -1, "", fmt.Errorf("unknown name %q", name)
+				}
+				return fds[0], "", nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(ms.mountFd)
+	if err := ms.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]byte, 4096)
+	n, err := syscall.Read(fds[1], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < int(sizeOfOutHeader) {
+		t.Fatalf("short reply: %d bytes", n)
+	}
+	outHdr := (*OutHeader)(unsafe.Pointer(&out[0]))
+	if outHdr.Unique != 1 || outHdr.Status != 0 {
+		t.Errorf("got reply %+v, want unique 1 and status 0", outHdr)
+	}
+	if err := ms.Unmount(); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+}
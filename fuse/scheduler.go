@@ -0,0 +1,232 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Priority is the urgency of a request, see SchedulerOptions.
+type Priority int
+
+const (
+	// PriorityHigh is for requests that users wait on
+	// interactively, eg. LOOKUP and GETATTR for ls.
+	PriorityHigh Priority = iota
+
+	// PriorityNormal is for most requests.
+	PriorityNormal
+
+	// PriorityLow is for bulk data transfer.
+	PriorityLow
+
+	priorityCount
+)
+
+// SchedulerOptions makes a fixed pool of handlers serve requests in
+// order of priority, see MountOptions.Scheduler. Without it, each
+// reader handles the request that it reads, so when all of them are
+// busy with large READs and WRITEs, a LOOKUP waits in the kernel
+// behind them, and an interactive ls stalls under a streaming load.
+// With it, readers queue the requests, and the handlers take the
+// most urgent ones first.
+//
+// Requests that handlers may be waiting for are never queued, but
+// handled by the reader that reads them: FORGET, BATCH_FORGET,
+// INTERRUPT, NOTIFY_REPLY, and SETLK, FLUSH and RELEASE, which
+// release locks that a SETLKW in a handler may wait for.
+type SchedulerOptions struct {
+	// Handlers is the number of goroutines that handle requests.
+	// If 0, 32 is used. They count against MaxHandlers, which
+	// caps them at MaxHandlers-1 and must then be at least 2.
+	Handlers int
+
+	// QueueLimit is the number of requests that may wait for a
+	// handler, which bounds the memory held by queued requests.
+	// Once it is reached, readers handle the requests that they
+	// read themselves, in arrival order, rather than block: a
+	// blocked reader could not read the request that would free
+	// a handler. If 0, Handlers is used.
+	QueueLimit int
+
+	// Priority returns the priority of a request. It is called
+	// by the readers, so it should be cheap. The request has no
+	// Cancel and Names yet. If nil, DefaultPriority is used.
+	Priority func(r *RequestInfo) Priority
+}
+
+const (
+	defaultSchedulerHandlers = 32
+
+	// largeTransfer is the size from which DefaultPriority
+	// considers a READ or WRITE to be bulk transfer.
+	largeTransfer = 64 * 1024
+
+	// maxSkips is the number of times that requests of a lower
+	// priority may be passed over before one of them is taken.
+	maxSkips = 8
+)
+
+// DefaultPriority gives lookups, attributes, forgets and interrupts
+// a high priority, and READs and WRITEs of 64 kiB or more a low one.
+func DefaultPriority(r *RequestInfo) Priority {
+	switch r.Header.Opcode {
+	case _OP_LOOKUP, _OP_GETATTR, _OP_STATX, _OP_FORGET, _OP_BATCH_FORGET,
+		_OP_INTERRUPT, _OP_ACCESS, _OP_READLINK:
+		return PriorityHigh
+	case _OP_READ, _OP_WRITE:
+		if r.Size() >= largeTransfer {
+			return PriorityLow
+		}
+	}
+	return PriorityNormal
+}
+
+// scheduler queues requests by priority for a pool of handlers.
+type scheduler struct {
+	ms       *Server
+	handlers int
+	limit    int
+	priority func(r *RequestInfo) Priority
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues [priorityCount][]*request
+	queued int
+	closed bool
+
+	// skips counts the requests that were taken while a request
+	// of lower priority waited.
+	skips int
+
+	done sync.WaitGroup
+}
+
+func newScheduler(ms *Server, opts *SchedulerOptions) *scheduler {
+	s := &scheduler{
+		ms:       ms,
+		handlers: opts.Handlers,
+		limit:    opts.QueueLimit,
+		priority: opts.Priority,
+	}
+	if s.handlers == 0 {
+		s.handlers = defaultSchedulerHandlers
+	}
+	// Leave room for the loop on the mount descriptor within
+	// MaxHandlers.
+	if ms != nil && ms.opts.MaxHandlers > 0 && s.handlers > ms.opts.MaxHandlers-1 {
+		s.handlers = ms.opts.MaxHandlers - 1
+	}
+	if s.limit == 0 {
+		s.limit = s.handlers
+	}
+	if s.priority == nil {
+		s.priority = DefaultPriority
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// start starts the handlers.
+func (s *scheduler) start() {
+	s.done.Add(s.handlers)
+	for i := 0; i < s.handlers; i++ {
+		go s.handle()
+	}
+}
+
+// stop waits for the handlers to serve the queued requests, and
+// exit.
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.done.Wait()
+}
+
+// submit queues req, and returns true. It returns false if the
+// reader should handle req itself, because handlers may wait for it,
+// or the queue is full.
+func (s *scheduler) submit(req *request) bool {
+	switch req.inHeader.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_NOTIFY_REPLY,
+		_OP_SETLK, _OP_FLUSH, _OP_RELEASE:
+		return false
+	}
+
+	r := RequestInfo{Header: req.inHeader}
+	if h := getHandler(req.inHeader.Opcode); h != nil && h.DecodeIn != nil &&
+		h.InputSize > 0 && len(req.inputBuf) >= int(h.InputSize) {
+		r.Input = h.DecodeIn(unsafe.Pointer(&req.inputBuf[0]))
+	}
+	p := s.priority(&r)
+	if p < 0 {
+		p = 0
+	} else if p >= priorityCount {
+		p = priorityCount - 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued >= s.limit || s.closed {
+		return false
+	}
+	s.queues[p] = append(s.queues[p], req)
+	s.queued++
+	s.cond.Broadcast()
+	return true
+}
+
+// next takes the most urgent request, or returns nil once the
+// scheduler is stopped and the queues are empty.
+func (s *scheduler) next() *request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.queued == 0 {
+		if s.closed {
+			return nil
+		}
+		s.cond.Wait()
+	}
+
+	first, last := -1, -1
+	for p := range s.queues {
+		if len(s.queues[p]) > 0 {
+			if first < 0 {
+				first = p
+			}
+			last = p
+		}
+	}
+	p := first
+	if first != last {
+		s.skips++
+		if s.skips > maxSkips {
+			// Don't starve the lower priorities.
+			p = last
+			s.skips = 0
+		}
+	}
+
+	req := s.queues[p][0]
+	s.queues[p][0] = nil
+	s.queues[p] = s.queues[p][1:]
+	s.queued--
+	s.cond.Broadcast()
+	return req
+}
+
+func (s *scheduler) handle() {
+	defer s.done.Done()
+	for {
+		req := s.next()
+		if req == nil {
+			return
+		}
+		s.ms.handleRequest(req)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(nil, &SchedulerOptions{QueueLimit: 100})
+
+	read := func(size uint32) *request {
+		in := ReadIn{InHeader: InHeader{Opcode: _OP_READ}, Size: size}
+		buf := make([]byte, unsafe.Sizeof(in))
+		*(*ReadIn)(unsafe.Pointer(&buf[0])) = in
+		return &request{inHeader: (*InHeader)(unsafe.Pointer(&buf[0])), inputBuf: buf}
+	}
+	op := func(opcode uint32) *request {
+		return &request{inHeader: &InHeader{Opcode: opcode}}
+	}
+
+	var bulk []*request
+	for i := 0; i < 10; i++ {
+		r := read(1 << 20)
+		bulk = append(bulk, r)
+		s.submit(r)
+	}
+	small := read(4096)
+	s.submit(small)
+	var lookups []*request
+	for i := 0; i < 10; i++ {
+		r := op(_OP_LOOKUP)
+		lookups = append(lookups, r)
+		s.submit(r)
+	}
+
+	var got []*request
+	for i := 0; i < 12; i++ {
+		got = append(got, s.next())
+	}
+	// Lookups come first, but after maxSkips, the lowest
+	// priority gets a turn.
+	want := append(append([]*request{}, lookups[:maxSkips]...), bulk[0], lookups[8], lookups[9], small)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("request %d: got %s, want %s", i, operationName(got[i].inHeader.Opcode), operationName(want[i].inHeader.Opcode))
+		}
+	}
+
+	for i := 1; i < len(bulk); i++ {
+		if r := s.next(); r != bulk[i] {
+			t.Errorf("bulk request %d out of order", i)
+		}
+	}
+	s.stop()
+	if r := s.next(); r != nil {
+		t.Errorf("got request after stop")
+	}
+}
+
+func TestDefaultPriority(t *testing.T) {
+	for _, c := range []struct {
+		opcode uint32
+		size   int
+		want   Priority
+	}{
+		{_OP_LOOKUP, 0, PriorityHigh},
+		{_OP_BATCH_FORGET, 0, PriorityHigh},
+		{_OP_READ, 4096, PriorityNormal},
+		{_OP_WRITE, 1 << 20, PriorityLow},
+		{_OP_MKDIR, 0, PriorityNormal},
+	} {
+		r := &RequestInfo{Header: &InHeader{Opcode: c.opcode}}
+		switch c.opcode {
+		case _OP_READ:
+			r.Input = &ReadIn{Size: uint32(c.size)}
+		case _OP_WRITE:
+			r.Header.Length = uint32(int(unsafe.Sizeof(WriteIn{})) + c.size)
+		}
+		if got := DefaultPriority(r); got != c.want {
+			t.Errorf("%s of %d bytes: got priority %d, want %d", r.OpcodeName(), c.size, got, c.want)
+		}
+	}
+}
+
+func TestSchedulerNeverBlocks(t *testing.T) {
+	s := newScheduler(nil, &SchedulerOptions{QueueLimit: 1})
+	op := func(opcode uint32) *request {
+		return &request{inHeader: &InHeader{Opcode: opcode}}
+	}
+	if !s.submit(op(_OP_GETATTR)) {
+		t.Fatal("first request was not queued")
+	}
+	// The queue is full; the reader handles the request itself.
+	if s.submit(op(_OP_GETATTR)) {
+		t.Error("request queued beyond QueueLimit")
+	}
+
+	s = newScheduler(nil, &SchedulerOptions{QueueLimit: 100})
+	for _, opcode := range []uint32{_OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_NOTIFY_REPLY, _OP_SETLK, _OP_FLUSH, _OP_RELEASE} {
+		if s.submit(op(opcode)) {
+			t.Errorf("%s was queued", operationName(opcode))
+		}
+	}
+	if s.queued != 0 {
+		t.Errorf("got %d queued requests, want 0", s.queued)
+	}
+}
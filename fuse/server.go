@@ -5,12 +5,13 @@
 package fuse
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -20,12 +21,19 @@ import (
 	"syscall"
 	"time"
 	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse/fusectl"
+	"github.com/hanwen/go-fuse/v2/internal"
 )
 
 const (
 	// Linux v4.20+ caps requests at 1 MiB. Older kernels at 128 kiB.
 	MAX_KERNEL_WRITE = 1024 * 1024
 
+	// maxStackDepth is the highest MountOptions.MaxStackDepth;
+	// FILESYSTEM_MAX_STACK_DEPTH in Linux.
+	maxStackDepth = 2
+
 	// defaultMaxWrite is the default value for MountOptions.MaxWrite
 	defaultMaxWrite = 128 * 1024 // 128 kiB
 
@@ -36,7 +44,8 @@ const (
 // Server contains the logic for reading from the FUSE device and
 // translating it to RawFileSystem interface calls.
 type Server struct {
-	// Empty if unmounted.
+	// Empty if unmounted. Once serving, it is changed with reqMu
+	// held; see mountPointLocked.
 	mountPoint string
 	fileSystem RawFileSystem
 
@@ -48,23 +57,40 @@ type Server struct {
 
 	latencies LatencyMap
 
+	// Set if MountOptions.EnableMetrics is set.
+	metrics *serverMetrics
+
 	opts *MountOptions
 
+	// Handlers for MountOptions.Extensions, by opcode.
+	extensions map[uint32]*operationHandler
+
+	// Stacks of slow handlers, see MountOptions.SlowRequestThreshold.
+	slowStacks slowStacks
+
 	// maxReaders is the maximum number of goroutines reading requests
 	maxReaders int
 
+	// extraLoops is the number of loops started by readRequest, in
+	// addition to the one of Serve. Protected by reqMu.
+	extraLoops int
+
+	// fixedLoops is the number of loops on the mount descriptor
+	// that never exit: the one of Serve, or those of PinReaders.
+	// Protected by reqMu.
+	fixedLoops int
+
 	// Pools for []byte
 	buffers bufferPool
 
 	// Pool for request structs.
 	reqPool sync.Pool
 
-	// Pool for raw requests data
-	readPool       sync.Pool
 	reqMu          sync.Mutex
 	reqReaders     int
 	reqInflight    []*request
 	recentUnique   []uint64
+	queueClock     queueClock
 	kernelSettings InitIn
 
 	// in-flight notify-retrieve queries
@@ -74,22 +100,96 @@ type Server struct {
 
 	singleReader bool
 	canSplice    bool
+
+	// Set if splice may not be used, see NewMinimalServer.
+	noSplice bool
+
+	// Prefix of generated trace IDs, or empty if requests have
+	// none. See MountOptions.TraceIDs.
+	traceIDPrefix string
+
+	// Queues requests by priority, see MountOptions.Scheduler.
+	sched *scheduler
+
+	// Throttles callers, see MountOptions.RateLimit.
+	limiter *rateLimiter
+
+	// Counters for Server.Stats.
+	counters *serverCounters
+
+	// Clones of the device, see MountOptions.DeviceClones.
+	clones []*devClone
+
+	// Set if requests arrive over io_uring, see
+	// MountOptions.EnableIoUring. Protected by reqMu.
+	uring bool
+
+	// Set if WRITE requests are read with splice, see
+	// MountOptions.SpliceWrite.
+	spliceWrites bool
 	loops        sync.WaitGroup
-	writes       int64
-	shutdown     bool
+
+	// serveDone is closed when Serve has released its resources.
+	// serving is set once Serve is called. Accessed atomically.
+	serveDone chan struct{}
+	serving   int32
+
+	// serveCtx is the context passed to ServeContext, if any.
+	serveCtx context.Context
+
+	shutdown bool
+
+	// Set once the connection was passed on with HandOff.
+	handedOff bool
+
+	// Set while open files are flushed for unmounting. Accessed
+	// atomically.
+	flushing int32
+
+	// Set while Unmount runs, see
+	// MountOptions.SkipForgetOnUnmount. Accessed atomically.
+	unmounting int32
+
+	// Set once Unmount has succeeded, see
+	// MountOptions.AfterUnmountStatus. Accessed atomically.
+	unmounted int32
+
+	// Set once the kernel has sent DESTROY. Accessed atomically.
+	destroying int32
+
+	// dispatched counts the handlers that run, and destroyed is
+	// set once the file system is destroyed, which waits for
+	// dispatched to drop to 0. See Destroyer. Protected by
+	// destroyMu.
+	destroyMu   sync.Mutex
+	destroyCond *sync.Cond
+	dispatched  int
+	destroyed   bool
+
+	// writeQueue holds the replies for the writer goroutine. See
+	// MountOptions.WriteQueueSize.
+	writeQueueMu  sync.RWMutex
+	writeQueue    chan *request
+	writerDone    chan struct{}
+	writeCounters *writeQueueCounters
+
+	// Set if requests are logged. Accessed atomically. See
+	// SetDebug.
+	debug int32
+
+	// Holds the *DebugFilter set with SetDebugFilter.
+	debugFilter atomic.Value
 
 	ready chan error
 
+	// Set if requests come from a virtio-fs device rather than
+	// /dev/fuse. See NewVirtioFSServer.
+	vhost *vhostUserSession
+
 	// for implementing single threaded processing.
 	requestProcessingMu sync.Mutex
 }
 
-// SetDebug is deprecated. Use MountOptions.Debug instead.
-func (ms *Server) SetDebug(dbg bool) {
-	// This will typically trigger the race detector.
-	ms.opts.Debug = dbg
-}
-
 // KernelSettings returns the Init message from the kernel, so
 // filesystems can adapt to availability of features of the kernel
 // driver. The message should not be altered.
@@ -104,7 +204,8 @@ func (ms *Server) KernelSettings() *InitIn {
 const _MAX_NAME_LEN = 20
 
 // This type may be provided for recording latencies of each FUSE
-// operation.
+// operation. If it also implements TimingMap, it receives the
+// estimated time spent in the kernel queue too.
 type LatencyMap interface {
 	Add(name string, dt time.Duration)
 }
@@ -117,14 +218,30 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 
 // Unmount calls fusermount -u on the mount. This has the effect of
 // shutting down the filesystem. After the Server is unmounted, it
-// should be discarded.
+// should be discarded. With MountOptions.UnmountFlushTimeout, open
+// files are flushed first, and files that failed to flush are
+// reported as a *FlushError once the unmount succeeded.
 func (ms *Server) Unmount() (err error) {
-	if ms.mountPoint == "" {
+	return ms.unmount(ms.opts)
+}
+
+// unmount is Unmount, with the unmount options taken from opts.
+func (ms *Server) unmount(opts *MountOptions) (err error) {
+	if ms.vhost != nil {
+		return ms.vhost.close()
+	}
+	mountPoint := ms.mountPointLocked()
+	if mountPoint == "" {
 		return nil
 	}
+	var flushErr error
+	if ms.opts.UnmountFlushTimeout > 0 {
+		flushErr = ms.flushOpenFiles()
+	}
+	atomic.StoreInt32(&ms.unmounting, 1)
 	delay := time.Duration(0)
 	for try := 0; try < 5; try++ {
-		err = unmount(ms.mountPoint, ms.opts)
+		err = unmount(mountPoint, opts)
 		if err == nil {
 			break
 		}
@@ -136,16 +253,271 @@ func (ms *Server) Unmount() (err error) {
 		time.Sleep(delay)
 	}
 	if err != nil {
+		atomic.StoreInt32(&ms.flushing, 0)
+		atomic.StoreInt32(&ms.unmounting, 0)
 		return
 	}
-	// Wait for event loops to exit.
-	ms.loops.Wait()
+	atomic.StoreInt32(&ms.unmounted, 1)
+	// Wait for event loops to exit, and the device to be closed.
+	ms.Wait()
+	atomic.StoreInt32(&ms.unmounting, 0)
+	ms.reqMu.Lock()
 	ms.mountPoint = ""
-	return err
+	ms.reqMu.Unlock()
+	return flushErr
+}
+
+// mountPointLocked returns the mount point, or "" once unmounted. It
+// may be called from any goroutine.
+func (ms *Server) mountPointLocked() string {
+	ms.reqMu.Lock()
+	defer ms.reqMu.Unlock()
+	return ms.mountPoint
+}
+
+// GracefulUnmount unmounts the file system without dropping requests
+// that are being served, eg. for a rolling restart. It stops reading
+// new requests, waits for the requests in flight to be answered, and
+// for their replies to be written, and then unmounts as Unmount does.
+// If ctx is done first, the remaining requests are interrupted, the
+// file system is unmounted anyway, and the error of ctx is returned.
+//
+// Readers that wait for requests on the device, including those of
+// DeviceClones, are woken up and paused. Requests that arrive over
+// io_uring are served until the unmount, because the kernel only
+// takes a reply along with the fetch of the next request.
+func (ms *Server) GracefulUnmount(ctx context.Context) error {
+	ms.reqMu.Lock()
+	ms.shutdown = true
+	ms.reqMu.Unlock()
+
+	drainErr := ms.drain(ctx)
+
+	// Let the main loop see the unmount.
+	ms.reqMu.Lock()
+	ms.shutdown = false
+	ms.reqMu.Unlock()
+
+	if err := ms.Unmount(); err != nil {
+		return err
+	}
+	return drainErr
+}
+
+// drainGrace is how long drain waits for interrupted requests to be
+// answered.
+const drainGrace = time.Second
+
+// drainWakeupInterval is the interval at which drain wakes up the
+// readers that wait for requests.
+const drainWakeupInterval = 100 * time.Millisecond
+
+// drain waits for the readers to pause, and for the requests in
+// flight to finish. If ctx is done first, it interrupts them, waits
+// at most drainGrace for their replies, and returns an error.
+func (ms *Server) drain(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	done := ctx.Done()
+	var grace <-chan time.Time
+	var err error
+	var lastWakeup time.Time
+	for {
+		ms.reqMu.Lock()
+		reqs := len(ms.reqInflight)
+		readers := ms.reqReaders
+		if ms.uring || ms.mountPoint == "" {
+			// Wakeups may go over io_uring and never reach
+			// the readers, or there is nothing to wake them
+			// up with.
+			readers = 0
+		}
+		ms.reqMu.Unlock()
+		if reqs == 0 && readers == 0 && atomic.LoadInt64(&ms.counters.writes) == 0 {
+			return err
+		}
+		if readers > 0 && time.Since(lastWakeup) >= drainWakeupInterval {
+			lastWakeup = time.Now()
+			go ms.wakeupReader()
+		}
+
+		select {
+		case <-t.C:
+		case <-grace:
+			return err
+		case <-done:
+			done = nil
+			ms.reqMu.Lock()
+			reqs = len(ms.reqInflight)
+			for _, req := range ms.reqInflight {
+				if !req.interrupted {
+					close(req.cancel)
+					req.interrupted = true
+				}
+			}
+			ms.reqMu.Unlock()
+			if reqs > 0 {
+				ms.infof("interrupted %d requests in flight", reqs)
+				err = fmt.Errorf("%d requests in flight: %w", reqs, ctx.Err())
+			}
+			grace = time.After(drainGrace)
+		}
+	}
+}
+
+// ServeContext is like Serve, and ties the server to ctx. Once ctx is
+// done, the requests in flight are interrupted, and the file system is
+// unmounted as with GracefulUnmount. The values of ctx are visible
+// through the Contexts of all requests, as described for
+// RequestTracer. ServeContext returns once the server has stopped,
+// with nil, or with the error of the unmount. If that unmount fails,
+// eg. because the file system is busy, the server keeps serving until
+// it is unmounted otherwise.
+func (ms *Server) ServeContext(ctx context.Context) error {
+	ms.serveCtx = ctx
+	served := make(chan struct{})
+	unmounted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			err := ms.GracefulUnmount(ctx)
+			if errors.Is(err, ctx.Err()) {
+				// The interrupted requests are expected.
+				err = nil
+			}
+			unmounted <- err
+		case <-served:
+			unmounted <- nil
+		}
+	}()
+	ms.Serve()
+	close(served)
+	return <-unmounted
+}
+
+// Abort aborts the connection to the kernel through the fusectl file
+// system (Linux only). Requests that are pending and that follow fail
+// with ENOTCONN, and Serve returns. Use this if the file system hangs
+// so badly that Unmount does not complete; the mount point must still
+// be unmounted, eg. with a lazy unmount. This needs write access to
+// /sys/fs/fuse/connections, which is normally reserved to root.
+func (ms *Server) Abort() error {
+	c, err := ms.fusectlConn()
+	if err != nil {
+		return err
+	}
+	return c.Abort()
+}
+
+// ConnStats returns the statistics that the kernel keeps on the
+// request queue of the connection (Linux only).
+func (ms *Server) ConnStats() (*fusectl.Stats, error) {
+	c, err := ms.fusectlConn()
+	if err != nil {
+		return nil, err
+	}
+	return c.Stats()
+}
+
+func (ms *Server) fusectlConn() (*fusectl.Conn, error) {
+	mountPoint := ms.mountPointLocked()
+	if ms.vhost != nil || mountPoint == "" {
+		return nil, fmt.Errorf("fusectl: server is not mounted")
+	}
+	return fusectl.ForMountpoint(mountPoint)
+}
+
+// flushOpenFiles rejects further modifications, and flushes the open
+// files of the file system. See MountOptions.UnmountFlushTimeout.
+func (ms *Server) flushOpenFiles() error {
+	atomic.StoreInt32(&ms.flushing, 1)
+	flusher, ok := ms.fileSystem.(OpenFileFlusher)
+	if !ok {
+		return nil
+	}
+
+	cancel := make(chan struct{})
+	t := time.AfterFunc(ms.opts.UnmountFlushTimeout, func() { close(cancel) })
+	defer t.Stop()
+	if failures := flusher.FlushOpenFiles(cancel); len(failures) > 0 {
+		return &FlushError{Failures: failures}
+	}
+	return nil
+}
+
+// rejectedWhileFlushing returns true if the request must fail,
+// because open files are flushed for unmounting.
+func (ms *Server) rejectedWhileFlushing(req *request) bool {
+	if atomic.LoadInt32(&ms.flushing) == 0 {
+		return false
+	}
+	switch req.inHeader.Opcode {
+	case _OP_WRITE:
+		// With the writeback cache, the kernel writes back
+		// dirty pages by itself. Rejecting those would lose
+		// data.
+		return !ms.opts.EnableWriteback
+	case _OP_OPEN:
+		in := (*OpenIn)(req.inData)
+		return in.Flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0
+	}
+	return req.handler.Mutates
 }
 
 // NewServer creates a server and attaches it to the given directory.
+//
+// The mount point may also be "/dev/fd/N", for a FUSE device that a
+// privileged helper has mounted and passed as file descriptor N, or
+// "scheme:name" for a scheme in MountOptions.MountpointResolvers. For
+// a mounted file descriptor, Unmount does nothing: the file system
+// goes away when whoever mounted it unmounts it.
 func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, mountPoint, err := ms.resolveMountpoint(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	if fd >= 0 {
+		// Mounted by someone else, who also unmounts it.
+		if err := ms.serveFd(fd); err != nil {
+			ms.errorf("mount: %s", err)
+			return nil, err
+		}
+		ms.loops.Add(1)
+		return ms, nil
+	}
+
+	mountPoint = filepath.Clean(mountPoint)
+	if !filepath.IsAbs(mountPoint) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	}
+	ms.mountPoint = mountPoint
+
+	err = ms.mount(ms.opts)
+	if err != nil {
+		ms.errorf("mount: %s", err)
+		return nil, err
+	}
+	if ms.opts.UnmountOnSignal != nil {
+		ms.handleSignals()
+	}
+	// This prepares for Serve being called somewhere, either
+	// synchronously or asynchronously.
+	ms.loops.Add(1)
+	return ms, nil
+}
+
+// newServer creates a server that is not attached to a transport
+// yet.
+func newServer(fs RawFileSystem, opts *MountOptions) (*Server, error) {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -171,58 +543,149 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		o.Name = strings.Replace(name[:l], ",", ";", -1)
 	}
 
+	if o.MaxBackground < 0 || o.MaxBackground > math.MaxUint16 {
+		return nil, fmt.Errorf("MaxBackground %d out of range [0, %d]", o.MaxBackground, math.MaxUint16)
+	}
+	if o.AfterUnmountStatus < 0 {
+		return nil, fmt.Errorf("AfterUnmountStatus %d must not be negative", o.AfterUnmountStatus)
+	}
+	if o.CongestionThreshold < 0 || o.CongestionThreshold > math.MaxUint16 {
+		return nil, fmt.Errorf("CongestionThreshold %d out of range [0, %d]", o.CongestionThreshold, math.MaxUint16)
+	}
+	if o.CongestionThreshold == 0 {
+		o.CongestionThreshold = o.MaxBackground * 3 / 4
+	}
+
+	if o.MaxStackDepth < 0 || o.MaxStackDepth > maxStackDepth {
+		return nil, fmt.Errorf("MaxStackDepth %d out of range [0, %d]", o.MaxStackDepth, maxStackDepth)
+	}
+	if o.MaxStackDepth > 0 && !o.EnablePassthrough {
+		return nil, fmt.Errorf("MaxStackDepth needs EnablePassthrough")
+	}
+
+	if o.SlowRequestThreshold < 0 {
+		return nil, fmt.Errorf("SlowRequestThreshold %v is negative", o.SlowRequestThreshold)
+	}
+	if o.RequestTimeout < 0 {
+		return nil, fmt.Errorf("RequestTimeout %v is negative", o.RequestTimeout)
+	}
+
+	if o.BlockSize != 0 {
+		if o.BlockDevice == "" {
+			return nil, fmt.Errorf("BlockSize needs BlockDevice")
+		}
+		if o.BlockSize < 512 || o.BlockSize > os.Getpagesize() || o.BlockSize&(o.BlockSize-1) != 0 {
+			return nil, fmt.Errorf("BlockSize %d must be a power of two in [512, %d]", o.BlockSize, os.Getpagesize())
+		}
+	}
+
+	if o.MapAlignment < 0 || o.MapAlignment >= 64 {
+		return nil, fmt.Errorf("MapAlignment %d must be in [0, 64)", o.MapAlignment)
+	}
+
+	extensions, err := newExtensions(o.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, s := range o.optionsStrings() {
 		if strings.Contains(s, ",") {
 			return nil, fmt.Errorf("found ',' in option string %q", s)
 		}
 	}
 
-	maxReaders := runtime.GOMAXPROCS(0)
-	if maxReaders < minMaxReaders {
-		maxReaders = minMaxReaders
-	} else if maxReaders > maxMaxReaders {
-		maxReaders = maxMaxReaders
+	if o.SpliceTimeout < 0 {
+		return nil, fmt.Errorf("SpliceTimeout %v is negative", o.SpliceTimeout)
+	}
+	if o.DeviceClones < 0 {
+		return nil, fmt.Errorf("DeviceClones %d must not be negative", o.DeviceClones)
+	}
+	if o.MaxReaders < 0 || o.MaxHandlers < 0 {
+		return nil, fmt.Errorf("MaxReaders %d and MaxHandlers %d must not be negative", o.MaxReaders, o.MaxHandlers)
+	}
+	if s := o.Scheduler; s != nil && (s.Handlers < 0 || s.QueueLimit < 0) {
+		return nil, fmt.Errorf("Scheduler: Handlers %d and QueueLimit %d must not be negative", s.Handlers, s.QueueLimit)
+	}
+	if o.Scheduler != nil && o.MaxHandlers == 1 {
+		return nil, fmt.Errorf("Scheduler needs a MaxHandlers of at least 2, for a reader and a handler")
+	}
+	if r := o.RateLimit; r != nil && (r.MaxIOPS < 0 || r.MaxBytesPerSecond < 0 || r.MaxConcurrent < 0) {
+		return nil, fmt.Errorf("RateLimit: MaxIOPS %d, MaxBytesPerSecond %d and MaxConcurrent %d must not be negative",
+			r.MaxIOPS, r.MaxBytesPerSecond, r.MaxConcurrent)
+	}
+	if u := o.UnmountOnSignal; u != nil && u.GracePeriod < 0 {
+		return nil, fmt.Errorf("UnmountOnSignal: GracePeriod %v is negative", u.GracePeriod)
+	}
+	if bp := o.BufferPool; bp != nil {
+		if bp.Prealloc < 0 || bp.MaxPooled < 0 {
+			return nil, fmt.Errorf("BufferPool: Prealloc %d and MaxPooled %d must not be negative", bp.Prealloc, bp.MaxPooled)
+		}
+		for _, sz := range bp.SizeClasses {
+			if sz <= 0 {
+				return nil, fmt.Errorf("BufferPool: size class %d must be positive", sz)
+			}
+		}
+	}
+	for _, c := range o.ReaderCPUs {
+		if c < 0 {
+			return nil, fmt.Errorf("ReaderCPUs has negative CPU %d", c)
+		}
+	}
+	maxReaders := o.MaxReaders
+	if maxReaders == 0 {
+		maxReaders = runtime.GOMAXPROCS(0)
+		if maxReaders < minMaxReaders {
+			maxReaders = minMaxReaders
+		} else if maxReaders > maxMaxReaders {
+			maxReaders = maxMaxReaders
+		}
 	}
 
 	ms := &Server{
 		fileSystem:  fs,
 		opts:        &o,
+		extensions:  extensions,
 		maxReaders:  maxReaders,
 		retrieveTab: make(map[uint64]*retrieveCacheRequest),
 		// OSX has races when multiple routines read from the
 		// FUSE device: on unmount, sometime some reads do not
 		// error-out, meaning that unmount will hang.
-		singleReader: runtime.GOOS == "darwin",
-		ready:        make(chan error, 1),
+		singleReader:  runtime.GOOS == "darwin",
+		ready:         make(chan error, 1),
+		spliceWrites:  o.SpliceWrite && isWriteSplicer(fs),
+		serveDone:     make(chan struct{}),
+		counters:      &serverCounters{},
+		writeCounters: &writeQueueCounters{},
+		fixedLoops:    1,
+	}
+	if o.EnableMetrics {
+		ms.metrics = newServerMetrics()
+	}
+	if o.SlowRequestThreshold > 0 {
+		ms.slowStacks.init(ms)
+	}
+	if o.Debug {
+		ms.debug = 1
 	}
 	ms.reqPool.New = func() interface{} {
 		return &request{
 			cancel: make(chan struct{}),
 		}
 	}
-	ms.readPool.New = func() interface{} {
-		buf := make([]byte, o.MaxWrite+int(maxInputSize)+logicalBlockSize)
-		buf = alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(o.MaxWrite)+maxInputSize)
-		return buf
+	if o.Scheduler != nil {
+		ms.sched = newScheduler(ms, o.Scheduler)
 	}
-	mountPoint = filepath.Clean(mountPoint)
-	if !filepath.IsAbs(mountPoint) {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	if o.RateLimit != nil {
+		ms.limiter = newRateLimiter(o.RateLimit)
 	}
-	ms.mountPoint = mountPoint
-
-	err := ms.mount(&o)
-	if err != nil {
-		log.Printf("mount: %s", err)
-		return nil, err
+	if o.TraceIDs || o.NewTraceID != nil {
+		ms.traceIDPrefix = newTraceIDPrefix()
 	}
-	// This prepares for Serve being called somewhere, either
-	// synchronously or asynchronously.
-	ms.loops.Add(1)
+	ms.buffers.init(o.BufferPool, o.MaxWrite, func() []byte {
+		buf := make([]byte, o.MaxWrite+int(maxInputSize)+logicalBlockSize)
+		buf = alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(o.MaxWrite)+maxInputSize)
+		return buf
+	})
 	return ms, nil
 }
 
@@ -234,6 +697,9 @@ func (ms *Server) mount(opt *MountOptions) error {
 			return fmt.Errorf("dial %s: %s", path, err)
 		}
 		defer c.Close()
+		if err := internal.CheckPeer(c.(*net.UnixConn), opt.AllowedPeerUids); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
 
 		msg, fds, err := getFd(c.(*net.UnixConn), 2)
 		if err != nil {
@@ -257,14 +723,20 @@ func (ms *Server) mount(opt *MountOptions) error {
 			syscall.CloseOnExec(fds[1])
 			ms.mountFd = fds[1]
 			ms.fileSystem.Init(ms)
-			ms.recentUnique = make([]uint64, 0)
 			go ms.sendFd(path)
-			go ms.checkLostRequests()
+			// Requests that the previous process read but did
+			// not answer are lost. If the kernel can resend
+			// them, they are served again, otherwise they are
+			// interrupted.
+			if code := ms.ResendNotify(); !code.Ok() {
+				ms.recentUnique = make([]uint64, 0)
+				go ms.checkLostRequests()
+			}
 			return nil
 		}
 	}
 
-	fd, err := mount(ms.mountPoint, opt, ms.ready)
+	fd, err := ms.mountWithRetry(opt)
 	if err != nil {
 		return err
 	}
@@ -272,7 +744,10 @@ func (ms *Server) mount(opt *MountOptions) error {
 
 	if code := ms.handleInit(); !code.Ok() {
 		syscall.Close(fd)
-		// TODO - unmount as well?
+		// Don't leave a dead mount behind.
+		if err := unmount(ms.mountPoint, opt); err != nil && opt.Debug {
+			ms.debugf("unmount after failed init: %v", err)
+		}
 		return fmt.Errorf("init: %s", code)
 	}
 
@@ -282,16 +757,56 @@ func (ms *Server) mount(opt *MountOptions) error {
 	return nil
 }
 
+const defaultMountRetryDelay = 10 * time.Millisecond
+
+// mountWithRetry mounts the file system, retrying transient
+// failures as configured by MountOptions.MountRetries.
+func (ms *Server) mountWithRetry(opt *MountOptions) (fd int, err error) {
+	delay := opt.MountRetryDelay
+	if delay <= 0 {
+		delay = defaultMountRetryDelay
+	}
+	for try := 0; ; try++ {
+		fd, err = mount(ms.mountPoint, opt, ms.ready)
+		if err == nil || try >= opt.MountRetries || !isTransientMountError(err) {
+			return fd, err
+		}
+		if opt.Debug {
+			ms.debugf("mount attempt %d failed: %v, retrying in %v", try+1, err, delay)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransientMountError returns true if a mount that failed with err
+// might succeed if it is tried again.
+func isTransientMountError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EBUSY, syscall.EAGAIN, syscall.EINTR:
+			return true
+		}
+		return false
+	}
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	return false
+}
+
 func (ms *Server) sendFd(path string) {
 	buf := make([]byte, unsafe.Sizeof(InitIn{}))
 	*(*InitIn)(unsafe.Pointer(&buf[0])) = ms.kernelSettings
 
 	for {
-		err := sendFuseFd(path, buf, ms.mountFd)
+		err := sendFuseFd(path, buf, ms.mountFd, ms.opts.AllowedPeerUids)
 		if err == nil {
 			break
 		}
-		log.Println("send FUSE", err)
+		ms.errorf("send FUSE %v", err)
 		time.Sleep(time.Millisecond * 100)
 	}
 }
@@ -303,7 +818,13 @@ func (o *MountOptions) optionsStrings() []string {
 	if o.AllowOther {
 		r = append(r, "allow_other")
 	}
-	if o.FsName != "" {
+	if o.BlockDevice != "" {
+		// fusermount mounts the fsname as the device.
+		r = append(r, "blkdev", "fsname="+o.BlockDevice)
+		if o.BlockSize != 0 {
+			r = append(r, fmt.Sprintf("blksize=%d", o.BlockSize))
+		}
+	} else if o.FsName != "" {
 		r = append(r, "fsname="+o.FsName)
 	}
 	if o.Name != "" {
@@ -346,7 +867,7 @@ func handleEINTR(fn func() error) (err error) {
 
 // Returns a new request, or error. In case exitIdle is given, returns
 // nil, OK if we have too many readers already.
-func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
+func (ms *Server) readRequest(clone *devClone, exitIdle bool) (req *request, code Status) {
 	ms.reqMu.Lock()
 	if exitIdle {
 		if ms.shutdown || ms.reqReaders >= ms.maxReaders {
@@ -354,27 +875,46 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 			return nil, OK
 		}
 	} else {
-		// main thread, don't exit for restart
+		// main thread or clone, don't exit for restart
 		for ms.shutdown {
+			if ms.handedOff {
+				ms.reqMu.Unlock()
+				return nil, OK
+			}
 			ms.reqMu.Unlock()
 			time.Sleep(time.Millisecond)
 			ms.reqMu.Lock()
 		}
 	}
+	fd := ms.mountFd
+	if clone != nil {
+		fd = clone.fd
+	}
 	ms.reqReaders++
 	ms.reqMu.Unlock()
 
-	dest := ms.readPool.Get().([]byte)
+	dest := ms.buffers.allocInput()
 
+	var readStart time.Time
+	timed := ms.timed()
+	if timed {
+		readStart = time.Now()
+	}
 	var n int
-	err := handleEINTR(func() error {
-		var err error
-		n, err = syscall.Read(ms.mountFd, dest)
-		return err
-	})
+	var writeData *WriteData
+	var err error
+	if ms.spliceWrites && ms.canSplice {
+		n, writeData, err = ms.readSpliced(fd, dest)
+	} else {
+		err = handleEINTR(func() error {
+			var err error
+			n, err = syscall.Read(fd, dest)
+			return err
+		})
+	}
 	if err != nil {
 		code = ToStatus(err)
-		ms.readPool.Put(dest)
+		ms.buffers.freeInput(dest)
 		ms.reqMu.Lock()
 		ms.reqReaders--
 		ms.reqMu.Unlock()
@@ -382,12 +922,14 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	}
 
 	req = ms.reqPool.Get().(*request)
-	if ms.latencies != nil {
+	req.clone = clone
+	if timed {
 		req.startTime = time.Now()
 	}
+	req.writeData = writeData
 	gobbled := req.setInput(dest[:n])
 	if !gobbled {
-		ms.readPool.Put(dest)
+		ms.buffers.freeInput(dest)
 	}
 
 	ms.reqMu.Lock()
@@ -395,22 +937,38 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	ms.reqReaders--
 	// Must parse request.Unique under lock
 	if status := req.parseHeader(); !status.Ok() {
+		ms.errorf("short read for input header: %v", req.inputBuf)
 		return nil, status
 	}
+	if timed {
+		req.queueLatency = ms.queueClock.estimate(req.inHeader.Unique, req.inHeader.Opcode, readStart, req.startTime)
+	}
 	if ms.recentUnique != nil {
 		ms.recentUnique = append(ms.recentUnique, req.inHeader.Unique)
 	}
 	req.inflightIndex = len(ms.reqInflight)
 	ms.reqInflight = append(ms.reqInflight, req)
 
-	if !ms.singleReader && ms.reqReaders < 2 && ms.reqReaders < ms.maxReaders && !ms.shutdown {
+	if clone == nil && !ms.singleReader && ms.reqReaders < 2 && ms.reqReaders < ms.maxReaders && !ms.shutdown &&
+		(ms.opts.MaxHandlers == 0 || ms.handlersLocked() < ms.opts.MaxHandlers) {
+		ms.extraLoops++
 		ms.loops.Add(1)
-		go ms.loop(true)
+		go ms.loop(nil, true)
 	}
 
 	return req, OK
 }
 
+// handlersLocked returns the number of goroutines that count against
+// MaxHandlers: the reader loops, and the handlers of the Scheduler.
+func (ms *Server) handlersLocked() int {
+	n := ms.fixedLoops + ms.extraLoops + len(ms.clones)
+	if ms.sched != nil {
+		n += ms.sched.handlers
+	}
+	return n
+}
+
 func (ms *Server) checkLostRequests() {
 	go func() {
 		// issue a few requests to interrupt lost ones
@@ -462,7 +1020,7 @@ func (ms *Server) returnInterrupted(unique uint64) {
 		return err
 	})
 	if err == nil {
-		log.Printf("FUSE: interrupt request %d", unique)
+		ms.infof("FUSE: interrupt request %d", unique)
 	}
 }
 
@@ -481,6 +1039,12 @@ func (ms *Server) returnRequest(req *request) {
 	ms.reqMu.Unlock()
 
 	ms.recordStats(req)
+	ms.endRequestContext(req)
+	if req.writeData != nil {
+		// Only the handler uses the pipe, and it has returned.
+		req.writeData.release()
+		req.writeData = nil
+	}
 	if interrupted {
 		// Don't reposses data, because someone might still
 		// be looking at it
@@ -496,23 +1060,37 @@ func (ms *Server) returnRequest(req *request) {
 
 	if p := req.bufferPoolInputBuf; p != nil {
 		req.bufferPoolInputBuf = nil
-		ms.readPool.Put(p)
+		ms.buffers.freeInput(p)
 	}
 
 	select {
 	case <-req.cancel:
 		// canceled
-		log.Printf("request is canceled")
+		ms.infof("request is canceled")
 	default:
 		ms.reqPool.Put(req)
 	}
 }
 
+// timed returns whether requests should record their arrival time.
+func (ms *Server) timed() bool {
+	return ms.latencies != nil || ms.opts.SlowRequestThreshold > 0 || ms.opts.RequestTimeout > 0 ||
+		ms.opts.Logger != nil || ms.metrics != nil || ms.opts.MetricsCollector != nil
+}
+
 func (ms *Server) recordStats(req *request) {
-	if ms.latencies != nil {
+	ms.collectMetrics(req)
+	if ms.latencies != nil && !req.startTime.IsZero() {
 		dt := time.Now().Sub(req.startTime)
 		opname := operationName(req.inHeader.Opcode)
 		ms.latencies.Add(opname, dt)
+		if tm, ok := ms.latencies.(TimingMap); ok {
+			tm.AddTiming(opname, &RequestTiming{
+				Arrival: req.startTime,
+				Handler: dt,
+				Queue:   req.queueLatency,
+			})
+		}
 	}
 }
 
@@ -522,8 +1100,43 @@ func (ms *Server) recordStats(req *request) {
 //
 // Each filesystem operation executes in a separate goroutine.
 func (ms *Server) Serve() {
-	ms.loop(false)
+	atomic.StoreInt32(&ms.serving, 1)
+	defer close(ms.serveDone)
+	if ms.opts.SlowRequestThreshold > 0 {
+		go ms.sampleSlowRequests()
+	}
+	if ms.opts.RequestTimeout > 0 {
+		go ms.watchRequests()
+	}
+	ms.startWriteQueue()
+	if ms.vhost != nil {
+		ms.vhost.serve()
+		ms.loops.Wait()
+		ms.destroy()
+		ms.stopWriteQueue()
+		return
+	}
+	ms.acquireSplicePool()
+	defer ms.releaseSplicePool()
+	ms.startIoUring()
+	if ms.sched != nil {
+		ms.sched.start()
+	}
+	ms.startClones()
+	if !ms.startPinnedLoops() {
+		ms.loop(nil, false)
+	}
 	ms.loops.Wait()
+	if ms.sched != nil {
+		ms.sched.stop()
+	}
+	ms.reqMu.Lock()
+	handedOff := ms.handedOff
+	ms.reqMu.Unlock()
+	if !handedOff {
+		ms.destroy()
+	}
+	ms.stopWriteQueue()
 
 	// shutdown in-flight cache retrieves.
 	//
@@ -542,26 +1155,31 @@ func (ms *Server) Serve() {
 		close(reading.ready)
 	}
 
-	_ = closeFuseFd()
+	_ = closeFuseFd(ms.opts.AllowedPeerUids)
 
 	ms.writeMu.Lock()
 	syscall.Close(ms.mountFd)
+	ms.closeClones()
 	ms.writeMu.Unlock()
 }
 
-// Wait waits for the serve loop to exit. This should only be called
-// after Serve has been called, or it will hang indefinitely.
+// Wait waits for the serve loop to exit, and Serve to close the
+// device and the splice pipes. This should only be called after Serve
+// has been called, or it will hang indefinitely.
 func (ms *Server) Wait() {
 	ms.loops.Wait()
-}
-
-func (ms *Server) wakeupReader() {
-	cmd := exec.Command("df", ms.mountPoint)
-	_ = cmd.Run()
+	if atomic.LoadInt32(&ms.serving) != 0 {
+		<-ms.serveDone
+	}
 }
 
 func (ms *Server) Shutdown() bool {
-	log.Printf("try to restart gracefully")
+	ms.infof("try to restart gracefully")
+	if ms.opts.UnmountFlushTimeout > 0 {
+		if err := ms.flushOpenFiles(); err != nil {
+			ms.errorf("Shutdown: %v", err)
+		}
+	}
 	start := time.Now()
 	ms.reqMu.Lock()
 	ms.shutdown = true
@@ -569,15 +1187,15 @@ func (ms *Server) Shutdown() bool {
 	reqs := len(ms.reqInflight)
 	ms.reqMu.Unlock()
 
-	for readers > 0 || reqs > 0 || atomic.LoadInt64(&ms.writes) > 0 {
+	for readers > 0 || reqs > 0 || atomic.LoadInt64(&ms.counters.writes) > 0 {
 		if readers > 0 {
 			go ms.wakeupReader()
-		} else if atomic.LoadInt64(&ms.writes) > 0 {
+		} else if atomic.LoadInt64(&ms.counters.writes) > 0 {
 			// the write could be blocked by FUSE requests, let's process them
 			time.Sleep(time.Millisecond * 100)
 			// double check
-			if n := atomic.LoadInt64(&ms.writes); n > 0 {
-				log.Printf("restore process for %d writes", n)
+			if n := atomic.LoadInt64(&ms.counters.writes); n > 0 {
+				ms.infof("restore process for %d writes", n)
 				ms.reqMu.Lock()
 				ms.shutdown = false
 				ms.reqMu.Unlock()
@@ -589,7 +1207,7 @@ func (ms *Server) Shutdown() bool {
 		}
 		if time.Since(start) > time.Second*3 {
 			ms.reqMu.Lock()
-			log.Printf("interrupt %d inflight requests", len(ms.reqInflight))
+			ms.infof("interrupt %d inflight requests", len(ms.reqInflight))
 			for _, req := range ms.reqInflight {
 				if !req.interrupted {
 					close(req.cancel)
@@ -599,11 +1217,12 @@ func (ms *Server) Shutdown() bool {
 			ms.reqMu.Unlock()
 		}
 		if time.Since(start) > time.Second*10 {
-			log.Printf("FUSE session is still busy (%d readers, %d requests, %d writers) after 10 seconds, give up",
-				readers, reqs, atomic.LoadInt64(&ms.writes))
+			ms.errorf("FUSE session is still busy (%d readers, %d requests, %d writers) after 10 seconds, give up",
+				readers, reqs, atomic.LoadInt64(&ms.counters.writes))
 			ms.reqMu.Lock()
 			ms.shutdown = false
 			ms.reqMu.Unlock()
+			atomic.StoreInt32(&ms.flushing, 0)
 			return false
 		}
 		time.Sleep(time.Millisecond * 10)
@@ -616,7 +1235,7 @@ func (ms *Server) Shutdown() bool {
 	// double check
 	ms.reqMu.Lock()
 	if len(ms.reqInflight) > 0 {
-		log.Printf("there are %d requests in flight, interrupt them", len(ms.reqInflight))
+		ms.infof("there are %d requests in flight, interrupt them", len(ms.reqInflight))
 		for _, req := range ms.reqInflight {
 			ms.returnInterrupted(req.inHeader.Unique)
 		}
@@ -630,7 +1249,7 @@ func (ms *Server) handleInit() Status {
 	// and don't spawn new readers.
 	orig := ms.singleReader
 	ms.singleReader = true
-	req, errNo := ms.readRequest(false)
+	req, errNo := ms.readRequest(nil, false)
 	ms.singleReader = orig
 
 	if errNo != OK || req == nil {
@@ -646,11 +1265,76 @@ func (ms *Server) handleInit() Status {
 	return OK
 }
 
-func (ms *Server) loop(exitIdle bool) {
+// startPinnedLoops starts the reader loops of
+// MountOptions.PinReaders. It returns false if there are none, in
+// which case the caller should run a loop itself.
+func (ms *Server) startPinnedLoops() bool {
+	if !ms.opts.PinReaders || ms.singleReader {
+		return false
+	}
+	cpus := ms.opts.ReaderCPUs
+	if len(cpus) == 0 {
+		var err error
+		if cpus, err = processCPUs(); err != nil {
+			ms.errorf("PinReaders: %v", err)
+			return false
+		}
+		if n := runtime.GOMAXPROCS(0); len(cpus) > n {
+			cpus = cpus[:n]
+		}
+	}
+	ms.reqMu.Lock()
+	if max := ms.opts.MaxHandlers; max > 0 {
+		// The pinned loops replace the loop of Serve, and there
+		// is at least one of them.
+		n := max - ms.handlersLocked() + ms.fixedLoops
+		if n < 1 {
+			n = 1
+		}
+		if len(cpus) > n {
+			cpus = cpus[:n]
+		}
+	}
+	if len(cpus) > 0 {
+		ms.fixedLoops = len(cpus)
+	}
+	ms.reqMu.Unlock()
+	if len(cpus) == 0 {
+		return false
+	}
+	for _, cpu := range cpus {
+		ms.loops.Add(1)
+		go ms.pinnedLoop(cpu)
+	}
+	// The loop that was accounted for on mount is not run.
+	ms.loops.Done()
+	return true
+}
+
+func (ms *Server) pinnedLoop(cpu int) {
+	// The thread is not unlocked, so it exits along with the
+	// goroutine rather than being reused with a changed affinity.
+	runtime.LockOSThread()
+	if err := pinThread(cpu); err != nil {
+		ms.errorf("PinReaders: CPU %d: %v", cpu, err)
+	}
+	ms.loop(nil, false)
+}
+
+// loop reads and dispatches requests. It reads from clone if set,
+// and from the mount descriptor otherwise.
+func (ms *Server) loop(clone *devClone, exitIdle bool) {
 	defer ms.loops.Done()
+	if exitIdle {
+		defer func() {
+			ms.reqMu.Lock()
+			ms.extraLoops--
+			ms.reqMu.Unlock()
+		}()
+	}
 exit:
 	for {
-		req, errNo := ms.readRequest(exitIdle)
+		req, errNo := ms.readRequest(clone, exitIdle)
 		switch errNo {
 		case OK:
 			if req == nil {
@@ -660,15 +1344,18 @@ exit:
 			continue
 		case ENODEV:
 			// unmount
-			if ms.opts.Debug {
-				log.Printf("received ENODEV (unmount request), thread exiting")
+			if ms.debugEnabled() {
+				ms.debugf("received ENODEV (unmount request), thread exiting")
 			}
 			break exit
 		default: // some other error?
-			log.Printf("Failed to read from fuse conn: %v", errNo)
+			ms.errorf("Failed to read from fuse conn: %v", errNo)
 			break exit
 		}
 
+		if ms.sched != nil && ms.sched.submit(req) {
+			continue
+		}
 		if ms.singleReader {
 			go ms.handleRequest(req)
 		} else {
@@ -678,44 +1365,101 @@ exit:
 }
 
 func (ms *Server) handleRequest(req *request) Status {
+	ms.slowStacks.label()
 	if ms.opts.SingleThreaded {
 		ms.requestProcessingMu.Lock()
 		defer ms.requestProcessingMu.Unlock()
 	}
 
-	req.parse()
-	if req.handler == nil {
-		req.status = ENOSYS
+	req.handler = ms.handler(req.inHeader.Opcode)
+	if err := req.parse(ms.kernelSettings); err != nil {
+		ms.errorf("%v", err)
+	}
+	ms.countRequest(req)
+
+	ms.assignTraceID(req)
+	req.debug = ms.debugRequest(req)
+	if req.status.Ok() && req.debug {
+		ms.logRequest(req)
 	}
 
-	if req.status.Ok() && ms.opts.Debug {
-		log.Println(req.InputDebug())
+	if req.status.Ok() {
+		ms.startRequestContext(req)
 	}
 
 	if req.inHeader.NodeId == pollHackInode ||
 		req.inHeader.NodeId == FUSE_ROOT_ID && len(req.filenames) > 0 && req.filenames[0] == pollHackName {
 		doPollHackLookup(ms, req)
+	} else if req.status.Ok() && ms.rejectedWhileFlushing(req) {
+		req.status = EROFS
+	} else if req.status.Ok() && ms.rejectedAfterUnmount(req) {
+		req.status = ms.opts.AfterUnmountStatus
 	} else if req.status.Ok() && req.handler.Func == nil {
-		log.Printf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
+		ms.errorf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
 		req.status = ENOSYS
+	} else if req.status.Ok() && ms.interruptedBeforeDispatch(req) {
+		req.status = EINTR
+	} else if req.status.Ok() && ms.limiter != nil {
+		if !ms.dispatchLimited(req) {
+			// Held back by the rate limit; served and
+			// answered later, see holdLimited.
+			return OK
+		}
 	} else if req.status.Ok() {
-		req.handler.Func(ms, req)
+		ms.dispatchUndestroyed(req)
 	}
+	return ms.sendReply(req)
+}
 
+// sendReply writes the reply to a request that was served, and
+// returns it to the pool.
+func (ms *Server) sendReply(req *request) Status {
+	if !ms.claimReply(req) {
+		// The watchdog answered with EIO already.
+		ms.returnRequest(req)
+		return OK
+	}
+	if ms.queueWrite(req) {
+		return OK
+	}
 	errNo := ms.write(req)
+	ms.finishRequest(req, errNo)
+	return errNo
+}
+
+// interruptedBeforeDispatch returns whether the kernel interrupted
+// req while it waited for a handler, eg. in the queue of the
+// Scheduler. Such requests are answered with EINTR without calling
+// the file system. Requests that are interrupted later see their
+// context canceled.
+func (ms *Server) interruptedBeforeDispatch(req *request) bool {
+	switch req.inHeader.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_RELEASE, _OP_RELEASEDIR, _OP_DESTROY:
+		// These must be served regardless.
+		return false
+	}
+	select {
+	case <-req.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// finishRequest logs write errors and returns req to the pool.
+func (ms *Server) finishRequest(req *request, errNo Status) {
 	if errNo != 0 {
 		// Unless debugging is enabled, ignore ENOENT for INTERRUPT responses
 		// which indicates that the referred request is no longer known by the
 		// kernel. This is a normal if the referred request already has
 		// completed.
-		if ms.opts.Debug || !(req.inHeader.Opcode == _OP_INTERRUPT && errNo == ENOENT) {
-			log.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
+		if req.debug || !(req.inHeader.Opcode == _OP_INTERRUPT && errNo == ENOENT) {
+			ms.errorf("writer: Write/Writev failed, err: %v. opcode: %v",
 				errNo, operationName(req.inHeader.Opcode))
 		}
 
 	}
 	ms.returnRequest(req)
-	return Status(errNo)
 }
 
 // alignSlice ensures that the byte at alignedByte is aligned with the
@@ -753,23 +1497,38 @@ func (ms *Server) write(req *request) Status {
 		}
 	}
 
+	if req.inHeader.Unique == 0 {
+		// Notifications do not go through handleRequest.
+		req.debug = ms.debugRequest(req)
+	}
 	header := req.serializeHeader(req.flatDataSize())
-	if ms.opts.Debug {
-		log.Println(req.OutputDebug())
+	if req.debug {
+		ms.logReply(req)
+	}
+	if ms.opts.VerifyReplies && header != nil {
+		if err := req.verifyHeader(header); err != nil {
+			log.Panicf("%s: %v", req.InputDebug(), err)
+		}
 	}
 
 	if header == nil {
 		return OK
 	}
 
-	atomic.AddInt64(&ms.writes, 1)
+	atomic.AddInt64(&ms.counters.writes, 1)
 	defer func() {
-		atomic.AddInt64(&ms.writes, -1)
+		atomic.AddInt64(&ms.counters.writes, -1)
 	}()
 	s := ms.systemWrite(req, header)
 	return s
 }
 
+// skipForget returns whether forgets should be dropped, see
+// MountOptions.SkipForgetOnUnmount.
+func (ms *Server) skipForget() bool {
+	return ms.opts.SkipForgetOnUnmount && atomic.LoadInt32(&ms.unmounting) != 0
+}
+
 func (ms *Server) isShutdown() bool {
 	ms.reqMu.Lock()
 	defer ms.reqMu.Unlock()
@@ -804,8 +1563,8 @@ func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
 	result := ms.write(&req)
 	ms.writeMu.RUnlock()
 
-	if ms.opts.Debug {
-		log.Println("Response: INODE_NOTIFY", result)
+	if req.debug {
+		ms.debugf("Response: INODE_NOTIFY %v", result)
 	}
 	return result
 }
@@ -869,8 +1628,8 @@ func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte
 	result := ms.write(&req)
 	ms.writeMu.RUnlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: INODE_NOTIFY_STORE_CACHE: %v", result)
+	if req.debug {
+		ms.debugf("Response: INODE_NOTIFY_STORE_CACHE: %v", result)
 	}
 	return result
 }
@@ -964,8 +1723,8 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 	result := ms.write(&req)
 	ms.writeMu.RUnlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: NOTIFY_RETRIEVE_CACHE: %v", result)
+	if req.debug {
+		ms.debugf("Response: NOTIFY_RETRIEVE_CACHE: %v", result)
 	}
 	if result != OK {
 		ms.retrieveMu.Lock()
@@ -979,7 +1738,7 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 			// unexpected NotifyReply with our notifyUnique, then
 			// retrieveNext wraps, makes full cycle, and another
 			// retrieve request is made with the same notifyUnique.
-			log.Printf("W: INODE_RETRIEVE_CACHE: request with notifyUnique=%d mutated", q.NotifyUnique)
+			ms.errorf("W: INODE_RETRIEVE_CACHE: request with notifyUnique=%d mutated", q.NotifyUnique)
 		}
 		ms.retrieveMu.Unlock()
 		return 0, result
@@ -1042,8 +1801,8 @@ func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status
 	result := ms.write(&req)
 	ms.writeMu.RUnlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: DELETE_NOTIFY: %v", result)
+	if req.debug {
+		ms.debugf("Response: DELETE_NOTIFY: %v", result)
 	}
 	return result
 }
@@ -1055,6 +1814,22 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	if !ms.kernelSettings.SupportsNotify(NOTIFY_INVAL_ENTRY) {
 		return ENOSYS
 	}
+	return ms.entryNotify(parent, name, 0)
+}
+
+// EntryExpireNotify is like EntryNotify, but only marks the entry
+// for revalidation on its next use, rather than dropping it from the
+// kernel cache. Lookups in progress are not disturbed, which makes
+// this cheaper for file systems that invalidate often. It needs
+// protocol version 38.
+func (ms *Server) EntryExpireNotify(parent uint64, name string) Status {
+	if !ms.kernelSettings.SupportsVersion(7, 38) {
+		return ENOSYS
+	}
+	return ms.entryNotify(parent, name, FUSE_EXPIRE_ONLY)
+}
+
+func (ms *Server) entryNotify(parent uint64, name string, flags uint32) Status {
 	if ms.isShutdown() {
 		return EINTR
 	}
@@ -1068,6 +1843,7 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	entry := (*NotifyInvalEntryOut)(req.outData())
 	entry.Parent = parent
 	entry.NameLen = uint32(len(name))
+	entry.Flags = flags
 
 	// Many versions of FUSE generate stacktraces if the
 	// terminating null byte is missing.
@@ -1081,8 +1857,70 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	result := ms.write(&req)
 	ms.writeMu.RUnlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: ENTRY_NOTIFY: %v", result)
+	if req.debug {
+		ms.debugf("Response: ENTRY_NOTIFY: %v", result)
+	}
+	return result
+}
+
+// ResendNotify asks the kernel to resend the requests that were read
+// from the FUSE device, but not answered yet. A server that takes
+// over the device from a process that died uses this to recover the
+// requests that process was working on. The kernel must have
+// negotiated CAP_HAS_RESEND.
+func (ms *Server) ResendNotify() Status {
+	if !ms.kernelSettings.SupportsNotify(NOTIFY_RESEND) || ms.kernelSettings.Flags64()&CAP_HAS_RESEND == 0 {
+		return ENOSYS
+	}
+	if ms.isShutdown() {
+		return EINTR
+	}
+
+	req := request{
+		inHeader: &InHeader{
+			Opcode: _OP_NOTIFY_RESEND,
+		},
+		handler: operationHandlers[_OP_NOTIFY_RESEND],
+		status:  NOTIFY_RESEND,
+	}
+
+	// Protect against concurrent close.
+	ms.writeMu.RLock()
+	result := ms.write(&req)
+	ms.writeMu.RUnlock()
+
+	if req.debug {
+		ms.debugf("Response: RESEND_NOTIFY: %v", result)
+	}
+	return result
+}
+
+// NotifyPollWakeup wakes up the poll(2) calls that wait on the kernel
+// poll handle kh, see RawFileSystem.Poll.
+func (ms *Server) NotifyPollWakeup(kh uint64) Status {
+	if !ms.kernelSettings.SupportsNotify(NOTIFY_POLL) {
+		return ENOSYS
+	}
+	if ms.isShutdown() {
+		return EINTR
+	}
+
+	req := request{
+		inHeader: &InHeader{
+			Opcode: _OP_NOTIFY_POLL,
+		},
+		handler: operationHandlers[_OP_NOTIFY_POLL],
+		status:  NOTIFY_POLL,
+	}
+	(*NotifyPollWakeupOut)(req.outData()).Kh = kh
+
+	// Protect against concurrent close.
+	ms.writeMu.RLock()
+	result := ms.write(&req)
+	ms.writeMu.RUnlock()
+
+	if req.debug {
+		ms.debugf("Response: POLL_NOTIFY: %v", result)
 	}
 	return result
 }
@@ -1097,6 +1935,8 @@ func (in *InitIn) SupportsVersion(maj, min uint32) bool {
 // supported. Pass any of the NOTIFY_* types as argument.
 func (in *InitIn) SupportsNotify(notifyType int) bool {
 	switch notifyType {
+	case NOTIFY_POLL:
+		return in.SupportsVersion(7, 11)
 	case NOTIFY_INVAL_ENTRY:
 		return in.SupportsVersion(7, 12)
 	case NOTIFY_INVAL_INODE:
@@ -1105,16 +1945,31 @@ func (in *InitIn) SupportsNotify(notifyType int) bool {
 		return in.SupportsVersion(7, 15)
 	case NOTIFY_DELETE:
 		return in.SupportsVersion(7, 18)
+	case NOTIFY_RESEND:
+		return in.SupportsVersion(7, 40)
 	}
 	return false
 }
 
+// Flags64 returns the capability flags as a single 64-bit word. The
+// upper half is taken from Flags2 if CAP_INIT_EXT is set.
+func (in *InitIn) Flags64() uint64 {
+	fl := uint64(in.Flags)
+	if in.Flags&CAP_INIT_EXT != 0 {
+		fl |= uint64(in.Flags2) << 32
+	}
+	return fl
+}
+
 // WaitMount waits for the first request to be served. Use this to
 // avoid racing between accessing the (empty or not yet mounted)
 // mountpoint, and the OS trying to setup the user-space mount.
 func (ms *Server) WaitMount() error {
 	err := <-ms.ready
-	if err != nil {
+	// Without a mount point, eg. for a session taken over from
+	// another process, there is nowhere to create the poll hack
+	// file; it would end up in the working directory.
+	if err != nil || ms.vhost != nil || ms.opts.EnablePoll || ms.mountPoint == "" {
 		return err
 	}
 	return pollHack(ms.mountPoint)
@@ -38,3 +38,32 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	}
 	return ToStatus(err)
 }
+
+// RegisterBackingFd is not supported on Darwin.
+func (ms *Server) RegisterBackingFd(m *BackingMap) (int32, syscall.Errno) {
+	return 0, syscall.ENOSYS
+}
+
+// UnregisterBackingFd is not supported on Darwin.
+func (ms *Server) UnregisterBackingFd(id int32) syscall.Errno {
+	return syscall.ENOSYS
+}
+
+// uringEntry is only used on Linux.
+type uringEntry struct{}
+
+// The virtio-fs transport is only available on Linux.
+type vhostUserSession struct{}
+type virtqElem struct{}
+
+func (s *vhostUserSession) serve()       {}
+func (s *vhostUserSession) close() error { return nil }
+
+func (ms *Server) startIoUring() {}
+
+// PinReaders is only supported on Linux.
+func processCPUs() ([]int, error) { return nil, syscall.ENOSYS }
+func pinThread(cpu int) error     { return syscall.ENOSYS }
+
+// DeviceClones is only supported on Linux.
+func cloneDevice(fd int) (int, error) { return -1, syscall.ENOSYS }
@@ -5,14 +5,30 @@
 package fuse
 
 import (
-	"log"
+	"errors"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
 )
 
+// errSpliceStalled is returned by trySplice if a pipe had no room for
+// the reply within MountOptions.SpliceTimeout.
+var errSpliceStalled = errors.New("splice stalled")
+
 func (ms *Server) systemWrite(req *request, header []byte) Status {
+	if req.ring != nil {
+		return req.ring.write(req, header)
+	}
+	if req.virtq != nil {
+		return req.virtq.write(req, header)
+	}
+	if ms.vhost != nil {
+		// Notifications have no virtqueue.
+		return ENOSYS
+	}
 	if req.flatDataSize() == 0 {
 		err := handleEINTR(func() error {
-			_, err := syscall.Write(ms.mountFd, header)
+			_, err := syscall.Write(ms.devFd(req), header)
 			return err
 		})
 		return ToStatus(err)
@@ -25,7 +41,15 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 				req.readResult.Done()
 				return OK
 			}
-			log.Println("trySplice:", err)
+			atomic.AddUint64(&ms.counters.spliceFallbacks, 1)
+			if err == errSpliceStalled {
+				atomic.AddUint64(&ms.counters.spliceStalls, 1)
+				if ms.debugEnabled() {
+					ms.debugf("trySplice: %v, writing reply to %d", err, req.inHeader.Unique)
+				}
+			} else {
+				ms.errorf("trySplice: %v", err)
+			}
 		}
 
 		sz := req.flatDataSize()
@@ -42,9 +66,44 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	} else {
 		bufs = append(bufs, req.flatData)
 	}
-	_, err := writev(ms.mountFd, bufs)
+	_, err := writev(ms.devFd(req), bufs)
 	if req.readResult != nil {
 		req.readResult.Done()
 	}
 	return ToStatus(err)
 }
+
+const (
+	// _IOW(229, 1, struct fuse_backing_map)
+	_FUSE_DEV_IOC_BACKING_OPEN = 0x4010e501
+	// _IOW(229, 2, uint32_t)
+	_FUSE_DEV_IOC_BACKING_CLOSE = 0x4004e502
+)
+
+// RegisterBackingFd registers the given file descriptor with the
+// kernel, for use as a passthrough backing file. It returns the ID
+// to put in OpenOut.BackingId. The kernel keeps its own reference to
+// the file, so the descriptor may be closed after registration. This
+// requires MountOptions.EnablePassthrough and CAP_SYS_ADMIN.
+func (ms *Server) RegisterBackingFd(m *BackingMap) (int32, syscall.Errno) {
+	if ms.kernelSettings.Flags64()&CAP_PASSTHROUGH == 0 {
+		return 0, syscall.ENOSYS
+	}
+	id, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(ms.mountFd),
+		_FUSE_DEV_IOC_BACKING_OPEN, uintptr(unsafe.Pointer(m)))
+	return int32(id), errno
+}
+
+// UnregisterBackingFd drops the kernel reference to a backing file
+// registered with RegisterBackingFd. Files opened with the ID
+// remain usable until they are closed.
+func (ms *Server) UnregisterBackingFd(id int32) syscall.Errno {
+	if ms.kernelSettings.Flags64()&CAP_PASSTHROUGH == 0 {
+		return syscall.ENOSYS
+	}
+	// The kernel reads the ID as uint32_t through the pointer.
+	arg := uint32(id)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(ms.mountFd),
+		_FUSE_DEV_IOC_BACKING_CLOSE, uintptr(unsafe.Pointer(&arg)))
+	return errno
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// UnmountOnSignalOptions makes the server unmount the file system
+// when the process is signalled, see MountOptions.UnmountOnSignal.
+//
+// On the first signal, the file system is unmounted as with
+// GracefulUnmount: the requests in flight may take GracePeriod to
+// finish. A second signal cuts the grace period short. If the
+// unmount fails, eg. because the file system is busy, it is done
+// lazily if Lazy is set; otherwise the server keeps serving, and the
+// next signal tries again.
+//
+// Once unmounted, Serve and Wait return, so a program whose main
+// function ends with Wait exits.
+type UnmountOnSignalOptions struct {
+	// Signals are the signals to handle. If empty, SIGINT and
+	// SIGTERM are handled.
+	Signals []os.Signal
+
+	// GracePeriod is the time that the requests in flight may
+	// take before they are interrupted. If 0, 10 seconds is used.
+	GracePeriod time.Duration
+
+	// Lazy makes the server detach the file system lazily if it
+	// cannot be unmounted otherwise, see MountOptions.LazyUnmount.
+	Lazy bool
+
+	// Exit makes the server exit the process with os.Exit(0) once
+	// the file system is unmounted, rather than leaving that to
+	// the program.
+	Exit bool
+}
+
+const defaultSignalGracePeriod = 10 * time.Second
+
+// osExit is os.Exit, replaced in tests.
+var osExit = os.Exit
+
+// handleSignals starts unmounting the file system on the signals of
+// MountOptions.UnmountOnSignal.
+func (ms *Server) handleSignals() {
+	sigs := ms.opts.UnmountOnSignal.Signals
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go ms.unmountOnSignal(ch)
+}
+
+func (ms *Server) unmountOnSignal(ch chan os.Signal) {
+	defer signal.Stop(ch)
+	opts := ms.opts.UnmountOnSignal
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = defaultSignalGracePeriod
+	}
+
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-ch:
+		case <-ms.serveDone:
+			// Unmounted by other means.
+			return
+		}
+		mountPoint := ms.mountPointLocked()
+		ms.infof("received %v, unmounting %s", sig, mountPoint)
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		go func() {
+			select {
+			case sig := <-ch:
+				ms.infof("received %v, interrupting requests in flight", sig)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := ms.GracefulUnmount(ctx)
+		cancel()
+
+		if err != nil && ms.mountPointLocked() != "" && opts.Lazy {
+			ms.infof("unmount %s: %v, detaching lazily", mountPoint, err)
+			o := *ms.opts
+			o.LazyUnmount = true
+			err = ms.unmount(&o)
+		}
+		if ms.mountPointLocked() != "" {
+			ms.errorf("unmount %s: %v", mountPoint, err)
+			continue
+		}
+		if err != nil {
+			ms.infof("unmounted %s: %v", mountPoint, err)
+		}
+		if opts.Exit {
+			osExit(0)
+		}
+		return
+	}
+}
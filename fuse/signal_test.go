@@ -0,0 +1,47 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnmountOnSignal(t *testing.T) {
+	exited := make(chan int, 1)
+	osExit = func(code int) { exited <- code }
+	defer func() { osExit = os.Exit }()
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		UnmountOnSignal: &UnmountOnSignalOptions{
+			Signals: []os.Signal{syscall.SIGUSR2},
+			Exit:    true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.handleSignals()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("exited with code %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("signal did not unmount")
+	}
+
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		UnmountOnSignal: &UnmountOnSignalOptions{GracePeriod: -time.Second},
+	}); err == nil {
+		t.Error("negative GracePeriod accepted")
+	}
+}
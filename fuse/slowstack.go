@@ -0,0 +1,187 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSlowStacks bounds the number of distinct stacks kept per
+// opcode. Samples of further stacks are dropped.
+const maxSlowStacks = 64
+
+// SlowStack is a stack trace sampled from a handler that ran longer
+// than MountOptions.SlowRequestThreshold.
+type SlowStack struct {
+	// Opcode is the name of the operation, eg. "GETATTR".
+	Opcode string
+
+	// Stack lists the frames of the handler goroutine, innermost
+	// first, down to the dispatch of the request.
+	Stack string
+
+	// Count is the number of times the stack was sampled.
+	Count int
+}
+
+// slowStacks aggregates the stacks of slow handlers.
+type slowStacks struct {
+	// labels marks the goroutines that handle requests for the
+	// server, so the sampler only picks up its own handlers.
+	labels context.Context
+
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+// slowStackLabel is the pprof label that carries the server of a
+// handler goroutine.
+const slowStackLabel = "go-fuse-server"
+
+func (s *slowStacks) init(ms *Server) {
+	s.labels = pprof.WithLabels(context.Background(), pprof.Labels(slowStackLabel, fmt.Sprintf("%p", ms)))
+}
+
+// label marks the calling goroutine as a handler. It does not
+// allocate, so it is cheap enough to call for every request.
+func (s *slowStacks) label() {
+	if s.labels != nil {
+		pprof.SetGoroutineLabels(s.labels)
+	}
+}
+
+func (s *slowStacks) add(opcode, stack string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = map[string]map[string]int{}
+	}
+	m := s.counts[opcode]
+	if m == nil {
+		m = map[string]int{}
+		s.counts[opcode] = m
+	}
+	if _, ok := m[stack]; ok || len(m) < maxSlowStacks {
+		m[stack] += n
+	}
+}
+
+// SlowStacks returns the stacks sampled from handlers that ran longer
+// than MountOptions.SlowRequestThreshold, most frequent first.
+func (ms *Server) SlowStacks() []SlowStack {
+	s := &ms.slowStacks
+	s.mu.Lock()
+	var r []SlowStack
+	for op, m := range s.counts {
+		for stack, n := range m {
+			r = append(r, SlowStack{Opcode: op, Stack: stack, Count: n})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Count != r[j].Count {
+			return r[i].Count > r[j].Count
+		}
+		if r[i].Opcode != r[j].Opcode {
+			return r[i].Opcode < r[j].Opcode
+		}
+		return r[i].Stack < r[j].Stack
+	})
+	return r
+}
+
+// sampleSlowRequests checks the requests in flight once per
+// threshold, until the server stops serving.
+func (ms *Server) sampleSlowRequests() {
+	t := time.NewTicker(ms.opts.SlowRequestThreshold)
+	defer t.Stop()
+	for {
+		select {
+		case <-ms.serveDone:
+			return
+		case now := <-t.C:
+			ms.sampleSlow(now)
+		}
+	}
+}
+
+// sampleSlow records the stacks of the handlers of requests that
+// arrived more than the threshold before now. Fast requests pay
+// nothing for this, as the goroutine profile is only taken once a
+// request is found to be slow. The profile aggregates goroutines
+// with the same stack, and only those that carry the label of the
+// server are kept.
+func (ms *Server) sampleSlow(now time.Time) {
+	funcs := map[string]string{}
+	ms.reqMu.Lock()
+	for _, req := range ms.reqInflight {
+		if req.startTime.IsZero() || now.Sub(req.startTime) < ms.opts.SlowRequestThreshold {
+			continue
+		}
+		if h := getHandler(req.inHeader.Opcode); h != nil && h.FuncName != "" {
+			funcs[h.FuncName] = h.Name
+		}
+	}
+	ms.reqMu.Unlock()
+	if len(funcs) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		ms.errorf("SlowRequestThreshold: %v", err)
+		return
+	}
+	v, _ := pprof.Label(ms.slowStacks.labels, slowStackLabel)
+	label := fmt.Sprintf("%q:%q", slowStackLabel, v)
+	for _, g := range strings.Split(buf.String(), "\n\n") {
+		if op, stack, n := handlerStack(g, label, funcs); op != "" {
+			ms.slowStacks.add(op, stack, n)
+		}
+	}
+}
+
+// handlerStack parses a record of a goroutine profile, which lists
+// the goroutines with the same stack. If they carry label, and one of
+// funcs is on the stack, it returns the name of its opcode, the frames
+// up to it without PC offsets, and the number of goroutines.
+func handlerStack(g string, label string, funcs map[string]string) (opcode string, stack string, n int) {
+	lines := strings.Split(strings.TrimSpace(g), "\n")
+	if len(lines) < 2 {
+		return "", "", 0
+	}
+	if _, err := fmt.Sscanf(lines[0], "%d @", &n); err != nil {
+		return "", "", 0
+	}
+	if !strings.HasPrefix(lines[1], "# labels: ") || !strings.Contains(lines[1], label) {
+		return "", "", 0
+	}
+
+	var frames []string
+	for _, l := range lines[2:] {
+		// "#\t0x4a1b2c\tpkg.fn+0x2c\t/path/file.go:12"
+		f := strings.Fields(strings.TrimPrefix(l, "#"))
+		if len(f) != 3 {
+			continue
+		}
+		fn := f[1]
+		if j := strings.LastIndex(fn, "+0x"); j >= 0 {
+			fn = fn[:j]
+		}
+		frames = append(frames, fn, "\t"+f[2])
+		if op, ok := funcs[fn]; ok {
+			return op, strings.Join(frames, "\n"), n
+		}
+	}
+	return "", "", 0
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type blockingGetAttrFS struct {
+	RawFileSystem
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (fs *blockingGetAttrFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	close(fs.entered)
+	<-fs.unblock
+	return OK
+}
+
+func TestSlowStacks(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &blockingGetAttrFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		entered:       make(chan struct{}),
+		unblock:       make(chan struct{}),
+	}
+	const threshold = time.Second
+	ms, err := newServer(fs, &MountOptions{SlowRequestThreshold: threshold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	hdrSz := int(unsafe.Sizeof(InHeader{}))
+	buf := make([]byte, hdrSz+int(unsafe.Sizeof(GetAttrIn{})))
+	*(*InHeader)(unsafe.Pointer(&buf[0])) = InHeader{Length: uint32(len(buf)), Opcode: _OP_GETATTR, Unique: 1, NodeId: 1}
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	start := time.Now()
+	req.startTime = start
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ms.handleRequest(req)
+		close(done)
+	}()
+	<-fs.entered
+
+	ms.sampleSlow(start.Add(threshold / 2))
+	if got := ms.SlowStacks(); len(got) != 0 {
+		t.Errorf("sampled fast request: %v", got)
+	}
+
+	ms.sampleSlow(start.Add(threshold))
+	ms.sampleSlow(start.Add(2 * threshold))
+	close(fs.unblock)
+	<-done
+
+	got := ms.SlowStacks()
+	if len(got) != 1 {
+		t.Fatalf("got %d stacks, want 1: %v", len(got), got)
+	}
+	s := got[0]
+	if s.Opcode != "GETATTR" || s.Count != 2 {
+		t.Errorf("got opcode %q count %d, want GETATTR 2", s.Opcode, s.Count)
+	}
+	if !strings.Contains(s.Stack, "(*blockingGetAttrFS).GetAttr") || !strings.Contains(s.Stack, "fuse.doGetAttr") {
+		t.Errorf("stack misses handler frames:\n%s", s.Stack)
+	}
+	if strings.Contains(s.Stack, "+0x") || strings.Contains(s.Stack, "handleRequest") {
+		t.Errorf("stack not normalized:\n%s", s.Stack)
+	}
+}
+
+func TestHandlerStackLabel(t *testing.T) {
+	funcs := map[string]string{"github.com/hanwen/go-fuse/v2/fuse.doGetAttr": "GETATTR"}
+	record := "2 @ 0x1 0x2\n" +
+		"# labels: {\"go-fuse-server\":\"0xc000010000\"}\n" +
+		"#\t0x1\tsync.runtime_Semacquire+0x25\t/go/src/runtime/sema.go:62\n" +
+		"#\t0x2\tgithub.com/hanwen/go-fuse/v2/fuse.doGetAttr+0x2c\t/src/fuse/opcode.go:12\n"
+
+	op, stack, n := handlerStack(record, `"go-fuse-server":"0xc000010000"`, funcs)
+	want := "sync.runtime_Semacquire\n\t/go/src/runtime/sema.go:62\n" +
+		"github.com/hanwen/go-fuse/v2/fuse.doGetAttr\n\t/src/fuse/opcode.go:12"
+	if op != "GETATTR" || n != 2 || stack != want {
+		t.Errorf("got %q %d %q, want GETATTR 2 %q", op, n, stack, want)
+	}
+	if op, _, _ := handlerStack(record, `"go-fuse-server":"0xc000020000"`, funcs); op != "" {
+		t.Errorf("picked up the handler of another server: %q", op)
+	}
+}
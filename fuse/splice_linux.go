@@ -2,17 +2,72 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build !fuse_minimal
+// +build !fuse_minimal
+
 package fuse
 
 import (
 	"fmt"
 	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/splice"
 )
 
+// writePipe holds the data of a WriteData.
+type writePipe = *splice.Pair
+
 func (s *Server) setSplice() {
-	s.canSplice = splice.Resizable()
+	s.canSplice = !s.noSplice && splice.Resizable()
+}
+
+// splicePoolUsers counts the servers that are serving, and may use
+// the process-wide splice pipe pool.
+var splicePoolUsers struct {
+	sync.Mutex
+	n int
+}
+
+func (ms *Server) acquireSplicePool() {
+	splicePoolUsers.Lock()
+	splicePoolUsers.n++
+	splicePoolUsers.Unlock()
+}
+
+// releaseSplicePool closes the pipes of the splice pool once the
+// last server stops, and reports pipes that were never returned.
+func (ms *Server) releaseSplicePool() {
+	splicePoolUsers.Lock()
+	defer splicePoolUsers.Unlock()
+	splicePoolUsers.n--
+	if splicePoolUsers.n > 0 {
+		return
+	}
+	splice.ClearSplicePool()
+	if used := splice.Used(); used > 0 {
+		ms.errorf("splice: %d pipe pairs still in use after shutdown", used)
+	}
+}
+
+// spliceStats returns the number of pipe pairs in the splice pool,
+// and the number of them in use.
+func spliceStats() (total, used int) {
+	return splice.Total(), splice.Used()
+}
+
+const defaultSpliceTimeout = time.Second
+
+// spliceTimeout returns how long trySplice waits for room in a pipe,
+// see MountOptions.SpliceTimeout.
+func (ms *Server) spliceTimeout() time.Duration {
+	if ms.opts.SpliceTimeout > 0 {
+		return ms.opts.SpliceTimeout
+	}
+	return defaultSpliceTimeout
 }
 
 // trySplice:  Zero-copy read from fdData.Fd into /dev/fuse
@@ -27,7 +82,9 @@ func (s *Server) setSplice() {
 //	3) Splice the data from "pair2" into /dev/fuse
 //
 // This dance is neccessary because header and payload cannot be split across
-// two splices and we cannot seek in a pipe buffer.
+// two splices and we cannot seek in a pipe buffer. If a pipe has no room
+// within MountOptions.SpliceTimeout, trySplice gives up with
+// errSpliceStalled before anything is written to /dev/fuse.
 func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) error {
 	var err error
 
@@ -46,7 +103,11 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 	}
 
 	// Read data from file
-	payloadLen, err := pair1.LoadFromAt(fdData.Fd, fdData.Size(), fdData.Off)
+	timeout := ms.spliceTimeout()
+	payloadLen, err := pair1.LoadFromAtTimeout(fdData.Fd, fdData.Size(), fdData.Off, timeout)
+	if err == splice.ErrStalled {
+		return errSpliceStalled
+	}
 
 	if err != nil {
 		// TODO - extract the data from splice.
@@ -79,7 +140,10 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 	}
 
 	// Write data into pair2
-	n, err = pair2.LoadFrom(pair1.ReadFd(), payloadLen)
+	n, err = pair2.LoadFromTimeout(pair1.ReadFd(), payloadLen, timeout)
+	if err == splice.ErrStalled {
+		return errSpliceStalled
+	}
 	if err != nil {
 		return err
 	}
@@ -88,10 +152,149 @@ func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) e
 	}
 
 	// Write header + data to /dev/fuse
-	_, err = pair2.WriteTo(uintptr(ms.mountFd), total)
+	_, err = pair2.WriteTo(uintptr(ms.devFd(req)), total)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// readSpliced reads a request from the device fd through a pipe, see
+// MountOptions.SpliceWrite. The data of a WRITE is left in the pipe,
+// and returned as WriteData; everything else is read into dest.
+//
+// If the pipe cannot hold a request of len(dest) bytes, eg. because
+// MaxWrite exceeds /proc/sys/fs/pipe-max-size, the request is read
+// with read(2) instead.
+func (ms *Server) readSpliced(fd int, dest []byte) (int, *WriteData, error) {
+	sz := len(dest) + os.Getpagesize()
+	if sz > splice.MaxPipeSize() {
+		return readDevice(fd, dest)
+	}
+	pair, err := splice.Get()
+	if err != nil {
+		return readDevice(fd, dest)
+	}
+	if err := pair.Grow(sz); err != nil {
+		splice.Done(pair)
+		return readDevice(fd, dest)
+	}
+
+	var n int
+	err = handleEINTR(func() error {
+		m, err := syscall.Splice(fd, nil, int(pair.WriteFd()), nil, len(dest), 0)
+		n = int(m)
+		return err
+	})
+	if err != nil {
+		splice.Done(pair)
+		return 0, nil, err
+	}
+
+	// Read the header, to see whether this is a WRITE.
+	hdr := int(unsafe.Sizeof(InHeader{}))
+	if n < hdr {
+		hdr = n
+	}
+	if err := readPipe(pair, dest[:hdr]); err != nil {
+		splice.Done(pair)
+		return 0, nil, err
+	}
+	rest := n
+	if hdr == int(unsafe.Sizeof(InHeader{})) && (*InHeader)(unsafe.Pointer(&dest[0])).Opcode == _OP_WRITE {
+		if in := int(unsafe.Sizeof(WriteIn{})); n > in {
+			rest = in
+		}
+	}
+	if err := readPipe(pair, dest[hdr:rest]); err != nil {
+		splice.Done(pair)
+		return 0, nil, err
+	}
+	if rest == n {
+		splice.Done(pair)
+		return n, nil, nil
+	}
+	return rest, &WriteData{pair: pair, size: n - rest}, nil
+}
+
+// readDevice reads a request from the device fd with read(2).
+func readDevice(fd int, dest []byte) (int, *WriteData, error) {
+	var n int
+	err := handleEINTR(func() error {
+		var err error
+		n, err = syscall.Read(fd, dest)
+		return err
+	})
+	return n, nil, err
+}
+
+// readPipe fills buf from the pipe.
+func readPipe(pair *splice.Pair, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := pair.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return syscall.EIO
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// SpliceTo moves the data into fd at offset off, or at the current
+// offset of fd if off is -1. It returns the number of bytes moved,
+// which is short if fd takes fewer bytes, eg. when the disk is full.
+func (d *WriteData) SpliceTo(fd uintptr, off int64) (int, error) {
+	d.used = true
+	total := 0
+	for d.size > 0 {
+		var n int
+		var err error
+		if off < 0 {
+			n, err = d.pair.WriteTo(fd, d.size)
+		} else {
+			n, err = d.pair.WriteToAt(fd, d.size, off+int64(total))
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			break
+		}
+		d.size -= n
+		total += n
+	}
+	return total, nil
+}
+
+// Bytes reads the data into buf, which must hold Size bytes, and
+// returns the part of buf that holds it.
+func (d *WriteData) Bytes(buf []byte) ([]byte, error) {
+	d.used = true
+	if len(buf) < d.size {
+		return nil, syscall.ERANGE
+	}
+	total := 0
+	for total < d.size {
+		n, err := d.pair.Read(buf[total:d.size])
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, syscall.EIO
+		}
+		total += n
+	}
+	d.size = 0
+	return buf[:total], nil
+}
+
+// release returns the pipe to the pool. Data that was not used is
+// discarded.
+func (d *WriteData) release() {
+	splice.Done(d.pair)
+	d.pair = nil
+}
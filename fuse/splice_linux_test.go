@@ -0,0 +1,166 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !fuse_minimal
+// +build !fuse_minimal
+
+package fuse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/splice"
+)
+
+func TestSplicePoolRelease(t *testing.T) {
+	a, b := &Server{}, &Server{}
+	a.acquireSplicePool()
+	b.acquireSplicePool()
+
+	p, err := splice.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	splice.Done(p)
+
+	a.releaseSplicePool()
+	if got := splice.Total(); got != 1 {
+		t.Errorf("pool cleared while in use: got %d pairs", got)
+	}
+	b.releaseSplicePool()
+	if got := splice.Total(); got != 0 {
+		t.Errorf("got %d pairs after the last server stopped", got)
+	}
+}
+
+type spliceWriteFS struct {
+	RawFileSystem
+	file *os.File
+}
+
+func (fs *spliceWriteFS) WriteSplice(cancel <-chan struct{}, input *WriteIn, data *WriteData) (uint32, Status) {
+	n, err := data.SpliceTo(fs.file.Fd(), int64(input.Offset))
+	return uint32(n), ToStatus(err)
+}
+
+func TestSpliceWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "splicewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &spliceWriteFS{RawFileSystem: NewDefaultRawFileSystem(), file: f}
+	ms, err := newServer(fs, &MountOptions{SpliceWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ms.spliceWrites {
+		t.Fatal("SpliceWrite was not enabled")
+	}
+	ms.mountFd = fds[0]
+
+	payload := bytes.Repeat([]byte("spliced!"), 1000)
+	in := WriteIn{InHeader: InHeader{Opcode: _OP_WRITE, NodeId: 1, Unique: 1}, Offset: 10, Size: uint32(len(payload))}
+	in.Length = uint32(int(unsafe.Sizeof(in)) + len(payload))
+	msg := append((*[unsafe.Sizeof(WriteIn{})]byte)(unsafe.Pointer(&in))[:], payload...)
+	if _, err := syscall.Write(fds[1], msg); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := ms.buffers.allocInput()
+	n, wd, err := ms.readSpliced(ms.mountFd, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int(unsafe.Sizeof(in)) || wd == nil || wd.Size() != len(payload) {
+		t.Fatalf("got %d header bytes, write data %v", n, wd)
+	}
+	if got := *(*WriteIn)(unsafe.Pointer(&dest[0])); got != in {
+		t.Errorf("got header %+v, want %+v", got, in)
+	}
+	written, st := fs.WriteSplice(nil, &in, wd)
+	wd.release()
+	if !st.Ok() || int(written) != len(payload) {
+		t.Fatalf("WriteSplice: %d, %v", written, st)
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[10:], payload) {
+		t.Errorf("file has %d bytes, want the payload at offset 10", len(content))
+	}
+
+	// Other requests are read in full.
+	get := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 2}}
+	if _, err := syscall.Write(fds[1], (*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&get))[:]); err != nil {
+		t.Fatal(err)
+	}
+	n, wd, err = ms.readSpliced(ms.mountFd, dest)
+	if err != nil || wd != nil || n != int(get.Length) {
+		t.Errorf("GETATTR: got %d bytes, write data %v, err %v", n, wd, err)
+	}
+	if splice.Used() != 0 {
+		t.Errorf("%d pipes still in use", splice.Used())
+	}
+}
+
+func TestSpliceWriteMaxWrite(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &spliceWriteFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{SpliceWrite: true, MaxWrite: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[0]
+
+	// The input buffer does not fit in a pipe of
+	// /proc/sys/fs/pipe-max-size bytes, so requests are read
+	// with read(2).
+	payload := []byte("not spliced")
+	in := WriteIn{InHeader: InHeader{Opcode: _OP_WRITE, NodeId: 1, Unique: 1}, Size: uint32(len(payload))}
+	in.Length = uint32(int(unsafe.Sizeof(in)) + len(payload))
+	msg := append((*[unsafe.Sizeof(WriteIn{})]byte)(unsafe.Pointer(&in))[:], payload...)
+	if _, err := syscall.Write(fds[1], msg); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := ms.buffers.allocInput()
+	if len(dest) < 1<<20 {
+		t.Fatalf("input buffer has %d bytes, want at least MaxWrite", len(dest))
+	}
+	n, wd, err := ms.readSpliced(ms.mountFd, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd != nil || n != len(msg) {
+		t.Fatalf("got %d bytes, write data %v, want %d bytes", n, wd, len(msg))
+	}
+	if !bytes.Equal(dest[unsafe.Sizeof(in):n], payload) {
+		t.Errorf("got payload %q, want %q", dest[unsafe.Sizeof(in):n], payload)
+	}
+	if splice.Used() != 0 {
+		t.Errorf("%d pipes still in use", splice.Used())
+	}
+}
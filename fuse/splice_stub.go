@@ -0,0 +1,47 @@
+// Copyright 2016 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux || fuse_minimal
+// +build !linux fuse_minimal
+
+package fuse
+
+import (
+	"fmt"
+	"syscall"
+)
+
+type writePipe struct{}
+
+func (s *Server) setSplice() {
+	s.canSplice = false
+}
+
+func (ms *Server) acquireSplicePool() {
+}
+
+func (ms *Server) releaseSplicePool() {
+}
+
+func spliceStats() (total, used int) {
+	return 0, 0
+}
+
+func (ms *Server) trySplice(header []byte, req *request, fdData *readResultFd) error {
+	return fmt.Errorf("unimplemented")
+}
+
+func (ms *Server) readSpliced(fd int, dest []byte) (int, *WriteData, error) {
+	return 0, nil, fmt.Errorf("unimplemented")
+}
+
+func (d *WriteData) SpliceTo(fd uintptr, off int64) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func (d *WriteData) Bytes(buf []byte) ([]byte, error) {
+	return nil, syscall.ENOSYS
+}
+
+func (d *WriteData) release() {}
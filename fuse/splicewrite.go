@@ -0,0 +1,41 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+// WriteSplicer is implemented by file systems that can take the data
+// of WRITE requests from a pipe, eg. to splice it into a backing
+// file without copying it through user space. See
+// MountOptions.SpliceWrite.
+type WriteSplicer interface {
+	// WriteSplice is called instead of Write, with the data left
+	// in a pipe. If it returns ENOSYS without having used data,
+	// the data is read into memory, and Write is called instead,
+	// so file systems can splice some files and not others.
+	WriteSplice(cancel <-chan struct{}, input *WriteIn, data *WriteData) (written uint32, code Status)
+}
+
+func isWriteSplicer(fs RawFileSystem) bool {
+	_, ok := fs.(WriteSplicer)
+	return ok
+}
+
+// WriteData is the payload of a WRITE request that is left in a pipe,
+// the counterpart of ReadResultFd. It is only valid during the
+// WriteSplice call.
+type WriteData struct {
+	pair writePipe
+
+	// size is the number of bytes still in the pipe.
+	size int
+
+	// used is set once the data was read.
+	used bool
+}
+
+// Size returns the number of bytes of the write that are still in
+// the pipe.
+func (d *WriteData) Size() int {
+	return d.size
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats is a snapshot of the state of a Server, for debugging
+// mounts in production. See Server.Stats.
+type ServerStats struct {
+	// Outstanding is the number of requests that were read and
+	// not answered yet. Interrupted is the number of them that
+	// were interrupted.
+	Outstanding int
+	Interrupted int
+
+	// OldestRequest is the age of the oldest outstanding request.
+	// It is only known if requests are timed, eg. with
+	// MountOptions.EnableMetrics or RequestTimeout.
+	OldestRequest time.Duration
+
+	// Readers is the number of goroutines that read requests.
+	Readers int
+
+	// Queued is the number of requests that wait for a handler,
+	// see MountOptions.Scheduler.
+	Queued int
+
+	// WriteQueue describes the reply queue, see
+	// MountOptions.WriteQueueSize.
+	WriteQueue WriteQueueStats
+
+	// Requests counts the requests of each opcode since the server
+	// started, by name, eg. "LOOKUP". Server.Metrics has more
+	// detail.
+	Requests map[string]uint64
+
+	// SplicePipes is the number of pipe pairs in the splice pool,
+	// which is shared by the servers of the process, and
+	// SplicePipesInUse the number of them that are in use.
+	SplicePipes      int
+	SplicePipesInUse int
+
+	// SpliceFallbacks is the number of replies that could not be
+	// spliced and were written with writev instead. SpliceStalls
+	// is the number of them that waited for room in a pipe for
+	// longer than MountOptions.SpliceTimeout.
+	SpliceFallbacks uint64
+	SpliceStalls    uint64
+
+	// PooledBytes is the number of bytes held by idle buffers, if
+	// MountOptions.BufferPool is set.
+	PooledBytes int64
+
+	// ProtocolMinor is the minor version of the protocol, and
+	// KernelFlags the capabilities, that were negotiated with
+	// the kernel. KernelFlagNames lists the capabilities by name.
+	ProtocolMinor   uint32
+	KernelFlags     uint64
+	KernelFlagNames string
+}
+
+// Stats returns a snapshot of the state of the server. It is cheap
+// enough to be polled, eg. from a debug HTTP handler.
+func (ms *Server) Stats() *ServerStats {
+	s := &ServerStats{
+		WriteQueue:  ms.WriteQueueStats(),
+		Requests:    map[string]uint64{},
+		PooledBytes: ms.buffers.pooledBytes(),
+	}
+	s.SplicePipes, s.SplicePipesInUse = spliceStats()
+	s.SpliceFallbacks = atomic.LoadUint64(&ms.counters.spliceFallbacks)
+	s.SpliceStalls = atomic.LoadUint64(&ms.counters.spliceStalls)
+
+	now := time.Now()
+	ms.reqMu.Lock()
+	s.Outstanding = len(ms.reqInflight)
+	for _, req := range ms.reqInflight {
+		if req.interrupted {
+			s.Interrupted++
+		}
+		if !req.startTime.IsZero() {
+			if age := now.Sub(req.startTime); age > s.OldestRequest {
+				s.OldestRequest = age
+			}
+		}
+	}
+	s.Readers = ms.reqReaders
+	settings := ms.kernelSettings
+	ms.reqMu.Unlock()
+
+	if ms.sched != nil {
+		ms.sched.mu.Lock()
+		s.Queued = ms.sched.queued
+		ms.sched.mu.Unlock()
+	}
+
+	for op := range ms.counters.ops {
+		if n := atomic.LoadUint64(&ms.counters.ops[op]); n > 0 {
+			s.Requests[operationName(uint32(op))] = n
+		}
+	}
+
+	s.ProtocolMinor = settings.Minor
+	s.KernelFlags = settings.Flags64()
+	s.KernelFlagNames = flagString(initFlagNames, int64(s.KernelFlags), "")
+	return s
+}
+
+// countRequest counts req in ServerStats.Requests.
+func (ms *Server) countRequest(req *request) {
+	if op := req.inHeader.Opcode; op < uint32(len(ms.counters.ops)) {
+		atomic.AddUint64(&ms.counters.ops[op], 1)
+	}
+}
+
+// serverCounters holds the counters of a Server, which are accessed
+// atomically. It is allocated on its own, so the 64-bit fields are
+// aligned also on 32-bit platforms.
+type serverCounters struct {
+	// Requests per opcode.
+	ops [_OPCODE_COUNT]uint64
+
+	// Replies that could not be spliced and were written with
+	// writev instead, and those of them that timed out, see
+	// MountOptions.SpliceTimeout.
+	spliceFallbacks uint64
+	spliceStalls    uint64
+
+	// Replies being written.
+	writes int64
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestServerStats(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		Scheduler:  &SchedulerOptions{},
+		BufferPool: &BufferPoolOptions{Prealloc: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	ms.kernelSettings = InitIn{Major: 7, Minor: 38, Flags: CAP_ASYNC_READ | CAP_BIG_WRITES}
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	if s := ms.Stats(); s.Outstanding != 1 {
+		t.Errorf("got %d outstanding requests, want 1", s.Outstanding)
+	}
+	ms.handleRequest(req)
+
+	s := ms.Stats()
+	if s.Outstanding != 0 || s.Queued != 0 {
+		t.Errorf("got %d outstanding and %d queued requests", s.Outstanding, s.Queued)
+	}
+	if s.Requests["GETATTR"] != 1 || len(s.Requests) != 1 {
+		t.Errorf("got request counts %v", s.Requests)
+	}
+	if s.PooledBytes == 0 {
+		t.Error("preallocated buffer is not counted")
+	}
+	if s.ProtocolMinor != 38 || s.KernelFlags != CAP_ASYNC_READ|CAP_BIG_WRITES {
+		t.Errorf("got protocol 7.%d, flags %x", s.ProtocolMinor, s.KernelFlags)
+	}
+	if !strings.Contains(s.KernelFlagNames, "ASYNC_READ") || !strings.Contains(s.KernelFlagNames, "BIG_WRITES") {
+		t.Errorf("got flag names %q", s.KernelFlagNames)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// RequestTracer starts a span for every request, eg. an OpenTelemetry
+// span, so the latency of FUSE requests shows up in distributed
+// traces. See MountOptions.RequestTracer.
+//
+// The context that StartRequest returns is visible to the file
+// system: the Value method of a Context whose Cancel is the cancel
+// channel of the request looks up values in it. The Contexts that the
+// fs package passes to nodes are such contexts, so spans that are
+// started from them, eg. for calls to a backend store, are children of
+// the request's span. A RawFileSystem can find it by wrapping the
+// cancel channel that it is passed:
+//
+//	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+//	span := trace.SpanFromContext(ctx)
+type RequestTracer interface {
+	// StartRequest is called before the request is handed to the
+	// file system, with the opcode, eg. "LOOKUP", the node ID,
+	// and the size of the request in bytes. It returns the
+	// context of the request, and a function that is called with
+	// the status and the size of the reply once the reply is
+	// written. It is called concurrently.
+	StartRequest(ctx context.Context, op string, node uint64, size int) (context.Context, func(status Status, size int))
+}
+
+// requestContexts maps the cancel channels of requests to their
+// contexts, see startRequestContext. tracedRequests counts them, to
+// skip the lookup if there are none.
+var (
+	requestContexts sync.Map
+	tracedRequests  int32
+)
+
+// requestValue looks up key in the context of the request with the
+// given cancel channel.
+func requestValue(cancel <-chan struct{}, key interface{}) interface{} {
+	if cancel == nil || atomic.LoadInt32(&tracedRequests) == 0 {
+		return nil
+	}
+	ctx, ok := requestContexts.Load(cancel)
+	if !ok {
+		return nil
+	}
+	return ctx.(context.Context).Value(key)
+}
+
+type traceIDKeyType struct{}
+
+var traceIDKey traceIDKeyType
+
+// TraceIDFromContext returns the correlation ID of the request that
+// ctx belongs to, see MountOptions.TraceIDs. It works for the
+// Contexts that are passed to file systems, and the contexts derived
+// from them.
+func TraceIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(traceIDKey).(string)
+	return id, ok
+}
+
+// newTraceIDPrefix returns a random prefix for the trace IDs of a
+// server, so IDs of different servers and restarts do not collide.
+func newTraceIDPrefix() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:]) + "-"
+}
+
+// assignTraceID gives req its trace ID, if trace IDs are enabled.
+func (ms *Server) assignTraceID(req *request) {
+	if ms.traceIDPrefix == "" {
+		return
+	}
+	if f := ms.opts.NewTraceID; f != nil {
+		req.traceID = f(req.inHeader)
+	} else {
+		req.traceID = ms.traceIDPrefix + strconv.FormatUint(req.inHeader.Unique, 16)
+	}
+}
+
+// startRequestContext gives req its context: a child of the context
+// passed to ServeContext, with the trace ID and the span of the
+// RequestTracer, if any.
+func (ms *Server) startRequestContext(req *request) {
+	t := ms.opts.RequestTracer
+	ctx := ms.serveCtx
+	if t == nil && ctx == nil && req.traceID == "" {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if req.traceID != "" {
+		ctx = context.WithValue(ctx, traceIDKey, req.traceID)
+	}
+	if t != nil {
+		ctx, req.traceEnd = t.StartRequest(ctx, operationName(req.inHeader.Opcode),
+			req.inHeader.NodeId, len(req.inputBuf))
+	}
+	if ctx != nil {
+		requestContexts.Store((<-chan struct{})(req.cancel), ctx)
+		atomic.AddInt32(&tracedRequests, 1)
+		req.traced = true
+	}
+}
+
+// endRequestContext ends the span of req, after its reply is
+// written.
+func (ms *Server) endRequestContext(req *request) {
+	if req.traced {
+		requestContexts.Delete((<-chan struct{})(req.cancel))
+		atomic.AddInt32(&tracedRequests, -1)
+		req.traced = false
+	}
+	if req.traceEnd != nil {
+		req.traceEnd(req.status, replySize(req))
+		req.traceEnd = nil
+	}
+}
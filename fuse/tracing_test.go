@@ -0,0 +1,208 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+type spanKey struct{}
+
+type recordTracer struct {
+	mu    sync.Mutex
+	spans []string
+	ended []Status
+}
+
+func (t *recordTracer) StartRequest(ctx context.Context, op string, node uint64, size int) (context.Context, func(Status, int)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, op)
+	return context.WithValue(ctx, spanKey{}, op), func(status Status, size int) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.ended = append(t.ended, status)
+	}
+}
+
+type spanFS struct {
+	RawFileSystem
+	seen interface{}
+}
+
+func (fs *spanFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	fs.seen = (&Context{Caller: in.Caller, Cancel: cancel}).Value(spanKey{})
+	return OK
+}
+
+func TestRequestTracer(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	tracer := &recordTracer{}
+	fs := &spanFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{RequestTracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	cancel := req.cancel
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+	ms.handleRequest(req)
+
+	out := make([]byte, 4096)
+	if _, err := syscall.Read(fds[0], out); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.seen != "GETATTR" {
+		t.Errorf("file system saw span %v, want GETATTR", fs.seen)
+	}
+	if len(tracer.spans) != 1 || tracer.spans[0] != "GETATTR" {
+		t.Errorf("got spans %v", tracer.spans)
+	}
+	if len(tracer.ended) != 1 || !tracer.ended[0].Ok() {
+		t.Errorf("got ended spans %v", tracer.ended)
+	}
+	if v := (&Context{Cancel: cancel}).Value(spanKey{}); v != nil {
+		t.Errorf("context of finished request still has value %v", v)
+	}
+}
+
+func TestServeContextValues(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &spanFS{RawFileSystem: NewDefaultRawFileSystem()}
+	ms, err := newServer(fs, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+	ms.serveCtx = context.WithValue(context.Background(), spanKey{}, "serve")
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+	ms.handleRequest(req)
+
+	out := make([]byte, 4096)
+	if _, err := syscall.Read(fds[0], out); err != nil {
+		t.Fatal(err)
+	}
+	if fs.seen != "serve" {
+		t.Errorf("file system saw %v, want the value of the serve context", fs.seen)
+	}
+}
+
+type traceIDFS struct {
+	RawFileSystem
+	id string
+}
+
+func (fs *traceIDFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	fs.id, _ = TraceIDFromContext(&Context{Caller: in.Caller, Cancel: cancel})
+	return OK
+}
+
+type recordFormatter struct {
+	JSONDebugFormatter
+	lines []string
+}
+
+func (f *recordFormatter) FormatRequest(r *RequestInfo) string {
+	s := f.JSONDebugFormatter.FormatRequest(r)
+	f.lines = append(f.lines, s)
+	return s
+}
+
+func TestTraceIDs(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &traceIDFS{RawFileSystem: NewDefaultRawFileSystem()}
+	formatter := &recordFormatter{}
+	ms, err := newServer(fs, &MountOptions{
+		Debug:          true,
+		DebugFormatter: formatter,
+		NewTraceID: func(h *InHeader) string {
+			return "op-" + operationName(h.Opcode)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 1, Unique: 1}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+	ms.handleRequest(req)
+
+	out := make([]byte, 4096)
+	if _, err := syscall.Read(fds[0], out); err != nil {
+		t.Fatal(err)
+	}
+	if fs.id != "op-GETATTR" {
+		t.Errorf("file system saw trace ID %q, want op-GETATTR", fs.id)
+	}
+	if len(formatter.lines) != 1 || !strings.Contains(formatter.lines[0], `"trace_id":"op-GETATTR"`) {
+		t.Errorf("got debug output %q", formatter.lines)
+	}
+
+	if id := newTraceIDPrefix(); len(id) != 9 || id == newTraceIDPrefix() {
+		t.Errorf("got trace ID prefix %q", id)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -73,6 +74,9 @@ const (
 
 	// EROFS Read-only file system
 	EROFS = Status(syscall.EROFS)
+
+	// ENOTCONN Transport endpoint is not connected
+	ENOTCONN = Status(syscall.ENOTCONN)
 )
 
 type ForgetIn struct {
@@ -81,8 +85,9 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
-// batch forget is handled internally.
-type _ForgetOne struct {
+// ForgetOne is an entry of a BATCH_FORGET request, see
+// BatchForgetter.
+type ForgetOne struct {
 	NodeId  uint64
 	Nlookup uint64
 }
@@ -98,7 +103,8 @@ type MkdirIn struct {
 	InHeader
 
 	// The mode for the new directory. The calling process' umask
-	// is already factored into the mode.
+	// is already factored into the mode, unless
+	// MountOptions.DontUmask is set.
 	Mode  uint32
 	Umask uint32
 }
@@ -137,6 +143,10 @@ const ( // SetAttrIn.Valid
 	FATTR_MTIME_NOW = (1 << 8)
 	FATTR_LOCKOWNER = (1 << 9)
 	FATTR_CTIME     = (1 << 10)
+
+	// FATTR_KILL_SUIDGID asks to clear the setuid and setgid bits
+	// when the size changes. See MountOptions.EnableKillPriv.
+	FATTR_KILL_SUIDGID = (1 << 11)
 )
 
 type SetAttrInCommon struct {
@@ -223,6 +233,12 @@ func (s *SetAttrInCommon) GetATime() (time.Time, bool) {
 	return t, false
 }
 
+// KillSuidGid returns whether the setuid and setgid bits of the file
+// should be cleared along with the size change.
+func (s *SetAttrInCommon) KillSuidGid() bool {
+	return s.Valid&FATTR_KILL_SUIDGID != 0
+}
+
 func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 	var t time.Time
 	if s.Valid&FATTR_CTIME != 0 {
@@ -235,6 +251,10 @@ func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 
 const RELEASE_FLUSH = (1 << 0)
 
+// RELEASE_FLOCK_UNLOCK asks to drop the flock(2) lock held by
+// LockOwner on release.
+const RELEASE_FLOCK_UNLOCK = (1 << 1)
+
 type ReleaseIn struct {
 	InHeader
 	Fh           uint64
@@ -246,7 +266,29 @@ type ReleaseIn struct {
 type OpenIn struct {
 	InHeader
 	Flags uint32
-	Mode  uint32
+
+	// Mode holds the kernel's open_flags, see OpenFlags. It is
+	// named for compatibility.
+	Mode uint32
+}
+
+// OpenFlags returns the OPEN_* flags of the request.
+func (in *OpenIn) OpenFlags() uint32 {
+	return in.Mode
+}
+
+// OpenIn.OpenFlags and CreateIn.OpenFlags
+const (
+	// OPEN_KILL_SUIDGID asks to clear the setuid and setgid bits
+	// when an O_TRUNC open truncates the file. See
+	// MountOptions.EnableKillPriv.
+	OPEN_KILL_SUIDGID = (1 << 0)
+)
+
+// KillSuidGid returns whether the setuid and setgid bits of the file
+// should be cleared because the open truncates it.
+func (in *OpenIn) KillSuidGid() bool {
+	return in.OpenFlags()&OPEN_KILL_SUIDGID != 0
 }
 
 const (
@@ -254,14 +296,40 @@ const (
 	FOPEN_DIRECT_IO   = (1 << 0)
 	FOPEN_KEEP_CACHE  = (1 << 1)
 	FOPEN_NONSEEKABLE = (1 << 2)
-	FOPEN_CACHE_DIR   = (1 << 3)
-	FOPEN_STREAM      = (1 << 4)
+
+	// FOPEN_CACHE_DIR, returned from OPENDIR, lets the kernel
+	// cache the directory listing in its page cache. The cache
+	// is dropped on the next OPENDIR unless FOPEN_KEEP_CACHE is
+	// also set, and when the directory changes: its mtime
+	// changes, entries are created or removed through the mount,
+	// or an entry or the directory inode is invalidated by a
+	// notification. It needs protocol version 28.
+	FOPEN_CACHE_DIR = (1 << 3)
+	FOPEN_STREAM    = (1 << 4)
+
+	// FOPEN_NOFLUSH makes the kernel skip FLUSH when the file is
+	// closed, which saves a round trip for read-only and
+	// stateless handles. With the writeback cache, FLUSH is still
+	// sent, because it writes back dirty pages. It needs protocol
+	// version 35.
+	FOPEN_NOFLUSH = (1 << 5)
+
+	// FOPEN_PARALLEL_DIRECT_WRITES lets the kernel send direct
+	// I/O writes to the file in parallel, rather than holding
+	// the inode lock for each of them. It is only honored with
+	// FOPEN_DIRECT_IO, and needs protocol version 38.
+	FOPEN_PARALLEL_DIRECT_WRITES = (1 << 6)
+	FOPEN_PASSTHROUGH            = (1 << 7)
 )
 
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+
+	// BackingId is the ID of a backing file registered with
+	// Server.RegisterBackingFd. It is only used if OpenFlags has
+	// FOPEN_PASSTHROUGH.
+	BackingId int32
 }
 
 // To be set in InitIn/InitOut.Flags.
@@ -299,8 +367,33 @@ const (
 	CAP_CACHE_SYMLINKS      = (1 << 23)
 	CAP_NO_OPENDIR_SUPPORT  = (1 << 24)
 	CAP_EXPLICIT_INVAL_DATA = (1 << 25)
+	CAP_MAP_ALIGNMENT       = (1 << 26)
+	CAP_SUBMOUNTS           = (1 << 27)
+	CAP_HANDLE_KILLPRIV_V2  = (1 << 28)
+	CAP_SETXATTR_EXT        = (1 << 29)
+
+	// CAP_INIT_EXT signals that InitIn.Flags2 and InitOut.Flags2
+	// carry the upper 32 bits of the capability flags.
+	CAP_INIT_EXT = (1 << 30)
+)
+
+// To be set in InitIn/InitOut.Flags2, if CAP_INIT_EXT is set in
+// Flags. The values are the bit positions in the 64-bit flag word
+// returned by InitIn.Flags64.
+const (
+	CAP_CREATE_SUPP_GROUP = (1 << 34)
+	CAP_PASSTHROUGH       = (1 << 37)
+	CAP_HAS_RESEND        = (1 << 39)
+	CAP_OVER_IO_URING     = (1 << 41)
 )
 
+// BackingMap is the argument to Server.RegisterBackingFd.
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	padding uint64
+}
+
 type InitIn struct {
 	InHeader
 
@@ -308,6 +401,8 @@ type InitIn struct {
 	Minor        uint32
 	MaxReadAhead uint32
 	Flags        uint32
+	Flags2       uint32
+	Unused       [11]uint32
 }
 
 type InitOut struct {
@@ -320,8 +415,10 @@ type InitOut struct {
 	MaxWrite            uint32
 	TimeGran            uint32
 	MaxPages            uint16
-	Padding             uint16
-	Unused              [8]uint32
+	MapAlignment        uint16
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
 }
 
 type _CuseInitIn struct {
@@ -349,21 +446,58 @@ type InterruptIn struct {
 	Unique uint64
 }
 
-type _BmapIn struct {
+type BmapIn struct {
 	InHeader
 	Block     uint64
 	Blocksize uint32
 	Padding   uint32
 }
 
-type _BmapOut struct {
+type BmapOut struct {
 	Block uint64
 }
 
+// SetupMappingIn.Flags
+const (
+	SETUPMAPPING_FLAG_WRITE = (1 << 0)
+	SETUPMAPPING_FLAG_READ  = (1 << 1)
+)
+
+// SetupMappingIn asks to map Len bytes of the file at Foffset into
+// the DAX window of a virtio-fs device, at Moffset.
+type SetupMappingIn struct {
+	InHeader
+	Fh      uint64
+	Foffset uint64
+	Len     uint64
+	Flags   uint64
+	Moffset uint64
+}
+
+// RemoveMappingIn is followed by Count RemoveMappingOne entries.
+type RemoveMappingIn struct {
+	InHeader
+	Count uint32
+}
+
+// removeMappingInSize is the size of RemoveMappingIn on the wire.
+// The entries follow Count directly, without the padding that Go
+// adds to the struct on 64-bit platforms.
+const removeMappingInSize = unsafe.Sizeof(InHeader{}) + 4
+
+// RemoveMappingOne is a range of the DAX window to unmap.
+type RemoveMappingOne struct {
+	Moffset uint64
+	Len     uint64
+}
+
 const (
 	FUSE_IOCTL_COMPAT       = (1 << 0)
 	FUSE_IOCTL_UNRESTRICTED = (1 << 1)
 	FUSE_IOCTL_RETRY        = (1 << 2)
+	FUSE_IOCTL_32BIT        = (1 << 3)
+	FUSE_IOCTL_DIR          = (1 << 4)
+	FUSE_IOCTL_COMPAT_X32   = (1 << 5)
 )
 
 type IoctlIn struct {
@@ -383,20 +517,63 @@ type IoctlOut struct {
 	OutIovs uint32
 }
 
-type _PollIn struct {
+// IoctlIovec is a region of the memory of the process calling
+// ioctl(2). See IoctlOut.SetRetry.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// SetRetry answers an unrestricted ioctl (FUSE_IOCTL_UNRESTRICTED in
+// IoctlIn.Flags) with FUSE_IOCTL_RETRY. The kernel then repeats the
+// ioctl, with the contents of the in regions as input data, and
+// copies the output data to the out regions. Typically, the first
+// call asks for the structure Arg points to, and later calls for the
+// buffers that structure refers to. bufOut must be the output buffer
+// passed to RawFileSystem.Ioctl; the regions are stored in it.
+func (o *IoctlOut) SetRetry(bufOut []byte, in, out []IoctlIovec) Status {
+	n := len(in) + len(out)
+	sz := int(unsafe.Sizeof(IoctlIovec{}))
+	if n > FUSE_IOCTL_MAX_IOV || n*sz > cap(bufOut) {
+		return EINVAL
+	}
+	bufOut = bufOut[:n*sz]
+	for i, iov := range append(in[:len(in):len(in)], out...) {
+		*(*IoctlIovec)(unsafe.Pointer(&bufOut[i*sz])) = iov
+	}
+	*o = IoctlOut{
+		Flags:   FUSE_IOCTL_RETRY,
+		InIovs:  uint32(len(in)),
+		OutIovs: uint32(len(out)),
+	}
+	return OK
+}
+
+type PollIn struct {
 	InHeader
-	Fh      uint64
-	Kh      uint64
-	Flags   uint32
-	Padding uint32
+	Fh uint64
+
+	// Kh is the kernel's handle for the poll, to pass to
+	// Server.NotifyPollWakeup.
+	Kh    uint64
+	Flags uint32
+
+	// Events are the poll(2) events that are waited for.
+	Events uint32
+}
+
+// ScheduleNotify returns whether the kernel waits for a
+// Server.NotifyPollWakeup call if no events are ready.
+func (in *PollIn) ScheduleNotify() bool {
+	return in.Flags&FUSE_POLL_SCHEDULE_NOTIFY != 0
 }
 
-type _PollOut struct {
+type PollOut struct {
 	Revents uint32
 	Padding uint32
 }
 
-type _NotifyPollWakeupOut struct {
+type NotifyPollWakeupOut struct {
 	Kh uint64
 }
 
@@ -451,6 +628,10 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// FSYNC_FDATASYNC is set in FsyncIn.FsyncFlags for fdatasync(2),
+// which only needs the data and the size of the file to be synced.
+const FSYNC_FDATASYNC = 1 << 0
+
 type OutHeader struct {
 	Length uint32
 	Status int32
@@ -466,9 +647,16 @@ type NotifyInvalInodeOut struct {
 type NotifyInvalEntryOut struct {
 	Parent  uint64
 	NameLen uint32
-	Padding uint32
+	Flags   uint32
 }
 
+// NotifyInvalEntryOut.Flags
+const (
+	// FUSE_EXPIRE_ONLY expires the entry, rather than dropping
+	// it from the cache. Protocol version 38.
+	FUSE_EXPIRE_ONLY = (1 << 0)
+)
+
 type NotifyInvalDeleteOut struct {
 	Parent  uint64
 	Child   uint64
@@ -502,14 +690,15 @@ type NotifyRetrieveIn struct {
 }
 
 const (
-	//	NOTIFY_POLL         = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
+	NOTIFY_POLL           = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
 	NOTIFY_INVAL_INODE    = -2 // notify kernel that an inode should be invalidated
 	NOTIFY_INVAL_ENTRY    = -3 // notify kernel that a directory entry should be invalidated
 	NOTIFY_STORE_CACHE    = -4 // store data into kernel cache of an inode
 	NOTIFY_RETRIEVE_CACHE = -5 // retrieve data from kernel cache of an inode
 	NOTIFY_DELETE         = -6 // notify kernel that a directory entry has been deleted
+	NOTIFY_RESEND         = -7 // ask the kernel to resend requests that were read but not answered
 
-//	NOTIFY_CODE_MAX     = -6
+//	NOTIFY_CODE_MAX     = -7
 )
 
 type FlushIn struct {
@@ -543,6 +732,82 @@ type CopyFileRangeIn struct {
 	Flags     uint64
 }
 
+// Masks for Statx.Mask, see statx(2).
+const (
+	STATX_BASIC_STATS = 0x7ff
+	STATX_BTIME       = 0x800
+)
+
+// SxTime is a timestamp in Statx.
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx holds the result of statx(2). Mask has the fields that are
+// set.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type SyncFsIn struct {
+	InHeader
+	Padding uint64
+}
+
+type StatxIn struct {
+	InHeader
+
+	// GetattrFlags has FUSE_GETATTR_FH if Fh is set.
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh           uint64
+
+	// SxFlags and SxMask are the flags and mask arguments of
+	// statx(2).
+	SxFlags uint32
+	SxMask  uint32
+}
+
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Statx
+}
+
+func (o *StatxOut) Timeout() time.Duration {
+	return time.Duration(uint64(o.AttrValidNsec) + o.AttrValid*1e9)
+}
+
+func (o *StatxOut) SetTimeout(dt time.Duration) {
+	ns := int64(dt)
+	o.AttrValidNsec = uint32(ns % 1e9)
+	o.AttrValid = uint64(ns / 1e9)
+}
+
 // EntryOut holds the result of a (directory,name) lookup.  It has two
 // TTLs, one for the (directory, name) lookup itself, and one for the
 // attributes (eg. size, mode). The entry TTL also applies if the
@@ -609,15 +874,128 @@ type Caller struct {
 	Pid uint32
 }
 
+// InHeader is the header of every request. Its fields mirror the
+// kernel's fuse_in_header, and may change along with the protocol;
+// the accessor methods below, which are also available on all input
+// types embedding InHeader, stay the same.
 type InHeader struct {
 	Length uint32
 	Opcode uint32
 	Unique uint64
 	NodeId uint64
 	Caller
+
+	// Since protocol version 38, the lower half holds the length
+	// of the request extensions, in units of 8 bytes.
 	Padding uint32
 }
 
+// RequestHeader describes a request without depending on the layout
+// of InHeader. All request input types implement it.
+type RequestHeader interface {
+	// CallerUid returns the user ID of the calling process.
+	CallerUid() uint32
+
+	// CallerGid returns the group ID of the calling process.
+	CallerGid() uint32
+
+	// CallerPid returns the process ID of the caller. It is 0
+	// for requests that the kernel issues on its own, such as
+	// writeback and FORGET.
+	CallerPid() uint32
+
+	// OpcodeName returns the name of the operation, eg. "LOOKUP".
+	OpcodeName() string
+
+	// RequestLength returns the total size of the request,
+	// including header, arguments and extensions.
+	RequestLength() uint32
+
+	// ExtensionLength returns the size in bytes of the request
+	// extensions at the end of the request.
+	ExtensionLength() uint32
+
+	// SuppGroups returns the supplementary groups sent with the
+	// request. See InHeader.SuppGroups.
+	SuppGroups() []uint32
+}
+
+var _ = (RequestHeader)((*InHeader)(nil))
+
+func (h *InHeader) CallerUid() uint32 {
+	return h.Uid
+}
+
+func (h *InHeader) CallerGid() uint32 {
+	return h.Gid
+}
+
+func (h *InHeader) CallerPid() uint32 {
+	return h.Pid
+}
+
+func (h *InHeader) OpcodeName() string {
+	return operationName(h.Opcode)
+}
+
+func (h *InHeader) RequestLength() uint32 {
+	return h.Length
+}
+
+func (h *InHeader) ExtensionLength() uint32 {
+	// total_extlen is the uint16 at the start of the padding,
+	// regardless of byte order.
+	return uint32(*(*uint16)(unsafe.Pointer(&h.Padding))) * 8
+}
+
+// Request extension types.
+const (
+	_FUSE_EXT_GROUPS = 32
+)
+
+// fuseExtHeader precedes each request extension. Size includes the
+// header, and is a multiple of 8.
+type fuseExtHeader struct {
+	Size uint32
+	Type uint32
+}
+
+// SuppGroups returns the groups of the FUSE_EXT_GROUPS extension.
+// With CAP_CREATE_SUPP_GROUP, the kernel sends it for requests that
+// create files in a directory whose group is a supplementary group
+// of the caller, so the file system can check the caller's
+// permission to create files through that group. The new file only
+// gets the group if the directory is setgid.
+//
+// The extensions follow the arguments in the request buffer, so this
+// only works on the headers passed to RawFileSystem methods, not on
+// copies.
+func (h *InHeader) SuppGroups() []uint32 {
+	extLen := h.ExtensionLength()
+	if extLen == 0 || extLen > h.Length {
+		return nil
+	}
+	ext := (*[1 << 30]byte)(unsafe.Pointer(h))[h.Length-extLen : h.Length : h.Length]
+	for len(ext) >= int(unsafe.Sizeof(fuseExtHeader{})) {
+		eh := (*fuseExtHeader)(unsafe.Pointer(&ext[0]))
+		if eh.Size < uint32(unsafe.Sizeof(fuseExtHeader{})) || int(eh.Size) > len(ext) {
+			break
+		}
+		if eh.Type == _FUSE_EXT_GROUPS && eh.Size >= 12 {
+			// struct fuse_supp_groups { nr_groups; groups[]; }
+			body := ext[8:eh.Size]
+			nr := *(*uint32)(unsafe.Pointer(&body[0]))
+			var groups []uint32
+			for i := 0; i < int(nr) && 4+4*(i+1) <= len(body); i++ {
+				groups = append(groups, *(*uint32)(unsafe.Pointer(&body[4+4*i])))
+			}
+			return groups
+		}
+		ext = ext[eh.Size:]
+	}
+	return nil
+}
+
 type StatfsOut struct {
 	Blocks  uint64
 	Bfree   uint64
@@ -647,8 +1025,18 @@ const (
 const (
 	WRITE_CACHE     = (1 << 0)
 	WRITE_LOCKOWNER = (1 << 1)
+
+	// WRITE_KILL_SUIDGID asks to clear the setuid and setgid bits
+	// of the file. See MountOptions.EnableKillPriv.
+	WRITE_KILL_SUIDGID = (1 << 2)
 )
 
+// KillSuidGid returns whether the setuid and setgid bits of the file
+// should be cleared after the write.
+func (in *WriteIn) KillSuidGid() bool {
+	return in.WriteFlags&WRITE_KILL_SUIDGID != 0
+}
+
 type FallocateIn struct {
 	InHeader
 	Fh      uint64
@@ -658,6 +1046,39 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+// Values for FallocateIn.Mode. These are the Linux fallocate(2)
+// flags. The Linux FUSE driver only sends KEEP_SIZE and PUNCH_HOLE,
+// and ZERO_RANGE on recent kernels, and fails the other modes with
+// EOPNOTSUPP before they reach the file system.
+const (
+	// FALLOC_FL_KEEP_SIZE allocates or zeroes the range without
+	// growing the file past its current size.
+	FALLOC_FL_KEEP_SIZE = 0x1
+
+	// FALLOC_FL_PUNCH_HOLE deallocates the range, which then
+	// reads as zeros. It must be combined with KEEP_SIZE.
+	FALLOC_FL_PUNCH_HOLE = 0x2
+
+	// FALLOC_FL_COLLAPSE_RANGE removes the range, shifting the
+	// data after it down. The range must be block aligned and
+	// end before the end of the file, which shrinks by its length.
+	FALLOC_FL_COLLAPSE_RANGE = 0x8
+
+	// FALLOC_FL_ZERO_RANGE zeroes the range and allocates it,
+	// growing the file unless KEEP_SIZE is set.
+	FALLOC_FL_ZERO_RANGE = 0x10
+
+	// FALLOC_FL_INSERT_RANGE inserts a hole at the start of the
+	// range, shifting the data after it up. The range must be
+	// block aligned and start inside the file, which grows by its
+	// length.
+	FALLOC_FL_INSERT_RANGE = 0x20
+
+	// FALLOC_FL_UNSHARE_RANGE unshares blocks shared with other
+	// files, eg. after a reflink copy. The size does not change.
+	FALLOC_FL_UNSHARE_RANGE = 0x40
+)
+
 func (lk *FileLock) ToFlockT(flockT *syscall.Flock_t) {
 	flockT.Start = int64(lk.Start)
 	if lk.End == (1<<63)-1 {
@@ -6,6 +6,7 @@ package fuse
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 const (
@@ -85,6 +86,14 @@ type CreateIn struct {
 	Mode  uint32
 }
 
+func (in *CreateIn) KillSuidGid() bool {
+	return false
+}
+
+func (in *CreateIn) CallerUmask() uint32 {
+	return 0
+}
+
 type MknodIn struct {
 	InHeader
 
@@ -92,6 +101,10 @@ type MknodIn struct {
 	Rdev uint32
 }
 
+func (in *MknodIn) CallerUmask() uint32 {
+	return 0
+}
+
 type ReadIn struct {
 	InHeader
 
@@ -117,6 +130,12 @@ type SetXAttrIn struct {
 	Padding  uint32
 }
 
+const setXAttrInCompatSize = unsafe.Sizeof(SetXAttrIn{})
+
+func (in *SetXAttrIn) KillSgid() bool {
+	return false
+}
+
 type GetXAttrIn struct {
 	InHeader
 	Size     uint32
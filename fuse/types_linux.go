@@ -6,6 +6,7 @@ package fuse
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 const (
@@ -34,9 +35,24 @@ type Attr struct {
 
 	// Blksize is the preferred size for file system operations.
 	Blksize uint32
+
+	// Padding holds FUSE_ATTR_* flags, see AttrFlags. It is named
+	// for compatibility.
 	Padding uint32
 }
 
+// AttrFlags returns the FUSE_ATTR_* flags of the attributes.
+func (a *Attr) AttrFlags() uint32 {
+	return a.Padding
+}
+
+// Attr.AttrFlags
+const (
+	// FUSE_ATTR_SUBMOUNT marks a directory as the root of a
+	// submount. See MountOptions.EnableSubmounts.
+	FUSE_ATTR_SUBMOUNT = (1 << 0)
+)
+
 type SetAttrIn struct {
 	SetAttrInCommon
 }
@@ -70,24 +86,53 @@ type CreateIn struct {
 	InHeader
 	Flags uint32
 
-	// Mode for the new file; already takes Umask into account.
+	// Mode for the new file; already takes Umask into account,
+	// unless MountOptions.DontUmask is set.
 	Mode uint32
 
 	// Umask used for this create call.
-	Umask   uint32
+	Umask uint32
+
+	// Padding holds the kernel's open_flags, see OpenFlags. It
+	// is named for compatibility.
 	Padding uint32
 }
 
+// OpenFlags returns the OPEN_* flags of the request.
+func (in *CreateIn) OpenFlags() uint32 {
+	return in.Padding
+}
+
+// KillSuidGid returns whether the setuid and setgid bits of the file
+// should be cleared, because the create opens and truncates an
+// existing file.
+func (in *CreateIn) KillSuidGid() bool {
+	return in.OpenFlags()&OPEN_KILL_SUIDGID != 0
+}
+
+// CallerUmask returns the umask of the process that creates the
+// file.
+func (in *CreateIn) CallerUmask() uint32 {
+	return in.Umask
+}
+
 type MknodIn struct {
 	InHeader
 
-	// Mode to use, including the Umask value
+	// Mode to use, including the Umask value, unless
+	// MountOptions.DontUmask is set.
 	Mode    uint32
 	Rdev    uint32
 	Umask   uint32
 	Padding uint32
 }
 
+// CallerUmask returns the umask of the process that creates the
+// node.
+func (in *MknodIn) CallerUmask() uint32 {
+	return in.Umask
+}
+
 type ReadIn struct {
 	InHeader
 	Fh        uint64
@@ -114,6 +159,26 @@ type SetXAttrIn struct {
 	InHeader
 	Size  uint32
 	Flags uint32
+
+	// SetXAttrFlags holds SETXATTR_* flags. Kernels only send it
+	// if CAP_SETXATTR_EXT was negotiated; otherwise it is zero.
+	SetXAttrFlags uint32
+	Padding       uint32
+}
+
+// setXAttrInCompatSize is the size of SetXAttrIn without
+// CAP_SETXATTR_EXT.
+const setXAttrInCompatSize = unsafe.Offsetof(SetXAttrIn{}.SetXAttrFlags)
+
+const (
+	// SetXAttrIn.SetXAttrFlags
+	SETXATTR_ACL_KILL_SGID = (1 << 0)
+)
+
+// KillSgid returns whether the setgid bit of the file should be
+// cleared after setting its POSIX ACL.
+func (in *SetXAttrIn) KillSgid() bool {
+	return in.SetXAttrFlags&SETXATTR_ACL_KILL_SGID != 0
 }
 
 type GetXAttrIn struct {
@@ -0,0 +1,695 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// FUSE-over-io_uring (Linux 6.14 and later). After INIT, the server
+// registers a number of ring entries for each CPU queue of the
+// kernel. Once every queue has an entry, the kernel delivers requests
+// by completing the entry's command, and the server commits the reply
+// and fetches the next request in a single submission. FORGET and
+// INTERRUPT keep going through /dev/fuse, so the classic read loop
+// stays active.
+
+const (
+	_SYS_IO_URING_SETUP = 425
+	_SYS_IO_URING_ENTER = 426
+
+	_IORING_SETUP_SQE128    = 1 << 10
+	_IORING_ENTER_GETEVENTS = 1 << 0
+	_IORING_OFF_SQ_RING     = 0
+	_IORING_OFF_CQ_RING     = 0x8000000
+	_IORING_OFF_SQES        = 0x10000000
+	_IORING_OP_READ         = 22
+	_IORING_OP_URING_CMD    = 46
+
+	_FUSE_IO_URING_CMD_REGISTER         = 1
+	_FUSE_IO_URING_CMD_COMMIT_AND_FETCH = 2
+
+	// Size of fuse_uring_req_header.in_out and op_in.
+	_FUSE_URING_IN_OUT_HEADER_SZ = 128
+	_FUSE_URING_OP_IN_OUT_SZ     = 128
+
+	// Default number of ring entries per CPU queue.
+	defaultIoUringQueueDepth = 8
+)
+
+type ioSqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type ioCqringOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	Cqes        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type ioUringParams struct {
+	SqEntries    uint32
+	CqEntries    uint32
+	Flags        uint32
+	SqThreadCPU  uint32
+	SqThreadIdle uint32
+	Features     uint32
+	WqFd         uint32
+	Resv         [3]uint32
+	SqOff        ioSqringOffsets
+	CqOff        ioCqringOffsets
+}
+
+// ioUringSqe128 is a submission queue entry for a ring set up with
+// IORING_SETUP_SQE128, laid out for IORING_OP_URING_CMD.
+type ioUringSqe128 struct {
+	Opcode        uint8
+	Flags         uint8
+	Ioprio        uint16
+	Fd            int32
+	CmdOp         uint32
+	Pad1          uint32
+	Addr          uint64
+	Len           uint32
+	UringCmdFlags uint32
+	UserData      uint64
+	BufIndex      uint16
+	Personality   uint16
+	FileIndex     int32
+	Cmd           [80]byte
+}
+
+type ioUringCqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// fuseUringCmdReq is the command payload of the submission.
+type fuseUringCmdReq struct {
+	Flags    uint64
+	CommitID uint64
+	Qid      uint16
+	Padding  [6]uint8
+}
+
+type fuseUringEntInOut struct {
+	Flags     uint64
+	CommitID  uint64
+	PayloadSz uint32
+	Padding   uint32
+	Reserved  uint64
+}
+
+type fuseUringReqHeader struct {
+	InOut    [_FUSE_URING_IN_OUT_HEADER_SZ]byte
+	OpIn     [_FUSE_URING_OP_IN_OUT_SZ]byte
+	EntInOut fuseUringEntInOut
+}
+
+// ioUring is a minimal io_uring instance that submits uring
+// commands. It is not safe for concurrent use: all submissions and
+// completions go through the goroutine running uringQueue.loop.
+type ioUring struct {
+	fd int
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray unsafe.Pointer
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   unsafe.Pointer
+
+	// Number of prepared, but not yet submitted SQEs.
+	pending uint32
+}
+
+func newIoUring(entries uint32) (*ioUring, error) {
+	var p ioUringParams
+	p.Flags = _IORING_SETUP_SQE128
+	fd, _, errno := syscall.Syscall(_SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %v", errno)
+	}
+	r := &ioUring{fd: int(fd)}
+
+	sqSize := int(p.SqOff.Array + p.SqEntries*4)
+	cqSize := int(p.CqOff.Cqes + p.CqEntries*uint32(unsafe.Sizeof(ioUringCqe{})))
+	var err error
+	if r.sqRing, err = syscall.Mmap(r.fd, _IORING_OFF_SQ_RING, sqSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("mmap SQ ring: %v", err)
+	}
+	if r.cqRing, err = syscall.Mmap(r.fd, _IORING_OFF_CQ_RING, cqSize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("mmap CQ ring: %v", err)
+	}
+	if r.sqes, err = syscall.Mmap(r.fd, _IORING_OFF_SQES, int(p.SqEntries)*int(unsafe.Sizeof(ioUringSqe128{})),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, fmt.Errorf("mmap SQEs: %v", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.SqOff.Head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.SqOff.Tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.SqOff.RingMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.SqOff.Array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.CqOff.Head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.CqOff.Tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.CqOff.RingMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[p.CqOff.Cqes])
+	return r, nil
+}
+
+func (r *ioUring) close() {
+	for _, m := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// prepare queues a single SQE, to be handed to the kernel by the
+// next call to wait. There are never more operations in flight than
+// ring entries, so the queue cannot overflow.
+func (r *ioUring) prepare(fill func(sqe *ioUringSqe128)) error {
+	tail := atomic.LoadUint32(r.sqTail)
+	if tail-atomic.LoadUint32(r.sqHead) > r.sqMask {
+		return syscall.EBUSY
+	}
+	idx := tail & r.sqMask
+	sqe := (*ioUringSqe128)(unsafe.Pointer(&r.sqes[uintptr(idx)*unsafe.Sizeof(ioUringSqe128{})]))
+	*sqe = ioUringSqe128{}
+	fill(sqe)
+	*(*uint32)(unsafe.Pointer(uintptr(r.sqArray) + uintptr(idx)*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+	return nil
+}
+
+// wait submits the prepared SQEs, blocks until at least one
+// completion is available, and returns all available completions.
+func (r *ioUring) wait(cqes []ioUringCqe) ([]ioUringCqe, error) {
+	err := handleEINTR(func() error {
+		n, _, errno := syscall.Syscall6(_SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.pending), 1, _IORING_ENTER_GETEVENTS, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		r.pending -= uint32(n)
+		return nil
+	})
+	if err != nil {
+		return cqes, err
+	}
+
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		idx := head & r.cqMask
+		cqes = append(cqes, *(*ioUringCqe)(unsafe.Pointer(uintptr(r.cqes) + uintptr(idx)*unsafe.Sizeof(ioUringCqe{}))))
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return cqes, nil
+}
+
+// uringQueue serves the requests of one kernel CPU queue.
+//
+// The kernel hands a request to an entry by running task work in the
+// thread that submitted the entry. If that were an arbitrary Go
+// thread, it could be blocked on this very file system, and the
+// request would never arrive. Therefore, all submissions are done by
+// the loop goroutine, which is locked to its thread; handlers pass
+// finished entries to it through an eventfd.
+type uringQueue struct {
+	ms   *Server
+	qid  uint16
+	ring *ioUring
+	ents []*uringEntry
+
+	wakeFd  int
+	wakeBuf [8]byte
+
+	// If set, requests are handled by workers that run on these
+	// CPUs, which share the NUMA node of the queue.
+	cpus []int
+	work chan *uringEntry
+
+	mu      sync.Mutex
+	commits []*uringEntry
+}
+
+// uringEntry is a ring entry. Its memory starts with a page holding
+// the header that the kernel fills in, followed by the payload. The
+// request is reassembled in front of the payload so that the payload
+// is not copied.
+type uringEntry struct {
+	q   *uringQueue
+	idx int
+
+	mem     []byte
+	header  *fuseUringReqHeader
+	payload []byte
+	iov     [2]syscall.Iovec
+
+	commitID  uint64
+	committed bool
+}
+
+// uringWakeup is the user data of the eventfd read.
+const uringWakeup = ^uint64(0)
+
+// startIoUring switches request delivery to io_uring if it was
+// negotiated in INIT. Errors are logged, and leave the server on
+// /dev/fuse.
+func (ms *Server) startIoUring() {
+	if ms.kernelSettings.Flags64()&CAP_OVER_IO_URING == 0 {
+		return
+	}
+
+	depth := ms.opts.IoUringQueueDepth
+	if depth <= 0 {
+		depth = defaultIoUringQueueDepth
+	}
+	pageSize := syscall.Getpagesize()
+	payloadSize := ms.uringPayloadSize()
+
+	var topo *numaTopology
+	if ms.opts.EnableNUMA {
+		var err error
+		if topo, err = readNUMATopology(); err != nil {
+			ms.errorf("FUSE NUMA topology: %v", err)
+		}
+	}
+
+	var queues []*uringQueue
+	for qid := 0; qid < possibleCPUs(); qid++ {
+		node := -1
+		var cpus []int
+		if topo != nil {
+			node = topo.node(qid)
+		}
+		if node >= 0 {
+			cpus = topo.nodeCPUs[node]
+		}
+		q, err := ms.newUringQueue(uint16(qid), depth, pageSize, payloadSize, node, cpus)
+		if err != nil {
+			ms.infof("FUSE io_uring setup failed, using /dev/fuse: %v", err)
+			for _, q := range queues {
+				q.close()
+			}
+			return
+		}
+		queues = append(queues, q)
+	}
+
+	ms.reqMu.Lock()
+	ms.uring = len(queues) > 0
+	ms.reqMu.Unlock()
+	for _, q := range queues {
+		ms.loops.Add(1)
+		go q.loop()
+	}
+}
+
+// uringPayloadSize returns the payload buffer size, which the kernel
+// requires to hold the largest request of the connection.
+func (ms *Server) uringPayloadSize() int {
+	pageSize := syscall.Getpagesize()
+	sz := ms.opts.MaxWrite
+	if maxPages := (ms.opts.MaxWrite-1)/pageSize + 1; maxPages*pageSize > sz {
+		sz = maxPages * pageSize
+	}
+	if min := _FUSE_DEFAULT_MAX_PAGES_PER_REQ * pageSize; sz < min {
+		sz = min
+	}
+	return sz
+}
+
+// newUringQueue sets up the ring and entries of a queue. If node is
+// not negative, the entry buffers are allocated on that NUMA node,
+// and the requests are handled on cpus, the CPUs of the node. If
+// the buffers cannot be placed, the requests are handled anywhere.
+func (ms *Server) newUringQueue(qid uint16, depth, pageSize, payloadSize, node int, cpus []int) (*uringQueue, error) {
+	ring, err := newIoUring(uint32(depth + 1))
+	if err != nil {
+		return nil, err
+	}
+	q := &uringQueue{ms: ms, qid: qid, ring: ring}
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		ring.close()
+		return nil, fmt.Errorf("eventfd: %v", errno)
+	}
+	q.wakeFd = int(fd)
+	for i := 0; i < depth; i++ {
+		mem, err := syscall.Mmap(-1, 0, pageSize+payloadSize,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+		if err != nil {
+			q.close()
+			return nil, fmt.Errorf("mmap: %v", err)
+		}
+		if node >= 0 {
+			if err := bindToNode(mem, node); err != nil {
+				ms.errorf("FUSE io_uring q%d: mbind node %d: %v", qid, node, err)
+				node = -1
+			}
+		}
+		e := &uringEntry{
+			q:       q,
+			idx:     i,
+			mem:     mem,
+			header:  (*fuseUringReqHeader)(unsafe.Pointer(&mem[0])),
+			payload: mem[pageSize:],
+		}
+		e.iov[0].Base = &mem[0]
+		e.iov[0].SetLen(int(unsafe.Sizeof(fuseUringReqHeader{})))
+		e.iov[1].Base = &e.payload[0]
+		e.iov[1].SetLen(len(e.payload))
+		q.ents = append(q.ents, e)
+	}
+	if node >= 0 {
+		q.cpus = cpus
+	}
+	return q, nil
+}
+
+func (q *uringQueue) close() {
+	q.ring.close()
+	syscall.Close(q.wakeFd)
+	for _, e := range q.ents {
+		syscall.Munmap(e.mem)
+	}
+	q.ents = nil
+}
+
+func (q *uringQueue) loop() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer q.ms.loops.Done()
+	var handlers sync.WaitGroup
+	if q.cpus != nil {
+		q.work = make(chan *uringEntry, len(q.ents))
+		for range q.ents {
+			go q.worker(&handlers)
+		}
+	}
+	defer func() {
+		handlers.Wait()
+		if q.work != nil {
+			close(q.work)
+		}
+		q.close()
+	}()
+
+	for _, e := range q.ents {
+		if err := e.prepare(_FUSE_IO_URING_CMD_REGISTER); err != nil {
+			q.ms.errorf("FUSE io_uring register q%d: %v", q.qid, err)
+			return
+		}
+	}
+	if err := q.prepareWakeup(); err != nil {
+		q.ms.errorf("FUSE io_uring q%d: %v", q.qid, err)
+		return
+	}
+
+	live := len(q.ents)
+	var cqes []ioUringCqe
+	for live > 0 {
+		var err error
+		cqes, err = q.ring.wait(cqes[:0])
+		if err != nil {
+			q.ms.errorf("FUSE io_uring q%d: %v", q.qid, err)
+			return
+		}
+		for _, cqe := range cqes {
+			if cqe.UserData == uringWakeup {
+				if cqe.Res < 0 {
+					q.ms.errorf("FUSE io_uring q%d wakeup: %v", q.qid, syscall.Errno(-cqe.Res))
+					return
+				}
+				q.flushCommits()
+				if err := q.prepareWakeup(); err != nil {
+					q.ms.errorf("FUSE io_uring q%d: %v", q.qid, err)
+					return
+				}
+				continue
+			}
+			e := q.ents[cqe.UserData]
+			if cqe.Res < 0 {
+				errno := syscall.Errno(-cqe.Res)
+				if errno != syscall.ENOTCONN && errno != syscall.ENODEV && errno != syscall.ECANCELED {
+					q.ms.errorf("FUSE io_uring q%d entry %d: %v", q.qid, e.idx, errno)
+				}
+				live--
+				continue
+			}
+			handlers.Add(1)
+			if q.work != nil {
+				q.work <- e
+				continue
+			}
+			go func() {
+				defer handlers.Done()
+				e.handle()
+			}()
+		}
+	}
+}
+
+// worker handles requests on a thread that is restricted to the CPUs
+// of the queue's NUMA node. There is a worker for each entry, so
+// handing over an entry never blocks.
+func (q *uringQueue) worker(handlers *sync.WaitGroup) {
+	// The thread is not unlocked, so it exits along with the
+	// goroutine rather than being reused with a changed affinity.
+	runtime.LockOSThread()
+	if err := setThreadAffinity(q.cpus); err != nil {
+		q.ms.errorf("FUSE io_uring q%d: sched_setaffinity: %v", q.qid, err)
+	}
+	for e := range q.work {
+		e.handle()
+		handlers.Done()
+	}
+}
+
+func (q *uringQueue) prepareWakeup() error {
+	return q.ring.prepare(func(sqe *ioUringSqe128) {
+		sqe.Opcode = _IORING_OP_READ
+		sqe.Fd = int32(q.wakeFd)
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(&q.wakeBuf[0])))
+		sqe.Len = uint32(len(q.wakeBuf))
+		sqe.UserData = uringWakeup
+	})
+}
+
+// commit hands a finished entry to the loop goroutine.
+func (q *uringQueue) commit(e *uringEntry) {
+	q.mu.Lock()
+	q.commits = append(q.commits, e)
+	q.mu.Unlock()
+
+	one := [8]byte{1}
+	if _, err := syscall.Write(q.wakeFd, one[:]); err != nil {
+		q.ms.errorf("FUSE io_uring wakeup q%d: %v", q.qid, err)
+	}
+}
+
+func (q *uringQueue) flushCommits() {
+	q.mu.Lock()
+	commits := q.commits
+	q.commits = nil
+	q.mu.Unlock()
+
+	for _, e := range commits {
+		if err := e.prepare(_FUSE_IO_URING_CMD_COMMIT_AND_FETCH); err != nil {
+			q.ms.errorf("FUSE io_uring commit: %v", err)
+		}
+	}
+}
+
+func (e *uringEntry) prepare(cmdOp uint32) error {
+	return e.q.ring.prepare(func(sqe *ioUringSqe128) {
+		sqe.Opcode = _IORING_OP_URING_CMD
+		sqe.Fd = int32(e.q.ms.mountFd)
+		sqe.CmdOp = cmdOp
+		sqe.Addr = uint64(uintptr(unsafe.Pointer(&e.iov[0])))
+		sqe.Len = uint32(len(e.iov))
+		sqe.UserData = uint64(e.idx)
+		cmd := (*fuseUringCmdReq)(unsafe.Pointer(&sqe.Cmd[0]))
+		cmd.CommitID = e.commitID
+		cmd.Qid = e.q.qid
+	})
+}
+
+// handle serves the request the kernel put into the entry, and
+// commits the reply.
+func (e *uringEntry) handle() {
+	ms := e.q.ms
+	e.commitID = e.header.EntInOut.CommitID
+	payloadSz := int(e.header.EntInOut.PayloadSz)
+	inHeader := (*InHeader)(unsafe.Pointer(&e.header.InOut[0]))
+	hdrSz := int(unsafe.Sizeof(InHeader{}))
+	opSz := int(inHeader.Length) - hdrSz - payloadSz
+	if opSz < 0 || opSz > _FUSE_URING_OP_IN_OUT_SZ || payloadSz > len(e.payload) {
+		e.q.ms.errorf("FUSE io_uring: malformed request %v, payload %d", inHeader, payloadSz)
+		e.commitError(inHeader.Unique, EIO)
+		return
+	}
+
+	// Reassemble header, op header and payload into one buffer.
+	pageSize := len(e.mem) - len(e.payload)
+	start := pageSize - hdrSz - opSz
+	copy(e.mem[start:], e.header.InOut[:hdrSz])
+	copy(e.mem[start+hdrSz:], e.header.OpIn[:opSz])
+
+	req := ms.reqPool.Get().(*request)
+	if ms.timed() {
+		req.startTime = time.Now()
+	}
+	req.inputBuf = e.mem[start : pageSize+payloadSz]
+	req.ring = e
+
+	ms.reqMu.Lock()
+	if status := req.parseHeader(); !status.Ok() {
+		ms.reqMu.Unlock()
+		e.commitError(inHeader.Unique, status)
+		return
+	}
+	if ms.recentUnique != nil {
+		ms.recentUnique = append(ms.recentUnique, req.inHeader.Unique)
+	}
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	// The entry is committed only after handleRequest returns:
+	// once committed, the kernel may fill it with a new request.
+	unique := req.inHeader.Unique
+	e.committed = false
+	ms.handleRequest(req)
+	if !e.committed {
+		// Requests without reply, such as NOTIFY_REPLY, must
+		// still return the entry to the kernel.
+		e.commitError(unique, OK)
+		return
+	}
+	e.q.commit(e)
+}
+
+// write copies the reply into the entry. The entry is committed by
+// handle.
+func (e *uringEntry) write(req *request, header []byte) Status {
+	data := req.flatData
+	if req.fdData != nil {
+		var st int
+		data, st = req.fdData.Bytes(e.payload[len(header)-int(sizeOfOutHeader):])
+		req.status = Status(st)
+		header = req.serializeHeader(len(data))
+	}
+
+	n := copy(e.payload, header[sizeOfOutHeader:])
+	if req.slices != nil {
+		for _, s := range req.slices {
+			n += copy(e.payload[n:], s)
+		}
+	} else if len(data) > 0 && &data[0] != &e.payload[n] {
+		n += copy(e.payload[n:], data)
+	} else {
+		n += len(data)
+	}
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
+
+	copy(e.header.InOut[:], header[:sizeOfOutHeader])
+	e.header.EntInOut.PayloadSz = uint32(n)
+	e.committed = true
+	return OK
+}
+
+// commitError answers a request that could not be parsed.
+func (e *uringEntry) commitError(unique uint64, status Status) {
+	o := (*OutHeader)(unsafe.Pointer(&e.header.InOut[0]))
+	*o = OutHeader{
+		Length: uint32(sizeOfOutHeader),
+		Status: -int32(status),
+		Unique: unique,
+	}
+	e.header.EntInOut.PayloadSz = 0
+	e.q.commit(e)
+}
+
+// possibleCPUs returns the number of queues the kernel expects,
+// which is the number of possible CPUs.
+func possibleCPUs() int {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	cpus, err := parseCPUList(string(data))
+	if err != nil || len(cpus) == 0 {
+		return runtime.NumCPU()
+	}
+	return cpus[len(cpus)-1] + 1
+}
+
+// parseCPUList parses a sysfs CPU list such as "0-3,8-11".
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		for c := lo; c <= hi; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
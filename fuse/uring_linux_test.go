@@ -0,0 +1,94 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestIoUringStructSizes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"io_uring_params", unsafe.Sizeof(ioUringParams{}), 120},
+		{"io_uring_sqe (SQE128)", unsafe.Sizeof(ioUringSqe128{}), 128},
+		{"io_uring_cqe", unsafe.Sizeof(ioUringCqe{}), 16},
+		{"fuse_uring_cmd_req", unsafe.Sizeof(fuseUringCmdReq{}), 24},
+		{"fuse_uring_req_header", unsafe.Sizeof(fuseUringReqHeader{}), 288},
+		{"sqe.cmd offset", unsafe.Offsetof(ioUringSqe128{}.Cmd), 48},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestUringPayloadSize(t *testing.T) {
+	ms := &Server{opts: &MountOptions{MaxWrite: 1 << 20}}
+	if got := ms.uringPayloadSize(); got < 1<<20 {
+		t.Errorf("payload size %d smaller than MaxWrite", got)
+	}
+	ms.opts.MaxWrite = 4096
+	if got, min := ms.uringPayloadSize(), 32*4096; got < min {
+		t.Errorf("payload size %d, want at least %d", got, min)
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for in, want := range map[string][]int{
+		"0\n":       {0},
+		"0-3":       {0, 1, 2, 3},
+		"0-1,8-9\n": {0, 1, 8, 9},
+		"2,5":       {2, 5},
+		"":          nil,
+	} {
+		got, err := parseCPUList(in)
+		if err != nil {
+			t.Errorf("parseCPUList(%q): %v", in, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCPUList(%q): got %v, want %v", in, got, want)
+		}
+	}
+	if _, err := parseCPUList("0-x"); err == nil {
+		t.Error("parseCPUList(\"0-x\"): want error")
+	}
+}
+
+func TestPinThread(t *testing.T) {
+	if _, err := newServer(NewDefaultRawFileSystem(), &MountOptions{PinReaders: true, ReaderCPUs: []int{-1}}); err == nil {
+		t.Error("negative CPU was accepted")
+	}
+
+	cpus, err := processCPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cpus) == 0 {
+		t.Fatal("process has no CPUs")
+	}
+	want := cpus[len(cpus)-1]
+
+	done := make(chan []int)
+	go func() {
+		// Exit with the thread, see pinnedLoop.
+		runtime.LockOSThread()
+		if err := pinThread(want); err != nil {
+			t.Error(err)
+		}
+		got, err := processCPUs()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+	if got := <-done; !reflect.DeepEqual(got, []int{want}) {
+		t.Errorf("got CPUs %v, want [%d]", got, want)
+	}
+}
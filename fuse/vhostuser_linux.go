@@ -0,0 +1,886 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/internal"
+)
+
+// vhost-user-fs transport. Instead of reading requests from
+// /dev/fuse, the server acts as the vhost-user back-end of a virtio-fs
+// device, like virtiofsd: a VMM such as QEMU connects to a unix
+// socket, shares the guest memory and hands over the virtqueues, on
+// which the guest kernel puts its FUSE requests. The first queue is
+// the high priority queue for FORGET and INTERRUPT, the others are
+// request queues, but all queues are served alike.
+//
+// Only split virtqueues without indirect descriptors are supported.
+// virtio-fs has no queue for notifications, so the notify methods of
+// the Server return ENOSYS.
+
+const (
+	_VHOST_USER_GET_FEATURES          = 1
+	_VHOST_USER_SET_FEATURES          = 2
+	_VHOST_USER_SET_OWNER             = 3
+	_VHOST_USER_RESET_OWNER           = 4
+	_VHOST_USER_SET_MEM_TABLE         = 5
+	_VHOST_USER_SET_VRING_NUM         = 8
+	_VHOST_USER_SET_VRING_ADDR        = 9
+	_VHOST_USER_SET_VRING_BASE        = 10
+	_VHOST_USER_GET_VRING_BASE        = 11
+	_VHOST_USER_SET_VRING_KICK        = 12
+	_VHOST_USER_SET_VRING_CALL        = 13
+	_VHOST_USER_SET_VRING_ERR         = 14
+	_VHOST_USER_GET_PROTOCOL_FEATURES = 15
+	_VHOST_USER_SET_PROTOCOL_FEATURES = 16
+	_VHOST_USER_GET_QUEUE_NUM         = 17
+	_VHOST_USER_SET_VRING_ENABLE      = 18
+
+	_VHOST_USER_VERSION    = 0x1
+	_VHOST_USER_REPLY_MASK = 0x4
+	_VHOST_USER_NEED_REPLY = 0x8
+
+	// In the u64 payload of SET_VRING_KICK and SET_VRING_CALL.
+	_VHOST_USER_VRING_IDX_MASK = 0xff
+	_VHOST_USER_VRING_NOFD     = 0x100
+
+	_VIRTIO_F_VERSION_1             = uint64(1) << 32
+	_VHOST_USER_F_PROTOCOL_FEATURES = uint64(1) << 30
+
+	_VHOST_USER_PROTOCOL_F_MQ        = uint64(1) << 0
+	_VHOST_USER_PROTOCOL_F_REPLY_ACK = uint64(1) << 3
+
+	_VRING_DESC_F_NEXT          = 1
+	_VRING_DESC_F_WRITE         = 2
+	_VRING_AVAIL_F_NO_INTERRUPT = 1
+
+	// The high priority queue, and up to 15 request queues.
+	vhostUserMaxQueues  = 16
+	vhostUserMaxRegions = 8
+	vhostUserMaxFds     = 8
+)
+
+type vhostUserHeader struct {
+	Request uint32
+	Flags   uint32
+	Size    uint32
+}
+
+type vhostUserMemRegion struct {
+	GuestPhysAddr uint64
+	MemorySize    uint64
+	UserspaceAddr uint64
+	MmapOffset    uint64
+}
+
+type vhostUserMemory struct {
+	NRegions uint32
+	Padding  uint32
+	Regions  [vhostUserMaxRegions]vhostUserMemRegion
+}
+
+type vhostVringState struct {
+	Index uint32
+	Num   uint32
+}
+
+type vhostVringAddr struct {
+	Index uint32
+	Flags uint32
+	Desc  uint64
+	Used  uint64
+	Avail uint64
+	Log   uint64
+}
+
+type vringDesc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+type vringUsedElem struct {
+	ID  uint32
+	Len uint32
+}
+
+// guestRegion is a region of guest memory, mapped into the server.
+type guestRegion struct {
+	gpa  uint64
+	uva  uint64
+	mmap []byte
+	data []byte
+}
+
+type guestMemory []guestRegion
+
+// slice returns the memory at guest physical address gpa.
+func (m guestMemory) slice(gpa uint64, n uint32) ([]byte, error) {
+	for _, r := range m {
+		if gpa >= r.gpa && gpa-r.gpa < uint64(len(r.data)) {
+			off := gpa - r.gpa
+			if off+uint64(n) > uint64(len(r.data)) {
+				break
+			}
+			return r.data[off : off+uint64(n) : off+uint64(n)], nil
+		}
+	}
+	return nil, fmt.Errorf("guest address %x+%d not mapped", gpa, n)
+}
+
+// frontendSlice returns the memory at address uva of the front-end
+// process, which is how vring addresses are given.
+func (m guestMemory) frontendSlice(uva uint64, n int) ([]byte, error) {
+	for _, r := range m {
+		if uva >= r.uva && uva-r.uva < uint64(len(r.data)) {
+			off := uva - r.uva
+			if off+uint64(n) > uint64(len(r.data)) {
+				break
+			}
+			return r.data[off : off+uint64(n)], nil
+		}
+	}
+	return nil, fmt.Errorf("front-end address %x+%d not mapped", uva, n)
+}
+
+// vhostUserSession is the connection to the vhost-user front-end.
+type vhostUserSession struct {
+	ms       *Server
+	listener *net.UnixListener
+
+	// mu protects the fields below, which the message loop
+	// changes.
+	mu   sync.Mutex
+	conn *net.UnixConn
+
+	features         uint64
+	protocolFeatures uint64
+
+	mem guestMemory
+	// Mappings replaced by a later SET_MEM_TABLE. These may still
+	// be referenced by requests in flight, so they are only
+	// unmapped when the session ends.
+	oldMem []guestMemory
+
+	queues [vhostUserMaxQueues]*virtqueue
+	closed bool
+}
+
+// NewVirtioFSServer creates a server that serves fs to a virtual
+// machine, as the vhost-user back-end of a virtio-fs device, instead
+// of mounting it. It listens on a unix socket at socketPath, to which
+// the VMM connects, eg. with QEMU's "-chardev socket,path=..." and
+// "-device vhost-user-fs-pci". Serve handles the connection of a
+// single front-end, and returns when it disconnects. Unmount closes
+// the connection.
+//
+// WaitMount returns once the guest has sent INIT. The server does not
+// reset its state if the guest mounts the file system again.
+func NewVirtioFSServer(fs RawFileSystem, socketPath string, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	// These act on /dev/fuse, which the guest kernel owns.
+	ms.opts.EnablePassthrough = false
+	ms.opts.EnableIoUring = false
+
+	addr, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	ms.vhost = &vhostUserSession{ms: ms, listener: l}
+	ms.mountFd = -1
+	ms.fileSystem.Init(ms)
+	ms.loops.Add(1)
+	return ms, nil
+}
+
+// accept waits for a front-end whose user ID is allowed, see
+// MountOptions.AllowedPeerUids.
+func (s *vhostUserSession) accept() (*net.UnixConn, error) {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		if err := internal.CheckPeer(conn, s.ms.opts.AllowedPeerUids); err != nil {
+			s.ms.errorf("vhost-user: reject front-end: %v", err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// serve accepts the front-end, and handles its messages until it
+// disconnects.
+func (s *vhostUserSession) serve() {
+	defer s.ms.loops.Done()
+	conn, err := s.accept()
+	s.listener.Close()
+	if err != nil {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if !closed {
+			s.ms.errorf("vhost-user accept: %v", err)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	defer s.shutdown()
+	for {
+		hdr, payload, fds, err := s.readMsg()
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				s.ms.errorf("vhost-user: %v", err)
+			}
+			return
+		}
+		reply, err := s.handleMsg(hdr, payload, fds)
+		if err != nil {
+			s.ms.errorf("vhost-user request %d: %v", hdr.Request, err)
+		}
+		if reply == nil && hdr.Flags&_VHOST_USER_NEED_REPLY != 0 &&
+			s.protocolFeatures&_VHOST_USER_PROTOCOL_F_REPLY_ACK != 0 {
+			var status uint64
+			if err != nil {
+				status = 1
+			}
+			reply = u64Bytes(status)
+		}
+		if reply != nil {
+			if err := s.writeReply(hdr.Request, reply); err != nil {
+				s.ms.errorf("vhost-user reply: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func (s *vhostUserSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// close ends the session, for Server.Unmount.
+func (s *vhostUserSession) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return s.listener.Close()
+}
+
+// shutdown stops the queues and releases the guest memory.
+func (s *vhostUserSession) shutdown() {
+	for _, q := range s.queues {
+		if q != nil {
+			q.stop()
+			q.closeFds()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.conn.Close()
+	for _, m := range append(s.oldMem, s.mem) {
+		m.unmap()
+	}
+	s.mem = nil
+	s.oldMem = nil
+}
+
+func (m guestMemory) unmap() {
+	for _, r := range m {
+		syscall.Munmap(r.mmap)
+	}
+}
+
+func (s *vhostUserSession) readMsg() (hdr vhostUserHeader, payload []byte, fds []int, err error) {
+	var hdrBuf [unsafe.Sizeof(vhostUserHeader{})]byte
+	oob := make([]byte, syscall.CmsgSpace(vhostUserMaxFds*4))
+	n, oobn, _, _, err := s.conn.ReadMsgUnix(hdrBuf[:], oob)
+	if err != nil {
+		return hdr, nil, nil, err
+	}
+	if n == 0 {
+		return hdr, nil, nil, io.EOF
+	}
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return hdr, nil, nil, err
+		}
+		for _, m := range msgs {
+			rights, err := syscall.ParseUnixRights(&m)
+			if err != nil {
+				closeFds(fds)
+				return hdr, nil, nil, err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	if n < len(hdrBuf) {
+		if _, err := io.ReadFull(s.conn, hdrBuf[n:]); err != nil {
+			closeFds(fds)
+			return hdr, nil, nil, err
+		}
+	}
+	hdr = *(*vhostUserHeader)(unsafe.Pointer(&hdrBuf[0]))
+	if hdr.Size > 4096 {
+		closeFds(fds)
+		return hdr, nil, nil, fmt.Errorf("message %d too large: %d bytes", hdr.Request, hdr.Size)
+	}
+	payload = make([]byte, hdr.Size)
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		closeFds(fds)
+		return hdr, nil, nil, err
+	}
+	return hdr, payload, fds, nil
+}
+
+func (s *vhostUserSession) writeReply(request uint32, payload []byte) error {
+	hdr := vhostUserHeader{
+		Request: request,
+		Flags:   _VHOST_USER_VERSION | _VHOST_USER_REPLY_MASK,
+		Size:    uint32(len(payload)),
+	}
+	msg := make([]byte, int(unsafe.Sizeof(hdr))+len(payload))
+	*(*vhostUserHeader)(unsafe.Pointer(&msg[0])) = hdr
+	copy(msg[unsafe.Sizeof(hdr):], payload)
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+func u64Bytes(v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+// handleMsg processes a front-end message. It returns the reply
+// payload for messages that have one. File descriptors that are not
+// kept are closed.
+func (s *vhostUserSession) handleMsg(hdr vhostUserHeader, payload []byte, fds []int) (reply []byte, err error) {
+	keep := 0
+	defer func() {
+		closeFds(fds[keep:])
+	}()
+
+	var u64 uint64
+	if len(payload) >= 8 {
+		u64 = binary.LittleEndian.Uint64(payload)
+	}
+	var state vhostVringState
+	if len(payload) >= int(unsafe.Sizeof(state)) {
+		state = *(*vhostVringState)(unsafe.Pointer(&payload[0]))
+	}
+
+	switch hdr.Request {
+	case _VHOST_USER_GET_FEATURES:
+		return u64Bytes(_VIRTIO_F_VERSION_1 | _VHOST_USER_F_PROTOCOL_FEATURES), nil
+	case _VHOST_USER_SET_FEATURES:
+		s.features = u64
+	case _VHOST_USER_GET_PROTOCOL_FEATURES:
+		return u64Bytes(_VHOST_USER_PROTOCOL_F_MQ | _VHOST_USER_PROTOCOL_F_REPLY_ACK), nil
+	case _VHOST_USER_SET_PROTOCOL_FEATURES:
+		s.protocolFeatures = u64
+	case _VHOST_USER_GET_QUEUE_NUM:
+		return u64Bytes(vhostUserMaxQueues), nil
+	case _VHOST_USER_SET_OWNER:
+	case _VHOST_USER_RESET_OWNER:
+		for _, q := range s.queues {
+			if q != nil {
+				q.stop()
+			}
+		}
+	case _VHOST_USER_SET_MEM_TABLE:
+		return nil, s.setMemTable(payload, fds)
+	case _VHOST_USER_SET_VRING_NUM:
+		q, err := s.queue(state.Index)
+		if err != nil {
+			return nil, err
+		}
+		if state.Num == 0 || state.Num > 1<<15 || state.Num&(state.Num-1) != 0 {
+			return nil, fmt.Errorf("bad ring size %d", state.Num)
+		}
+		q.num = uint16(state.Num)
+	case _VHOST_USER_SET_VRING_ADDR:
+		if len(payload) < int(unsafe.Sizeof(vhostVringAddr{})) {
+			return nil, fmt.Errorf("short SET_VRING_ADDR")
+		}
+		addr := *(*vhostVringAddr)(unsafe.Pointer(&payload[0]))
+		q, err := s.queue(addr.Index)
+		if err != nil {
+			return nil, err
+		}
+		return nil, q.setAddr(s.mem, &addr)
+	case _VHOST_USER_SET_VRING_BASE:
+		q, err := s.queue(state.Index)
+		if err != nil {
+			return nil, err
+		}
+		q.lastAvail = uint16(state.Num)
+		q.usedIdx = uint16(state.Num)
+	case _VHOST_USER_GET_VRING_BASE:
+		q, err := s.queue(state.Index)
+		if err != nil {
+			return nil, err
+		}
+		q.stop()
+		q.closeFds()
+		state.Num = uint32(q.lastAvail)
+		return (*[unsafe.Sizeof(state)]byte)(unsafe.Pointer(&state))[:], nil
+	case _VHOST_USER_SET_VRING_KICK, _VHOST_USER_SET_VRING_CALL, _VHOST_USER_SET_VRING_ERR:
+		q, err := s.queue(uint32(u64 & _VHOST_USER_VRING_IDX_MASK))
+		if err != nil {
+			return nil, err
+		}
+		if u64&_VHOST_USER_VRING_NOFD != 0 || len(fds) == 0 {
+			if hdr.Request == _VHOST_USER_SET_VRING_KICK {
+				return nil, fmt.Errorf("polling queue %d is not supported", q.idx)
+			}
+			return nil, nil
+		}
+		keep = 1
+		switch hdr.Request {
+		case _VHOST_USER_SET_VRING_KICK:
+			q.setKick(fds[0])
+			if s.features&_VHOST_USER_F_PROTOCOL_FEATURES == 0 {
+				q.enabled = true
+			}
+			return nil, q.maybeStart()
+		case _VHOST_USER_SET_VRING_CALL:
+			q.setCall(fds[0])
+		default:
+			syscall.Close(fds[0])
+		}
+	case _VHOST_USER_SET_VRING_ENABLE:
+		q, err := s.queue(state.Index)
+		if err != nil {
+			return nil, err
+		}
+		q.enabled = state.Num != 0
+		if !q.enabled {
+			q.stop()
+			return nil, nil
+		}
+		return nil, q.maybeStart()
+	default:
+		return nil, fmt.Errorf("unsupported request")
+	}
+	return nil, nil
+}
+
+// queue returns queue i, creating it if needed.
+func (s *vhostUserSession) queue(i uint32) (*virtqueue, error) {
+	if i >= vhostUserMaxQueues {
+		return nil, fmt.Errorf("queue %d out of range", i)
+	}
+	if s.queues[i] == nil {
+		s.queues[i] = &virtqueue{s: s, idx: int(i), kickFd: -1, callFd: -1}
+	}
+	return s.queues[i], nil
+}
+
+func (s *vhostUserSession) setMemTable(payload []byte, fds []int) error {
+	if len(payload) < 8 {
+		return fmt.Errorf("short SET_MEM_TABLE")
+	}
+	var table vhostUserMemory
+	copy((*[unsafe.Sizeof(table)]byte)(unsafe.Pointer(&table))[:], payload)
+	if table.NRegions > vhostUserMaxRegions || int(table.NRegions) != len(fds) {
+		return fmt.Errorf("got %d regions with %d fds", table.NRegions, len(fds))
+	}
+
+	var mem guestMemory
+	for i, r := range table.Regions[:table.NRegions] {
+		m, err := syscall.Mmap(fds[i], 0, int(r.MmapOffset+r.MemorySize),
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			mem.unmap()
+			return fmt.Errorf("mmap region %d: %v", i, err)
+		}
+		mem = append(mem, guestRegion{
+			gpa:  r.GuestPhysAddr,
+			uva:  r.UserspaceAddr,
+			mmap: m,
+			data: m[r.MmapOffset:],
+		})
+	}
+
+	s.mu.Lock()
+	if s.mem != nil {
+		s.oldMem = append(s.oldMem, s.mem)
+	}
+	s.mem = mem
+	s.mu.Unlock()
+	return nil
+}
+
+// virtqueue is a split virtqueue of the device. Its configuration is
+// only changed by the message loop, while the queue is stopped.
+type virtqueue struct {
+	s   *vhostUserSession
+	idx int
+
+	num   uint16
+	desc  []byte
+	avail []byte
+	used  []byte
+	mem   guestMemory
+
+	kickFd  int
+	callFd  int
+	enabled bool
+
+	// kick is the duplicate of kickFd that the running loop
+	// reads. Closing it stops the loop.
+	kick *os.File
+
+	// lastAvail is the next avail ring entry to take. It is only
+	// accessed by the queue loop while it runs.
+	lastAvail uint16
+
+	// done is closed when the loop exits. Nil if the loop is not
+	// running.
+	done     chan struct{}
+	inflight sync.WaitGroup
+
+	// mu serializes updates of the used ring.
+	mu      sync.Mutex
+	usedIdx uint16
+}
+
+func (q *virtqueue) setAddr(mem guestMemory, addr *vhostVringAddr) error {
+	if q.num == 0 {
+		return fmt.Errorf("queue %d has no size", q.idx)
+	}
+	n := int(q.num)
+	var err error
+	if q.desc, err = mem.frontendSlice(addr.Desc, n*int(unsafe.Sizeof(vringDesc{}))); err != nil {
+		return err
+	}
+	// The flags and index of the avail and used rings are read
+	// and written as one 32-bit word.
+	if addr.Avail%4 != 0 || addr.Used%4 != 0 {
+		return fmt.Errorf("queue %d rings are not aligned", q.idx)
+	}
+	if q.avail, err = mem.frontendSlice(addr.Avail, 6+2*n); err != nil {
+		return err
+	}
+	if q.used, err = mem.frontendSlice(addr.Used, 6+n*int(unsafe.Sizeof(vringUsedElem{}))); err != nil {
+		return err
+	}
+	q.mem = mem
+	return nil
+}
+
+func (q *virtqueue) setKick(fd int) {
+	q.stop()
+	if q.kickFd >= 0 {
+		syscall.Close(q.kickFd)
+	}
+	q.kickFd = fd
+}
+
+func (q *virtqueue) setCall(fd int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.callFd >= 0 {
+		syscall.Close(q.callFd)
+	}
+	q.callFd = fd
+}
+
+func (q *virtqueue) closeFds() {
+	if q.kickFd >= 0 {
+		syscall.Close(q.kickFd)
+		q.kickFd = -1
+	}
+	q.mu.Lock()
+	if q.callFd >= 0 {
+		syscall.Close(q.callFd)
+		q.callFd = -1
+	}
+	q.mu.Unlock()
+}
+
+// maybeStart starts processing the queue once it is set up, kicked
+// and enabled.
+func (q *virtqueue) maybeStart() error {
+	if q.done != nil || q.kickFd < 0 || !q.enabled {
+		return nil
+	}
+	if q.desc == nil {
+		return fmt.Errorf("queue %d has no addresses", q.idx)
+	}
+	fd, err := syscall.Dup(q.kickFd)
+	if err != nil {
+		return err
+	}
+	// A non-blocking descriptor goes through the runtime poller,
+	// so closing the file interrupts a pending read.
+	syscall.CloseOnExec(fd)
+	syscall.SetNonblock(fd, true)
+	q.kick = os.NewFile(uintptr(fd), fmt.Sprintf("vhost-user-kick-%d", q.idx))
+	q.done = make(chan struct{})
+	go q.loop(q.kick, q.done)
+	return nil
+}
+
+// stop stops the queue loop, and waits for the requests in flight.
+func (q *virtqueue) stop() {
+	if q.done == nil {
+		return
+	}
+	q.kick.Close()
+	<-q.done
+	q.done = nil
+	q.kick = nil
+	q.inflight.Wait()
+}
+
+func (q *virtqueue) loop(kick *os.File, done chan struct{}) {
+	defer close(done)
+	var buf [8]byte
+	for {
+		for {
+			e, ok, err := q.pop()
+			if err != nil {
+				q.s.ms.errorf("vhost-user queue %d: %v", q.idx, err)
+				return
+			}
+			if !ok {
+				break
+			}
+			q.inflight.Add(1)
+			go e.handle()
+		}
+		if _, err := kick.Read(buf[:]); err != nil {
+			return
+		}
+	}
+}
+
+// availIdx returns the flags and index of the avail ring.
+func (q *virtqueue) availIdx() (flags, idx uint16) {
+	v := atomicLoadUint32(q.avail)
+	return uint16(v), uint16(v >> 16)
+}
+
+// pop takes the next descriptor chain from the avail ring.
+func (q *virtqueue) pop() (*virtqElem, bool, error) {
+	if _, idx := q.availIdx(); idx == q.lastAvail {
+		return nil, false, nil
+	}
+	slot := int(q.lastAvail % q.num)
+	head := binary.LittleEndian.Uint16(q.avail[4+2*slot:])
+	q.lastAvail++
+
+	e := &virtqElem{q: q, head: head}
+	i := head
+	for n := 0; ; n++ {
+		if i >= q.num || n >= int(q.num) {
+			return nil, false, fmt.Errorf("bad descriptor chain at %d", head)
+		}
+		d := *(*vringDesc)(unsafe.Pointer(&q.desc[int(i)*int(unsafe.Sizeof(vringDesc{}))]))
+		buf, err := q.mem.slice(d.Addr, d.Len)
+		if err != nil {
+			return nil, false, err
+		}
+		if d.Flags&_VRING_DESC_F_WRITE != 0 {
+			e.out = append(e.out, buf)
+		} else if len(e.out) > 0 {
+			return nil, false, fmt.Errorf("readable descriptor after writable one in chain %d", head)
+		} else {
+			e.in = append(e.in, buf)
+		}
+		if d.Flags&_VRING_DESC_F_NEXT == 0 {
+			break
+		}
+		i = d.Next
+	}
+	return e, true, nil
+}
+
+// push returns a chain to the driver, with n bytes written.
+func (q *virtqueue) push(head uint16, n uint32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	slot := int(q.usedIdx % q.num)
+	*(*vringUsedElem)(unsafe.Pointer(&q.used[4+slot*int(unsafe.Sizeof(vringUsedElem{}))])) = vringUsedElem{
+		ID:  uint32(head),
+		Len: n,
+	}
+	q.usedIdx++
+	// Publish the element before the index. The device does not
+	// set any used ring flags.
+	atomicStoreUint32(q.used, uint32(q.usedIdx)<<16)
+
+	if flags, _ := q.availIdx(); flags&_VRING_AVAIL_F_NO_INTERRUPT == 0 && q.callFd >= 0 {
+		if _, err := syscall.Write(q.callFd, u64Bytes(1)); err != nil {
+			q.s.ms.errorf("vhost-user queue %d call: %v", q.idx, err)
+		}
+	}
+}
+
+// virtqElem is a request from a virtqueue. The guest writes the
+// request into the in buffers, and the reply goes into the out
+// buffers.
+type virtqElem struct {
+	q    *virtqueue
+	head uint16
+	in   [][]byte
+	out  [][]byte
+	done bool
+}
+
+func (e *virtqElem) handle() {
+	defer e.q.inflight.Done()
+	ms := e.q.s.ms
+
+	n := 0
+	for _, b := range e.in {
+		n += len(b)
+	}
+	dest := ms.buffers.allocInput()
+	if n > len(dest) {
+		ms.buffers.freeInput(dest)
+		ms.errorf("vhost-user queue %d: request of %d bytes too large", e.q.idx, n)
+		e.q.push(e.head, 0)
+		return
+	}
+	n = 0
+	for _, b := range e.in {
+		n += copy(dest[n:], b)
+	}
+
+	req := ms.reqPool.Get().(*request)
+	if ms.timed() {
+		req.startTime = time.Now()
+	}
+	if !req.setInput(dest[:n]) {
+		ms.buffers.freeInput(dest)
+	}
+	req.virtq = e
+
+	ms.reqMu.Lock()
+	if status := req.parseHeader(); !status.Ok() {
+		ms.reqMu.Unlock()
+		ms.errorf("vhost-user queue %d: short read for input header: %v", e.q.idx, req.inputBuf)
+		e.q.push(e.head, 0)
+		return
+	}
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	isInit := req.inHeader.Opcode == _OP_INIT
+	ms.handleRequest(req)
+	if !e.done {
+		// Requests without reply, such as FORGET, must still
+		// be returned to the driver.
+		e.q.push(e.head, 0)
+	}
+	if isInit {
+		select {
+		case ms.ready <- nil:
+		default:
+		}
+	}
+}
+
+// write copies the reply into the out buffers, and returns the
+// chain to the driver.
+func (e *virtqElem) write(req *request, header []byte) Status {
+	data := req.flatData
+	if req.fdData != nil {
+		buf := e.q.s.ms.allocOut(req, uint32(req.flatDataSize()))
+		var st int
+		data, st = req.fdData.Bytes(buf)
+		req.status = Status(st)
+		header = req.serializeHeader(len(data))
+	}
+
+	bufs := [][]byte{header}
+	if req.slices != nil {
+		bufs = append(bufs, req.slices...)
+	} else {
+		bufs = append(bufs, data)
+	}
+
+	var n, total int
+	out := e.out
+	for _, b := range bufs {
+		total += len(b)
+		for len(b) > 0 && len(out) > 0 {
+			c := copy(out[0], b)
+			b = b[c:]
+			out[0] = out[0][c:]
+			n += c
+			if len(out[0]) == 0 {
+				out = out[1:]
+			}
+		}
+	}
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
+
+	e.done = true
+	e.q.push(e.head, uint32(n))
+	if n < total {
+		return Status(syscall.ENOBUFS)
+	}
+	return OK
+}
+
+func atomicLoadUint32(b []byte) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[0])))
+}
+
+func atomicStoreUint32(b []byte, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b[0])), v)
+}
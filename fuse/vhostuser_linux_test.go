@@ -0,0 +1,291 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestVhostUserStructSizes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"VhostUserMsg header", unsafe.Sizeof(vhostUserHeader{}), 12},
+		{"VhostUserMemoryRegion", unsafe.Sizeof(vhostUserMemRegion{}), 32},
+		{"VhostUserMemory", unsafe.Sizeof(vhostUserMemory{}), 8 + 8*32},
+		{"vhost_vring_addr", unsafe.Sizeof(vhostVringAddr{}), 40},
+		{"vring_desc", unsafe.Sizeof(vringDesc{}), 16},
+		{"vring_used_elem", unsafe.Sizeof(vringUsedElem{}), 8},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+type vhostTestFS struct {
+	RawFileSystem
+}
+
+func (fs *vhostTestFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Mode = syscall.S_IFDIR | 0755
+	out.Ino = input.NodeId
+	return OK
+}
+
+// Guest memory layout of the test front-end.
+const (
+	testGuestBase  = 0x100000
+	testGuestSize  = 1 << 20
+	testQueueSize  = 8
+	testDescOff    = 0
+	testAvailOff   = 512
+	testUsedOff    = 1024
+	testRequestOff = 4096
+	testReplyOff   = 8192
+)
+
+// vhostTestFrontend plays the VMM and the guest driver.
+type vhostTestFrontend struct {
+	t      *testing.T
+	conn   *net.UnixConn
+	mem    []byte
+	kickFd int
+	callFd int
+	avail  uint16
+}
+
+func eventfd(t *testing.T) int {
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		t.Fatalf("eventfd: %v", errno)
+	}
+	return int(fd)
+}
+
+func (f *vhostTestFrontend) send(request uint32, payload []byte, fds ...int) {
+	f.t.Helper()
+	msg := make([]byte, 12+len(payload))
+	*(*vhostUserHeader)(unsafe.Pointer(&msg[0])) = vhostUserHeader{
+		Request: request,
+		Flags:   _VHOST_USER_VERSION,
+		Size:    uint32(len(payload)),
+	}
+	copy(msg[12:], payload)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := f.conn.WriteMsgUnix(msg, oob, nil); err != nil {
+		f.t.Fatalf("send %d: %v", request, err)
+	}
+}
+
+func (f *vhostTestFrontend) call(request uint32, payload []byte) []byte {
+	f.t.Helper()
+	f.send(request, payload)
+	var hdr [12]byte
+	if _, err := f.conn.Read(hdr[:]); err != nil {
+		f.t.Fatalf("reply %d: %v", request, err)
+	}
+	h := *(*vhostUserHeader)(unsafe.Pointer(&hdr[0]))
+	if h.Request != request || h.Flags&_VHOST_USER_REPLY_MASK == 0 {
+		f.t.Fatalf("got reply header %+v for %d", h, request)
+	}
+	reply := make([]byte, h.Size)
+	if _, err := f.conn.Read(reply); err != nil {
+		f.t.Fatalf("reply %d: %v", request, err)
+	}
+	return reply
+}
+
+func (f *vhostTestFrontend) uva(off int) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&f.mem[off])))
+}
+
+// roundTrip puts a request in the queue, and returns the reply.
+func (f *vhostTestFrontend) roundTrip(in []byte) []byte {
+	f.t.Helper()
+	copy(f.mem[testRequestOff:], in)
+	desc := (*[testQueueSize]vringDesc)(unsafe.Pointer(&f.mem[testDescOff]))
+	desc[0] = vringDesc{Addr: testGuestBase + testRequestOff, Len: uint32(len(in)), Flags: _VRING_DESC_F_NEXT, Next: 1}
+	desc[1] = vringDesc{Addr: testGuestBase + testReplyOff, Len: 4096, Flags: _VRING_DESC_F_WRITE}
+
+	binary.LittleEndian.PutUint16(f.mem[testAvailOff+4+2*int(f.avail%testQueueSize):], 0)
+	f.avail++
+	atomicStoreUint32(f.mem[testAvailOff:], uint32(f.avail)<<16)
+	if _, err := syscall.Write(f.kickFd, u64Bytes(1)); err != nil {
+		f.t.Fatalf("kick: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for uint16(atomicLoadUint32(f.mem[testUsedOff:])>>16) != f.avail {
+		if time.Now().After(deadline) {
+			f.t.Fatalf("no reply for request %d", f.avail)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var buf [8]byte
+	if _, err := syscall.Read(f.callFd, buf[:]); err != nil {
+		f.t.Errorf("call: %v", err)
+	}
+	slot := int((f.avail - 1) % testQueueSize)
+	used := (*vringUsedElem)(unsafe.Pointer(&f.mem[testUsedOff+4+8*slot]))
+	if used.ID != 0 {
+		f.t.Errorf("used ID %d, want 0", used.ID)
+	}
+	return f.mem[testReplyOff : testReplyOff+int(used.Len)]
+}
+
+func TestVirtioFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVirtioFS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "vhost.sock")
+	ms, err := NewVirtioFSServer(&vhostTestFS{NewDefaultRawFileSystem()}, sock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ms.Serve()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memFile, err := ioutil.TempFile(dir, "mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memFile.Close()
+	if err := memFile.Truncate(testGuestSize); err != nil {
+		t.Fatal(err)
+	}
+	mem, err := syscall.Mmap(int(memFile.Fd()), 0, testGuestSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(mem)
+
+	f := &vhostTestFrontend{
+		t:      t,
+		conn:   conn.(*net.UnixConn),
+		mem:    mem,
+		kickFd: eventfd(t),
+		callFd: eventfd(t),
+	}
+	defer syscall.Close(f.kickFd)
+	defer syscall.Close(f.callFd)
+
+	features := binary.LittleEndian.Uint64(f.call(_VHOST_USER_GET_FEATURES, nil))
+	if features&_VHOST_USER_F_PROTOCOL_FEATURES == 0 {
+		t.Fatalf("features %x lack VHOST_USER_F_PROTOCOL_FEATURES", features)
+	}
+	f.send(_VHOST_USER_SET_FEATURES, u64Bytes(features))
+	protocol := binary.LittleEndian.Uint64(f.call(_VHOST_USER_GET_PROTOCOL_FEATURES, nil))
+	f.send(_VHOST_USER_SET_PROTOCOL_FEATURES, u64Bytes(protocol))
+	f.send(_VHOST_USER_SET_OWNER, nil)
+
+	table := vhostUserMemory{NRegions: 1}
+	table.Regions[0] = vhostUserMemRegion{
+		GuestPhysAddr: testGuestBase,
+		MemorySize:    testGuestSize,
+		UserspaceAddr: f.uva(0),
+	}
+	f.send(_VHOST_USER_SET_MEM_TABLE, (*[unsafe.Sizeof(table)]byte)(unsafe.Pointer(&table))[:], int(memFile.Fd()))
+
+	state := func(idx, num uint32) []byte {
+		s := vhostVringState{idx, num}
+		return append([]byte{}, (*[8]byte)(unsafe.Pointer(&s))[:]...)
+	}
+	f.send(_VHOST_USER_SET_VRING_NUM, state(1, testQueueSize))
+	addr := vhostVringAddr{
+		Index: 1,
+		Desc:  f.uva(testDescOff),
+		Used:  f.uva(testUsedOff),
+		Avail: f.uva(testAvailOff),
+	}
+	f.send(_VHOST_USER_SET_VRING_ADDR, (*[unsafe.Sizeof(addr)]byte)(unsafe.Pointer(&addr))[:])
+	f.send(_VHOST_USER_SET_VRING_BASE, state(1, 0))
+	f.send(_VHOST_USER_SET_VRING_KICK, u64Bytes(1), f.kickFd)
+	f.send(_VHOST_USER_SET_VRING_CALL, u64Bytes(1), f.callFd)
+	f.send(_VHOST_USER_SET_VRING_ENABLE, state(1, 1))
+
+	initIn := InitIn{
+		InHeader: InHeader{
+			Length: uint32(unsafe.Sizeof(InitIn{})),
+			Opcode: _OP_INIT,
+			Unique: 2,
+		},
+		Major: _FUSE_KERNEL_VERSION,
+		Minor: 31,
+	}
+	reply := f.roundTrip((*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(&initIn))[:])
+	out := (*OutHeader)(unsafe.Pointer(&reply[0]))
+	if out.Unique != 2 || out.Status != 0 {
+		t.Fatalf("INIT: got %+v", out)
+	}
+	if initOut := (*InitOut)(unsafe.Pointer(&reply[sizeOfOutHeader])); initOut.Major != _FUSE_KERNEL_VERSION {
+		t.Errorf("INIT: got major %d", initOut.Major)
+	}
+	if err := ms.WaitMount(); err != nil {
+		t.Errorf("WaitMount: %v", err)
+	}
+
+	getattr := GetAttrIn{InHeader: InHeader{
+		Length: uint32(unsafe.Sizeof(GetAttrIn{})),
+		Opcode: _OP_GETATTR,
+		Unique: 4,
+		NodeId: 1,
+	}}
+	reply = f.roundTrip((*[unsafe.Sizeof(GetAttrIn{})]byte)(unsafe.Pointer(&getattr))[:])
+	out = (*OutHeader)(unsafe.Pointer(&reply[0]))
+	if out.Unique != 4 || out.Status != 0 || int(out.Length) != len(reply) {
+		t.Fatalf("GETATTR: got %+v, %d bytes", out, len(reply))
+	}
+	if attr := (*AttrOut)(unsafe.Pointer(&reply[sizeOfOutHeader])); attr.Mode != syscall.S_IFDIR|0755 {
+		t.Errorf("GETATTR: got mode %o", attr.Mode)
+	}
+
+	// FORGET has no reply, but the buffers are returned.
+	forget := ForgetIn{InHeader: InHeader{
+		Length: uint32(unsafe.Sizeof(ForgetIn{})),
+		Opcode: _OP_FORGET,
+		Unique: 6,
+		NodeId: 1,
+	}}
+	if reply := f.roundTrip((*[unsafe.Sizeof(ForgetIn{})]byte)(unsafe.Pointer(&forget))[:]); len(reply) != 0 {
+		t.Errorf("FORGET: got %d reply bytes", len(reply))
+	}
+
+	base := f.call(_VHOST_USER_GET_VRING_BASE, state(1, 0))
+	if got := (*vhostVringState)(unsafe.Pointer(&base[0])); got.Num != 3 {
+		t.Errorf("GET_VRING_BASE: got %+v, want 3", got)
+	}
+
+	conn.Close()
+	done := make(chan struct{})
+	go func() {
+		ms.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after disconnect")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TimedOutRequest describes a request that the file system did not
+// answer within MountOptions.RequestTimeout.
+type TimedOutRequest struct {
+	// Opcode is the name of the operation, eg. "READ".
+	Opcode string
+	NodeId uint64
+	Unique uint64
+	Caller Caller
+
+	// Elapsed is the time since the request was read, less the
+	// time it waited for MountOptions.RateLimit.
+	Elapsed time.Duration
+
+	// Replied is set if the request was answered with EIO, see
+	// MountOptions.RequestTimeoutEIO.
+	Replied bool
+
+	opcode uint32
+	clone  *devClone
+}
+
+// minWatchdogInterval is the shortest interval at which the requests
+// in flight are checked for timeouts.
+const minWatchdogInterval = 10 * time.Millisecond
+
+// watchRequests checks the requests in flight for timeouts until
+// Serve returns.
+func (ms *Server) watchRequests() {
+	interval := ms.opts.RequestTimeout / 4
+	if interval < minWatchdogInterval {
+		interval = minWatchdogInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ms.serveDone:
+			return
+		case now := <-t.C:
+			ms.checkTimeouts(now)
+		}
+	}
+}
+
+// checkTimeouts reports the requests that arrived more than
+// RequestTimeout before now, once each, and answers them with EIO if
+// RequestTimeoutEIO is set.
+func (ms *Server) checkTimeouts(now time.Time) {
+	var timedOut []TimedOutRequest
+	ms.reqMu.Lock()
+	for _, req := range ms.reqInflight {
+		if req.timedOut || req.startTime.IsZero() || !req.limitedSince.IsZero() {
+			continue
+		}
+		// The time spent waiting for the rate limits is not the
+		// file system's.
+		elapsed := now.Sub(req.startTime) - req.limitWait
+		if elapsed < ms.opts.RequestTimeout {
+			continue
+		}
+		switch req.inHeader.Opcode {
+		// SETLKW waits for as long as the lock is held.
+		case _OP_FORGET, _OP_BATCH_FORGET, _OP_INTERRUPT, _OP_NOTIFY_REPLY, _OP_SETLKW:
+			continue
+		}
+		req.timedOut = true
+		r := TimedOutRequest{
+			Opcode:  operationName(req.inHeader.Opcode),
+			NodeId:  req.inHeader.NodeId,
+			Unique:  req.inHeader.Unique,
+			Caller:  req.inHeader.Caller,
+			Elapsed: elapsed,
+			opcode:  req.inHeader.Opcode,
+			clone:   req.clone,
+		}
+		// Replies over io_uring and virtio-fs must go through
+		// the entry that delivered the request.
+		if ms.opts.RequestTimeoutEIO && req.ring == nil && req.virtq == nil &&
+			!createsState(req.inHeader.Opcode) &&
+			atomic.CompareAndSwapInt32(&req.replied, 0, 1) {
+			r.Replied = true
+			if !req.interrupted {
+				close(req.cancel)
+				req.interrupted = true
+			}
+		}
+		timedOut = append(timedOut, r)
+	}
+	ms.reqMu.Unlock()
+
+	for i := range timedOut {
+		r := &timedOut[i]
+		if r.Replied {
+			ms.replyTimedOut(r)
+		}
+		ms.errorf("request %s n%d (unique %d) did not finish in %v, replied EIO: %v",
+			r.Opcode, r.NodeId, r.Unique, r.Elapsed, r.Replied)
+		if f := ms.opts.OnRequestTimeout; f != nil {
+			f(r)
+		}
+	}
+}
+
+// createsState returns whether the reply to opcode hands out node
+// IDs or a file handle, which the kernel only learns about from the
+// reply. Dropping such a reply would leak them in the file system.
+func createsState(opcode uint32) bool {
+	switch opcode {
+	case _OP_LOOKUP, _OP_READDIRPLUS, _OP_CREATE, _OP_MKNOD, _OP_MKDIR, _OP_SYMLINK, _OP_LINK,
+		_OP_TMPFILE, _OP_OPEN, _OP_OPENDIR:
+		return true
+	}
+	return false
+}
+
+// replyTimedOut answers a request with EIO, on behalf of its
+// handler, which still runs.
+func (ms *Server) replyTimedOut(r *TimedOutRequest) {
+	req := request{
+		inHeader: &InHeader{
+			Opcode: r.opcode,
+			NodeId: r.NodeId,
+			Unique: r.Unique,
+		},
+		handler: getHandler(r.opcode),
+		status:  EIO,
+		// The kernel only takes the reply on the device that
+		// the request was read from.
+		clone: r.clone,
+	}
+	ms.writeMu.RLock()
+	result := ms.write(&req)
+	ms.writeMu.RUnlock()
+	if !result.Ok() {
+		ms.errorf("writer: replying EIO to timed out request %d failed: %v", r.Unique, result)
+	}
+}
+
+// claimReply returns whether the handler of req may write its reply,
+// which it may not if the watchdog answered the request already.
+func (ms *Server) claimReply(req *request) bool {
+	if !ms.opts.RequestTimeoutEIO {
+		return true
+	}
+	return atomic.CompareAndSwapInt32(&req.replied, 0, 1)
+}
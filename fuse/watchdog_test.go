@@ -0,0 +1,211 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type hangingFS struct {
+	RawFileSystem
+	started chan struct{}
+}
+
+func (fs *hangingFS) GetAttr(cancel <-chan struct{}, in *GetAttrIn, out *AttrOut) Status {
+	close(fs.started)
+	<-cancel
+	return EINTR
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &hangingFS{RawFileSystem: NewDefaultRawFileSystem(), started: make(chan struct{})}
+	var timedOut []TimedOutRequest
+	ms, err := newServer(fs, &MountOptions{
+		RequestTimeout:    time.Second,
+		RequestTimeoutEIO: true,
+		OnRequestTimeout: func(r *TimedOutRequest) {
+			timedOut = append(timedOut, *r)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	in := GetAttrIn{InHeader: InHeader{Length: uint32(unsafe.Sizeof(GetAttrIn{})), Opcode: _OP_GETATTR, NodeId: 7, Unique: 42}}
+	buf := make([]byte, in.Length)
+	*(*GetAttrIn)(unsafe.Pointer(&buf[0])) = in
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	start := time.Now()
+	req.startTime = start
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ms.handleRequest(req)
+		close(done)
+	}()
+	<-fs.started
+
+	ms.checkTimeouts(start.Add(time.Second / 2))
+	if len(timedOut) != 0 {
+		t.Fatalf("request timed out early: %v", timedOut)
+	}
+	ms.checkTimeouts(start.Add(2 * time.Second))
+	<-done
+	ms.checkTimeouts(start.Add(3 * time.Second))
+
+	if len(timedOut) != 1 {
+		t.Fatalf("got timeouts %v, want 1", timedOut)
+	}
+	if r := timedOut[0]; r.Opcode != "GETATTR" || r.NodeId != 7 || r.Unique != 42 || !r.Replied || r.Elapsed != 2*time.Second {
+		t.Errorf("got %+v", r)
+	}
+
+	// Only the EIO of the watchdog is written.
+	out := make([]byte, 4096)
+	n, err := syscall.Read(fds[0], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (*OutHeader)(unsafe.Pointer(&out[0]))
+	if n != int(sizeOfOutHeader) || h.Unique != 42 || h.Status != -int32(syscall.EIO) {
+		t.Errorf("got reply %+v of %d bytes, want EIO", h, n)
+	}
+	syscall.SetNonblock(fds[0], true)
+	if n, err := syscall.Read(fds[0], out); err != syscall.EAGAIN {
+		t.Errorf("got a second reply of %d bytes, err %v", n, err)
+	}
+}
+
+type slowLookupFS struct {
+	RawFileSystem
+	started, release chan struct{}
+}
+
+func (fs *slowLookupFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	close(fs.started)
+	<-fs.release
+	out.NodeId = 5
+	return OK
+}
+
+func TestRequestTimeoutLookup(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	fs := &slowLookupFS{RawFileSystem: NewDefaultRawFileSystem(), started: make(chan struct{}), release: make(chan struct{})}
+	var timedOut []TimedOutRequest
+	ms, err := newServer(fs, &MountOptions{
+		RequestTimeout:    time.Second,
+		RequestTimeoutEIO: true,
+		OnRequestTimeout: func(r *TimedOutRequest) {
+			timedOut = append(timedOut, *r)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mountFd = fds[1]
+
+	hdr := InHeader{Opcode: _OP_LOOKUP, NodeId: 1, Unique: 42}
+	buf := append((*[unsafe.Sizeof(InHeader{})]byte)(unsafe.Pointer(&hdr))[:], "file\x00"...)
+	(*InHeader)(unsafe.Pointer(&buf[0])).Length = uint32(len(buf))
+
+	req := ms.reqPool.Get().(*request)
+	req.setInput(buf)
+	if st := req.parseHeader(); !st.Ok() {
+		t.Fatal(st)
+	}
+	start := time.Now()
+	req.startTime = start
+	ms.reqMu.Lock()
+	req.inflightIndex = len(ms.reqInflight)
+	ms.reqInflight = append(ms.reqInflight, req)
+	ms.reqMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ms.handleRequest(req)
+		close(done)
+	}()
+	<-fs.started
+	ms.checkTimeouts(start.Add(2 * time.Second))
+	close(fs.release)
+	<-done
+
+	if len(timedOut) != 1 || timedOut[0].Replied {
+		t.Fatalf("got timeouts %+v, want one that was not replied", timedOut)
+	}
+
+	// The entry reaches the kernel, which can forget it later.
+	out := make([]byte, 4096)
+	n, err := syscall.Read(fds[0], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (*OutHeader)(unsafe.Pointer(&out[0]))
+	if h.Unique != 42 || h.Status != 0 || n <= int(sizeOfOutHeader) {
+		t.Errorf("got reply %+v of %d bytes, want the entry", h, n)
+	}
+	if e := (*EntryOut)(unsafe.Pointer(&out[sizeOfOutHeader])); e.NodeId != 5 {
+		t.Errorf("got node %d, want 5", e.NodeId)
+	}
+}
+
+func TestRequestTimeoutExempt(t *testing.T) {
+	var timedOut []TimedOutRequest
+	ms, err := newServer(NewDefaultRawFileSystem(), &MountOptions{
+		RequestTimeout: time.Second,
+		OnRequestTimeout: func(r *TimedOutRequest) {
+			timedOut = append(timedOut, *r)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i, req := range []*request{
+		// Waits for a lock.
+		{inHeader: &InHeader{Opcode: _OP_SETLKW, Unique: 1}},
+		// Waits for the rate limits.
+		{inHeader: &InHeader{Opcode: _OP_READ, Unique: 2}, limitedSince: start},
+		// Waited for the rate limits for most of its time.
+		{inHeader: &InHeader{Opcode: _OP_READ, Unique: 3}, limitWait: 1500 * time.Millisecond},
+		{inHeader: &InHeader{Opcode: _OP_READ, Unique: 4}},
+	} {
+		req.startTime = start
+		req.inflightIndex = i
+		ms.reqInflight = append(ms.reqInflight, req)
+	}
+
+	ms.checkTimeouts(start.Add(2 * time.Second))
+	if len(timedOut) != 1 || timedOut[0].Unique != 4 {
+		t.Errorf("got timeouts %+v, want only 4", timedOut)
+	}
+}
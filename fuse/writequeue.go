@@ -0,0 +1,114 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WriteQueueStats describes the reply queue, see
+// MountOptions.WriteQueueSize.
+type WriteQueueStats struct {
+	// Queued is the number of replies waiting to be written.
+	Queued int
+
+	// Written is the number of replies that were written from the
+	// queue.
+	Written uint64
+
+	// Stalls is the number of times a handler had to wait because
+	// the queue was full.
+	Stalls uint64
+
+	// WriteTime is the total time spent writing to the kernel.
+	WriteTime time.Duration
+}
+
+// writeQueueCounters is allocated on its own, so the 64-bit fields
+// are aligned also on 32-bit platforms.
+type writeQueueCounters struct {
+	written   uint64
+	stalls    uint64
+	writeTime int64
+}
+
+// WriteQueueStats returns statistics of the reply queue. They are
+// zero if MountOptions.WriteQueueSize is not set.
+func (ms *Server) WriteQueueStats() WriteQueueStats {
+	ms.writeQueueMu.RLock()
+	queued := len(ms.writeQueue)
+	ms.writeQueueMu.RUnlock()
+	return WriteQueueStats{
+		Queued:    queued,
+		Written:   atomic.LoadUint64(&ms.writeCounters.written),
+		Stalls:    atomic.LoadUint64(&ms.writeCounters.stalls),
+		WriteTime: time.Duration(atomic.LoadInt64(&ms.writeCounters.writeTime)),
+	}
+}
+
+// queueWrite hands the reply to req to the writer goroutine, which
+// also returns req. It returns false if the reply must be written
+// directly, because there is no queue, or req came from io_uring or
+// virtio-fs, or needs no reply.
+func (ms *Server) queueWrite(req *request) bool {
+	if req.ring != nil || req.virtq != nil || ms.vhost != nil {
+		return false
+	}
+	switch req.inHeader.Opcode {
+	case _OP_INIT, _OP_FORGET, _OP_BATCH_FORGET, _OP_NOTIFY_REPLY:
+		return false
+	}
+	ms.writeQueueMu.RLock()
+	defer ms.writeQueueMu.RUnlock()
+	if ms.writeQueue == nil {
+		return false
+	}
+	select {
+	case ms.writeQueue <- req:
+	default:
+		atomic.AddUint64(&ms.writeCounters.stalls, 1)
+		ms.writeQueue <- req
+	}
+	return true
+}
+
+// startWriteQueue starts the writer goroutine, if
+// MountOptions.WriteQueueSize is set.
+func (ms *Server) startWriteQueue() {
+	if ms.opts.WriteQueueSize <= 0 {
+		return
+	}
+	ms.writeQueueMu.Lock()
+	ms.writeQueue = make(chan *request, ms.opts.WriteQueueSize)
+	ms.writerDone = make(chan struct{})
+	go ms.writeLoop(ms.writeQueue, ms.writerDone)
+	ms.writeQueueMu.Unlock()
+}
+
+// writeLoop writes the queued replies, until the queue is closed.
+func (ms *Server) writeLoop(queue chan *request, done chan struct{}) {
+	defer close(done)
+	for req := range queue {
+		start := time.Now()
+		st := ms.write(req)
+		atomic.AddInt64(&ms.writeCounters.writeTime, int64(time.Since(start)))
+		atomic.AddUint64(&ms.writeCounters.written, 1)
+		ms.finishRequest(req, st)
+	}
+}
+
+// stopWriteQueue writes the pending replies, and makes later replies
+// go directly to the kernel.
+func (ms *Server) stopWriteQueue() {
+	ms.writeQueueMu.Lock()
+	queue := ms.writeQueue
+	ms.writeQueue = nil
+	ms.writeQueueMu.Unlock()
+	if queue != nil {
+		close(queue)
+		<-ms.writerDone
+	}
+}
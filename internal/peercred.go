@@ -0,0 +1,58 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// PeerUid returns the effective user ID of the process at the other
+// end of conn, as the kernel recorded it when the connection was
+// made.
+func PeerUid(conn *net.UnixConn) (uint32, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var uid uint32
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		uid, credErr = peerUid(int(fd))
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("peer credentials: %v", credErr)
+	}
+	return uid, nil
+}
+
+// CheckPeer returns an error unless the peer of conn runs as one of
+// the allowed user IDs. If allowed is empty, the effective user ID of
+// this process and root are allowed.
+func CheckPeer(conn *net.UnixConn, allowed []uint32) error {
+	uid, err := PeerUid(conn)
+	if err != nil {
+		return err
+	}
+	if !uidAllowed(uid, allowed) {
+		return fmt.Errorf("peer user ID %d is not allowed", uid)
+	}
+	return nil
+}
+
+func uidAllowed(uid uint32, allowed []uint32) bool {
+	if len(allowed) == 0 {
+		return uid == 0 || uid == uint32(os.Geteuid())
+	}
+	for _, a := range allowed {
+		if a == uid {
+			return true
+		}
+	}
+	return false
+}
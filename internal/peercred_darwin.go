@@ -0,0 +1,39 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// From <sys/un.h> and <sys/ucred.h>.
+const (
+	_SOL_LOCAL      = 0
+	_LOCAL_PEERCRED = 1
+	_XUCRED_VERSION = 0
+	_XU_NGROUPS     = 16
+)
+
+type xucred struct {
+	Version uint32
+	Uid     uint32
+	Ngroups int16
+	Groups  [_XU_NGROUPS]uint32
+}
+
+func peerUid(fd int) (uint32, error) {
+	var cred xucred
+	size := uint32(unsafe.Sizeof(cred))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), _SOL_LOCAL, _LOCAL_PEERCRED,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	if cred.Version != _XUCRED_VERSION {
+		return 0, syscall.EINVAL
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestCheckPeer(t *testing.T) {
+	a, b := unixPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	me := uint32(os.Geteuid())
+	uid, err := PeerUid(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != me {
+		t.Errorf("got peer uid %d, want %d", uid, me)
+	}
+
+	if err := CheckPeer(a, nil); err != nil {
+		t.Errorf("default: %v", err)
+	}
+	if err := CheckPeer(a, []uint32{me}); err != nil {
+		t.Errorf("allowed %d: %v", me, err)
+	}
+	if err := CheckPeer(a, []uint32{me + 1}); err == nil {
+		t.Errorf("allowed %d: peer %d was accepted", me+1, me)
+	}
+}
+
+func TestUidAllowed(t *testing.T) {
+	me := uint32(os.Geteuid())
+	for _, tc := range []struct {
+		uid     uint32
+		allowed []uint32
+		want    bool
+	}{
+		{0, nil, true},
+		{me, nil, true},
+		{me + 1, nil, me+1 == 0},
+		{1000, []uint32{1000, 1001}, true},
+		{0, []uint32{1000}, false},
+	} {
+		if got := uidAllowed(tc.uid, tc.allowed); got != tc.want {
+			t.Errorf("uidAllowed(%d, %v) = %v, want %v", tc.uid, tc.allowed, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// OpenFds returns the open file descriptors of the process, and what
+// they refer to, eg. "pipe:[1234]" or "/dev/fuse". It returns nil if
+// /proc/self/fd is not available.
+func OpenFds() map[int]string {
+	d, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil
+	}
+	fds := make(map[int]string, len(names))
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		if target, err := os.Readlink("/proc/self/fd/" + name); err == nil {
+			fds[fd] = target
+		}
+	}
+	return fds
+}
+
+// CheckFdLeaks records the open file descriptors. The returned
+// function fails the test if pipes or /dev/fuse descriptors were
+// opened since, and are still open. Call it after the server has
+// been unmounted.
+func CheckFdLeaks(t testing.TB) func() {
+	before := OpenFds()
+	return func() {
+		t.Helper()
+		if before == nil {
+			return
+		}
+		for fd, target := range OpenFds() {
+			if before[fd] == target {
+				continue
+			}
+			if strings.HasPrefix(target, "pipe:") || target == "/dev/fuse" {
+				t.Errorf("fd %d (%s) leaked", fd, target)
+			}
+		}
+	}
+}
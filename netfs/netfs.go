@@ -0,0 +1,355 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netfs serves a file system from a network backend that
+// addresses files by opaque handles, such as an NFS client library.
+// It maps the handles and attributes of the backend onto the nodes
+// of the fs package, so the backend only has to implement Client.
+// It also serves as a template for backends that need more control.
+//
+// Handles must stay valid while the file exists, also across
+// renames, as NFS file handles do. Backends that only have paths,
+// such as SFTP, can use the path as the handle, but then a renamed
+// file or directory must be looked up again before it can be used.
+package netfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Handle identifies a file on the server, eg. an NFS file handle.
+type Handle string
+
+// Attr holds the attributes of a file, eg. an NFS fattr3.
+type Attr struct {
+	// Ino is the file ID. It identifies the file on the server,
+	// and is used as the inode number.
+	Ino uint64
+
+	// Mode holds the file type and permission bits, as in
+	// syscall.Stat_t.
+	Mode uint32
+
+	Nlink uint32
+	Uid   uint32
+	Gid   uint32
+	Size  uint64
+
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+}
+
+// SetAttr holds the attributes to change. Nil fields are left alone.
+type SetAttr struct {
+	Mode  *uint32
+	Uid   *uint32
+	Gid   *uint32
+	Size  *uint64
+	Atime *time.Time
+	Mtime *time.Time
+}
+
+// DirEntry is an entry of a directory listing.
+type DirEntry struct {
+	Name string
+	Ino  uint64
+
+	// Mode holds the file type of the entry, eg. syscall.S_IFDIR.
+	Mode uint32
+}
+
+// Client is a connection to the server. Its methods are called
+// concurrently, with the context of the FUSE request, which is
+// canceled if the request is interrupted.
+//
+// Errors are passed to the kernel as errno values: a syscall.Errno,
+// possibly wrapped, is passed as is, so clients should map the status
+// codes of their protocol to them. Handles that no longer exist
+// should give syscall.ESTALE, so the kernel looks up the file again.
+// Other errors give EIO.
+type Client interface {
+	// Root returns the handle of the exported directory.
+	Root(ctx context.Context) (Handle, *Attr, error)
+
+	Lookup(ctx context.Context, dir Handle, name string) (Handle, *Attr, error)
+	GetAttr(ctx context.Context, h Handle) (*Attr, error)
+	SetAttr(ctx context.Context, h Handle, sa *SetAttr) (*Attr, error)
+
+	// ReadDir lists the entries of dir, except "." and "..".
+	ReadDir(ctx context.Context, dir Handle) ([]DirEntry, error)
+
+	// Read reads into dest from offset off. At the end of the
+	// file, it returns fewer bytes, and no error.
+	Read(ctx context.Context, h Handle, dest []byte, off int64) (int, error)
+	Write(ctx context.Context, h Handle, data []byte, off int64) (int, error)
+
+	// Commit makes the data that was written to h durable, as
+	// NFS COMMIT does. It is called on close and fsync.
+	Commit(ctx context.Context, h Handle) error
+
+	// Create creates a regular file. If exclusive is set, it
+	// fails with EEXIST if the file exists, otherwise it returns
+	// the existing file as is; O_TRUNC is applied with SetAttr.
+	Create(ctx context.Context, dir Handle, name string, mode uint32, exclusive bool) (Handle, *Attr, error)
+	Mkdir(ctx context.Context, dir Handle, name string, mode uint32) (Handle, *Attr, error)
+	Symlink(ctx context.Context, dir Handle, name string, target string) (Handle, *Attr, error)
+	Readlink(ctx context.Context, h Handle) (string, error)
+
+	// Remove removes a file that is not a directory.
+	Remove(ctx context.Context, dir Handle, name string) error
+	Rmdir(ctx context.Context, dir Handle, name string) error
+	Rename(ctx context.Context, fromDir Handle, fromName string, toDir Handle, toName string) error
+}
+
+// NewRoot returns the root node for the file system that client
+// exports, to pass to fs.Mount.
+func NewRoot(ctx context.Context, client Client) (fs.InodeEmbedder, error) {
+	h, _, err := client.Root(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &node{client: client, handle: h}, nil
+}
+
+// node is a file on the server. A lookup that finds the file again
+// refreshes its handle, for backends whose handles change on rename.
+type node struct {
+	fs.Inode
+
+	client Client
+
+	mu     sync.Mutex
+	handle Handle
+}
+
+var _ = (fs.NodeLookuper)((*node)(nil))
+var _ = (fs.NodeGetattrer)((*node)(nil))
+var _ = (fs.NodeSetattrer)((*node)(nil))
+var _ = (fs.NodeReaddirer)((*node)(nil))
+var _ = (fs.NodeOpener)((*node)(nil))
+var _ = (fs.NodeReader)((*node)(nil))
+var _ = (fs.NodeWriter)((*node)(nil))
+var _ = (fs.NodeFlusher)((*node)(nil))
+var _ = (fs.NodeFsyncer)((*node)(nil))
+var _ = (fs.NodeCreater)((*node)(nil))
+var _ = (fs.NodeMkdirer)((*node)(nil))
+var _ = (fs.NodeSymlinker)((*node)(nil))
+var _ = (fs.NodeReadlinker)((*node)(nil))
+var _ = (fs.NodeUnlinker)((*node)(nil))
+var _ = (fs.NodeRmdirer)((*node)(nil))
+var _ = (fs.NodeRenamer)((*node)(nil))
+
+func (n *node) getHandle() Handle {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.handle
+}
+
+// newChild returns the Inode for the file with the given handle,
+// which was found under name. The inode number identifies the file,
+// so a file that is looked up under another name, or through
+// another handle, maps to the same Inode. If name already has that
+// Inode, it takes the new handle.
+func (n *node) newChild(ctx context.Context, name string, h Handle, a *Attr, out *fuse.EntryOut) *fs.Inode {
+	setAttr(a, &out.Attr)
+	mode := a.Mode & syscall.S_IFMT
+	if c := n.GetChild(name); c != nil {
+		if existing, ok := c.Operations().(*node); ok && c.StableAttr().Ino == a.Ino && c.StableAttr().Mode == mode {
+			existing.mu.Lock()
+			existing.handle = h
+			existing.mu.Unlock()
+			return c
+		}
+	}
+	child := &node{client: n.client, handle: h}
+	return n.NewInode(ctx, child, fs.StableAttr{Mode: mode, Ino: a.Ino})
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	h, a, err := n.client.Lookup(ctx, n.getHandle(), name)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, name, h, a, out), 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	a, err := n.client.GetAttr(ctx, n.getHandle())
+	if err != nil {
+		return toErrno(err)
+	}
+	setAttr(a, &out.Attr)
+	return 0
+}
+
+func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	var sa SetAttr
+	if m, ok := in.GetMode(); ok {
+		sa.Mode = &m
+	}
+	if uid, ok := in.GetUID(); ok {
+		sa.Uid = &uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		sa.Gid = &gid
+	}
+	if sz, ok := in.GetSize(); ok {
+		sa.Size = &sz
+	}
+	if t, ok := in.GetATime(); ok {
+		sa.Atime = &t
+	}
+	if t, ok := in.GetMTime(); ok {
+		sa.Mtime = &t
+	}
+	a, err := n.client.SetAttr(ctx, n.getHandle(), &sa)
+	if err != nil {
+		return toErrno(err)
+	}
+	setAttr(a, &out.Attr)
+	return 0
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := n.client.ReadDir(ctx, n.getHandle())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, fuse.DirEntry{Name: e.Name, Ino: e.Ino, Mode: e.Mode})
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+// Open opens the file statelessly, as NFS v3 does. Not setting
+// FOPEN_KEEP_CACHE makes the kernel drop cached data on open, which
+// gives close-to-open consistency.
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return nil, 0, 0
+}
+
+func (n *node) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	m, err := n.client.Read(ctx, n.getHandle(), dest, off)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return fuse.ReadResultData(dest[:m]), 0
+}
+
+func (n *node) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	m, err := n.client.Write(ctx, n.getHandle(), data, off)
+	if err != nil {
+		return 0, toErrno(err)
+	}
+	return uint32(m), 0
+}
+
+func (n *node) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	return toErrno(n.client.Commit(ctx, n.getHandle()))
+}
+
+func (n *node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+	return toErrno(n.client.Commit(ctx, n.getHandle()))
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	h, a, err := n.client.Create(ctx, n.getHandle(), name, mode, flags&syscall.O_EXCL != 0)
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+	if flags&syscall.O_TRUNC != 0 && a.Size != 0 {
+		// The file existed already.
+		var size uint64
+		if a, err = n.client.SetAttr(ctx, h, &SetAttr{Size: &size}); err != nil {
+			return nil, nil, 0, toErrno(err)
+		}
+	}
+	return n.newChild(ctx, name, h, a, out), nil, 0, 0
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	h, a, err := n.client.Mkdir(ctx, n.getHandle(), name, mode)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, name, h, a, out), 0
+}
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	h, a, err := n.client.Symlink(ctx, n.getHandle(), name, target)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return n.newChild(ctx, name, h, a, out), 0
+}
+
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := n.client.Readlink(ctx, n.getHandle())
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return []byte(target), 0
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.client.Remove(ctx, n.getHandle(), name))
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.client.Rmdir(ctx, n.getHandle(), name))
+}
+
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		// NFS has no RENAME_NOREPLACE or RENAME_EXCHANGE.
+		return syscall.EINVAL
+	}
+	p, ok := newParent.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	return toErrno(n.client.Rename(ctx, n.getHandle(), name, p.getHandle(), newName))
+}
+
+// setAttr copies the attributes of the server into out.
+func setAttr(a *Attr, out *fuse.Attr) {
+	out.Ino = a.Ino
+	out.Mode = a.Mode
+	out.Nlink = a.Nlink
+	out.Owner = fuse.Owner{Uid: a.Uid, Gid: a.Gid}
+	out.Size = a.Size
+	out.Blocks = (a.Size + 511) / 512
+	out.SetTimes(&a.Atime, &a.Mtime, &a.Ctime)
+}
+
+// toErrno maps an error of the client to an errno, see Client.
+func toErrno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,459 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// memClient is a Client for an in-memory server. Handles are opaque
+// strings that stay valid until the file is removed, as NFS file
+// handles are.
+type memClient struct {
+	mu    sync.Mutex
+	next  uint64
+	files map[Handle]*memFile
+	root  Handle
+}
+
+type memFile struct {
+	attr     Attr
+	data     []byte
+	target   string
+	children map[string]Handle
+}
+
+func newMemClient() *memClient {
+	c := &memClient{files: map[Handle]*memFile{}}
+	c.root = c.newFile(syscall.S_IFDIR | 0755)
+	return c
+}
+
+func (c *memClient) newFile(mode uint32) Handle {
+	c.next++
+	h := Handle(fmt.Sprintf("fh-%d", c.next))
+	now := time.Now()
+	f := &memFile{attr: Attr{Ino: c.next, Mode: mode, Nlink: 1, Atime: now, Mtime: now, Ctime: now}}
+	if mode&syscall.S_IFMT == syscall.S_IFDIR {
+		f.children = map[string]Handle{}
+		f.attr.Nlink = 2
+	}
+	c.files[h] = f
+	return h
+}
+
+func (c *memClient) file(h Handle) (*memFile, error) {
+	f := c.files[h]
+	if f == nil {
+		return nil, syscall.ESTALE
+	}
+	return f, nil
+}
+
+func (c *memClient) dir(h Handle) (*memFile, error) {
+	f, err := c.file(h)
+	if err != nil {
+		return nil, err
+	}
+	if f.children == nil {
+		return nil, syscall.ENOTDIR
+	}
+	return f, nil
+}
+
+func (c *memClient) Root(ctx context.Context) (Handle, *Attr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.files[c.root].attr
+	return c.root, &a, nil
+}
+
+func (c *memClient) Lookup(ctx context.Context, dir Handle, name string) (Handle, *Attr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.dir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	h, ok := d.children[name]
+	if !ok {
+		return "", nil, syscall.ENOENT
+	}
+	a := c.files[h].attr
+	return h, &a, nil
+}
+
+func (c *memClient) GetAttr(ctx context.Context, h Handle) (*Attr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(h)
+	if err != nil {
+		return nil, err
+	}
+	a := f.attr
+	return &a, nil
+}
+
+func (c *memClient) SetAttr(ctx context.Context, h Handle, sa *SetAttr) (*Attr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(h)
+	if err != nil {
+		return nil, err
+	}
+	if sa.Mode != nil {
+		f.attr.Mode = f.attr.Mode&syscall.S_IFMT | *sa.Mode&07777
+	}
+	if sa.Uid != nil {
+		f.attr.Uid = *sa.Uid
+	}
+	if sa.Gid != nil {
+		f.attr.Gid = *sa.Gid
+	}
+	if sa.Size != nil {
+		data := make([]byte, *sa.Size)
+		copy(data, f.data)
+		f.data = data
+		f.attr.Size = *sa.Size
+	}
+	if sa.Atime != nil {
+		f.attr.Atime = *sa.Atime
+	}
+	if sa.Mtime != nil {
+		f.attr.Mtime = *sa.Mtime
+	}
+	a := f.attr
+	return &a, nil
+}
+
+func (c *memClient) ReadDir(ctx context.Context, dir Handle) ([]DirEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.dir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DirEntry
+	for name, h := range d.children {
+		a := c.files[h].attr
+		entries = append(entries, DirEntry{Name: name, Ino: a.Ino, Mode: a.Mode & syscall.S_IFMT})
+	}
+	return entries, nil
+}
+
+func (c *memClient) Read(ctx context.Context, h Handle, dest []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(h)
+	if err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.data)) {
+		return 0, nil
+	}
+	return copy(dest, f.data[off:]), nil
+}
+
+func (c *memClient) Write(ctx context.Context, h Handle, data []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(h)
+	if err != nil {
+		return 0, err
+	}
+	if end := int(off) + len(data); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+		f.attr.Size = uint64(end)
+	}
+	copy(f.data[off:], data)
+	return len(data), nil
+}
+
+func (c *memClient) Commit(ctx context.Context, h Handle) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.file(h)
+	return err
+}
+
+func (c *memClient) create(dir Handle, name string, mode uint32, exclusive bool) (Handle, *Attr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.dir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if h, ok := d.children[name]; ok {
+		if exclusive || mode&syscall.S_IFMT != syscall.S_IFREG {
+			return "", nil, syscall.EEXIST
+		}
+		a := c.files[h].attr
+		return h, &a, nil
+	}
+	h := c.newFile(mode)
+	d.children[name] = h
+	a := c.files[h].attr
+	return h, &a, nil
+}
+
+func (c *memClient) Create(ctx context.Context, dir Handle, name string, mode uint32, exclusive bool) (Handle, *Attr, error) {
+	return c.create(dir, name, syscall.S_IFREG|mode&07777, exclusive)
+}
+
+func (c *memClient) Mkdir(ctx context.Context, dir Handle, name string, mode uint32) (Handle, *Attr, error) {
+	return c.create(dir, name, syscall.S_IFDIR|mode&07777, true)
+}
+
+func (c *memClient) Symlink(ctx context.Context, dir Handle, name string, target string) (Handle, *Attr, error) {
+	h, a, err := c.create(dir, name, syscall.S_IFLNK|0777, true)
+	if err != nil {
+		return "", nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[h].target = target
+	return h, a, nil
+}
+
+func (c *memClient) Readlink(ctx context.Context, h Handle) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := c.file(h)
+	if err != nil {
+		return "", err
+	}
+	return f.target, nil
+}
+
+func (c *memClient) remove(dir Handle, name string, isDir bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, err := c.dir(dir)
+	if err != nil {
+		return err
+	}
+	h, ok := d.children[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	f := c.files[h]
+	switch {
+	case isDir && f.children == nil:
+		return syscall.ENOTDIR
+	case !isDir && f.children != nil:
+		return syscall.EISDIR
+	case isDir && len(f.children) > 0:
+		return syscall.ENOTEMPTY
+	}
+	delete(d.children, name)
+	delete(c.files, h)
+	return nil
+}
+
+func (c *memClient) Remove(ctx context.Context, dir Handle, name string) error {
+	return c.remove(dir, name, false)
+}
+
+func (c *memClient) Rmdir(ctx context.Context, dir Handle, name string) error {
+	return c.remove(dir, name, true)
+}
+
+func (c *memClient) Rename(ctx context.Context, fromDir Handle, fromName string, toDir Handle, toName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from, err := c.dir(fromDir)
+	if err != nil {
+		return err
+	}
+	to, err := c.dir(toDir)
+	if err != nil {
+		return err
+	}
+	h, ok := from.children[fromName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if old, ok := to.children[toName]; ok {
+		delete(c.files, old)
+	}
+	delete(from.children, fromName)
+	to.children[toName] = h
+	return nil
+}
+
+func TestNetFS(t *testing.T) {
+	client := newMemClient()
+	root, err := NewRoot(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := fs.NewNodeFS(root, &fs.Options{})
+
+	var dirOut fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "dir", &dirOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if dirOut.Attr.Mode != syscall.S_IFDIR|0755 {
+		t.Errorf("mkdir: got mode %o", dirOut.Attr.Mode)
+	}
+
+	var createOut fuse.CreateOut
+	createIn := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Flags: syscall.O_RDWR | syscall.O_EXCL, Mode: 0644}
+	if st := rawFS.Create(nil, createIn, "file", &createOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	fileID := createOut.NodeId
+	if st := rawFS.Create(nil, createIn, "file", &createOut); st != fuse.Status(syscall.EEXIST) {
+		t.Errorf("exclusive create of existing file: got %v, want EEXIST", st)
+	}
+
+	data := []byte("hello")
+	if n, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: fileID}}, data); !st.Ok() || n != uint32(len(data)) {
+		t.Fatalf("write: %d, %v", n, st)
+	}
+	buf := make([]byte, 100)
+	res, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: fileID}, Size: uint32(len(buf))}, buf)
+	if !st.Ok() {
+		t.Fatal(st)
+	}
+	if got, _ := res.Bytes(buf); string(got) != "hello" {
+		t.Errorf("read: got %q", got)
+	}
+
+	// The handle of a file survives renames, so the node keeps
+	// working under its new name.
+	renameIn := &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: dirOut.NodeId}, Newdir: 1}
+	if st := rawFS.Rename(nil, renameIn, "file", "renamed"); !st.Ok() {
+		t.Fatal(st)
+	}
+	var lookupOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "renamed", &lookupOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if lookupOut.NodeId != fileID || lookupOut.Attr.Size != uint64(len(data)) {
+		t.Errorf("lookup after rename: got node %d size %d, want node %d size %d",
+			lookupOut.NodeId, lookupOut.Attr.Size, fileID, len(data))
+	}
+
+	// Truncate through SETATTR.
+	setIn := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{InHeader: fuse.InHeader{NodeId: fileID}, Valid: fuse.FATTR_SIZE, Size: 2}}
+	var attrOut fuse.AttrOut
+	if st := rawFS.SetAttr(nil, setIn, &attrOut); !st.Ok() || attrOut.Size != 2 {
+		t.Errorf("truncate: got size %d, %v", attrOut.Size, st)
+	}
+
+	// A file that is removed behind our back is stale.
+	if err := client.Remove(context.Background(), client.root, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: fileID}}, &attrOut); st != fuse.Status(syscall.ESTALE) {
+		t.Errorf("getattr of removed file: got %v, want ESTALE", st)
+	}
+
+	var linkOut fuse.EntryOut
+	if st := rawFS.Symlink(nil, &fuse.InHeader{NodeId: 1}, "target", "link", &linkOut); !st.Ok() {
+		t.Fatal(st)
+	}
+	if target, st := rawFS.Readlink(nil, &fuse.InHeader{NodeId: linkOut.NodeId}); !st.Ok() || string(target) != "target" {
+		t.Errorf("readlink: got %q, %v", target, st)
+	}
+
+	if st := rawFS.Rmdir(nil, &fuse.InHeader{NodeId: 1}, "dir"); !st.Ok() {
+		t.Errorf("rmdir: %v", st)
+	}
+}
+
+func TestCreateTrunc(t *testing.T) {
+	client := newMemClient()
+	root, err := NewRoot(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := fs.NewNodeFS(root, &fs.Options{})
+
+	var out fuse.CreateOut
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0644}
+	if st := rawFS.Create(nil, in, "file", &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	if _, st := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}, []byte("hello")); !st.Ok() {
+		t.Fatal(st)
+	}
+
+	in.Flags = syscall.O_RDWR | syscall.O_TRUNC
+	if st := rawFS.Create(nil, in, "file", &out); !st.Ok() {
+		t.Fatal(st)
+	}
+	if out.Attr.Size != 0 {
+		t.Errorf("create with O_TRUNC: got size %d, want 0", out.Attr.Size)
+	}
+	a, err := client.GetAttr(context.Background(), client.files[client.root].children["file"])
+	if err != nil || a.Size != 0 {
+		t.Errorf("server: got %+v, %v, want size 0", a, err)
+	}
+}
+
+func TestLookupRefreshesHandle(t *testing.T) {
+	client := newMemClient()
+	root, err := NewRoot(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := fs.NewNodeFS(root, &fs.Options{})
+
+	var out fuse.CreateOut
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0644}
+	if st := rawFS.Create(nil, in, "file", &out); !st.Ok() {
+		t.Fatal(st)
+	}
+
+	// The server hands out a new handle for the file, as servers
+	// that use paths as handles do after a rename.
+	client.mu.Lock()
+	d := client.files[client.root]
+	old := d.children["file"]
+	client.files["fh-new"] = client.files[old]
+	delete(client.files, old)
+	d.children["file"] = "fh-new"
+	client.mu.Unlock()
+
+	var attrOut fuse.AttrOut
+	getIn := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}
+	if st := rawFS.GetAttr(nil, getIn, &attrOut); st != fuse.Status(syscall.ESTALE) {
+		t.Fatalf("getattr with old handle: got %v, want ESTALE", st)
+	}
+	var lookupOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &lookupOut); !st.Ok() || lookupOut.NodeId != out.NodeId {
+		t.Fatalf("lookup: got node %d, %v, want node %d", lookupOut.NodeId, st, out.NodeId)
+	}
+	if st := rawFS.GetAttr(nil, getIn, &attrOut); !st.Ok() {
+		t.Errorf("getattr after lookup: %v", st)
+	}
+}
+
+func TestToErrno(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{nil, 0},
+		{syscall.ESTALE, syscall.ESTALE},
+		{fmt.Errorf("lookup: %w", syscall.ENOENT), syscall.ENOENT},
+		{context.Canceled, syscall.EINTR},
+		{fmt.Errorf("connection reset"), syscall.EIO},
+	} {
+		if got := toErrno(tc.err); got != tc.want {
+			t.Errorf("toErrno(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
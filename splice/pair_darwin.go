@@ -20,3 +20,8 @@ func (p *Pair) WriteTo(fd uintptr, n int) (int, error) {
 	panic("not implemented")
 	return 0, nil
 }
+
+func (p *Pair) WriteToAt(fd uintptr, n int, off int64) (int, error) {
+	panic("not implemented")
+	return 0, nil
+}
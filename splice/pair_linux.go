@@ -5,10 +5,14 @@
 package splice
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func (p *Pair) LoadFromAt(fd uintptr, sz int, off int64) (int, error) {
@@ -39,6 +43,87 @@ func (p *Pair) WriteTo(fd uintptr, n int) (int, error) {
 
 const _SPLICE_F_NONBLOCK = 0x2
 
+// ErrStalled is returned by LoadFromAtTimeout and LoadFromTimeout if
+// the pipe has no room for the data within the timeout, eg. because
+// its reader does not keep up.
+var ErrStalled = errors.New("splice: pipe stalled")
+
+// LoadFromAtTimeout is like LoadFromAt, but waits at most timeout
+// for room in the pipe. Waiting for data from a pipe or socket fd is
+// not bounded, as the data cannot be read otherwise either.
+func (p *Pair) LoadFromAtTimeout(fd uintptr, sz int, off int64, timeout time.Duration) (int, error) {
+	return p.loadTimeout(int(fd), timeout, func() (int, error) {
+		n, err := syscall.Splice(int(fd), &off, p.w, nil, sz, _SPLICE_F_NONBLOCK)
+		return int(n), err
+	})
+}
+
+// LoadFromTimeout is like LoadFrom, but waits at most timeout for
+// room in the pipe, like LoadFromAtTimeout.
+func (p *Pair) LoadFromTimeout(fd uintptr, sz int, timeout time.Duration) (int, error) {
+	if sz > p.size {
+		return 0, fmt.Errorf("LoadFrom: not enough space %d, %d",
+			sz, p.size)
+	}
+	n, err := p.loadTimeout(int(fd), timeout, func() (int, error) {
+		n, err := syscall.Splice(int(fd), nil, p.w, nil, sz, _SPLICE_F_NONBLOCK)
+		return int(n), err
+	})
+	if err != nil && err != ErrStalled {
+		err = os.NewSyscallError("Splice load from", err)
+	}
+	return n, err
+}
+
+// loadTimeout runs the non-blocking splice from src into the pipe
+// until it succeeds. If it would block, either the pipe is full, which
+// may last for the timeout, or src has no data yet, which is waited
+// for without a timeout.
+func (p *Pair) loadTimeout(src int, timeout time.Duration, splice func() (int, error)) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := splice()
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != syscall.EAGAIN {
+			return n, err
+		}
+
+		room, err := p.poll(p.w, unix.POLLOUT, 0)
+		if err != nil {
+			return 0, err
+		}
+		if room {
+			// src has no data yet; this is not a stall.
+			if _, err := p.poll(src, unix.POLLIN, -1); err != nil {
+				return 0, err
+			}
+			deadline = time.Now().Add(timeout)
+			continue
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			return 0, ErrStalled
+		}
+		if _, err := p.poll(p.w, unix.POLLOUT, int((left+time.Millisecond-1)/time.Millisecond)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// poll waits at most ms milliseconds, or indefinitely if ms is
+// negative, for events on fd, and returns whether they occurred.
+func (p *Pair) poll(fd int, events int16, ms int) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+	n, err := unix.Poll(fds, ms)
+	if err == syscall.EINTR {
+		return false, nil
+	}
+	return n > 0 && fds[0].Revents != 0, err
+}
+
 func (p *Pair) discard() {
 	_, err := syscall.Splice(p.r, nil, int(devNullFD), nil, int(p.size), _SPLICE_F_NONBLOCK)
 	if err == syscall.EAGAIN {
@@ -52,3 +137,12 @@ func (p *Pair) discard() {
 		log.Panicf("splicing into /dev/null: %v (close R %d '%v', close W %d '%v')", err, p.r, errR, p.w, errW)
 	}
 }
+
+// WriteToAt moves n bytes from the pipe into fd, at offset off.
+func (p *Pair) WriteToAt(fd uintptr, n int, off int64) (int, error) {
+	m, err := syscall.Splice(p.r, nil, int(fd), &off, n, 0)
+	if err != nil {
+		err = os.NewSyscallError("Splice write", err)
+	}
+	return int(m), err
+}
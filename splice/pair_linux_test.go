@@ -0,0 +1,84 @@
+// Copyright 2023 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package splice
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadFromTimeout(t *testing.T) {
+	p, err := Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Done(p)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := p.LoadFromTimeout(r.Fd(), 5, time.Second)
+	if err != nil || n != 5 {
+		t.Fatalf("LoadFromTimeout: got (%d, %v), want (5, nil)", n, err)
+	}
+	got := make([]byte, 5)
+	if _, err := p.Read(got); err != nil || !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf("Read: got (%q, %v)", got, err)
+	}
+
+	// Fill the pipe, so nothing more can be loaded into it.
+	if _, err := p.Write(make([]byte, p.Cap())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if n, err := p.LoadFromTimeout(r.Fd(), 5, 50*time.Millisecond); err != ErrStalled {
+		t.Fatalf("LoadFromTimeout on full pipe: got (%d, %v), want ErrStalled", n, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("LoadFromTimeout gave up after %v", d)
+	}
+}
+
+func TestLoadFromTimeoutSlowSource(t *testing.T) {
+	p, err := Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Done(p)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// A source that has no data yet is waited for, even past the
+	// timeout.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("late"))
+	}()
+	n, err := p.LoadFromTimeout(r.Fd(), 4, 10*time.Millisecond)
+	if err != nil || n != 4 {
+		t.Fatalf("LoadFromTimeout: got (%d, %v), want (4, nil)", n, err)
+	}
+	got := make([]byte, 4)
+	if _, err := p.Read(got); err != nil || string(got) != "late" {
+		t.Fatalf("Read: got (%q, %v)", got, err)
+	}
+}